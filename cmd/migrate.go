@@ -74,6 +74,24 @@ func MigrationStartupCheck(logger *zap.Logger, db *sql.DB) {
 	}
 }
 
+// MigrationStartupApply applies all pending migrations to a database the server keeps schema for itself, such as a
+// storage backend.
+func MigrationStartupApply(logger *zap.Logger, db *sql.DB) {
+	migrate.SetTable(migrationTable)
+	ms := &migrate.AssetMigrationSource{
+		Asset:    migration.Asset,
+		AssetDir: migration.AssetDir,
+	}
+
+	appliedMigrations, err := migrate.ExecMax(db, dialect, ms, migrate.Up, defaultLimit)
+	if err != nil {
+		logger.Fatal("Failed to apply migrations", zap.Int("count", appliedMigrations), zap.Error(err))
+	}
+	if appliedMigrations > 0 {
+		logger.Info("Successfully applied migration", zap.Int("count", appliedMigrations))
+	}
+}
+
 func MigrateParse(args []string, logger *zap.Logger) {
 	if len(args) == 0 {
 		logger.Fatal("Migrate requires a subcommand. Available commands are: 'up', 'down', 'redo', 'status'.")
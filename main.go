@@ -94,22 +94,61 @@ func main() {
 	// Check migration status and log if the schema has diverged.
 	cmd.MigrationStartupCheck(multiLogger, db)
 
+	if err := server.ValidateSessionDuplicatePolicy(config.GetSession().DuplicatePolicy); err != nil {
+		multiLogger.Fatal("Invalid session config.", zap.Error(err))
+	}
+
+	storageBackends := make(map[string]*sql.DB, len(config.GetStorage().Backends))
+	for name, dsn := range config.GetStorage().Backends {
+		multiLogger.Info("Storage backend connection", zap.String("backend", name), zap.String("dsn", dsn))
+		storageBackends[name] = dbConnect(multiLogger, []string{dsn})
+		// Storage backends hold no data but routed collections, so they are kept on the current schema automatically.
+		cmd.MigrationStartupApply(multiLogger, storageBackends[name])
+	}
+	storageRouter, err := server.NewStorageRouter(config.GetStorage(), storageBackends)
+	if err != nil {
+		multiLogger.Fatal("Failed initializing storage.", zap.Error(err))
+	}
+	if dsn := config.GetStorage().ReadReplica; dsn != "" {
+		multiLogger.Info("Storage read replica connection", zap.String("dsn", dsn))
+		storageRouter = storageRouter.WithReadReplica(server.NewStorageReplica(db, dbConnect(multiLogger, []string{dsn}), config.GetStorage().PrimaryAfterWriteMs))
+	}
+
 	trackerService := server.NewTrackerService(config.GetName())
-	statsService := server.NewStatsService(jsonLogger, config, semver, trackerService, startedAt)
-	matchmakerService := server.NewMatchmakerService(config.GetName())
-	sessionRegistry := server.NewSessionRegistry(jsonLogger, config, trackerService, matchmakerService)
+	matchmakerService := server.NewMatchmakerService(config.GetName(), config.GetMatchmaker())
+	sessionRegistry := server.NewSessionRegistry(jsonLogger, config, db, trackerService, matchmakerService)
+	sessionRegistry.Start()
 	messageRouter := server.NewMessageRouterService(sessionRegistry)
 	presenceNotifier := server.NewPresenceNotifier(jsonLogger, config.GetName(), trackerService, messageRouter)
 	trackerService.AddDiffListener(presenceNotifier.HandleDiff)
+	matchRegistry := server.NewMatchRegistryService(jsonLogger, config.GetName(), trackerService, messageRouter)
+	trackerService.AddDiffListener(matchRegistry.HandleDiff)
+
+	notificationService := server.NewNotificationService(jsonLogger, db, trackerService, messageRouter)
+	pushService := server.NewPushService(jsonLogger, trackerService, messageRouter, config.GetRuntime())
+	trackerService.AddDiffListener(pushService.HandleDiff)
+
+	clusterLeader := server.NewStaticClusterLeader(config.GetName(), config.GetCluster().Leader)
 
-	runtime, err := server.NewRuntime(jsonLogger, multiLogger, db, config.GetRuntime())
+	runtime, err := server.NewRuntime(jsonLogger, multiLogger, db, storageRouter, config.GetRuntime(), matchRegistry, notificationService, pushService, clusterLeader, sessionRegistry)
 	if err != nil {
 		multiLogger.Fatal("Failed initializing runtime modules.", zap.Error(err))
 	}
 
+	presenceCoalescer := server.NewRuntimePresenceCoalescer(jsonLogger, runtime, trackerService, time.Duration(config.GetRuntime().PresenceCoalesceMs)*time.Millisecond)
+	trackerService.AddDiffListener(presenceCoalescer.HandleDiff)
+
+	statsService := server.NewStatsService(jsonLogger, config, semver, trackerService, runtime, startedAt)
+
 	socialClient := social.NewClient(5 * time.Second)
-	pipeline := server.NewPipeline(config, db, trackerService, matchmakerService, messageRouter, sessionRegistry, socialClient, runtime)
-	authService := server.NewAuthenticationService(jsonLogger, config, db, statsService, sessionRegistry, socialClient, pipeline, runtime)
+	pipeline := server.NewPipeline(config, db, runtime.StorageRouter(), trackerService, matchmakerService, matchRegistry, messageRouter, sessionRegistry, socialClient, runtime, notificationService)
+	matchmakerService.Start(func(expired map[server.MatchmakerKey]*server.MatchmakerProfile) {
+		pipeline.MatchmakerExpired(jsonLogger, expired)
+	}, func(matches []map[server.MatchmakerKey]*server.MatchmakerProfile) {
+		pipeline.MatchmakerMatched(jsonLogger, matches)
+	})
+	rpcQuotaStore := server.NewLocalRpcQuotaStore(config.GetRuntime().RPCQuota, time.Minute)
+	authService := server.NewAuthenticationService(jsonLogger, config, db, statsService, sessionRegistry, socialClient, pipeline, runtime, rpcQuotaStore)
 	opsService := server.NewOpsService(jsonLogger, multiLogger, semver, config, statsService)
 
 	gaenabled := len(os.Getenv("NAKAMA_TELEMETRY")) < 1
@@ -129,7 +168,11 @@ func main() {
 
 		authService.Stop()
 		opsService.Stop()
+		matchRegistry.Stop()
+		matchmakerService.Stop()
+		notificationService.Stop()
 		trackerService.Stop()
+		presenceCoalescer.Stop()
 		runtime.Stop()
 
 		if gaenabled {
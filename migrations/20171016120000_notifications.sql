@@ -0,0 +1,33 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS notification (
+    PRIMARY KEY (user_id, id),
+    id         BYTEA        NOT NULL,
+    user_id    BYTEA        NOT NULL,
+    subject    VARCHAR(255) NOT NULL,
+    content    BYTEA        DEFAULT '{}' CHECK (length(content) < 16000) NOT NULL,
+    code       BIGINT       NOT NULL,
+    sender_id  BYTEA,
+    created_at BIGINT       CHECK (created_at > 0) NOT NULL,
+    expires_at BIGINT       CHECK (expires_at >= 0) DEFAULT 0 NOT NULL -- Never expires if 0.
+);
+CREATE INDEX IF NOT EXISTS user_id_created_at_id_idx ON notification (user_id, created_at, id);
+CREATE INDEX IF NOT EXISTS expires_at_idx ON notification (expires_at);
+
+-- +migrate Down
+DROP TABLE IF EXISTS notification;
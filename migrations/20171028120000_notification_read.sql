@@ -0,0 +1,25 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+-- +migrate Up
+ALTER TABLE IF EXISTS notification ADD COLUMN IF NOT EXISTS read_at BIGINT CHECK (read_at >= 0) DEFAULT 0 NOT NULL; -- Unread if 0.
+-- Covers inbox counts, with or without a code filter.
+CREATE INDEX IF NOT EXISTS user_id_code_read_at_expires_at_idx ON notification (user_id, code, read_at, expires_at);
+
+-- +migrate Down
+-- NOTE: not postgres compatible, it expects table.index rather than table@index.
+DROP INDEX IF EXISTS notification@user_id_code_read_at_expires_at_idx;
+ALTER TABLE IF EXISTS notification DROP COLUMN IF EXISTS read_at;
@@ -0,0 +1,28 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS unique_claim (
+    PRIMARY KEY (namespace, value),
+    namespace  VARCHAR(64)  CHECK (length(namespace) > 0) NOT NULL,
+    value      VARCHAR(255) CHECK (length(value) > 0) NOT NULL,
+    owner_id   BYTEA        NOT NULL,
+    created_at BIGINT       CHECK (created_at > 0) NOT NULL
+);
+CREATE INDEX IF NOT EXISTS owner_id_idx ON unique_claim (owner_id);
+
+-- +migrate Down
+DROP TABLE IF EXISTS unique_claim;
@@ -0,0 +1,32 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS job (
+    PRIMARY KEY (id),
+    id         BYTEA        NOT NULL,
+    queue      VARCHAR(128) NOT NULL,
+    payload    BYTEA        DEFAULT '{}' CHECK (length(payload) < 16000) NOT NULL,
+    attempts   INT          DEFAULT 0 CHECK (attempts >= 0) NOT NULL,
+    last_error VARCHAR(255) DEFAULT '' NOT NULL,
+    created_at BIGINT       CHECK (created_at > 0) NOT NULL,
+    run_at     BIGINT       CHECK (run_at > 0) NOT NULL,
+    dead_at    BIGINT       DEFAULT 0 CHECK (dead_at >= 0) NOT NULL
+);
+CREATE INDEX IF NOT EXISTS queue_dead_at_run_at_idx ON job (queue, dead_at, run_at);
+
+-- +migrate Down
+DROP TABLE IF EXISTS job;
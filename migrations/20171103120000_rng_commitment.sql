@@ -0,0 +1,34 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS rng_commitment (
+    PRIMARY KEY (id),
+    id          BYTEA        NOT NULL,
+    user_id     BYTEA        NOT NULL,
+    seed        BYTEA        NOT NULL,
+    commitment  BYTEA        NOT NULL,
+    client_seed VARCHAR(128) DEFAULT '' NOT NULL,
+    sides       BIGINT       DEFAULT 0 CHECK (sides >= 0) NOT NULL,
+    results     BYTEA        DEFAULT '[]' NOT NULL,
+    created_at  BIGINT       CHECK (created_at > 0) NOT NULL,
+    rolled_at   BIGINT       DEFAULT 0 CHECK (rolled_at >= 0) NOT NULL,
+    revealed_at BIGINT       DEFAULT 0 CHECK (revealed_at >= 0) NOT NULL
+);
+CREATE INDEX IF NOT EXISTS user_id_created_at_idx ON rng_commitment (user_id, created_at);
+
+-- +migrate Down
+DROP TABLE IF EXISTS rng_commitment;
@@ -0,0 +1,29 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS audit_log (
+    PRIMARY KEY (seq),
+    seq        BIGINT CHECK (seq > 0) NOT NULL,
+    event      BYTEA  DEFAULT '{}' NOT NULL,
+    created_at BIGINT CHECK (created_at > 0) NOT NULL,
+    prev_hash  BYTEA  NOT NULL,
+    hash       BYTEA  NOT NULL
+);
+
+-- +migrate Down
+DROP TABLE IF EXISTS audit_log;
@@ -0,0 +1,37 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS storage_change (
+    PRIMARY KEY (seq),
+    seq          BIGINT       DEFAULT unique_rowid() NOT NULL,
+    bucket       VARCHAR(128) NOT NULL,
+    collection   VARCHAR(128) NOT NULL,
+    record       VARCHAR(128) NOT NULL,
+    user_id      BYTEA        NOT NULL,
+    op           VARCHAR(8)   NOT NULL,
+    value_before BYTEA,
+    value_after  BYTEA,
+    created_at   BIGINT       CHECK (created_at > 0) NOT NULL,
+    run_at       BIGINT       CHECK (run_at > 0) NOT NULL,
+    attempts     BIGINT       DEFAULT 0 CHECK (attempts >= 0) NOT NULL
+);
+CREATE INDEX IF NOT EXISTS bucket_collection_user_id_record_seq_idx ON storage_change (bucket, collection, user_id, record, seq);
+CREATE INDEX IF NOT EXISTS run_at_idx ON storage_change (run_at);
+
+-- +migrate Down
+DROP TABLE IF EXISTS storage_change;
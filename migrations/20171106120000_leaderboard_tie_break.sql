@@ -0,0 +1,27 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+-- +migrate Up
+ALTER TABLE IF EXISTS leaderboard_record ADD COLUMN IF NOT EXISTS tie_break BIGINT DEFAULT 0 NOT NULL; -- Negated on descending leaderboards.
+CREATE INDEX IF NOT EXISTS leaderboard_id_expires_at_score_tie_break_updated_at_inverse_id_idx ON leaderboard_record (leaderboard_id, expires_at, score, tie_break, updated_at_inverse, id);
+CREATE INDEX IF NOT EXISTS leaderboard_id_expires_at_score_tie_break_updated_at_id_idx ON leaderboard_record (leaderboard_id, expires_at, score, tie_break, updated_at, id);
+
+-- +migrate Down
+-- NOTE: not postgres compatible, it expects table.index rather than table@index.
+DROP INDEX IF EXISTS leaderboard_record@leaderboard_id_expires_at_score_tie_break_updated_at_inverse_id_idx;
+DROP INDEX IF EXISTS leaderboard_record@leaderboard_id_expires_at_score_tie_break_updated_at_id_idx;
+ALTER TABLE IF EXISTS leaderboard_record DROP COLUMN IF EXISTS tie_break;
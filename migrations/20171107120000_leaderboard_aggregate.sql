@@ -0,0 +1,27 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS leaderboard_aggregate (
+    PRIMARY KEY (aggregate_id, source_id),
+    aggregate_id BYTEA NOT NULL,
+    source_id    BYTEA NOT NULL
+);
+CREATE INDEX IF NOT EXISTS source_id_idx ON leaderboard_aggregate (source_id);
+
+-- +migrate Down
+DROP TABLE IF EXISTS leaderboard_aggregate;
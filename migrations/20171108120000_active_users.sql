@@ -0,0 +1,36 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS user_activity (
+    PRIMARY KEY (day, user_id),
+    day     INT   NOT NULL, -- UTC days since the Unix epoch.
+    user_id BYTEA NOT NULL
+);
+CREATE INDEX IF NOT EXISTS user_id_idx ON user_activity (user_id);
+
+CREATE TABLE IF NOT EXISTS active_users (
+    PRIMARY KEY (period, day),
+    period     VARCHAR(8) NOT NULL, -- day, week or month.
+    day        INT        NOT NULL, -- Last day of the period.
+    count      BIGINT     DEFAULT 0 CHECK (count >= 0) NOT NULL,
+    updated_at INT        CHECK (updated_at > 0) NOT NULL
+);
+
+-- +migrate Down
+DROP TABLE IF EXISTS active_users;
+DROP TABLE IF EXISTS user_activity;
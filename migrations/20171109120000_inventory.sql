@@ -0,0 +1,31 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS inventory (
+    PRIMARY KEY (user_id, item_id),
+    user_id     BYTEA        NOT NULL,
+    item_id     VARCHAR(128) NOT NULL,
+    count       BIGINT       CHECK (count >= 0) NOT NULL,
+    unique_item BOOLEAN      DEFAULT FALSE NOT NULL,
+    metadata    BYTEA        DEFAULT '{}' CHECK (length(metadata) < 16000) NOT NULL,
+    created_at  INT          CHECK (created_at > 0) NOT NULL,
+    updated_at  INT          CHECK (updated_at > 0) NOT NULL
+);
+
+-- +migrate Down
+DROP TABLE IF EXISTS inventory;
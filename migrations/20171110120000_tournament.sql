@@ -0,0 +1,63 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS tournament (
+    PRIMARY KEY (id),
+    id         BYTEA        NOT NULL,
+    title      VARCHAR(128) NOT NULL,
+    size       INT          CHECK (size > 1) NOT NULL,
+    -- open (0), running (1), complete (2)
+    state      SMALLINT     DEFAULT 0 CHECK (state >= 0) NOT NULL,
+    round      INT          DEFAULT 0 CHECK (round >= 0) NOT NULL,
+    winner_id  BYTEA,
+    metadata   BYTEA        DEFAULT '{}' CHECK (length(metadata) < 16000) NOT NULL,
+    start_at   INT          CHECK (start_at > 0) NOT NULL,
+    end_at     INT          CHECK (end_at > start_at) NOT NULL,
+    created_at INT          CHECK (created_at > 0) NOT NULL,
+    updated_at INT          CHECK (updated_at > 0) NOT NULL
+);
+CREATE INDEX IF NOT EXISTS state_start_at_idx ON tournament (state, start_at);
+CREATE INDEX IF NOT EXISTS state_end_at_idx ON tournament (state, end_at);
+
+CREATE TABLE IF NOT EXISTS tournament_participant (
+    PRIMARY KEY (tournament_id, user_id),
+    tournament_id BYTEA        NOT NULL,
+    user_id       BYTEA        NOT NULL,
+    handle        VARCHAR(20)  NOT NULL,
+    rating        INT          DEFAULT 0 NOT NULL,
+    -- Assigned when the tournament starts, 1 is the best seed.
+    seed          INT          DEFAULT 0 CHECK (seed >= 0) NOT NULL,
+    created_at    INT          CHECK (created_at > 0) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS tournament_match (
+    PRIMARY KEY (tournament_id, round, position),
+    tournament_id BYTEA NOT NULL,
+    round         INT   CHECK (round > 0) NOT NULL,
+    position      INT   CHECK (position >= 0) NOT NULL,
+    -- Either user is NULL for a bye.
+    user_a        BYTEA,
+    user_b        BYTEA,
+    winner_id     BYTEA,
+    updated_at    INT   CHECK (updated_at > 0) NOT NULL
+);
+
+-- +migrate Down
+DROP TABLE IF EXISTS tournament_match;
+DROP TABLE IF EXISTS tournament_participant;
+DROP TABLE IF EXISTS tournament;
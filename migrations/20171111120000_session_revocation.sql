@@ -0,0 +1,33 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+-- +migrate Up
+-- Revoked session tokens (kind 0, keyed by token hash) and users whose tokens are all revoked up to an expiry
+-- (kind 1, keyed by user ID). Every node reads new rows to reject and close the sessions they cover.
+CREATE TABLE IF NOT EXISTS session_revocation (
+    PRIMARY KEY (id),
+    id         BYTEA    NOT NULL,
+    kind       SMALLINT CHECK (kind >= 0) NOT NULL,
+    user_id    BYTEA    NOT NULL,
+    expires_at BIGINT   CHECK (expires_at > 0) NOT NULL,
+    created_at BIGINT   CHECK (created_at > 0) NOT NULL
+);
+CREATE INDEX IF NOT EXISTS created_at_idx ON session_revocation (created_at);
+CREATE INDEX IF NOT EXISTS expires_at_idx ON session_revocation (expires_at);
+
+-- +migrate Down
+DROP TABLE IF EXISTS session_revocation;
@@ -0,0 +1,40 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+-- +migrate Up
+-- Audit log entries name the user they are about, so erasure can clear their events. Entries are chained over a digest
+-- of the event keyed with the audit log key, which is kept when the event itself is erased.
+ALTER TABLE IF EXISTS audit_log ADD COLUMN IF NOT EXISTS user_id BYTEA;
+ALTER TABLE IF EXISTS audit_log ADD COLUMN IF NOT EXISTS event_digest BYTEA DEFAULT '' NOT NULL;
+ALTER TABLE IF EXISTS audit_log ADD COLUMN IF NOT EXISTS erased_at BIGINT CHECK (erased_at >= 0) DEFAULT 0 NOT NULL; -- Not erased if 0.
+CREATE INDEX IF NOT EXISTS user_id_idx ON audit_log (user_id);
+-- Jobs enqueued on behalf of a user are removed with the user.
+ALTER TABLE IF EXISTS job ADD COLUMN IF NOT EXISTS user_id BYTEA;
+CREATE INDEX IF NOT EXISTS user_id_idx ON job (user_id);
+CREATE INDEX IF NOT EXISTS user_id_idx ON storage_change (user_id);
+CREATE INDEX IF NOT EXISTS user_id_idx ON tournament_participant (user_id);
+
+-- +migrate Down
+-- NOTE: not postgres compatible, it expects table.index rather than table@index.
+DROP INDEX IF EXISTS tournament_participant@user_id_idx;
+DROP INDEX IF EXISTS storage_change@user_id_idx;
+DROP INDEX IF EXISTS job@user_id_idx;
+ALTER TABLE IF EXISTS job DROP COLUMN IF EXISTS user_id;
+DROP INDEX IF EXISTS audit_log@user_id_idx;
+ALTER TABLE IF EXISTS audit_log DROP COLUMN IF EXISTS erased_at;
+ALTER TABLE IF EXISTS audit_log DROP COLUMN IF EXISTS event_digest;
+ALTER TABLE IF EXISTS audit_log DROP COLUMN IF EXISTS user_id;
@@ -0,0 +1,23 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+-- +migrate Up
+-- Time of the last decaying increment, so decay is measured from it rather than from the last write of any kind.
+ALTER TABLE IF EXISTS leaderboard_record ADD COLUMN IF NOT EXISTS decayed_at BIGINT CHECK (decayed_at >= 0) DEFAULT 0 NOT NULL; -- Never decayed if 0.
+
+-- +migrate Down
+ALTER TABLE IF EXISTS leaderboard_record DROP COLUMN IF EXISTS decayed_at;
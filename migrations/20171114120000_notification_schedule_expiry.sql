@@ -0,0 +1,23 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+-- +migrate Up
+-- Scheduled and deferred notifications keep the expiry the runtime notification function gave them.
+ALTER TABLE IF EXISTS notification_schedule ADD COLUMN IF NOT EXISTS expires_at BIGINT CHECK (expires_at >= 0) DEFAULT 0 NOT NULL; -- Never expires if 0.
+
+-- +migrate Down
+ALTER TABLE IF EXISTS notification_schedule DROP COLUMN IF EXISTS expires_at;
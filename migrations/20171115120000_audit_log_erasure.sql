@@ -0,0 +1,23 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+-- +migrate Up
+-- Erasing an entry is signed, so an erased entry cannot be forged without the audit log key.
+ALTER TABLE IF EXISTS audit_log ADD COLUMN IF NOT EXISTS erasure_hash BYTEA DEFAULT '' NOT NULL;
+
+-- +migrate Down
+ALTER TABLE IF EXISTS audit_log DROP COLUMN IF EXISTS erasure_hash;
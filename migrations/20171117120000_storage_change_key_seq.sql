@@ -0,0 +1,25 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+-- +migrate Up
+-- Changes to a record are ordered by a counter taken in the transaction that records them, since seq is not ordered
+-- by commit across nodes. Changes recorded before this migration keep key_seq 0 and fall back to seq among themselves.
+ALTER TABLE IF EXISTS storage_change ADD COLUMN IF NOT EXISTS key_seq BIGINT CHECK (key_seq >= 0) DEFAULT 0 NOT NULL;
+CREATE INDEX IF NOT EXISTS bucket_collection_user_id_record_key_seq_idx ON storage_change (bucket, collection, user_id, record, key_seq);
+
+-- +migrate Down
+DROP INDEX IF EXISTS storage_change@bucket_collection_user_id_record_key_seq_idx;
+ALTER TABLE IF EXISTS storage_change DROP COLUMN IF EXISTS key_seq;
@@ -0,0 +1,49 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+// ClusterLeader reports which node in the cluster is the leader, used to run singleton work on exactly one node.
+type ClusterLeader interface {
+	// Leader returns the name of the current leader node.
+	Leader() string
+	// IsLeader reports whether the current node is the leader.
+	IsLeader() bool
+}
+
+// StaticClusterLeader is a leader chosen through configuration, it does not change while the server is running.
+type StaticClusterLeader struct {
+	name   string
+	leader string
+}
+
+// NewStaticClusterLeader creates a cluster leader for the named node. An empty leader name makes the node its own leader,
+// which is the right choice for single node deployments.
+func NewStaticClusterLeader(name string, leader string) *StaticClusterLeader {
+	if leader == "" {
+		leader = name
+	}
+	return &StaticClusterLeader{
+		name:   name,
+		leader: leader,
+	}
+}
+
+func (s *StaticClusterLeader) Leader() string {
+	return s.leader
+}
+
+func (s *StaticClusterLeader) IsLeader() bool {
+	return s.name == s.leader
+}
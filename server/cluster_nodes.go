@@ -0,0 +1,65 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import "sort"
+
+// ClusterNodes lists the nodes in the cluster, and the address clients connect to each of them on.
+type ClusterNodes interface {
+	// Self returns the name of the current node.
+	Self() string
+	// Address returns the address of the named node, and false if it is not in the cluster.
+	Address(name string) (string, bool)
+	// Names returns the names of all nodes in the cluster, including the current node, in a stable order.
+	Names() []string
+}
+
+// StaticClusterNodes is a node list set through configuration, it does not change while the server is running.
+type StaticClusterNodes struct {
+	name      string
+	addresses map[string]string
+	names     []string
+}
+
+// NewStaticClusterNodes creates the node list for the named node. Addresses are keyed by node name, and the current
+// node is always part of the cluster even if it has no address of its own.
+func NewStaticClusterNodes(name string, addresses map[string]string) *StaticClusterNodes {
+	names := make([]string, 0, len(addresses)+1)
+	if _, ok := addresses[name]; !ok {
+		names = append(names, name)
+	}
+	for n := range addresses {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return &StaticClusterNodes{
+		name:      name,
+		addresses: addresses,
+		names:     names,
+	}
+}
+
+func (s *StaticClusterNodes) Self() string {
+	return s.name
+}
+
+func (s *StaticClusterNodes) Address(name string) (string, bool) {
+	address, ok := s.addresses[name]
+	return address, ok
+}
+
+func (s *StaticClusterNodes) Names() []string {
+	return s.names
+}
@@ -34,19 +34,27 @@ type Config interface {
 	GetDatabase() *DatabaseConfig
 	GetSocial() *SocialConfig
 	GetRuntime() *RuntimeConfig
+	GetMatchmaker() *MatchmakerConfig
+	GetCluster() *ClusterConfig
+	GetStorage() *StorageConfig
+	GetRateLimit() *RateLimitConfig
 }
 
 type config struct {
-	Name      string           `yaml:"name" json:"name"`
-	Datadir   string           `yaml:"data_dir" json:"data_dir"`
-	Port      int              `yaml:"port" json:"port"`
-	OpsPort   int              `yaml:"ops_port" json:"ops_port"`
-	Dsns      []string         `yaml:"dsns" json:"dsns"`
-	Session   *SessionConfig   `yaml:"session" json:"session"`
-	Transport *TransportConfig `yaml:"transport" json:"transport"`
-	Database  *DatabaseConfig  `yaml:"database" json:"database"`
-	Social    *SocialConfig    `yaml:"social" json:"social"`
-	Runtime   *RuntimeConfig   `yaml:"runtime" json:"runtime"`
+	Name       string            `yaml:"name" json:"name"`
+	Datadir    string            `yaml:"data_dir" json:"data_dir"`
+	Port       int               `yaml:"port" json:"port"`
+	OpsPort    int               `yaml:"ops_port" json:"ops_port"`
+	Dsns       []string          `yaml:"dsns" json:"dsns"`
+	Session    *SessionConfig    `yaml:"session" json:"session"`
+	Transport  *TransportConfig  `yaml:"transport" json:"transport"`
+	Database   *DatabaseConfig   `yaml:"database" json:"database"`
+	Social     *SocialConfig     `yaml:"social" json:"social"`
+	Runtime    *RuntimeConfig    `yaml:"runtime" json:"runtime"`
+	Matchmaker *MatchmakerConfig `yaml:"matchmaker" json:"matchmaker"`
+	Cluster    *ClusterConfig    `yaml:"cluster" json:"cluster"`
+	Storage    *StorageConfig    `yaml:"storage" json:"storage"`
+	RateLimit  *RateLimitConfig  `yaml:"rate_limit" json:"rate_limit"`
 }
 
 // NewConfig constructs a Config struct which represents server settings.
@@ -55,16 +63,20 @@ func NewConfig() *config {
 	dataDirectory := filepath.Join(cwd, "data")
 	nodeName := "nakama-" + strings.Split(uuid.NewV4().String(), "-")[3]
 	return &config{
-		Name:      nodeName,
-		Datadir:   dataDirectory,
-		Port:      7350,
-		OpsPort:   7351,
-		Dsns:      []string{"root@localhost:26257"},
-		Session:   NewSessionConfig(),
-		Transport: NewTransportConfig(),
-		Database:  NewDatabaseConfig(),
-		Social:    NewSocialConfig(),
-		Runtime:   NewRuntimeConfig(),
+		Name:       nodeName,
+		Datadir:    dataDirectory,
+		Port:       7350,
+		OpsPort:    7351,
+		Dsns:       []string{"root@localhost:26257"},
+		Session:    NewSessionConfig(),
+		Transport:  NewTransportConfig(),
+		Database:   NewDatabaseConfig(),
+		Social:     NewSocialConfig(),
+		Runtime:    NewRuntimeConfig(),
+		Matchmaker: NewMatchmakerConfig(),
+		Cluster:    NewClusterConfig(),
+		Storage:    NewStorageConfig(),
+		RateLimit:  NewRateLimitConfig(),
 	}
 }
 
@@ -108,27 +120,54 @@ func (c *config) GetRuntime() *RuntimeConfig {
 	return c.Runtime
 }
 
+func (c *config) GetMatchmaker() *MatchmakerConfig {
+	return c.Matchmaker
+}
+
+func (c *config) GetCluster() *ClusterConfig {
+	return c.Cluster
+}
+
+func (c *config) GetStorage() *StorageConfig {
+	return c.Storage
+}
+
+func (c *config) GetRateLimit() *RateLimitConfig {
+	return c.RateLimit
+}
+
 // SessionConfig is configuration relevant to the session
 type SessionConfig struct {
-	EncryptionKey string `yaml:"encryption_key" json:"encryption_key"`
-	TokenExpiryMs int64  `yaml:"token_expiry_ms" json:"token_expiry_ms"`
+	EncryptionKey         string   `yaml:"encryption_key" json:"encryption_key"`
+	TokenExpiryMs         int64    `yaml:"token_expiry_ms" json:"token_expiry_ms"`
+	SequencedMessageTypes []string `yaml:"sequenced_message_types" json:"sequenced_message_types"`
+	SequenceResume        bool     `yaml:"sequence_resume" json:"sequence_resume"`
+	// Applied when a user connects while they have sessions on the same node, sessions on other nodes are not seen.
+	DuplicatePolicy string `yaml:"duplicate_policy" json:"duplicate_policy"`
 }
 
 // NewSessionConfig creates a new SessionConfig struct
 func NewSessionConfig() *SessionConfig {
 	return &SessionConfig{
-		EncryptionKey: "defaultencryptionkey",
-		TokenExpiryMs: 60000,
+		EncryptionKey:         "defaultencryptionkey",
+		TokenExpiryMs:         60000,
+		SequencedMessageTypes: make([]string, 0),
+		SequenceResume:        false,
+		DuplicatePolicy:       SESSION_DUPLICATE_ALLOW,
 	}
 }
 
 // TransportConfig is configuration relevant to the transport socket and protocol
 type TransportConfig struct {
-	ServerKey           string `yaml:"server_key" json:"server_key"`
-	MaxMessageSizeBytes int64  `yaml:"max_message_size_bytes" json:"max_message_size_bytes"`
-	WriteWaitMs         int    `yaml:"write_wait_ms" json:"write_wait_ms"`
-	PongWaitMs          int    `yaml:"pong_wait_ms" json:"pong_wait_ms"`
-	PingPeriodMs        int    `yaml:"ping_period_ms" json:"ping_period_ms"`
+	ServerKey           string   `yaml:"server_key" json:"server_key"`
+	MaxMessageSizeBytes int64    `yaml:"max_message_size_bytes" json:"max_message_size_bytes"`
+	WriteWaitMs         int      `yaml:"write_wait_ms" json:"write_wait_ms"`
+	PongWaitMs          int      `yaml:"pong_wait_ms" json:"pong_wait_ms"`
+	PingPeriodMs        int      `yaml:"ping_period_ms" json:"ping_period_ms"`
+	CompressionEnabled  bool     `yaml:"compression_enabled" json:"compression_enabled"`
+	CompressionMinBytes int      `yaml:"compression_min_bytes" json:"compression_min_bytes"`
+	MaxSessionsPerIP    int      `yaml:"max_sessions_per_ip" json:"max_sessions_per_ip"`
+	SessionLimitExempt  []string `yaml:"session_limit_exempt" json:"session_limit_exempt"`
 }
 
 // NewTransportConfig creates a new TransportConfig struct
@@ -139,6 +178,10 @@ func NewTransportConfig() *TransportConfig {
 		WriteWaitMs:         5000,
 		PongWaitMs:          10000,
 		PingPeriodMs:        8000,
+		CompressionEnabled:  false,
+		CompressionMinBytes: 256,
+		MaxSessionsPerIP:    0,
+		SessionLimitExempt:  make([]string, 0),
 	}
 }
 
@@ -181,16 +224,172 @@ func NewSocialConfig() *SocialConfig {
 
 // RuntimeConfig is configuration relevant to the Runtime Lua VM
 type RuntimeConfig struct {
-	Environment map[string]interface{} `yaml:"env" json:"env"`
-	Path        string                 `yaml:"path" json:"path"`
-	HTTPKey     string                 `yaml:"http_key" json:"http_key"`
+	Environment        map[string]interface{} `yaml:"env" json:"env"`
+	Path               string                 `yaml:"path" json:"path"`
+	HTTPKey            string                 `yaml:"http_key" json:"http_key"`
+	RPCQuota           int                    `yaml:"rpc_quota" json:"rpc_quota"`
+	RPCAPIKeys         map[string]string      `yaml:"rpc_api_keys" json:"rpc_api_keys"`
+	DeterministicSeed  int64                  `yaml:"deterministic_seed" json:"deterministic_seed"`
+	DeterministicTime  int64                  `yaml:"deterministic_time" json:"deterministic_time"`
+	MetricsTagLimit    int                    `yaml:"metrics_tag_limit" json:"metrics_tag_limit"`
+	ShutdownTimeoutMs  int64                  `yaml:"shutdown_timeout_ms" json:"shutdown_timeout_ms"`
+	ConversionMaxDepth int                    `yaml:"conversion_max_depth" json:"conversion_max_depth"`
+	RedactionRules     []*RedactionRuleConfig `yaml:"redaction_rules" json:"redaction_rules"`
+	PresenceCoalesceMs int64                  `yaml:"presence_coalesce_ms" json:"presence_coalesce_ms"`
+	EvalTimeoutMs      int64                  `yaml:"eval_timeout_ms" json:"eval_timeout_ms"`
+	EvalInstructionCap int64                  `yaml:"eval_instruction_cap" json:"eval_instruction_cap"`
+	PushBufferSize     int                    `yaml:"push_buffer_size" json:"push_buffer_size"`
+	PushBufferExpiryMs int64                  `yaml:"push_buffer_expiry_ms" json:"push_buffer_expiry_ms"`
+	TraceEndpoint      string                 `yaml:"trace_endpoint" json:"trace_endpoint"`
+	GeoIPPath          string                 `yaml:"geoip_path" json:"geoip_path"`
+	Erasure            map[string]string      `yaml:"erasure" json:"erasure"`
+	AuditLogKey        string                 `yaml:"audit_log_key" json:"audit_log_key"`
+	ActiveUsersRollup  string                 `yaml:"active_users_rollup" json:"active_users_rollup"`
+}
+
+// RedactionRuleConfig removes the field at a path from payloads handed to external after functions, or replaces it
+// with the mask if one is set
+type RedactionRuleConfig struct {
+	Path string `yaml:"path" json:"path"`
+	Mask string `yaml:"mask" json:"mask"`
 }
 
+// DefaultAuditLogKey is the audit log key used when none is configured. Anyone who knows it can forge audit log
+// entries, so a warning is logged at startup while it is in use.
+const DefaultAuditLogKey = "defaultauditlogkey"
+
 // NewRuntimeConfig creates a new RuntimeConfig struct
 func NewRuntimeConfig() *RuntimeConfig {
 	return &RuntimeConfig{
-		Environment: make(map[string]interface{}),
-		Path:        "",
-		HTTPKey:     "defaultkey",
+		Environment:        make(map[string]interface{}),
+		Path:               "",
+		HTTPKey:            "defaultkey",
+		RPCQuota:           0,
+		RPCAPIKeys:         make(map[string]string),
+		DeterministicSeed:  0,
+		DeterministicTime:  0,
+		MetricsTagLimit:    100,
+		ShutdownTimeoutMs:  5000,
+		ConversionMaxDepth: 64,
+		RedactionRules:     make([]*RedactionRuleConfig, 0),
+		PresenceCoalesceMs: 1000,
+		EvalTimeoutMs:      100,
+		EvalInstructionCap: 1000000,
+		PushBufferSize:     32,
+		PushBufferExpiryMs: 60000,
+		TraceEndpoint:      "",
+		GeoIPPath:          "",
+		Erasure: map[string]string{
+			"account":             USER_ERASURE_DELETE,
+			"messages":            USER_ERASURE_ANONYMIZE,
+			"leaderboard_records": USER_ERASURE_DELETE,
+			"purchases":           USER_ERASURE_ANONYMIZE,
+		},
+		AuditLogKey:       DefaultAuditLogKey,
+		ActiveUsersRollup: "0 * * * *",
+	}
+}
+
+// MatchmakerConfig is configuration relevant to matchmaking
+type MatchmakerConfig struct {
+	TicketTimeoutMs int64 `yaml:"ticket_timeout_ms" json:"ticket_timeout_ms"`
+	// Longest a ticket may wait whatever timeout the client or a before hook asks for, 0 for no limit.
+	MaxTicketTimeoutMs int64                            `yaml:"max_ticket_timeout_ms" json:"max_ticket_timeout_ms"`
+	Pools              map[string]*MatchmakerPoolConfig `yaml:"pools" json:"pools"`
+	// Most matches a user can be in at once across all their sessions, 0 for no limit.
+	MaxUserMatches int `yaml:"max_user_matches" json:"max_user_matches"`
+	// Whether clients may create authoritative matches without a runtime match create function to vet them.
+	ClientMatchCreate bool `yaml:"client_match_create" json:"client_match_create"`
+	// Most authoritative matches created by clients that may run on this node at once, 0 for no limit.
+	MaxClientMatches int `yaml:"max_client_matches" json:"max_client_matches"`
+}
+
+// MatchmakerPoolConfig is configuration for a named matchmaker pool, tickets waiting longer than the promotion delay
+// in this pool are matched in the pool they are promoted to instead
+type MatchmakerPoolConfig struct {
+	PromoteAfterMs int64  `yaml:"promote_after_ms" json:"promote_after_ms"`
+	PromoteTo      string `yaml:"promote_to" json:"promote_to"`
+}
+
+// NewMatchmakerConfig creates a new MatchmakerConfig struct
+func NewMatchmakerConfig() *MatchmakerConfig {
+	return &MatchmakerConfig{
+		TicketTimeoutMs:    0,
+		MaxTicketTimeoutMs: 600000,
+		Pools:              make(map[string]*MatchmakerPoolConfig),
+		MaxUserMatches:     0,
+		ClientMatchCreate:  false,
+		MaxClientMatches:   100,
+	}
+}
+
+// ClusterConfig is configuration relevant to running several nodes together
+type ClusterConfig struct {
+	Leader string            `yaml:"leader" json:"leader"`
+	Nodes  map[string]string `yaml:"nodes" json:"nodes"`
+}
+
+// NewClusterConfig creates a new ClusterConfig struct
+func NewClusterConfig() *ClusterConfig {
+	return &ClusterConfig{
+		Leader: "",
+		Nodes:  make(map[string]string),
+	}
+}
+
+// StorageConfig is configuration relevant to storage
+type StorageConfig struct {
+	IdempotencyKeyTtlMs   int64                                `yaml:"idempotency_key_ttl_ms" json:"idempotency_key_ttl_ms"`
+	EncryptionKeys        []string                             `yaml:"encryption_keys" json:"encryption_keys"`
+	EncryptedCollections  []string                             `yaml:"encrypted_collections" json:"encrypted_collections"`
+	CollectionPermissions map[string]*StoragePermissionsConfig `yaml:"collection_permissions" json:"collection_permissions"`
+	Backends              map[string]string                    `yaml:"backends" json:"backends"`
+	CollectionBackends    map[string]string                    `yaml:"collection_backends" json:"collection_backends"`
+	ReadReplica           string                               `yaml:"read_replica" json:"read_replica"`
+	PrimaryAfterWriteMs   int64                                `yaml:"primary_after_write_ms" json:"primary_after_write_ms"`
+}
+
+// NewStorageConfig creates a new StorageConfig struct
+func NewStorageConfig() *StorageConfig {
+	return &StorageConfig{
+		IdempotencyKeyTtlMs:   86400000,
+		EncryptionKeys:        make([]string, 0),
+		EncryptedCollections:  make([]string, 0),
+		CollectionPermissions: make(map[string]*StoragePermissionsConfig),
+		Backends:              make(map[string]string),
+		CollectionBackends:    make(map[string]string),
+		PrimaryAfterWriteMs:   5000,
+	}
+}
+
+// StoragePermissionsConfig is the read and write permissions forced on all writes to a storage collection
+type StoragePermissionsConfig struct {
+	Read  int64 `yaml:"read" json:"read"`
+	Write int64 `yaml:"write" json:"write"`
+}
+
+// RateLimitConfig is configuration relevant to limiting the messages each session may send
+type RateLimitConfig struct {
+	DefaultTier string                          `yaml:"default_tier" json:"default_tier"`
+	Tiers       map[string]*RateLimitTierConfig `yaml:"tiers" json:"tiers"`
+}
+
+// RateLimitTierConfig limits how many messages a session may send per minute, in total and per message type.
+// A limit of 0 means unlimited.
+type RateLimitTierConfig struct {
+	MessagesPerMinute int            `yaml:"messages_per_minute" json:"messages_per_minute"`
+	MessageTypes      map[string]int `yaml:"message_types" json:"message_types"`
+}
+
+// NewRateLimitConfig creates a new RateLimitConfig struct
+func NewRateLimitConfig() *RateLimitConfig {
+	return &RateLimitConfig{
+		DefaultTier: "default",
+		Tiers: map[string]*RateLimitTierConfig{
+			"default": &RateLimitTierConfig{
+				MessagesPerMinute: 0,
+				MessageTypes:      make(map[string]int),
+			},
+		},
 	}
 }
@@ -0,0 +1,183 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gorhill/cronexpr"
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+const (
+	ACTIVE_USERS_DAY   = "day"
+	ACTIVE_USERS_WEEK  = "week"
+	ACTIVE_USERS_MONTH = "month"
+
+	activeUsersDayMs = int64(24 * time.Hour / time.Millisecond)
+	// Activity older than the longest window is not needed by any rollup.
+	activeUsersRetentionDays = 30
+)
+
+// activeUsersWindows is how many days, up to and including the rolled up day, each window covers.
+var activeUsersWindows = map[string]int64{
+	ACTIVE_USERS_DAY:   1,
+	ACTIVE_USERS_WEEK:  7,
+	ACTIVE_USERS_MONTH: activeUsersRetentionDays,
+}
+
+// ErrActiveUsersWindow is returned when active users are asked for an unknown window.
+var ErrActiveUsersWindow = errors.New("Active users window must be 'day', 'week' or 'month'")
+
+// ActiveUsers records which users connect on each UTC day, and rolls the records up into daily, weekly and monthly
+// active user counts on a schedule. A user is recorded at most once per day however many sessions and nodes they
+// connect to, so counts never double count. Only the cluster leader runs rollups.
+type ActiveUsers struct {
+	sync.Mutex
+	logger *zap.Logger
+	db     *sql.DB
+	leader ClusterLeader
+	expr   *cronexpr.Expression
+	// Users already recorded today by this node, so reconnects do not write again.
+	day      int64
+	recorded map[uuid.UUID]bool
+	stopCh   chan bool
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// NewActiveUsers creates an active users recorder that rolls up on the given cron schedule once started, an empty
+// schedule disables rollups.
+func NewActiveUsers(logger *zap.Logger, db *sql.DB, leader ClusterLeader, schedule string) (*ActiveUsers, error) {
+	a := &ActiveUsers{
+		logger:   logger,
+		db:       db,
+		leader:   leader,
+		recorded: make(map[uuid.UUID]bool),
+		stopCh:   make(chan bool),
+	}
+	if schedule != "" {
+		expr, err := cronexpr.Parse(schedule)
+		if err != nil {
+			return nil, err
+		}
+		a.expr = expr
+	}
+	return a, nil
+}
+
+// Start runs rollups on the schedule until stopped.
+func (a *ActiveUsers) Start() {
+	if a.expr == nil {
+		return
+	}
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		for {
+			timer := time.NewTimer(a.expr.Next(time.Now()).Sub(time.Now()))
+			select {
+			case <-a.stopCh:
+				timer.Stop()
+				return
+			case <-timer.C:
+				if a.leader.IsLeader() {
+					a.Rollup()
+				}
+			}
+		}
+	}()
+}
+
+// Stop ends rollups once the rollup in progress is done.
+func (a *ActiveUsers) Stop() {
+	a.stopOnce.Do(func() {
+		close(a.stopCh)
+	})
+	a.wg.Wait()
+}
+
+// Record notes that the user was active today.
+func (a *ActiveUsers) Record(userID uuid.UUID) {
+	day := nowMs() / activeUsersDayMs
+	a.Lock()
+	if a.day != day {
+		a.day = day
+		a.recorded = make(map[uuid.UUID]bool)
+	}
+	if a.recorded[userID] {
+		a.Unlock()
+		return
+	}
+	a.recorded[userID] = true
+	a.Unlock()
+
+	if _, err := a.db.Exec("UPSERT INTO user_activity (day, user_id) VALUES ($1, $2)", day, userID.Bytes()); err != nil {
+		a.logger.Warn("Could not record user activity", zap.Error(err))
+		a.Lock()
+		delete(a.recorded, userID)
+		a.Unlock()
+	}
+}
+
+// Rollup counts the active users of every window ending yesterday and today, and drops activity no window needs any
+// more. Yesterday is counted again so activity recorded just before midnight is not missed.
+func (a *ActiveUsers) Rollup() error {
+	today := nowMs() / activeUsersDayMs
+	updatedAt := nowMs()
+	for _, day := range []int64{today - 1, today} {
+		for window, days := range activeUsersWindows {
+			var count int64
+			err := a.db.QueryRow("SELECT count(DISTINCT user_id) FROM user_activity WHERE day > $1 AND day <= $2", day-days, day).Scan(&count)
+			if err != nil {
+				a.logger.Error("Could not count active users", zap.String("window", window), zap.Error(err))
+				return err
+			}
+			_, err = a.db.Exec("UPSERT INTO active_users (period, day, count, updated_at) VALUES ($1, $2, $3, $4)", window, day, count, updatedAt)
+			if err != nil {
+				a.logger.Error("Could not store active users", zap.String("window", window), zap.Error(err))
+				return err
+			}
+		}
+	}
+
+	if _, err := a.db.Exec("DELETE FROM user_activity WHERE day <= $1", today-activeUsersRetentionDays-1); err != nil {
+		a.logger.Error("Could not drop old user activity", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// Count returns the latest rolled up count of active users for a window, and the UTC day it was counted for as days
+// since the Unix epoch. The latest day is usually today, counted up to the last rollup. Both are 0 if there has been no
+// rollup yet.
+func (a *ActiveUsers) Count(window string) (int64, int64, error) {
+	if _, ok := activeUsersWindows[window]; !ok {
+		return 0, 0, ErrActiveUsersWindow
+	}
+
+	var day, count int64
+	err := a.db.QueryRow("SELECT day, count FROM active_users WHERE period = $1 ORDER BY day DESC LIMIT 1", window).Scan(&day, &count)
+	if err == sql.ErrNoRows {
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+	return count, day, nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	assetURLCacheMaxEntries = 10000
+	// Cached signed URLs are replaced this long before they expire, so clients are never handed one about to lapse.
+	assetURLCacheMargin = 10 * time.Second
+)
+
+// AssetURLCache keeps signed asset URLs by the stored reference they were signed for, until shortly before they expire.
+type AssetURLCache struct {
+	sync.Mutex
+	entries map[string]*assetURLCacheEntry
+}
+
+type assetURLCacheEntry struct {
+	url       string
+	expiresAt time.Time
+}
+
+func NewAssetURLCache() *AssetURLCache {
+	return &AssetURLCache{
+		entries: make(map[string]*assetURLCacheEntry),
+	}
+}
+
+// Get returns the signed URL cached for the reference, if it is still valid.
+func (c *AssetURLCache) Get(reference string) (string, bool) {
+	c.Lock()
+	defer c.Unlock()
+	entry, ok := c.entries[reference]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(entry.expiresAt) {
+		delete(c.entries, reference)
+		return "", false
+	}
+	return entry.url, true
+}
+
+// Set caches the signed URL for the reference for as long as it stays valid.
+func (c *AssetURLCache) Set(reference, url string, validity time.Duration) {
+	if validity <= assetURLCacheMargin {
+		return
+	}
+	c.Lock()
+	// Start over rather than grow without bound, signatures are cheap to redo.
+	if len(c.entries) >= assetURLCacheMaxEntries {
+		c.entries = make(map[string]*assetURLCacheEntry)
+	}
+	c.entries[reference] = &assetURLCacheEntry{url: url, expiresAt: time.Now().Add(validity - assetURLCacheMargin)}
+	c.Unlock()
+}
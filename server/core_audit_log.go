@@ -0,0 +1,199 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"sync"
+
+	"github.com/lib/pq"
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+// AuditLogService appends to, erases from and verifies the audit log, signing entries with its key.
+type AuditLogService struct {
+	// Serialises appends through this service so they do not race for the same sequence number. Appends from other
+	// services or nodes are caught by the sequence number being the primary key, and the losing append runs again on the
+	// new head.
+	sync.Mutex
+	logger *zap.Logger
+	db     *sql.DB
+	key    []byte
+}
+
+// NewAuditLogService creates an audit log service that signs and verifies entries with the given key.
+func NewAuditLogService(logger *zap.Logger, db *sql.DB, key []byte) *AuditLogService {
+	return &AuditLogService{
+		logger: logger,
+		db:     db,
+		key:    key,
+	}
+}
+
+// Append appends an event about a user, or about no user if the ID is nil, to the audit log and returns its sequence
+// number. Each entry is signed with an HMAC-SHA256 of its sequence number, time, event digest and the previous entry's
+// hash, so changing, removing or reordering entries breaks the chain from that point on. The event digest is itself an
+// HMAC-SHA256 of the event, so erasing a user's events keeps the chain intact without the kept digests confirming what
+// the erased events said to anyone without the key.
+func (a *AuditLogService) Append(userID uuid.UUID, event []byte) (int64, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	var owner interface{}
+	if userID != uuid.Nil {
+		owner = userID.Bytes()
+	}
+	digest := auditLogDigest(a.key, event)
+
+	var seq int64
+	err := retryTx(a.logger, a.db, func(tx *sql.Tx) error {
+		var prevHash []byte
+		seq = 0
+		err := tx.QueryRow("SELECT seq, hash FROM audit_log ORDER BY seq DESC LIMIT 1").Scan(&seq, &prevHash)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		seq++
+		if prevHash == nil {
+			prevHash = []byte{}
+		}
+
+		createdAt := nowMs()
+		hash := auditLogHash(a.key, seq, createdAt, digest, prevHash)
+		_, err = tx.Exec("INSERT INTO audit_log (seq, user_id, event, event_digest, created_at, prev_hash, hash) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+			seq, owner, event, digest, createdAt, prevHash, hash)
+		if e, ok := err.(*pq.Error); ok && e.Code == "23505" {
+			// Another node appended the same sequence number first.
+			return errTxConflict
+		}
+		return err
+	})
+	if err != nil {
+		a.logger.Error("Could not append to audit log", zap.Error(err))
+		return 0, err
+	}
+	return seq, nil
+}
+
+// Erase erases the events of a user's audit log entries in the transaction, keeping the entries in the chain. Each
+// erasure is signed with an HMAC-SHA256 of the entry's sequence number, hash and erasure time, so an entry can only be
+// passed off as erased by someone holding the key.
+func (a *AuditLogService) Erase(tx *sql.Tx, userID []byte, erasedAt int64) error {
+	rows, err := tx.Query("SELECT seq, hash FROM audit_log WHERE user_id = $1", userID)
+	if err != nil {
+		return err
+	}
+	seqs := make([]int64, 0)
+	hashes := make([][]byte, 0)
+	for rows.Next() {
+		var seq int64
+		var hash []byte
+		if err = rows.Scan(&seq, &hash); err != nil {
+			rows.Close()
+			return err
+		}
+		seqs = append(seqs, seq)
+		hashes = append(hashes, hash)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for i, seq := range seqs {
+		_, err = tx.Exec("UPDATE audit_log SET event = '{}', user_id = NULL, erased_at = $2, erasure_hash = $3 WHERE seq = $1",
+			seq, erasedAt, auditLogErasureHash(a.key, seq, erasedAt, hashes[i]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Verify walks the audit log from the first entry and returns the sequence number of the first entry that does not
+// follow on from the one before it, or 0 if the whole chain is intact. Erased entries must have an empty event, no user
+// and a valid erasure signature. Entries removed from the end of the log leave an intact chain, keep the last sequence
+// number elsewhere to detect truncation.
+func (a *AuditLogService) Verify() (int64, error) {
+	rows, err := a.db.Query("SELECT seq, user_id, event, event_digest, erased_at, erasure_hash, created_at, prev_hash, hash FROM audit_log ORDER BY seq ASC")
+	if err != nil {
+		a.logger.Error("Could not read audit log", zap.Error(err))
+		return 0, err
+	}
+	defer rows.Close()
+
+	var expectedSeq int64 = 1
+	expectedPrevHash := []byte{}
+	for rows.Next() {
+		var seq, erasedAt, createdAt int64
+		var userID, event, digest, erasureHash, prevHash, hash []byte
+		if err = rows.Scan(&seq, &userID, &event, &digest, &erasedAt, &erasureHash, &createdAt, &prevHash, &hash); err != nil {
+			a.logger.Error("Could not scan audit log", zap.Error(err))
+			return 0, err
+		}
+		// Events that were not erased must still match the digest they were signed with.
+		if erasedAt == 0 {
+			if !hmac.Equal(auditLogDigest(a.key, event), digest) {
+				return seq, nil
+			}
+		} else if string(event) != "{}" || userID != nil || !hmac.Equal(erasureHash, auditLogErasureHash(a.key, seq, erasedAt, hash)) {
+			return seq, nil
+		}
+		// A gap in the sequence means entries were removed, the entry after the gap is the first broken link.
+		if seq != expectedSeq || !hmac.Equal(prevHash, expectedPrevHash) || !hmac.Equal(hash, auditLogHash(a.key, seq, createdAt, digest, prevHash)) {
+			return seq, nil
+		}
+		expectedSeq = seq + 1
+		expectedPrevHash = hash
+	}
+	if err = rows.Err(); err != nil {
+		a.logger.Error("Could not read audit log", zap.Error(err))
+		return 0, err
+	}
+	return 0, nil
+}
+
+func auditLogDigest(key []byte, event []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("event"))
+	mac.Write(event)
+	return mac.Sum(nil)
+}
+
+func auditLogHash(key []byte, seq, createdAt int64, digest, prevHash []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(seq))
+	binary.BigEndian.PutUint64(b[8:], uint64(createdAt))
+	mac.Write(prevHash)
+	mac.Write(b[:])
+	mac.Write(digest)
+	return mac.Sum(nil)
+}
+
+func auditLogErasureHash(key []byte, seq, erasedAt int64, hash []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(seq))
+	binary.BigEndian.PutUint64(b[8:], uint64(erasedAt))
+	mac.Write([]byte("erased"))
+	mac.Write(hash)
+	mac.Write(b[:])
+	return mac.Sum(nil)
+}
@@ -0,0 +1,61 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// CooldownCheck starts a cooldown for a user's action if the action is ready, and otherwise returns how long is left
+// until it is. The check and the start are a single statement, so of several concurrent checks within one cooldown
+// exactly one finds the action ready.
+func CooldownCheck(logger *zap.Logger, db *sql.DB, userID []byte, action string, cooldown time.Duration) (time.Duration, error) {
+	if action == "" || len(action) > 128 {
+		return 0, errors.New("Cooldown action must be set and at most 128 characters")
+	}
+	if cooldown <= 0 {
+		return 0, errors.New("Cooldown must be greater than 0")
+	}
+
+	ts := nowMs()
+	readyAt := ts + int64(cooldown/time.Millisecond)
+	err := db.QueryRow(`
+INSERT INTO cooldown (user_id, action, ready_at)
+VALUES ($1, $2, $3)
+ON CONFLICT (user_id, action) DO UPDATE SET ready_at = $3 WHERE cooldown.ready_at <= $4
+RETURNING ready_at`, userID, action, readyAt, ts).Scan(&readyAt)
+	if err == nil {
+		return 0, nil
+	} else if err != sql.ErrNoRows {
+		logger.Error("Could not check cooldown", zap.Error(err))
+		return 0, err
+	}
+
+	// The action is still cooling down, look up when it is ready.
+	if err = db.QueryRow("SELECT ready_at FROM cooldown WHERE user_id = $1 AND action = $2", userID, action).Scan(&readyAt); err != nil {
+		logger.Error("Could not look up cooldown", zap.Error(err))
+		return 0, err
+	}
+	remaining := time.Duration(readyAt-ts) * time.Millisecond
+	if remaining <= 0 {
+		// Never report a refused check as ready.
+		remaining = time.Millisecond
+	}
+	return remaining, nil
+}
@@ -15,12 +15,20 @@
 package server
 
 import (
+	"bytes"
 	"database/sql"
+	"encoding/gob"
 	"errors"
+	"strconv"
 
+	"github.com/satori/go.uuid"
 	"go.uber.org/zap"
 )
 
+type friendsListCursor struct {
+	UserID []byte
+}
+
 func friendAdd(logger *zap.Logger, db *sql.DB, userID []byte, friendID []byte) error {
 	tx, txErr := db.Begin()
 	if txErr != nil {
@@ -94,12 +102,60 @@ OR source_id = $3`,
 	return nil
 }
 
-func friendAddHandle(logger *zap.Logger, db *sql.DB, userID []byte, friendHandle string) error {
+func friendIDByHandle(db *sql.DB, friendHandle string) ([]byte, error) {
 	var friendIdBytes []byte
 	err := db.QueryRow("SELECT id FROM users WHERE handle = $1", friendHandle).Scan(&friendIdBytes)
+	return friendIdBytes, err
+}
+
+// FriendsList returns a page of the user's friends, ordered by user ID. Invites and blocked users are not included.
+func FriendsList(logger *zap.Logger, db *sql.DB, userID uuid.UUID, limit int64, cursor []byte) ([]*User, []byte, error) {
+	filterQuery := "WHERE users.id IN (SELECT destination_id FROM user_edge WHERE source_id = $1 AND state = 0)"
+	return friendsPage(logger, db, filterQuery, []interface{}{userID.Bytes()}, limit, cursor)
+}
+
+// FriendsMutual returns a page of the users who are friends with both given users, ordered by user ID.
+func FriendsMutual(logger *zap.Logger, db *sql.DB, userID uuid.UUID, otherUserID uuid.UUID, limit int64, cursor []byte) ([]*User, []byte, error) {
+	filterQuery := `WHERE users.id IN (
+SELECT a.destination_id FROM user_edge a, user_edge b
+WHERE a.source_id = $1 AND b.source_id = $2 AND a.destination_id = b.destination_id AND a.state = 0 AND b.state = 0)`
+	return friendsPage(logger, db, filterQuery, []interface{}{userID.Bytes(), otherUserID.Bytes()}, limit, cursor)
+}
+
+func friendsPage(logger *zap.Logger, db *sql.DB, filterQuery string, params []interface{}, limit int64, cursor []byte) ([]*User, []byte, error) {
+	if limit == 0 {
+		limit = 100
+	} else if limit < 10 || limit > 1000 {
+		return nil, nil, errors.New("Limit must be between 10 and 1000")
+	}
+
+	if len(cursor) != 0 {
+		incomingCursor := &friendsListCursor{}
+		if err := gob.NewDecoder(bytes.NewReader(cursor)).Decode(incomingCursor); err != nil {
+			return nil, nil, errors.New("Invalid cursor data")
+		}
+		params = append(params, incomingCursor.UserID)
+		filterQuery += " AND users.id > $" + strconv.Itoa(len(params))
+	}
+	// Select one extra row to find out if there is another page.
+	params = append(params, limit+1)
+	filterQuery += " ORDER BY users.id LIMIT $" + strconv.Itoa(len(params))
+
+	users, err := querySocialGraph(logger, db, filterQuery, params)
 	if err != nil {
-		return err
+		return nil, nil, errors.New("Could not retrieve friends")
+	}
+
+	var outgoingCursor []byte
+	if int64(len(users)) > limit {
+		users = users[:limit]
+		cursorBuf := new(bytes.Buffer)
+		if err := gob.NewEncoder(cursorBuf).Encode(&friendsListCursor{UserID: users[limit-1].Id}); err != nil {
+			logger.Error("Could not create friends list cursor", zap.Error(err))
+			return nil, nil, err
+		}
+		outgoingCursor = cursorBuf.Bytes()
 	}
 
-	return friendAdd(logger, db, userID, friendIdBytes)
+	return users, outgoingCursor, nil
 }
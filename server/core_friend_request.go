@@ -0,0 +1,61 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+const (
+	FRIEND_REQUEST_ALLOW  = "allow"
+	FRIEND_REQUEST_REJECT = "reject"
+	FRIEND_REQUEST_DROP   = "drop"
+
+	friendRequestWindowMs = int64(time.Hour / time.Millisecond)
+)
+
+// FriendRequestCounter counts the friend requests each user received on this node in the current window, so spam
+// checks know a target's incoming request rate without querying the database. Counts reset when the window ends.
+type FriendRequestCounter struct {
+	sync.Mutex
+	windowMs    int64
+	windowStart int64
+	counts      map[uuid.UUID]int64
+}
+
+// NewFriendRequestCounter creates a counter with windows of the given length.
+func NewFriendRequestCounter(windowMs int64) *FriendRequestCounter {
+	return &FriendRequestCounter{
+		windowMs: windowMs,
+		counts:   make(map[uuid.UUID]int64),
+	}
+}
+
+// Add counts a request to the user, and returns how many they received in the window before it.
+func (c *FriendRequestCounter) Add(userID uuid.UUID) int64 {
+	ts := nowMs()
+	c.Lock()
+	defer c.Unlock()
+	if ts-c.windowStart >= c.windowMs {
+		c.windowStart = ts - ts%c.windowMs
+		c.counts = make(map[uuid.UUID]int64)
+	}
+	count := c.counts[userID]
+	c.counts[userID] = count + 1
+	return count
+}
@@ -0,0 +1,108 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+)
+
+// GeoIPRecord is where an IP address is located.
+type GeoIPRecord struct {
+	Country   string
+	Region    string
+	Latitude  float64
+	Longitude float64
+}
+
+// GeoIPDatabase locates IP addresses. It returns nil for addresses it has no record of.
+type GeoIPDatabase interface {
+	Lookup(ip net.IP) *GeoIPRecord
+}
+
+// CSVGeoIPDatabase is a GeoIP database read from a CSV file with one network per line, as
+// "network,country,region,latitude,longitude" with the network in CIDR notation. Addresses resolve to the most
+// specific network that contains them.
+type CSVGeoIPDatabase struct {
+	// Networks by prefix length, keyed by the masked network address.
+	networks [net.IPv6len*8 + 1]map[string]*GeoIPRecord
+}
+
+// NewCSVGeoIPDatabase loads a CSV GeoIP database from a file.
+func NewCSVGeoIPDatabase(path string) (*CSVGeoIPDatabase, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	db := &CSVGeoIPDatabase{}
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	for line := 1; ; line++ {
+		fields, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("geoip database line %v must have at least a network, country and region", line)
+		}
+		_, network, err := net.ParseCIDR(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("geoip database line %v has an invalid network: %v", line, err)
+		}
+		record := &GeoIPRecord{Country: fields[1], Region: fields[2]}
+		if len(fields) >= 5 {
+			if record.Latitude, err = strconv.ParseFloat(fields[3], 64); err != nil {
+				return nil, fmt.Errorf("geoip database line %v has an invalid latitude", line)
+			}
+			if record.Longitude, err = strconv.ParseFloat(fields[4], 64); err != nil {
+				return nil, fmt.Errorf("geoip database line %v has an invalid longitude", line)
+			}
+		}
+
+		ones, _ := network.Mask.Size()
+		ones += (net.IPv6len - len(network.IP)) * 8
+		if db.networks[ones] == nil {
+			db.networks[ones] = make(map[string]*GeoIPRecord)
+		}
+		db.networks[ones][string(network.IP.To16())] = record
+	}
+	return db, nil
+}
+
+// Lookup returns the record of the most specific network containing the address.
+func (db *CSVGeoIPDatabase) Lookup(ip net.IP) *GeoIPRecord {
+	ip = ip.To16()
+	if ip == nil {
+		return nil
+	}
+	for ones := len(db.networks) - 1; ones >= 0; ones-- {
+		if db.networks[ones] == nil {
+			continue
+		}
+		masked := ip.Mask(net.CIDRMask(ones, net.IPv6len*8))
+		if record, ok := db.networks[ones][string(masked)]; ok {
+			return record
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+)
+
+// Group metadata key holding the maximum member count for that group. Only runtime before hooks on group create or
+// update may set it, clients cannot.
+const groupMetadataMaxCount = "max_count"
+
+// ErrGroupFull is returned when a join or add would take a group past the member limit in its metadata.
+var ErrGroupFull = errors.New("Group is full")
+
+// GroupMetadataStripMaxCount removes the member limit from client supplied group metadata. Metadata that is not a JSON
+// object is returned unchanged, it is rejected later.
+func GroupMetadataStripMaxCount(metadata []byte) []byte {
+	var m map[string]interface{}
+	if len(metadata) == 0 || json.Unmarshal(metadata, &m) != nil {
+		return metadata
+	}
+	if _, ok := m[groupMetadataMaxCount]; !ok {
+		return metadata
+	}
+	delete(m, groupMetadataMaxCount)
+	stripped, err := json.Marshal(m)
+	if err != nil {
+		return metadata
+	}
+	return stripped
+}
+
+// GroupMetadataKeepMaxCount carries the member limit from the stored metadata over to updated metadata that does not
+// set one, so replacing or removing a group's metadata does not remove its limit.
+func GroupMetadataKeepMaxCount(metadata []byte, stored []byte) ([]byte, error) {
+	maxCount := groupMaxCount(stored)
+	if maxCount == 0 {
+		return metadata, nil
+	}
+	m := make(map[string]interface{})
+	if len(metadata) != 0 {
+		if err := json.Unmarshal(metadata, &m); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := m[groupMetadataMaxCount]; ok {
+		return metadata, nil
+	}
+	m[groupMetadataMaxCount] = maxCount
+	return json.Marshal(m)
+}
+
+// GroupCheckCapacity returns the state of a group, or ErrGroupFull if it has no room for another member.
+func GroupCheckCapacity(tx *sql.Tx, groupID []byte) (int64, error) {
+	var state sql.NullInt64
+	var count sql.NullInt64
+	var metadata []byte
+	if err := tx.QueryRow("SELECT state, count, metadata FROM groups WHERE id = $1 AND disabled_at = 0", groupID).Scan(&state, &count, &metadata); err != nil {
+		return 0, err
+	}
+	if maxCount := groupMaxCount(metadata); maxCount > 0 && count.Int64 >= maxCount {
+		return state.Int64, ErrGroupFull
+	}
+	return state.Int64, nil
+}
+
+// groupMaxCount returns the member limit stored in group metadata, or 0 if the group has no limit.
+func groupMaxCount(metadata []byte) int64 {
+	var m map[string]interface{}
+	if len(metadata) == 0 || json.Unmarshal(metadata, &m) != nil {
+		return 0
+	}
+	if maxCount, ok := m[groupMetadataMaxCount].(float64); ok && maxCount > 0 {
+		return int64(maxCount)
+	}
+	return 0
+}
+
+func validGroupMaxCount(metadata map[string]interface{}) bool {
+	v, ok := metadata[groupMetadataMaxCount]
+	if !ok {
+		return true
+	}
+	maxCount, ok := v.(float64)
+	return ok && maxCount >= 1
+}
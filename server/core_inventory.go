@@ -0,0 +1,219 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrInventoryInsufficient is returned when a user does not own enough of an item to consume.
+	ErrInventoryInsufficient = errors.New("Not enough items owned")
+	// ErrInventoryUniqueOwned is returned when a user is granted a unique item they already own.
+	ErrInventoryUniqueOwned = errors.New("Unique item is already owned")
+)
+
+// InventoryRejectedError is returned when the runtime inventory grant function rejects a grant.
+type InventoryRejectedError struct {
+	Reason string
+}
+
+func (e *InventoryRejectedError) Error() string {
+	if e.Reason == "" {
+		return "Inventory grant rejected"
+	}
+	return "Inventory grant rejected: " + e.Reason
+}
+
+// InventoryItem is a stack of items a user owns, or one unique item. In a grant Count is how many to add, and
+// Owned is how many the user had before the grant.
+type InventoryItem struct {
+	ItemID    string
+	Count     int64
+	Owned     int64
+	Unique    bool
+	Metadata  []byte
+	CreatedAt int64
+	UpdatedAt int64
+}
+
+// InventoryGrant adds items to a user's inventory, all or none of them. Stackable items add to the count the user owns,
+// unique items fail the grant if the user already owns one. The runtime inventory grant function, if registered, sees
+// the grant and the counts owned within the transaction, so caps it enforces hold under concurrent grants. Grants are
+// retried if they conflict with another transaction, the function may then run more than once. It returns the items
+// as they are stored after the grant.
+func InventoryGrant(logger *zap.Logger, db *sql.DB, runtime *Runtime, userID uuid.UUID, grants []*InventoryItem) ([]*InventoryItem, error) {
+	if len(grants) == 0 {
+		return nil, errors.New("At least one item must be granted")
+	}
+	seen := make(map[string]bool, len(grants))
+	for _, grant := range grants {
+		if err := validateInventoryItemID(grant.ItemID); err != nil {
+			return nil, err
+		} else if seen[grant.ItemID] {
+			return nil, errors.New("Item must be granted at most once per grant")
+		} else if grant.Count <= 0 {
+			return nil, errors.New("Item count must be greater than 0")
+		} else if grant.Unique && grant.Count != 1 {
+			return nil, errors.New("Unique item count must be 1")
+		} else if len(grant.Metadata) != 0 {
+			var maybeJSON map[string]interface{}
+			if json.Unmarshal(grant.Metadata, &maybeJSON) != nil {
+				return nil, errors.New("Item metadata must be a valid JSON object")
+			}
+		}
+		seen[grant.ItemID] = true
+	}
+
+	var items []*InventoryItem
+	err := retryTx(logger, db, func(tx *sql.Tx) error {
+		items = make([]*InventoryItem, 0, len(grants))
+		for _, grant := range grants {
+			item, err := inventoryItemRead(tx, userID, grant.ItemID)
+			if err != nil {
+				return err
+			}
+			if item == nil {
+				item = &InventoryItem{ItemID: grant.ItemID, Unique: grant.Unique, Metadata: []byte("{}")}
+			} else if item.Unique || grant.Unique {
+				if item.Unique != grant.Unique {
+					return errors.New("Item is already owned as a different kind of item")
+				}
+				return ErrInventoryUniqueOwned
+			}
+			grant.Owned = item.Count
+			item.Count += grant.Count
+			if len(grant.Metadata) != 0 {
+				item.Metadata = grant.Metadata
+			}
+			items = append(items, item)
+		}
+
+		if runtime != nil && runtime.IsRuntimeInventoryGrantRegistered() {
+			accepted, reason, err := runtime.InvokeFunctionInventoryGrant(userID, grants)
+			if err != nil {
+				return err
+			} else if !accepted {
+				return &InventoryRejectedError{Reason: reason}
+			}
+		}
+
+		ts := nowMs()
+		for _, item := range items {
+			if item.CreatedAt == 0 {
+				item.CreatedAt = ts
+			}
+			item.UpdatedAt = ts
+			_, err := tx.Exec(`UPSERT INTO inventory (user_id, item_id, count, unique_item, metadata, created_at, updated_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7)`, userID.Bytes(), item.ItemID, item.Count, item.Unique, item.Metadata, item.CreatedAt, item.UpdatedAt)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// InventoryConsume removes items from a user's inventory, all or none of them. It returns ErrInventoryInsufficient if
+// the user owns fewer of any item than asked for. Items whose count reaches 0 are removed.
+func InventoryConsume(logger *zap.Logger, db *sql.DB, userID uuid.UUID, consume map[string]int64) error {
+	if err := validateInventoryConsume(consume); err != nil {
+		return err
+	}
+
+	return retryTx(logger, db, func(tx *sql.Tx) error {
+		return inventoryConsumeTx(tx, userID, consume)
+	})
+}
+
+func validateInventoryConsume(consume map[string]int64) error {
+	if len(consume) == 0 {
+		return errors.New("At least one item must be consumed")
+	}
+	for itemID, count := range consume {
+		if err := validateInventoryItemID(itemID); err != nil {
+			return err
+		} else if count <= 0 {
+			return errors.New("Item count must be greater than 0")
+		}
+	}
+	return nil
+}
+
+// inventoryConsumeTx removes validated items from a user's inventory in the caller's transaction, which must roll back
+// if it returns ErrInventoryInsufficient.
+func inventoryConsumeTx(tx *sql.Tx, userID uuid.UUID, consume map[string]int64) error {
+	ts := nowMs()
+	for itemID, count := range consume {
+		res, err := tx.Exec("UPDATE inventory SET count = count - $3, updated_at = $4 WHERE user_id = $1 AND item_id = $2 AND count >= $3",
+			userID.Bytes(), itemID, count, ts)
+		if err != nil {
+			return err
+		}
+		if rowsAffected, _ := res.RowsAffected(); rowsAffected != 1 {
+			return ErrInventoryInsufficient
+		}
+	}
+	_, err := tx.Exec("DELETE FROM inventory WHERE user_id = $1 AND count = 0", userID.Bytes())
+	return err
+}
+
+// InventoryList returns everything in a user's inventory, ordered by item ID.
+func InventoryList(logger *zap.Logger, db *sql.DB, userID uuid.UUID) ([]*InventoryItem, error) {
+	rows, err := db.Query("SELECT item_id, count, unique_item, metadata, created_at, updated_at FROM inventory WHERE user_id = $1 ORDER BY item_id", userID.Bytes())
+	if err != nil {
+		logger.Error("Could not list inventory", zap.Error(err))
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := make([]*InventoryItem, 0)
+	for rows.Next() {
+		item := &InventoryItem{}
+		if err = rows.Scan(&item.ItemID, &item.Count, &item.Unique, &item.Metadata, &item.CreatedAt, &item.UpdatedAt); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func inventoryItemRead(tx *sql.Tx, userID uuid.UUID, itemID string) (*InventoryItem, error) {
+	item := &InventoryItem{ItemID: itemID}
+	err := tx.QueryRow("SELECT count, unique_item, metadata, created_at FROM inventory WHERE user_id = $1 AND item_id = $2", userID.Bytes(), itemID).
+		Scan(&item.Count, &item.Unique, &item.Metadata, &item.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func validateInventoryItemID(itemID string) error {
+	if itemID == "" || len(itemID) > 128 {
+		return errors.New("Item ID must be set and at most 128 characters")
+	}
+	return nil
+}
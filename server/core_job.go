@@ -0,0 +1,250 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+const (
+	jobPollInterval = time.Second
+	// Claimed jobs are hidden from other workers for this long, and run again if not completed or failed by then.
+	jobLeaseMs = int64(5 * 60 * 1000)
+	// Failed jobs are retried after a delay that doubles with every attempt, up to the maximum.
+	jobRetryBaseMs = int64(1000)
+	jobRetryMaxMs  = int64(60 * 60 * 1000)
+)
+
+// Job is a unit of background work kept in a durable queue until a worker completes it.
+type Job struct {
+	Id       []byte
+	Queue    string
+	Payload  []byte
+	Attempts int64
+}
+
+// JobEnqueue stores a job in the named queue, with a payload that must be a JSON object, and returns its ID. Jobs
+// enqueued on behalf of a user, with a user ID other than nil, are removed if the user's data is deleted.
+func JobEnqueue(logger *zap.Logger, db *sql.DB, queue string, userID uuid.UUID, payload []byte) ([]byte, error) {
+	if queue == "" || len(queue) > 128 {
+		return nil, errors.New("Queue name must be set and at most 128 characters")
+	}
+	if len(payload) == 0 {
+		payload = []byte("{}")
+	}
+	var maybeJSON map[string]interface{}
+	if json.Unmarshal(payload, &maybeJSON) != nil {
+		return nil, errors.New("Job payload must be a valid JSON object")
+	}
+
+	id := uuid.NewV4().Bytes()
+	ts := nowMs()
+	var owner interface{}
+	if userID != uuid.Nil {
+		owner = userID.Bytes()
+	}
+	_, err := db.Exec("INSERT INTO job (id, queue, user_id, payload, created_at, run_at) VALUES ($1, $2, $3, $4, $5, $5)", id, queue, owner, payload, ts)
+	if err != nil {
+		logger.Error("Could not enqueue job", zap.Error(err))
+		return nil, err
+	}
+	metrics.IncrCounter([]string{"job", "enqueued"}, 1)
+	return id, nil
+}
+
+// JobClaim takes up to limit jobs from the queue that are due, and leases them to the caller. A leased job runs again
+// if it is neither completed nor failed before the lease ends, so jobs are processed at least once. Jobs whose lease
+// ended after their last of maxAttempts attempts are dead lettered rather than handed out again.
+func JobClaim(logger *zap.Logger, db *sql.DB, queue string, limit int, maxAttempts int64) ([]*Job, error) {
+	ts := nowMs()
+	res, err := db.Exec("UPDATE job SET dead_at = $1, last_error = 'Lease ended after the last attempt' WHERE queue = $2 AND dead_at = 0 AND run_at <= $1 AND attempts >= $3",
+		ts, queue, maxAttempts)
+	if err != nil {
+		logger.Error("Could not dead letter exhausted jobs", zap.Error(err))
+		return nil, err
+	}
+	if dead, _ := res.RowsAffected(); dead > 0 {
+		metrics.IncrCounter([]string{"job", "dead"}, float32(dead))
+	}
+
+	rows, err := db.Query(`UPDATE job SET run_at = $1, attempts = attempts + 1
+WHERE id IN (SELECT id FROM job WHERE queue = $2 AND dead_at = 0 AND run_at <= $3 AND attempts < $5 ORDER BY run_at LIMIT $4)
+RETURNING id, payload, attempts`, ts+jobLeaseMs, queue, ts, limit, maxAttempts)
+	if err != nil {
+		logger.Error("Could not claim jobs", zap.Error(err))
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := make([]*Job, 0, limit)
+	for rows.Next() {
+		job := &Job{Queue: queue}
+		if err = rows.Scan(&job.Id, &job.Payload, &job.Attempts); err != nil {
+			logger.Error("Could not scan claimed job", zap.Error(err))
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	if err = rows.Err(); err != nil {
+		logger.Error("Could not claim jobs", zap.Error(err))
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// JobComplete removes a job that was processed.
+func JobComplete(logger *zap.Logger, db *sql.DB, job *Job) error {
+	if _, err := db.Exec("DELETE FROM job WHERE id = $1", job.Id); err != nil {
+		logger.Error("Could not complete job", zap.Error(err))
+		return err
+	}
+	metrics.IncrCounter([]string{"job", "completed"}, 1)
+	return nil
+}
+
+// JobFail records why a job failed and schedules it to be retried with backoff. Once the job has been attempted
+// maxAttempts times it is dead lettered instead, it stays in the queue for inspection but never runs again. It returns
+// true if the job was dead lettered.
+func JobFail(logger *zap.Logger, db *sql.DB, job *Job, maxAttempts int64, cause error) (bool, error) {
+	reason := []rune(cause.Error())
+	if len(reason) > 255 {
+		reason = reason[:255]
+	}
+
+	ts := nowMs()
+	var err error
+	dead := job.Attempts >= maxAttempts
+	if dead {
+		_, err = db.Exec("UPDATE job SET dead_at = $1, last_error = $2 WHERE id = $3", ts, string(reason), job.Id)
+	} else {
+		_, err = db.Exec("UPDATE job SET run_at = $1, last_error = $2 WHERE id = $3", ts+jobRetryBackoff(job.Attempts), string(reason), job.Id)
+	}
+	if err != nil {
+		logger.Error("Could not record job failure", zap.Error(err))
+		return false, err
+	}
+	if dead {
+		metrics.IncrCounter([]string{"job", "dead"}, 1)
+	} else {
+		metrics.IncrCounter([]string{"job", "retried"}, 1)
+	}
+	return dead, nil
+}
+
+func jobRetryBackoff(attempts int64) int64 {
+	backoff := jobRetryBaseMs
+	for i := int64(1); i < attempts && backoff < jobRetryMaxMs; i++ {
+		backoff *= 2
+	}
+	if backoff > jobRetryMaxMs {
+		return jobRetryMaxMs
+	}
+	return backoff
+}
+
+// JobWorker processes the jobs of one queue, running up to its concurrency at a time.
+type JobWorker struct {
+	logger      *zap.Logger
+	db          *sql.DB
+	queue       string
+	concurrency int
+	maxAttempts int64
+	process     func(job *Job) error
+	stopCh      chan bool
+	stopOnce    sync.Once
+	wg          sync.WaitGroup
+}
+
+// NewJobWorker starts processing the queue with the given function, until stopped. Jobs the function returns an error
+// for are retried, up to maxAttempts attempts in total.
+func NewJobWorker(logger *zap.Logger, db *sql.DB, queue string, concurrency int, maxAttempts int64, process func(job *Job) error) *JobWorker {
+	w := &JobWorker{
+		logger:      logger.With(zap.String("queue", queue)),
+		db:          db,
+		queue:       queue,
+		concurrency: concurrency,
+		maxAttempts: maxAttempts,
+		process:     process,
+		stopCh:      make(chan bool),
+	}
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		ticker := time.NewTicker(jobPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.stopCh:
+				return
+			case <-ticker.C:
+				w.poll()
+			}
+		}
+	}()
+
+	return w
+}
+
+// Stop ends processing once the jobs in progress are done. Jobs claimed but not started run again after their lease.
+func (w *JobWorker) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.stopCh)
+	})
+	w.wg.Wait()
+}
+
+// poll processes batches of due jobs until the queue has none left or the worker is stopped.
+func (w *JobWorker) poll() {
+	for {
+		select {
+		case <-w.stopCh:
+			return
+		default:
+		}
+
+		jobs, err := JobClaim(w.logger, w.db, w.queue, w.concurrency, w.maxAttempts)
+		if err != nil {
+			return
+		}
+
+		var wg sync.WaitGroup
+		for _, job := range jobs {
+			wg.Add(1)
+			go func(job *Job) {
+				defer wg.Done()
+				if err := w.process(job); err != nil {
+					w.logger.Warn("Job failed", zap.Int64("attempts", job.Attempts), zap.Error(err))
+					JobFail(w.logger, w.db, job, w.maxAttempts, err)
+					return
+				}
+				JobComplete(w.logger, w.db, job)
+			}(job)
+		}
+		wg.Wait()
+
+		if len(jobs) < w.concurrency {
+			return
+		}
+	}
+}
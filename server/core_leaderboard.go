@@ -16,11 +16,15 @@ package server
 
 import (
 	"encoding/json"
+	"math"
+	"sync"
+	"time"
 
 	"database/sql"
 	"errors"
 
 	"github.com/gorhill/cronexpr"
+	"github.com/lib/pq"
 	"github.com/satori/go.uuid"
 	"go.uber.org/zap"
 )
@@ -85,3 +89,351 @@ func createLeaderboard(logger *zap.Logger, db *sql.DB, id, sortOrder, resetSched
 
 	return params[0].([]byte), nil
 }
+
+// leaderboardRecordReadWrite reads the owner's current record on a leaderboard and writes back the record returned by
+// the update function, all in one transaction. The update function receives nil if the owner has no record in the
+// current leaderboard period yet. If it returns nil the record is left unchanged.
+func leaderboardRecordReadWrite(logger *zap.Logger, db *sql.DB, runtime *Runtime, leaderboardID []byte, ownerID []byte, update func(record *LeaderboardRecord) (*LeaderboardRecord, error)) (*LeaderboardRecord, error) {
+	return leaderboardRecordReadWriteDecay(logger, db, runtime, leaderboardID, ownerID, false, func(record *LeaderboardRecord, decayedAt int64) (*LeaderboardRecord, error) {
+		return update(record)
+	})
+}
+
+// leaderboardRecordReadWriteDecay is leaderboardRecordReadWrite that also passes the update function the time the
+// record was last decayed, or 0 if it never was. If decay is true the write sets that time to the time of the write,
+// other writes leave it unchanged. The transaction is run again if it conflicts with a concurrent write to the record,
+// so the update function may be called more than once and must not have side effects. The runtime tie-break function
+// runs once the write commits.
+func leaderboardRecordReadWriteDecay(logger *zap.Logger, db *sql.DB, runtime *Runtime, leaderboardID []byte, ownerID []byte, decay bool, update func(record *LeaderboardRecord, decayedAt int64) (*LeaderboardRecord, error)) (*LeaderboardRecord, error) {
+	var record *LeaderboardRecord
+	var tieBreak *leaderboardTieBreak
+	err := retryTx(logger, db, func(tx *sql.Tx) error {
+		var err error
+		record, tieBreak, err = leaderboardRecordReadWriteDecayTx(logger, tx, leaderboardID, ownerID, decay, update)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	leaderboardTieBreakUpdate(logger, runtime, db, tieBreak)
+	return record, nil
+}
+
+func leaderboardRecordReadWriteDecayTx(logger *zap.Logger, tx *sql.Tx, leaderboardID []byte, ownerID []byte, decay bool, update func(record *LeaderboardRecord, decayedAt int64) (*LeaderboardRecord, error)) (*LeaderboardRecord, *leaderboardTieBreak, error) {
+	var sortOrder int64
+	var resetSchedule sql.NullString
+	err := tx.QueryRow("SELECT sort_order, reset_schedule FROM leaderboard WHERE id = $1", leaderboardID).Scan(&sortOrder, &resetSchedule)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = errors.New("Leaderboard not found")
+		}
+		return nil, nil, err
+	}
+
+	now := now()
+	updatedAt := timeToMs(now)
+	expiresAt := int64(0)
+	if resetSchedule.Valid {
+		expr, e := cronexpr.Parse(resetSchedule.String)
+		if e != nil {
+			err = e
+			return nil, nil, err
+		}
+		expiresAt = timeToMs(expr.Next(now))
+	}
+
+	recordQuery := `SELECT handle, lang, location, timezone, rank_value, score, num_score, metadata, ranked_at, updated_at, decayed_at
+		FROM leaderboard_record
+		WHERE leaderboard_id = $1
+		AND expires_at = $2
+		AND owner_id = $3`
+	var current *LeaderboardRecord
+	var location sql.NullString
+	var timezone sql.NullString
+	var decayedAt int64
+	record := &LeaderboardRecord{LeaderboardId: leaderboardID, OwnerId: ownerID, ExpiresAt: expiresAt}
+	err = tx.QueryRow(recordQuery, leaderboardID, expiresAt, ownerID).
+		Scan(&record.Handle, &record.Lang, &location, &timezone, &record.Rank, &record.Score, &record.NumScore, &record.Metadata, &record.RankedAt, &record.UpdatedAt, &decayedAt)
+	if err == nil {
+		record.Location = location.String
+		record.Timezone = timezone.String
+		current = record
+	} else if err != sql.ErrNoRows {
+		return nil, nil, err
+	}
+	err = nil
+
+	updated, e := update(current, decayedAt)
+	if e != nil {
+		err = e
+		return nil, nil, err
+	}
+	if updated == nil {
+		return current, nil, nil
+	}
+
+	// As with client writes, empty location, timezone, and metadata keep their current values.
+	params := []interface{}{leaderboardID, expiresAt, ownerID, nil, nil, updated.Score, nil, updatedAt, invertMs(updatedAt), nil}
+	if decay {
+		params[9] = updatedAt
+	}
+	if updated.Location != "" {
+		params[3] = updated.Location
+	}
+	if updated.Timezone != "" {
+		params[4] = updated.Timezone
+	}
+	if len(updated.Metadata) != 0 {
+		var maybeJSON map[string]interface{}
+		if json.Unmarshal(updated.Metadata, &maybeJSON) != nil {
+			err = errors.New("Metadata must be a valid JSON object")
+			return nil, nil, err
+		}
+		params[6] = updated.Metadata
+	}
+
+	if current != nil {
+		_, err = tx.Exec(`UPDATE leaderboard_record SET location = COALESCE($4, location), timezone = COALESCE($5, timezone),
+			score = $6, num_score = num_score + 1, metadata = COALESCE($7, metadata), updated_at = $8, updated_at_inverse = $9,
+			decayed_at = COALESCE($10, decayed_at)
+			WHERE leaderboard_id = $1 AND expires_at = $2 AND owner_id = $3`, params...)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		var handle, lang string
+		err = tx.QueryRow("SELECT handle, lang FROM users WHERE id = $1", ownerID).Scan(&handle, &lang)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				err = errors.New("Leaderboard record owner not found")
+			}
+			return nil, nil, err
+		}
+
+		_, err = tx.Exec(`INSERT INTO leaderboard_record (id, leaderboard_id, owner_id, handle, lang, location, timezone,
+				rank_value, score, num_score, metadata, ranked_at, updated_at, updated_at_inverse, expires_at, banned_at, decayed_at)
+			VALUES ($11, $1, $3, $12, $13, $4, $5, 0, $6, 1, COALESCE($7, '{}'), 0, $8, $9, $2, 0, COALESCE($10, 0))`,
+			append(params, uuid.NewV4().Bytes(), handle, lang)...)
+		if e, ok := err.(*pq.Error); ok && e.Code == "23505" {
+			// A concurrent write created the record first, read it again and update it instead.
+			return nil, nil, errTxConflict
+		} else if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Read back the stored record so coalesced fields reflect what was written.
+	record = &LeaderboardRecord{LeaderboardId: leaderboardID, OwnerId: ownerID, ExpiresAt: expiresAt}
+	err = tx.QueryRow(recordQuery, leaderboardID, expiresAt, ownerID).
+		Scan(&record.Handle, &record.Lang, &location, &timezone, &record.Rank, &record.Score, &record.NumScore, &record.Metadata, &record.RankedAt, &record.UpdatedAt, &decayedAt)
+	if err != nil {
+		return nil, nil, err
+	}
+	record.Location = location.String
+	record.Timezone = timezone.String
+
+	if err = leaderboardAggregateUpdate(tx, leaderboardID, ownerID); err != nil {
+		return nil, nil, err
+	}
+	return record, &leaderboardTieBreak{sortOrder: sortOrder, record: record, previous: current}, nil
+}
+
+// LeaderboardRecordIncrementDecay decays an owner's score by the time since it was last decayed then adds delta to
+// it, reading and writing the record in one transaction so concurrent increments never lose a decay or a delta. The
+// score halves every halfLifeMs, measured from the record's decayed_at which only this function sets, so other writes
+// do not reset the decay. Owners without a record in the current leaderboard period start from a score of zero, and
+// records never decayed before start decaying from this increment.
+func LeaderboardRecordIncrementDecay(logger *zap.Logger, db *sql.DB, runtime *Runtime, leaderboardID []byte, ownerID []byte, delta int64, halfLifeMs int64) (*LeaderboardRecord, error) {
+	if halfLifeMs <= 0 {
+		return nil, errors.New("Half-life must be greater than zero")
+	}
+
+	return leaderboardRecordReadWriteDecay(logger, db, runtime, leaderboardID, ownerID, true, func(record *LeaderboardRecord, decayedAt int64) (*LeaderboardRecord, error) {
+		if record == nil {
+			return &LeaderboardRecord{Score: delta}, nil
+		}
+		if decayedAt == 0 {
+			return &LeaderboardRecord{Score: record.Score + delta}, nil
+		}
+		return &LeaderboardRecord{Score: LeaderboardDecayScore(record.Score, nowMs()-decayedAt, halfLifeMs) + delta}, nil
+	})
+}
+
+// LeaderboardDecayScore returns a score decayed over elapsedMs, halving every halfLifeMs. Decayed scores are truncated
+// toward zero.
+func LeaderboardDecayScore(score int64, elapsedMs int64, halfLifeMs int64) int64 {
+	if elapsedMs <= 0 || halfLifeMs <= 0 {
+		return score
+	}
+	return int64(float64(score) * math.Pow(0.5, float64(elapsedMs)/float64(halfLifeMs)))
+}
+
+// leaderboardTieBreak is a committed record write, with the record as it was before the write or nil if it is new, to
+// pass to the runtime tie-break function.
+type leaderboardTieBreak struct {
+	sortOrder int64
+	record    *LeaderboardRecord
+	previous  *LeaderboardRecord
+}
+
+// leaderboardTieBreakUpdate stores the tie-break key the runtime leaderboard tie-break function gives a record write.
+// Keys are computed once per write so listings and ranks order records by a stored column and never call the function.
+// It runs after the write commits, so the function never runs inside a transaction or again when one is retried, and
+// the record briefly ranks by its previous key. The key is only stored if no later write changed the record since,
+// that write stores its own. Errors are logged and the record keeps its key.
+func leaderboardTieBreakUpdate(logger *zap.Logger, runtime *Runtime, db *sql.DB, t *leaderboardTieBreak) {
+	if t == nil || runtime == nil || !runtime.IsRuntimeLeaderboardTieBreakRegistered() {
+		return
+	}
+
+	record := t.record
+	var stored int64
+	err := db.QueryRow(`SELECT tie_break FROM leaderboard_record WHERE leaderboard_id = $1 AND expires_at = $2 AND owner_id = $3
+AND num_score = $4 AND updated_at = $5`, record.LeaderboardId, record.ExpiresAt, record.OwnerId, record.NumScore, record.UpdatedAt).Scan(&stored)
+	if err == sql.ErrNoRows {
+		return
+	} else if err != nil {
+		logger.Error("Could not read leaderboard record tie-break key", zap.Error(err))
+		return
+	}
+	key, err := runtime.InvokeFunctionLeaderboardTieBreak(record, t.previous, leaderboardTieBreakKey(t.sortOrder, stored))
+	if err != nil {
+		logger.Error("Runtime leaderboard tie-break function caused an error", zap.Error(err))
+		return
+	}
+	// Aggregate leaderboards copy the key, so they are updated with it.
+	err = retryTx(logger, db, func(tx *sql.Tx) error {
+		res, err := tx.Exec(`UPDATE leaderboard_record SET tie_break = $6 WHERE leaderboard_id = $1 AND expires_at = $2 AND owner_id = $3
+AND num_score = $4 AND updated_at = $5`, record.LeaderboardId, record.ExpiresAt, record.OwnerId, record.NumScore, record.UpdatedAt, leaderboardTieBreakKey(t.sortOrder, key))
+		if err != nil {
+			return err
+		}
+		if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+			return nil
+		}
+		return leaderboardAggregateUpdate(tx, record.LeaderboardId, record.OwnerId)
+	})
+	if err != nil {
+		logger.Error("Could not store leaderboard record tie-break key", zap.Error(err))
+	}
+}
+
+// leaderboardTieBreakKey converts between tie-break keys, where lower keys rank first, and the stored tie_break column.
+// The column is negated on descending leaderboards, so listings and ranks order it in the same direction as the score.
+func leaderboardTieBreakKey(sortOrder, value int64) int64 {
+	if sortOrder == 0 {
+		return value
+	}
+	return -value
+}
+
+// ErrLeaderboardRecordNotFound is returned when an owner has no record in the current period of a leaderboard.
+var ErrLeaderboardRecordNotFound = errors.New("Leaderboard record not found")
+
+const leaderboardRankCacheMaxEntries = 10000
+
+// LeaderboardRankCache keeps owner ranks for a short time, each rank counts every record placed above the owner.
+type LeaderboardRankCache struct {
+	sync.Mutex
+	duration time.Duration
+	entries  map[string]*leaderboardRankEntry
+}
+
+type leaderboardRankEntry struct {
+	rank      int64
+	score     int64
+	checkedAt time.Time
+}
+
+func NewLeaderboardRankCache(duration time.Duration) *LeaderboardRankCache {
+	return &LeaderboardRankCache{
+		duration: duration,
+		entries:  make(map[string]*leaderboardRankEntry),
+	}
+}
+
+// Get returns a cached rank and score if they are recent enough, otherwise it computes them again.
+func (c *LeaderboardRankCache) Get(logger *zap.Logger, db *sql.DB, leaderboardID []byte, ownerID []byte) (int64, int64, error) {
+	key := string(leaderboardID) + "/" + string(ownerID)
+
+	c.Lock()
+	entry, ok := c.entries[key]
+	c.Unlock()
+	if ok && time.Since(entry.checkedAt) < c.duration {
+		return entry.rank, entry.score, nil
+	}
+
+	rank, score, err := leaderboardRank(logger, db, leaderboardID, ownerID)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	c.Lock()
+	if len(c.entries) >= leaderboardRankCacheMaxEntries {
+		for k, e := range c.entries {
+			if time.Since(e.checkedAt) >= c.duration {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= leaderboardRankCacheMaxEntries {
+			c.entries = make(map[string]*leaderboardRankEntry)
+		}
+	}
+	c.entries[key] = &leaderboardRankEntry{rank: rank, score: score, checkedAt: time.Now()}
+	c.Unlock()
+	return rank, score, nil
+}
+
+// leaderboardRank returns the rank of an owner's record in the current period of a leaderboard, and its score. Records
+// are ordered as leaderboard listings order them, by score, then by tie-break key and then by the earliest update, and
+// records with the same score, key and update time share a rank.
+func leaderboardRank(logger *zap.Logger, db *sql.DB, leaderboardID []byte, ownerID []byte) (int64, int64, error) {
+	var sortOrder int64
+	var resetSchedule sql.NullString
+	err := db.QueryRow("SELECT sort_order, reset_schedule FROM leaderboard WHERE id = $1", leaderboardID).Scan(&sortOrder, &resetSchedule)
+	if err == sql.ErrNoRows {
+		return 0, 0, errors.New("Leaderboard not found")
+	} else if err != nil {
+		logger.Error("Could not execute leaderboard rank metadata query", zap.Error(err))
+		return 0, 0, err
+	}
+
+	expiresAt := int64(0)
+	if resetSchedule.Valid {
+		expr, err := cronexpr.Parse(resetSchedule.String)
+		if err != nil {
+			logger.Error("Could not parse leaderboard reset schedule", zap.Error(err))
+			return 0, 0, err
+		}
+		expiresAt = timeToMs(expr.Next(now()))
+	}
+
+	var score int64
+	var tieBreak int64
+	var updatedAt int64
+	err = db.QueryRow("SELECT score, tie_break, updated_at FROM leaderboard_record WHERE leaderboard_id = $1 AND expires_at = $2 AND owner_id = $3",
+		leaderboardID, expiresAt, ownerID).Scan(&score, &tieBreak, &updatedAt)
+	if err == sql.ErrNoRows {
+		return 0, 0, ErrLeaderboardRecordNotFound
+	} else if err != nil {
+		logger.Error("Could not execute leaderboard rank record query", zap.Error(err))
+		return 0, 0, err
+	}
+
+	// Lower scores are better on ascending leaderboards, higher scores on descending ones. Stored tie-break keys follow
+	// the score's direction.
+	comparison := "<"
+	if sortOrder != 0 {
+		comparison = ">"
+	}
+	var above int64
+	err = db.QueryRow(`SELECT count(*) FROM leaderboard_record
+		WHERE leaderboard_id = $1 AND expires_at = $2
+		AND (score `+comparison+` $3 OR (score = $3 AND tie_break `+comparison+` $4) OR (score = $3 AND tie_break = $4 AND updated_at < $5))`,
+		leaderboardID, expiresAt, score, tieBreak, updatedAt).Scan(&above)
+	if err != nil {
+		logger.Error("Could not execute leaderboard rank count query", zap.Error(err))
+		return 0, 0, err
+	}
+	return above + 1, score, nil
+}
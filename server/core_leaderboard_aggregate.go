@@ -0,0 +1,229 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/gorhill/cronexpr"
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+// An aggregate leaderboard is an authoritative leaderboard whose records are kept in step with those of its regional
+// source leaderboards, so the global ranking is listed and ranked like any other leaderboard. Each owner has at most
+// one aggregate record, a copy of their best unexpired, unbanned record across all sources by the aggregate's sort
+// order, which all sources share. If scores tie the record with the best tie-break key wins, then the earliest one, and
+// the copy keeps the key so it ranks against other owners as its source record does. Records are refreshed in the
+// transaction that writes a source record, and the whole aggregate can be rebuilt with LeaderboardAggregateRefresh.
+
+// LeaderboardAggregateRegister makes an existing authoritative leaderboard the aggregate of the given source
+// leaderboards, replacing any sources it had, and rebuilds its records. Aggregates cannot be sources themselves.
+func LeaderboardAggregateRegister(logger *zap.Logger, db *sql.DB, aggregateID []byte, sourceIDs [][]byte) error {
+	if len(sourceIDs) == 0 {
+		return errors.New("Aggregate leaderboard needs at least one source leaderboard")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = leaderboardAggregateRegisterTx(tx, aggregateID, sourceIDs); err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			logger.Error("Could not rollback transaction", zap.Error(rollbackErr))
+		}
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		logger.Error("Could not commit transaction", zap.Error(err))
+		return err
+	}
+
+	return LeaderboardAggregateRefresh(logger, db, aggregateID)
+}
+
+func leaderboardAggregateRegisterTx(tx *sql.Tx, aggregateID []byte, sourceIDs [][]byte) error {
+	var authoritative bool
+	var sortOrder int64
+	err := tx.QueryRow("SELECT authoritative, sort_order FROM leaderboard WHERE id = $1", aggregateID).Scan(&authoritative, &sortOrder)
+	if err == sql.ErrNoRows {
+		return errors.New("Aggregate leaderboard not found")
+	} else if err != nil {
+		return err
+	}
+	// Client writes would be overwritten by the next refresh.
+	if !authoritative {
+		return errors.New("Aggregate leaderboard must be authoritative")
+	}
+
+	var count int64
+	if err = tx.QueryRow("SELECT count(*) FROM leaderboard_aggregate WHERE source_id = $1", aggregateID).Scan(&count); err != nil {
+		return err
+	} else if count != 0 {
+		return errors.New("Aggregate leaderboard is a source of another aggregate")
+	}
+
+	if _, err = tx.Exec("DELETE FROM leaderboard_aggregate WHERE aggregate_id = $1", aggregateID); err != nil {
+		return err
+	}
+	for _, sourceID := range sourceIDs {
+		if string(sourceID) == string(aggregateID) {
+			return errors.New("Aggregate leaderboard cannot be its own source")
+		}
+		var sourceSortOrder int64
+		err = tx.QueryRow("SELECT sort_order FROM leaderboard WHERE id = $1", sourceID).Scan(&sourceSortOrder)
+		if err == sql.ErrNoRows {
+			return errors.New("Source leaderboard not found")
+		} else if err != nil {
+			return err
+		} else if sourceSortOrder != sortOrder {
+			// Best records and tie-break keys would not compare across the sources.
+			return errors.New("Source leaderboard sort order must match the aggregate leaderboard")
+		}
+		err = tx.QueryRow("SELECT count(*) FROM leaderboard_aggregate WHERE aggregate_id = $1", sourceID).Scan(&count)
+		if err != nil {
+			return err
+		} else if count != 0 {
+			return errors.New("Source leaderboard is an aggregate")
+		}
+		if _, err = tx.Exec("UPSERT INTO leaderboard_aggregate (aggregate_id, source_id) VALUES ($1, $2)", aggregateID, sourceID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LeaderboardAggregateRefresh rebuilds the records of an aggregate leaderboard from its sources, one owner at a time.
+// Use it after changes not made through leaderboard writes, such as bans, or on a schedule to drop records whose source
+// records have expired.
+func LeaderboardAggregateRefresh(logger *zap.Logger, db *sql.DB, aggregateID []byte) error {
+	rows, err := db.Query(`SELECT DISTINCT owner_id FROM leaderboard_record
+WHERE leaderboard_id = $1 OR leaderboard_id IN (SELECT source_id FROM leaderboard_aggregate WHERE aggregate_id = $1)`, aggregateID)
+	if err != nil {
+		logger.Error("Could not list aggregate leaderboard owners", zap.Error(err))
+		return err
+	}
+	ownerIDs := make([][]byte, 0)
+	for rows.Next() {
+		var ownerID []byte
+		if err = rows.Scan(&ownerID); err != nil {
+			rows.Close()
+			return err
+		}
+		ownerIDs = append(ownerIDs, ownerID)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, ownerID := range ownerIDs {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if err = leaderboardAggregateOwner(tx, aggregateID, ownerID); err != nil {
+			tx.Rollback()
+			logger.Error("Could not refresh aggregate leaderboard record", zap.Error(err))
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			logger.Error("Could not commit transaction", zap.Error(err))
+			return err
+		}
+	}
+	return nil
+}
+
+// leaderboardAggregateUpdate refreshes the owner's records on every aggregate of a leaderboard, in the transaction that
+// wrote the owner's record on it.
+func leaderboardAggregateUpdate(tx *sql.Tx, sourceID, ownerID []byte) error {
+	rows, err := tx.Query("SELECT aggregate_id FROM leaderboard_aggregate WHERE source_id = $1", sourceID)
+	if err != nil {
+		return err
+	}
+	aggregateIDs := make([][]byte, 0)
+	for rows.Next() {
+		var aggregateID []byte
+		if err = rows.Scan(&aggregateID); err != nil {
+			rows.Close()
+			return err
+		}
+		aggregateIDs = append(aggregateIDs, aggregateID)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, aggregateID := range aggregateIDs {
+		if err = leaderboardAggregateOwner(tx, aggregateID, ownerID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// leaderboardAggregateOwner copies the owner's best source record into the current period of the aggregate, or removes
+// the owner's aggregate record if they have no source record left.
+func leaderboardAggregateOwner(tx *sql.Tx, aggregateID, ownerID []byte) error {
+	var sortOrder int64
+	var resetSchedule sql.NullString
+	err := tx.QueryRow("SELECT sort_order, reset_schedule FROM leaderboard WHERE id = $1", aggregateID).Scan(&sortOrder, &resetSchedule)
+	if err != nil {
+		return err
+	}
+
+	now := now()
+	expiresAt := int64(0)
+	if resetSchedule.Valid {
+		expr, err := cronexpr.Parse(resetSchedule.String)
+		if err != nil {
+			return err
+		}
+		expiresAt = timeToMs(expr.Next(now))
+	}
+
+	order := "DESC"
+	if sortOrder == 0 {
+		order = "ASC"
+	}
+	var handle, lang string
+	var location, timezone sql.NullString
+	var score, numScore, tieBreak, updatedAt int64
+	var metadata []byte
+	err = tx.QueryRow(`SELECT handle, lang, location, timezone, score, num_score, metadata, tie_break, updated_at FROM leaderboard_record
+WHERE owner_id = $1 AND leaderboard_id IN (SELECT source_id FROM leaderboard_aggregate WHERE aggregate_id = $2)
+AND (expires_at = 0 OR expires_at > $3) AND banned_at = 0
+ORDER BY score `+order+`, tie_break `+order+`, updated_at ASC LIMIT 1`, ownerID, aggregateID, timeToMs(now)).
+		Scan(&handle, &lang, &location, &timezone, &score, &numScore, &metadata, &tieBreak, &updatedAt)
+	if err == sql.ErrNoRows {
+		_, err = tx.Exec("DELETE FROM leaderboard_record WHERE leaderboard_id = $1 AND expires_at = $2 AND owner_id = $3", aggregateID, expiresAt, ownerID)
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	// The aggregate record keeps the tie-break key and the time the best score was set, so ties rank as in the sources.
+	_, err = tx.Exec(`INSERT INTO leaderboard_record (id, leaderboard_id, owner_id, handle, lang, location, timezone,
+		rank_value, score, num_score, metadata, ranked_at, updated_at, updated_at_inverse, expires_at, banned_at, tie_break)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, 0, $8, $9, $10, 0, $11, $12, $13, 0, $14)
+	ON CONFLICT (leaderboard_id, expires_at, owner_id)
+	DO UPDATE SET handle = $4, lang = $5, location = $6, timezone = $7, score = $8, num_score = $9, metadata = $10,
+		updated_at = $11, updated_at_inverse = $12, tie_break = $14`,
+		uuid.NewV4().Bytes(), aggregateID, ownerID, handle, lang, location, timezone, score, numScore, metadata, updatedAt, invertMs(updatedAt), expiresAt, tieBreak)
+	return err
+}
@@ -0,0 +1,123 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/rand"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Letters and digits that cannot be mistaken for each other when read out or typed, 32 of them so a random byte
+	// maps to one without bias.
+	matchCodeAlphabet    = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	matchCodeLength      = 6
+	matchCodeMaxAttempts = 10
+	// MatchCodeDefaultTTL is how long a match code stays valid if no expiry is given.
+	MatchCodeDefaultTTL = time.Hour
+)
+
+// ErrMatchCodeExhausted is returned when no unused match code could be found, there are far too many live codes.
+var ErrMatchCodeExhausted = errors.New("Could not generate an unused match code")
+
+// MatchCodes hands out short human friendly codes for private matches, so players can join a lobby by typing the code a
+// friend shares instead of a match ID. Codes live on this node only, like the matches they point to.
+type MatchCodes struct {
+	sync.Mutex
+	codes map[string]*matchCode
+}
+
+type matchCode struct {
+	matchID   string
+	expiresAt time.Time
+}
+
+func NewMatchCodes() *MatchCodes {
+	return &MatchCodes{
+		codes: make(map[string]*matchCode),
+	}
+}
+
+// Create generates a new code for the match, valid for ttl. Codes of expired entries are reused.
+func (c *MatchCodes) Create(matchID string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	c.Lock()
+	defer c.Unlock()
+
+	for attempt := 0; attempt < matchCodeMaxAttempts; attempt++ {
+		code, err := matchCodeGenerate()
+		if err != nil {
+			return "", err
+		}
+		if existing, ok := c.codes[code]; ok && now.Before(existing.expiresAt) {
+			continue
+		}
+		c.codes[code] = &matchCode{matchID: matchID, expiresAt: now.Add(ttl)}
+		c.purge(now)
+		return code, nil
+	}
+	return "", ErrMatchCodeExhausted
+}
+
+// Resolve returns the match ID a code points to, if the code exists and has not expired. Codes are not case sensitive.
+func (c *MatchCodes) Resolve(code string) (string, bool) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	now := time.Now()
+	c.Lock()
+	defer c.Unlock()
+
+	entry, ok := c.codes[code]
+	if !ok {
+		return "", false
+	}
+	if !now.Before(entry.expiresAt) {
+		delete(c.codes, code)
+		return "", false
+	}
+	return entry.matchID, true
+}
+
+// Remove drops a code, so it can no longer be resolved.
+func (c *MatchCodes) Remove(code string) {
+	c.Lock()
+	delete(c.codes, strings.ToUpper(strings.TrimSpace(code)))
+	c.Unlock()
+}
+
+// purge drops expired codes once there are enough of them to matter. Must be called with the lock held.
+func (c *MatchCodes) purge(now time.Time) {
+	if len(c.codes)%1000 != 0 {
+		return
+	}
+	for code, entry := range c.codes {
+		if !now.Before(entry.expiresAt) {
+			delete(c.codes, code)
+		}
+	}
+}
+
+func matchCodeGenerate() (string, error) {
+	b := make([]byte, matchCodeLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = matchCodeAlphabet[int(b[i])%len(matchCodeAlphabet)]
+	}
+	return string(b), nil
+}
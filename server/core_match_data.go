@@ -0,0 +1,180 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+const (
+	matchDataScratchMaxEntries = 10000
+	// Players idle for longer start over with empty state.
+	matchDataScratchTTL = time.Hour
+	// Updates that keep losing to concurrent updates of the same state give up after this many runs.
+	matchDataScratchMaxAttempts = 3
+	// Players kicked from a match by the match data function may not rejoin it for this long.
+	matchDataKickCooldown = 5 * time.Minute
+)
+
+var ErrMatchDataScratchConflict = errors.New("Match data state was changed by concurrent updates")
+
+// MatchDataScratch is scratch space for the runtime match data function, it keeps the state the function accumulates
+// for each player in each match between messages, such as anti-cheat suspicion scores. It also remembers the players
+// the function kicked, until their rejoin cooldown ends. State lives on this node only, and the least recently updated
+// state is evicted once there are matchDataScratchMaxEntries entries.
+type MatchDataScratch struct {
+	sync.Mutex
+	entries map[matchDataScratchKey]*list.Element
+	// Least recently updated at the back.
+	order   *list.List
+	version uint64
+	kicks   map[matchDataScratchKey]*list.Element
+	// Kicks all have the same cooldown, so the list is in expiry order with the soonest at the front.
+	kickOrder *list.List
+}
+
+type matchDataScratchKey struct {
+	matchID uuid.UUID
+	userID  uuid.UUID
+}
+
+type matchDataScratchEntry struct {
+	key       matchDataScratchKey
+	state     map[string]interface{}
+	version   uint64
+	updatedAt time.Time
+}
+
+type matchDataKick struct {
+	key       matchDataScratchKey
+	expiresAt time.Time
+}
+
+func NewMatchDataScratch() *MatchDataScratch {
+	return &MatchDataScratch{
+		entries:   make(map[matchDataScratchKey]*list.Element),
+		order:     list.New(),
+		kicks:     make(map[matchDataScratchKey]*list.Element),
+		kickOrder: list.New(),
+	}
+}
+
+// Update runs fn with a copy of the player's current state in the match, nil if there is none, and keeps the state it
+// returns. Returning nil clears the player's state. Nothing changes if fn returns an error. No lock is held while fn
+// runs, the result is only kept if the state did not change meanwhile, otherwise fn runs again on the newer state.
+func (s *MatchDataScratch) Update(matchID, userID uuid.UUID, fn func(state map[string]interface{}) (map[string]interface{}, error)) error {
+	key := matchDataScratchKey{matchID: matchID, userID: userID}
+	for attempt := 1; ; attempt++ {
+		s.Lock()
+		current := s.get(key, time.Now())
+		var state map[string]interface{}
+		var version uint64
+		if current != nil {
+			state = make(map[string]interface{}, len(current.state))
+			for k, v := range current.state {
+				state[k] = v
+			}
+			version = current.version
+		}
+		s.Unlock()
+
+		next, err := fn(state)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		s.Lock()
+		if current = s.get(key, now); (current == nil && version != 0) || (current != nil && current.version != version) {
+			s.Unlock()
+			if attempt >= matchDataScratchMaxAttempts {
+				return ErrMatchDataScratchConflict
+			}
+			continue
+		}
+		s.set(key, next, now)
+		s.Unlock()
+		return nil
+	}
+}
+
+// get returns the unexpired state entry for the key, or nil. The caller must hold the lock.
+func (s *MatchDataScratch) get(key matchDataScratchKey, now time.Time) *matchDataScratchEntry {
+	element, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*matchDataScratchEntry)
+	if now.Sub(entry.updatedAt) >= matchDataScratchTTL {
+		return nil
+	}
+	return entry
+}
+
+// set replaces the state for the key, or clears it if state is nil, and evicts the least recently updated entries
+// over the limit. The caller must hold the lock.
+func (s *MatchDataScratch) set(key matchDataScratchKey, state map[string]interface{}, now time.Time) {
+	if element, ok := s.entries[key]; ok {
+		s.order.Remove(element)
+		delete(s.entries, key)
+	}
+	if state == nil {
+		return
+	}
+
+	s.version++
+	s.entries[key] = s.order.PushFront(&matchDataScratchEntry{key: key, state: state, version: s.version, updatedAt: now})
+	for s.order.Len() > matchDataScratchMaxEntries {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(*matchDataScratchEntry).key)
+	}
+}
+
+// Kick clears the player's state in the match and starts their rejoin cooldown.
+func (s *MatchDataScratch) Kick(matchID, userID uuid.UUID) {
+	key := matchDataScratchKey{matchID: matchID, userID: userID}
+	now := time.Now()
+	s.Lock()
+	s.set(key, nil, now)
+	s.expireKicks(now)
+	if element, ok := s.kicks[key]; ok {
+		s.kickOrder.Remove(element)
+	}
+	s.kicks[key] = s.kickOrder.PushBack(&matchDataKick{key: key, expiresAt: now.Add(matchDataKickCooldown)})
+	s.Unlock()
+}
+
+// Kicked reports whether the player was kicked from the match and their rejoin cooldown has not ended.
+func (s *MatchDataScratch) Kicked(matchID, userID uuid.UUID) bool {
+	s.Lock()
+	s.expireKicks(time.Now())
+	_, ok := s.kicks[matchDataScratchKey{matchID: matchID, userID: userID}]
+	s.Unlock()
+	return ok
+}
+
+// expireKicks forgets kicks whose cooldown has ended. The caller must hold the lock.
+func (s *MatchDataScratch) expireKicks(now time.Time) {
+	for front := s.kickOrder.Front(); front != nil && !now.Before(front.Value.(*matchDataKick).expiresAt); front = s.kickOrder.Front() {
+		s.kickOrder.Remove(front)
+		delete(s.kicks, front.Value.(*matchDataKick).key)
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/gob"
+	"errors"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// topicHistoryScanLimit bounds how many messages one history call reads while looking for filter matches.
+const topicHistoryScanLimit = 1000
+
+// TopicMessageFilter narrows a topic's message history. Empty fields match every message.
+type TopicMessageFilter struct {
+	// UserID only matches messages sent by this user.
+	UserID []byte
+	// Contains only matches messages whose data contains this term, ignoring case.
+	Contains string
+}
+
+// TopicMessagesHistory returns a page of a topic's messages matching the filter, newest first, and a cursor for the
+// next page if there is one. The sender filter is applied by the query. Message data is stored as bytes so the term
+// filter is applied as rows are read, and at most topicHistoryScanLimit messages are read per call. A call that reaches
+// that bound returns the matches found so far, and a cursor to carry on from.
+func TopicMessagesHistory(logger *zap.Logger, db *sql.DB, topic *TopicId, filter *TopicMessageFilter, limit int64, cursor []byte) ([]*TopicMessage, []byte, error) {
+	if limit == 0 {
+		limit = 10
+	} else if limit < 1 || limit > 100 {
+		return nil, nil, errors.New("Limit must be between 1 and 100")
+	}
+	if filter == nil {
+		filter = &TopicMessageFilter{}
+	}
+
+	var topicBytes []byte
+	var topicType int64
+	switch topic.Id.(type) {
+	case *TopicId_Dm:
+		topicBytes = topic.GetDm()
+		topicType = 0
+	case *TopicId_Room:
+		topicBytes = topic.GetRoom()
+		topicType = 1
+	case *TopicId_GroupId:
+		topicBytes = topic.GetGroupId()
+		topicType = 2
+	default:
+		return nil, nil, errors.New("Topic ID is required")
+	}
+
+	var position *messageCursor
+	if len(cursor) != 0 {
+		position = &messageCursor{}
+		if err := gob.NewDecoder(bytes.NewReader(cursor)).Decode(position); err != nil {
+			return nil, nil, errors.New("Invalid cursor data")
+		}
+	}
+	term := strings.ToLower(filter.Contains)
+
+	// Select one extra match to find out if there is another page.
+	messages := make([]*TopicMessage, 0, limit+1)
+	scanned := 0
+	exhausted := false
+	for int64(len(messages)) <= limit && scanned < topicHistoryScanLimit {
+		query := "SELECT message_id, user_id, created_at, expires_at, handle, type, data FROM message WHERE topic = $1 AND topic_type = $2"
+		params := []interface{}{topicBytes, topicType}
+		if len(filter.UserID) != 0 {
+			params = append(params, filter.UserID)
+			query += " AND user_id = $" + strconv.Itoa(len(params))
+		}
+		if position != nil {
+			params = append(params, position.CreatedAt, position.MessageID, position.UserID)
+			query += " AND (created_at, message_id, user_id) < ($" + strconv.Itoa(len(params)-2) + ", $" + strconv.Itoa(len(params)-1) + ", $" + strconv.Itoa(len(params)) + ")"
+		}
+		params = append(params, limit+1)
+		query += " ORDER BY created_at DESC, message_id DESC, user_id DESC LIMIT $" + strconv.Itoa(len(params))
+
+		rows, err := db.Query(query, params...)
+		if err != nil {
+			logger.Error("Could not get topic message history", zap.Error(err))
+			return nil, nil, errors.New("Could not get topic message history")
+		}
+		read := int64(0)
+		for rows.Next() {
+			message := &TopicMessage{Topic: topic}
+			if err = rows.Scan(&message.MessageId, &message.UserId, &message.CreatedAt, &message.ExpiresAt, &message.Handle, &message.Type, &message.Data); err != nil {
+				rows.Close()
+				logger.Error("Error scanning topic message history", zap.Error(err))
+				return nil, nil, errors.New("Error scanning topic message history")
+			}
+			read++
+			scanned++
+			position = &messageCursor{MessageID: message.MessageId, UserID: message.UserId, CreatedAt: message.CreatedAt}
+			if term == "" || strings.Contains(strings.ToLower(string(message.Data)), term) {
+				messages = append(messages, message)
+				if int64(len(messages)) > limit {
+					break
+				}
+			}
+			if scanned >= topicHistoryScanLimit {
+				break
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			logger.Error("Error reading topic message history", zap.Error(err))
+			return nil, nil, errors.New("Could not read topic message history")
+		}
+		if read <= limit && int64(len(messages)) <= limit && scanned < topicHistoryScanLimit {
+			exhausted = true
+			break
+		}
+	}
+
+	var last *TopicMessage
+	if int64(len(messages)) > limit {
+		messages = messages[:limit]
+		last = messages[limit-1]
+	} else if !exhausted {
+		// The scan bound was reached, resume after the last message read rather than the last match.
+		last = &TopicMessage{MessageId: position.MessageID, UserId: position.UserID, CreatedAt: position.CreatedAt}
+	} else {
+		return messages, nil, nil
+	}
+
+	cursorBuf := new(bytes.Buffer)
+	if err := gob.NewEncoder(cursorBuf).Encode(&messageCursor{MessageID: last.MessageId, UserID: last.UserId, CreatedAt: last.CreatedAt}); err != nil {
+		logger.Error("Could not create topic message history cursor", zap.Error(err))
+		return nil, nil, err
+	}
+	return messages, cursorBuf.Bytes(), nil
+}
@@ -0,0 +1,56 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import "sync"
+
+const messageTranslationCacheMaxEntries = 10000
+
+// MessageTranslationCache keeps translated message data by original data and target locale, so a message seen by many
+// recipients with the same locale, or sent again, is only translated once. Each node has its own cache.
+type MessageTranslationCache struct {
+	sync.Mutex
+	entries map[messageTranslationKey][]byte
+}
+
+type messageTranslationKey struct {
+	data   string
+	locale string
+}
+
+func NewMessageTranslationCache() *MessageTranslationCache {
+	return &MessageTranslationCache{
+		entries: make(map[messageTranslationKey][]byte),
+	}
+}
+
+// Get returns the cached translation of the data into the locale, if there is one.
+func (c *MessageTranslationCache) Get(data []byte, locale string) ([]byte, bool) {
+	c.Lock()
+	translated, ok := c.entries[messageTranslationKey{data: string(data), locale: locale}]
+	c.Unlock()
+	return translated, ok
+}
+
+// Set caches the translation of the data into the locale.
+func (c *MessageTranslationCache) Set(data []byte, locale string, translated []byte) {
+	c.Lock()
+	// Start over rather than grow without bound, translations are cheap to redo compared to the memory they hold.
+	if len(c.entries) >= messageTranslationCacheMaxEntries {
+		c.entries = make(map[messageTranslationKey][]byte)
+	}
+	c.entries[messageTranslationKey{data: string(data), locale: locale}] = translated
+	c.Unlock()
+}
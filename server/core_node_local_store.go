@@ -0,0 +1,201 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"container/heap"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	nodeLocalKeyMaxBytes   = 128
+	nodeLocalValueMaxBytes = 16 * 1024
+	// New keys are rejected while a node's store holds this many unexpired keys.
+	nodeLocalMaxKeys = 100000
+)
+
+var (
+	// ErrNodeLocalKeyInvalid is returned for an empty key or a key over 128 bytes.
+	ErrNodeLocalKeyInvalid = errors.New("Node-local key must be set and at most 128 bytes")
+	// ErrNodeLocalValueTooLarge is returned for a value over 16KB.
+	ErrNodeLocalValueTooLarge = errors.New("Node-local value must be at most 16384 bytes")
+	// ErrNodeLocalNotInteger is returned when incrementing a key whose value is not an integer.
+	ErrNodeLocalNotInteger = errors.New("Node-local value is not an integer")
+	// ErrNodeLocalFull is returned when setting a new key while the store holds the most keys allowed.
+	ErrNodeLocalFull = errors.New("Node-local store is full")
+)
+
+// NodeLocalStore is a key value store in memory for transient state the runtime modules of one node share, such as
+// per-node counters, kept apart from the storage engine's user owned records. It is node-local: values are never
+// propagated to other nodes of a cluster, each node reads and writes its own keys, and all keys are lost when the node
+// stops. State that must agree across a cluster belongs in the storage engine. Each operation is atomic on the node.
+// Keys with a TTL are dropped soonest first from a heap as operations find them expired, so the store never scans every
+// key and holds at most nodeLocalMaxKeys unexpired keys.
+type NodeLocalStore struct {
+	sync.Mutex
+	entries map[string]*nodeLocalEntry
+	heap    nodeLocalEntryHeap
+}
+
+// NewNodeLocalStore creates an empty node-local store.
+func NewNodeLocalStore() *NodeLocalStore {
+	return &NodeLocalStore{
+		entries: make(map[string]*nodeLocalEntry),
+	}
+}
+
+// Get returns the value of a key, and false if it is not set or expired.
+func (s *NodeLocalStore) Get(key string) (string, bool, error) {
+	if err := validateNodeLocalKey(key); err != nil {
+		return "", false, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.expire(nowMs())
+	e, ok := s.entries[key]
+	if !ok {
+		return "", false, nil
+	}
+	return e.value, true, nil
+}
+
+// Set sets a key, expiring after the TTL or never if it is 0.
+func (s *NodeLocalStore) Set(key string, value string, ttl time.Duration) error {
+	if err := validateNodeLocalKey(key); err != nil {
+		return err
+	} else if len(value) > nodeLocalValueMaxBytes {
+		return ErrNodeLocalValueTooLarge
+	}
+
+	ts := nowMs()
+	expiresAt := int64(0)
+	if ttl > 0 {
+		expiresAt = ts + int64(ttl/time.Millisecond)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.expire(ts)
+	e, ok := s.entries[key]
+	if !ok {
+		if len(s.entries) >= nodeLocalMaxKeys {
+			return ErrNodeLocalFull
+		}
+		e = s.add(key)
+	}
+	e.value = value
+	s.setExpiry(e, expiresAt)
+	return nil
+}
+
+// Incr adds delta to the integer value of a key, treating a missing key as 0, and returns the result. A TTL above 0
+// sets the key to expire after it, 0 keeps the expiry the key has.
+func (s *NodeLocalStore) Incr(key string, delta int64, ttl time.Duration) (int64, error) {
+	if err := validateNodeLocalKey(key); err != nil {
+		return 0, err
+	}
+
+	ts := nowMs()
+	s.Lock()
+	defer s.Unlock()
+	s.expire(ts)
+	value := int64(0)
+	e, ok := s.entries[key]
+	if ok {
+		var err error
+		if value, err = strconv.ParseInt(e.value, 10, 64); err != nil {
+			return 0, ErrNodeLocalNotInteger
+		}
+	} else if len(s.entries) >= nodeLocalMaxKeys {
+		return 0, ErrNodeLocalFull
+	} else {
+		e = s.add(key)
+	}
+	value += delta
+	e.value = strconv.FormatInt(value, 10)
+	if ttl > 0 {
+		s.setExpiry(e, ts+int64(ttl/time.Millisecond))
+	}
+	return value, nil
+}
+
+func (s *NodeLocalStore) add(key string) *nodeLocalEntry {
+	e := &nodeLocalEntry{key: key, index: -1}
+	s.entries[key] = e
+	return e
+}
+
+// setExpiry sets when an entry expires, in milliseconds or never if 0, keeping only entries that expire on the heap.
+func (s *NodeLocalStore) setExpiry(e *nodeLocalEntry, expiresAt int64) {
+	e.expiresAt = expiresAt
+	switch {
+	case e.index < 0 && expiresAt > 0:
+		heap.Push(&s.heap, e)
+	case e.index >= 0 && expiresAt > 0:
+		heap.Fix(&s.heap, e.index)
+	case e.index >= 0:
+		heap.Remove(&s.heap, e.index)
+	}
+}
+
+func (s *NodeLocalStore) expire(now int64) {
+	for len(s.heap) > 0 && s.heap[0].expiresAt <= now {
+		e := heap.Pop(&s.heap).(*nodeLocalEntry)
+		delete(s.entries, e.key)
+	}
+}
+
+type nodeLocalEntry struct {
+	key       string
+	value     string
+	expiresAt int64
+	index     int
+}
+
+// nodeLocalEntryHeap orders entries that expire by expiry, soonest first.
+type nodeLocalEntryHeap []*nodeLocalEntry
+
+func (h nodeLocalEntryHeap) Len() int           { return len(h) }
+func (h nodeLocalEntryHeap) Less(i, j int) bool { return h[i].expiresAt < h[j].expiresAt }
+func (h nodeLocalEntryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *nodeLocalEntryHeap) Push(x interface{}) {
+	e := x.(*nodeLocalEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *nodeLocalEntryHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	e.index = -1
+	return e
+}
+
+func validateNodeLocalKey(key string) error {
+	if key == "" || len(key) > nodeLocalKeyMaxBytes {
+		return ErrNodeLocalKeyInvalid
+	}
+	return nil
+}
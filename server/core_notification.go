@@ -0,0 +1,806 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+const (
+	notificationSweepInterval = time.Minute
+
+	// Users matching a notification query are resolved and notified this many at a time, once per interval.
+	notificationQueryBatchSize     = 500
+	notificationQueryBatchInterval = time.Second
+
+	// Scheduled notifications are checked for once per interval, and delivered this many at a time.
+	notificationScheduleInterval  = time.Second
+	notificationScheduleBatchSize = 100
+
+	// Notifications are stored this many to a statement.
+	notificationStoreBatchSize = 100
+)
+
+const (
+	NOTIFICATION_DELIVER = "deliver"
+	NOTIFICATION_DEFER   = "defer"
+	NOTIFICATION_DROP    = "drop"
+)
+
+// NNotification is a notification as handled by the notification service.
+type NNotification struct {
+	Id         []byte
+	UserID     []byte
+	Subject    string
+	Content    []byte
+	Code       int64
+	SenderID   []byte
+	CreatedAt  int64
+	ExpiresAt  int64
+	ReadAt     int64
+	Persistent bool
+}
+
+type notificationsListCursor struct {
+	CreatedAt int64
+	Id        []byte
+}
+
+// NotificationService stores and delivers notifications, and periodically purges expired ones.
+type NotificationService struct {
+	logger        *zap.Logger
+	db            *sql.DB
+	tracker       Tracker
+	messageRouter MessageRouter
+	runtime       atomic.Value // *Runtime, set once the runtime is created.
+	stopCh        chan bool
+	stopOnce      sync.Once
+}
+
+func NewNotificationService(logger *zap.Logger, db *sql.DB, tracker Tracker, messageRouter MessageRouter) *NotificationService {
+	n := &NotificationService{
+		logger:        logger,
+		db:            db,
+		tracker:       tracker,
+		messageRouter: messageRouter,
+		stopCh:        make(chan bool),
+	}
+
+	go func() {
+		ticker := time.NewTicker(notificationSweepInterval)
+		defer ticker.Stop()
+		scheduleTicker := time.NewTicker(notificationScheduleInterval)
+		defer scheduleTicker.Stop()
+		for {
+			select {
+			case <-n.stopCh:
+				return
+			case <-ticker.C:
+				n.sweep()
+			case <-scheduleTicker.C:
+				n.deliverScheduled()
+			}
+		}
+	}()
+
+	return n
+}
+
+func (n *NotificationService) Stop() {
+	n.stopOnce.Do(func() {
+		close(n.stopCh)
+	})
+}
+
+// notificationDeferral is a notification the delivery function deferred, and when to deliver it.
+type notificationDeferral struct {
+	notification *NNotification
+	deliverAt    int64
+}
+
+// NotificationSend stores persistent notifications, then delivers all of them to their recipients if online.
+// Non-persistent notifications are never stored and are lost if the recipient is offline.
+func (n *NotificationService) NotificationSend(notifications []*NNotification) error {
+	_, _, err := n.send(notifications)
+	return err
+}
+
+// send stores and delivers notifications like NotificationSend, and returns how many recipients had a live session
+// and how many notifications were stored.
+func (n *NotificationService) send(notifications []*NNotification) (int, int, error) {
+	if err := n.prepare(notifications); err != nil {
+		return 0, 0, err
+	}
+	send, deferred, err := n.gate(notifications)
+	if err != nil {
+		return 0, 0, err
+	}
+	// Deferred and stored notifications are written together, so a failure leaves none of them behind.
+	if err = retryTx(n.logger, n.db, func(tx *sql.Tx) error {
+		if err := n.schedule(tx, deferred); err != nil {
+			return err
+		}
+		return n.store(tx, send)
+	}); err != nil {
+		return 0, 0, err
+	}
+	return n.deliver(send), notificationsPersistent(send), nil
+}
+
+// prepare fills in the defaults of notifications about to be sent, and validates them.
+func (n *NotificationService) prepare(notifications []*NNotification) error {
+	ts := nowMs()
+	for _, notification := range notifications {
+		if len(notification.Id) == 0 {
+			notification.Id = uuid.NewV4().Bytes()
+		}
+		if len(notification.Content) == 0 {
+			notification.Content = []byte("{}")
+		}
+		if notification.CreatedAt == 0 {
+			notification.CreatedAt = ts
+		}
+		if err := notification.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliver sends notifications to their recipients' live sessions, and returns how many recipients had one.
+func (n *NotificationService) deliver(notifications []*NNotification) int {
+	byUser := make(map[string][]*Notification)
+	for _, notification := range notifications {
+		userID := uuid.FromBytesOrNil(notification.UserID).String()
+		byUser[userID] = append(byUser[userID], notification.toProto())
+	}
+	delivered := 0
+	for userID, ns := range byUser {
+		ps := n.tracker.ListByTopic("notifications:" + userID)
+		if len(ps) == 0 {
+			continue
+		}
+		n.messageRouter.Send(n.logger, ps, &Envelope{Payload: &Envelope_LiveNotifications{LiveNotifications: &Notifications{Notifications: ns}}})
+		delivered++
+	}
+	return delivered
+}
+
+func notificationsPersistent(notifications []*NNotification) int {
+	stored := 0
+	for _, notification := range notifications {
+		if notification.Persistent {
+			stored++
+		}
+	}
+	return stored
+}
+
+// gate runs notifications through the runtime notification delivery function, which sees each recipient's language,
+// timezone, UTC offset and metadata to apply their preferences, such as quiet hours. Deferred notifications are
+// returned with the time the function gives and dropped ones are discarded, the rest are returned to be sent now.
+// Deferred notifications pass through the function again when they are due. Errors from the function are logged and
+// the notification is sent.
+func (n *NotificationService) gate(notifications []*NNotification) ([]*NNotification, []*notificationDeferral, error) {
+	runtime, _ := n.runtime.Load().(*Runtime)
+	if runtime == nil || len(notifications) == 0 || !runtime.IsRuntimeNotificationDeliveryRegistered() {
+		return notifications, nil, nil
+	}
+
+	recipients, err := n.recipients(notifications)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ts := nowMs()
+	send := make([]*NNotification, 0, len(notifications))
+	deferred := make([]*notificationDeferral, 0)
+	for _, notification := range notifications {
+		action, deliverAt, err := runtime.InvokeFunctionNotificationDelivery(notification, recipients[string(notification.UserID)])
+		if err != nil {
+			n.logger.Error("Runtime notification delivery function caused an error", zap.Error(err))
+			action = NOTIFICATION_DELIVER
+		}
+
+		if action == NOTIFICATION_DROP {
+			metrics.IncrCounter([]string{"notification", "dropped"}, 1)
+		} else if action == NOTIFICATION_DEFER && deliverAt > ts {
+			deferred = append(deferred, &notificationDeferral{notification: notification, deliverAt: deliverAt})
+			metrics.IncrCounter([]string{"notification", "deferred"}, 1)
+		} else {
+			send = append(send, notification)
+		}
+	}
+	return send, deferred, nil
+}
+
+// recipients loads the profile fields notification delivery preferences are based on, keyed by user ID.
+func (n *NotificationService) recipients(notifications []*NNotification) (map[string]map[string]interface{}, error) {
+	seen := make(map[string]bool, len(notifications))
+	params := make([]interface{}, 0, len(notifications))
+	for _, notification := range notifications {
+		if !seen[string(notification.UserID)] {
+			seen[string(notification.UserID)] = true
+			params = append(params, notification.UserID)
+		}
+	}
+
+	rows, err := n.db.Query("SELECT id, lang, timezone, utc_offset_ms, metadata FROM users WHERE id IN ("+notificationPlaceholders(0, len(params))+")", params...)
+	if err != nil {
+		n.logger.Error("Could not load notification recipients", zap.Error(err))
+		return nil, err
+	}
+	defer rows.Close()
+
+	recipients := make(map[string]map[string]interface{}, len(params))
+	for rows.Next() {
+		var id, metadataBytes []byte
+		var lang string
+		var timezone sql.NullString
+		var utcOffsetMs int64
+		if err = rows.Scan(&id, &lang, &timezone, &utcOffsetMs, &metadataBytes); err != nil {
+			n.logger.Error("Could not load notification recipients", zap.Error(err))
+			return nil, err
+		}
+		var metadata map[string]interface{}
+		json.Unmarshal(metadataBytes, &metadata)
+		recipients[string(id)] = map[string]interface{}{
+			"user_id":       uuid.FromBytesOrNil(id).String(),
+			"lang":          lang,
+			"timezone":      timezone.String,
+			"utc_offset_ms": utcOffsetMs,
+			"metadata":      metadata,
+		}
+	}
+	return recipients, rows.Err()
+}
+
+// store writes the persistent notifications in the transaction.
+func (n *NotificationService) store(tx *sql.Tx, notifications []*NNotification) error {
+	persistent := make([]*NNotification, 0, len(notifications))
+	for _, notification := range notifications {
+		if notification.Persistent {
+			persistent = append(persistent, notification)
+		}
+	}
+
+	// Insert several rows per statement, so large sends take few round trips.
+	for len(persistent) != 0 {
+		batch := persistent
+		if len(batch) > notificationStoreBatchSize {
+			batch = batch[:notificationStoreBatchSize]
+		}
+		persistent = persistent[len(batch):]
+
+		values := make([]string, 0, len(batch))
+		params := make([]interface{}, 0, len(batch)*8)
+		for _, notification := range batch {
+			var senderID interface{}
+			if len(notification.SenderID) != 0 {
+				senderID = notification.SenderID
+			}
+			values = append(values, "("+notificationPlaceholders(len(params), 8)+")")
+			params = append(params, notification.Id, notification.UserID, notification.Subject, notification.Content, notification.Code, senderID, notification.CreatedAt, notification.ExpiresAt)
+		}
+		_, err := tx.Exec("INSERT INTO notification (id, user_id, subject, content, code, sender_id, created_at, expires_at) VALUES "+strings.Join(values, ", "), params...)
+		if err != nil {
+			n.logger.Error("Could not store notification", zap.Error(err))
+			return err
+		}
+	}
+	return nil
+}
+
+// notificationPlaceholders returns count comma separated statement placeholders, numbered from after the first offset.
+func notificationPlaceholders(offset, count int) string {
+	placeholders := make([]string, count)
+	for i := range placeholders {
+		placeholders[i] = "$" + strconv.Itoa(offset+i+1)
+	}
+	return strings.Join(placeholders, ", ")
+}
+
+// NotificationsList returns a page of the user's stored notifications that have not expired, oldest first.
+func (n *NotificationService) NotificationsList(userID uuid.UUID, limit int64, cursor []byte) ([]*NNotification, []byte, error) {
+	if limit == 0 {
+		limit = 10
+	} else if limit < 10 || limit > 100 {
+		return nil, nil, errors.New("Limit must be between 10 and 100")
+	}
+
+	query := `SELECT id, subject, content, code, sender_id, created_at, expires_at, read_at FROM notification
+WHERE user_id = $1 AND (expires_at = 0 OR expires_at > $2)`
+	params := []interface{}{userID.Bytes(), nowMs()}
+	if len(cursor) != 0 {
+		incomingCursor := &notificationsListCursor{}
+		if err := gob.NewDecoder(bytes.NewReader(cursor)).Decode(incomingCursor); err != nil {
+			return nil, nil, errors.New("Invalid cursor data")
+		}
+		query += " AND (created_at, id) > ($3, $4)"
+		params = append(params, incomingCursor.CreatedAt, incomingCursor.Id)
+	}
+	// Select one extra row to find out if there is another page.
+	params = append(params, limit+1)
+	query += " ORDER BY created_at, id LIMIT $" + strconv.Itoa(len(params))
+
+	rows, err := n.db.Query(query, params...)
+	if err != nil {
+		n.logger.Error("Could not list notifications", zap.Error(err))
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	notifications := make([]*NNotification, 0)
+	var outgoingCursor []byte
+	for rows.Next() {
+		notification := &NNotification{UserID: userID.Bytes(), Persistent: true}
+		if err := rows.Scan(&notification.Id, &notification.Subject, &notification.Content, &notification.Code, &notification.SenderID, &notification.CreatedAt, &notification.ExpiresAt, &notification.ReadAt); err != nil {
+			n.logger.Error("Could not scan notification", zap.Error(err))
+			return nil, nil, err
+		}
+
+		if int64(len(notifications)) >= limit {
+			last := notifications[len(notifications)-1]
+			cursorBuf := new(bytes.Buffer)
+			if err := gob.NewEncoder(cursorBuf).Encode(&notificationsListCursor{CreatedAt: last.CreatedAt, Id: last.Id}); err != nil {
+				n.logger.Error("Could not create notifications list cursor", zap.Error(err))
+				return nil, nil, err
+			}
+			outgoingCursor = cursorBuf.Bytes()
+			break
+		}
+		notifications = append(notifications, notification)
+	}
+	if err := rows.Err(); err != nil {
+		n.logger.Error("Could not list notifications", zap.Error(err))
+		return nil, nil, err
+	}
+
+	return notifications, outgoingCursor, nil
+}
+
+// NotificationsRemove deletes stored notifications belonging to the given user.
+func (n *NotificationService) NotificationsRemove(userID uuid.UUID, notificationIDs [][]byte) error {
+	if len(notificationIDs) == 0 {
+		return errors.New("At least one notification ID is required")
+	}
+
+	for _, id := range notificationIDs {
+		if _, err := n.db.Exec("DELETE FROM notification WHERE user_id = $1 AND id = $2", userID.Bytes(), id); err != nil {
+			n.logger.Error("Could not remove notification", zap.Error(err))
+			return err
+		}
+	}
+	return nil
+}
+
+// NotificationCount returns how many of the user's stored notifications have not expired, and how many of those are
+// still unread, counting only notifications with one of the given codes if any are given. Both counts are read from a
+// single index over the user's notifications, so they stay cheap for large inboxes.
+func (n *NotificationService) NotificationCount(userID uuid.UUID, codes []int64) (int64, int64, error) {
+	query := `SELECT count(id), COALESCE(sum(CASE WHEN read_at = 0 THEN 1 ELSE 0 END), 0) FROM notification
+WHERE user_id = $1 AND (expires_at = 0 OR expires_at > $2)`
+	params := []interface{}{userID.Bytes(), nowMs()}
+	if len(codes) != 0 {
+		placeholders := make([]string, len(codes))
+		for i, code := range codes {
+			params = append(params, code)
+			placeholders[i] = "$" + strconv.Itoa(len(params))
+		}
+		query += " AND code IN (" + strings.Join(placeholders, ", ") + ")"
+	}
+
+	var total, unread int64
+	if err := n.db.QueryRow(query, params...).Scan(&total, &unread); err != nil {
+		n.logger.Error("Could not count notifications", zap.Error(err))
+		return 0, 0, err
+	}
+	return total, unread, nil
+}
+
+// NotificationsMarkRead marks stored notifications belonging to the given user as read. Notifications that were
+// already read keep the time they were first read.
+func (n *NotificationService) NotificationsMarkRead(userID uuid.UUID, notificationIDs [][]byte) error {
+	if len(notificationIDs) == 0 {
+		return errors.New("At least one notification ID is required")
+	}
+
+	ts := nowMs()
+	for _, id := range notificationIDs {
+		if _, err := n.db.Exec("UPDATE notification SET read_at = $3 WHERE user_id = $1 AND id = $2 AND read_at = 0", userID.Bytes(), id, ts); err != nil {
+			n.logger.Error("Could not mark notification as read", zap.Error(err))
+			return err
+		}
+	}
+	return nil
+}
+
+// NotificationQueryFilter selects the users a notification query sends to. Each field that is set narrows the users
+// selected, and disabled users are never selected. Values are always bound as query parameters.
+type NotificationQueryFilter struct {
+	// Users last online at or after this time in milliseconds.
+	LastOnlineAfter int64
+	// Users last online before this time in milliseconds.
+	LastOnlineBefore int64
+	// Users who registered at or after this time in milliseconds.
+	CreatedAfter int64
+	// Users who registered before this time in milliseconds.
+	CreatedBefore int64
+	Lang          string
+	Location      string
+	Timezone      string
+}
+
+// where returns the filter as the body of a WHERE clause over the users table, with the parameters it binds.
+func (f *NotificationQueryFilter) where() (string, []interface{}, error) {
+	if f == nil {
+		return "", nil, errors.New("Notification query filter must set at least one field")
+	}
+	clauses := []string{"disabled_at = 0"}
+	params := make([]interface{}, 0, 7)
+	add := func(clause string, param interface{}) {
+		params = append(params, param)
+		clauses = append(clauses, clause+" $"+strconv.Itoa(len(params)))
+	}
+	if f.LastOnlineAfter > 0 {
+		add("last_online_at >=", f.LastOnlineAfter)
+	}
+	if f.LastOnlineBefore > 0 {
+		add("last_online_at <", f.LastOnlineBefore)
+	}
+	if f.CreatedAfter > 0 {
+		add("created_at >=", f.CreatedAfter)
+	}
+	if f.CreatedBefore > 0 {
+		add("created_at <", f.CreatedBefore)
+	}
+	if f.Lang != "" {
+		add("lang =", f.Lang)
+	}
+	if f.Location != "" {
+		add("location =", f.Location)
+	}
+	if f.Timezone != "" {
+		add("timezone =", f.Timezone)
+	}
+	if len(params) == 0 {
+		return "", nil, errors.New("Notification query filter must set at least one field")
+	}
+	return strings.Join(clauses, " AND "), params, nil
+}
+
+// NotificationQueryCount returns how many users match the given filter.
+func (n *NotificationService) NotificationQueryCount(filter *NotificationQueryFilter) (int64, error) {
+	where, params, err := filter.where()
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+	if err := n.db.QueryRow("SELECT count(id) FROM users WHERE "+where, params...).Scan(&count); err != nil {
+		n.logger.Error("Could not count users matching notification query", zap.Error(err))
+		return 0, err
+	}
+	return count, nil
+}
+
+// NotificationQuery resolves the users matching the given filter in batches ordered by user ID, and calls send with
+// each batch. Only one batch of IDs is held in memory at a time, and batches are dispatched no faster than one per
+// notificationQueryBatchInterval. The first batch is resolved before returning so an invalid filter is reported to
+// the caller, the remaining batches are dispatched in the background until done or the service is stopped.
+func (n *NotificationService) NotificationQuery(filter *NotificationQueryFilter, send func(userIDs [][]byte) error) error {
+	userIDs, err := n.NotificationQueryUsers(filter, nil, notificationQueryBatchSize)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(notificationQueryBatchInterval)
+		defer ticker.Stop()
+		var sent int
+		for len(userIDs) != 0 {
+			if err := send(userIDs); err != nil {
+				n.logger.Error("Could not send notification batch, stopping notification query", zap.Error(err), zap.Int("sent", sent))
+				return
+			}
+			sent += len(userIDs)
+			if len(userIDs) < notificationQueryBatchSize {
+				break
+			}
+
+			select {
+			case <-n.stopCh:
+				n.logger.Warn("Notification query interrupted by shutdown", zap.Int("sent", sent))
+				return
+			case <-ticker.C:
+			}
+
+			if userIDs, err = n.NotificationQueryUsers(filter, userIDs[len(userIDs)-1], notificationQueryBatchSize); err != nil {
+				n.logger.Error("Could not resolve notification batch, stopping notification query", zap.Error(err), zap.Int("sent", sent))
+				return
+			}
+		}
+		n.logger.Debug("Notification query complete", zap.Int("sent", sent))
+	}()
+
+	return nil
+}
+
+// NotificationQueryUsers returns up to limit IDs of users matching the filter, ordered by user ID and starting after
+// the given ID, or from the first if it is nil.
+func (n *NotificationService) NotificationQueryUsers(filter *NotificationQueryFilter, after []byte, limit int) ([][]byte, error) {
+	where, params, err := filter.where()
+	if err != nil {
+		return nil, err
+	}
+	query := "SELECT id FROM users WHERE " + where
+	if after != nil {
+		params = append(params, after)
+		query += " AND id > $" + strconv.Itoa(len(params))
+	}
+	params = append(params, limit)
+	query += " ORDER BY id LIMIT $" + strconv.Itoa(len(params))
+
+	rows, err := n.db.Query(query, params...)
+	if err != nil {
+		n.logger.Error("Could not resolve users matching notification query", zap.Error(err))
+		return nil, err
+	}
+	defer rows.Close()
+
+	userIDs := make([][]byte, 0, limit)
+	for rows.Next() {
+		var userID []byte
+		if err := rows.Scan(&userID); err != nil {
+			n.logger.Error("Could not scan user ID matching notification query", zap.Error(err))
+			return nil, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	if err := rows.Err(); err != nil {
+		n.logger.Error("Could not resolve users matching notification query", zap.Error(err))
+		return nil, err
+	}
+	return userIDs, nil
+}
+
+// NotificationSchedule stores a notification to be sent once the delivery time in milliseconds is reached. Scheduled
+// notifications are kept in the database, so they are still delivered if the server restarts before they are due.
+func (n *NotificationService) NotificationSchedule(notification *NNotification, deliverAt int64) error {
+	if len(notification.Id) == 0 {
+		notification.Id = uuid.NewV4().Bytes()
+	}
+	if len(notification.Content) == 0 {
+		notification.Content = []byte("{}")
+	}
+	if err := notification.validate(); err != nil {
+		return err
+	}
+	if deliverAt <= 0 {
+		return errors.New("Notification delivery time must be greater than 0")
+	}
+
+	return retryTx(n.logger, n.db, func(tx *sql.Tx) error {
+		return n.schedule(tx, []*notificationDeferral{&notificationDeferral{notification: notification, deliverAt: deliverAt}})
+	})
+}
+
+// schedule writes the deferred notifications to the schedule in the transaction. Their creation and expiry times are
+// kept, so they are delivered with the expiry they were given when first sent or scheduled.
+func (n *NotificationService) schedule(tx *sql.Tx, deferred []*notificationDeferral) error {
+	ts := nowMs()
+	for _, d := range deferred {
+		var senderID interface{}
+		if len(d.notification.SenderID) != 0 {
+			senderID = d.notification.SenderID
+		}
+		createdAt := d.notification.CreatedAt
+		if createdAt == 0 {
+			createdAt = ts
+		}
+		_, err := tx.Exec(`INSERT INTO notification_schedule (id, user_id, subject, content, code, sender_id, persistent, created_at, deliver_at, expires_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+			d.notification.Id, d.notification.UserID, d.notification.Subject, d.notification.Content, d.notification.Code, senderID, d.notification.Persistent, createdAt, d.deliverAt, d.notification.ExpiresAt)
+		if err != nil {
+			n.logger.Error("Could not schedule notification", zap.Error(err))
+			return err
+		}
+	}
+	return nil
+}
+
+// NotificationScheduleCancel removes a scheduled notification, and returns false if it was not found because it was
+// already delivered or cancelled.
+func (n *NotificationService) NotificationScheduleCancel(notificationID []byte) (bool, error) {
+	res, err := n.db.Exec("DELETE FROM notification_schedule WHERE id = $1", notificationID)
+	if err != nil {
+		n.logger.Error("Could not cancel scheduled notification", zap.Error(err))
+		return false, err
+	}
+	rowsAffected, _ := res.RowsAffected()
+	return rowsAffected != 0, nil
+}
+
+// deliverScheduled sends scheduled notifications that are due. Each batch is removed from the schedule in the same
+// transaction that stores it, so a notification is delivered by only one node even if several deliver scheduled
+// notifications at the same time, and a failed delivery leaves the batch scheduled to be tried again. Notifications
+// that expired while scheduled are discarded. The batch is passed to the runtime notification delivery function before
+// the transaction opens, so the function runs once per batch however many times the transaction is retried.
+func (n *NotificationService) deliverScheduled() {
+	for {
+		notifications, err := n.dueScheduled()
+		if err != nil {
+			n.logger.Error("Could not read scheduled notifications", zap.Error(err))
+			return
+		}
+		due := len(notifications)
+		unexpired := notificationsUnexpired(notifications, nowMs())
+		if err = n.prepare(unexpired); err != nil {
+			n.logger.Error("Could not deliver scheduled notifications", zap.Error(err))
+			return
+		}
+		send, deferred, err := n.gate(unexpired)
+		if err != nil {
+			n.logger.Error("Could not deliver scheduled notifications", zap.Error(err))
+			return
+		}
+
+		var delivered []*NNotification
+		err = retryTx(n.logger, n.db, func(tx *sql.Tx) error {
+			claimed, err := n.claimScheduled(tx, notifications)
+			if err != nil {
+				return err
+			}
+			// Notifications another node claimed first are left to it.
+			delivered = make([]*NNotification, 0, len(send))
+			for _, notification := range send {
+				if claimed[string(notification.Id)] {
+					delivered = append(delivered, notification)
+				}
+			}
+			rescheduled := make([]*notificationDeferral, 0, len(deferred))
+			for _, d := range deferred {
+				if claimed[string(d.notification.Id)] {
+					rescheduled = append(rescheduled, d)
+				}
+			}
+			if err = n.schedule(tx, rescheduled); err != nil {
+				return err
+			}
+			return n.store(tx, delivered)
+		})
+		if err != nil {
+			n.logger.Error("Could not deliver scheduled notifications", zap.Error(err))
+			return
+		}
+
+		n.deliver(delivered)
+		if due < notificationScheduleBatchSize {
+			return
+		}
+	}
+}
+
+// dueScheduled reads a batch of due notifications from the schedule, without claiming them.
+func (n *NotificationService) dueScheduled() ([]*NNotification, error) {
+	rows, err := n.db.Query(`SELECT id, user_id, subject, content, code, sender_id, persistent, created_at, expires_at
+FROM notification_schedule WHERE deliver_at <= $1 ORDER BY deliver_at LIMIT $2`, nowMs(), notificationScheduleBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notifications := make([]*NNotification, 0)
+	for rows.Next() {
+		notification := &NNotification{}
+		if err = rows.Scan(&notification.Id, &notification.UserID, &notification.Subject, &notification.Content, &notification.Code, &notification.SenderID, &notification.Persistent, &notification.CreatedAt, &notification.ExpiresAt); err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, notification)
+	}
+	return notifications, rows.Err()
+}
+
+// claimScheduled removes notifications from the schedule in the transaction, and returns the IDs of those that were
+// still scheduled.
+func (n *NotificationService) claimScheduled(tx *sql.Tx, notifications []*NNotification) (map[string]bool, error) {
+	claimed := make(map[string]bool, len(notifications))
+	if len(notifications) == 0 {
+		return claimed, nil
+	}
+	params := make([]interface{}, 0, len(notifications))
+	for _, notification := range notifications {
+		params = append(params, notification.Id)
+	}
+	rows, err := tx.Query("DELETE FROM notification_schedule WHERE id IN ("+notificationPlaceholders(0, len(params))+") RETURNING id", params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id []byte
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		claimed[string(id)] = true
+	}
+	return claimed, rows.Err()
+}
+
+// notificationsUnexpired returns the notifications that have not expired by the given time.
+func notificationsUnexpired(notifications []*NNotification, ts int64) []*NNotification {
+	unexpired := make([]*NNotification, 0, len(notifications))
+	for _, notification := range notifications {
+		if notification.ExpiresAt > 0 && notification.ExpiresAt <= ts {
+			metrics.IncrCounter([]string{"notification", "expired"}, 1)
+			continue
+		}
+		unexpired = append(unexpired, notification)
+	}
+	return unexpired
+}
+
+func (n *NotificationService) sweep() {
+	res, err := n.db.Exec("DELETE FROM notification WHERE expires_at > 0 AND expires_at <= $1", nowMs())
+	if err != nil {
+		n.logger.Error("Could not purge expired notifications", zap.Error(err))
+		return
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected != 0 {
+		n.logger.Debug("Purged expired notifications", zap.Int64("count", rowsAffected))
+	}
+}
+
+func (n *NNotification) validate() error {
+	if _, err := uuid.FromBytes(n.UserID); err != nil {
+		return errors.New("Invalid notification user ID")
+	}
+	if n.Subject == "" {
+		return errors.New("Notification subject must not be empty")
+	}
+	var maybeJSON map[string]interface{}
+	if json.Unmarshal(n.Content, &maybeJSON) != nil {
+		return errors.New("Notification content must be a valid JSON object")
+	}
+	return nil
+}
+
+func (n *NNotification) toProto() *Notification {
+	return &Notification{
+		Id:         n.Id,
+		Subject:    n.Subject,
+		Content:    n.Content,
+		Code:       n.Code,
+		SenderId:   n.SenderID,
+		CreatedAt:  n.CreatedAt,
+		ExpiresAt:  n.ExpiresAt,
+		ReadAt:     n.ReadAt,
+		Persistent: n.Persistent,
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const oneTimeTokenSweepInterval = time.Minute
+
+// ErrOneTimeTokenInvalid is returned when a one-time token does not exist, has expired, or was already consumed.
+var ErrOneTimeTokenInvalid = errors.New("One-time token is invalid or expired")
+
+// OneTimeTokenCreate stores a payload behind a new random token that can be consumed once before the TTL runs out.
+// Only a hash of the token is stored, so tokens cannot be recovered from the database.
+func OneTimeTokenCreate(logger *zap.Logger, db *sql.DB, payload []byte, ttl time.Duration) (string, error) {
+	if ttl <= 0 {
+		return "", errors.New("One-time token TTL must be greater than 0")
+	}
+	if len(payload) == 0 {
+		payload = []byte("{}")
+	}
+	var maybeJSON map[string]interface{}
+	if json.Unmarshal(payload, &maybeJSON) != nil {
+		return "", errors.New("One-time token payload must be a valid JSON object")
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		logger.Error("Could not generate one-time token", zap.Error(err))
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	ts := nowMs()
+	_, err := db.Exec("INSERT INTO one_time_token (id, payload, created_at, expires_at) VALUES ($1, $2, $3, $4)",
+		oneTimeTokenID(token), payload, ts, ts+int64(ttl/time.Millisecond))
+	if err != nil {
+		logger.Error("Could not store one-time token", zap.Error(err))
+		return "", err
+	}
+	return token, nil
+}
+
+// OneTimeTokenConsume returns the payload of a token and deletes it in the same statement, so concurrent attempts to
+// consume the same token cannot both succeed.
+func OneTimeTokenConsume(logger *zap.Logger, db *sql.DB, token string) ([]byte, error) {
+	if token == "" {
+		return nil, ErrOneTimeTokenInvalid
+	}
+
+	var payload []byte
+	err := db.QueryRow("DELETE FROM one_time_token WHERE id = $1 AND expires_at > $2 RETURNING payload", oneTimeTokenID(token), nowMs()).Scan(&payload)
+	if err == sql.ErrNoRows {
+		return nil, ErrOneTimeTokenInvalid
+	} else if err != nil {
+		logger.Error("Could not consume one-time token", zap.Error(err))
+		return nil, err
+	}
+	return payload, nil
+}
+
+func oneTimeTokenID(token string) []byte {
+	id := sha256.Sum256([]byte(token))
+	return id[:]
+}
+
+// OneTimeTokenSweeper periodically purges expired one-time tokens, they can no longer be consumed anyway.
+type OneTimeTokenSweeper struct {
+	logger   *zap.Logger
+	db       *sql.DB
+	stopCh   chan bool
+	stopOnce sync.Once
+}
+
+func NewOneTimeTokenSweeper(logger *zap.Logger, db *sql.DB) *OneTimeTokenSweeper {
+	s := &OneTimeTokenSweeper{
+		logger: logger,
+		db:     db,
+		stopCh: make(chan bool),
+	}
+
+	go func() {
+		ticker := time.NewTicker(oneTimeTokenSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stopCh:
+				return
+			case <-ticker.C:
+				s.sweep()
+			}
+		}
+	}()
+
+	return s
+}
+
+func (s *OneTimeTokenSweeper) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stopCh)
+	})
+}
+
+func (s *OneTimeTokenSweeper) sweep() {
+	res, err := s.db.Exec("DELETE FROM one_time_token WHERE expires_at <= $1", nowMs())
+	if err != nil {
+		s.logger.Error("Could not purge expired one-time tokens", zap.Error(err))
+		return
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected != 0 {
+		s.logger.Debug("Purged expired one-time tokens", zap.Int64("count", rowsAffected))
+	}
+}
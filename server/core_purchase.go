@@ -0,0 +1,66 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+// ErrPurchaseReceiptUsed is returned when a receipt has already been used to grant items.
+var ErrPurchaseReceiptUsed = errors.New("Purchase receipt was already used")
+
+// PurchaseGrant writes the grants of a verified purchase and records its receipt in the same transaction, so a receipt
+// grants items at most once however many times it is submitted. Grants are written with server authority. Only a
+// hash of the receipt is stored.
+func PurchaseGrant(logger *zap.Logger, db *sql.DB, router *StorageRouter, userID uuid.UUID, store, productID, receipt string, grants []*StorageData) ([]*StorageKey, Error_Code, error) {
+	if store == "" || len(store) > 64 {
+		return nil, BAD_INPUT, errors.New("Purchase store must be set and at most 64 characters")
+	}
+	if productID == "" || len(productID) > 128 {
+		return nil, BAD_INPUT, errors.New("Purchase product ID must be set and at most 128 characters")
+	}
+	if receipt == "" {
+		return nil, BAD_INPUT, errors.New("Purchase receipt must be set")
+	}
+	if len(grants) == 0 {
+		return nil, RUNTIME_FUNCTION_EXCEPTION, errors.New("Purchase validation returned no storage writes to grant")
+	}
+
+	id := purchaseReceiptID(store, receipt)
+	keys, _, code, err := storageWriteTx(logger, db, router, uuid.Nil, grants, nil, "", 0, func(tx *sql.Tx) (Error_Code, error) {
+		res, err := tx.Exec(`INSERT INTO purchase_receipt (id, user_id, store, product_id, created_at)
+VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (id) DO NOTHING`, id, userID.Bytes(), store, productID, nowMs())
+		if err != nil {
+			logger.Error("Could not record purchase receipt", zap.Error(err))
+			return RUNTIME_EXCEPTION, errors.New("Could not record purchase receipt")
+		}
+		if rowsAffected, _ := res.RowsAffected(); rowsAffected != 1 {
+			return PURCHASE_RECEIPT_USED, ErrPurchaseReceiptUsed
+		}
+		return 0, nil
+	})
+	return keys, code, err
+}
+
+func purchaseReceiptID(store, receipt string) []byte {
+	id := sha256.Sum256([]byte(store + ":" + receipt))
+	return id[:]
+}
@@ -0,0 +1,115 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+type bufferedPush struct {
+	push      *RpcPush
+	expiresAt int64
+}
+
+// PushService delivers runtime pushes to the live sessions of a user. Pushes to a user with no sessions are dropped,
+// or held in memory on this node until one of the user's sessions connects if the sender asks for it.
+type PushService struct {
+	sync.Mutex
+	logger        *zap.Logger
+	tracker       Tracker
+	messageRouter MessageRouter
+	bufferSize    int
+	bufferExpiry  int64
+	buffered      map[uuid.UUID][]*bufferedPush
+	sweptAt       int64
+}
+
+func NewPushService(logger *zap.Logger, tracker Tracker, messageRouter MessageRouter, config *RuntimeConfig) *PushService {
+	return &PushService{
+		logger:        logger,
+		tracker:       tracker,
+		messageRouter: messageRouter,
+		bufferSize:    config.PushBufferSize,
+		bufferExpiry:  config.PushBufferExpiryMs,
+		buffered:      make(map[uuid.UUID][]*bufferedPush),
+	}
+}
+
+// Push sends a push to all of the user's sessions, and returns false if the user had none. If buffer is set, a push
+// that is not delivered is kept for the configured expiry, and the oldest pushes are dropped once a user has more than
+// the configured buffer size waiting.
+func (s *PushService) Push(userID uuid.UUID, id string, payload []byte, buffer bool) bool {
+	push := &RpcPush{Id: id, Payload: payload}
+	ps := s.tracker.ListByTopic("notifications:" + userID.String())
+	if len(ps) != 0 {
+		s.messageRouter.Send(s.logger, ps, &Envelope{Payload: &Envelope_RpcPush{RpcPush: push}})
+		return true
+	}
+	if !buffer || s.bufferSize <= 0 || s.bufferExpiry <= 0 {
+		return false
+	}
+
+	ts := nowMs()
+	s.Lock()
+	s.sweep(ts)
+	pushes := append(s.buffered[userID], &bufferedPush{push: push, expiresAt: ts + s.bufferExpiry})
+	if len(pushes) > s.bufferSize {
+		pushes = pushes[len(pushes)-s.bufferSize:]
+	}
+	s.buffered[userID] = pushes
+	s.Unlock()
+	return false
+}
+
+// HandleDiff is a tracker diff listener, it delivers buffered pushes to the first session of a user that connects.
+func (s *PushService) HandleDiff(joins, leaves []Presence) {
+	for _, p := range joins {
+		if p.Topic != "notifications:"+p.UserID.String() {
+			continue
+		}
+
+		s.Lock()
+		pushes, ok := s.buffered[p.UserID]
+		delete(s.buffered, p.UserID)
+		s.Unlock()
+		if !ok {
+			continue
+		}
+
+		ts := nowMs()
+		for _, bp := range pushes {
+			if bp.expiresAt > ts {
+				s.messageRouter.Send(s.logger, []Presence{p}, &Envelope{Payload: &Envelope_RpcPush{RpcPush: bp.push}})
+			}
+		}
+	}
+}
+
+// sweep drops the buffers of users who have not connected before all their pushes expired. It runs at most once per
+// expiry period, and the caller must hold the lock.
+func (s *PushService) sweep(ts int64) {
+	if ts-s.sweptAt < s.bufferExpiry {
+		return
+	}
+	s.sweptAt = ts
+	for userID, pushes := range s.buffered {
+		if pushes[len(pushes)-1].expiresAt <= ts {
+			delete(s.buffered, userID)
+		}
+	}
+}
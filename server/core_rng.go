@@ -0,0 +1,180 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrRngCommitmentNotFound is returned when a commitment does not exist.
+	ErrRngCommitmentNotFound = errors.New("RNG commitment not found")
+	// ErrRngCommitmentUsed is returned when rolling with a commitment that was already rolled or revealed.
+	ErrRngCommitmentUsed = errors.New("RNG commitment was already used")
+)
+
+// RngCommitment is a server seed committed to before an outcome is rolled with it. Only the commitment, a SHA-256 hash
+// of the seed, is shown before the seed is revealed.
+type RngCommitment struct {
+	Id         []byte
+	UserID     []byte
+	Seed       []byte
+	Commitment []byte
+	ClientSeed string
+	Sides      int64
+	Results    []int64
+	CreatedAt  int64
+	RolledAt   int64
+	RevealedAt int64
+}
+
+// SecureRandom returns n bytes from the operating system's cryptographically secure random source.
+func SecureRandom(n int) ([]byte, error) {
+	if n < 1 || n > 1024 {
+		return nil, errors.New("Random byte count must be between 1 and 1024")
+	}
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// RngCommit creates and stores a secret seed for the user, and returns the commitment ID and the commitment to show
+// them before anything is rolled.
+func RngCommit(logger *zap.Logger, db *sql.DB, userID uuid.UUID) ([]byte, []byte, error) {
+	seed, err := SecureRandom(32)
+	if err != nil {
+		logger.Error("Could not generate RNG seed", zap.Error(err))
+		return nil, nil, err
+	}
+	commitment := sha256.Sum256(seed)
+
+	id := uuid.NewV4().Bytes()
+	_, err = db.Exec("INSERT INTO rng_commitment (id, user_id, seed, commitment, created_at) VALUES ($1, $2, $3, $4, $5)",
+		id, userID.Bytes(), seed, commitment[:], nowMs())
+	if err != nil {
+		logger.Error("Could not store RNG commitment", zap.Error(err))
+		return nil, nil, err
+	}
+	return id, commitment[:], nil
+}
+
+// RngRoll rolls count dice with the given number of sides using a commitment's seed and a seed chosen by the client,
+// and records the outcome. Each commitment can be rolled once, before it is revealed, so neither side can choose their
+// seed knowing the other's.
+func RngRoll(logger *zap.Logger, db *sql.DB, id []byte, clientSeed string, sides, count int64) ([]int64, error) {
+	if len(clientSeed) > 128 {
+		return nil, errors.New("Client seed must be at most 128 characters")
+	}
+	if sides < 2 {
+		return nil, errors.New("Dice must have at least 2 sides")
+	}
+	if count < 1 || count > 100 {
+		return nil, errors.New("Dice count must be between 1 and 100")
+	}
+
+	var seed []byte
+	var rolledAt, revealedAt int64
+	err := db.QueryRow("SELECT seed, rolled_at, revealed_at FROM rng_commitment WHERE id = $1", id).Scan(&seed, &rolledAt, &revealedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrRngCommitmentNotFound
+	} else if err != nil {
+		logger.Error("Could not read RNG commitment", zap.Error(err))
+		return nil, err
+	}
+	if rolledAt != 0 || revealedAt != 0 {
+		return nil, ErrRngCommitmentUsed
+	}
+
+	results := RngResults(seed, clientSeed, sides, count)
+	resultsJSON, _ := json.Marshal(results)
+	res, err := db.Exec(`UPDATE rng_commitment SET client_seed = $1, sides = $2, results = $3, rolled_at = $4
+WHERE id = $5 AND rolled_at = 0 AND revealed_at = 0`, clientSeed, sides, resultsJSON, nowMs(), id)
+	if err != nil {
+		logger.Error("Could not record RNG roll", zap.Error(err))
+		return nil, err
+	}
+	// Guard against a concurrent roll or reveal of the same commitment.
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		return nil, ErrRngCommitmentUsed
+	}
+	return results, nil
+}
+
+// RngReveal marks a commitment revealed and returns it with its seed, so the outcome can be checked against the
+// commitment shown beforehand. A commitment revealed before it was rolled can no longer be rolled.
+func RngReveal(logger *zap.Logger, db *sql.DB, id []byte) (*RngCommitment, error) {
+	if _, err := db.Exec("UPDATE rng_commitment SET revealed_at = $1 WHERE id = $2 AND revealed_at = 0", nowMs(), id); err != nil {
+		logger.Error("Could not reveal RNG commitment", zap.Error(err))
+		return nil, err
+	}
+
+	c := &RngCommitment{Id: id}
+	var results []byte
+	err := db.QueryRow(`SELECT user_id, seed, commitment, client_seed, sides, results, created_at, rolled_at, revealed_at
+FROM rng_commitment WHERE id = $1`, id).Scan(&c.UserID, &c.Seed, &c.Commitment, &c.ClientSeed, &c.Sides, &results, &c.CreatedAt, &c.RolledAt, &c.RevealedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrRngCommitmentNotFound
+	} else if err != nil {
+		logger.Error("Could not read RNG commitment", zap.Error(err))
+		return nil, err
+	}
+	if err = json.Unmarshal(results, &c.Results); err != nil {
+		logger.Error("Could not decode RNG results", zap.Error(err))
+		return nil, err
+	}
+	return c, nil
+}
+
+// RngVerify checks a revealed seed against the commitment shown before the roll, and returns the results the seeds
+// produce. It needs no stored state, so clients can run the same check.
+func RngVerify(commitment, seed []byte, clientSeed string, sides, count int64) ([]int64, bool) {
+	expected := sha256.Sum256(seed)
+	if !hmac.Equal(expected[:], commitment) || sides < 2 || count < 1 || count > 100 {
+		return nil, false
+	}
+	return RngResults(seed, clientSeed, sides, count), true
+}
+
+// RngResults derives dice rolls from the seeds. Roll i is HMAC-SHA256 keyed by the server seed over
+// "<client seed>:<i>:<attempt>", read as a big endian unsigned 64 bit integer. Values in the incomplete range at the top
+// are rejected and the next attempt is used, so every side is equally likely. Rolls start at 1.
+func RngResults(seed []byte, clientSeed string, sides, count int64) []int64 {
+	limit := ^uint64(0) - ^uint64(0)%uint64(sides)
+	results := make([]int64, count)
+	for i := int64(0); i < count; i++ {
+		for attempt := 0; ; attempt++ {
+			mac := hmac.New(sha256.New, seed)
+			mac.Write([]byte(clientSeed + ":" + strconv.FormatInt(i, 10) + ":" + strconv.Itoa(attempt)))
+			v := binary.BigEndian.Uint64(mac.Sum(nil))
+			if v < limit {
+				results[i] = int64(v%uint64(sides)) + 1
+				break
+			}
+		}
+	}
+	return results
+}
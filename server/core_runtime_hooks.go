@@ -16,62 +16,182 @@ package server
 
 import (
 	"bytes"
+	"database/sql"
 	"encoding/json"
+	"errors"
 
 	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
 	"strings"
+	"time"
 
+	"github.com/armon/go-metrics"
 	"github.com/gogo/protobuf/jsonpb"
 	"github.com/satori/go.uuid"
 	"go.uber.org/zap"
 )
 
-func RuntimeBeforeHook(runtime *Runtime, jsonpbMarshaler *jsonpb.Marshaler, jsonpbUnmarshaler *jsonpb.Unmarshaler, messageType string, envelope *Envelope, session *session) (*Envelope, error) {
+// matchPresenceMetadataMaxBytes is the largest JSON metadata the runtime match join function may set on a presence.
+const matchPresenceMetadataMaxBytes = 1024
+
+// ErrMatchJoinRejected is returned when the runtime match join function turns a user away from a match.
+var ErrMatchJoinRejected = errors.New("Match join rejected")
+
+// MatchCreateRejectedError is returned when the runtime match create function rejects the parameters a client asked
+// to create a match with.
+type MatchCreateRejectedError struct {
+	Reason string
+}
+
+func (e *MatchCreateRejectedError) Error() string {
+	if e.Reason == "" {
+		return "Match create rejected"
+	}
+	return "Match create rejected: " + e.Reason
+}
+
+// TournamentJoinRejectedError is returned when the runtime tournament join function turns a user away from a
+// tournament.
+type TournamentJoinRejectedError struct {
+	Reason string
+}
+
+func (e *TournamentJoinRejectedError) Error() string {
+	if e.Reason == "" {
+		return "Tournament join rejected"
+	}
+	return "Tournament join rejected: " + e.Reason
+}
+
+// runtimeHookGlobal is the message name used to register hooks that apply to every message.
+const runtimeHookGlobal = "*"
+
+// RuntimeBeforeHook runs the before function registered for the message type, if any. Along with the resulting envelope it
+// returns any side effect storage writes the function requested, these must be committed together with the message's own operation,
+// and any stream subscriptions to apply to the session. If the function causes an error and a before fallback function is
+// registered, the fallback runs on the original envelope in its place and its result or error is used instead. A validation
+// error raised by the function is a rejection of the message, not a fault, and is returned without running the fallback.
+func RuntimeBeforeHook(runtime *Runtime, jsonpbMarshaler *jsonpb.Marshaler, jsonpbUnmarshaler *jsonpb.Unmarshaler, messageType string, envelope *Envelope, session *session) (*Envelope, []*StorageData, *StreamDirective, error) {
 	fn := runtime.GetRuntimeCallback(BEFORE, messageType)
 	if fn == nil {
-		return envelope, nil
+		return envelope, nil, nil, nil
 	}
 
 	strEnvelope, err := jsonpbMarshaler.MarshalToString(envelope)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 
 	var jsonEnvelope map[string]interface{}
 	if err = json.Unmarshal([]byte(strEnvelope), &jsonEnvelope); err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 
 	userId := uuid.Nil
 	handle := ""
 	expiry := int64(0)
+	clientVersion := ""
 	if session != nil {
 		userId = session.userID
 		handle = session.handle.Load()
 		expiry = session.expiry
+		clientVersion = session.clientVersion
+	}
+
+	var ctxValues map[string]interface{}
+	if session != nil {
+		// The last sequence accepted from the session, so hooks can enforce their own ordering rules on the envelope's.
+		ctxValues = map[string]interface{}{
+			__CTX_SEQUENCE_LAST: session.sequence.Last(),
+		}
+
+		// Before hooks registered for them see the user's flags, so they can branch on experiments without a database read.
+		if runtime.IsRuntimeBeforeUserFlags(messageType) {
+			flags, err := runtime.userFlagCache.Get(session.userID)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			ctxFlags := make(map[string]interface{}, len(flags))
+			for k, v := range flags {
+				ctxFlags[k] = v
+			}
+			ctxValues[__CTX_USER_FLAGS] = ctxFlags
+		}
+
+		// Storage write hooks see the user's current storage usage, so they can enforce quotas.
+		if messageType == "StorageWrite" {
+			usage, err := runtime.storageUsageCache.Get(session.userID)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			ctxValues[__CTX_STORAGE_COUNT] = usage.Count
+			ctxValues[__CTX_STORAGE_BYTES] = usage.Bytes
+		}
+	}
+
+	// Purchase hooks see the receipt to verify with the store, and reject the purchase by raising an error.
+	if purchase := envelope.GetPurchaseValidate(); purchase != nil {
+		if ctxValues == nil {
+			ctxValues = make(map[string]interface{}, 3)
+		}
+		ctxValues[__CTX_PURCHASE_STORE] = purchase.Store
+		ctxValues[__CTX_PURCHASE_PRODUCT] = purchase.ProductId
+		ctxValues[__CTX_PURCHASE_RECEIPT] = purchase.Receipt
 	}
 
-	result, fnErr := runtime.InvokeFunctionBefore(fn, userId, handle, expiry, jsonEnvelope)
+	span := runtime.tracer.Start(nil, "runtime.before", map[string]interface{}{"message_type": messageType, "user_id": userId.String()})
+	result, writes, directive, fnErr := runtime.invokeFunctionBefore(span, fn, userId, handle, expiry, clientVersion, ctxValues, jsonEnvelope)
 	if fnErr != nil {
-		return nil, fnErr
+		fallbackFn := runtime.GetRuntimeFallback(BEFORE, messageType)
+		if _, ok := fnErr.(*RuntimeValidationError); ok || fallbackFn == nil {
+			span.End(fnErr)
+			return nil, nil, nil, fnErr
+		}
+		metrics.IncrCounter([]string{"runtime", "before", strings.ToLower(messageType), "fallback"}, 1)
+		runtime.logger.Warn("Runtime before function caused an error, running fallback", zap.String("message", messageType), zap.Error(fnErr))
+		if span != nil {
+			span.Attributes["fallback"] = true
+		}
+		result, writes, directive, fnErr = runtime.invokeFunctionBefore(span, fallbackFn, userId, handle, expiry, clientVersion, ctxValues, jsonEnvelope)
+		if fnErr != nil {
+			span.End(fnErr)
+			return nil, nil, nil, fnErr
+		}
 	}
+	span.End(nil)
 
 	bytesEnvelope, err := json.Marshal(result)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 
 	resultEnvelope := &Envelope{}
 	if err = jsonpbUnmarshaler.Unmarshal(bytes.NewReader(bytesEnvelope), resultEnvelope); err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 
-	return resultEnvelope, nil
+	return resultEnvelope, writes, directive, nil
 }
 
+// RuntimeAfterHook runs the after function registered for a message type, and the global after function, once the
+// response is sent. If the after function causes an error and an after fallback function is registered, the fallback
+// runs on the same envelope and only its error is logged.
 func RuntimeAfterHook(logger *zap.Logger, runtime *Runtime, jsonpbMarshaler *jsonpb.Marshaler, messageType string, envelope *Envelope, session *session) {
 	fn := runtime.GetRuntimeCallback(AFTER, messageType)
-	if fn == nil {
+	globalFn := runtime.GetRuntimeCallback(AFTER, runtimeHookGlobal)
+
+	// Leader only functions run on exactly one node in the cluster, other nodes skip them.
+	if !runtime.IsLeader() {
+		if fn != nil && runtime.IsRuntimeAfterLeaderOnly(messageType) {
+			fn = nil
+		}
+		if globalFn != nil && runtime.IsRuntimeAfterLeaderOnly(runtimeHookGlobal) {
+			globalFn = nil
+		}
+	}
+	if fn == nil && globalFn == nil {
 		return
 	}
 
@@ -81,26 +201,139 @@ func RuntimeAfterHook(logger *zap.Logger, runtime *Runtime, jsonpbMarshaler *jso
 		return
 	}
 
-	var jsonEnvelope map[string]interface{}
-	if err = json.Unmarshal([]byte(strEnvelope), &jsonEnvelope); err != nil {
-		logger.Error("Failed to convert protoJSON message to Map in After invocation", zap.String("message", messageType), zap.Error(err))
-		return
-	}
-
 	userId := uuid.Nil
 	handle := ""
 	expiry := int64(0)
+	clientVersion := ""
 	if session != nil {
 		userId = session.userID
 		handle = session.handle.Load()
 		expiry = session.expiry
+		clientVersion = session.clientVersion
 	}
 
-	if fnErr := runtime.InvokeFunctionAfter(fn, userId, handle, expiry, jsonEnvelope); fnErr != nil {
+	// The global after hook observes every message, it runs on the runtime worker pool so it never delays or affects the response.
+	if globalFn != nil {
+		globalEnvelope := strEnvelope
+		if runtime.IsRuntimeAfterExternal(runtimeHookGlobal) {
+			if globalEnvelope, err = runtimeRedactEnvelope(runtime, strEnvelope); err != nil {
+				logger.Error("Failed to redact envelope for global After invocation", zap.String("message", messageType), zap.Error(err))
+				return
+			}
+		}
+		payload := map[string]interface{}{"message_type": messageType, "envelope": globalEnvelope}
+		queued := runtime.RunAsync(func() {
+			if fnErr := runtime.InvokeFunctionAfter(globalFn, userId, handle, expiry, clientVersion, 1, payload); fnErr != nil {
+				logger.Error("Runtime global after function caused an error", zap.String("message", messageType), zap.Error(fnErr))
+			}
+		})
+		if !queued {
+			logger.Warn("Runtime worker pool full, dropping global after invocation", zap.String("message", messageType))
+		}
+	}
+
+	if fn == nil {
+		return
+	}
+
+	sampleRate := runtime.GetRuntimeAfterSampleRate(messageType)
+	if sampleRate < 1 {
+		if !runtimeAfterHookSampled(messageType, session, sampleRate) {
+			metrics.IncrCounter([]string{"runtime", "after", strings.ToLower(messageType), "skipped"}, 1)
+			return
+		}
+		metrics.IncrCounter([]string{"runtime", "after", strings.ToLower(messageType), "sampled"}, 1)
+	}
+
+	var jsonEnvelope map[string]interface{}
+	if err = json.Unmarshal([]byte(strEnvelope), &jsonEnvelope); err != nil {
+		logger.Error("Failed to convert protoJSON message to Map in After invocation", zap.String("message", messageType), zap.Error(err))
+		return
+	}
+	if runtime.IsRuntimeAfterExternal(messageType) {
+		redact(jsonEnvelope, runtime.redactionRules)
+	}
+
+	span := runtime.tracer.Start(nil, "runtime.after", map[string]interface{}{"message_type": messageType, "user_id": userId.String()})
+	fnErr := runtime.invokeFunctionAfter(span, fn, userId, handle, expiry, clientVersion, sampleRate, jsonEnvelope)
+	if fnErr != nil {
+		if fallbackFn := runtime.GetRuntimeFallback(AFTER, messageType); fallbackFn != nil {
+			metrics.IncrCounter([]string{"runtime", "after", strings.ToLower(messageType), "fallback"}, 1)
+			logger.Warn("Runtime after function caused an error, running fallback", zap.String("message", messageType), zap.Error(fnErr))
+			if span != nil {
+				span.Attributes["fallback"] = true
+			}
+			fnErr = runtime.invokeFunctionAfter(span, fallbackFn, userId, handle, expiry, clientVersion, sampleRate, jsonEnvelope)
+		}
+	}
+	span.End(fnErr)
+	if fnErr != nil {
 		logger.Error("Runtime after function caused an error", zap.String("message", messageType), zap.Error(fnErr))
 	}
 }
 
+// runtimeRedactEnvelope returns the protoJSON envelope with the runtime's redaction rules applied.
+func runtimeRedactEnvelope(runtime *Runtime, strEnvelope string) (string, error) {
+	var jsonEnvelope map[string]interface{}
+	if err := json.Unmarshal([]byte(strEnvelope), &jsonEnvelope); err != nil {
+		return "", err
+	}
+	redact(jsonEnvelope, runtime.redactionRules)
+	bytesEnvelope, err := json.Marshal(jsonEnvelope)
+	if err != nil {
+		return "", err
+	}
+	return string(bytesEnvelope), nil
+}
+
+// runtimeAfterHookSampled decides if a message is part of the sample seen by an after function. Sessions are hashed so
+// each session is consistently in or out of the sample for a message type, messages without a session are picked at random.
+func runtimeAfterHookSampled(messageType string, session *session, sampleRate float64) bool {
+	if session == nil {
+		return rand.Float64() < sampleRate
+	}
+	h := fnv.New32a()
+	h.Write(session.id.Bytes())
+	h.Write([]byte(strings.ToLower(messageType)))
+	return float64(h.Sum32())/float64(math.MaxUint32) < sampleRate
+}
+
+// RuntimeTransformHook passes an outgoing envelope through the transform function registered for its message type, if any.
+// The client's reported version is available to the transform so it can produce the layout that client expects.
+func RuntimeTransformHook(runtime *Runtime, jsonpbMarshaler *jsonpb.Marshaler, jsonpbUnmarshaler *jsonpb.Unmarshaler, messageType string, envelope *Envelope, clientVersion string) (*Envelope, error) {
+	fn := runtime.GetRuntimeCallback(TRANSFORM, messageType)
+	if fn == nil {
+		return envelope, nil
+	}
+
+	strEnvelope, err := jsonpbMarshaler.MarshalToString(envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	var jsonEnvelope map[string]interface{}
+	if err = json.Unmarshal([]byte(strEnvelope), &jsonEnvelope); err != nil {
+		return nil, err
+	}
+
+	result, fnErr := runtime.InvokeFunctionTransform(fn, clientVersion, jsonEnvelope)
+	if fnErr != nil {
+		return nil, fnErr
+	}
+
+	bytesEnvelope, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+
+	resultEnvelope := &Envelope{}
+	if err = jsonpbUnmarshaler.Unmarshal(bytes.NewReader(bytesEnvelope), resultEnvelope); err != nil {
+		return nil, err
+	}
+
+	return resultEnvelope, nil
+}
+
 func RuntimeBeforeHookAuthentication(runtime *Runtime, jsonpbMarshaler *jsonpb.Marshaler, jsonpbUnmarshaler *jsonpb.Unmarshaler, envelope *AuthenticateRequest) (*AuthenticateRequest, error) {
 	messageType := strings.TrimPrefix(fmt.Sprintf("%T", envelope.Id), "*server.")
 	messageType = strings.TrimSuffix(messageType, "_")
@@ -123,7 +356,7 @@ func RuntimeBeforeHookAuthentication(runtime *Runtime, jsonpbMarshaler *jsonpb.M
 	handle := ""
 	expiry := int64(0)
 
-	result, fnErr := runtime.InvokeFunctionBefore(fn, userId, handle, expiry, jsonEnvelope)
+	result, fnErr := runtime.InvokeFunctionBefore(fn, userId, handle, expiry, "", jsonEnvelope)
 	if fnErr != nil {
 		return nil, fnErr
 	}
@@ -144,7 +377,7 @@ func RuntimeBeforeHookAuthentication(runtime *Runtime, jsonpbMarshaler *jsonpb.M
 func RuntimeAfterHookAuthentication(logger *zap.Logger, runtime *Runtime, jsonpbMarshaler *jsonpb.Marshaler, envelope *AuthenticateRequest, userId uuid.UUID, handle string, expiry int64) {
 	messageType := strings.TrimPrefix(fmt.Sprintf("%T", envelope.Id), "*server")
 	fn := runtime.GetRuntimeCallback(AFTER, messageType)
-	if fn == nil {
+	if fn == nil || (runtime.IsRuntimeAfterLeaderOnly(messageType) && !runtime.IsLeader()) {
 		return
 	}
 
@@ -159,8 +392,591 @@ func RuntimeAfterHookAuthentication(logger *zap.Logger, runtime *Runtime, jsonpb
 		logger.Error("Failed to convert protoJSON message to Map in After invocation", zap.String("message", messageType), zap.Error(err))
 		return
 	}
+	if runtime.IsRuntimeAfterExternal(messageType) {
+		redact(jsonEnvelope, runtime.redactionRules)
+	}
 
-	if fnErr := runtime.InvokeFunctionAfter(fn, userId, handle, expiry, jsonEnvelope); fnErr != nil {
+	if fnErr := runtime.InvokeFunctionAfter(fn, userId, handle, expiry, "", 1, jsonEnvelope); fnErr != nil {
 		logger.Error("Runtime after function caused an error", zap.String("message", messageType), zap.Error(fnErr))
 	}
 }
+
+// RuntimeBeforeHookRpc checks the caller's API key against the quota store before a runtime HTTP RPC runs. The key is
+// identified by its configured name, never the raw key. If the call is rejected it returns false and how long the
+// caller should wait before retrying.
+func RuntimeBeforeHookRpc(logger *zap.Logger, quotaStore RpcQuotaStore, keyName string, id string) (bool, time.Duration) {
+	metrics.IncrCounter([]string{"runtime", "rpc", keyName, "calls"}, 1)
+
+	allowed, retryAfter := quotaStore.Allow(keyName, id)
+	if !allowed {
+		metrics.IncrCounter([]string{"runtime", "rpc", keyName, "rejected"}, 1)
+		logger.Warn("Runtime RPC rejected, API key over quota", zap.String("api_key_name", keyName), zap.String("id", id), zap.Duration("retry_after", retryAfter))
+	}
+	return allowed, retryAfter
+}
+
+// RuntimeMatchmakerMatchedHook returns the JSON properties the runtime wants added to the matchmaker result sent to the
+// given recipient, or nil if there are none. Errors are logged and the result is sent without properties.
+func RuntimeMatchmakerMatchedHook(logger *zap.Logger, runtime *Runtime, recipient MatchmakerKey, recipientProfile *MatchmakerProfile, selected map[MatchmakerKey]*MatchmakerProfile, requiredCount int64) []byte {
+	presences := make([]interface{}, 0, len(selected))
+	for mk, mp := range selected {
+		presences = append(presences, matchmakerPresence(mk, mp))
+	}
+	matched := map[string]interface{}{
+		"ticket":         recipient.Ticket.String(),
+		"required_count": requiredCount,
+		"pool":           recipientProfile.Pool,
+		"presences":      presences,
+		"self":           matchmakerPresence(recipient, recipientProfile),
+	}
+
+	properties, err := runtime.InvokeFunctionMatchmakerMatched(recipient.UserID, recipientProfile.Meta.Handle, matched)
+	if err != nil {
+		logger.Error("Runtime matchmaker matched function caused an error", zap.Error(err))
+		return nil
+	}
+	if properties == nil {
+		return nil
+	}
+
+	propertiesBytes, err := json.Marshal(properties)
+	if err != nil {
+		logger.Error("Could not marshal matchmaker matched properties", zap.Error(err))
+		return nil
+	}
+	return propertiesBytes
+}
+
+func matchmakerPresence(mk MatchmakerKey, mp *MatchmakerProfile) map[string]interface{} {
+	presence := map[string]interface{}{
+		"user_id":    mk.UserID.String(),
+		"session_id": mk.ID.SessionID.String(),
+		"handle":     mp.Meta.Handle,
+	}
+	if region := presenceRegion(mp.Meta.Region); region != nil {
+		presence["region"] = region
+	}
+	return presence
+}
+
+// RuntimeRateLimitTierHook resolves the rate limit tier of a connecting session through the runtime rate limit tier
+// function. Errors are logged and the session gets the default tier.
+func RuntimeRateLimitTierHook(logger *zap.Logger, runtime *Runtime, userID uuid.UUID, handle string, sessionExpiry int64) string {
+	tier, err := runtime.InvokeFunctionRateLimitTier(userID, handle, sessionExpiry)
+	if err != nil {
+		logger.Error("Runtime rate limit tier function caused an error", zap.Error(err))
+		return ""
+	}
+	return tier
+}
+
+// RuntimeSessionDuplicateHook decides what happens when a user connects while they have active sessions on this node:
+// the registered session duplicate function chooses, falling back to the configured policy if there is no function,
+// it returns nil, or it fails. The auth type is the one the session token was issued for, empty for older tokens.
+func RuntimeSessionDuplicateHook(logger *zap.Logger, runtime *Runtime, policy string, userID uuid.UUID, handle string, authType string, clientIP string, sessions []*SessionInfo) string {
+	if !runtime.IsRuntimeSessionDuplicateRegistered() {
+		return policy
+	}
+	chosen, err := runtime.InvokeFunctionSessionDuplicate(userID, handle, authType, clientIP, sessions)
+	if err != nil {
+		logger.Error("Runtime session duplicate function caused an error", zap.Error(err))
+		return policy
+	} else if chosen == "" {
+		return policy
+	}
+	return chosen
+}
+
+// RuntimeFriendRequestHook decides what happens to a friend request: the registered friend request function allows,
+// rejects or silently drops it, given the target's recent incoming request count and whether the target blocked the
+// sender. Rejected and dropped requests are counted in metrics.
+func RuntimeFriendRequestHook(logger *zap.Logger, runtime *Runtime, userID uuid.UUID, handle string, sessionExpiry int64, targetID uuid.UUID) (string, error) {
+	if !runtime.IsRuntimeFriendRequestRegistered() {
+		return FRIEND_REQUEST_ALLOW, nil
+	}
+
+	recent := runtime.friendRequests.Add(targetID)
+	var blocked bool
+	err := runtime.db.QueryRow("SELECT EXISTS (SELECT source_id FROM user_edge WHERE source_id = $1 AND destination_id = $2 AND state = 3)",
+		targetID.Bytes(), userID.Bytes()).Scan(&blocked)
+	if err != nil {
+		logger.Error("Could not check if friend request target blocked the user", zap.Error(err))
+		return "", err
+	}
+
+	action, err := runtime.InvokeFunctionFriendRequest(userID, handle, sessionExpiry, targetID, recent, blocked)
+	if err != nil {
+		return "", err
+	}
+	switch action {
+	case FRIEND_REQUEST_REJECT:
+		metrics.IncrCounter([]string{"friend", "request", "rejected"}, 1)
+	case FRIEND_REQUEST_DROP:
+		metrics.IncrCounter([]string{"friend", "request", "dropped"}, 1)
+	}
+	return action, nil
+}
+
+// RuntimeStorageListHook returns the virtual records the runtime storage list function adds to a storage listing. They
+// are only added to the first page and do not count towards its limit, the cursor still points past the last stored
+// record, so no record is repeated or skipped across pages. Errors are logged and no virtual records are added.
+func RuntimeStorageListHook(logger *zap.Logger, runtime *Runtime, session *session, incoming *TStorageList, data []*StorageData) []*StorageData {
+	if len(incoming.Cursor) != 0 || !runtime.IsRuntimeStorageListRegistered() {
+		return nil
+	}
+
+	virtual, err := runtime.InvokeFunctionStorageList(session.userID, session.handle.Load(), session.expiry, incoming.UserId, incoming.Bucket, incoming.Collection, incoming.Limit, data)
+	if err != nil {
+		logger.Error("Runtime storage list function caused an error", zap.Error(err))
+		return nil
+	}
+	return virtual
+}
+
+// RuntimeMatchDataFlag is the user flag set to the match ID when the runtime match data function flags a user.
+const RuntimeMatchDataFlag = "match_data_flagged"
+
+// RuntimeMatchDataHook hands a match data message a user sent to the runtime match data function, on the runtime worker
+// pool so it never delays the match. The function may flag the user, which sets the RuntimeMatchDataFlag user flag, or
+// kick them from the match. Kicked sessions are told with a MATCH_KICKED error, and may not rejoin the match until the
+// kick cooldown ends. Messages are dropped if the worker pool is full.
+func RuntimeMatchDataHook(logger *zap.Logger, runtime *Runtime, tracker Tracker, session *session, matchID uuid.UUID, opCode int64, data []byte) {
+	if !runtime.IsRuntimeMatchDataRegistered() {
+		return
+	}
+
+	userID := session.userID
+	sessionID := session.id
+	handle := session.handle.Load()
+	expiry := session.expiry
+	queued := runtime.RunAsync(func() {
+		message := map[string]interface{}{
+			"match_id":   matchID.String(),
+			"session_id": sessionID.String(),
+			"op_code":    opCode,
+			"data":       string(data),
+		}
+		action, err := runtime.InvokeFunctionMatchData(userID, handle, expiry, matchID, message)
+		if err != nil {
+			logger.Error("Runtime match data function caused an error", zap.Error(err))
+			return
+		}
+		switch action {
+		case "flag":
+			metrics.IncrCounter([]string{"runtime", "match_data", "flagged"}, 1)
+			if err := runtime.userFlagCache.Set(userID, RuntimeMatchDataFlag, matchID.String()); err != nil {
+				logger.Error("Could not flag user from match data function", zap.Error(err))
+			}
+			if _, err := runtime.AuditLog(userID, map[string]interface{}{"action": "match_data_flag", "user_id": userID.String(), "match_id": matchID.String()}); err != nil {
+				logger.Error("Could not record match data flag in the audit log", zap.String("mid", matchID.String()), zap.Error(err))
+			}
+		case "kick":
+			metrics.IncrCounter([]string{"runtime", "match_data", "kicked"}, 1)
+			logger.Info("Match data function kicked user from match", zap.String("mid", matchID.String()))
+			runtime.KickMatchData(matchID, userID)
+			tracker.Untrack(sessionID, "match:"+matchID.String(), userID)
+			session.Send(ErrorMessage("", MATCH_KICKED, "Removed from the match"))
+			if _, err := runtime.AuditLog(userID, map[string]interface{}{"action": "match_data_kick", "user_id": userID.String(), "match_id": matchID.String()}); err != nil {
+				logger.Error("Could not record match data kick in the audit log", zap.String("mid", matchID.String()), zap.Error(err))
+			}
+		}
+	})
+	if !queued {
+		metrics.IncrCounter([]string{"runtime", "match_data", "dropped"}, 1)
+	}
+}
+
+// RuntimePresenceRegionHook asks the runtime for the region metadata of a connecting session, from the IP it connects
+// from. It returns the metadata as JSON to store on the session's presences, or an empty string if the function
+// abstains or fails.
+func RuntimePresenceRegionHook(logger *zap.Logger, runtime *Runtime, userID uuid.UUID, handle string, sessionExpiry int64, clientIP string) string {
+	region, err := runtime.InvokeFunctionPresenceRegion(userID, handle, sessionExpiry, clientIP)
+	if err != nil {
+		logger.Error("Runtime presence region function caused an error", zap.Error(err))
+		return ""
+	}
+	if region == nil {
+		return ""
+	}
+	regionBytes, err := json.Marshal(region)
+	if err != nil {
+		logger.Error("Could not encode presence region", zap.Error(err))
+		return ""
+	}
+	return string(regionBytes)
+}
+
+// presenceRegion decodes the region metadata of a presence, or returns nil if it has none.
+func presenceRegion(region string) map[string]interface{} {
+	if region == "" {
+		return nil
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal([]byte(region), &decoded); err != nil {
+		return nil
+	}
+	return decoded
+}
+
+// RuntimeMessageTranslateHook returns chat message data translated into the locale by the runtime. Translations are
+// cached on this node by original data and locale. The original data is returned if the function abstains, fails, or returns
+// anything other than a JSON object.
+func RuntimeMessageTranslateHook(logger *zap.Logger, runtime *Runtime, userID uuid.UUID, handle string, sessionExpiry int64, topic *TopicId, data []byte, locale string) []byte {
+	if translated, ok := runtime.translationCache.Get(data, locale); ok {
+		return translated
+	}
+
+	message := map[string]interface{}{
+		"user_id": userID.String(),
+		"handle":  handle,
+		"data":    string(data),
+		"locale":  locale,
+	}
+	switch topic.Id.(type) {
+	case *TopicId_Dm:
+		message["topic_type"] = "dm"
+	case *TopicId_Room:
+		message["topic_type"] = "room"
+		message["room"] = string(topic.GetRoom())
+	case *TopicId_GroupId:
+		message["topic_type"] = "group"
+		message["group_id"] = uuid.FromBytesOrNil(topic.GetGroupId()).String()
+	}
+
+	translated, err := runtime.InvokeFunctionMessageTranslate(userID, handle, sessionExpiry, message)
+	if err != nil {
+		logger.Error("Runtime message translate function caused an error", zap.Error(err))
+		metrics.IncrCounter([]string{"runtime", "message_translate", "failed"}, 1)
+		return data
+	}
+	if translated == nil {
+		return data
+	}
+	var maybeJSON map[string]interface{}
+	if json.Unmarshal(translated, &maybeJSON) != nil {
+		logger.Warn("Runtime message translate function returned data that is not a JSON object", zap.String("locale", locale))
+		return data
+	}
+	runtime.translationCache.Set(data, locale, translated)
+	return translated
+}
+
+// RuntimeAssetURLHook returns the URL clients should use for a stored asset reference, as signed by the runtime.
+// Signed URLs are cached by reference while they are valid. The reference is returned unchanged if it is empty, or
+// if the function abstains or fails.
+func RuntimeAssetURLHook(logger *zap.Logger, runtime *Runtime, userID uuid.UUID, handle string, sessionExpiry int64, reference string) string {
+	if reference == "" {
+		return reference
+	}
+	if url, ok := runtime.assetURLCache.Get(reference); ok {
+		return url
+	}
+
+	url, validity, err := runtime.InvokeFunctionAssetURL(userID, handle, sessionExpiry, reference)
+	if err != nil {
+		logger.Error("Runtime asset URL function caused an error", zap.Error(err))
+		return reference
+	}
+	runtime.assetURLCache.Set(reference, url, validity)
+	return url
+}
+
+// RuntimeSessionNodeHook asks the runtime which node a connecting user's session should be on. It returns the name and
+// address of the node to redirect the session to, or empty strings to keep the session on the current node. Sessions
+// stay on the current node if the function abstains, fails, or names a node that is not in the cluster.
+func RuntimeSessionNodeHook(logger *zap.Logger, runtime *Runtime, nodes ClusterNodes, userID uuid.UUID, handle string, sessionExpiry int64) (string, string) {
+	node, err := runtime.InvokeFunctionSessionNode(userID, handle, sessionExpiry, nodes.Self(), nodes.Names())
+	if err != nil {
+		logger.Error("Runtime session node function caused an error", zap.Error(err))
+		return "", ""
+	}
+	if node == "" || node == nodes.Self() {
+		return "", ""
+	}
+	address, ok := nodes.Address(node)
+	if !ok || address == "" {
+		logger.Warn("Runtime session node function chose an unknown node", zap.String("node", node))
+		return "", ""
+	}
+	metrics.IncrCounter([]string{"runtime", "session_node", "redirected"}, 1)
+	return node, address
+}
+
+// RuntimeTopicJoinHook asks the runtime topic join function whether a session may join a chat topic, and whether it
+// joins muted. It returns an error message to send to the client if the join is rejected, or if the function caused an
+// error.
+func RuntimeTopicJoinHook(logger *zap.Logger, runtime *Runtime, session *session, collationID string, topic map[string]interface{}) (bool, *Envelope) {
+	allow, muted, reason, err := runtime.InvokeFunctionTopicJoin(session.userID, session.handle.Load(), session.expiry, topic)
+	if err != nil {
+		logger.Error("Runtime topic join function caused an error", zap.Error(err))
+		return false, ErrorMessage(collationID, RUNTIME_FUNCTION_EXCEPTION, "Runtime topic join function caused an error")
+	}
+	if !allow {
+		if reason == "" {
+			reason = "Topic join rejected"
+		}
+		return false, ErrorMessage(collationID, TOPIC_JOIN_REJECTED, reason)
+	}
+	return muted, nil
+}
+
+// RuntimeLeaderboardRecordsHook lets the runtime leaderboard records function decorate a page of records before it is
+// sent. The owners of all records are loaded in a single query. Errors are logged and the records are sent unchanged.
+func RuntimeLeaderboardRecordsHook(logger *zap.Logger, runtime *Runtime, db *sql.DB, session *session, records []*LeaderboardRecord) {
+	if len(records) == 0 || !runtime.IsRuntimeLeaderboardRecordsRegistered() {
+		return
+	}
+
+	ownerIDs := make([][]byte, 0, len(records))
+	seen := make(map[string]bool, len(records))
+	for _, record := range records {
+		if !seen[string(record.OwnerId)] {
+			seen[string(record.OwnerId)] = true
+			ownerIDs = append(ownerIDs, record.OwnerId)
+		}
+	}
+	users, err := UsersFetchIds(logger, db, ownerIDs)
+	if err != nil {
+		logger.Error("Could not load leaderboard record owners", zap.Error(err))
+		return
+	}
+	owners := make(map[string]*User, len(users))
+	for _, user := range users {
+		owners[string(user.Id)] = user
+	}
+
+	if err = runtime.InvokeFunctionLeaderboardRecords(session.userID, session.handle.Load(), session.expiry, records, owners); err != nil {
+		logger.Error("Runtime leaderboard records function caused an error", zap.Error(err))
+	}
+}
+
+// RuntimeGroupsListHook lets the runtime groups list function reorder or filter a page of listed groups. Only the page
+// is affected, the cursor still points past its last group as stored, so no group is skipped or repeated across pages.
+// Errors are logged and the page is sent unchanged.
+func RuntimeGroupsListHook(logger *zap.Logger, runtime *Runtime, session *session, groups []*Group) []*Group {
+	result, err := runtime.InvokeFunctionGroupsList(session.userID, session.handle.Load(), session.expiry, groups)
+	if err != nil {
+		logger.Error("Runtime groups list function caused an error", zap.Error(err))
+		return groups
+	}
+	return result
+}
+
+// RuntimeLeaderboardRecordUpdateHook returns the subscribers the runtime leaderboard record update function picked to
+// receive a written record. Errors are logged and no subscriber receives the record.
+func RuntimeLeaderboardRecordUpdateHook(logger *zap.Logger, runtime *Runtime, record *LeaderboardRecord, subscribers []Presence) []Presence {
+	recipients, err := runtime.InvokeFunctionLeaderboardRecordUpdate(record, subscribers)
+	if err != nil {
+		logger.Error("Runtime leaderboard record update function caused an error", zap.Error(err))
+		return nil
+	}
+	return recipients
+}
+
+// RuntimeAccountHook adds the fields returned by the runtime account function to the metadata of the account about to
+// be sent to its owner. The fields are only part of the response and are never stored. Errors are logged and the
+// account is sent unchanged.
+func RuntimeAccountHook(logger *zap.Logger, runtime *Runtime, handle string, sessionExpiry int64, self *Self) {
+	userID, err := uuid.FromBytes(self.User.Id)
+	if err != nil {
+		logger.Error("Could not read account user ID", zap.Error(err))
+		return
+	}
+
+	metadata := make(map[string]interface{})
+	if len(self.User.Metadata) != 0 {
+		if err = json.Unmarshal(self.User.Metadata, &metadata); err != nil {
+			logger.Error("Could not unmarshal account metadata", zap.Error(err))
+			return
+		}
+	}
+
+	deviceIDs := make([]interface{}, 0, len(self.DeviceIds))
+	for _, deviceID := range self.DeviceIds {
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+	account := map[string]interface{}{
+		"user_id":        userID.String(),
+		"handle":         self.User.Handle,
+		"fullname":       self.User.Fullname,
+		"avatar_url":     self.User.AvatarUrl,
+		"lang":           self.User.Lang,
+		"location":       self.User.Location,
+		"timezone":       self.User.Timezone,
+		"metadata":       metadata,
+		"created_at":     self.User.CreatedAt,
+		"updated_at":     self.User.UpdatedAt,
+		"last_online_at": self.User.LastOnlineAt,
+		"verified":       self.Verified,
+		"email":          self.Email,
+		"device_ids":     deviceIDs,
+	}
+
+	fields, err := runtime.InvokeFunctionAccount(userID, handle, sessionExpiry, account)
+	if err != nil {
+		logger.Error("Runtime account function caused an error", zap.Error(err))
+		return
+	}
+	if len(fields) == 0 {
+		return
+	}
+
+	for k, v := range fields {
+		metadata[k] = v
+	}
+	metadataBytes, err := json.Marshal(metadata)
+	if err != nil {
+		logger.Error("Could not marshal account metadata", zap.Error(err))
+		return
+	}
+	self.User.Metadata = metadataBytes
+}
+
+// RuntimeMatchJoinHook returns the JSON metadata the runtime wants set on a presence joining a match, or an empty string
+// if there is none.
+func RuntimeMatchJoinHook(logger *zap.Logger, runtime *Runtime, userID uuid.UUID, sessionID uuid.UUID, handle string, sessionExpiry int64, matchID uuid.UUID) (string, error) {
+	return RuntimeMatchJoinHookWithCount(logger, runtime, userID, sessionID, handle, sessionExpiry, matchID, 0, 0)
+}
+
+// RuntimeMatchJoinHookWithCount is RuntimeMatchJoinHook for a user already in matchCount other matches, when at most
+// matchLimit are allowed or 0 for no limit, so the function can turn away users in too many matches. It returns
+// ErrMatchJoinRejected if the function rejects the join.
+func RuntimeMatchJoinHookWithCount(logger *zap.Logger, runtime *Runtime, userID uuid.UUID, sessionID uuid.UUID, handle string, sessionExpiry int64, matchID uuid.UUID, matchCount int, matchLimit int) (string, error) {
+	join := map[string]interface{}{
+		"match_id":    matchID.String(),
+		"user_id":     userID.String(),
+		"session_id":  sessionID.String(),
+		"handle":      handle,
+		"match_count": matchCount,
+		"match_limit": matchLimit,
+	}
+
+	metadata, err := runtime.InvokeFunctionMatchJoin(userID, handle, sessionExpiry, join)
+	if err != nil {
+		return "", err
+	}
+	if len(metadata) == 0 {
+		return "", nil
+	}
+
+	metadataBytes, err := json.Marshal(metadata)
+	if err != nil {
+		return "", err
+	}
+	if len(metadataBytes) > matchPresenceMetadataMaxBytes {
+		logger.Warn("Runtime match join function returned metadata over the size limit", zap.Int("size", len(metadataBytes)))
+		return "", fmt.Errorf("presence metadata must be at most %d bytes", matchPresenceMetadataMaxBytes)
+	}
+	return string(metadataBytes), nil
+}
+
+// RuntimeTournamentHook runs the runtime tournament round function for each round a tournament ended, and the end
+// function if it completed. Failures are logged, the tournament has already moved on.
+func RuntimeTournamentHook(logger *zap.Logger, runtime *Runtime, id uuid.UUID, progress *TournamentProgress) {
+	cb := runtime.vm.Context().Value(CALLBACKS).(*Callbacks)
+	if (cb.TournamentRound == nil || len(progress.Rounds) == 0) && (cb.TournamentEnd == nil || !progress.Complete) {
+		return
+	}
+
+	bracket, err := runtime.TournamentGet(id)
+	if err != nil {
+		logger.Error("Could not read tournament for runtime tournament function", zap.String("tournament_id", id.String()), zap.Error(err))
+		return
+	}
+	if cb.TournamentRound != nil {
+		for _, round := range progress.Rounds {
+			if err = runtime.InvokeFunctionTournament(cb.TournamentRound, bracket, round); err != nil {
+				logger.Error("Runtime tournament round function caused an error", zap.String("tournament_id", id.String()), zap.Int("round", round), zap.Error(err))
+			}
+		}
+	}
+	if cb.TournamentEnd != nil && progress.Complete {
+		if err = runtime.InvokeFunctionTournament(cb.TournamentEnd, bracket, 0); err != nil {
+			logger.Error("Runtime tournament end function caused an error", zap.String("tournament_id", id.String()), zap.Error(err))
+		}
+	}
+}
+
+// RuntimeTournamentJoinHook returns the entry fee the runtime tournament join function takes from a user joining a
+// tournament, or nil if there is no function or it takes none. It returns TournamentJoinRejectedError if the function
+// rejects the join. The function runs before the join transaction, so it runs once however often that retries.
+func RuntimeTournamentJoinHook(logger *zap.Logger, runtime *Runtime, id uuid.UUID, userID uuid.UUID, handle string, rating int64) (map[string]int64, error) {
+	fn := runtime.vm.Context().Value(CALLBACKS).(*Callbacks).TournamentJoin
+	if fn == nil {
+		return nil, nil
+	}
+
+	bracket, err := runtime.TournamentGet(id)
+	if err != nil {
+		return nil, err
+	}
+	items, err := runtime.InventoryList(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	fee, accepted, reason, err := runtime.InvokeFunctionTournamentJoin(fn, bracket, userID, handle, rating, items)
+	if err != nil {
+		logger.Error("Runtime tournament join function caused an error", zap.String("tournament_id", id.String()), zap.Error(err))
+		return nil, err
+	} else if !accepted {
+		metrics.IncrCounter([]string{"tournament", "join", "rejected"}, 1)
+		return nil, &TournamentJoinRejectedError{Reason: reason}
+	}
+	return fee, nil
+}
+
+// RuntimeMatchCreateHook returns the parameters a client's match is created with: those the runtime match create
+// function returns, or the requested ones if there is no function or it returns nil. It returns
+// MatchCreateRejectedError if the function rejects them.
+func RuntimeMatchCreateHook(logger *zap.Logger, runtime *Runtime, userID uuid.UUID, handle string, sessionExpiry int64, module string, params map[string]interface{}) (map[string]interface{}, error) {
+	if !runtime.IsRuntimeMatchCreateRegistered() {
+		return params, nil
+	}
+
+	sanitized, accepted, reason, err := runtime.InvokeFunctionMatchCreate(userID, handle, sessionExpiry, module, params)
+	if err != nil {
+		return nil, err
+	} else if !accepted {
+		metrics.IncrCounter([]string{"match", "create", "rejected"}, 1)
+		return nil, &MatchCreateRejectedError{Reason: reason}
+	} else if sanitized == nil {
+		return params, nil
+	}
+	return sanitized, nil
+}
+
+// RuntimeShutdownHook runs the runtime shutdown function, waiting for it at most until the timeout.
+func RuntimeShutdownHook(logger *zap.Logger, runtime *Runtime, timeout time.Duration) {
+	start := time.Now()
+	if err := runtime.InvokeFunctionShutdown(timeout); err != nil {
+		logger.Error("Runtime shutdown function caused an error", zap.Duration("duration", time.Since(start)), zap.Error(err))
+		return
+	}
+	logger.Info("Runtime shutdown function completed", zap.Duration("duration", time.Since(start)))
+}
+
+// RuntimeNotificationHook lets the runtime decide whether each notification is stored, and for how long.
+func RuntimeNotificationHook(logger *zap.Logger, runtime *Runtime, notifications []*NNotification) error {
+	for _, notification := range notifications {
+		persistent, ttl, err := runtime.InvokeFunctionNotification(notification)
+		if err != nil {
+			logger.Error("Runtime notification function caused an error", zap.Error(err))
+			return err
+		}
+		notification.Persistent = persistent
+		if ttl > 0 {
+			if notification.CreatedAt == 0 {
+				notification.CreatedAt = nowMs()
+			}
+			notification.ExpiresAt = notification.CreatedAt + ttl
+		}
+	}
+	return nil
+}
+
+// RuntimeAfterHookRpc emits an audit record for a completed runtime HTTP RPC call.
+func RuntimeAfterHookRpc(logger *zap.Logger, keyName string, id string, status int, duration time.Duration) {
+	metrics.MeasureSince([]string{"runtime", "rpc", keyName, "latency"}, time.Now().Add(-duration))
+	logger.Info("Runtime RPC audit", zap.String("api_key_name", keyName), zap.String("id", id), zap.Int("status", status), zap.Duration("duration", duration))
+}
@@ -21,12 +21,60 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
+	"sync"
+	"time"
 
 	"encoding/gob"
+	"github.com/armon/go-metrics"
 	"github.com/satori/go.uuid"
 	"go.uber.org/zap"
 )
 
+type StorageStat struct {
+	Bucket     string
+	Collection string
+	Count      int64
+	Bytes      int64
+}
+
+// StorageStatsCache keeps storage stats results for a short time, each stats query counts every live record in scope
+// and samples every collection it finds. Callers asking for the same stats while they are queried wait for that query
+// instead of running their own. Failed queries are not kept.
+type StorageStatsCache struct {
+	sync.Mutex
+	duration time.Duration
+	entries  map[string]*storageStatsEntry
+}
+
+type storageStatsEntry struct {
+	stats     []*StorageStat
+	code      Error_Code
+	err       error
+	checkedAt time.Time
+	done      chan struct{}
+}
+
+const storageUsageCacheMaxEntries = 10000
+
+type StorageUsage struct {
+	Count int64
+	Bytes int64
+}
+
+// StorageUsageCache keeps the storage usage of each user until their storage next changes. Usage is computed on
+// first use, and entries are dropped by writes and removes once they commit so the next read recomputes them. Each
+// drop also moves the user's version on, so a usage read before a write commits is not cached after it.
+type StorageUsageCache struct {
+	sync.Mutex
+	logger   *zap.Logger
+	db       *sql.DB
+	router   *StorageRouter
+	entries  map[uuid.UUID]*StorageUsage
+	versions map[uuid.UUID]uint64
+	epoch    uint64
+}
+
 type storageListCursor struct {
 	Bucket     string
 	Collection string
@@ -58,7 +106,16 @@ type StorageData struct {
 	ExpiresAt       int64
 }
 
-func StorageList(logger *zap.Logger, db *sql.DB, caller uuid.UUID, userID []byte, bucket string, collection string, limit int64, cursor []byte) ([]*StorageData, []byte, Error_Code, error) {
+func StorageList(logger *zap.Logger, db *sql.DB, router *StorageRouter, caller uuid.UUID, userID []byte, bucket string, collection string, limit int64, cursor []byte) ([]*StorageData, []byte, Error_Code, error) {
+	return storageList(logger, db, router, caller, userID, bucket, collection, limit, cursor, false)
+}
+
+// StorageListPrimary lists storage like StorageList, but never reads from the read replica.
+func StorageListPrimary(logger *zap.Logger, db *sql.DB, router *StorageRouter, caller uuid.UUID, userID []byte, bucket string, collection string, limit int64, cursor []byte) ([]*StorageData, []byte, Error_Code, error) {
+	return storageList(logger, db, router, caller, userID, bucket, collection, limit, cursor, true)
+}
+
+func storageList(logger *zap.Logger, db *sql.DB, router *StorageRouter, caller uuid.UUID, userID []byte, bucket string, collection string, limit int64, cursor []byte, primary bool) ([]*StorageData, []byte, Error_Code, error) {
 	// We list by at least User ID, or bucket as a list criteria.
 	if len(userID) == 0 && bucket == "" {
 		return nil, nil, BAD_INPUT, errors.New("Either a User ID or a bucket is required as an initial list criteria")
@@ -84,6 +141,16 @@ func StorageList(logger *zap.Logger, db *sql.DB, caller uuid.UUID, userID []byte
 		return nil, nil, BAD_INPUT, errors.New("Limit must be between 10 and 100")
 	}
 
+	// Listings narrowed to a collection read from the backend holding it.
+	if collection != "" {
+		db = router.resolve(db, bucket, collection)
+	}
+	if len(userID) != 0 {
+		db = router.readReplica().resolveRead(db, primary, userID)
+	} else {
+		db = router.readReplica().resolveRead(db, primary)
+	}
+
 	// Process the incoming cursor if one is provided.
 	var incomingCursor *storageListCursor
 	if len(cursor) != 0 {
@@ -247,14 +314,42 @@ func StorageList(logger *zap.Logger, db *sql.DB, caller uuid.UUID, userID []byte
 		return nil, nil, RUNTIME_EXCEPTION, err
 	}
 
+	encryption := router.encrypter()
+	for _, d := range storageData {
+		if err = encryption.decrypt(d); err != nil {
+			logger.Error("Could not decrypt storage value", zap.Error(err), zap.String("bucket", d.Bucket), zap.String("collection", d.Collection), zap.String("record", d.Record))
+			return nil, nil, RUNTIME_EXCEPTION, errors.New("Error listing storage data")
+		}
+	}
+
 	return storageData, outgoingCursor, 0, nil
 }
 
-func StorageFetch(logger *zap.Logger, db *sql.DB, caller uuid.UUID, keys []*StorageKey) ([]*StorageData, Error_Code, error) {
+func StorageFetch(logger *zap.Logger, db *sql.DB, router *StorageRouter, caller uuid.UUID, keys []*StorageKey) ([]*StorageData, Error_Code, error) {
+	return storageFetch(logger, db, router, caller, keys, false)
+}
+
+// StorageFetchPrimary fetches storage like StorageFetch, but never reads from the read replica. Use it where a read
+// must see every committed write.
+func StorageFetchPrimary(logger *zap.Logger, db *sql.DB, router *StorageRouter, caller uuid.UUID, keys []*StorageKey) ([]*StorageData, Error_Code, error) {
+	return storageFetch(logger, db, router, caller, keys, true)
+}
+
+func storageFetch(logger *zap.Logger, db *sql.DB, router *StorageRouter, caller uuid.UUID, keys []*StorageKey, primary bool) ([]*StorageData, Error_Code, error) {
 	// Ensure there is at least one key requested.
 	if len(keys) == 0 {
 		return nil, BAD_INPUT, errors.New("At least one fetch key is required")
 	}
+	if routed, err := router.resolveKeys(db, keys); err != nil {
+		return nil, BAD_INPUT, err
+	} else {
+		db = routed
+	}
+	owners := make([][]byte, len(keys))
+	for i, key := range keys {
+		owners[i] = key.UserId
+	}
+	db = router.readReplica().resolveRead(db, primary, owners...)
 
 	query := `
 SELECT user_id, bucket, collection, record, value, version, read, write, created_at, updated_at, expires_at
@@ -348,67 +443,151 @@ WHERE `
 		return nil, RUNTIME_EXCEPTION, err
 	}
 
+	encryption := router.encrypter()
+	for _, d := range storageData {
+		if err = encryption.decrypt(d); err != nil {
+			logger.Error("Could not decrypt storage value", zap.Error(err), zap.String("bucket", d.Bucket), zap.String("collection", d.Collection), zap.String("record", d.Record))
+			return nil, RUNTIME_EXCEPTION, errors.New("Error fetching storage data")
+		}
+	}
+
 	return storageData, 0, nil
 }
 
-func StorageWrite(logger *zap.Logger, db *sql.DB, caller uuid.UUID, data []*StorageData) ([]*StorageKey, Error_Code, error) {
+func StorageWrite(logger *zap.Logger, db *sql.DB, router *StorageRouter, caller uuid.UUID, data []*StorageData) ([]*StorageKey, Error_Code, error) {
+	return StorageWriteWithSideEffects(logger, db, router, caller, data, nil)
+}
+
+// StorageWriteWithSideEffects writes the caller's data along with side effect writes requested by the runtime, all in one transaction.
+// Side effect writes are checked with the same rules as writes from the runtime. Only keys for the caller's data are returned.
+func StorageWriteWithSideEffects(logger *zap.Logger, db *sql.DB, router *StorageRouter, caller uuid.UUID, data []*StorageData, sideEffects []*StorageData) ([]*StorageKey, Error_Code, error) {
+	keys, _, code, err := StorageWriteIdempotent(logger, db, router, caller, data, sideEffects, "", 0)
+	return keys, code, err
+}
+
+// StorageWriteIdempotent writes like StorageWriteWithSideEffects. When an idempotency key is given the result is stored
+// with the key, in the same transaction as the writes, and any repeat with the same key from the same caller within the
+// TTL returns the stored result without writing again. The boolean result reports whether the write was such a repeat.
+func StorageWriteIdempotent(logger *zap.Logger, db *sql.DB, router *StorageRouter, caller uuid.UUID, data []*StorageData, sideEffects []*StorageData, idempotencyKey string, ttl time.Duration) ([]*StorageKey, bool, Error_Code, error) {
+	return storageWriteTx(logger, db, router, caller, data, sideEffects, idempotencyKey, ttl, nil)
+}
+
+// storageWriteTx writes like StorageWriteIdempotent, and runs inTx in the same transaction once all writes succeed. If
+// inTx returns an error the transaction is rolled back and its code and error are returned.
+func storageWriteTx(logger *zap.Logger, db *sql.DB, router *StorageRouter, caller uuid.UUID, data []*StorageData, sideEffects []*StorageData, idempotencyKey string, ttl time.Duration, inTx func(tx *sql.Tx) (Error_Code, error)) ([]*StorageKey, bool, Error_Code, error) {
 	// Ensure there is at least one value requested.
 	if len(data) == 0 {
-		return nil, BAD_INPUT, errors.New("At least one write value is required")
+		return nil, false, BAD_INPUT, errors.New("At least one write value is required")
+	}
+	if len(idempotencyKey) > 128 {
+		return nil, false, BAD_INPUT, errors.New("Idempotency key must be at most 128 chars")
+	}
+
+	// All writes, and anything else done in their transaction, must be in the same storage backend.
+	routed, err := router.resolveData(db, append(append(make([]*StorageData, 0, len(data)+len(sideEffects)), data...), sideEffects...))
+	if err != nil {
+		return nil, false, BAD_INPUT, err
+	}
+	if inTx != nil && routed != db {
+		return nil, false, BAD_INPUT, ErrStorageBackendsSpanned
+	}
+	// Idempotency keys are kept in the main database, they cannot commit together with writes to another backend.
+	if idempotencyKey != "" && routed != db {
+		return nil, false, BAD_INPUT, errors.New("Idempotency keys are not supported for collections in other storage backends")
 	}
+	db = routed
+
+	// Repeated writes return the result of the original write.
+	if idempotencyKey != "" {
+		if keys, err := storageIdempotencyResult(db, caller, idempotencyKey); err != nil {
+			logger.Error("Could not read storage idempotency key", zap.Error(err))
+			return nil, false, RUNTIME_EXCEPTION, errors.New("Could not write storage")
+		} else if keys != nil {
+			metrics.IncrCounter([]string{"storage", "idempotency", "hit"}, 1)
+			return keys, true, 0, nil
+		}
+		metrics.IncrCounter([]string{"storage", "idempotency", "miss"}, 1)
+	}
+
+	callers := make([]uuid.UUID, 0, len(data)+len(sideEffects))
+	for range data {
+		callers = append(callers, caller)
+	}
+	for range sideEffects {
+		callers = append(callers, uuid.Nil)
+	}
+	all := append(append(make([]*StorageData, 0, len(callers)), data...), sideEffects...)
+
+	// Governed collections get their configured permissions, whatever the writer asked for.
+	policy := router.permissionPolicy()
 
 	// Validate all input before starting DB operations.
-	for _, d := range data {
+	for i, d := range all {
+		caller := callers[i]
+		policy.apply(d)
 		// Check the storage identifiers.
 		if d.Bucket == "" || d.Collection == "" || d.Record == "" {
-			return nil, BAD_INPUT, errors.New("Invalid values for bucket, collection, or record")
+			return nil, false, BAD_INPUT, errors.New("Invalid values for bucket, collection, or record")
 		}
 
 		// Check the read permission value.
 		if d.PermissionRead != 0 && d.PermissionRead != 1 && d.PermissionRead != 2 {
-			return nil, BAD_INPUT, errors.New("Invalid read permission value")
+			return nil, false, BAD_INPUT, errors.New("Invalid read permission value")
 		}
 
 		// Check the write permission value.
 		if d.PermissionWrite != 0 && d.PermissionWrite != 1 {
-			return nil, BAD_INPUT, errors.New("Invalid write permission value")
+			return nil, false, BAD_INPUT, errors.New("Invalid write permission value")
 		}
 
 		// If a user ID is provided, validate the format.
 		if len(d.UserId) != 0 {
 			if uid, err := uuid.FromBytes(d.UserId); err != nil {
-				return nil, BAD_INPUT, errors.New("Invalid user ID")
+				return nil, false, BAD_INPUT, errors.New("Invalid user ID")
 			} else if caller != uuid.Nil && caller != uid {
 				// If the caller is a client, only allow them to write their own data.
-				return nil, BAD_INPUT, errors.New("A client can only write their own records")
+				return nil, false, BAD_INPUT, errors.New("A client can only write their own records")
 			}
 		} else if caller != uuid.Nil {
 			// If the caller is a client, do not allow them to write global data.
-			return nil, BAD_INPUT, errors.New("A client cannot write global records")
+			return nil, false, BAD_INPUT, errors.New("A client cannot write global records")
 		}
 
 		// Make this `var js interface{}` if we want to allow top-level JSON arrays.
 		var maybeJSON map[string]interface{}
 		if json.Unmarshal(d.Value, &maybeJSON) != nil {
-			return nil, BAD_INPUT, errors.New("All values must be valid JSON objects")
+			return nil, false, BAD_INPUT, errors.New("All values must be valid JSON objects")
 		}
 	}
 
-	// Prepare response structure, expect to return as many keys as we're writing.
+	// Prepare response structure, expect to return as many keys as the caller is writing.
 	keys := make([]*StorageKey, len(data))
 
 	// Use same timestamp for all operations in this batch.
 	ts := nowMs()
 
+	// Encrypt values of flagged collections, versions are still computed from the plaintext.
+	encryption := router.encrypter()
+	values := make([][]byte, len(all))
+	for i, d := range all {
+		value, err := encryption.encrypt(d)
+		if err != nil {
+			logger.Error("Could not encrypt storage value", zap.Error(err))
+			return nil, false, RUNTIME_EXCEPTION, errors.New("Could not write storage")
+		}
+		values[i] = value
+	}
+
 	// Start a transaction.
 	tx, err := db.Begin()
 	if err != nil {
 		logger.Error("Could not write storage, transaction error", zap.Error(err))
-		return nil, RUNTIME_EXCEPTION, errors.New("Could not write storage")
+		return nil, false, RUNTIME_EXCEPTION, errors.New("Could not write storage")
 	}
 
 	// Execute each storage write.
-	for i, d := range data {
+	for i, d := range all {
+		caller := callers[i]
 		id := uuid.NewV4().Bytes()
 		//sha := fmt.Sprintf("%x", sha256.Sum256(d.Value))
 		version := []byte(fmt.Sprintf("%x", sha256.Sum256(d.Value)))
@@ -422,7 +601,7 @@ func StorageWrite(logger *zap.Logger, db *sql.DB, caller uuid.UUID, data []*Stor
 		query := `
 INSERT INTO storage (id, user_id, bucket, collection, record, value, version, read, write, created_at, updated_at, deleted_at)
 SELECT $1, $2, $3, $4, $5, $6::BYTEA, $7, $8, $9, $10, $10, 0`
-		params := []interface{}{id, owner, d.Bucket, d.Collection, d.Record, d.Value, version, d.PermissionRead, d.PermissionWrite, ts}
+		params := []interface{}{id, owner, d.Bucket, d.Collection, d.Record, values[i], version, d.PermissionRead, d.PermissionWrite, ts}
 
 		if len(d.Version) == 0 {
 			// Simple write.
@@ -451,6 +630,20 @@ DO UPDATE SET value = $6::BYTEA, version = $7, read = $8, write = $9, updated_at
 			params = append(params, d.Version)
 		}
 
+		// Writes to collections with change subscribers are recorded along with the value they replace.
+		var change *StorageChange
+		if router.changeCaptured(d.Bucket, d.Collection) {
+			before, err := storageChangeBefore(tx, d.Bucket, d.Collection, owner, d.Record)
+			if err != nil {
+				logger.Error("Could not write storage, change capture error", zap.Error(err))
+				if e := tx.Rollback(); e != nil {
+					logger.Error("Could not write storage, rollback error", zap.Error(e))
+				}
+				return nil, false, RUNTIME_EXCEPTION, errors.New("Could not write storage")
+			}
+			change = &StorageChange{Bucket: d.Bucket, Collection: d.Collection, Record: d.Record, UserId: owner, Op: STORAGE_CHANGE_WRITE, Before: before, After: values[i]}
+		}
+
 		// Execute the query.
 		res, err := tx.Exec(query, params...)
 		if err != nil {
@@ -458,7 +651,7 @@ DO UPDATE SET value = $6::BYTEA, version = $7, read = $8, write = $9, updated_at
 			if e := tx.Rollback(); e != nil {
 				logger.Error("Could not write storage, rollback error", zap.Error(e))
 			}
-			return nil, RUNTIME_EXCEPTION, errors.New("Could not write storage")
+			return nil, false, RUNTIME_EXCEPTION, errors.New("Could not write storage")
 		}
 
 		// Check there was exactly 1 row affected.
@@ -467,37 +660,134 @@ DO UPDATE SET value = $6::BYTEA, version = $7, read = $8, write = $9, updated_at
 			if err != nil {
 				logger.Error("Could not write storage, rollback error", zap.Error(err))
 			}
-			return nil, STORAGE_REJECTED, errors.New("Storage write rejected: not found, version check failed, or permission denied")
+			return nil, false, STORAGE_REJECTED, errors.New("Storage write rejected: not found, version check failed, or permission denied")
 		}
 
-		keys[i] = &StorageKey{
-			Bucket:     d.Bucket,
-			Collection: d.Collection,
-			Record:     d.Record,
-			UserId:     d.UserId,
-			Version:    version[:],
+		if change != nil {
+			if err = storageChangeRecord(tx, change, ts); err != nil {
+				logger.Error("Could not write storage, change capture error", zap.Error(err))
+				if e := tx.Rollback(); e != nil {
+					logger.Error("Could not write storage, rollback error", zap.Error(e))
+				}
+				return nil, false, RUNTIME_EXCEPTION, errors.New("Could not write storage")
+			}
+		}
+
+		if i < len(keys) {
+			keys[i] = &StorageKey{
+				Bucket:     d.Bucket,
+				Collection: d.Collection,
+				Record:     d.Record,
+				UserId:     d.UserId,
+				Version:    version[:],
+			}
+		}
+	}
+
+	if inTx != nil {
+		if code, err := inTx(tx); err != nil {
+			if e := tx.Rollback(); e != nil {
+				logger.Error("Could not write storage, rollback error", zap.Error(e))
+			}
+			return nil, false, code, err
+		}
+	}
+
+	if idempotencyKey != "" {
+		stored, err := storageIdempotencyStore(tx, caller, idempotencyKey, keys, ts, ttl)
+		if err != nil {
+			logger.Error("Could not write storage idempotency key", zap.Error(err))
+			if e := tx.Rollback(); e != nil {
+				logger.Error("Could not write storage, rollback error", zap.Error(e))
+			}
+			return nil, false, RUNTIME_EXCEPTION, errors.New("Could not write storage")
+		}
+		if !stored {
+			// A concurrent write with the same key got there first, drop this one and return its result instead.
+			if e := tx.Rollback(); e != nil {
+				logger.Error("Could not write storage, rollback error", zap.Error(e))
+			}
+			keys, err := storageIdempotencyResult(db, caller, idempotencyKey)
+			if err != nil || keys == nil {
+				logger.Error("Could not read storage idempotency key", zap.Error(err))
+				return nil, false, RUNTIME_EXCEPTION, errors.New("Could not write storage")
+			}
+			metrics.IncrCounter([]string{"storage", "idempotency", "hit"}, 1)
+			return keys, true, 0, nil
 		}
 	}
 
 	err = tx.Commit()
 	if err != nil {
 		logger.Error("Could not write storage, commit error", zap.Error(err))
-		return nil, RUNTIME_EXCEPTION, errors.New("Could not write storage")
+		return nil, false, RUNTIME_EXCEPTION, errors.New("Could not write storage")
+	}
+	owners := make([][]byte, len(all))
+	for i, d := range all {
+		owners[i] = d.UserId
+	}
+	router.readReplica().written(db, owners...)
+
+	return keys, false, 0, nil
+}
+
+// storageIdempotencyResult returns the keys stored with an unexpired idempotency key, or nil if there are none.
+func storageIdempotencyResult(db *sql.DB, caller uuid.UUID, idempotencyKey string) ([]*StorageKey, error) {
+	var result []byte
+	err := db.QueryRow("SELECT result FROM storage_idempotency WHERE user_id = $1 AND idempotency_key = $2 AND expires_at > $3",
+		caller.Bytes(), idempotencyKey, nowMs()).Scan(&result)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	keys := make([]*StorageKey, 0)
+	if err = json.Unmarshal(result, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// storageIdempotencyStore saves the write result with the idempotency key. It returns false if the key is already in use.
+func storageIdempotencyStore(tx *sql.Tx, caller uuid.UUID, idempotencyKey string, keys []*StorageKey, ts int64, ttl time.Duration) (bool, error) {
+	result, err := json.Marshal(keys)
+	if err != nil {
+		return false, err
 	}
 
-	return keys, 0, nil
+	// Expired keys of the same caller are no longer needed, this keeps the table from growing without bound.
+	if _, err = tx.Exec("DELETE FROM storage_idempotency WHERE user_id = $1 AND expires_at <= $2", caller.Bytes(), ts); err != nil {
+		return false, err
+	}
+	res, err := tx.Exec(`INSERT INTO storage_idempotency (user_id, idempotency_key, result, created_at, expires_at)
+VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (user_id, idempotency_key) DO NOTHING`,
+		caller.Bytes(), idempotencyKey, result, ts, ts+int64(ttl/time.Millisecond))
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, _ := res.RowsAffected()
+	return rowsAffected == 1, nil
 }
 
-func StorageRemove(logger *zap.Logger, db *sql.DB, caller uuid.UUID, keys []*StorageKey) (Error_Code, error) {
+func StorageRemove(logger *zap.Logger, db *sql.DB, router *StorageRouter, caller uuid.UUID, keys []*StorageKey) (Error_Code, error) {
 	// Ensure there is at least one key requested.
 	if len(keys) == 0 {
 		return BAD_INPUT, errors.New("At least one remove key is required")
 	}
+	if routed, err := router.resolveKeys(db, keys); err != nil {
+		return BAD_INPUT, err
+	} else {
+		db = routed
+	}
 
+	ts := nowMs()
 	query := `
 UPDATE storage SET deleted_at = $1, updated_at = $1
 WHERE `
-	params := []interface{}{nowMs()}
+	params := []interface{}{ts}
+	changes := make([]*StorageChange, 0)
 
 	// Accumulate the query clauses and corresponding parameters.
 	for i, key := range keys {
@@ -539,6 +829,11 @@ WHERE `
 			params = append(params, key.Version)
 		}
 		query += ")"
+
+		// Removals from collections with change subscribers are recorded along with the value they remove.
+		if router.changeCaptured(key.Bucket, key.Collection) {
+			changes = append(changes, &StorageChange{Bucket: key.Bucket, Collection: key.Collection, Record: key.Record, UserId: owner, Op: STORAGE_CHANGE_REMOVE})
+		}
 	}
 
 	// Start a transaction.
@@ -548,6 +843,16 @@ WHERE `
 		return RUNTIME_EXCEPTION, errors.New("Could not remove storage")
 	}
 
+	for _, change := range changes {
+		if change.Before, err = storageChangeBefore(tx, change.Bucket, change.Collection, change.UserId, change.Record); err != nil {
+			logger.Error("Could not remove storage, change capture error", zap.Error(err))
+			if e := tx.Rollback(); e != nil {
+				logger.Error("Could not remove storage, rollback error", zap.Error(e))
+			}
+			return RUNTIME_EXCEPTION, errors.New("Could not remove storage")
+		}
+	}
+
 	// Execute the query.
 	res, err := tx.Exec(query, params...)
 	if err != nil {
@@ -564,11 +869,241 @@ WHERE `
 		return STORAGE_REJECTED, errors.New("Storage remove rejected: not found, version check failed, or permission denied")
 	}
 
+	for _, change := range changes {
+		if err = storageChangeRecord(tx, change, ts); err != nil {
+			logger.Error("Could not remove storage, change capture error", zap.Error(err))
+			if e := tx.Rollback(); e != nil {
+				logger.Error("Could not remove storage, rollback error", zap.Error(e))
+			}
+			return RUNTIME_EXCEPTION, errors.New("Could not remove storage")
+		}
+	}
+
 	err = tx.Commit()
 	if err != nil {
 		logger.Error("Could not remove storage, commit error", zap.Error(err))
 		return RUNTIME_EXCEPTION, errors.New("Could not remove storage")
 	}
+	owners := make([][]byte, len(keys))
+	for i, key := range keys {
+		owners[i] = key.UserId
+	}
+	router.readReplica().written(db, owners...)
 
 	return 0, nil
 }
+
+// storageStatsSampleSize is how many records of each collection StorageStats reads to estimate its total value size.
+const storageStatsSampleSize = 100
+
+// StorageStats returns the live record count and approximate total value size per collection. If a collection is given
+// the result has a single entry for it, otherwise there is one entry for each collection in the bucket, or in all
+// buckets if the bucket is also empty, ordered by bucket and collection. Counts are read from a storage index without
+// reading record values, sizes are the average size of a sample of each collection's records times its count, exact for
+// collections no larger than the sample. Every storage backend is queried for the collections it holds, records a
+// backend keeps for collections routed elsewhere cannot be read and are not counted.
+func StorageStats(logger *zap.Logger, db *sql.DB, router *StorageRouter, bucket string, collection string) ([]*StorageStat, Error_Code, error) {
+	if bucket == "" && collection != "" {
+		return nil, BAD_INPUT, errors.New("Cannot get stats by collection without a bucket")
+	}
+
+	dbs := router.all(db)
+	if collection != "" {
+		dbs = []*sql.DB{router.resolve(db, bucket, collection)}
+	}
+
+	stats := make([]*StorageStat, 0)
+	for _, backend := range dbs {
+		backendStats, err := storageStatsCount(backend, bucket, collection)
+		if err != nil {
+			logger.Error("Could not execute storage stats query", zap.Error(err))
+			return nil, RUNTIME_EXCEPTION, errors.New("Error getting storage stats")
+		}
+		for _, stat := range backendStats {
+			if router.resolve(db, stat.Bucket, stat.Collection) != backend {
+				continue
+			}
+			if err = storageStatsSample(backend, stat); err != nil {
+				logger.Error("Could not execute storage stats sample query", zap.Error(err))
+				return nil, RUNTIME_EXCEPTION, errors.New("Error getting storage stats")
+			}
+			stats = append(stats, stat)
+		}
+	}
+
+	// Report empty collections explicitly when one was requested.
+	if collection != "" && len(stats) == 0 {
+		stats = append(stats, &StorageStat{Bucket: bucket, Collection: collection})
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Bucket != stats[j].Bucket {
+			return stats[i].Bucket < stats[j].Bucket
+		}
+		return stats[i].Collection < stats[j].Collection
+	})
+	return stats, 0, nil
+}
+
+// storageStatsCount counts the live records of each collection in one database.
+func storageStatsCount(db *sql.DB, bucket string, collection string) ([]*StorageStat, error) {
+	// The index leads with deleted_at, bucket and collection so counting never reads the records themselves.
+	query := "SELECT bucket, collection, count(*) FROM storage@deleted_at_bucket_collection_read_record_user_id_idx WHERE deleted_at = 0"
+	params := make([]interface{}, 0)
+	if bucket != "" {
+		params = append(params, bucket)
+		query += fmt.Sprintf(" AND bucket = $%v", len(params))
+	}
+	if collection != "" {
+		params = append(params, collection)
+		query += fmt.Sprintf(" AND collection = $%v", len(params))
+	}
+	query += " GROUP BY bucket, collection"
+
+	rows, err := db.Query(query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := make([]*StorageStat, 0)
+	for rows.Next() {
+		stat := &StorageStat{}
+		if err = rows.Scan(&stat.Bucket, &stat.Collection, &stat.Count); err != nil {
+			return nil, err
+		}
+		stats = append(stats, stat)
+	}
+	return stats, rows.Err()
+}
+
+// storageStatsSample estimates the total value size of a counted collection from a sample of its records.
+func storageStatsSample(db *sql.DB, stat *StorageStat) error {
+	var sampleCount, sampleBytes int64
+	err := db.QueryRow(`SELECT count(*), COALESCE(sum(length(value)), 0)
+FROM (SELECT value FROM storage WHERE deleted_at = 0 AND bucket = $1 AND collection = $2 LIMIT $3) AS sample`,
+		stat.Bucket, stat.Collection, storageStatsSampleSize).Scan(&sampleCount, &sampleBytes)
+	if err != nil {
+		return err
+	}
+	if sampleCount != 0 {
+		stat.Bytes = sampleBytes * stat.Count / sampleCount
+	}
+	return nil
+}
+
+func NewStorageStatsCache(duration time.Duration) *StorageStatsCache {
+	return &StorageStatsCache{
+		duration: duration,
+		entries:  make(map[string]*storageStatsEntry),
+	}
+}
+
+// Get returns cached storage stats if they are recent enough, otherwise it queries them again, or waits for the query
+// already running for them.
+func (c *StorageStatsCache) Get(logger *zap.Logger, db *sql.DB, router *StorageRouter, bucket string, collection string) ([]*StorageStat, Error_Code, error) {
+	key := bucket + "/" + collection
+
+	c.Lock()
+	entry, ok := c.entries[key]
+	if ok {
+		select {
+		case <-entry.done:
+			ok = time.Since(entry.checkedAt) < c.duration
+		default:
+		}
+	}
+	if !ok {
+		entry = &storageStatsEntry{done: make(chan struct{})}
+		c.entries[key] = entry
+		c.Unlock()
+
+		entry.stats, entry.code, entry.err = StorageStats(logger, db, router, bucket, collection)
+		if entry.err == nil {
+			entry.checkedAt = time.Now()
+		}
+		close(entry.done)
+		return entry.stats, entry.code, entry.err
+	}
+	c.Unlock()
+
+	<-entry.done
+	return entry.stats, entry.code, entry.err
+}
+
+func NewStorageUsageCache(logger *zap.Logger, db *sql.DB, router *StorageRouter) *StorageUsageCache {
+	return &StorageUsageCache{
+		logger:   logger,
+		db:       db,
+		router:   router,
+		entries:  make(map[uuid.UUID]*StorageUsage),
+		versions: make(map[uuid.UUID]uint64),
+	}
+}
+
+// Get returns the number of live records a user owns and the total size of their values.
+func (c *StorageUsageCache) Get(userID uuid.UUID) (*StorageUsage, error) {
+	c.Lock()
+	usage, ok := c.entries[userID]
+	version, epoch := c.versions[userID], c.epoch
+	c.Unlock()
+	if ok {
+		return usage, nil
+	}
+
+	// A user's records may be spread over several storage backends.
+	usage = &StorageUsage{}
+	for _, db := range c.router.all(c.db) {
+		var count, size int64
+		err := db.QueryRow("SELECT count(*), COALESCE(sum(length(value)), 0) FROM storage WHERE deleted_at = 0 AND user_id = $1", userID.Bytes()).
+			Scan(&count, &size)
+		if err != nil {
+			c.logger.Error("Could not execute storage usage query", zap.Error(err))
+			return nil, err
+		}
+		usage.Count += count
+		usage.Bytes += size
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if c.versions[userID] != version || c.epoch != epoch {
+		// The user's storage changed while it was read, the usage may be stale so only the caller sees it.
+		return usage, nil
+	}
+	// Start over rather than grow without bound, entries are cheap to recompute. Versions start over too, and the
+	// epoch keeps usage read before that from being cached.
+	if len(c.entries) >= storageUsageCacheMaxEntries {
+		c.entries = make(map[uuid.UUID]*StorageUsage)
+		c.versions = make(map[uuid.UUID]uint64)
+		c.epoch++
+	}
+	c.entries[userID] = usage
+	return usage, nil
+}
+
+// Invalidate drops the cached usage of each given user, it should be called after changes to their storage commit.
+func (c *StorageUsageCache) Invalidate(userIDs ...[]byte) {
+	c.Lock()
+	if len(c.versions) >= storageUsageCacheMaxEntries {
+		c.entries = make(map[uuid.UUID]*StorageUsage)
+		c.versions = make(map[uuid.UUID]uint64)
+		c.epoch++
+	}
+	for _, userID := range userIDs {
+		if uid, err := uuid.FromBytes(userID); err == nil {
+			delete(c.entries, uid)
+			c.versions[uid]++
+		}
+	}
+	c.Unlock()
+}
+
+// InvalidateData drops the cached usage of the owners of the given storage data.
+func (c *StorageUsageCache) InvalidateData(data []*StorageData) {
+	userIDs := make([][]byte, 0, len(data))
+	for _, d := range data {
+		userIDs = append(userIDs, d.UserId)
+	}
+	c.Invalidate(userIDs...)
+}
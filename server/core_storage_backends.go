@@ -0,0 +1,198 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrStorageBackendsSpanned is returned when one storage operation touches collections kept in different backends, it
+// would need a transaction across databases.
+var ErrStorageBackendsSpanned = errors.New("Storage operation spans collections in different storage backends")
+
+// StorageRouter sends reads and writes of routed collections to a secondary database instead of the main one. Every
+// backend is migrated like the main database on startup. Listings and stats that are not narrowed to a collection,
+// idempotency keys, change records, and anything outside the storage engine use the main database. The router also
+// carries the storage encryption, permission policy, read replica and the collections whose changes are captured, so
+// every storage call it is passed to encrypts, decrypts, governs permissions, reads and records changes the same way. A
+// nil router keeps all collections in the main database, unencrypted, with the permissions their writers ask for, reads
+// from the main database, and captures no changes.
+type StorageRouter struct {
+	collections map[string]*sql.DB
+	backends    []*sql.DB
+	encryption  *StorageEncryption
+	policy      *StoragePermissionPolicy
+	replica     *StorageReplica
+	changes     map[string]bool
+}
+
+// NewStorageRouter creates the router described by the storage config, given the connection of each named backend. It
+// returns nil if no collections are routed, no encryption keys are configured and no collection permissions are set.
+func NewStorageRouter(config *StorageConfig, backends map[string]*sql.DB) (*StorageRouter, error) {
+	encryption, err := NewStorageEncryption(config)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := NewStoragePermissionPolicy(config)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.CollectionBackends) == 0 && encryption == nil && policy == nil {
+		return nil, nil
+	}
+
+	r := &StorageRouter{
+		collections: make(map[string]*sql.DB, len(config.CollectionBackends)),
+		backends:    make([]*sql.DB, 0, len(backends)),
+		encryption:  encryption,
+		policy:      policy,
+	}
+	used := make(map[*sql.DB]bool, len(backends))
+	for c, name := range config.CollectionBackends {
+		parts := strings.SplitN(c, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.New("storage collection backends must be keyed by bucket/collection")
+		}
+		db, ok := backends[name]
+		if !ok || db == nil {
+			return nil, fmt.Errorf("storage collection %v is routed to unknown backend %v", c, name)
+		}
+		r.collections[c] = db
+		if !used[db] {
+			used[db] = true
+			r.backends = append(r.backends, db)
+		}
+	}
+	return r, nil
+}
+
+// WithChangeCollections returns a copy of the router that records writes and removals in the given collections, keyed
+// by bucket/collection, for change subscribers. The router it is called on is left as it was.
+func (r *StorageRouter) WithChangeCollections(collections map[string]bool) *StorageRouter {
+	c := &StorageRouter{}
+	if r != nil {
+		*c = *r
+	}
+	c.changes = collections
+	return c
+}
+
+// WithReadReplica returns a copy of the router that sends reads meant for the main database to the replica. The router it
+// is called on is left as it was.
+func (r *StorageRouter) WithReadReplica(replica *StorageReplica) *StorageRouter {
+	c := &StorageRouter{}
+	if r != nil {
+		*c = *r
+	}
+	c.replica = replica
+	return c
+}
+
+// routed reports whether a collection is kept in a backend other than the main database.
+func (r *StorageRouter) routed(bucket, collection string) bool {
+	if r == nil {
+		return false
+	}
+	_, ok := r.collections[bucket+"/"+collection]
+	return ok
+}
+
+// resolve returns the database holding a collection.
+func (r *StorageRouter) resolve(db *sql.DB, bucket, collection string) *sql.DB {
+	if r == nil {
+		return db
+	}
+	if routed, ok := r.collections[bucket+"/"+collection]; ok {
+		return routed
+	}
+	return db
+}
+
+// resolveKeys returns the database holding all the keys, or ErrStorageBackendsSpanned if they are not in one database.
+func (r *StorageRouter) resolveKeys(db *sql.DB, keys []*StorageKey) (*sql.DB, error) {
+	if r == nil || len(keys) == 0 {
+		return db, nil
+	}
+	resolved := r.resolve(db, keys[0].Bucket, keys[0].Collection)
+	for _, key := range keys[1:] {
+		if r.resolve(db, key.Bucket, key.Collection) != resolved {
+			return nil, ErrStorageBackendsSpanned
+		}
+	}
+	return resolved, nil
+}
+
+// resolveData returns the database holding all the data, or ErrStorageBackendsSpanned if it is not in one database.
+func (r *StorageRouter) resolveData(db *sql.DB, data []*StorageData) (*sql.DB, error) {
+	if r == nil || len(data) == 0 {
+		return db, nil
+	}
+	resolved := r.resolve(db, data[0].Bucket, data[0].Collection)
+	for _, d := range data[1:] {
+		if r.resolve(db, d.Bucket, d.Collection) != resolved {
+			return nil, ErrStorageBackendsSpanned
+		}
+	}
+	return resolved, nil
+}
+
+// all returns the main database and every backend with routed collections.
+func (r *StorageRouter) all(db *sql.DB) []*sql.DB {
+	if r == nil {
+		return []*sql.DB{db}
+	}
+	dbs := []*sql.DB{db}
+	for _, backend := range r.backends {
+		if backend != db {
+			dbs = append(dbs, backend)
+		}
+	}
+	return dbs
+}
+
+// encrypter returns the storage encryption values are written and read with, nil if none is configured.
+func (r *StorageRouter) encrypter() *StorageEncryption {
+	if r == nil {
+		return nil
+	}
+	return r.encryption
+}
+
+// permissionPolicy returns the permission policy applied to writes, nil if no collection permissions are set.
+func (r *StorageRouter) permissionPolicy() *StoragePermissionPolicy {
+	if r == nil {
+		return nil
+	}
+	return r.policy
+}
+
+// changeCaptured reports whether changes to a collection are recorded.
+func (r *StorageRouter) changeCaptured(bucket, collection string) bool {
+	if r == nil {
+		return false
+	}
+	return r.changes[bucket+"/"+collection]
+}
+
+// readReplica returns the read replica router, nil if reads stay on the main database.
+func (r *StorageRouter) readReplica() *StorageReplica {
+	if r == nil {
+		return nil
+	}
+	return r.replica
+}
@@ -0,0 +1,225 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"go.uber.org/zap"
+)
+
+const (
+	STORAGE_CHANGE_WRITE  = "write"
+	STORAGE_CHANGE_REMOVE = "remove"
+
+	storageChangePollInterval = time.Second
+	storageChangeBatchSize    = 100
+	// Claimed changes are hidden from other workers for this long, and delivered again if not completed or failed by then.
+	storageChangeLeaseMs = int64(60 * 1000)
+)
+
+// StorageChange is a write or removal of a record in a collection with change subscribers. Before and After hold the
+// record's value as stored, and are nil if there was no record before the change or none after it.
+type StorageChange struct {
+	Seq        int64
+	Bucket     string
+	Collection string
+	Record     string
+	UserId     []byte
+	Op         string
+	Before     []byte
+	After      []byte
+	CreatedAt  int64
+	Attempts   int64
+}
+
+// storageChangeBefore reads the value a record has before it is changed in the transaction, or nil if it does not exist.
+func storageChangeBefore(tx *sql.Tx, bucket, collection string, owner []byte, record string) ([]byte, error) {
+	var value []byte
+	err := tx.QueryRow("SELECT value FROM storage WHERE user_id = $1 AND bucket = $2 AND collection = $3 AND record = $4 AND deleted_at = 0",
+		owner, bucket, collection, record).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return value, err
+}
+
+// storageChangeRecord stores a change in the same transaction as the change itself, so it is delivered if and only if
+// the change is committed. The change is numbered after the record's pending changes in the same transaction, so two
+// writers on different nodes cannot commit their changes to a record out of order.
+func storageChangeRecord(tx *sql.Tx, change *StorageChange, ts int64) error {
+	_, err := tx.Exec(`INSERT INTO storage_change (bucket, collection, record, user_id, op, value_before, value_after, created_at, run_at, key_seq)
+SELECT $1, $2, $3, $4, $5, $6, $7, $8, $8, COALESCE(max(key_seq), 0) + 1 FROM storage_change
+WHERE bucket = $1 AND collection = $2 AND user_id = $4 AND record = $3`, change.Bucket, change.Collection, change.Record, change.UserId, change.Op, change.Before, change.After, ts)
+	return err
+}
+
+// StorageChangeClaim takes up to limit changes that are due for delivery, and leases them to the caller. Only the oldest
+// pending change of each record is claimed, so the changes to a record are delivered one at a time and in order. A
+// leased change is delivered again if it is neither completed nor failed before the lease ends.
+func StorageChangeClaim(logger *zap.Logger, db *sql.DB, limit int) ([]*StorageChange, error) {
+	ts := nowMs()
+	rows, err := db.Query(`UPDATE storage_change SET run_at = $1, attempts = attempts + 1
+WHERE seq IN (SELECT seq FROM storage_change AS c WHERE run_at <= $2 AND NOT EXISTS (
+  SELECT seq FROM storage_change AS p
+  WHERE p.bucket = c.bucket AND p.collection = c.collection AND p.user_id = c.user_id AND p.record = c.record
+  AND (p.key_seq < c.key_seq OR (p.key_seq = c.key_seq AND p.seq < c.seq))
+) ORDER BY seq LIMIT $3)
+RETURNING seq, bucket, collection, record, user_id, op, value_before, value_after, created_at, attempts`, ts+storageChangeLeaseMs, ts, limit)
+	if err != nil {
+		logger.Error("Could not claim storage changes", zap.Error(err))
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := make([]*StorageChange, 0, limit)
+	for rows.Next() {
+		change := &StorageChange{}
+		if err = rows.Scan(&change.Seq, &change.Bucket, &change.Collection, &change.Record, &change.UserId, &change.Op, &change.Before, &change.After, &change.CreatedAt, &change.Attempts); err != nil {
+			logger.Error("Could not scan claimed storage change", zap.Error(err))
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	if err = rows.Err(); err != nil {
+		logger.Error("Could not claim storage changes", zap.Error(err))
+		return nil, err
+	}
+	return changes, nil
+}
+
+// StorageChangeComplete removes a change that was delivered.
+func StorageChangeComplete(logger *zap.Logger, db *sql.DB, change *StorageChange) error {
+	if _, err := db.Exec("DELETE FROM storage_change WHERE seq = $1", change.Seq); err != nil {
+		logger.Error("Could not complete storage change", zap.Error(err))
+		return err
+	}
+	metrics.IncrCounter([]string{"storage", "change", "delivered"}, 1)
+	return nil
+}
+
+// StorageChangeFail schedules a change that could not be delivered to be retried with backoff. Changes are never
+// dropped, later changes to the same record wait until it is delivered.
+func StorageChangeFail(logger *zap.Logger, db *sql.DB, change *StorageChange) error {
+	if _, err := db.Exec("UPDATE storage_change SET run_at = $1 WHERE seq = $2", nowMs()+jobRetryBackoff(change.Attempts), change.Seq); err != nil {
+		logger.Error("Could not record storage change failure", zap.Error(err))
+		return err
+	}
+	metrics.IncrCounter([]string{"storage", "change", "retried"}, 1)
+	return nil
+}
+
+// decrypt returns the plaintext of one of the change's values.
+func (c *StorageChange) decrypt(encryption *StorageEncryption, value []byte) ([]byte, error) {
+	if value == nil {
+		return nil, nil
+	}
+	d := &StorageData{Bucket: c.Bucket, Collection: c.Collection, Record: c.Record, UserId: c.UserId, Value: value}
+	if err := encryption.decrypt(d); err != nil {
+		return nil, err
+	}
+	return d.Value, nil
+}
+
+// StorageChangeWorker delivers recorded storage changes until stopped. Changes are only recorded in the main database,
+// collections routed to other storage backends cannot have change functions.
+type StorageChangeWorker struct {
+	logger     *zap.Logger
+	db         *sql.DB
+	encryption *StorageEncryption
+	deliver    func(change *StorageChange, before, after []byte) error
+	stopCh     chan bool
+	stopOnce   sync.Once
+	wg         sync.WaitGroup
+}
+
+// NewStorageChangeWorker starts delivering changes with the given function, which gets the plaintext values before and
+// after each change, decrypted with the router's storage encryption. Changes the function returns an error for are
+// retried.
+func NewStorageChangeWorker(logger *zap.Logger, db *sql.DB, router *StorageRouter, deliver func(change *StorageChange, before, after []byte) error) *StorageChangeWorker {
+	w := &StorageChangeWorker{
+		logger:     logger,
+		db:         db,
+		encryption: router.encrypter(),
+		deliver:    deliver,
+		stopCh:     make(chan bool),
+	}
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		ticker := time.NewTicker(storageChangePollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.stopCh:
+				return
+			case <-ticker.C:
+				w.poll(w.db)
+			}
+		}
+	}()
+
+	return w
+}
+
+// Stop ends delivery once the change in progress is done. Changes claimed but not delivered are delivered again after
+// their lease.
+func (w *StorageChangeWorker) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.stopCh)
+	})
+	w.wg.Wait()
+}
+
+// poll delivers batches of due changes from one database until it has none left or the worker is stopped.
+func (w *StorageChangeWorker) poll(db *sql.DB) {
+	for {
+		select {
+		case <-w.stopCh:
+			return
+		default:
+		}
+
+		changes, err := StorageChangeClaim(w.logger, db, storageChangeBatchSize)
+		if err != nil || len(changes) == 0 {
+			return
+		}
+
+		for _, change := range changes {
+			if err := w.deliverChange(change); err != nil {
+				w.logger.Warn("Storage change delivery failed", zap.Int64("attempts", change.Attempts), zap.Error(err))
+				StorageChangeFail(w.logger, db, change)
+				continue
+			}
+			StorageChangeComplete(w.logger, db, change)
+		}
+	}
+}
+
+func (w *StorageChangeWorker) deliverChange(change *StorageChange) error {
+	before, err := change.decrypt(w.encryption, change.Before)
+	if err != nil {
+		return err
+	}
+	after, err := change.decrypt(w.encryption, change.After)
+	if err != nil {
+		return err
+	}
+	return w.deliver(change, before, after)
+}
@@ -0,0 +1,139 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Encrypted values start with this envelope version byte. Plain values are JSON objects, which never do.
+const storageEnvelopeVersion byte = 1
+
+// StorageEncryption encrypts the values of flagged collections before they are written, and decrypts any encrypted
+// value after it is read. Bucket, collection, record, owner and permissions stay in plaintext so listing and
+// permission checks work as before.
+type StorageEncryption struct {
+	keyID       string
+	aeads       map[string]cipher.AEAD
+	collections map[string]bool
+}
+
+// NewStorageEncryption creates the storage encryption described by the storage config, or returns nil if no
+// encryption keys are configured. Keys are "id:base64" pairs of 32 byte AES keys. The first key encrypts new
+// writes, the rest are kept to decrypt values written before a key rotation.
+func NewStorageEncryption(config *StorageConfig) (*StorageEncryption, error) {
+	if len(config.EncryptionKeys) == 0 {
+		if len(config.EncryptedCollections) != 0 {
+			return nil, errors.New("storage encrypted collections need at least one encryption key")
+		}
+		return nil, nil
+	}
+
+	e := &StorageEncryption{
+		aeads:       make(map[string]cipher.AEAD, len(config.EncryptionKeys)),
+		collections: make(map[string]bool, len(config.EncryptedCollections)),
+	}
+	for _, k := range config.EncryptionKeys {
+		parts := strings.SplitN(k, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || len(parts[0]) > 255 {
+			return nil, errors.New("storage encryption keys must be given as id:base64")
+		}
+		if _, ok := e.aeads[parts[0]]; ok {
+			return nil, fmt.Errorf("duplicate storage encryption key id %v", parts[0])
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("storage encryption key %v must be 32 bytes encoded as base64", parts[0])
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		if e.keyID == "" {
+			e.keyID = parts[0]
+		}
+		e.aeads[parts[0]] = aead
+	}
+	for _, c := range config.EncryptedCollections {
+		parts := strings.SplitN(c, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.New("storage encrypted collections must be given as bucket/collection")
+		}
+		e.collections[c] = true
+	}
+	return e, nil
+}
+
+// encrypt returns the value to store for the given data, encrypted with the current key if its collection is flagged.
+func (e *StorageEncryption) encrypt(d *StorageData) ([]byte, error) {
+	if e == nil || !e.collections[d.Bucket+"/"+d.Collection] {
+		return d.Value, nil
+	}
+
+	aead := e.aeads[e.keyID]
+	header := make([]byte, 2+len(e.keyID)+aead.NonceSize(), 2+len(e.keyID)+aead.NonceSize()+len(d.Value)+aead.Overhead())
+	header[0] = storageEnvelopeVersion
+	header[1] = byte(len(e.keyID))
+	copy(header[2:], e.keyID)
+	nonce := header[2+len(e.keyID):]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(header, nonce, d.Value, storageEnvelopeAdditionalData(d)), nil
+}
+
+// decrypt replaces an encrypted value with its plaintext, values that are not encrypted are left as they are.
+func (e *StorageEncryption) decrypt(d *StorageData) error {
+	if len(d.Value) == 0 || d.Value[0] != storageEnvelopeVersion {
+		return nil
+	}
+	if e == nil {
+		return errors.New("storage value is encrypted but no encryption keys are configured")
+	}
+
+	if len(d.Value) < 2 || len(d.Value) < 2+int(d.Value[1]) {
+		return errors.New("storage value has an invalid encryption envelope")
+	}
+	keyID := string(d.Value[2 : 2+int(d.Value[1])])
+	aead, ok := e.aeads[keyID]
+	if !ok {
+		return fmt.Errorf("storage value is encrypted with unknown key %v", keyID)
+	}
+	body := d.Value[2+len(keyID):]
+	if len(body) < aead.NonceSize() {
+		return errors.New("storage value has an invalid encryption envelope")
+	}
+	value, err := aead.Open(nil, body[:aead.NonceSize()], body[aead.NonceSize():], storageEnvelopeAdditionalData(d))
+	if err != nil {
+		return err
+	}
+	d.Value = value
+	return nil
+}
+
+// Ciphertexts are bound to their storage key, so an encrypted value copied to another record will not decrypt.
+func storageEnvelopeAdditionalData(d *StorageData) []byte {
+	return []byte(d.Bucket + "\x00" + d.Collection + "\x00" + d.Record + "\x00" + string(d.UserId))
+}
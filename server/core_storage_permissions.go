@@ -0,0 +1,67 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// StoragePermissionPolicy sets the read and write permissions of every write to governed collections, whatever
+// permissions the writer asked for.
+type StoragePermissionPolicy struct {
+	collections map[string]*StoragePermissionsConfig
+}
+
+// NewStoragePermissionPolicy creates the permission policy described by the storage config, or returns nil if no
+// collections are governed.
+func NewStoragePermissionPolicy(config *StorageConfig) (*StoragePermissionPolicy, error) {
+	if len(config.CollectionPermissions) == 0 {
+		return nil, nil
+	}
+
+	p := &StoragePermissionPolicy{
+		collections: make(map[string]*StoragePermissionsConfig, len(config.CollectionPermissions)),
+	}
+	for c, permissions := range config.CollectionPermissions {
+		parts := strings.SplitN(c, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.New("storage collection permissions must be keyed by bucket/collection")
+		}
+		if permissions == nil {
+			return nil, fmt.Errorf("storage collection permissions for %v must be set", c)
+		}
+		if permissions.Read != 0 && permissions.Read != 1 && permissions.Read != 2 {
+			return nil, fmt.Errorf("storage collection permissions for %v have an invalid read value", c)
+		}
+		if permissions.Write != 0 && permissions.Write != 1 {
+			return nil, fmt.Errorf("storage collection permissions for %v have an invalid write value", c)
+		}
+		p.collections[c] = permissions
+	}
+	return p, nil
+}
+
+// apply replaces the permissions of data in a governed collection with the collection's permissions.
+func (p *StoragePermissionPolicy) apply(d *StorageData) {
+	if p == nil {
+		return
+	}
+	if permissions, ok := p.collections[d.Bucket+"/"+d.Collection]; ok {
+		d.PermissionRead = permissions.Read
+		d.PermissionWrite = permissions.Write
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"sync"
+
+	"github.com/satori/go.uuid"
+)
+
+// storageReplicaSweepWrites is how many writes are tracked between sweeps of write times past the primary window.
+const storageReplicaSweepWrites = 1024
+
+// StorageReplica sends storage reads meant for the main database to a read replica, writes always go to the main
+// database. Reads of a user's records shortly after they were written go to the main database too, so users see their
+// own writes even when the replica lags. Writes are only tracked on the node that made them. Global records are
+// tracked together as if they had one owner.
+type StorageReplica struct {
+	sync.Mutex
+	primary             *sql.DB
+	replica             *sql.DB
+	primaryAfterWriteMs int64
+	writes              map[uuid.UUID]int64
+	sweepCount          int
+}
+
+// NewStorageReplica creates a replica router for the primary database. Reads of records written in the last
+// primaryAfterWriteMs go to the primary, 0 sends all reads to the replica.
+func NewStorageReplica(primary, replica *sql.DB, primaryAfterWriteMs int64) *StorageReplica {
+	return &StorageReplica{
+		primary:             primary,
+		replica:             replica,
+		primaryAfterWriteMs: primaryAfterWriteMs,
+		writes:              make(map[uuid.UUID]int64),
+	}
+}
+
+// resolveRead returns the database a read from db should use. Only reads from the primary are sent to the replica,
+// unless the caller asked for the primary or one of the owners' records was written recently.
+func (r *StorageReplica) resolveRead(db *sql.DB, primary bool, owners ...[]byte) *sql.DB {
+	if r == nil || primary || db != r.primary {
+		return db
+	}
+	if r.primaryAfterWriteMs > 0 {
+		cutoff := nowMs() - r.primaryAfterWriteMs
+		r.Lock()
+		defer r.Unlock()
+		for _, owner := range owners {
+			if r.writes[uuid.FromBytesOrNil(owner)] > cutoff {
+				return db
+			}
+		}
+	}
+	return r.replica
+}
+
+// written records that the owners' records in db were just written.
+func (r *StorageReplica) written(db *sql.DB, owners ...[]byte) {
+	if r == nil || db != r.primary || r.primaryAfterWriteMs <= 0 {
+		return
+	}
+	ts := nowMs()
+	r.Lock()
+	defer r.Unlock()
+	for _, owner := range owners {
+		r.writes[uuid.FromBytesOrNil(owner)] = ts
+	}
+	if r.sweepCount++; r.sweepCount >= storageReplicaSweepWrites {
+		r.sweepCount = 0
+		for owner, writtenAt := range r.writes {
+			if writtenAt <= ts-r.primaryAfterWriteMs {
+				delete(r.writes, owner)
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+const (
+	STORAGE_SET_INTERSECT  = "intersect"
+	STORAGE_SET_UNION      = "union"
+	STORAGE_SET_DIFFERENCE = "difference"
+)
+
+var storageSetOperators = map[string]string{
+	STORAGE_SET_INTERSECT:  "INTERSECT",
+	STORAGE_SET_UNION:      "UNION",
+	STORAGE_SET_DIFFERENCE: "EXCEPT",
+}
+
+// StorageSetOp compares the record keys of two owners' collections in the database and returns the keys in the
+// result, sorted, a page at a time. Difference returns the keys only the first owner has. A nil owner means global
+// records. Both collections must be kept in the same storage backend. The returned cursor fetches the next page, and
+// is nil after the last page.
+func StorageSetOp(logger *zap.Logger, db *sql.DB, router *StorageRouter, bucket string, collectionA string, ownerA uuid.UUID, collectionB string, ownerB uuid.UUID, op string, limit int64, cursor []byte) ([]string, []byte, Error_Code, error) {
+	operator, ok := storageSetOperators[op]
+	if !ok {
+		return nil, nil, BAD_INPUT, errors.New("Set operation must be intersect, union or difference")
+	}
+	if bucket == "" || collectionA == "" || collectionB == "" {
+		return nil, nil, BAD_INPUT, errors.New("Invalid values for bucket or collection")
+	}
+	if limit == 0 {
+		limit = 10
+	} else if limit < 10 || limit > 100 {
+		return nil, nil, BAD_INPUT, errors.New("Limit must be between 10 and 100")
+	}
+
+	keyA := &StorageKey{Bucket: bucket, Collection: collectionA, UserId: storageSetOwner(ownerA)}
+	keyB := &StorageKey{Bucket: bucket, Collection: collectionB, UserId: storageSetOwner(ownerB)}
+	if routed, err := router.resolveKeys(db, []*StorageKey{keyA, keyB}); err != nil {
+		return nil, nil, BAD_INPUT, err
+	} else {
+		db = routed
+	}
+	db = router.readReplica().resolveRead(db, false, keyA.UserId, keyB.UserId)
+
+	// The cursor is the last record key of the previous page. One more key than the limit is read to tell whether
+	// there is a next page.
+	query := `
+SELECT record FROM (
+  SELECT record FROM storage WHERE bucket = $1 AND collection = $2 AND user_id = $3 AND deleted_at = 0
+  ` + operator + `
+  SELECT record FROM storage WHERE bucket = $1 AND collection = $4 AND user_id = $5 AND deleted_at = 0
+) AS s WHERE record > $6
+ORDER BY record LIMIT $7`
+	rows, err := db.Query(query, bucket, collectionA, keyA.UserId, collectionB, keyB.UserId, string(cursor), limit+1)
+	if err != nil {
+		logger.Error("Error in storage set operation", zap.Error(err))
+		return nil, nil, RUNTIME_EXCEPTION, err
+	}
+	defer rows.Close()
+
+	records := make([]string, 0, limit)
+	var newCursor []byte
+	for rows.Next() {
+		if int64(len(records)) >= limit {
+			newCursor = []byte(records[len(records)-1])
+			break
+		}
+		var record string
+		if err := rows.Scan(&record); err != nil {
+			logger.Error("Could not execute storage set operation query", zap.Error(err))
+			return nil, nil, RUNTIME_EXCEPTION, err
+		}
+		records = append(records, record)
+	}
+	if err = rows.Err(); err != nil {
+		logger.Error("Could not execute storage set operation query", zap.Error(err))
+		return nil, nil, RUNTIME_EXCEPTION, err
+	}
+
+	return records, newCursor, 0, nil
+}
+
+// storageSetOwner returns the stored form of an owner, global records have an empty user ID.
+func storageSetOwner(owner uuid.UUID) []byte {
+	if owner == uuid.Nil {
+		return []byte{}
+	}
+	return owner.Bytes()
+}
@@ -0,0 +1,119 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"unicode/utf8"
+
+	"github.com/armon/go-metrics"
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+// StreamDescriptor identifies a real-time stream a session can be subscribed to. Mode is either "room", with the room
+// name as the subject, "group", with the group ID as the subject, or "leaderboard", with the leaderboard ID as the
+// subject.
+type StreamDescriptor struct {
+	Mode    string
+	Subject string
+}
+
+// StreamDirective lists the stream subscriptions a runtime before function wants added to or removed from the session
+// that sent the message.
+type StreamDirective struct {
+	Join  []*StreamDescriptor
+	Leave []*StreamDescriptor
+}
+
+// Topic returns the tracker topic backing the stream, or an error if the stream is not valid.
+func (s *StreamDescriptor) Topic() (string, error) {
+	switch s.Mode {
+	case "room":
+		if len(s.Subject) < 1 || len(s.Subject) > 64 {
+			return "", errors.New("room name is required and must be 1-64 chars")
+		}
+		if controlCharsRegex.MatchString(s.Subject) {
+			return "", errors.New("room name must not contain control chars")
+		}
+		if !utf8.ValidString(s.Subject) {
+			return "", errors.New("room name must only contain valid UTF-8 bytes")
+		}
+		return "room:" + s.Subject, nil
+	case "group":
+		groupID, err := uuid.FromString(s.Subject)
+		if err != nil {
+			return "", errors.New("group ID is not valid")
+		}
+		return "group:" + groupID.String(), nil
+	case "leaderboard":
+		if len(s.Subject) < 1 || len(s.Subject) > 128 {
+			return "", errors.New("leaderboard ID is required and must be 1-128 chars")
+		}
+		return "leaderboard:" + s.Subject, nil
+	}
+	return "", errors.New("stream mode must be room, group or leaderboard")
+}
+
+// StreamDirectiveApply subscribes the session to the joined streams and unsubscribes it from the left ones. Subscriptions
+// are tracked presences, so they are dropped along with all other presences when the session closes.
+func StreamDirectiveApply(tracker Tracker, sessionID uuid.UUID, userID uuid.UUID, handle string, directive *StreamDirective) error {
+	for _, s := range directive.Join {
+		topic, err := s.Topic()
+		if err != nil {
+			return err
+		}
+		tracker.Track(sessionID, topic, userID, PresenceMeta{Handle: handle})
+	}
+	for _, s := range directive.Leave {
+		topic, err := s.Topic()
+		if err != nil {
+			return err
+		}
+		tracker.Untrack(sessionID, topic, userID)
+	}
+	return nil
+}
+
+// StreamLeaderboardRecord sends a written record to the sessions subscribed to its leaderboard. If a runtime leaderboard
+// record update function is registered it picks the subscribers that receive the record, and runs on the runtime worker
+// pool so the writer is not held up. While the pool is full those updates are dropped, logged and counted in
+// leaderboard.stream.dropped.
+func StreamLeaderboardRecord(logger *zap.Logger, runtime *Runtime, tracker Tracker, messageRouter MessageRouter, record *LeaderboardRecord) {
+	subscribers := tracker.ListByTopic("leaderboard:" + string(record.LeaderboardId))
+	if len(subscribers) == 0 {
+		return
+	}
+
+	update := &Envelope{Payload: &Envelope_LeaderboardRecordUpdate{LeaderboardRecordUpdate: record}}
+	if !runtime.IsRuntimeLeaderboardRecordUpdateRegistered() {
+		messageRouter.Send(logger, subscribers, update)
+		metrics.IncrCounter([]string{"leaderboard", "stream", "sent"}, float32(len(subscribers)))
+		return
+	}
+
+	queued := runtime.RunAsync(func() {
+		recipients := RuntimeLeaderboardRecordUpdateHook(logger, runtime, record, subscribers)
+		if len(recipients) == 0 {
+			return
+		}
+		messageRouter.Send(logger, recipients, update)
+		metrics.IncrCounter([]string{"leaderboard", "stream", "sent"}, float32(len(recipients)))
+	})
+	if !queued {
+		logger.Warn("Runtime worker pool full, dropping leaderboard record update", zap.String("leaderboard_id", string(record.LeaderboardId)))
+		metrics.IncrCounter([]string{"leaderboard", "stream", "dropped"}, float32(len(subscribers)))
+	}
+}
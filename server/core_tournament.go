@@ -0,0 +1,598 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+const (
+	TOURNAMENT_STATE_OPEN     = 0
+	TOURNAMENT_STATE_RUNNING  = 1
+	TOURNAMENT_STATE_COMPLETE = 2
+
+	tournamentSizeMax      = 256
+	tournamentPollInterval = 10 * time.Second
+)
+
+var (
+	// ErrTournamentNotFound is returned when a tournament does not exist.
+	ErrTournamentNotFound = errors.New("Tournament not found")
+	// ErrTournamentClosed is returned when a user joins a tournament that has already started.
+	ErrTournamentClosed = errors.New("Tournament is not open to join")
+	// ErrTournamentFull is returned when a user joins a tournament that has as many participants as its size.
+	ErrTournamentFull = errors.New("Tournament is full")
+	// ErrTournamentNotRunning is returned when a result is submitted to a tournament that has not started or is complete.
+	ErrTournamentNotRunning = errors.New("Tournament is not running")
+	// ErrTournamentNoMatch is returned when a result is submitted for a user with no undecided match in the current round.
+	ErrTournamentNoMatch = errors.New("User has no undecided match in the current round")
+)
+
+var tournamentStates = map[int]string{
+	TOURNAMENT_STATE_OPEN:     "open",
+	TOURNAMENT_STATE_RUNNING:  "running",
+	TOURNAMENT_STATE_COMPLETE: "complete",
+}
+
+// Tournament is a single elimination tournament. It is open to join until it starts, then runs one round at a time
+// until a winner is left or it ends.
+type Tournament struct {
+	ID        uuid.UUID
+	Title     string
+	Size      int
+	State     int
+	Round     int
+	WinnerID  uuid.UUID
+	Metadata  []byte
+	StartAt   int64
+	EndAt     int64
+	CreatedAt int64
+	UpdatedAt int64
+}
+
+// TournamentParticipant is a user who joined a tournament. Participants are seeded by rating when the tournament
+// starts, 1 is the best seed.
+type TournamentParticipant struct {
+	UserID    uuid.UUID
+	Handle    string
+	Rating    int64
+	Seed      int
+	CreatedAt int64
+}
+
+// TournamentMatch is one match in a tournament bracket. A match against a bye has a nil user, and is won by the other.
+type TournamentMatch struct {
+	Round     int
+	Position  int
+	UserA     uuid.UUID
+	UserB     uuid.UUID
+	WinnerID  uuid.UUID
+	UpdatedAt int64
+}
+
+// TournamentBracket is a tournament with its participants and every match played or to play so far.
+type TournamentBracket struct {
+	Tournament   *Tournament
+	Participants []*TournamentParticipant
+	Matches      []*TournamentMatch
+}
+
+// TournamentProgress is how a tournament moved on from one change, so its hooks can run once the change is stored.
+type TournamentProgress struct {
+	// Rounds that ended, in order.
+	Rounds   []int
+	Complete bool
+}
+
+// TournamentCreate stores a new tournament open to join until its start time, and returns its ID.
+func TournamentCreate(logger *zap.Logger, db *sql.DB, t *Tournament) (uuid.UUID, error) {
+	if t.Title == "" || len(t.Title) > 128 {
+		return uuid.Nil, errors.New("Tournament title must be set and at most 128 characters")
+	} else if t.Size < 2 || t.Size > tournamentSizeMax {
+		return uuid.Nil, errors.New("Tournament size must be between 2 and 256")
+	} else if t.StartAt <= 0 || t.EndAt <= t.StartAt {
+		return uuid.Nil, errors.New("Tournament must have a start time, and end after it starts")
+	}
+	metadata := t.Metadata
+	if len(metadata) == 0 {
+		metadata = []byte("{}")
+	}
+	var maybeJSON map[string]interface{}
+	if json.Unmarshal(metadata, &maybeJSON) != nil {
+		return uuid.Nil, errors.New("Tournament metadata must be a valid JSON object")
+	}
+
+	id := uuid.NewV4()
+	ts := nowMs()
+	_, err := db.Exec(`INSERT INTO tournament (id, title, size, metadata, start_at, end_at, created_at, updated_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $7)`, id.Bytes(), t.Title, t.Size, metadata, t.StartAt, t.EndAt, ts)
+	if err != nil {
+		logger.Error("Could not create tournament", zap.Error(err))
+		return uuid.Nil, err
+	}
+	return id, nil
+}
+
+// TournamentJoin adds a user to a tournament that has not started yet, with the rating they are seeded by. Joining
+// again updates the handle and rating. Any entry fee is consumed from the user's inventory in the same transaction as
+// a new join, which returns ErrInventoryInsufficient and does not happen if they own too few. Joining again is free.
+func TournamentJoin(logger *zap.Logger, db *sql.DB, id uuid.UUID, userID uuid.UUID, handle string, rating int64, fee map[string]int64) error {
+	if len(fee) != 0 {
+		if err := validateInventoryConsume(fee); err != nil {
+			return err
+		}
+	}
+
+	return retryTx(logger, db, func(tx *sql.Tx) error {
+		var state, size int
+		err := tx.QueryRow("SELECT state, size FROM tournament WHERE id = $1", id.Bytes()).Scan(&state, &size)
+		if err == sql.ErrNoRows {
+			return ErrTournamentNotFound
+		} else if err != nil {
+			return err
+		} else if state != TOURNAMENT_STATE_OPEN {
+			return ErrTournamentClosed
+		}
+
+		res, err := tx.Exec("UPDATE tournament_participant SET handle = $1, rating = $2 WHERE tournament_id = $3 AND user_id = $4",
+			handle, rating, id.Bytes(), userID.Bytes())
+		if err != nil {
+			return err
+		} else if updated, _ := res.RowsAffected(); updated != 0 {
+			return nil
+		}
+
+		var count int
+		if err = tx.QueryRow("SELECT count(*) FROM tournament_participant WHERE tournament_id = $1", id.Bytes()).Scan(&count); err != nil {
+			return err
+		} else if count >= size {
+			return ErrTournamentFull
+		}
+		if len(fee) != 0 {
+			if err = inventoryConsumeTx(tx, userID, fee); err != nil {
+				return err
+			}
+		}
+		_, err = tx.Exec(`INSERT INTO tournament_participant (tournament_id, user_id, handle, rating, created_at)
+VALUES ($1, $2, $3, $4, $5)`, id.Bytes(), userID.Bytes(), handle, rating, nowMs())
+		if e, ok := err.(*pq.Error); ok && e.Code == "23505" {
+			// A concurrent join by the same user inserted first, rolling back returns the fee and running again updates it.
+			return errTxConflict
+		}
+		return err
+	})
+}
+
+// TournamentResult records the user as the winner of their undecided match in the current round of a running
+// tournament. The next round starts once every match in the round is decided, and the tournament completes when the
+// final is.
+func TournamentResult(logger *zap.Logger, db *sql.DB, id uuid.UUID, winnerID uuid.UUID) (*TournamentProgress, error) {
+	var progress *TournamentProgress
+	err := retryTx(logger, db, func(tx *sql.Tx) error {
+		t, err := tournamentRead(tx, id)
+		if err != nil {
+			return err
+		} else if t.State != TOURNAMENT_STATE_RUNNING {
+			return ErrTournamentNotRunning
+		}
+
+		res, err := tx.Exec(`UPDATE tournament_match SET winner_id = $1, updated_at = $2
+WHERE tournament_id = $3 AND round = $4 AND winner_id IS NULL AND (user_a = $1 OR user_b = $1)`, winnerID.Bytes(), nowMs(), id.Bytes(), t.Round)
+		if err != nil {
+			return err
+		} else if updated, _ := res.RowsAffected(); updated == 0 {
+			return ErrTournamentNoMatch
+		}
+
+		progress = &TournamentProgress{}
+		return tournamentAdvance(tx, t, progress)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return progress, nil
+}
+
+// TournamentGet returns a tournament's bracket, or ErrTournamentNotFound.
+func TournamentGet(logger *zap.Logger, db *sql.DB, id uuid.UUID) (*TournamentBracket, error) {
+	t, err := tournamentRead(db, id)
+	if err == ErrTournamentNotFound {
+		return nil, err
+	} else if err != nil {
+		logger.Error("Could not read tournament", zap.Error(err))
+		return nil, err
+	}
+	bracket := &TournamentBracket{Tournament: t}
+
+	rows, err := db.Query(`SELECT user_id, handle, rating, seed, created_at FROM tournament_participant
+WHERE tournament_id = $1 ORDER BY seed, created_at`, id.Bytes())
+	if err != nil {
+		logger.Error("Could not read tournament participants", zap.Error(err))
+		return nil, err
+	}
+	for rows.Next() {
+		var userID []byte
+		p := &TournamentParticipant{}
+		if err = rows.Scan(&userID, &p.Handle, &p.Rating, &p.Seed, &p.CreatedAt); err != nil {
+			rows.Close()
+			logger.Error("Could not scan tournament participant", zap.Error(err))
+			return nil, err
+		}
+		p.UserID = uuid.FromBytesOrNil(userID)
+		bracket.Participants = append(bracket.Participants, p)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		logger.Error("Could not read tournament participants", zap.Error(err))
+		return nil, err
+	}
+
+	if bracket.Matches, err = tournamentMatches(db, id, 0); err != nil {
+		logger.Error("Could not read tournament matches", zap.Error(err))
+		return nil, err
+	}
+	return bracket, nil
+}
+
+// tournamentQuerier is either the database or a transaction.
+type tournamentQuerier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func tournamentRead(q tournamentQuerier, id uuid.UUID) (*Tournament, error) {
+	var winnerID []byte
+	t := &Tournament{ID: id}
+	err := q.QueryRow(`SELECT title, size, state, round, winner_id, metadata, start_at, end_at, created_at, updated_at
+FROM tournament WHERE id = $1`, id.Bytes()).
+		Scan(&t.Title, &t.Size, &t.State, &t.Round, &winnerID, &t.Metadata, &t.StartAt, &t.EndAt, &t.CreatedAt, &t.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrTournamentNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	t.WinnerID = uuid.FromBytesOrNil(winnerID)
+	return t, nil
+}
+
+// tournamentMatches returns the matches of one round, or of every round if round is 0.
+func tournamentMatches(q tournamentQuerier, id uuid.UUID, round int) ([]*TournamentMatch, error) {
+	query := "SELECT round, position, user_a, user_b, winner_id, updated_at FROM tournament_match WHERE tournament_id = $1"
+	params := []interface{}{id.Bytes()}
+	if round != 0 {
+		query += " AND round = $2"
+		params = append(params, round)
+	}
+	rows, err := q.Query(query+" ORDER BY round, position", params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	matches := make([]*TournamentMatch, 0)
+	for rows.Next() {
+		var userA, userB, winnerID []byte
+		m := &TournamentMatch{}
+		if err = rows.Scan(&m.Round, &m.Position, &userA, &userB, &winnerID, &m.UpdatedAt); err != nil {
+			return nil, err
+		}
+		m.UserA = uuid.FromBytesOrNil(userA)
+		m.UserB = uuid.FromBytesOrNil(userB)
+		m.WinnerID = uuid.FromBytesOrNil(winnerID)
+		matches = append(matches, m)
+	}
+	return matches, rows.Err()
+}
+
+// tournamentStart seeds the participants of an open tournament by rating, best first and earliest joined on ties, and
+// draws the first round. Top seeds get byes when there are fewer participants than bracket places.
+func tournamentStart(tx *sql.Tx, t *Tournament, progress *TournamentProgress) error {
+	rows, err := tx.Query("SELECT user_id FROM tournament_participant WHERE tournament_id = $1 ORDER BY rating DESC, created_at",
+		t.ID.Bytes())
+	if err != nil {
+		return err
+	}
+	seeded := make([]uuid.UUID, 0, t.Size)
+	for rows.Next() {
+		var userID []byte
+		if err = rows.Scan(&userID); err != nil {
+			rows.Close()
+			return err
+		}
+		seeded = append(seeded, uuid.FromBytesOrNil(userID))
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	ts := nowMs()
+	for i, userID := range seeded {
+		if _, err = tx.Exec("UPDATE tournament_participant SET seed = $1 WHERE tournament_id = $2 AND user_id = $3",
+			i+1, t.ID.Bytes(), userID.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	// Nobody to play, or a walkover.
+	if len(seeded) < 2 {
+		t.State = TOURNAMENT_STATE_COMPLETE
+		if len(seeded) == 1 {
+			t.WinnerID = seeded[0]
+		}
+		progress.Complete = true
+		return tournamentUpdate(tx, t, ts)
+	}
+
+	order := tournamentSeedOrder(len(seeded))
+	seedUser := func(seed int) uuid.UUID {
+		if seed > len(seeded) {
+			return uuid.Nil
+		}
+		return seeded[seed-1]
+	}
+	for position := 0; position < len(order)/2; position++ {
+		m := &TournamentMatch{Round: 1, Position: position, UserA: seedUser(order[2*position]), UserB: seedUser(order[2*position+1])}
+		if m.UserB == uuid.Nil {
+			m.WinnerID = m.UserA
+		}
+		if err = tournamentMatchInsert(tx, t.ID, m, ts); err != nil {
+			return err
+		}
+	}
+
+	t.State = TOURNAMENT_STATE_RUNNING
+	t.Round = 1
+	if err = tournamentUpdate(tx, t, ts); err != nil {
+		return err
+	}
+	// A round of byes and one match may already be decided enough to advance.
+	return tournamentAdvance(tx, t, progress)
+}
+
+// tournamentAdvance draws the next round once every match in the current one is decided, pairing the winners of
+// neighbouring matches, or completes the tournament if the final was decided.
+func tournamentAdvance(tx *sql.Tx, t *Tournament, progress *TournamentProgress) error {
+	matches, err := tournamentMatches(tx, t.ID, t.Round)
+	if err != nil {
+		return err
+	}
+	for _, m := range matches {
+		if m.WinnerID == uuid.Nil {
+			return nil
+		}
+	}
+
+	ts := nowMs()
+	progress.Rounds = append(progress.Rounds, t.Round)
+	if len(matches) == 1 {
+		t.State = TOURNAMENT_STATE_COMPLETE
+		t.WinnerID = matches[0].WinnerID
+		progress.Complete = true
+		return tournamentUpdate(tx, t, ts)
+	}
+
+	t.Round++
+	for position := 0; position < len(matches)/2; position++ {
+		m := &TournamentMatch{Round: t.Round, Position: position, UserA: matches[2*position].WinnerID, UserB: matches[2*position+1].WinnerID}
+		if err = tournamentMatchInsert(tx, t.ID, m, ts); err != nil {
+			return err
+		}
+	}
+	return tournamentUpdate(tx, t, ts)
+}
+
+// tournamentEnd decides every undecided match of a tournament whose time is up in favour of the better seed, round
+// after round until it completes.
+func tournamentEnd(tx *sql.Tx, t *Tournament, progress *TournamentProgress) error {
+	rows, err := tx.Query("SELECT user_id, seed FROM tournament_participant WHERE tournament_id = $1", t.ID.Bytes())
+	if err != nil {
+		return err
+	}
+	seeds := make(map[uuid.UUID]int)
+	for rows.Next() {
+		var userID []byte
+		var seed int
+		if err = rows.Scan(&userID, &seed); err != nil {
+			rows.Close()
+			return err
+		}
+		seeds[uuid.FromBytesOrNil(userID)] = seed
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for t.State == TOURNAMENT_STATE_RUNNING {
+		matches, err := tournamentMatches(tx, t.ID, t.Round)
+		if err != nil {
+			return err
+		}
+		for _, m := range matches {
+			if m.WinnerID != uuid.Nil {
+				continue
+			}
+			winnerID := m.UserA
+			if seeds[m.UserB] < seeds[m.UserA] {
+				winnerID = m.UserB
+			}
+			if _, err = tx.Exec("UPDATE tournament_match SET winner_id = $1, updated_at = $2 WHERE tournament_id = $3 AND round = $4 AND position = $5",
+				winnerID.Bytes(), nowMs(), t.ID.Bytes(), m.Round, m.Position); err != nil {
+				return err
+			}
+		}
+		if err = tournamentAdvance(tx, t, progress); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func tournamentUpdate(tx *sql.Tx, t *Tournament, ts int64) error {
+	var winnerID []byte
+	if t.WinnerID != uuid.Nil {
+		winnerID = t.WinnerID.Bytes()
+	}
+	t.UpdatedAt = ts
+	_, err := tx.Exec("UPDATE tournament SET state = $1, round = $2, winner_id = $3, updated_at = $4 WHERE id = $5",
+		t.State, t.Round, winnerID, ts, t.ID.Bytes())
+	return err
+}
+
+func tournamentMatchInsert(tx *sql.Tx, id uuid.UUID, m *TournamentMatch, ts int64) error {
+	var userA, userB, winnerID []byte
+	if m.UserA != uuid.Nil {
+		userA = m.UserA.Bytes()
+	}
+	if m.UserB != uuid.Nil {
+		userB = m.UserB.Bytes()
+	}
+	if m.WinnerID != uuid.Nil {
+		winnerID = m.WinnerID.Bytes()
+	}
+	_, err := tx.Exec(`INSERT INTO tournament_match (tournament_id, round, position, user_a, user_b, winner_id, updated_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7)`, id.Bytes(), m.Round, m.Position, userA, userB, winnerID, ts)
+	return err
+}
+
+// tournamentSeedOrder returns the seeds in bracket order for the smallest bracket that fits the participants, so that
+// neighbouring pairs play in the first round and the best seeds can only meet late. Seeds past the participant count
+// are byes, and are always paired with a real seed.
+func tournamentSeedOrder(participants int) []int {
+	order := []int{1}
+	for len(order) < participants {
+		size := len(order) * 2
+		next := make([]int, 0, size)
+		for _, seed := range order {
+			next = append(next, seed, size+1-seed)
+		}
+		order = next
+	}
+	return order
+}
+
+// TournamentScheduler starts tournaments at their start time, and ends those still running at their end time. Only
+// the cluster leader runs tournaments.
+type TournamentScheduler struct {
+	logger   *zap.Logger
+	db       *sql.DB
+	leader   ClusterLeader
+	progress func(id uuid.UUID, progress *TournamentProgress)
+	stopCh   chan bool
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// NewTournamentScheduler creates a scheduler that reports how each tournament it starts or ends moved on.
+func NewTournamentScheduler(logger *zap.Logger, db *sql.DB, leader ClusterLeader, progress func(id uuid.UUID, progress *TournamentProgress)) *TournamentScheduler {
+	return &TournamentScheduler{
+		logger:   logger,
+		db:       db,
+		leader:   leader,
+		progress: progress,
+		stopCh:   make(chan bool),
+	}
+}
+
+// Start runs the scheduler until stopped.
+func (s *TournamentScheduler) Start() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(tournamentPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stopCh:
+				return
+			case <-ticker.C:
+				if s.leader.IsLeader() {
+					s.Run()
+				}
+			}
+		}
+	}()
+}
+
+// Stop ends the scheduler once the run in progress is done.
+func (s *TournamentScheduler) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stopCh)
+	})
+	s.wg.Wait()
+}
+
+// Run starts every open tournament past its start time, and ends every tournament past its end time.
+func (s *TournamentScheduler) Run() error {
+	ts := nowMs()
+	rows, err := s.db.Query("SELECT id FROM tournament WHERE (state = $1 AND start_at <= $2) OR (state = $3 AND end_at <= $2)",
+		TOURNAMENT_STATE_OPEN, ts, TOURNAMENT_STATE_RUNNING)
+	if err != nil {
+		s.logger.Error("Could not list due tournaments", zap.Error(err))
+		return err
+	}
+	ids := make([]uuid.UUID, 0)
+	for rows.Next() {
+		var id []byte
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			s.logger.Error("Could not scan due tournament", zap.Error(err))
+			return err
+		}
+		ids = append(ids, uuid.FromBytesOrNil(id))
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		s.logger.Error("Could not list due tournaments", zap.Error(err))
+		return err
+	}
+
+	for _, id := range ids {
+		progress := &TournamentProgress{}
+		err := retryTx(s.logger, s.db, func(tx *sql.Tx) error {
+			progress.Rounds = nil
+			progress.Complete = false
+			t, err := tournamentRead(tx, id)
+			if err != nil {
+				return err
+			}
+			now := nowMs()
+			if t.State == TOURNAMENT_STATE_OPEN && t.StartAt <= now {
+				if err = tournamentStart(tx, t, progress); err != nil {
+					return err
+				}
+			}
+			if t.State == TOURNAMENT_STATE_RUNNING && t.EndAt <= now {
+				return tournamentEnd(tx, t, progress)
+			}
+			return nil
+		})
+		if err != nil {
+			s.logger.Error("Could not run tournament", zap.String("tournament_id", id.String()), zap.Error(err))
+			continue
+		}
+		s.progress(id, progress)
+	}
+	return nil
+}
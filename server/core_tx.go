@@ -0,0 +1,53 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// txMaxAttempts is how many times retryTx runs a transaction that keeps conflicting before it gives up.
+const txMaxAttempts = 5
+
+// errTxConflict may be returned by a retryTx function that detects a conflict with a concurrent transaction which the
+// database reports as some other error, to have it run again.
+var errTxConflict = errors.New("Transaction conflicted with a concurrent transaction")
+
+// retryTx runs fn in a transaction, and runs it again if the transaction conflicted with a concurrent one.
+func retryTx(logger *zap.Logger, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	var err error
+	for attempt := 0; attempt < txMaxAttempts; attempt++ {
+		var tx *sql.Tx
+		if tx, err = db.Begin(); err != nil {
+			return err
+		}
+		if err = fn(tx); err == nil {
+			err = tx.Commit()
+		} else if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			logger.Error("Could not rollback transaction", zap.Error(rollbackErr))
+		}
+		if e, ok := err.(*pq.Error); err != errTxConflict && (!ok || e.Code != "40001") {
+			break
+		}
+	}
+	if _, ok := err.(*pq.Error); ok {
+		logger.Error("Could not run transaction", zap.Error(err))
+	}
+	return err
+}
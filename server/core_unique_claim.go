@@ -0,0 +1,86 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+
+	"go.uber.org/zap"
+)
+
+// ErrUniqueClaimed is returned when a unique value is already claimed by another owner.
+var ErrUniqueClaimed = errors.New("Value is already claimed")
+
+// UniqueClaim claims a value in a namespace for an owner, such as a guild name or a vanity URL. The claim is a single
+// insert against the table's primary key, so of several concurrent claims for the same value exactly one succeeds.
+// Claiming a value the owner already holds succeeds again.
+func UniqueClaim(logger *zap.Logger, db *sql.DB, namespace, value string, ownerID []byte) error {
+	if err := validateUniqueClaim(namespace, value); err != nil {
+		return err
+	}
+
+	res, err := db.Exec(`
+INSERT INTO unique_claim (namespace, value, owner_id, created_at)
+VALUES ($1, $2, $3, $4)
+ON CONFLICT (namespace, value) DO NOTHING`, namespace, value, ownerID, nowMs())
+	if err != nil {
+		logger.Error("Could not claim unique value", zap.Error(err))
+		return err
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 1 {
+		return nil
+	}
+
+	var currentOwnerID []byte
+	err = db.QueryRow("SELECT owner_id FROM unique_claim WHERE namespace = $1 AND value = $2", namespace, value).Scan(&currentOwnerID)
+	if err == sql.ErrNoRows {
+		// Released between the insert and the lookup, the caller may try again.
+		return ErrUniqueClaimed
+	} else if err != nil {
+		logger.Error("Could not look up unique value owner", zap.Error(err))
+		return err
+	}
+	if !bytes.Equal(currentOwnerID, ownerID) {
+		return ErrUniqueClaimed
+	}
+	return nil
+}
+
+// UniqueRelease releases a value claimed by the owner, and returns false if the owner did not hold it.
+func UniqueRelease(logger *zap.Logger, db *sql.DB, namespace, value string, ownerID []byte) (bool, error) {
+	if err := validateUniqueClaim(namespace, value); err != nil {
+		return false, err
+	}
+
+	res, err := db.Exec("DELETE FROM unique_claim WHERE namespace = $1 AND value = $2 AND owner_id = $3", namespace, value, ownerID)
+	if err != nil {
+		logger.Error("Could not release unique value", zap.Error(err))
+		return false, err
+	}
+	rowsAffected, _ := res.RowsAffected()
+	return rowsAffected == 1, nil
+}
+
+func validateUniqueClaim(namespace, value string) error {
+	if namespace == "" || len(namespace) > 64 {
+		return errors.New("Namespace must be set and at most 64 characters")
+	}
+	if value == "" || len(value) > 255 {
+		return errors.New("Value must be set and at most 255 characters")
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+const (
+	USER_ERASURE_DELETE    = "delete"
+	USER_ERASURE_ANONYMIZE = "anonymize"
+)
+
+// ErrUserNotFound is returned when a user to delete does not exist.
+var ErrUserNotFound = errors.New("User not found")
+
+// UserErasure says, for each kind of data that stays meaningful without the user it belonged to, whether deleting the
+// user anonymizes it instead of removing it. Everything else about the user is always removed.
+type UserErasure struct {
+	// An anonymized account keeps its ID with a random handle, and loses every other field and all its logins.
+	AnonymizeAccount bool
+	// Anonymized chat messages stay in their topics with no sender.
+	AnonymizeMessages bool
+	// Anonymized leaderboard records keep their score under the random handle.
+	AnonymizeLeaderboardRecords bool
+	// Anonymized purchase receipts are kept with no user, so they can never grant items again.
+	AnonymizePurchases bool
+}
+
+// NewUserErasure reads the erasure mode of each kind of data from the runtime config.
+func NewUserErasure(config map[string]string) (*UserErasure, error) {
+	e := &UserErasure{}
+	for dataType, mode := range config {
+		if mode != USER_ERASURE_DELETE && mode != USER_ERASURE_ANONYMIZE {
+			return nil, fmt.Errorf("erasure mode of %v must be %v or %v", dataType, USER_ERASURE_DELETE, USER_ERASURE_ANONYMIZE)
+		}
+		anonymize := mode == USER_ERASURE_ANONYMIZE
+		switch dataType {
+		case "account":
+			e.AnonymizeAccount = anonymize
+		case "messages":
+			e.AnonymizeMessages = anonymize
+		case "leaderboard_records":
+			e.AnonymizeLeaderboardRecords = anonymize
+		case "purchases":
+			e.AnonymizePurchases = anonymize
+		default:
+			return nil, fmt.Errorf("erasure mode set for unknown data type %v", dataType)
+		}
+	}
+	return e, nil
+}
+
+type userDeleteStatement struct {
+	query  string
+	params []interface{}
+}
+
+// UserDelete permanently removes everything stored about a user, or anonymizes what the erasure config says to keep.
+// Devices, friend and group relations, storage and its pending changes, notifications, flags, cooldowns, unique claims,
+// RNG commitments, activity, inventory, tournament entries and jobs are always removed, and the user's audit log events
+// are erased with an erasure signed with the audit log key. Tournament brackets keep their shape with the user replaced
+// by the nil user. Removed records of storage collections with change functions are reported as removals, without their
+// values. Everything in the main database changes in one transaction. Storage records in other storage backends are
+// removed first, each backend on its own, so if anything fails the account still exists and the deletion can be run
+// again. Groups the user was the last admin of are left without an admin.
+func UserDelete(logger *zap.Logger, db *sql.DB, router *StorageRouter, auditLog *AuditLogService, userID uuid.UUID, erasure *UserErasure) (err error) {
+	var handle string
+	err = db.QueryRow("SELECT handle FROM users WHERE id = $1", userID.Bytes()).Scan(&handle)
+	if err == sql.ErrNoRows {
+		return ErrUserNotFound
+	} else if err != nil {
+		logger.Error("Could not look up user to delete", zap.Error(err))
+		return err
+	}
+
+	for _, backend := range router.all(db)[1:] {
+		if _, err = backend.Exec("DELETE FROM storage WHERE user_id = $1", userID.Bytes()); err != nil {
+			logger.Error("Could not delete user storage from storage backend", zap.Error(err))
+			return err
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		logger.Error("Could not begin user delete transaction", zap.Error(err))
+		return err
+	}
+	defer func() {
+		if err != nil {
+			logger.Error("Could not delete user", zap.Error(err))
+			if e := tx.Rollback(); e != nil {
+				logger.Error("Could not rollback transaction", zap.Error(e))
+			}
+		} else {
+			if err = tx.Commit(); err != nil {
+				logger.Error("Could not commit transaction", zap.Error(err))
+			} else {
+				logger.Info("Deleted user", zap.String("user_id", userID.String()), zap.String("handle", handle))
+			}
+		}
+	}()
+
+	uid := userID.Bytes()
+	updatedAt := nowMs()
+	anonymousHandle := "deleted_" + strings.Replace(uuid.NewV4().String(), "-", "", -1)[:12]
+
+	statements := []userDeleteStatement{
+		// Every edge counts towards its source's edge count, and groups count their admins and members.
+		{"UPDATE user_edge_metadata SET count = count - 1, updated_at = $2 WHERE source_id IN (SELECT source_id FROM user_edge WHERE destination_id = $1)", []interface{}{uid, updatedAt}},
+		{"DELETE FROM user_edge WHERE source_id = $1 OR destination_id = $1", []interface{}{uid}},
+		{"UPDATE groups SET count = count - 1, updated_at = $2 WHERE id IN (SELECT source_id FROM group_edge WHERE destination_id = $1 AND state IN (0, 1))", []interface{}{uid, updatedAt}},
+		{"DELETE FROM group_edge WHERE source_id = $1 OR destination_id = $1", []interface{}{uid}},
+		{"DELETE FROM user_device WHERE user_id = $1", []interface{}{uid}},
+		{"DELETE FROM storage WHERE user_id = $1", []interface{}{uid}},
+		{"DELETE FROM storage_idempotency WHERE user_id = $1", []interface{}{uid}},
+		{"DELETE FROM notification WHERE user_id = $1", []interface{}{uid}},
+		{"DELETE FROM notification_schedule WHERE user_id = $1", []interface{}{uid}},
+		{"DELETE FROM user_flag WHERE user_id = $1", []interface{}{uid}},
+		{"DELETE FROM cooldown WHERE user_id = $1", []interface{}{uid}},
+		{"DELETE FROM unique_claim WHERE owner_id = $1", []interface{}{uid}},
+		{"DELETE FROM rng_commitment WHERE user_id = $1", []interface{}{uid}},
+		{"DELETE FROM user_activity WHERE user_id = $1", []interface{}{uid}},
+		{"DELETE FROM inventory WHERE user_id = $1", []interface{}{uid}},
+		{"DELETE FROM job WHERE user_id = $1", []interface{}{uid}},
+		{"DELETE FROM tournament_participant WHERE user_id = $1", []interface{}{uid}},
+		{"UPDATE tournament_match SET user_a = $2 WHERE user_a = $1", []interface{}{uid, uuid.Nil.Bytes()}},
+		{"UPDATE tournament_match SET user_b = $2 WHERE user_b = $1", []interface{}{uid, uuid.Nil.Bytes()}},
+		{"UPDATE tournament_match SET winner_id = $2 WHERE winner_id = $1", []interface{}{uid, uuid.Nil.Bytes()}},
+		{"UPDATE tournament SET winner_id = $2 WHERE winner_id = $1", []interface{}{uid, uuid.Nil.Bytes()}},
+	}
+
+	if erasure.AnonymizeMessages {
+		statements = append(statements, userDeleteStatement{"UPDATE message SET user_id = $2, handle = '' WHERE user_id = $1", []interface{}{uid, uuid.Nil.Bytes()}})
+	} else {
+		statements = append(statements, userDeleteStatement{"DELETE FROM message WHERE user_id = $1", []interface{}{uid}})
+	}
+	if erasure.AnonymizeLeaderboardRecords {
+		statements = append(statements, userDeleteStatement{"UPDATE leaderboard_record SET handle = $2, location = NULL, timezone = NULL, metadata = '{}' WHERE owner_id = $1", []interface{}{uid, anonymousHandle}})
+	} else {
+		statements = append(statements, userDeleteStatement{"DELETE FROM leaderboard_record WHERE owner_id = $1", []interface{}{uid}})
+	}
+	if erasure.AnonymizePurchases {
+		statements = append(statements, userDeleteStatement{"UPDATE purchase_receipt SET user_id = $2 WHERE user_id = $1", []interface{}{uid, uuid.Nil.Bytes()}})
+	} else {
+		statements = append(statements, userDeleteStatement{"DELETE FROM purchase_receipt WHERE user_id = $1", []interface{}{uid}})
+	}
+	if erasure.AnonymizeAccount {
+		statements = append(statements, userDeleteStatement{`UPDATE users SET handle = $2, fullname = NULL, avatar_url = NULL, lang = 'en', location = NULL, timezone = NULL,
+utc_offset_ms = 0, metadata = '{}', email = NULL, password = NULL, facebook_id = NULL, google_id = NULL,
+gamecenter_id = NULL, steam_id = NULL, custom_id = NULL, updated_at = $3, disabled_at = $3
+WHERE id = $1`, []interface{}{uid, anonymousHandle, updatedAt}})
+	} else {
+		statements = append(statements, userDeleteStatement{"DELETE FROM user_edge_metadata WHERE source_id = $1", []interface{}{uid}}, userDeleteStatement{"DELETE FROM users WHERE id = $1", []interface{}{uid}})
+	}
+
+	if err = userDeleteStorageChanges(tx, router, uid, updatedAt); err != nil {
+		return err
+	}
+	if err = auditLog.Erase(tx, uid, updatedAt); err != nil {
+		return err
+	}
+	for _, s := range statements {
+		if _, err = tx.Exec(s.query, s.params...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// userDeleteStorageChanges drops the user's pending storage changes, which hold record values, and records the removal
+// of each of the user's records in collections with change functions.
+func userDeleteStorageChanges(tx *sql.Tx, router *StorageRouter, uid []byte, ts int64) error {
+	if _, err := tx.Exec("DELETE FROM storage_change WHERE user_id = $1", uid); err != nil {
+		return err
+	}
+
+	rows, err := tx.Query("SELECT bucket, collection, record FROM storage WHERE user_id = $1 AND deleted_at = 0", uid)
+	if err != nil {
+		return err
+	}
+	changes := make([]*StorageChange, 0)
+	for rows.Next() {
+		change := &StorageChange{UserId: uid, Op: STORAGE_CHANGE_REMOVE}
+		if err = rows.Scan(&change.Bucket, &change.Collection, &change.Record); err != nil {
+			rows.Close()
+			return err
+		}
+		if router.changeCaptured(change.Bucket, change.Collection) {
+			changes = append(changes, change)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, change := range changes {
+		if err = storageChangeRecord(tx, change, ts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,460 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"strconv"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+// userExportSection is one list of records in a user data export, read from each of the databases in turn. Scan reads
+// the current row into a value to encode.
+type userExportSection struct {
+	name  string
+	dbs   []*sql.DB
+	query string
+	scan  func(rows *sql.Rows, userID uuid.UUID) (interface{}, error)
+}
+
+// UserDataExport writes everything stored about a user to w as a single JSON object, for data subject access requests.
+// It holds the account, devices, friend and group relations, storage records from every storage backend and their
+// pending changes with encrypted values decrypted, notifications, leaderboard records, purchases, inventory items,
+// server side flags, audit log events, tournament entries and matches, days active, jobs, chat messages sent, unique
+// claims, cooldowns, random number commitments and scheduled notifications. Records are written as they are read, so
+// the export is never held in memory. Password hashes and unrevealed random number seeds are left out.
+func UserDataExport(logger *zap.Logger, db *sql.DB, router *StorageRouter, userID uuid.UUID, w io.Writer) error {
+	out := bufio.NewWriter(w)
+	enc := json.NewEncoder(out)
+
+	out.WriteString(`{"user_id":` + strconv.Quote(userID.String()) + `,"exported_at":` + strconv.FormatInt(nowMs(), 10) + `,"account":`)
+	account, err := userExportAccount(db, userID)
+	if err != nil {
+		logger.Error("Could not export user account", zap.Error(err))
+		return err
+	}
+	if err = enc.Encode(account); err != nil {
+		return err
+	}
+
+	for _, section := range userExportSections(db, router) {
+		out.WriteString(`,"` + section.name + `":[`)
+		first := true
+		for _, sectionDB := range section.dbs {
+			if first, err = userExportRows(enc, out, sectionDB, section, userID, first); err != nil {
+				logger.Error("Could not export user data", zap.String("section", section.name), zap.Error(err))
+				return err
+			}
+		}
+		out.WriteString("]")
+	}
+
+	out.WriteString("}")
+	return out.Flush()
+}
+
+func userExportAccount(db *sql.DB, userID uuid.UUID) (map[string]interface{}, error) {
+	var handle string
+	var fullname, avatarURL, location, timezone, email, facebookID, googleID, gamecenterID, steamID, customID sql.NullString
+	var lang string
+	var utcOffsetMs int64
+	var metadata []byte
+	var createdAt, updatedAt, verifiedAt, disabledAt, lastOnlineAt int64
+	err := db.QueryRow(`SELECT handle, fullname, avatar_url, lang, location, timezone, utc_offset_ms, metadata, email,
+facebook_id, google_id, gamecenter_id, steam_id, custom_id, created_at, updated_at, verified_at, disabled_at, last_online_at
+FROM users WHERE id = $1`, userID.Bytes()).Scan(&handle, &fullname, &avatarURL, &lang, &location, &timezone, &utcOffsetMs, &metadata, &email,
+		&facebookID, &googleID, &gamecenterID, &steamID, &customID, &createdAt, &updatedAt, &verifiedAt, &disabledAt, &lastOnlineAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"handle":         handle,
+		"fullname":       fullname.String,
+		"avatar_url":     avatarURL.String,
+		"lang":           lang,
+		"location":       location.String,
+		"timezone":       timezone.String,
+		"utc_offset_ms":  utcOffsetMs,
+		"metadata":       userExportJSON(metadata),
+		"email":          email.String,
+		"facebook_id":    facebookID.String,
+		"google_id":      googleID.String,
+		"gamecenter_id":  gamecenterID.String,
+		"steam_id":       steamID.String,
+		"custom_id":      customID.String,
+		"created_at":     createdAt,
+		"updated_at":     updatedAt,
+		"verified_at":    verifiedAt,
+		"disabled_at":    disabledAt,
+		"last_online_at": lastOnlineAt,
+	}, nil
+}
+
+func userExportSections(db *sql.DB, router *StorageRouter) []*userExportSection {
+	return []*userExportSection{
+		{
+			name:  "devices",
+			dbs:   []*sql.DB{db},
+			query: "SELECT id FROM user_device WHERE user_id = $1",
+			scan: func(rows *sql.Rows, _ uuid.UUID) (interface{}, error) {
+				var id string
+				err := rows.Scan(&id)
+				return map[string]interface{}{"id": id}, err
+			},
+		},
+		{
+			name:  "friends",
+			dbs:   []*sql.DB{db},
+			query: "SELECT destination_id, state, updated_at FROM user_edge WHERE source_id = $1",
+			scan: func(rows *sql.Rows, _ uuid.UUID) (interface{}, error) {
+				var friendID []byte
+				var state, updatedAt int64
+				err := rows.Scan(&friendID, &state, &updatedAt)
+				return map[string]interface{}{"user_id": uuid.FromBytesOrNil(friendID).String(), "state": state, "updated_at": updatedAt}, err
+			},
+		},
+		{
+			name:  "groups",
+			dbs:   []*sql.DB{db},
+			query: "SELECT destination_id, state, updated_at FROM group_edge WHERE source_id = $1",
+			scan: func(rows *sql.Rows, _ uuid.UUID) (interface{}, error) {
+				var groupID []byte
+				var state, updatedAt int64
+				err := rows.Scan(&groupID, &state, &updatedAt)
+				return map[string]interface{}{"group_id": uuid.FromBytesOrNil(groupID).String(), "state": state, "updated_at": updatedAt}, err
+			},
+		},
+		{
+			// Routed collections live in other databases, each backend holds its own part of the user's storage.
+			name: "storage",
+			dbs:  router.all(db),
+			query: `SELECT bucket, collection, record, value, version, read, write, created_at, updated_at, expires_at
+FROM storage WHERE user_id = $1 AND deleted_at = 0`,
+			scan: userExportStorage(router.encrypter()),
+		},
+		{
+			// Changes are only captured for collections in the main database.
+			name: "storage_changes",
+			dbs:  []*sql.DB{db},
+			query: `SELECT seq, bucket, collection, record, op, value_before, value_after, created_at
+FROM storage_change WHERE user_id = $1 ORDER BY bucket, collection, record, key_seq, seq`,
+			scan: userExportStorageChange(router.encrypter()),
+		},
+		{
+			name:  "notifications",
+			dbs:   []*sql.DB{db},
+			query: "SELECT id, subject, content, code, sender_id, created_at, expires_at, read_at FROM notification WHERE user_id = $1",
+			scan: func(rows *sql.Rows, _ uuid.UUID) (interface{}, error) {
+				var id, content, senderID []byte
+				var subject string
+				var code, createdAt, expiresAt, readAt int64
+				if err := rows.Scan(&id, &subject, &content, &code, &senderID, &createdAt, &expiresAt, &readAt); err != nil {
+					return nil, err
+				}
+				notification := map[string]interface{}{"id": uuid.FromBytesOrNil(id).String(), "subject": subject, "content": userExportJSON(content),
+					"code": code, "created_at": createdAt, "expires_at": expiresAt, "read_at": readAt}
+				if len(senderID) != 0 {
+					notification["sender_id"] = uuid.FromBytesOrNil(senderID).String()
+				}
+				return notification, nil
+			},
+		},
+		{
+			name:  "leaderboard_records",
+			dbs:   []*sql.DB{db},
+			query: "SELECT leaderboard_id, handle, score, num_score, metadata, updated_at, expires_at FROM leaderboard_record WHERE owner_id = $1",
+			scan: func(rows *sql.Rows, _ uuid.UUID) (interface{}, error) {
+				var leaderboardID, metadata []byte
+				var handle string
+				var score, numScore, updatedAt, expiresAt int64
+				err := rows.Scan(&leaderboardID, &handle, &score, &numScore, &metadata, &updatedAt, &expiresAt)
+				return map[string]interface{}{"leaderboard_id": string(leaderboardID), "handle": handle, "score": score, "num_score": numScore,
+					"metadata": userExportJSON(metadata), "updated_at": updatedAt, "expires_at": expiresAt}, err
+			},
+		},
+		{
+			name:  "purchases",
+			dbs:   []*sql.DB{db},
+			query: "SELECT store, product_id, created_at FROM purchase_receipt WHERE user_id = $1",
+			scan: func(rows *sql.Rows, _ uuid.UUID) (interface{}, error) {
+				var store, productID string
+				var createdAt int64
+				err := rows.Scan(&store, &productID, &createdAt)
+				return map[string]interface{}{"store": store, "product_id": productID, "created_at": createdAt}, err
+			},
+		},
+		{
+			name:  "inventory",
+			dbs:   []*sql.DB{db},
+			query: "SELECT item_id, count, unique_item, metadata, updated_at FROM inventory WHERE user_id = $1",
+			scan: func(rows *sql.Rows, _ uuid.UUID) (interface{}, error) {
+				var itemID string
+				var count, updatedAt int64
+				var unique bool
+				var metadata []byte
+				err := rows.Scan(&itemID, &count, &unique, &metadata, &updatedAt)
+				return map[string]interface{}{"item_id": itemID, "count": count, "unique": unique, "metadata": userExportJSON(metadata), "updated_at": updatedAt}, err
+			},
+		},
+		{
+			name:  "flags",
+			dbs:   []*sql.DB{db},
+			query: "SELECT key, value, updated_at FROM user_flag WHERE user_id = $1",
+			scan: func(rows *sql.Rows, _ uuid.UUID) (interface{}, error) {
+				var key, value string
+				var updatedAt int64
+				err := rows.Scan(&key, &value, &updatedAt)
+				return map[string]interface{}{"key": key, "value": value, "updated_at": updatedAt}, err
+			},
+		},
+		{
+			name:  "audit_events",
+			dbs:   []*sql.DB{db},
+			query: "SELECT seq, event, created_at FROM audit_log WHERE user_id = $1 AND erased_at = 0 ORDER BY seq",
+			scan: func(rows *sql.Rows, _ uuid.UUID) (interface{}, error) {
+				var seq, createdAt int64
+				var event []byte
+				err := rows.Scan(&seq, &event, &createdAt)
+				return map[string]interface{}{"seq": seq, "event": userExportJSON(event), "created_at": createdAt}, err
+			},
+		},
+		{
+			name:  "tournaments",
+			dbs:   []*sql.DB{db},
+			query: "SELECT tournament_id, handle, rating, seed, created_at FROM tournament_participant WHERE user_id = $1",
+			scan: func(rows *sql.Rows, _ uuid.UUID) (interface{}, error) {
+				var tournamentID []byte
+				var handle string
+				var rating, seed, createdAt int64
+				err := rows.Scan(&tournamentID, &handle, &rating, &seed, &createdAt)
+				return map[string]interface{}{"tournament_id": uuid.FromBytesOrNil(tournamentID).String(), "handle": handle, "rating": rating,
+					"seed": seed, "created_at": createdAt}, err
+			},
+		},
+		{
+			name:  "tournament_matches",
+			dbs:   []*sql.DB{db},
+			query: "SELECT tournament_id, round, position, user_a, user_b, winner_id, updated_at FROM tournament_match WHERE user_a = $1 OR user_b = $1",
+			scan: func(rows *sql.Rows, _ uuid.UUID) (interface{}, error) {
+				var tournamentID, userA, userB, winnerID []byte
+				var round, position, updatedAt int64
+				if err := rows.Scan(&tournamentID, &round, &position, &userA, &userB, &winnerID, &updatedAt); err != nil {
+					return nil, err
+				}
+				match := map[string]interface{}{"tournament_id": uuid.FromBytesOrNil(tournamentID).String(), "round": round, "position": position,
+					"updated_at": updatedAt}
+				for key, id := range map[string][]byte{"user_a": userA, "user_b": userB, "winner_id": winnerID} {
+					if len(id) != 0 {
+						match[key] = uuid.FromBytesOrNil(id).String()
+					}
+				}
+				return match, nil
+			},
+		},
+		{
+			name:  "activity",
+			dbs:   []*sql.DB{db},
+			query: "SELECT day FROM user_activity WHERE user_id = $1 ORDER BY day",
+			scan: func(rows *sql.Rows, _ uuid.UUID) (interface{}, error) {
+				var day int64
+				err := rows.Scan(&day)
+				return map[string]interface{}{"day": day}, err
+			},
+		},
+		{
+			name:  "jobs",
+			dbs:   []*sql.DB{db},
+			query: "SELECT id, queue, payload, attempts, created_at, run_at, dead_at FROM job WHERE user_id = $1",
+			scan: func(rows *sql.Rows, _ uuid.UUID) (interface{}, error) {
+				var id, payload []byte
+				var queue string
+				var attempts, createdAt, runAt, deadAt int64
+				err := rows.Scan(&id, &queue, &payload, &attempts, &createdAt, &runAt, &deadAt)
+				return map[string]interface{}{"id": uuid.FromBytesOrNil(id).String(), "queue": queue, "payload": userExportJSON(payload),
+					"attempts": attempts, "created_at": createdAt, "run_at": runAt, "dead_at": deadAt}, err
+			},
+		},
+		{
+			name:  "messages",
+			dbs:   []*sql.DB{db},
+			query: "SELECT topic, topic_type, message_id, handle, type, data, created_at, expires_at FROM message WHERE user_id = $1",
+			scan: func(rows *sql.Rows, _ uuid.UUID) (interface{}, error) {
+				var topic, messageID, data []byte
+				var topicType, messageType, createdAt, expiresAt int64
+				var handle string
+				err := rows.Scan(&topic, &topicType, &messageID, &handle, &messageType, &data, &createdAt, &expiresAt)
+				return map[string]interface{}{"topic": userExportTopic(topic, topicType), "topic_type": topicType, "message_id": uuid.FromBytesOrNil(messageID).String(),
+					"handle": handle, "type": messageType, "data": userExportJSON(data), "created_at": createdAt, "expires_at": expiresAt}, err
+			},
+		},
+		{
+			name:  "unique_claims",
+			dbs:   []*sql.DB{db},
+			query: "SELECT namespace, value, created_at FROM unique_claim WHERE owner_id = $1",
+			scan: func(rows *sql.Rows, _ uuid.UUID) (interface{}, error) {
+				var namespace, value string
+				var createdAt int64
+				err := rows.Scan(&namespace, &value, &createdAt)
+				return map[string]interface{}{"namespace": namespace, "value": value, "created_at": createdAt}, err
+			},
+		},
+		{
+			name:  "cooldowns",
+			dbs:   []*sql.DB{db},
+			query: "SELECT action, ready_at FROM cooldown WHERE user_id = $1",
+			scan: func(rows *sql.Rows, _ uuid.UUID) (interface{}, error) {
+				var action string
+				var readyAt int64
+				err := rows.Scan(&action, &readyAt)
+				return map[string]interface{}{"action": action, "ready_at": readyAt}, err
+			},
+		},
+		{
+			// Seeds are left out until they are revealed, exporting them earlier would let the user predict rolls.
+			name:  "rng_commitments",
+			dbs:   []*sql.DB{db},
+			query: "SELECT id, seed, commitment, client_seed, sides, results, created_at, rolled_at, revealed_at FROM rng_commitment WHERE user_id = $1",
+			scan: func(rows *sql.Rows, _ uuid.UUID) (interface{}, error) {
+				var id, seed, commitment, results []byte
+				var clientSeed string
+				var sides, createdAt, rolledAt, revealedAt int64
+				if err := rows.Scan(&id, &seed, &commitment, &clientSeed, &sides, &results, &createdAt, &rolledAt, &revealedAt); err != nil {
+					return nil, err
+				}
+				rng := map[string]interface{}{"id": uuid.FromBytesOrNil(id).String(), "commitment": hex.EncodeToString(commitment),
+					"client_seed": clientSeed, "sides": sides, "results": userExportJSON(results), "created_at": createdAt,
+					"rolled_at": rolledAt, "revealed_at": revealedAt}
+				if revealedAt != 0 {
+					rng["seed"] = hex.EncodeToString(seed)
+				}
+				return rng, nil
+			},
+		},
+		{
+			name:  "scheduled_notifications",
+			dbs:   []*sql.DB{db},
+			query: "SELECT id, subject, content, code, sender_id, persistent, created_at, deliver_at, expires_at FROM notification_schedule WHERE user_id = $1",
+			scan: func(rows *sql.Rows, _ uuid.UUID) (interface{}, error) {
+				var id, content, senderID []byte
+				var subject string
+				var code, createdAt, deliverAt, expiresAt int64
+				var persistent bool
+				if err := rows.Scan(&id, &subject, &content, &code, &senderID, &persistent, &createdAt, &deliverAt, &expiresAt); err != nil {
+					return nil, err
+				}
+				notification := map[string]interface{}{"id": uuid.FromBytesOrNil(id).String(), "subject": subject, "content": userExportJSON(content),
+					"code": code, "persistent": persistent, "created_at": createdAt, "deliver_at": deliverAt, "expires_at": expiresAt}
+				if len(senderID) != 0 {
+					notification["sender_id"] = uuid.FromBytesOrNil(senderID).String()
+				}
+				return notification, nil
+			},
+		},
+	}
+}
+
+// userExportRows writes the rows a section has in one database as JSON array elements, and reports whether the array
+// is still empty.
+func userExportRows(enc *json.Encoder, out *bufio.Writer, db *sql.DB, section *userExportSection, userID uuid.UUID, first bool) (bool, error) {
+	rows, err := db.Query(section.query, userID.Bytes())
+	if err != nil {
+		return first, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		record, err := section.scan(rows, userID)
+		if err != nil {
+			return first, err
+		}
+		if !first {
+			out.WriteString(",")
+		}
+		first = false
+		if err = enc.Encode(record); err != nil {
+			return first, err
+		}
+	}
+	return first, rows.Err()
+}
+
+// userExportStorage returns a scan that reads a storage record, decrypting its value if it is kept encrypted.
+func userExportStorage(encryption *StorageEncryption) func(rows *sql.Rows, userID uuid.UUID) (interface{}, error) {
+	return func(rows *sql.Rows, userID uuid.UUID) (interface{}, error) {
+		d := &StorageData{UserId: userID.Bytes()}
+		if err := rows.Scan(&d.Bucket, &d.Collection, &d.Record, &d.Value, &d.Version, &d.PermissionRead, &d.PermissionWrite, &d.CreatedAt, &d.UpdatedAt, &d.ExpiresAt); err != nil {
+			return nil, err
+		}
+		if err := encryption.decrypt(d); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"bucket": d.Bucket, "collection": d.Collection, "record": d.Record, "value": userExportJSON(d.Value),
+			"version": string(d.Version), "permission_read": d.PermissionRead, "permission_write": d.PermissionWrite,
+			"created_at": d.CreatedAt, "updated_at": d.UpdatedAt, "expires_at": d.ExpiresAt}, nil
+	}
+}
+
+// userExportStorageChange returns a scan that reads a pending storage change, decrypting its values if they are kept
+// encrypted.
+func userExportStorageChange(encryption *StorageEncryption) func(rows *sql.Rows, userID uuid.UUID) (interface{}, error) {
+	return func(rows *sql.Rows, userID uuid.UUID) (interface{}, error) {
+		c := &StorageChange{UserId: userID.Bytes()}
+		if err := rows.Scan(&c.Seq, &c.Bucket, &c.Collection, &c.Record, &c.Op, &c.Before, &c.After, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		change := map[string]interface{}{"seq": c.Seq, "bucket": c.Bucket, "collection": c.Collection, "record": c.Record, "op": c.Op,
+			"created_at": c.CreatedAt}
+		for key, value := range map[string][]byte{"value_before": c.Before, "value_after": c.After} {
+			plain, err := c.decrypt(encryption, value)
+			if err != nil {
+				return nil, err
+			}
+			if plain != nil {
+				change[key] = userExportJSON(plain)
+			}
+		}
+		return change, nil
+	}
+}
+
+// userExportJSON embeds stored JSON as is, and anything else as a string.
+func userExportJSON(data []byte) interface{} {
+	if json.Valid(data) {
+		return json.RawMessage(data)
+	}
+	return string(data)
+}
+
+// userExportTopic returns a chat topic in readable form, a room name, a group ID, or the two user IDs of a direct
+// message topic.
+func userExportTopic(topic []byte, topicType int64) string {
+	switch {
+	case topicType == 0 && len(topic) == 32:
+		return uuid.FromBytesOrNil(topic[:16]).String() + ":" + uuid.FromBytesOrNil(topic[16:]).String()
+	case topicType == 2:
+		return uuid.FromBytesOrNil(topic).String()
+	default:
+		return string(topic)
+	}
+}
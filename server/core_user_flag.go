@@ -0,0 +1,144 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+const (
+	userFlagCacheMaxEntries = 10000
+	userFlagCacheTTLMs      = 30000
+)
+
+// UserFlagCache keeps the server side flags of each user until one of them is set on this node, or for at most
+// userFlagCacheTTLMs. Flags set on other nodes are seen here once the cached entry expires. Flags are loaded on first
+// use, so code that reads them on every request only hits the database about once per user and TTL.
+type UserFlagCache struct {
+	sync.Mutex
+	logger  *zap.Logger
+	db      *sql.DB
+	entries map[uuid.UUID]*userFlagCacheEntry
+	// Bumped by every set, so a load that raced with a set is not cached.
+	version int64
+}
+
+type userFlagCacheEntry struct {
+	flags    map[string]string
+	loadedAt int64
+}
+
+func NewUserFlagCache(logger *zap.Logger, db *sql.DB) *UserFlagCache {
+	return &UserFlagCache{
+		logger:  logger,
+		db:      db,
+		entries: make(map[uuid.UUID]*userFlagCacheEntry),
+	}
+}
+
+// Get returns a copy of all flags set for a user.
+func (c *UserFlagCache) Get(userID uuid.UUID) (map[string]string, error) {
+	ts := nowMs()
+	c.Lock()
+	entry, ok := c.entries[userID]
+	version := c.version
+	c.Unlock()
+	if ok && ts-entry.loadedAt < userFlagCacheTTLMs {
+		return copyUserFlags(entry.flags), nil
+	}
+
+	rows, err := c.db.Query("SELECT key, value FROM user_flag WHERE user_id = $1", userID.Bytes())
+	if err != nil {
+		c.logger.Error("Could not load user flags", zap.Error(err))
+		return nil, err
+	}
+	defer rows.Close()
+
+	flags := make(map[string]string)
+	for rows.Next() {
+		var key, value string
+		if err = rows.Scan(&key, &value); err != nil {
+			c.logger.Error("Could not scan user flags", zap.Error(err))
+			return nil, err
+		}
+		flags[key] = value
+	}
+	if err = rows.Err(); err != nil {
+		c.logger.Error("Could not load user flags", zap.Error(err))
+		return nil, err
+	}
+
+	c.Lock()
+	if c.version == version {
+		// Start over rather than grow without bound, entries are cheap to reload.
+		if len(c.entries) >= userFlagCacheMaxEntries {
+			c.entries = make(map[uuid.UUID]*userFlagCacheEntry)
+		}
+		c.entries[userID] = &userFlagCacheEntry{flags: flags, loadedAt: ts}
+	}
+	c.Unlock()
+	return copyUserFlags(flags), nil
+}
+
+// Set stores a flag for a user and drops their cached flags. An empty value removes the flag.
+func (c *UserFlagCache) Set(userID uuid.UUID, key, value string) error {
+	if key == "" || len(key) > 64 {
+		return errors.New("User flag key must be set and at most 64 characters")
+	}
+	if len(value) > 255 {
+		return errors.New("User flag value must be at most 255 characters")
+	}
+
+	var err error
+	if value == "" {
+		_, err = c.db.Exec("DELETE FROM user_flag WHERE user_id = $1 AND key = $2", userID.Bytes(), key)
+	} else {
+		_, err = c.db.Exec(`
+INSERT INTO user_flag (user_id, key, value, updated_at)
+VALUES ($1, $2, $3, $4)
+ON CONFLICT (user_id, key) DO UPDATE SET value = $3, updated_at = $4`, userID.Bytes(), key, value, nowMs())
+	}
+	if err != nil {
+		c.logger.Error("Could not set user flag", zap.Error(err))
+		return err
+	}
+
+	c.Lock()
+	c.version++
+	delete(c.entries, userID)
+	c.Unlock()
+	return nil
+}
+
+func copyUserFlags(flags map[string]string) map[string]string {
+	result := make(map[string]string, len(flags))
+	for k, v := range flags {
+		result[k] = v
+	}
+	return result
+}
+
+// forget drops a user's cached flags, after the flags were removed by other means.
+func (c *UserFlagCache) forget(userID uuid.UUID) {
+	c.Lock()
+	delete(c.entries, userID)
+	c.version++
+	c.Unlock()
+}
@@ -0,0 +1,75 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/satori/go.uuid"
+)
+
+var (
+	// ErrClientMatchCreateDisabled is returned when a client asks for an authoritative match while client match
+	// creation is not enabled and no match create function is registered to vet the request.
+	ErrClientMatchCreateDisabled = errors.New("Clients may not create authoritative matches")
+	// ErrClientMatchesFull is returned when clients already have as many authoritative matches running on this node as
+	// allowed.
+	ErrClientMatchesFull = errors.New("Too many client created matches are running")
+)
+
+// ClientMatches creates the authoritative matches clients ask for, and keeps track of those still running on this node
+// to cap how many there are at once.
+type ClientMatches struct {
+	sync.Mutex
+	enabled bool
+	max     int
+	ids     map[uuid.UUID]bool
+}
+
+// NewClientMatches creates a tracker for client created matches following the matchmaker configuration.
+func NewClientMatches(config *MatchmakerConfig) *ClientMatches {
+	return &ClientMatches{
+		enabled: config.ClientMatchCreate,
+		max:     config.MaxClientMatches,
+		ids:     make(map[uuid.UUID]bool),
+	}
+}
+
+// Create starts an authoritative match for a client. Clients may only create matches if client match creation is
+// enabled, or a runtime match create function is registered to vet their requests.
+func (c *ClientMatches) Create(runtime *Runtime, module string, params map[string]interface{}) (string, error) {
+	if !c.enabled && !runtime.IsRuntimeMatchCreateRegistered() {
+		return "", ErrClientMatchCreateDisabled
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	for id := range c.ids {
+		if runtime.MatchGet(id.String()) == nil {
+			delete(c.ids, id)
+		}
+	}
+	if c.max > 0 && len(c.ids) >= c.max {
+		return "", ErrClientMatchesFull
+	}
+
+	matchID, err := runtime.CreateMatch(module, params)
+	if err != nil {
+		return "", err
+	}
+	c.ids[uuid.FromStringOrNil(matchID)] = true
+	return matchID, nil
+}
@@ -0,0 +1,774 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/armon/go-metrics"
+	"github.com/satori/go.uuid"
+	"github.com/yuin/gopher-lua"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+const (
+	matchCallQueueSize    = 128
+	matchTickRateDefault  = 1
+	matchTickRateMax      = 30
+	matchHandlerInit      = "match_init"
+	matchHandlerJoin      = "match_join"
+	matchHandlerAttempt   = "match_join_attempt"
+	matchHandlerWelcome   = "match_welcome"
+	matchHandlerLeave     = "match_leave"
+	matchHandlerLoop      = "match_loop"
+	matchHandlerTerminate = "match_terminate"
+	matchHandlerSummary   = "match_summary"
+	matchHandlerOpCodes   = "match_op_codes"
+	matchHandlerRoles     = "match_roles"
+	matchLabelMaxBytes    = 2048
+	matchTimersMax        = 1024
+)
+
+// MATCH_GOROUTINE keys the ID of the match in the context of Lua states that run on a match goroutine.
+const MATCH_GOROUTINE = "runtime_match_goroutine"
+
+// NotificationCodeMatchSummary is the code of the notifications carrying the summaries a match module's match_summary
+// function returns when a match ends. Their content is the summary the function returned for the recipient.
+const NotificationCodeMatchSummary int64 = -2
+
+const (
+	// MatchRolePlayer is the role presences join authoritative matches in unless they ask for another.
+	MatchRolePlayer = "player"
+	// MatchRoleSpectator is the role of presences watching an authoritative match.
+	MatchRoleSpectator = "spectator"
+)
+
+var (
+	// ErrMatchNotFound is returned when a match is not running on this node, or stopped before a call could run.
+	ErrMatchNotFound = errors.New("match not found")
+	// ErrMatchBusy is returned when a match has too many queued calls to take another.
+	ErrMatchBusy = errors.New("match call queue is full")
+	// ErrMatchFull is returned when a presence would join a match in a role that has no free places left.
+	ErrMatchFull = errors.New("match is full")
+	// ErrMatchRoleInvalid is returned when a presence would join a match in a role the match does not have.
+	ErrMatchRoleInvalid = errors.New("match role is not valid")
+	// ErrMatchTimersFull is returned when a match has too many pending timers to start another.
+	ErrMatchTimersFull = errors.New("match has too many pending timers")
+)
+
+type matchMessage struct {
+	presence Presence
+	opCode   int64
+	data     []byte
+}
+
+type matchTimer struct {
+	timer *time.Timer
+	fn    func(vm *lua.LState, ctx *lua.LTable, state lua.LValue) (lua.LValue, error)
+}
+
+// MatchHandler runs a single authoritative match. All calls into the match module are serialized onto one goroutine.
+type MatchHandler struct {
+	logger   *zap.Logger
+	runtime  *Runtime
+	registry MatchRegistry
+	ID       uuid.UUID
+	Module   string
+	label    *atomic.String
+
+	vm          *lua.LState
+	ctx         *lua.LTable
+	joinFn      *lua.LFunction
+	attemptFn   *lua.LFunction
+	welcomeFn   *lua.LFunction
+	leaveFn     *lua.LFunction
+	loopFn      *lua.LFunction
+	terminateFn *lua.LFunction
+	summaryFn   *lua.LFunction
+	// Everyone who joined the match while it ran, kept only if the match module has a summary function.
+	participants map[uuid.UUID]Presence
+	// Op codes clients may send match data with, nil if the match module allows any op code.
+	opCodes map[int64]bool
+	// How many presences each role has places for, nil if the match module has players and spectators without limit.
+	roleLimits map[string]int
+	// Role of every presence admitted by a join attempt, keyed by session ID, until it leaves.
+	roles map[uuid.UUID]string
+
+	state    lua.LValue
+	tick     int64
+	tickRate int
+	messages []*matchMessage
+
+	// Pending timers keyed by ID. A timer is removed when its function runs or it is cancelled. Fired timers are
+	// listed as due in the order they fired, and the match goroutine is woken through timerCh to run them.
+	timersMu  sync.Mutex
+	timers    map[int64]*matchTimer
+	timersDue []int64
+	timerNext int64
+	timerCh   chan struct{}
+
+	ticker      *time.Ticker
+	callCh      chan func(mh *MatchHandler)
+	stopCh      chan bool
+	doneCh      chan bool
+	stopOnce    sync.Once
+	stopped     *atomic.Bool
+	summaryOnce sync.Once
+}
+
+func NewMatchHandler(logger *zap.Logger, runtime *Runtime, registry MatchRegistry, matchID uuid.UUID, module string, handlers *lua.LTable, params map[string]interface{}) (*MatchHandler, error) {
+	initFn, ok := handlers.RawGetString(matchHandlerInit).(*lua.LFunction)
+	if !ok {
+		return nil, errors.New("match module is missing a match_init function")
+	}
+	loopFn, ok := handlers.RawGetString(matchHandlerLoop).(*lua.LFunction)
+	if !ok {
+		return nil, errors.New("match module is missing a match_loop function")
+	}
+	// Join, join attempt, welcome, leave, terminate, and summary handlers are optional.
+	joinFn, _ := handlers.RawGetString(matchHandlerJoin).(*lua.LFunction)
+	attemptFn, _ := handlers.RawGetString(matchHandlerAttempt).(*lua.LFunction)
+	welcomeFn, _ := handlers.RawGetString(matchHandlerWelcome).(*lua.LFunction)
+	leaveFn, _ := handlers.RawGetString(matchHandlerLeave).(*lua.LFunction)
+	terminateFn, _ := handlers.RawGetString(matchHandlerTerminate).(*lua.LFunction)
+	summaryFn, _ := handlers.RawGetString(matchHandlerSummary).(*lua.LFunction)
+	var opCodes map[int64]bool
+	if lv := handlers.RawGetString(matchHandlerOpCodes); lv != lua.LNil {
+		lt, ok := lv.(*lua.LTable)
+		if !ok {
+			return nil, errors.New("match module match_op_codes must be a table of op codes")
+		}
+		opCodes = make(map[int64]bool)
+		valid := true
+		lt.ForEach(func(k lua.LValue, v lua.LValue) {
+			opCode, ok := v.(lua.LNumber)
+			if !ok {
+				valid = false
+				return
+			}
+			opCodes[int64(opCode)] = true
+		})
+		if !valid {
+			return nil, errors.New("match module match_op_codes must be a table of op codes")
+		}
+	}
+	var roleLimits map[string]int
+	if lv := handlers.RawGetString(matchHandlerRoles); lv != lua.LNil {
+		lt, ok := lv.(*lua.LTable)
+		if !ok {
+			return nil, errors.New("match module match_roles must be a table of role limits keyed by role")
+		}
+		roleLimits = make(map[string]int)
+		valid := true
+		lt.ForEach(func(k lua.LValue, v lua.LValue) {
+			role, ok := k.(lua.LString)
+			limit, limitOk := v.(lua.LNumber)
+			if !ok || role == "" || !limitOk || limit < 1 {
+				valid = false
+				return
+			}
+			roleLimits[string(role)] = int(limit)
+		})
+		if !valid {
+			return nil, errors.New("match module match_roles must be a table of role limits keyed by role")
+		}
+	}
+
+	vm, _ := runtime.NewStateThread()
+	vm.SetContext(context.WithValue(vm.Context(), MATCH_GOROUTINE, matchID))
+	ctx := NewLuaContext(vm, runtime.luaEnv, MATCH, uuid.Nil, "", 0)
+	ctx.RawSetString(__CTX_MATCH_ID, lua.LString(matchID.String()))
+	ctx.RawSetString(__CTX_MATCH_MODULE, lua.LString(module))
+
+	mh := &MatchHandler{
+		logger:   logger.With(zap.String("mid", matchID.String()), zap.String("module", module)),
+		runtime:  runtime,
+		registry: registry,
+		ID:       matchID,
+		Module:   module,
+		label:    atomic.NewString(""),
+
+		vm:          vm,
+		ctx:         ctx,
+		joinFn:      joinFn,
+		attemptFn:   attemptFn,
+		welcomeFn:   welcomeFn,
+		leaveFn:     leaveFn,
+		loopFn:      loopFn,
+		terminateFn: terminateFn,
+		summaryFn:   summaryFn,
+		opCodes:     opCodes,
+		roleLimits:  roleLimits,
+		roles:       make(map[uuid.UUID]string),
+
+		messages: make([]*matchMessage, 0),
+		timers:   make(map[int64]*matchTimer),
+		timerCh:  make(chan struct{}, 1),
+
+		callCh:  make(chan func(mh *MatchHandler), matchCallQueueSize),
+		stopCh:  make(chan bool),
+		doneCh:  make(chan bool),
+		stopped: atomic.NewBool(false),
+	}
+
+	// Match init receives the creation parameters, and returns the initial state, the tick rate and the initial label.
+	lv := ConvertMap(vm, params)
+	ret, err := mh.invoke(initFn, 3, lv)
+	if err != nil {
+		vm.Close()
+		return nil, err
+	}
+	if ret[0] == lua.LNil {
+		vm.Close()
+		return nil, errors.New("match_init returned no initial state")
+	}
+	mh.state = ret[0]
+
+	mh.tickRate = matchTickRateDefault
+	if ret[1] != lua.LNil {
+		rate, ok := ret[1].(lua.LNumber)
+		if !ok || int(rate) < 1 || int(rate) > matchTickRateMax {
+			vm.Close()
+			return nil, errors.New("match_init returned an invalid tick rate, must be between 1 and 30")
+		}
+		mh.tickRate = int(rate)
+	}
+	if ret[2] != lua.LNil {
+		label, ok := ret[2].(lua.LString)
+		if !ok {
+			vm.Close()
+			return nil, errors.New("match_init returned an invalid label, must be a string")
+		}
+		if err = mh.SetLabel(string(label)); err != nil {
+			vm.Close()
+			return nil, err
+		}
+	}
+
+	return mh, nil
+}
+
+// Label returns the match's current label, which is empty unless match_init returned one or it was updated since.
+func (mh *MatchHandler) Label() string {
+	return mh.label.Load()
+}
+
+// SetLabel replaces the label matches are listed with. Labels are free-form, such as a status or a JSON object, but
+// must be valid UTF-8 without control characters and at most 2048 bytes.
+func (mh *MatchHandler) SetLabel(label string) error {
+	if len(label) > matchLabelMaxBytes {
+		return errors.New("match label must be at most 2048 bytes")
+	}
+	if !utf8.ValidString(label) {
+		return errors.New("match label must only contain valid UTF-8 bytes")
+	}
+	if controlCharsRegex.MatchString(label) {
+		return errors.New("match label must not contain control chars")
+	}
+	mh.label.Store(label)
+	return nil
+}
+
+func (mh *MatchHandler) Start() {
+	mh.ticker = time.NewTicker(time.Second / time.Duration(mh.tickRate))
+	mh.logger.Info("Match started", zap.Int("tick_rate", mh.tickRate))
+
+	go func() {
+		defer close(mh.doneCh)
+		defer func() {
+			// A failure outside the match module still ends the match, so its summaries are sent.
+			if r := recover(); r != nil {
+				mh.logger.Error("Match handler failed", zap.Any("error", r))
+				mh.stopped.Store(true)
+				mh.ticker.Stop()
+				mh.stopTimers()
+				mh.summarize()
+				mh.registry.Remove(mh.ID)
+				mh.vm.Close()
+			}
+		}()
+		for {
+			select {
+			case <-mh.stopCh:
+				mh.terminate()
+				return
+			case <-mh.ticker.C:
+				if !mh.loop() {
+					mh.terminate()
+					return
+				}
+			case call := <-mh.callCh:
+				call(mh)
+			case <-mh.timerCh:
+				mh.runTimers()
+			}
+		}
+	}()
+}
+
+// Stop asks the match to terminate, the match module's terminate function will run on the match goroutine.
+func (mh *MatchHandler) Stop() {
+	mh.stopOnce.Do(func() {
+		close(mh.stopCh)
+	})
+}
+
+// Wait blocks until the match goroutine has exited.
+func (mh *MatchHandler) Wait() {
+	<-mh.doneCh
+}
+
+// JoinAttempt decides whether a presence may join the match and in what role, before it is tracked. The match module's
+// match_join_attempt function receives the state, the presence and the requested role, and returns the new state,
+// whether to allow the join, and the role to assign or nil to keep the requested one. The role must be one listed in
+// match_roles, or player or spectator if the match module lists none. The join is rejected with ErrMatchFull if the
+// role has no free places. It returns the assigned role.
+func (mh *MatchHandler) JoinAttempt(p Presence, role string) (string, error) {
+	if role == "" {
+		role = MatchRolePlayer
+	}
+	result, err := mh.State(func(vm *lua.LState, ctx *lua.LTable, state lua.LValue) (lua.LValue, interface{}, error) {
+		assigned := role
+		if mh.attemptFn != nil {
+			ret, err := mh.invoke(mh.attemptFn, 3, state, matchPresenceToTable(vm, p), lua.LString(role))
+			if err != nil {
+				return nil, nil, err
+			}
+			mh.setState(ret[0])
+			if !lua.LVAsBool(ret[1]) {
+				return nil, nil, ErrMatchJoinRejected
+			}
+			if ret[2] != lua.LNil {
+				r, ok := ret[2].(lua.LString)
+				if !ok {
+					return nil, nil, errors.New("match_join_attempt returned an invalid role, must be a string")
+				}
+				assigned = string(r)
+			}
+		}
+
+		limit := 0
+		if mh.roleLimits == nil {
+			if assigned != MatchRolePlayer && assigned != MatchRoleSpectator {
+				return nil, nil, ErrMatchRoleInvalid
+			}
+		} else if limit = mh.roleLimits[assigned]; limit == 0 {
+			return nil, nil, ErrMatchRoleInvalid
+		}
+		if limit > 0 {
+			count := 0
+			for sessionID, r := range mh.roles {
+				if r == assigned && sessionID != p.ID.SessionID {
+					count++
+				}
+			}
+			if count >= limit {
+				return nil, nil, ErrMatchFull
+			}
+		}
+		mh.roles[p.ID.SessionID] = assigned
+		return nil, assigned, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return result.(string), nil
+}
+
+func (mh *MatchHandler) Join(joins []Presence) {
+	if mh.joinFn == nil && mh.welcomeFn == nil && mh.summaryFn == nil {
+		return
+	}
+	mh.queue(func(mh *MatchHandler) {
+		if mh.summaryFn != nil {
+			if mh.participants == nil {
+				mh.participants = make(map[uuid.UUID]Presence)
+			}
+			for _, p := range joins {
+				mh.participants[p.UserID] = p
+			}
+		}
+		if mh.joinFn != nil {
+			ret, err := mh.invoke(mh.joinFn, 1, mh.state, matchPresencesToTable(mh.vm, joins))
+			if err != nil {
+				mh.logger.Error("Match join function caused an error", zap.Error(err))
+				return
+			}
+			mh.setState(ret[0])
+		}
+		if mh.welcomeFn != nil {
+			for _, p := range joins {
+				mh.welcome(p)
+			}
+		}
+	})
+}
+
+// welcome asks the match module for an initial message tailored to a joining presence, and sends it only to them.
+// The welcome function receives the state after the join and returns an op code and data, or nil to send nothing.
+func (mh *MatchHandler) welcome(p Presence) {
+	ret, err := mh.invoke(mh.welcomeFn, 2, mh.state, matchPresenceToTable(mh.vm, p))
+	if err != nil {
+		mh.logger.Error("Match welcome function caused an error", zap.Error(err))
+		return
+	}
+	if ret[0] == lua.LNil {
+		return
+	}
+	opCode, ok := ret[0].(lua.LNumber)
+	if !ok {
+		mh.logger.Error("Match welcome function returned an invalid op code")
+		return
+	}
+	data, ok := ret[1].(lua.LString)
+	if !ok && ret[1] != lua.LNil {
+		mh.logger.Error("Match welcome function returned invalid data, must be a string")
+		return
+	}
+	if err := mh.registry.Broadcast(mh.ID, int64(opCode), []byte(data), []Presence{p}); err != nil {
+		mh.logger.Error("Could not send match welcome message", zap.Error(err))
+	}
+}
+
+func (mh *MatchHandler) Leave(leaves []Presence) {
+	mh.queue(func(mh *MatchHandler) {
+		for _, p := range leaves {
+			delete(mh.roles, p.ID.SessionID)
+		}
+		if mh.leaveFn == nil {
+			return
+		}
+		ret, err := mh.invoke(mh.leaveFn, 1, mh.state, matchPresencesToTable(mh.vm, leaves))
+		if err != nil {
+			mh.logger.Error("Match leave function caused an error", zap.Error(err))
+			return
+		}
+		mh.setState(ret[0])
+	})
+}
+
+// Data buffers a match data message, it will be delivered to the match module on the next tick. Messages with an op code
+// the match module does not allow are dropped.
+func (mh *MatchHandler) Data(presence Presence, opCode int64, data []byte) {
+	if mh.opCodes != nil && !mh.opCodes[opCode] {
+		mh.logger.Warn("Match data op code not allowed, dropping message", zap.Int64("op_code", opCode), zap.String("uid", presence.UserID.String()), zap.String("sid", presence.ID.SessionID.String()))
+		metrics.IncrCounter([]string{"match", "data", "rejected"}, 1)
+		return
+	}
+	mh.queue(func(mh *MatchHandler) {
+		mh.messages = append(mh.messages, &matchMessage{presence: presence, opCode: opCode, data: data})
+	})
+}
+
+// State runs fn on the match goroutine between ticks, with exclusive access to the match state, and returns its result.
+// The function returns the new state, or nil to keep the current one. State must not be called from a match goroutine,
+// the match's own or another's, as two matches reading each other's state would wait on each other forever. It
+// returns ErrMatchNotFound if the match stops before the function runs.
+func (mh *MatchHandler) State(fn func(vm *lua.LState, ctx *lua.LTable, state lua.LValue) (lua.LValue, interface{}, error)) (interface{}, error) {
+	type stateResult struct {
+		result interface{}
+		err    error
+	}
+	resultCh := make(chan stateResult, 1)
+	if !mh.queue(func(mh *MatchHandler) {
+		state, result, err := fn(mh.vm, mh.ctx, mh.state)
+		if err == nil && state != nil && state != lua.LNil {
+			mh.state = state
+		}
+		resultCh <- stateResult{result: result, err: err}
+	}) {
+		if mh.stopped.Load() {
+			return nil, ErrMatchNotFound
+		}
+		return nil, ErrMatchBusy
+	}
+
+	select {
+	case r := <-resultCh:
+		return r.result, r.err
+	case <-mh.doneCh:
+		// The call may have run just before the match stopped.
+		select {
+		case r := <-resultCh:
+			return r.result, r.err
+		default:
+			return nil, ErrMatchNotFound
+		}
+	}
+}
+
+// Timer runs fn on the match goroutine once the delay has passed, between ticks and with exclusive access to the match
+// state like State does. The function returns the new state, or nil to keep the current one. It returns an ID to
+// cancel the timer with. Fired timers do not go through the call queue so they are never dropped, timers still
+// pending when the match ends never run.
+func (mh *MatchHandler) Timer(after time.Duration, fn func(vm *lua.LState, ctx *lua.LTable, state lua.LValue) (lua.LValue, error)) (int64, error) {
+	if mh.stopped.Load() {
+		return 0, ErrMatchNotFound
+	}
+
+	mh.timersMu.Lock()
+	defer mh.timersMu.Unlock()
+	if len(mh.timers) >= matchTimersMax {
+		return 0, ErrMatchTimersFull
+	}
+	mh.timerNext++
+	id := mh.timerNext
+	t := &matchTimer{fn: fn}
+	t.timer = time.AfterFunc(after, func() {
+		mh.timersMu.Lock()
+		if _, pending := mh.timers[id]; pending {
+			mh.timersDue = append(mh.timersDue, id)
+		}
+		mh.timersMu.Unlock()
+
+		select {
+		case mh.timerCh <- struct{}{}:
+		default:
+			// The match goroutine is already due to run timers, and will see this one.
+		}
+	})
+	mh.timers[id] = t
+	return id, nil
+}
+
+// runTimers runs the functions of all due timers on the match goroutine, in the order they fired.
+func (mh *MatchHandler) runTimers() {
+	mh.timersMu.Lock()
+	due := mh.timersDue
+	mh.timersDue = nil
+	mh.timersMu.Unlock()
+
+	for _, id := range due {
+		// Cancelling after the timer fired but before its function runs still stops the function.
+		mh.timersMu.Lock()
+		t, pending := mh.timers[id]
+		delete(mh.timers, id)
+		mh.timersMu.Unlock()
+		if !pending || mh.stopped.Load() {
+			continue
+		}
+
+		state, err := t.fn(mh.vm, mh.ctx, mh.state)
+		if err != nil {
+			mh.logger.Error("Match timer function caused an error", zap.Int64("timer_id", id), zap.Error(err))
+			continue
+		}
+		if state != nil && state != lua.LNil {
+			mh.state = state
+		}
+	}
+}
+
+// TimerCancel stops a pending timer, and returns false if it already ran or was cancelled.
+func (mh *MatchHandler) TimerCancel(id int64) bool {
+	mh.timersMu.Lock()
+	defer mh.timersMu.Unlock()
+	t, ok := mh.timers[id]
+	if !ok {
+		return false
+	}
+	t.timer.Stop()
+	delete(mh.timers, id)
+	return true
+}
+
+func (mh *MatchHandler) stopTimers() {
+	mh.timersMu.Lock()
+	for id, t := range mh.timers {
+		t.timer.Stop()
+		delete(mh.timers, id)
+	}
+	mh.timersDue = nil
+	mh.timersMu.Unlock()
+}
+
+func (mh *MatchHandler) queue(f func(mh *MatchHandler)) bool {
+	if mh.stopped.Load() {
+		return false
+	}
+	select {
+	case mh.callCh <- f:
+		return true
+	default:
+		mh.logger.Warn("Match call queue full, dropping call")
+		return false
+	}
+}
+
+func (mh *MatchHandler) loop() bool {
+	mh.tick++
+
+	messages := mh.vm.NewTable()
+	for i, m := range mh.messages {
+		msg := mh.vm.NewTable()
+		msg.RawSetString("presence", matchPresenceToTable(mh.vm, m.presence))
+		msg.RawSetString("op_code", lua.LNumber(m.opCode))
+		msg.RawSetString("data", lua.LString(m.data))
+		messages.RawSetInt(i+1, msg)
+	}
+	mh.messages = mh.messages[:0]
+
+	ret, err := mh.invoke(mh.loopFn, 1, mh.state, lua.LNumber(mh.tick), messages)
+	if err != nil {
+		mh.logger.Error("Match loop function caused an error", zap.Error(err))
+		return true
+	}
+
+	// Returning a nil state from the loop ends the match.
+	if ret[0] == lua.LNil {
+		return false
+	}
+	mh.state = ret[0]
+	return true
+}
+
+func (mh *MatchHandler) terminate() {
+	mh.stopped.Store(true)
+	mh.ticker.Stop()
+	mh.stopTimers()
+
+	mh.summarize()
+	if mh.terminateFn != nil {
+		if _, err := mh.invoke(mh.terminateFn, 0, mh.state, lua.LNumber(mh.tick)); err != nil {
+			mh.logger.Error("Match terminate function caused an error", zap.Error(err))
+		}
+	}
+
+	mh.registry.Remove(mh.ID)
+	mh.vm.Close()
+	mh.logger.Info("Match stopped", zap.Int64("tick", mh.tick))
+}
+
+// summarize asks the match module for a summary of the match for each participant, and sends each summary to its
+// participant as a notification. The summary function receives the last state, the final tick and everyone who joined,
+// and returns a table of summary tables keyed by user ID. It runs at most once however the match ends.
+func (mh *MatchHandler) summarize() {
+	if mh.summaryFn == nil {
+		return
+	}
+	mh.summaryOnce.Do(func() {
+		participants := make([]Presence, 0, len(mh.participants))
+		for _, p := range mh.participants {
+			participants = append(participants, p)
+		}
+		ret, err := mh.invoke(mh.summaryFn, 1, mh.state, lua.LNumber(mh.tick), matchPresencesToTable(mh.vm, participants))
+		if err != nil {
+			mh.logger.Error("Match summary function caused an error", zap.Error(err))
+			return
+		}
+		summaries, ok := ret[0].(*lua.LTable)
+		if !ok {
+			if ret[0] != lua.LNil {
+				mh.logger.Error("Match summary function returned invalid data, must be a table of summaries keyed by user ID")
+			}
+			return
+		}
+
+		notifications := make([]*NNotification, 0)
+		summaries.ForEach(func(k lua.LValue, v lua.LValue) {
+			userID := uuid.FromStringOrNil(lua.LVAsString(k))
+			summary, ok := v.(*lua.LTable)
+			if _, participated := mh.participants[userID]; !participated || !ok {
+				mh.logger.Warn("Match summary function returned a summary for a user who did not join, or one that is not a table", zap.String("uid", lua.LVAsString(k)))
+				return
+			}
+			data, err := ConvertLuaTableMaxDepth(summary, mh.runtime.conversionMaxDepth)
+			if err != nil {
+				mh.logger.Warn("Match summary function returned a summary that could not be converted", zap.String("uid", userID.String()), zap.Error(err))
+				return
+			}
+			content, err := json.Marshal(data)
+			if err != nil {
+				mh.logger.Error("Could not marshal match summary", zap.Error(err))
+				return
+			}
+			notifications = append(notifications, &NNotification{
+				UserID:     userID.Bytes(),
+				Subject:    "match_summary",
+				Content:    content,
+				Code:       NotificationCodeMatchSummary,
+				Persistent: true,
+			})
+		})
+		if len(notifications) == 0 {
+			return
+		}
+		if err := mh.runtime.notificationService.NotificationSend(notifications); err != nil {
+			mh.logger.Error("Could not send match summaries", zap.Error(err))
+		}
+	})
+}
+
+func (mh *MatchHandler) setState(state lua.LValue) {
+	if state == lua.LNil {
+		mh.logger.Warn("Match function returned nil state, keeping previous state")
+		return
+	}
+	mh.state = state
+}
+
+func (mh *MatchHandler) invoke(fn *lua.LFunction, nret int, args ...lua.LValue) ([]lua.LValue, error) {
+	mh.vm.Push(fn)
+	mh.vm.Push(mh.ctx)
+	for _, arg := range args {
+		mh.vm.Push(arg)
+	}
+
+	if err := mh.vm.PCall(len(args)+1, nret, nil); err != nil {
+		return nil, err
+	}
+
+	ret := make([]lua.LValue, nret)
+	for i := 0; i < nret; i++ {
+		ret[i] = mh.vm.Get(i - nret)
+	}
+	mh.vm.Pop(nret)
+	return ret, nil
+}
+
+func matchPresenceToTable(l *lua.LState, p Presence) *lua.LTable {
+	lt := l.NewTable()
+	lt.RawSetString("user_id", lua.LString(p.UserID.String()))
+	lt.RawSetString("session_id", lua.LString(p.ID.SessionID.String()))
+	lt.RawSetString("node", lua.LString(p.ID.Node))
+	lt.RawSetString("handle", lua.LString(p.Meta.Handle))
+	if p.Meta.Role != "" {
+		lt.RawSetString("role", lua.LString(p.Meta.Role))
+	}
+	if p.Meta.Metadata != "" {
+		var metadata map[string]interface{}
+		if err := json.Unmarshal([]byte(p.Meta.Metadata), &metadata); err == nil {
+			lt.RawSetString("metadata", ConvertMap(l, metadata))
+		}
+	}
+	if region := presenceRegion(p.Meta.Region); region != nil {
+		lt.RawSetString("region", ConvertMap(l, region))
+	}
+	return lt
+}
+
+func matchPresencesToTable(l *lua.LState, ps []Presence) *lua.LTable {
+	lt := l.NewTable()
+	for i, p := range ps {
+		lt.RawSetInt(i+1, matchPresenceToTable(l, p))
+	}
+	return lt
+}
@@ -0,0 +1,212 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+// MatchRegistry keeps track of authoritative matches running on the current node.
+type MatchRegistry interface {
+	Create(runtime *Runtime, module string, params map[string]interface{}) (uuid.UUID, error)
+	Get(matchID uuid.UUID) *MatchHandler
+	Remove(matchID uuid.UUID)
+	Count() int
+	// List returns up to limit matches on this node in no particular order, only those with the given label if it is not empty.
+	List(limit int, label string) []*MatchHandler
+	Stop()
+
+	// Broadcast sends match data from the server to all presences in a match, or only the given presences if any.
+	Broadcast(matchID uuid.UUID, opCode int64, data []byte, presences []Presence) error
+
+	// Tracker diff listener, used to deliver match joins and leaves to match handlers.
+	HandleDiff(joins, leaves []Presence)
+}
+
+type MatchRegistryService struct {
+	sync.RWMutex
+	logger        *zap.Logger
+	name          string
+	tracker       Tracker
+	messageRouter MessageRouter
+	matches       map[uuid.UUID]*MatchHandler
+}
+
+func NewMatchRegistryService(logger *zap.Logger, name string, tracker Tracker, messageRouter MessageRouter) *MatchRegistryService {
+	return &MatchRegistryService{
+		logger:        logger,
+		name:          name,
+		tracker:       tracker,
+		messageRouter: messageRouter,
+		matches:       make(map[uuid.UUID]*MatchHandler),
+	}
+}
+
+func (m *MatchRegistryService) Create(runtime *Runtime, module string, params map[string]interface{}) (uuid.UUID, error) {
+	handlers := runtime.GetRuntimeMatch(module)
+	if handlers == nil {
+		return uuid.Nil, errors.New("match module not registered")
+	}
+
+	matchID := uuid.NewV4()
+	mh, err := NewMatchHandler(m.logger, runtime, m, matchID, strings.ToLower(module), handlers, params)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	m.Lock()
+	m.matches[matchID] = mh
+	m.Unlock()
+
+	mh.Start()
+	return matchID, nil
+}
+
+func (m *MatchRegistryService) Get(matchID uuid.UUID) *MatchHandler {
+	var mh *MatchHandler
+	m.RLock()
+	mh = m.matches[matchID]
+	m.RUnlock()
+	return mh
+}
+
+func (m *MatchRegistryService) Remove(matchID uuid.UUID) {
+	m.Lock()
+	delete(m.matches, matchID)
+	m.Unlock()
+
+	// Drop any presences still in the match, they have nowhere to send data to.
+	topic := "match:" + matchID.String()
+	for _, p := range m.tracker.ListLocalByTopic(topic) {
+		m.tracker.Untrack(p.ID.SessionID, topic, p.UserID)
+	}
+}
+
+func (m *MatchRegistryService) Count() int {
+	var count int
+	m.RLock()
+	count = len(m.matches)
+	m.RUnlock()
+	return count
+}
+
+func (m *MatchRegistryService) List(limit int, label string) []*MatchHandler {
+	handlers := make([]*MatchHandler, 0)
+	m.RLock()
+	for _, mh := range m.matches {
+		if len(handlers) >= limit {
+			break
+		}
+		if label == "" || mh.Label() == label {
+			handlers = append(handlers, mh)
+		}
+	}
+	m.RUnlock()
+	return handlers
+}
+
+func (m *MatchRegistryService) Stop() {
+	m.RLock()
+	handlers := make([]*MatchHandler, 0, len(m.matches))
+	for _, mh := range m.matches {
+		handlers = append(handlers, mh)
+	}
+	m.RUnlock()
+
+	for _, mh := range handlers {
+		mh.Stop()
+	}
+	// Wait for terminate functions to complete, the runtime is usually stopped right after this.
+	for _, mh := range handlers {
+		mh.Wait()
+	}
+}
+
+func (m *MatchRegistryService) Broadcast(matchID uuid.UUID, opCode int64, data []byte, presences []Presence) error {
+	ps := m.tracker.ListByTopic("match:" + matchID.String())
+	if len(ps) == 0 && m.Get(matchID) == nil {
+		return ErrMatchNotFound
+	}
+
+	if len(presences) != 0 {
+		targets := make([]Presence, 0, len(presences))
+		for _, p := range ps {
+			for _, filter := range presences {
+				if p.ID.SessionID == filter.ID.SessionID && p.UserID == filter.UserID {
+					targets = append(targets, p)
+					break
+				}
+			}
+		}
+		ps = targets
+	}
+
+	// Match data sent by the server has no sender presence.
+	outgoing := &Envelope{
+		Payload: &Envelope_MatchData{
+			MatchData: &MatchData{
+				MatchId: matchID.Bytes(),
+				OpCode:  opCode,
+				Data:    data,
+			},
+		},
+	}
+	m.messageRouter.Send(m.logger, ps, outgoing)
+	return nil
+}
+
+func (m *MatchRegistryService) HandleDiff(joins, leaves []Presence) {
+	matchJoins := make(map[uuid.UUID][]Presence, 0)
+	matchLeaves := make(map[uuid.UUID][]Presence, 0)
+
+	// Group joins and leaves by match, only authoritative matches are relevant here.
+	for _, p := range joins {
+		if matchID := m.matchIDFromTopic(p.Topic); matchID != uuid.Nil {
+			matchJoins[matchID] = append(matchJoins[matchID], p)
+		}
+	}
+	for _, p := range leaves {
+		if matchID := m.matchIDFromTopic(p.Topic); matchID != uuid.Nil {
+			matchLeaves[matchID] = append(matchLeaves[matchID], p)
+		}
+	}
+
+	for matchID, ps := range matchJoins {
+		if mh := m.Get(matchID); mh != nil {
+			mh.Join(ps)
+		}
+	}
+	for matchID, ps := range matchLeaves {
+		if mh := m.Get(matchID); mh != nil {
+			mh.Leave(ps)
+		}
+	}
+}
+
+func (m *MatchRegistryService) matchIDFromTopic(topic string) uuid.UUID {
+	if !strings.HasPrefix(topic, "match:") {
+		return uuid.Nil
+	}
+	matchID := uuid.FromStringOrNil(strings.TrimPrefix(topic, "match:"))
+	if matchID == uuid.Nil || m.Get(matchID) == nil {
+		return uuid.Nil
+	}
+	return matchID
+}
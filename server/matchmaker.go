@@ -16,12 +16,20 @@ package server
 
 import (
 	"errors"
+	"github.com/armon/go-metrics"
 	"github.com/satori/go.uuid"
 	"sync"
+	"time"
 )
 
+// MatchmakerDefaultPool is the pool tickets are matched in when they are not routed to a named pool.
+const MatchmakerDefaultPool = "default"
+
+// How often waiting tickets are checked for expiry.
+const matchmakerSweepInterval = time.Second
+
 type Matchmaker interface {
-	Add(sessionID uuid.UUID, userID uuid.UUID, meta PresenceMeta, requiredCount int64) (uuid.UUID, map[MatchmakerKey]*MatchmakerProfile)
+	Add(sessionID uuid.UUID, userID uuid.UUID, meta PresenceMeta, requiredCount int64, timeoutMs int64, pool string) (uuid.UUID, map[MatchmakerKey]*MatchmakerProfile)
 	Remove(sessionID uuid.UUID, userID uuid.UUID, ticket uuid.UUID) error
 	RemoveAll(sessionID uuid.UUID)
 	UpdateAll(sessionID uuid.UUID, meta PresenceMeta)
@@ -36,30 +44,190 @@ type MatchmakerKey struct {
 type MatchmakerProfile struct {
 	Meta          PresenceMeta
 	RequiredCount int64
+	// Time in milliseconds after which the ticket is no longer matched, 0 if it never expires.
+	ExpiresAt int64
+	// Pool the ticket was routed to, and the pool it was matched in once it is matched.
+	Pool      string
+	CreatedAt int64
 }
 
 type MatchmakerService struct {
 	sync.Mutex
-	name   string
-	values map[MatchmakerKey]*MatchmakerProfile
+	name               string
+	ticketTimeoutMs    int64
+	maxTicketTimeoutMs int64
+	pools              map[string]*MatchmakerPoolConfig
+	values             map[MatchmakerKey]*MatchmakerProfile
+	// Pools with a size gauge, so pools that empty out are reported as 0 rather than keeping their last size.
+	gaugedPools map[string]bool
+	// Whether any pool promotes waiting tickets, so waiting tickets may come to match each other.
+	promotes bool
+	stopCh   chan struct{}
+}
+
+// matchmakerGroup is the pool and size of match a waiting ticket can currently be matched in.
+type matchmakerGroup struct {
+	pool          string
+	requiredCount int64
+}
+
+// MatchmakerPoolConfigured reports whether tickets may be routed to a pool: the default pool, a configured pool, or a
+// pool that configured pools promote to.
+func MatchmakerPoolConfigured(pools map[string]*MatchmakerPoolConfig, pool string) bool {
+	if pool == MatchmakerDefaultPool {
+		return true
+	}
+	if _, ok := pools[pool]; ok {
+		return true
+	}
+	for _, pc := range pools {
+		if pc != nil && pc.PromoteTo == pool {
+			return true
+		}
+	}
+	return false
 }
 
-func NewMatchmakerService(name string) *MatchmakerService {
+func NewMatchmakerService(name string, config *MatchmakerConfig) *MatchmakerService {
+	promotes := false
+	for _, pc := range config.Pools {
+		if pc != nil && pc.PromoteTo != "" && pc.PromoteAfterMs > 0 {
+			promotes = true
+		}
+	}
 	return &MatchmakerService{
-		name:   name,
-		values: make(map[MatchmakerKey]*MatchmakerProfile),
+		name:               name,
+		ticketTimeoutMs:    config.TicketTimeoutMs,
+		maxTicketTimeoutMs: config.MaxTicketTimeoutMs,
+		pools:              config.Pools,
+		values:             make(map[MatchmakerKey]*MatchmakerProfile),
+		gaugedPools:        make(map[string]bool),
+		promotes:           promotes,
+		stopCh:             make(chan struct{}),
+	}
+}
+
+// Start sweeps expired tickets and matches promoted tickets in the background until Stop is called. Each batch of
+// expired tickets is passed to expiredFn and each batch of matches to matchedFn, so the owners can be told.
+func (m *MatchmakerService) Start(expiredFn func(expired map[MatchmakerKey]*MatchmakerProfile), matchedFn func(matches []map[MatchmakerKey]*MatchmakerProfile)) {
+	go func() {
+		ticker := time.NewTicker(matchmakerSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stopCh:
+				return
+			case <-ticker.C:
+				ts := nowMs()
+				if expired := m.Sweep(ts); len(expired) != 0 {
+					expiredFn(expired)
+				}
+				if matches := m.Match(ts); len(matches) != 0 {
+					matchedFn(matches)
+				}
+			}
+		}
+	}()
+}
+
+func (m *MatchmakerService) Stop() {
+	close(m.stopCh)
+}
+
+// Sweep removes the tickets that have expired by the given time and returns them.
+func (m *MatchmakerService) Sweep(ts int64) map[MatchmakerKey]*MatchmakerProfile {
+	expired := make(map[MatchmakerKey]*MatchmakerProfile)
+	m.Lock()
+	for mk, mp := range m.values {
+		if mp.ExpiresAt != 0 && mp.ExpiresAt <= ts {
+			expired[mk] = mp
+			delete(m.values, mk)
+		}
+	}
+	if len(expired) != 0 {
+		m.reportPoolSizes(ts)
+	}
+	m.Unlock()
+	return expired
+}
+
+// Match matches waiting tickets with each other. Tickets are otherwise only matched when one of them is added, so this
+// finds the matches that become possible as tickets are promoted into other pools while they wait.
+func (m *MatchmakerService) Match(ts int64) []map[MatchmakerKey]*MatchmakerProfile {
+	if !m.promotes {
+		return nil
+	}
+
+	matches := make([]map[MatchmakerKey]*MatchmakerProfile, 0)
+	m.Lock()
+	partial := make(map[matchmakerGroup]map[MatchmakerKey]*MatchmakerProfile)
+	for mk, mp := range m.values {
+		if mp.ExpiresAt != 0 && mp.ExpiresAt <= ts {
+			continue
+		}
+		group := matchmakerGroup{pool: m.pool(mp, ts), requiredCount: mp.RequiredCount}
+		selected, ok := partial[group]
+		if !ok {
+			selected = make(map[MatchmakerKey]*MatchmakerProfile, mp.RequiredCount)
+			partial[group] = selected
+		}
+		conflict := false
+		for smk := range selected {
+			if smk.ID.SessionID == mk.ID.SessionID || smk.UserID == mk.UserID {
+				conflict = true
+				break
+			}
+		}
+		if conflict {
+			continue
+		}
+		selected[mk] = mp
+		if int64(len(selected)) == mp.RequiredCount {
+			for smk, smp := range selected {
+				delete(m.values, smk)
+				smp.Pool = group.pool
+			}
+			matches = append(matches, selected)
+			delete(partial, group)
+		}
+	}
+	if len(matches) != 0 {
+		m.reportPoolSizes(ts)
 	}
+	m.Unlock()
+	return matches
 }
 
-func (m *MatchmakerService) Add(sessionID uuid.UUID, userID uuid.UUID, meta PresenceMeta, requiredCount int64) (uuid.UUID, map[MatchmakerKey]*MatchmakerProfile) {
+// Add creates a ticket and tries to match it immediately with tickets currently in the same pool. A timeout of 0 uses
+// the matchmaker's default ticket timeout, and an empty pool uses the default pool. Timeouts are capped at the
+// configured maximum, if there is one.
+func (m *MatchmakerService) Add(sessionID uuid.UUID, userID uuid.UUID, meta PresenceMeta, requiredCount int64, timeoutMs int64, pool string) (uuid.UUID, map[MatchmakerKey]*MatchmakerProfile) {
+	if pool == "" {
+		pool = MatchmakerDefaultPool
+	}
 	ticket := uuid.NewV4()
 	selected := make(map[MatchmakerKey]*MatchmakerProfile, requiredCount-1)
 	qmk := MatchmakerKey{ID: PresenceID{SessionID: sessionID, Node: m.name}, UserID: userID, Ticket: ticket}
-	qmp := &MatchmakerProfile{Meta: meta, RequiredCount: requiredCount}
+	ts := nowMs()
+	qmp := &MatchmakerProfile{Meta: meta, RequiredCount: requiredCount, Pool: pool, CreatedAt: ts}
+
+	if timeoutMs == 0 {
+		timeoutMs = m.ticketTimeoutMs
+	}
+	if m.maxTicketTimeoutMs > 0 && (timeoutMs <= 0 || timeoutMs > m.maxTicketTimeoutMs) {
+		timeoutMs = m.maxTicketTimeoutMs
+	}
+	if timeoutMs > 0 {
+		qmp.ExpiresAt = ts + timeoutMs
+	}
 
 	m.Lock()
 	for mk, mp := range m.values {
-		if mk.ID.SessionID != sessionID && mk.UserID != userID && mp.RequiredCount == requiredCount {
+		if mp.ExpiresAt != 0 && mp.ExpiresAt <= ts {
+			// Expired tickets are left for the sweep, which tells their owners.
+			continue
+		}
+		if mk.ID.SessionID != sessionID && mk.UserID != userID && mp.RequiredCount == requiredCount && m.pool(mp, ts) == pool {
 			selected[mk] = mp
 			if int64(len(selected)) == requiredCount-1 {
 				break
@@ -67,13 +235,15 @@ func (m *MatchmakerService) Add(sessionID uuid.UUID, userID uuid.UUID, meta Pres
 		}
 	}
 	if int64(len(selected)) == requiredCount-1 {
-		for mk, _ := range selected {
+		for mk, mp := range selected {
 			delete(m.values, mk)
+			mp.Pool = pool
 		}
 		selected[qmk] = qmp
 	} else {
 		m.values[qmk] = qmp
 	}
+	m.reportPoolSizes(ts)
 	m.Unlock()
 
 	if int64(len(selected)) != requiredCount {
@@ -91,6 +261,7 @@ func (m *MatchmakerService) Remove(sessionID uuid.UUID, userID uuid.UUID, ticket
 	_, ok := m.values[mk]
 	if ok {
 		delete(m.values, mk)
+		m.reportPoolSizes(nowMs())
 	} else {
 		e = errors.New("ticket not found")
 	}
@@ -106,6 +277,7 @@ func (m *MatchmakerService) RemoveAll(sessionID uuid.UUID) {
 			delete(m.values, mk)
 		}
 	}
+	m.reportPoolSizes(nowMs())
 	m.Unlock()
 }
 
@@ -118,3 +290,43 @@ func (m *MatchmakerService) UpdateAll(sessionID uuid.UUID, meta PresenceMeta) {
 	}
 	m.Unlock()
 }
+
+// pool returns the pool a ticket is matched in at the given time. Tickets are promoted along the configured chain of
+// pools, each promotion delay counting from when the ticket entered that pool. A chain that loops back on itself is
+// followed no further than the number of configured pools.
+func (m *MatchmakerService) pool(mp *MatchmakerProfile, ts int64) string {
+	pool := mp.Pool
+	waited := ts - mp.CreatedAt
+	for i := 0; i < len(m.pools); i++ {
+		pc, ok := m.pools[pool]
+		if !ok || pc == nil || pc.PromoteTo == "" || pc.PromoteAfterMs <= 0 || waited < pc.PromoteAfterMs {
+			break
+		}
+		waited -= pc.PromoteAfterMs
+		pool = pc.PromoteTo
+	}
+	return pool
+}
+
+// reportPoolSizes sets a gauge with the number of waiting tickets in each pool. The caller must hold the lock.
+func (m *MatchmakerService) reportPoolSizes(ts int64) {
+	sizes := make(map[string]int)
+	for _, mp := range m.values {
+		if mp.ExpiresAt == 0 || mp.ExpiresAt > ts {
+			sizes[m.pool(mp, ts)]++
+		}
+	}
+	for pool := range m.gaugedPools {
+		if _, ok := sizes[pool]; !ok {
+			sizes[pool] = 0
+		}
+	}
+	for pool, size := range sizes {
+		metrics.SetGauge([]string{"matchmaker", "pool", pool, "tickets"}, float32(size))
+		if size == 0 {
+			delete(m.gaugedPools, pool)
+		} else {
+			m.gaugedPools[pool] = true
+		}
+	}
+}
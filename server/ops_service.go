@@ -32,21 +32,27 @@ type statsService struct {
 	version   string
 	config    Config
 	tracker   Tracker
+	runtime   *Runtime
 	startedAt int64
 }
 
 // NewStatsService creates a new StatsService
-func NewStatsService(logger *zap.Logger, config Config, version string, tracker Tracker, startedAt int64) StatsService {
+func NewStatsService(logger *zap.Logger, config Config, version string, tracker Tracker, runtime *Runtime, startedAt int64) StatsService {
 	return &statsService{
 		logger:    logger,
 		version:   version,
 		config:    config,
 		tracker:   tracker,
+		runtime:   runtime,
 		startedAt: startedAt,
 	}
 }
 
 func (s *statsService) GetHealthStatus() int {
+	// Report degraded until runtime modules say they are ready, for example after warming their caches.
+	if !s.runtime.IsReady() {
+		return 1
+	}
 	return 0 //TODO - calculate extra information such as connectivity to DB etc
 }
 
@@ -21,37 +21,55 @@ import (
 	"nakama/pkg/social"
 
 	"strings"
+	"sync"
 
+	"github.com/armon/go-metrics"
 	"github.com/gogo/protobuf/jsonpb"
+	"github.com/gogo/protobuf/proto"
+	"github.com/satori/go.uuid"
 	"go.uber.org/zap"
 )
 
 type pipeline struct {
-	config            Config
-	db                *sql.DB
-	tracker           Tracker
-	matchmaker        Matchmaker
-	hmacSecretByte    []byte
-	messageRouter     MessageRouter
-	sessionRegistry   *SessionRegistry
-	socialClient      *social.Client
-	runtime           *Runtime
-	jsonpbMarshaler   *jsonpb.Marshaler
-	jsonpbUnmarshaler *jsonpb.Unmarshaler
+	config              Config
+	db                  *sql.DB
+	storageRouter       *StorageRouter
+	tracker             Tracker
+	matchmaker          Matchmaker
+	matchRegistry       MatchRegistry
+	hmacSecretByte      []byte
+	messageRouter       MessageRouter
+	sessionRegistry     *SessionRegistry
+	socialClient        *social.Client
+	runtime             *Runtime
+	notificationService *NotificationService
+	jsonpbMarshaler     *jsonpb.Marshaler
+	jsonpbUnmarshaler   *jsonpb.Unmarshaler
+	topicTranslations   *topicTranslations
+	// Matches each user is joining, see matchJoin.
+	matchJoinMutex   sync.Mutex
+	matchJoinPending map[uuid.UUID]map[string]int
+	clientMatches    *ClientMatches
 }
 
 // NewPipeline creates a new Pipeline
-func NewPipeline(config Config, db *sql.DB, tracker Tracker, matchmaker Matchmaker, messageRouter MessageRouter, registry *SessionRegistry, socialClient *social.Client, runtime *Runtime) *pipeline {
+func NewPipeline(config Config, db *sql.DB, storageRouter *StorageRouter, tracker Tracker, matchmaker Matchmaker, matchRegistry MatchRegistry, messageRouter MessageRouter, registry *SessionRegistry, socialClient *social.Client, runtime *Runtime, notificationService *NotificationService) *pipeline {
 	return &pipeline{
-		config:          config,
-		db:              db,
-		tracker:         tracker,
-		matchmaker:      matchmaker,
-		hmacSecretByte:  []byte(config.GetSession().EncryptionKey),
-		messageRouter:   messageRouter,
-		sessionRegistry: registry,
-		socialClient:    socialClient,
-		runtime:         runtime,
+		config:              config,
+		db:                  db,
+		storageRouter:       storageRouter,
+		tracker:             tracker,
+		matchmaker:          matchmaker,
+		matchRegistry:       matchRegistry,
+		hmacSecretByte:      []byte(config.GetSession().EncryptionKey),
+		messageRouter:       messageRouter,
+		sessionRegistry:     registry,
+		socialClient:        socialClient,
+		runtime:             runtime,
+		notificationService: notificationService,
+		topicTranslations:   newTopicTranslations(),
+		matchJoinPending:    make(map[uuid.UUID]map[string]int),
+		clientMatches:       NewClientMatches(config.GetMatchmaker()),
 		jsonpbMarshaler: &jsonpb.Marshaler{
 			EnumsAsInts:  true,
 			EmitDefaults: false,
@@ -64,7 +82,8 @@ func NewPipeline(config Config, db *sql.DB, tracker Tracker, matchmaker Matchmak
 	}
 }
 
-func (p *pipeline) processRequest(logger *zap.Logger, session *session, originalEnvelope *Envelope) {
+// ProcessRequest handles an envelope received from a session.
+func (p *pipeline) ProcessRequest(logger *zap.Logger, session *session, originalEnvelope *Envelope) {
 	if originalEnvelope.Payload == nil {
 		session.Send(ErrorMessage(originalEnvelope.CollationId, MISSING_PAYLOAD, "No payload found"))
 		return
@@ -74,12 +93,59 @@ func (p *pipeline) processRequest(logger *zap.Logger, session *session, original
 	logger.Debug("Received message", zap.String("type", messageType))
 
 	messageType = strings.TrimPrefix(messageType, "*server.Envelope_")
-	envelope, fnErr := RuntimeBeforeHook(p.runtime, p.jsonpbMarshaler, p.jsonpbUnmarshaler, messageType, originalEnvelope, session)
-	if fnErr != nil {
+	if !session.rateLimiter.Allow(messageType) {
+		logger.Debug("Session rate limit exceeded", zap.String("message", messageType), zap.String("tier", session.rateLimiter.tier))
+		session.Send(ErrorMessage(originalEnvelope.CollationId, RATE_LIMITED, "Rate limit exceeded"))
+		return
+	}
+	if !session.sequence.Check(messageType, originalEnvelope.Sequence) {
+		logger.Debug("Session message sequence rejected", zap.String("message", messageType), zap.Int64("sequence", originalEnvelope.Sequence))
+		metrics.IncrCounter([]string{"session", "sequence", "rejected"}, 1)
+		session.Send(ErrorMessage(originalEnvelope.CollationId, SEQUENCE_REJECTED, "Message sequence out of order or replayed"))
+		return
+	}
+	if p.storageWriteRepeat(logger, session, originalEnvelope) {
+		session.sequence.Commit(originalEnvelope.Sequence)
+		return
+	}
+
+	// Group member limits and matchmaker pools come only from before hooks, never from the client.
+	groupStripMaxCount(originalEnvelope)
+	matchmakeStripPool(originalEnvelope)
+
+	envelope, sideEffects, streams, fnErr := RuntimeBeforeHook(p.runtime, p.jsonpbMarshaler, p.jsonpbUnmarshaler, messageType, originalEnvelope, session)
+	if validationErr, ok := fnErr.(*RuntimeValidationError); ok {
+		logger.Debug("Runtime before function rejected message fields", zap.String("message", messageType), zap.Error(fnErr))
+		session.Send(ErrorMessageValidation(originalEnvelope.CollationId, validationErr.Fields))
+		return
+	} else if fnErr != nil {
 		logger.Error("Runtime before function caused an error", zap.String("message", messageType), zap.Error(fnErr))
 		session.Send(ErrorMessage(originalEnvelope.CollationId, RUNTIME_FUNCTION_EXCEPTION, fmt.Sprintf("Runtime before function caused an error: %s", fnErr.Error())))
 		return
 	}
+	// Only messages the before function let through use up their sequence, a rejected one may be sent again.
+	session.sequence.Commit(originalEnvelope.Sequence)
+
+	// Side effect storage writes are committed in the same transaction as the message's own storage writes, or as the
+	// record of a purchase receipt.
+	switch envelope.Payload.(type) {
+	case *Envelope_StorageWrite, *Envelope_PurchaseValidate:
+	default:
+		if len(sideEffects) != 0 {
+			logger.Error("Runtime before function returned storage writes for an unsupported message", zap.String("message", messageType))
+			session.Send(ErrorMessage(originalEnvelope.CollationId, RUNTIME_FUNCTION_EXCEPTION, "Runtime before function returned storage writes, which are only supported for storage write and purchase messages"))
+			return
+		}
+	}
+
+	// Stream subscriptions requested by the before function apply to the sending session, whatever the message outcome.
+	if streams != nil {
+		if err := StreamDirectiveApply(p.tracker, session.id, session.userID, session.handle.Load(), streams); err != nil {
+			logger.Error("Runtime before function returned invalid stream subscriptions", zap.String("message", messageType), zap.Error(err))
+			session.Send(ErrorMessage(originalEnvelope.CollationId, RUNTIME_FUNCTION_EXCEPTION, fmt.Sprintf("Runtime before function returned invalid stream subscriptions: %s", err.Error())))
+			return
+		}
+	}
 
 	switch envelope.Payload.(type) {
 	case *Envelope_Logout:
@@ -161,10 +227,13 @@ func (p *pipeline) processRequest(logger *zap.Logger, session *session, original
 	case *Envelope_StorageFetch:
 		p.storageFetch(logger, session, envelope)
 	case *Envelope_StorageWrite:
-		p.storageWrite(logger, session, envelope)
+		p.storageWrite(logger, session, envelope, sideEffects)
 	case *Envelope_StorageRemove:
 		p.storageRemove(logger, session, envelope)
 
+	case *Envelope_PurchaseValidate:
+		p.purchaseValidate(logger, session, envelope, sideEffects)
+
 	case *Envelope_LeaderboardsList:
 		p.leaderboardsList(logger, session, envelope)
 	case *Envelope_LeaderboardRecordsWrite:
@@ -173,6 +242,15 @@ func (p *pipeline) processRequest(logger *zap.Logger, session *session, original
 		p.leaderboardRecordsFetch(logger, session, envelope)
 	case *Envelope_LeaderboardRecordsList:
 		p.leaderboardRecordsList(logger, session, envelope)
+	case *Envelope_LeaderboardsSubscribe:
+		p.leaderboardsSubscribe(logger, session, envelope)
+	case *Envelope_LeaderboardsUnsubscribe:
+		p.leaderboardsUnsubscribe(logger, session, envelope)
+
+	case *Envelope_NotificationsList:
+		p.notificationsList(logger, session, envelope)
+	case *Envelope_NotificationsRemove:
+		p.notificationsRemove(logger, session, envelope)
 
 	case *Envelope_Rpc:
 		p.rpc(logger, session, envelope)
@@ -185,6 +263,82 @@ func (p *pipeline) processRequest(logger *zap.Logger, session *session, original
 	RuntimeAfterHook(logger, p.runtime, p.jsonpbMarshaler, messageType, envelope, session)
 }
 
+// transformResponse lets runtime transforms rewrite outgoing envelopes, usually to keep older client versions working.
+func (p *pipeline) transformResponse(session *session, envelope *Envelope) *Envelope {
+	if envelope.Payload == nil {
+		return envelope
+	}
+	envelope = p.signAssetURLs(session, envelope)
+
+	if e, ok := envelope.Payload.(*Envelope_Error); ok {
+		code, message, fnErr := p.runtime.InvokeFunctionError(session.userID, session.handle.Load(), session.expiry, session.lang, session.clientVersion, e.Error.Code, e.Error.Message)
+		if fnErr != nil {
+			// Never let a failing error function replace the original error.
+			session.logger.Error("Runtime error function caused an error", zap.Error(fnErr))
+		} else {
+			envelope = &Envelope{CollationId: envelope.CollationId, Payload: &Envelope_Error{Error: &Error{Code: code, Message: message, Fields: e.Error.Fields}}}
+		}
+	}
+
+	messageType := strings.TrimPrefix(fmt.Sprintf("%T", envelope.Payload), "*server.Envelope_")
+	result, fnErr := RuntimeTransformHook(p.runtime, p.jsonpbMarshaler, p.jsonpbUnmarshaler, messageType, envelope, session.clientVersion)
+	if fnErr != nil {
+		session.logger.Error("Runtime transform function caused an error", zap.String("message", messageType), zap.Error(fnErr))
+		return envelope
+	}
+	return result
+}
+
+// signAssetURLs replaces the avatar URLs of users and groups in account and group responses with URLs signed by the
+// runtime. The envelope is copied first, it may also be sent to other sessions.
+func (p *pipeline) signAssetURLs(session *session, envelope *Envelope) *Envelope {
+	switch envelope.Payload.(type) {
+	case *Envelope_Self, *Envelope_Users, *Envelope_Friends, *Envelope_Group, *Envelope_Groups, *Envelope_GroupUsers:
+	default:
+		return envelope
+	}
+	if !p.runtime.IsRuntimeAssetURLRegistered() {
+		return envelope
+	}
+
+	envelope = proto.Clone(envelope).(*Envelope)
+	handle := session.handle.Load()
+	sign := func(reference string) string {
+		return RuntimeAssetURLHook(session.logger, p.runtime, session.userID, handle, session.expiry, reference)
+	}
+	switch payload := envelope.Payload.(type) {
+	case *Envelope_Self:
+		if payload.Self.Self != nil && payload.Self.Self.User != nil {
+			payload.Self.Self.User.AvatarUrl = sign(payload.Self.Self.User.AvatarUrl)
+		}
+	case *Envelope_Users:
+		for _, user := range payload.Users.Users {
+			user.AvatarUrl = sign(user.AvatarUrl)
+		}
+	case *Envelope_Friends:
+		for _, friend := range payload.Friends.Friends {
+			if friend.User != nil {
+				friend.User.AvatarUrl = sign(friend.User.AvatarUrl)
+			}
+		}
+	case *Envelope_Group:
+		if payload.Group.Group != nil {
+			payload.Group.Group.AvatarUrl = sign(payload.Group.Group.AvatarUrl)
+		}
+	case *Envelope_Groups:
+		for _, group := range payload.Groups.Groups {
+			group.AvatarUrl = sign(group.AvatarUrl)
+		}
+	case *Envelope_GroupUsers:
+		for _, groupUser := range payload.GroupUsers.Users {
+			if groupUser.User != nil {
+				groupUser.User.AvatarUrl = sign(groupUser.User.AvatarUrl)
+			}
+		}
+	}
+	return envelope
+}
+
 func ErrorMessageRuntimeException(collationID string, message string) *Envelope {
 	return ErrorMessage(collationID, RUNTIME_EXCEPTION, message)
 }
@@ -193,6 +347,17 @@ func ErrorMessageBadInput(collationID string, message string) *Envelope {
 	return ErrorMessage(collationID, BAD_INPUT, message)
 }
 
+// ErrorMessageValidation reports field-level validation errors, so clients can show them all at once.
+func ErrorMessageValidation(collationID string, fields map[string]string) *Envelope {
+	return &Envelope{
+		CollationId: collationID,
+		Payload: &Envelope_Error{&Error{
+			Message: "Validation failed",
+			Code:    int32(BAD_INPUT),
+			Fields:  fields,
+		}}}
+}
+
 func ErrorMessage(collationID string, code Error_Code, message string) *Envelope {
 	return &Envelope{
 		CollationId: collationID,
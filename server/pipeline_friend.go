@@ -277,6 +277,10 @@ func (p *pipeline) friendAddById(l *zap.Logger, session *session, envelope *Enve
 		return
 	}
 
+	if !p.friendRequestCheck(logger, session, envelope, friendID) {
+		return
+	}
+
 	if err := friendAdd(logger, p.db, session.userID.Bytes(), friendID.Bytes()); err != nil {
 		logger.Error("Could not add friend", zap.Error(err))
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Failed to add friend"))
@@ -294,7 +298,18 @@ func (p *pipeline) friendAddByHandle(l *zap.Logger, session *session, envelope *
 	}
 
 	logger := l.With(zap.String("friend_handle", friendHandle))
-	if err := friendAddHandle(logger, p.db, session.userID.Bytes(), friendHandle); err != nil {
+	friendIDBytes, err := friendIDByHandle(p.db, friendHandle)
+	if err != nil {
+		logger.Error("Could not add friend", zap.Error(err))
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Failed to add friend"))
+		return
+	}
+
+	if !p.friendRequestCheck(logger, session, envelope, uuid.FromBytesOrNil(friendIDBytes)) {
+		return
+	}
+
+	if err := friendAdd(logger, p.db, session.userID.Bytes(), friendIDBytes); err != nil {
 		logger.Error("Could not add friend", zap.Error(err))
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Failed to add friend"))
 		return
@@ -304,6 +319,43 @@ func (p *pipeline) friendAddByHandle(l *zap.Logger, session *session, envelope *
 	session.Send(&Envelope{CollationId: envelope.CollationId})
 }
 
+// friendRequestCheck runs the runtime friend request function, and reports whether to go on adding the friend. Dropped
+// requests are answered as if they succeeded, so the sender cannot tell they were stopped. Accepting an invite the
+// friend already sent is not a request, the function is not run and the friend's request count is left alone.
+func (p *pipeline) friendRequestCheck(logger *zap.Logger, session *session, envelope *Envelope, friendID uuid.UUID) bool {
+	if !p.runtime.IsRuntimeFriendRequestRegistered() {
+		return true
+	}
+	var invited bool
+	err := p.db.QueryRow("SELECT EXISTS (SELECT source_id FROM user_edge WHERE source_id = $1 AND destination_id = $2 AND state = 2)",
+		friendID.Bytes(), session.userID.Bytes()).Scan(&invited)
+	if err != nil {
+		logger.Error("Could not check for a friend invite", zap.Error(err))
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not add friend"))
+		return false
+	} else if invited {
+		return true
+	}
+
+	action, err := RuntimeFriendRequestHook(logger, p.runtime, session.userID, session.handle.Load(), session.expiry, friendID)
+	if err != nil {
+		logger.Error("Runtime friend request function caused an error", zap.Error(err))
+		session.Send(ErrorMessage(envelope.CollationId, RUNTIME_FUNCTION_EXCEPTION, fmt.Sprintf("Runtime friend request function caused an error: %s", err.Error())))
+		return false
+	}
+	switch action {
+	case FRIEND_REQUEST_REJECT:
+		logger.Info("Friend request rejected")
+		session.Send(ErrorMessage(envelope.CollationId, FRIEND_REQUEST_REJECTED, "Friend request rejected"))
+		return false
+	case FRIEND_REQUEST_DROP:
+		logger.Info("Friend request dropped")
+		session.Send(&Envelope{CollationId: envelope.CollationId})
+		return false
+	}
+	return true
+}
+
 func (p *pipeline) friendRemove(l *zap.Logger, session *session, envelope *Envelope) {
 	e := envelope.GetFriendsRemove()
 
@@ -182,6 +182,10 @@ func (p *pipeline) groupCreate(logger *zap.Logger, session *session, envelope *E
 			session.Send(ErrorMessageBadInput(envelope.CollationId, "Metadata must be a valid JSON object"))
 			return
 		}
+		if !validGroupMaxCount(maybeJSON) {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Metadata max_count must be a positive number"))
+			return
+		}
 
 		columns = append(columns, "metadata")
 		params = append(params, "$"+strconv.Itoa(len(values)))
@@ -242,9 +246,27 @@ func (p *pipeline) groupUpdate(l *zap.Logger, session *session, envelope *Envelo
 		session.Send(ErrorMessageBadInput(envelope.CollationId, "Metadata must be a valid JSON object"))
 		return
 	}
+	if !validGroupMaxCount(maybeJSON) {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Metadata max_count must be a positive number"))
+		return
+	}
 
 	logger := l.With(zap.String("group_id", groupID.String()))
 
+	// An update replaces the metadata, keep the group's member limit unless a before hook set a new one.
+	var storedMetadata []byte
+	err = p.db.QueryRow("SELECT metadata FROM groups WHERE id = $1", groupID.Bytes()).Scan(&storedMetadata)
+	if err != nil && err != sql.ErrNoRows {
+		logger.Error("Could not read group metadata", zap.Error(err))
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not update group"))
+		return
+	}
+	metadata, err := GroupMetadataKeepMaxCount(g.Metadata, storedMetadata)
+	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Metadata must be a valid JSON object"))
+		return
+	}
+
 	statements := make([]string, 6)
 	params := make([]interface{}, 8)
 
@@ -264,7 +286,7 @@ func (p *pipeline) groupUpdate(l *zap.Logger, session *session, envelope *Envelo
 	params[5] = g.Lang
 
 	statements[4] = "metadata = $7"
-	params[6] = g.Metadata
+	params[6] = metadata
 
 	statements[5] = "state = $8"
 	params[7] = 0
@@ -538,6 +560,7 @@ LIMIT $` + strconv.Itoa(len(params))
 		}
 		groups = append(groups, lastGroup)
 	}
+	groups = RuntimeGroupsListHook(logger, p.runtime, session, groups)
 
 	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_Groups{Groups: &TGroups{
 		Groups: groups,
@@ -672,13 +695,18 @@ func (p *pipeline) groupJoin(l *zap.Logger, session *session, envelope *Envelope
 	}
 	defer func() {
 		if err != nil {
+			groupFull := err == ErrGroupFull
 			logger.Error("Could not join group", zap.Error(err))
 			err = tx.Rollback()
 			if err != nil {
 				logger.Error("Could not rollback transaction", zap.Error(err))
 			}
 
-			session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not join group"))
+			if groupFull {
+				session.Send(ErrorMessage(envelope.CollationId, GROUP_FULL, "Could not join group, group is full"))
+			} else {
+				session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not join group"))
+			}
 		} else {
 			err = tx.Commit()
 			if err != nil {
@@ -696,14 +724,13 @@ func (p *pipeline) groupJoin(l *zap.Logger, session *session, envelope *Envelope
 		}
 	}()
 
-	var groupState sql.NullInt64
-	err = tx.QueryRow("SELECT state FROM groups WHERE id = $1 AND disabled_at = 0", groupID.Bytes()).Scan(&groupState)
+	groupState, err := GroupCheckCapacity(tx, groupID.Bytes())
 	if err != nil {
 		return
 	}
 
 	userState := 1
-	if groupState.Int64 == 1 {
+	if groupState == 1 {
 		userState = 2
 	}
 
@@ -723,7 +750,7 @@ VALUES ($1, $2, $2, $3, $4), ($3, $2, $2, $1, $4)`,
 		return
 	}
 
-	if groupState.Int64 == 0 {
+	if groupState == 0 {
 		_, err = tx.Exec("UPDATE groups SET count = count + 1, updated_at = $2 WHERE id = $1", groupID.Bytes(), updatedAt)
 	}
 	if err != nil {
@@ -883,6 +910,7 @@ func (p *pipeline) groupUserAdd(l *zap.Logger, session *session, envelope *Envel
 	}
 	defer func() {
 		if err != nil {
+			groupFull := err == ErrGroupFull
 			if _, ok := err.(*pq.Error); ok {
 				logger.Error("Could not add user to group", zap.Error(err))
 			} else {
@@ -893,7 +921,11 @@ func (p *pipeline) groupUserAdd(l *zap.Logger, session *session, envelope *Envel
 				logger.Error("Could not rollback transaction", zap.Error(err))
 			}
 
-			session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not add user to group"))
+			if groupFull {
+				session.Send(ErrorMessage(envelope.CollationId, GROUP_FULL, "Could not add user to group, group is full"))
+			} else {
+				session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not add user to group"))
+			}
 		} else {
 			err = tx.Commit()
 			if err != nil {
@@ -918,6 +950,10 @@ func (p *pipeline) groupUserAdd(l *zap.Logger, session *session, envelope *Envel
 		return
 	}
 
+	if _, err = GroupCheckCapacity(tx, groupID.Bytes()); err != nil {
+		return
+	}
+
 	res, err := tx.Exec(`
 INSERT INTO group_edge (source_id, position, updated_at, destination_id, state)
 SELECT data.id, data.position, data.updated_at, data.destination, data.state
@@ -1132,3 +1168,18 @@ AND
 
 	session.Send(&Envelope{CollationId: envelope.CollationId})
 }
+
+// groupStripMaxCount removes member limits from the group metadata in a client's create or update message, before any
+// runtime before hook sees it.
+func groupStripMaxCount(envelope *Envelope) {
+	switch e := envelope.Payload.(type) {
+	case *Envelope_GroupsCreate:
+		for _, g := range e.GroupsCreate.Groups {
+			g.Metadata = GroupMetadataStripMaxCount(g.Metadata)
+		}
+	case *Envelope_GroupsUpdate:
+		for _, g := range e.GroupsUpdate.Groups {
+			g.Metadata = GroupMetadataStripMaxCount(g.Metadata)
+		}
+	}
+}
@@ -38,6 +38,7 @@ type leaderboardRecordFetchCursor struct {
 
 type leaderboardRecordListCursor struct {
 	Score     int64
+	TieBreak  int64
 	UpdatedAt int64
 	Id        []byte
 }
@@ -267,14 +268,40 @@ func (p *pipeline) leaderboardRecordWrite(logger *zap.Logger, session *session,
 			DO UPDATE SET handle = $4, lang = $5, location = COALESCE($6, leaderboard_record.location),
 			  timezone = COALESCE($7, leaderboard_record.timezone), ` + scoreOpSql + `, num_score = leaderboard_record.num_score + 1,
 			  metadata = COALESCE($11, leaderboard_record.metadata), updated_at = $13`
+	tx, err := p.db.Begin()
+	if err != nil {
+		logger.Error("Could not begin leaderboard record write transaction", zap.Error(err))
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Error writing leaderboard record"))
+		return
+	}
+
+	// The record as it was before the write is only needed by the runtime tie-break function.
+	var previous *LeaderboardRecord
+	tieBreak := p.runtime.IsRuntimeLeaderboardTieBreakRegistered()
+	if tieBreak {
+		previous = &LeaderboardRecord{}
+		err = tx.QueryRow("SELECT score, num_score, updated_at FROM leaderboard_record WHERE leaderboard_id = $1 AND expires_at = $2 AND owner_id = $3",
+			incoming.LeaderboardId, expiresAt, session.userID.Bytes()).Scan(&previous.Score, &previous.NumScore, &previous.UpdatedAt)
+		if err == sql.ErrNoRows {
+			previous = nil
+		} else if err != nil {
+			tx.Rollback()
+			logger.Error("Could not execute leaderboard record previous read query", zap.Error(err))
+			session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Error writing leaderboard record"))
+			return
+		}
+	}
+
 	logger.Debug("Leaderboard record write", zap.String("query", query))
-	res, err := p.db.Exec(query, params...)
+	res, err := tx.Exec(query, params...)
 	if err != nil {
+		tx.Rollback()
 		logger.Error("Could not execute leaderboard record write query", zap.Error(err))
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Error writing leaderboard record"))
 		return
 	}
 	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		tx.Rollback()
 		logger.Error("Unexpected row count from leaderboard record write query")
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Error writing leaderboard record"))
 		return
@@ -294,36 +321,86 @@ func (p *pipeline) leaderboardRecordWrite(logger *zap.Logger, session *session,
 		AND expires_at = $2
 		AND owner_id = $3`
 	logger.Debug("Leaderboard record read", zap.String("query", query))
-	err = p.db.QueryRow(query, incoming.LeaderboardId, expiresAt, session.userID.Bytes()).
+	err = tx.QueryRow(query, incoming.LeaderboardId, expiresAt, session.userID.Bytes()).
 		Scan(&location, &timezone, &rankValue, &score, &numScore, &metadata, &rankedAt, &bannedAt)
 	if err != nil {
+		tx.Rollback()
 		logger.Error("Could not execute leaderboard record read query", zap.Error(err))
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Error writing leaderboard record"))
 		return
 	}
 
+	record := &LeaderboardRecord{
+		LeaderboardId: incoming.LeaderboardId,
+		OwnerId:       session.userID.Bytes(),
+		Handle:        handle,
+		Lang:          session.lang,
+		Location:      location.String,
+		Timezone:      timezone.String,
+		Rank:          rankValue,
+		Score:         score,
+		NumScore:      numScore,
+		Metadata:      metadata,
+		RankedAt:      rankedAt,
+		UpdatedAt:     updatedAt,
+		ExpiresAt:     expiresAt,
+	}
+	if err = leaderboardAggregateUpdate(tx, incoming.LeaderboardId, session.userID.Bytes()); err != nil {
+		tx.Rollback()
+		logger.Error("Could not execute aggregate leaderboard record update", zap.Error(err))
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Error writing leaderboard record"))
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		logger.Error("Could not commit leaderboard record write transaction", zap.Error(err))
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Error writing leaderboard record"))
+		return
+	}
+	if tieBreak {
+		leaderboardTieBreakUpdate(logger, p.runtime, p.db, &leaderboardTieBreak{sortOrder: sortOrder, record: record, previous: previous})
+	}
+
 	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_LeaderboardRecords{
 		LeaderboardRecords: &TLeaderboardRecords{
-			Records: []*LeaderboardRecord{
-				&LeaderboardRecord{
-					LeaderboardId: incoming.LeaderboardId,
-					OwnerId:       session.userID.Bytes(),
-					Handle:        handle,
-					Lang:          session.lang,
-					Location:      location.String,
-					Timezone:      timezone.String,
-					Rank:          rankValue,
-					Score:         score,
-					NumScore:      numScore,
-					Metadata:      metadata,
-					RankedAt:      rankedAt,
-					UpdatedAt:     updatedAt,
-					ExpiresAt:     expiresAt,
-				},
-			},
+			Records: []*LeaderboardRecord{record},
 			// No cursor.
 		},
 	}})
+	StreamLeaderboardRecord(logger, p.runtime, p.tracker, p.messageRouter, record)
+}
+
+func (p *pipeline) leaderboardsSubscribe(logger *zap.Logger, session *session, envelope *Envelope) {
+	p.leaderboardsStream(logger, session, envelope, envelope.GetLeaderboardsSubscribe().LeaderboardIds, true)
+}
+
+func (p *pipeline) leaderboardsUnsubscribe(logger *zap.Logger, session *session, envelope *Envelope) {
+	p.leaderboardsStream(logger, session, envelope, envelope.GetLeaderboardsUnsubscribe().LeaderboardIds, false)
+}
+
+// leaderboardsStream subscribes the session to, or unsubscribes it from, the record updates of the given leaderboards.
+func (p *pipeline) leaderboardsStream(logger *zap.Logger, session *session, envelope *Envelope, leaderboardIDs [][]byte, subscribe bool) {
+	if len(leaderboardIDs) == 0 {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "At least one leaderboard ID must be present"))
+		return
+	}
+
+	streams := make([]*StreamDescriptor, 0, len(leaderboardIDs))
+	for _, leaderboardID := range leaderboardIDs {
+		stream := &StreamDescriptor{Mode: "leaderboard", Subject: string(leaderboardID)}
+		// Check every ID first, so an invalid one leaves the session's subscriptions as they were.
+		if _, err := stream.Topic(); err != nil {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, err.Error()))
+			return
+		}
+		streams = append(streams, stream)
+	}
+	directive := &StreamDirective{Leave: streams}
+	if subscribe {
+		directive = &StreamDirective{Join: streams}
+	}
+	StreamDirectiveApply(p.tracker, session.id, session.userID, session.handle.Load(), directive)
+
+	session.Send(&Envelope{CollationId: envelope.CollationId})
 }
 
 func (p *pipeline) leaderboardRecordsFetch(logger *zap.Logger, session *session, envelope *Envelope) {
@@ -502,7 +579,7 @@ func (p *pipeline) leaderboardRecordsList(logger *zap.Logger, session *session,
 	}
 
 	query = `SELECT id, owner_id, handle, lang, location, timezone,
-	  rank_value, score, num_score, metadata, ranked_at, updated_at, expires_at, banned_at
+	  rank_value, score, num_score, metadata, ranked_at, updated_at, expires_at, banned_at, tie_break
 	FROM leaderboard_record
 	WHERE leaderboard_id = $1
 	AND expires_at = $2`
@@ -556,25 +633,28 @@ func (p *pipeline) leaderboardRecordsList(logger *zap.Logger, session *session,
 		count := len(params)
 		if sortOrder == 0 {
 			// Ascending leaderboard.
-			query += " AND (score, updated_at, id) > ($" + strconv.Itoa(count) +
-				", $" + strconv.Itoa(count+1) +
-				", $" + strconv.Itoa(count+2) + ")"
-			params = append(params, incomingCursor.Score, incomingCursor.UpdatedAt, incomingCursor.Id)
+			query += " AND (score, tie_break, updated_at, id) > ($" + strconv.Itoa(count+1) +
+				", $" + strconv.Itoa(count+2) +
+				", $" + strconv.Itoa(count+3) +
+				", $" + strconv.Itoa(count+4) + ")"
+			params = append(params, incomingCursor.Score, incomingCursor.TieBreak, incomingCursor.UpdatedAt, incomingCursor.Id)
 		} else {
 			// Descending leaderboard.
-			query += " AND (score, updated_at_inverse, id) < ($" + strconv.Itoa(count) +
-				", $" + strconv.Itoa(count+1) +
-				", $" + strconv.Itoa(count+2) + ")"
-			params = append(params, incomingCursor.Score, invertMs(incomingCursor.UpdatedAt), incomingCursor.Id)
+			query += " AND (score, tie_break, updated_at_inverse, id) < ($" + strconv.Itoa(count+1) +
+				", $" + strconv.Itoa(count+2) +
+				", $" + strconv.Itoa(count+3) +
+				", $" + strconv.Itoa(count+4) + ")"
+			params = append(params, incomingCursor.Score, incomingCursor.TieBreak, invertMs(incomingCursor.UpdatedAt), incomingCursor.Id)
 		}
 	}
 
+	// Stored tie-break keys follow the direction of the score.
 	if sortOrder == 0 {
 		// Ascending leaderboard, lower score is better.
-		query += " ORDER BY score ASC, updated_at ASC"
+		query += " ORDER BY score ASC, tie_break ASC, updated_at ASC"
 	} else {
 		// Descending leaderboard, higher score is better.
-		query += " ORDER BY score DESC, updated_at_inverse DESC"
+		query += " ORDER BY score DESC, tie_break DESC, updated_at_inverse DESC"
 	}
 
 	params = append(params, limit+1)
@@ -606,11 +686,13 @@ func (p *pipeline) leaderboardRecordsList(logger *zap.Logger, session *session,
 	var updatedAt int64
 	var expiresAt int64
 	var bannedAt int64
+	var tieBreak int64
 	for rows.Next() {
 		if returnCursor && int64(len(leaderboardRecords)) >= limit {
 			cursorBuf := new(bytes.Buffer)
 			newCursor := &leaderboardRecordListCursor{
 				Score:     score,
+				TieBreak:  tieBreak,
 				UpdatedAt: updatedAt,
 				Id:        id,
 			}
@@ -624,7 +706,7 @@ func (p *pipeline) leaderboardRecordsList(logger *zap.Logger, session *session,
 		}
 
 		err = rows.Scan(&id, &ownerId, &handle, &lang, &location, &timezone,
-			&rankValue, &score, &numScore, &metadata, &rankedAt, &updatedAt, &expiresAt, &bannedAt)
+			&rankValue, &score, &numScore, &metadata, &rankedAt, &updatedAt, &expiresAt, &bannedAt, &tieBreak)
 		if err != nil {
 			logger.Error("Could not scan leaderboard records list query results", zap.Error(err))
 			session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Error loading leaderboard records"))
@@ -660,14 +742,15 @@ func (p *pipeline) loadLeaderboardRecordsHaystack(logger *zap.Logger, session *s
 	// Find the owner's record.
 	var id []byte
 	var score int64
+	var tieBreak int64
 	var updatedAt int64
-	findQuery := `SELECT id, score, updated_at
+	findQuery := `SELECT id, score, tie_break, updated_at
 		FROM leaderboard_record
 		WHERE leaderboard_id = $1
 		AND expires_at = $2
 		AND owner_id = $3`
 	logger.Debug("Leaderboard record find", zap.String("query", findQuery))
-	err := p.db.QueryRow(findQuery, leaderboardId, currentExpiresAt, findOwnerId).Scan(&id, &score, &updatedAt)
+	err := p.db.QueryRow(findQuery, leaderboardId, currentExpiresAt, findOwnerId).Scan(&id, &score, &tieBreak, &updatedAt)
 	if err != nil {
 		// TODO handle errors other than record not found?
 		session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_LeaderboardRecords{LeaderboardRecords: &TLeaderboardRecords{
@@ -684,16 +767,18 @@ func (p *pipeline) loadLeaderboardRecordsHaystack(logger *zap.Logger, session *s
 	copy(firstParams, params)
 	if sortOrder == 0 {
 		// Lower score is better, but get in reverse order from current user to get those immediately above.
-		firstQuery += " AND (score, updated_at_inverse, id) <= ($" + strconv.Itoa(count+1) +
+		firstQuery += " AND (score, tie_break, updated_at_inverse, id) <= ($" + strconv.Itoa(count+1) +
 			", $" + strconv.Itoa(count+2) +
-			", $" + strconv.Itoa(count+3) + ") ORDER BY score DESC, updated_at_inverse DESC"
-		firstParams = append(firstParams, score, invertMs(updatedAt), id)
+			", $" + strconv.Itoa(count+3) +
+			", $" + strconv.Itoa(count+4) + ") ORDER BY score DESC, tie_break DESC, updated_at_inverse DESC"
+		firstParams = append(firstParams, score, tieBreak, invertMs(updatedAt), id)
 	} else {
 		// Higher score is better.
-		firstQuery += " AND (score, updated_at, id) >= ($" + strconv.Itoa(count+1) +
+		firstQuery += " AND (score, tie_break, updated_at, id) >= ($" + strconv.Itoa(count+1) +
 			", $" + strconv.Itoa(count+2) +
-			", $" + strconv.Itoa(count+3) + ") ORDER BY score ASC, updated_at ASC"
-		firstParams = append(firstParams, score, updatedAt, id)
+			", $" + strconv.Itoa(count+3) +
+			", $" + strconv.Itoa(count+4) + ") ORDER BY score ASC, tie_break ASC, updated_at ASC"
+		firstParams = append(firstParams, score, tieBreak, updatedAt, id)
 	}
 	firstParams = append(firstParams, int64(limit/2))
 	firstQuery += " LIMIT $" + strconv.Itoa(len(firstParams))
@@ -722,7 +807,7 @@ func (p *pipeline) loadLeaderboardRecordsHaystack(logger *zap.Logger, session *s
 	var bannedAt int64
 	for firstRows.Next() {
 		err = firstRows.Scan(&id, &ownerId, &handle, &lang, &location, &timezone,
-			&rankValue, &score, &numScore, &metadata, &rankedAt, &updatedAt, &expiresAt, &bannedAt)
+			&rankValue, &score, &numScore, &metadata, &rankedAt, &updatedAt, &expiresAt, &bannedAt, &tieBreak)
 		if err != nil {
 			logger.Error("Could not scan leaderboard records list query results", zap.Error(err))
 			session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Error loading leaderboard records"))
@@ -762,16 +847,18 @@ func (p *pipeline) loadLeaderboardRecordsHaystack(logger *zap.Logger, session *s
 	copy(secondParams, params)
 	if sortOrder == 0 {
 		// Lower score is better.
-		secondQuery += " AND (score, updated_at, id) > ($" + strconv.Itoa(count+1) +
+		secondQuery += " AND (score, tie_break, updated_at, id) > ($" + strconv.Itoa(count+1) +
 			", $" + strconv.Itoa(count+2) +
-			", $" + strconv.Itoa(count+3) + ") ORDER BY score ASC, updated_at ASC"
-		secondParams = append(secondParams, score, updatedAt, id)
+			", $" + strconv.Itoa(count+3) +
+			", $" + strconv.Itoa(count+4) + ") ORDER BY score ASC, tie_break ASC, updated_at ASC"
+		secondParams = append(secondParams, score, tieBreak, updatedAt, id)
 	} else {
 		// Higher score is better.
-		secondQuery += " AND (score, updated_at_inverse, id) < ($" + strconv.Itoa(count+1) +
+		secondQuery += " AND (score, tie_break, updated_at_inverse, id) < ($" + strconv.Itoa(count+1) +
 			", $" + strconv.Itoa(count+2) +
-			", $" + strconv.Itoa(count+3) + ") ORDER BY score DESC, updated_at DESC"
-		secondParams = append(secondParams, score, invertMs(updatedAt), id)
+			", $" + strconv.Itoa(count+3) +
+			", $" + strconv.Itoa(count+4) + ") ORDER BY score DESC, tie_break DESC, updated_at_inverse DESC"
+		secondParams = append(secondParams, score, tieBreak, invertMs(updatedAt), id)
 	}
 	secondParams = append(secondParams, limit-int64(len(leaderboardRecords))+2)
 	secondQuery += " LIMIT $" + strconv.Itoa(len(secondParams))
@@ -792,6 +879,7 @@ func (p *pipeline) loadLeaderboardRecordsHaystack(logger *zap.Logger, session *s
 			cursorBuf := new(bytes.Buffer)
 			newCursor := &leaderboardRecordListCursor{
 				Score:     score,
+				TieBreak:  tieBreak,
 				UpdatedAt: updatedAt,
 				Id:        id,
 			}
@@ -805,7 +893,7 @@ func (p *pipeline) loadLeaderboardRecordsHaystack(logger *zap.Logger, session *s
 		}
 
 		err = secondRows.Scan(&id, &ownerId, &handle, &lang, &location, &timezone,
-			&rankValue, &score, &numScore, &metadata, &rankedAt, &updatedAt, &expiresAt, &bannedAt)
+			&rankValue, &score, &numScore, &metadata, &rankedAt, &updatedAt, &expiresAt, &bannedAt, &tieBreak)
 		if err != nil {
 			logger.Error("Could not scan leaderboard records list query results", zap.Error(err))
 			session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Error loading leaderboard records"))
@@ -849,6 +937,7 @@ func (p *pipeline) normalizeAndSendLeaderboardRecords(logger *zap.Logger, sessio
 			records[i].Rank = bestRank + i
 		}
 	}
+	RuntimeLeaderboardRecordsHook(logger, p.runtime, p.db, session, records)
 
 	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_LeaderboardRecords{LeaderboardRecords: &TLeaderboardRecords{
 		Records: records,
@@ -15,7 +15,9 @@
 package server
 
 import (
+	"encoding/json"
 	"fmt"
+	"strings"
 	"unicode/utf8"
 
 	"github.com/dgrijalva/jwt-go"
@@ -29,18 +31,66 @@ type matchDataFilter struct {
 }
 
 func (p *pipeline) matchCreate(logger *zap.Logger, session *session, envelope *Envelope) {
-	matchID := uuid.NewV4()
+	e := envelope.GetMatchCreate()
+
+	var params map[string]interface{}
+	if len(e.Params) != 0 {
+		if e.Module == "" {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Match params are only used with a match module"))
+			return
+		}
+		if err := json.Unmarshal(e.Params, &params); err != nil {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Match params must be a JSON object"))
+			return
+		}
+	}
+	if e.Module != "" && p.runtime.GetRuntimeMatch(e.Module) == nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Match module not found"))
+		return
+	}
 
 	handle := session.handle.Load()
 
+	// The runtime may reject the requested configuration, or replace it with the one the match is created with.
+	params, err := RuntimeMatchCreateHook(logger, p.runtime, session.userID, handle, session.expiry, e.Module, params)
+	if rejected, ok := err.(*MatchCreateRejectedError); ok {
+		session.Send(ErrorMessage(envelope.CollationId, MATCH_CREATE_REJECTED, rejected.Error()))
+		return
+	} else if err != nil {
+		logger.Error("Runtime match create function caused an error", zap.Error(err))
+		session.Send(ErrorMessage(envelope.CollationId, RUNTIME_FUNCTION_EXCEPTION, fmt.Sprintf("Runtime match create function caused an error: %s", err.Error())))
+		return
+	}
+
+	if e.Module != "" {
+		matchID, err := p.clientMatches.Create(p.runtime, e.Module, params)
+		if err == ErrClientMatchCreateDisabled || err == ErrClientMatchesFull {
+			session.Send(ErrorMessage(envelope.CollationId, MATCH_CREATE_REJECTED, err.Error()))
+			return
+		} else if err != nil {
+			logger.Error("Could not create match", zap.String("module", e.Module), zap.Error(err))
+			session.Send(ErrorMessageRuntimeException(envelope.CollationId, fmt.Sprintf("Could not create match: %s", err.Error())))
+			return
+		}
+		session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_Match{Match: &TMatch{Match: &Match{
+			MatchId:   uuid.FromStringOrNil(matchID).Bytes(),
+			Presences: []*UserPresence{},
+		}}}})
+		return
+	}
+
+	matchID := uuid.NewV4()
+
 	p.tracker.Track(session.id, "match:"+matchID.String(), session.userID, PresenceMeta{
 		Handle: handle,
+		Region: session.region,
 	})
 
 	self := &UserPresence{
 		UserId:    session.userID.Bytes(),
 		SessionId: session.id.Bytes(),
 		Handle:    handle,
+		Region:    []byte(session.region),
 	}
 
 	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_Match{Match: &TMatch{Match: &Match{
@@ -115,16 +165,81 @@ func (p *pipeline) matchJoin(logger *zap.Logger, session *session, envelope *Env
 	topic := "match:" + matchID.String()
 
 	ps := p.tracker.ListByTopic(topic)
-	if !allowEmpty && len(ps) == 0 {
+	// Authoritative matches may be joined before any other presence is in them.
+	if !allowEmpty && len(ps) == 0 && p.matchRegistry.Get(matchID) == nil {
 		session.Send(ErrorMessage(envelope.CollationId, MATCH_NOT_FOUND, "Match not found"))
 		return
 	}
 
+	if p.runtime.IsMatchDataKicked(matchID, session.userID) {
+		session.Send(ErrorMessage(envelope.CollationId, MATCH_JOIN_REJECTED, "Removed from the match, rejoining is not allowed yet"))
+		return
+	}
+
 	handle := session.handle.Load()
 
-	p.tracker.Track(session.id, topic, session.userID, PresenceMeta{
-		Handle: handle,
-	})
+	// Joins in progress reserve their match until they are tracked in it, so simultaneous joins from several sessions
+	// cannot all slip under the limit. The lock is only held to count and reserve, never while the runtime runs.
+	matchLimit := p.config.GetMatchmaker().MaxUserMatches
+	p.matchJoinMutex.Lock()
+	matchCount := p.userMatchCount(session.userID, topic)
+	if matchLimit > 0 && matchCount >= matchLimit {
+		p.matchJoinMutex.Unlock()
+		session.Send(ErrorMessage(envelope.CollationId, MATCH_JOIN_REJECTED, fmt.Sprintf("Already in the most matches allowed at once: %d", matchLimit)))
+		return
+	}
+	p.reserveMatchJoin(session.userID, topic)
+	p.matchJoinMutex.Unlock()
+	defer p.releaseMatchJoin(session.userID, topic)
+
+	// The runtime may tag the presence with metadata other match members and the match module will see.
+	metadata, fnErr := RuntimeMatchJoinHookWithCount(logger, p.runtime, session.userID, session.id, handle, session.expiry, matchID, matchCount, matchLimit)
+	if fnErr == ErrMatchJoinRejected {
+		session.Send(ErrorMessage(envelope.CollationId, MATCH_JOIN_REJECTED, "Match join rejected"))
+		return
+	} else if fnErr != nil {
+		logger.Error("Runtime match join function caused an error", zap.Error(fnErr))
+		session.Send(ErrorMessage(envelope.CollationId, RUNTIME_FUNCTION_EXCEPTION, fmt.Sprintf("Runtime match join function caused an error: %s", fnErr.Error())))
+		return
+	}
+
+	meta := PresenceMeta{
+		Handle:   handle,
+		Metadata: metadata,
+		Region:   session.region,
+	}
+
+	// Authoritative matches decide the role each presence joins in, and turn away joins to roles with no free places.
+	if mh := p.matchRegistry.Get(matchID); mh != nil {
+		presence := Presence{
+			ID:     PresenceID{Node: p.config.GetName(), SessionID: session.id},
+			Topic:  topic,
+			UserID: session.userID,
+			Meta:   meta,
+		}
+		meta.Role, err = mh.JoinAttempt(presence, m.Role)
+		switch err {
+		case nil:
+		case ErrMatchJoinRejected:
+			session.Send(ErrorMessage(envelope.CollationId, MATCH_JOIN_REJECTED, "Match join rejected"))
+			return
+		case ErrMatchFull:
+			session.Send(ErrorMessage(envelope.CollationId, MATCH_JOIN_REJECTED, "Match is full"))
+			return
+		case ErrMatchRoleInvalid:
+			session.Send(ErrorMessage(envelope.CollationId, MATCH_JOIN_REJECTED, "Match role is not valid"))
+			return
+		case ErrMatchNotFound:
+			session.Send(ErrorMessage(envelope.CollationId, MATCH_NOT_FOUND, "Match not found"))
+			return
+		default:
+			logger.Error("Match join attempt function caused an error", zap.Error(err))
+			session.Send(ErrorMessage(envelope.CollationId, RUNTIME_FUNCTION_EXCEPTION, fmt.Sprintf("Match join attempt function caused an error: %s", err.Error())))
+			return
+		}
+	}
+
+	p.tracker.Track(session.id, topic, session.userID, meta)
 
 	userPresences := make([]*UserPresence, len(ps)+1)
 	for i := 0; i < len(ps); i++ {
@@ -133,12 +248,18 @@ func (p *pipeline) matchJoin(logger *zap.Logger, session *session, envelope *Env
 			UserId:    p.UserID.Bytes(),
 			SessionId: p.ID.SessionID.Bytes(),
 			Handle:    p.Meta.Handle,
+			Metadata:  []byte(p.Meta.Metadata),
+			Region:    []byte(p.Meta.Region),
+			Role:      p.Meta.Role,
 		}
 	}
 	self := &UserPresence{
 		UserId:    session.userID.Bytes(),
 		SessionId: session.id.Bytes(),
 		Handle:    handle,
+		Metadata:  []byte(metadata),
+		Region:    []byte(session.region),
+		Role:      meta.Role,
 	}
 	userPresences[len(ps)] = self
 
@@ -153,6 +274,46 @@ func (p *pipeline) matchJoin(logger *zap.Logger, session *session, envelope *Env
 	}}})
 }
 
+// userMatchCount returns how many matches other than the given one the user is in or is joining, across all their
+// sessions. Callers must hold the match join lock.
+func (p *pipeline) userMatchCount(userID uuid.UUID, exceptTopic string) int {
+	topics := make(map[string]bool)
+	for _, presence := range p.tracker.ListByUser(userID) {
+		if strings.HasPrefix(presence.Topic, "match:") && presence.Topic != exceptTopic {
+			topics[presence.Topic] = true
+		}
+	}
+	for topic := range p.matchJoinPending[userID] {
+		if topic != exceptTopic {
+			topics[topic] = true
+		}
+	}
+	return len(topics)
+}
+
+// reserveMatchJoin counts a join in progress towards the user's matches. Callers must hold the match join lock.
+func (p *pipeline) reserveMatchJoin(userID uuid.UUID, topic string) {
+	pending, ok := p.matchJoinPending[userID]
+	if !ok {
+		pending = make(map[string]int)
+		p.matchJoinPending[userID] = pending
+	}
+	pending[topic]++
+}
+
+// releaseMatchJoin drops the reservation of a join once it is tracked or has failed.
+func (p *pipeline) releaseMatchJoin(userID uuid.UUID, topic string) {
+	p.matchJoinMutex.Lock()
+	pending := p.matchJoinPending[userID]
+	if pending[topic]--; pending[topic] <= 0 {
+		delete(pending, topic)
+		if len(pending) == 0 {
+			delete(p.matchJoinPending, userID)
+		}
+	}
+	p.matchJoinMutex.Unlock()
+}
+
 func (p *pipeline) matchLeave(logger *zap.Logger, session *session, envelope *Envelope) {
 	e := envelope.GetMatchesLeave()
 
@@ -230,6 +391,7 @@ func (p *pipeline) matchDataSend(logger *zap.Logger, session *session, envelope
 	}
 
 	senderFound := false
+	var senderMeta PresenceMeta
 	for i := 0; i < len(ps); i++ {
 		p := ps[i]
 		if p.ID.SessionID == session.id && p.UserID == session.userID {
@@ -237,6 +399,7 @@ func (p *pipeline) matchDataSend(logger *zap.Logger, session *session, envelope
 			ps[i] = ps[len(ps)-1]
 			ps = ps[:len(ps)-1]
 			senderFound = true
+			senderMeta = p.Meta
 			if !filterPresences {
 				break
 			} else {
@@ -268,6 +431,23 @@ func (p *pipeline) matchDataSend(logger *zap.Logger, session *session, envelope
 		return
 	}
 
+	RuntimeMatchDataHook(logger, p.runtime, p.tracker, session, matchID, incoming.OpCode, incoming.Data)
+
+	// Authoritative matches receive all match data, the match module decides what to relay.
+	if mh := p.matchRegistry.Get(matchID); mh != nil {
+		// The sender's tracked meta carries the role and metadata the match assigned when it joined.
+		meta := senderMeta
+		meta.Handle = session.handle.Load()
+		meta.Region = session.region
+		mh.Data(Presence{
+			ID:     PresenceID{Node: p.config.GetName(), SessionID: session.id},
+			Topic:  topic,
+			UserID: session.userID,
+			Meta:   meta,
+		}, incoming.OpCode, incoming.Data)
+		return
+	}
+
 	// Check if there are any recipients left.
 	if len(ps) == 0 {
 		return
@@ -281,6 +461,8 @@ func (p *pipeline) matchDataSend(logger *zap.Logger, session *session, envelope
 					UserId:    session.userID.Bytes(),
 					SessionId: session.id.Bytes(),
 					Handle:    session.handle.Load(),
+					Metadata:  []byte(senderMeta.Metadata),
+					Region:    []byte(session.region),
 				},
 				OpCode: incoming.OpCode,
 				Data:   incoming.Data,
@@ -13,8 +13,20 @@ func (p *pipeline) matchmakeAdd(logger *zap.Logger, session *session, envelope *
 		session.Send(ErrorMessageBadInput(envelope.CollationId, "Required count must be >= 2"))
 		return
 	}
+	timeoutMs := envelope.GetMatchmakeAdd().TimeoutMs
+	if timeoutMs < 0 {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Timeout must be >= 0"))
+		return
+	}
+
+	// Clients cannot name a pool, only runtime before hooks route tickets, and only to configured pools.
+	pool := envelope.GetMatchmakeAdd().Pool
+	if pool != "" && !MatchmakerPoolConfigured(p.config.GetMatchmaker().Pools, pool) {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Unknown matchmaker pool"))
+		return
+	}
 
-	ticket, selected := p.matchmaker.Add(session.id, session.userID, PresenceMeta{Handle: session.handle.Load()}, requiredCount)
+	ticket, selected := p.matchmaker.Add(session.id, session.userID, PresenceMeta{Handle: session.handle.Load(), Region: session.region}, requiredCount, timeoutMs, pool)
 
 	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_MatchmakeTicket{MatchmakeTicket: &TMatchmakeTicket{
 		Ticket: ticket.Bytes(),
@@ -23,7 +35,18 @@ func (p *pipeline) matchmakeAdd(logger *zap.Logger, session *session, envelope *
 	if selected == nil {
 		return
 	}
+	p.matchmakeMatched(logger, selected, requiredCount)
+}
 
+// MatchmakerMatched tells the owners of tickets the matchmaker matched on its own, after they were promoted into the
+// same pool while waiting.
+func (p *pipeline) MatchmakerMatched(logger *zap.Logger, matches []map[MatchmakerKey]*MatchmakerProfile) {
+	for _, selected := range matches {
+		p.matchmakeMatched(logger, selected, int64(len(selected)))
+	}
+}
+
+func (p *pipeline) matchmakeMatched(logger *zap.Logger, selected map[MatchmakerKey]*MatchmakerProfile, requiredCount int64) {
 	matchID := uuid.NewV4()
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 		"mid": matchID.String(),
@@ -38,6 +61,7 @@ func (p *pipeline) matchmakeAdd(logger *zap.Logger, session *session, envelope *
 			UserId:    mk.UserID.Bytes(),
 			SessionId: mk.ID.SessionID.Bytes(),
 			Handle:    mp.Meta.Handle,
+			Region:    []byte(mp.Meta.Region),
 		}
 		idx++
 	}
@@ -61,11 +85,36 @@ func (p *pipeline) matchmakeAdd(logger *zap.Logger, session *session, envelope *
 			UserId:    mk.UserID.Bytes(),
 			SessionId: mk.ID.SessionID.Bytes(),
 			Handle:    mp.Meta.Handle,
+			Region:    []byte(mp.Meta.Region),
 		}
+		outgoing.GetMatchmakeMatched().Properties = RuntimeMatchmakerMatchedHook(logger, p.runtime, mk, mp, selected, requiredCount)
 		p.messageRouter.Send(logger, to, outgoing)
 	}
 }
 
+// matchmakeStripPool clears the pool from a client's matchmake message, before any runtime before hook sees it.
+func matchmakeStripPool(envelope *Envelope) {
+	if e, ok := envelope.Payload.(*Envelope_MatchmakeAdd); ok {
+		e.MatchmakeAdd.Pool = ""
+	}
+}
+
+// MatchmakerExpired tells the owners of expired matchmake tickets that matchmaking stopped without a match.
+func (p *pipeline) MatchmakerExpired(logger *zap.Logger, expired map[MatchmakerKey]*MatchmakerProfile) {
+	for mk, mp := range expired {
+		to := []Presence{
+			Presence{
+				ID:     mk.ID,
+				UserID: mk.UserID,
+				Meta:   mp.Meta,
+			},
+		}
+		p.messageRouter.Send(logger, to, &Envelope{Payload: &Envelope_MatchmakeExpired{MatchmakeExpired: &MatchmakeExpired{
+			Ticket: mk.Ticket.Bytes(),
+		}}})
+	}
+}
+
 func (p *pipeline) matchmakeRemove(logger *zap.Logger, session *session, envelope *Envelope) {
 	ticketBytes := envelope.GetMatchmakeRemove().Ticket
 	ticket, err := uuid.FromBytes(ticketBytes)
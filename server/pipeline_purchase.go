@@ -0,0 +1,52 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"go.uber.org/zap"
+)
+
+// purchaseValidate grants the storage writes returned by the purchase validation before function. Receipts are only
+// verified by that function, so purchases are refused when there is none.
+func (p *pipeline) purchaseValidate(logger *zap.Logger, session *session, envelope *Envelope, grants []*StorageData) {
+	incoming := envelope.GetPurchaseValidate()
+	if p.runtime.GetRuntimeCallback(BEFORE, "PurchaseValidate") == nil {
+		session.Send(ErrorMessage(envelope.CollationId, RUNTIME_FUNCTION_NOT_FOUND, "Purchase validation requires a runtime before function"))
+		return
+	}
+
+	keys, code, err := PurchaseGrant(logger, p.db, p.storageRouter, session.userID, incoming.Store, incoming.ProductId, incoming.Receipt, grants)
+	if err == ErrPurchaseReceiptUsed {
+		logger.Warn("Purchase receipt submitted again", zap.String("store", incoming.Store), zap.String("product_id", incoming.ProductId))
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	} else if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+	p.runtime.storageUsageCache.InvalidateData(grants)
+
+	storageKeys := make([]*TStorageKeys_StorageKey, len(keys))
+	for i, key := range keys {
+		storageKeys[i] = &TStorageKeys_StorageKey{
+			Bucket:     key.Bucket,
+			Collection: key.Collection,
+			Record:     key.Record,
+			Version:    key.Version,
+		}
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_StorageKeys{StorageKeys: &TStorageKeys{Keys: storageKeys}}})
+}
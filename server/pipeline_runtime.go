@@ -33,12 +33,12 @@ func (p *pipeline) rpc(logger *zap.Logger, session *session, envelope *Envelope)
 		return
 	}
 
-	result, fnErr := p.runtime.InvokeFunctionRPC(lf, session.userID, session.handle.Load(), session.expiry, rpcMessage.Payload)
+	result, contentType, fnErr := p.runtime.InvokeFunctionRPCWithFormat(lf, rpcMessage.Id, session.userID, session.handle.Load(), session.expiry, rpcMessage.Payload)
 	if fnErr != nil {
 		logger.Error("Runtime RPC function caused an error", zap.String("id", rpcMessage.Id), zap.Error(fnErr))
 		session.Send(ErrorMessage(envelope.CollationId, RUNTIME_FUNCTION_EXCEPTION, fmt.Sprintf("Runtime function caused an error: %s", fnErr.Error())))
 		return
 	}
 
-	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_Rpc{Rpc: &TRpc{Id: rpcMessage.Id, Payload: result}}})
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_Rpc{Rpc: &TRpc{Id: rpcMessage.Id, Payload: result, ContentType: contentType}}})
 }
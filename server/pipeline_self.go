@@ -17,6 +17,7 @@ package server
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"strconv"
 	"strings"
 
@@ -104,11 +105,29 @@ WHERE u.id = $1`,
 		Verified:     verifiedAt.Int64 > 0,
 	}
 
+	// Fields added by the runtime are only part of this response, the stored metadata is unchanged.
+	RuntimeAccountHook(logger, p.runtime, session.handle.Load(), session.expiry, s)
+
 	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_Self{Self: &TSelf{Self: s}}})
 }
 
 func (p *pipeline) selfUpdate(logger *zap.Logger, session *session, envelope *Envelope) {
 	update := envelope.GetSelfUpdate()
+
+	// Custom naming policy, the normalized handle is the one stored and checked for uniqueness.
+	if update.Handle != "" {
+		handle, reason, fnErr := p.runtime.InvokeFunctionHandle(session.userID, update.Handle)
+		if fnErr != nil {
+			logger.Error("Runtime handle function caused an error", zap.Error(fnErr))
+			session.Send(ErrorMessage(envelope.CollationId, RUNTIME_FUNCTION_EXCEPTION, fmt.Sprintf("Runtime handle function caused an error: %s", fnErr.Error())))
+			return
+		} else if reason != "" {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, reason))
+			return
+		}
+		update.Handle = handle
+	}
+
 	index := 1
 	statements := make([]string, 0)
 	params := make([]interface{}, 0)
@@ -14,18 +14,25 @@
 
 package server
 
-import "go.uber.org/zap"
+import (
+	"time"
+
+	"github.com/armon/go-metrics"
+	"go.uber.org/zap"
+)
 
 func (p *pipeline) storageList(logger *zap.Logger, session *session, envelope *Envelope) {
 	incoming := envelope.GetStorageList()
 
-	data, cursor, code, err := StorageList(logger, p.db, session.userID, incoming.UserId, incoming.Bucket, incoming.Collection, incoming.Limit, incoming.Cursor)
+	data, cursor, code, err := StorageList(logger, p.db, p.storageRouter, session.userID, incoming.UserId, incoming.Bucket, incoming.Collection, incoming.Limit, incoming.Cursor)
 	if err != nil {
 		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
 		return
 	}
 
-	storageData := make([]*TStorageData_StorageData, len(data))
+	virtual := RuntimeStorageListHook(logger, p.runtime, session, incoming, data)
+
+	storageData := make([]*TStorageData_StorageData, len(data), len(data)+len(virtual))
 	for i, d := range data {
 		storageData[i] = &TStorageData_StorageData{
 			Bucket:          d.Bucket,
@@ -41,6 +48,19 @@ func (p *pipeline) storageList(logger *zap.Logger, session *session, envelope *E
 			ExpiresAt:       d.ExpiresAt,
 		}
 	}
+	for _, d := range virtual {
+		storageData = append(storageData, &TStorageData_StorageData{
+			Bucket:         d.Bucket,
+			Collection:     d.Collection,
+			Record:         d.Record,
+			UserId:         d.UserId,
+			Value:          d.Value,
+			PermissionRead: int32(d.PermissionRead),
+			CreatedAt:      d.CreatedAt,
+			UpdatedAt:      d.UpdatedAt,
+			Virtual:        true,
+		})
+	}
 
 	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_StorageData{StorageData: &TStorageData{Data: storageData, Cursor: cursor}}})
 }
@@ -62,7 +82,7 @@ func (p *pipeline) storageFetch(logger *zap.Logger, session *session, envelope *
 		}
 	}
 
-	data, code, err := StorageFetch(logger, p.db, session.userID, keys)
+	data, code, err := StorageFetch(logger, p.db, p.storageRouter, session.userID, keys)
 	if err != nil {
 		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
 		return
@@ -88,7 +108,7 @@ func (p *pipeline) storageFetch(logger *zap.Logger, session *session, envelope *
 	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_StorageData{StorageData: &TStorageData{Data: storageData}}})
 }
 
-func (p *pipeline) storageWrite(logger *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) storageWrite(logger *zap.Logger, session *session, envelope *Envelope, sideEffects []*StorageData) {
 	incoming := envelope.GetStorageWrite()
 	if len(incoming.Data) == 0 {
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "At least one write value is required"))
@@ -109,12 +129,47 @@ func (p *pipeline) storageWrite(logger *zap.Logger, session *session, envelope *
 		}
 	}
 
-	keys, code, err := StorageWrite(logger, p.db, session.userID, data)
+	ttl := time.Duration(p.config.GetStorage().IdempotencyKeyTtlMs) * time.Millisecond
+	keys, repeated, code, err := StorageWriteIdempotent(logger, p.db, p.storageRouter, session.userID, data, sideEffects, incoming.IdempotencyKey, ttl)
 	if err != nil {
 		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
 		return
 	}
+	if repeated {
+		logger.Debug("Storage write repeated with the same idempotency key", zap.String("idempotency_key", incoming.IdempotencyKey))
+	} else {
+		p.runtime.storageUsageCache.Invalidate(session.userID.Bytes())
+		p.runtime.storageUsageCache.InvalidateData(sideEffects)
+	}
+
+	session.Send(storageKeysEnvelope(envelope.CollationId, keys))
+}
+
+// storageWriteRepeat answers a storage write that repeats an idempotency key the user already wrote with, with the
+// result of the original write, and reports whether it did. Repeats are answered before the runtime before function
+// runs, so the function and its side effect writes run once per key however often the client retries.
+func (p *pipeline) storageWriteRepeat(logger *zap.Logger, session *session, envelope *Envelope) bool {
+	incoming := envelope.GetStorageWrite()
+	if incoming == nil || incoming.IdempotencyKey == "" {
+		return false
+	}
+
+	keys, err := storageIdempotencyResult(p.db, session.userID, incoming.IdempotencyKey)
+	if err != nil {
+		// The write itself checks the key again, and fails if it still cannot be read.
+		logger.Error("Could not read storage idempotency key", zap.Error(err))
+		return false
+	}
+	if keys == nil {
+		return false
+	}
+	metrics.IncrCounter([]string{"storage", "idempotency", "hit"}, 1)
+	logger.Debug("Storage write repeated with the same idempotency key", zap.String("idempotency_key", incoming.IdempotencyKey))
+	session.Send(storageKeysEnvelope(envelope.CollationId, keys))
+	return true
+}
 
+func storageKeysEnvelope(collationID string, keys []*StorageKey) *Envelope {
 	storageKeys := make([]*TStorageKeys_StorageKey, len(keys))
 	for i, key := range keys {
 		storageKeys[i] = &TStorageKeys_StorageKey{
@@ -124,8 +179,7 @@ func (p *pipeline) storageWrite(logger *zap.Logger, session *session, envelope *
 			Version:    key.Version,
 		}
 	}
-
-	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_StorageKeys{StorageKeys: &TStorageKeys{Keys: storageKeys}}})
+	return &Envelope{CollationId: collationID, Payload: &Envelope_StorageKeys{StorageKeys: &TStorageKeys{Keys: storageKeys}}}
 }
 
 func (p *pipeline) storageRemove(logger *zap.Logger, session *session, envelope *Envelope) {
@@ -146,11 +200,12 @@ func (p *pipeline) storageRemove(logger *zap.Logger, session *session, envelope
 		}
 	}
 
-	code, err := StorageRemove(logger, p.db, session.userID, keys)
+	code, err := StorageRemove(logger, p.db, p.storageRouter, session.userID, keys)
 	if err != nil {
 		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
 		return
 	}
+	p.runtime.storageUsageCache.Invalidate(session.userID.Bytes())
 
 	session.Send(&Envelope{CollationId: envelope.CollationId})
 }
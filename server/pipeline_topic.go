@@ -20,12 +20,16 @@ import (
 	"encoding/gob"
 	"encoding/json"
 	"regexp"
+	"sync"
 	"unicode/utf8"
 
+	"github.com/armon/go-metrics"
 	"github.com/satori/go.uuid"
 	"go.uber.org/zap"
 )
 
+const topicTranslationQueueSize = 64
+
 type messageCursor struct {
 	MessageID []byte
 	UserID    []byte
@@ -34,6 +38,54 @@ type messageCursor struct {
 
 var controlCharsRegex = regexp.MustCompilePOSIX("[[:cntrl:]]+")
 
+// topicTranslations runs message translations one at a time for each topic, so translated copies go out in the order
+// the messages were sent. Each topic with pending translations has one goroutine, which exits once its queue is empty.
+// Queues are per node, so the order only holds between messages sent through the same node.
+type topicTranslations struct {
+	sync.Mutex
+	queues map[string]chan func()
+}
+
+func newTopicTranslations() *topicTranslations {
+	return &topicTranslations{queues: make(map[string]chan func())}
+}
+
+// run queues a translation for the topic. It returns false and drops the function if the topic's queue is full.
+func (t *topicTranslations) run(topic string, f func()) bool {
+	t.Lock()
+	defer t.Unlock()
+	queue, ok := t.queues[topic]
+	if !ok {
+		queue = make(chan func(), topicTranslationQueueSize)
+		t.queues[topic] = queue
+		go t.drain(topic, queue)
+	}
+	select {
+	case queue <- f:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *topicTranslations) drain(topic string, queue chan func()) {
+	for {
+		select {
+		case f := <-queue:
+			f()
+		default:
+			// Translations are only queued under the lock, so none can arrive between this check and the delete.
+			t.Lock()
+			if len(queue) == 0 {
+				delete(t.queues, topic)
+				t.Unlock()
+				return
+			}
+			t.Unlock()
+		}
+	}
+}
+
 func (p *pipeline) topicJoin(logger *zap.Logger, session *session, envelope *Envelope) {
 	e := envelope.GetTopicsJoin()
 
@@ -48,6 +100,7 @@ func (p *pipeline) topicJoin(logger *zap.Logger, session *session, envelope *Env
 
 	var topic *TopicId
 	var trackerTopic string
+	var descriptor map[string]interface{}
 	switch t.Id.(type) {
 	case *TTopicsJoin_TopicJoin_UserId:
 		// Check input is valid ID.
@@ -84,6 +137,7 @@ func (p *pipeline) topicJoin(logger *zap.Logger, session *session, envelope *Env
 			topic = &TopicId{Id: &TopicId_Dm{Dm: append(otherUserIDBytes, session.userID.Bytes()...)}}
 			trackerTopic = "dm:" + otherUserIDString + ":" + userIDString
 		}
+		descriptor = map[string]interface{}{"type": "dm", "user_id": otherUserIDString}
 	case *TTopicsJoin_TopicJoin_Room:
 		// Check input is valid room name.
 		room := t.GetRoom()
@@ -102,6 +156,7 @@ func (p *pipeline) topicJoin(logger *zap.Logger, session *session, envelope *Env
 
 		topic = &TopicId{Id: &TopicId_Room{Room: room}}
 		trackerTopic = "room:" + string(room)
+		descriptor = map[string]interface{}{"type": "room", "room": string(room)}
 	case *TTopicsJoin_TopicJoin_GroupId:
 		// Check input is valid ID.
 		groupIDBytes := t.GetGroupId()
@@ -124,6 +179,7 @@ func (p *pipeline) topicJoin(logger *zap.Logger, session *session, envelope *Env
 
 		trackerTopic = "group:" + groupID.String()
 		topic = &TopicId{Id: &TopicId_GroupId{GroupId: groupIDBytes}}
+		descriptor = map[string]interface{}{"type": "group", "group_id": groupID.String()}
 	case nil:
 		session.Send(ErrorMessageBadInput(envelope.CollationId, "No topic ID found"))
 		return
@@ -132,11 +188,23 @@ func (p *pipeline) topicJoin(logger *zap.Logger, session *session, envelope *Env
 		return
 	}
 
+	muted, errorMessage := RuntimeTopicJoinHook(logger, p.runtime, session, envelope.CollationId, descriptor)
+	if errorMessage != nil {
+		session.Send(errorMessage)
+		return
+	}
+	if muted {
+		session.mutedTopics[trackerTopic] = true
+	} else {
+		delete(session.mutedTopics, trackerTopic)
+	}
+
 	handle := session.handle.Load()
 
 	// Track the presence, and gather current member list.
 	p.tracker.Track(session.id, trackerTopic, session.userID, PresenceMeta{
 		Handle: handle,
+		Region: session.region,
 	})
 	presences := p.tracker.ListByTopic(trackerTopic)
 
@@ -146,6 +214,7 @@ func (p *pipeline) topicJoin(logger *zap.Logger, session *session, envelope *Env
 			UserId:    presences[i].UserID.Bytes(),
 			SessionId: presences[i].ID.SessionID.Bytes(),
 			Handle:    presences[i].Meta.Handle,
+			Region:    []byte(presences[i].Meta.Region),
 		}
 	}
 
@@ -158,6 +227,7 @@ func (p *pipeline) topicJoin(logger *zap.Logger, session *session, envelope *Env
 					UserId:    session.userID.Bytes(),
 					SessionId: session.id.Bytes(),
 					Handle:    handle,
+					Region:    []byte(session.region),
 				},
 			},
 		},
@@ -257,6 +327,7 @@ func (p *pipeline) topicLeave(logger *zap.Logger, session *session, envelope *En
 
 	// Drop the session's presence from this topic, if any.
 	p.tracker.Untrack(session.id, trackerTopic, session.userID)
+	delete(session.mutedTopics, trackerTopic)
 
 	session.Send(&Envelope{CollationId: envelope.CollationId})
 }
@@ -363,6 +434,10 @@ func (p *pipeline) topicMessageSend(logger *zap.Logger, session *session, envelo
 		session.Send(ErrorMessageBadInput(envelope.CollationId, "Must join topic before sending messages"))
 		return
 	}
+	if session.mutedTopics[trackerTopic] {
+		session.Send(ErrorMessage(envelope.CollationId, TOPIC_MUTED, "Muted in this topic"))
+		return
+	}
 
 	// Store message to history.
 	messageID, handle, createdAt, expiresAt, err := p.storeMessage(logger, session, topic, 0, data)
@@ -645,7 +720,46 @@ func (p *pipeline) deliverMessage(logger *zap.Logger, session *session, topic *T
 	}
 
 	presences := p.tracker.ListByTopic(trackerTopic)
-	p.messageRouter.Send(logger, presences, outgoing)
+	if msgType != 0 || !p.runtime.IsRuntimeMessageTranslateRegistered() {
+		p.messageRouter.Send(logger, presences, outgoing)
+		return
+	}
+
+	// Chat messages go out as sent to recipients sharing the sender's locale, or with none set. Everyone else
+	// receives a copy translated into their locale once the runtime has produced it, the original is what is stored.
+	// Only sessions on this node have a known locale, recipients connected to other nodes get the original.
+	original := make([]Presence, 0, len(presences))
+	localized := make(map[string][]Presence)
+	for _, presence := range presences {
+		recipient := p.sessionRegistry.Get(presence.ID.SessionID)
+		if recipient == nil || recipient.lang == "" || recipient.lang == session.lang {
+			original = append(original, presence)
+		} else {
+			localized[recipient.lang] = append(localized[recipient.lang], presence)
+		}
+	}
+	p.messageRouter.Send(logger, original, outgoing)
+	if len(localized) == 0 {
+		return
+	}
+
+	userID := session.userID
+	sessionExpiry := session.expiry
+	queued := p.topicTranslations.run(trackerTopic, func() {
+		for locale, recipients := range localized {
+			translated := RuntimeMessageTranslateHook(logger, p.runtime, userID, handle, sessionExpiry, topic, data, locale)
+			message := *outgoing.GetTopicMessage()
+			message.Data = translated
+			p.messageRouter.Send(logger, recipients, &Envelope{Payload: &Envelope_TopicMessage{TopicMessage: &message}})
+		}
+	})
+	if !queued {
+		// The topic is sending faster than messages can be translated, recipients get the original instead.
+		metrics.IncrCounter([]string{"topic", "translate", "dropped"}, 1)
+		for _, recipients := range localized {
+			p.messageRouter.Send(logger, recipients, outgoing)
+		}
+	}
 }
 
 func (p *pipeline) storeAndDeliverMessage(logger *zap.Logger, session *session, topic *TopicId, msgType int64, data []byte) error {
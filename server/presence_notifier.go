@@ -115,6 +115,10 @@ func (pn *presenceNotifier) HandleDiff(joins, leaves []Presence) {
 			} else {
 				pn.handleDiffTopic(t, to, tjs, nil)
 			}
+		case "notifications":
+			// Notification routing presences are not visible to other users.
+		case "leaderboard":
+			// Leaderboard record stream subscribers are not visible to other users.
 		default:
 			pn.logger.Warn("Skipping presence notifications for unknown topic", zap.Any("topic", topic))
 		}
@@ -149,6 +153,7 @@ func (pn *presenceNotifier) HandleDiff(joins, leaves []Presence) {
 		case "group":
 			t := &TopicId{Id: &TopicId_GroupId{GroupId: uuid.FromStringOrNil(splitTopic[1]).Bytes()}}
 			pn.handleDiffTopic(t, to, nil, tls)
+		case "notifications", "leaderboard":
 		default:
 			pn.logger.Warn("Skipping presence notifications for unknown topic", zap.Any("topic", topic))
 		}
@@ -167,6 +172,9 @@ func (pn *presenceNotifier) handleDiffMatch(matchID []byte, to, joins, leaves []
 				UserId:    joins[i].UserID.Bytes(),
 				SessionId: joins[i].ID.SessionID.Bytes(),
 				Handle:    joins[i].Meta.Handle,
+				Metadata:  []byte(joins[i].Meta.Metadata),
+				Region:    []byte(joins[i].Meta.Region),
+				Role:      joins[i].Meta.Role,
 			}
 		}
 		msg.Joins = muJoins
@@ -178,6 +186,9 @@ func (pn *presenceNotifier) handleDiffMatch(matchID []byte, to, joins, leaves []
 				UserId:    leaves[i].UserID.Bytes(),
 				SessionId: leaves[i].ID.SessionID.Bytes(),
 				Handle:    leaves[i].Meta.Handle,
+				Metadata:  []byte(leaves[i].Meta.Metadata),
+				Region:    []byte(leaves[i].Meta.Region),
+				Role:      leaves[i].Meta.Role,
 			}
 		}
 		msg.Leaves = muLeaves
@@ -199,6 +210,7 @@ func (pn *presenceNotifier) handleDiffTopic(topic *TopicId, to, joins, leaves []
 				UserId:    joins[i].UserID.Bytes(),
 				SessionId: joins[i].ID.SessionID.Bytes(),
 				Handle:    joins[i].Meta.Handle,
+				Region:    []byte(joins[i].Meta.Region),
 			}
 		}
 		msg.Joins = tuJoins
@@ -210,6 +222,7 @@ func (pn *presenceNotifier) handleDiffTopic(topic *TopicId, to, joins, leaves []
 				UserId:    leaves[i].UserID.Bytes(),
 				SessionId: leaves[i].ID.SessionID.Bytes(),
 				Handle:    leaves[i].Meta.Handle,
+				Region:    []byte(leaves[i].Meta.Region),
 			}
 		}
 		msg.Leaves = tuLeaves
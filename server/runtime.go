@@ -15,15 +15,23 @@
 package server
 
 import (
+	"bytes"
+	"io"
+	"net"
 	"os"
 	"path/filepath"
 
 	"errors"
 
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"database/sql"
+	"encoding/json"
 
+	"github.com/armon/go-metrics"
 	"github.com/satori/go.uuid"
 	"github.com/yuin/gopher-lua"
 	"go.uber.org/zap"
@@ -32,6 +40,13 @@ import (
 
 const (
 	__nakamaReturnValue = "__nakama_return_flag__"
+
+	runtimeAsyncWorkers   = 4
+	runtimeAsyncQueueSize = 1024
+
+	runtimeReadinessCacheDuration       = 5 * time.Second
+	runtimeStorageStatsCacheDuration    = 30 * time.Second
+	runtimeLeaderboardRankCacheDuration = 5 * time.Second
 )
 
 type BuiltinModule interface {
@@ -39,15 +54,72 @@ type BuiltinModule interface {
 }
 
 type Runtime struct {
-	logger *zap.Logger
-	vm     *lua.LState
-	luaEnv *lua.LTable
+	logger               *zap.Logger
+	db                   *sql.DB
+	vm                   *lua.LState
+	luaEnv               *lua.LTable
+	matchRegistry        MatchRegistry
+	metrics              *RuntimeMetrics
+	notificationService  *NotificationService
+	pushService          *PushService
+	clusterLeader        ClusterLeader
+	sessionRegistry      *SessionRegistry
+	storageRouter        *StorageRouter
+	storageStatsCache    *StorageStatsCache
+	storageUsageCache    *StorageUsageCache
+	leaderboardRankCache *LeaderboardRankCache
+	userFlagCache        *UserFlagCache
+	translationCache     *MessageTranslationCache
+	assetURLCache        *AssetURLCache
+	matchDataScratch     *MatchDataScratch
+	matchCodes           *MatchCodes
+	friendRequests       *FriendRequestCounter
+	nodeLocalStore       *NodeLocalStore
+	tracer               *RuntimeTracer
+	jobWorkers           []*JobWorker
+	storageChangeWorker  *StorageChangeWorker
+	activeUsers          *ActiveUsers
+	tournamentScheduler  *TournamentScheduler
+	oneTimeTokenSweeper  *OneTimeTokenSweeper
+	conversionMaxDepth   int
+	redactionRules       []*redactionRule
+	erasure              *UserErasure
+	auditLog             *AuditLogService
+	geoip                GeoIPDatabase
+	evalCache            *RuntimeEvalCache
+	evalTimeout          time.Duration
+	evalInstructionCap   int64
+	asyncQueue           chan func()
+	asyncWg              sync.WaitGroup
+	asyncMutex           sync.RWMutex
+	asyncStopped         bool
+
+	readinessMutex     sync.Mutex
+	readinessCheckedAt time.Time
+	ready              bool
 }
 
-func NewRuntime(logger *zap.Logger, multiLogger *zap.Logger, db *sql.DB, config *RuntimeConfig) (*Runtime, error) {
+func NewRuntime(logger *zap.Logger, multiLogger *zap.Logger, db *sql.DB, storageRouter *StorageRouter, config *RuntimeConfig, matchRegistry MatchRegistry, notificationService *NotificationService, pushService *PushService, clusterLeader ClusterLeader, sessionRegistry *SessionRegistry) (*Runtime, error) {
 	if err := os.MkdirAll(config.Path, os.ModePerm); err != nil {
 		return nil, err
 	}
+	redactionRules, err := newRedactionRules(config.RedactionRules)
+	if err != nil {
+		return nil, err
+	}
+	erasure, err := NewUserErasure(config.Erasure)
+	if err != nil {
+		return nil, err
+	}
+	if config.AuditLogKey == DefaultAuditLogKey {
+		multiLogger.Warn("Audit log key is the default, audit log entries can be forged. Set runtime.audit_log_key to a secret value")
+	}
+	var geoip GeoIPDatabase
+	if config.GeoIPPath != "" {
+		if geoip, err = NewCSVGeoIPDatabase(config.GeoIPPath); err != nil {
+			return nil, err
+		}
+	}
 
 	// override before Package library is invoked.
 	lua.LuaLDir = config.Path
@@ -75,20 +147,54 @@ func NewRuntime(logger *zap.Logger, multiLogger *zap.Logger, db *sql.DB, config
 		vm.Call(1, 0)
 	}
 
-	nakamaModule := NewNakamaModule(logger, db, vm)
+	r := &Runtime{
+		logger:               logger,
+		db:                   db,
+		storageRouter:        storageRouter,
+		vm:                   vm,
+		luaEnv:               ConvertMap(vm, config.Environment),
+		matchRegistry:        matchRegistry,
+		metrics:              NewRuntimeMetrics(config.MetricsTagLimit),
+		notificationService:  notificationService,
+		pushService:          pushService,
+		clusterLeader:        clusterLeader,
+		sessionRegistry:      sessionRegistry,
+		storageStatsCache:    NewStorageStatsCache(runtimeStorageStatsCacheDuration),
+		storageUsageCache:    NewStorageUsageCache(logger, db, storageRouter),
+		leaderboardRankCache: NewLeaderboardRankCache(runtimeLeaderboardRankCacheDuration),
+		userFlagCache:        NewUserFlagCache(logger, db),
+		translationCache:     NewMessageTranslationCache(),
+		assetURLCache:        NewAssetURLCache(),
+		matchDataScratch:     NewMatchDataScratch(),
+		matchCodes:           NewMatchCodes(),
+		friendRequests:       NewFriendRequestCounter(friendRequestWindowMs),
+		nodeLocalStore:       NewNodeLocalStore(),
+		tracer:               NewRuntimeTracer(logger, config.TraceEndpoint),
+		conversionMaxDepth:   config.ConversionMaxDepth,
+		redactionRules:       redactionRules,
+		erasure:              erasure,
+		auditLog:             NewAuditLogService(logger, db, []byte(config.AuditLogKey)),
+		geoip:                geoip,
+		evalCache:            NewRuntimeEvalCache(),
+		evalTimeout:          time.Duration(config.EvalTimeoutMs) * time.Millisecond,
+		evalInstructionCap:   config.EvalInstructionCap,
+		asyncQueue:           make(chan func(), runtimeAsyncQueueSize),
+	}
+
+	if r.activeUsers, err = NewActiveUsers(logger, db, clusterLeader, config.ActiveUsersRollup); err != nil {
+		logger.Error("Could not parse active users rollup schedule", zap.Error(err))
+		return nil, err
+	}
+
+	nakamaModule := NewNakamaModule(logger, db, r, vm)
+	vm.SetContext(context.WithValue(vm.Context(), SOURCES, NewSources(config)))
 	vm.PreloadModule("nakama", nakamaModule.Loader)
 	nakamaxModule := NewNakamaxModule(logger)
 	vm.PreloadModule("nakamax", nakamaxModule.Loader)
 
-	r := &Runtime{
-		logger: logger,
-		vm:     vm,
-		luaEnv: ConvertMap(vm, config.Environment),
-	}
-
 	logger.Info("Initialising modules", zap.String("path", lua.LuaLDir))
 	modules := make([]string, 0)
-	err := filepath.Walk(lua.LuaLDir, func(path string, f os.FileInfo, err error) error {
+	err = filepath.Walk(lua.LuaLDir, func(path string, f os.FileInfo, err error) error {
 		if err != nil {
 			logger.Error("Could not read module", zap.Error(err))
 			return err
@@ -110,6 +216,39 @@ func NewRuntime(logger *zap.Logger, multiLogger *zap.Logger, db *sql.DB, config
 	}
 	multiLogger.Info("Modules loaded")
 
+	rc := r.vm.Context().Value(CALLBACKS).(*Callbacks)
+	for queue, fn := range rc.QueueWorker {
+		fn := fn
+		r.jobWorkers = append(r.jobWorkers, NewJobWorker(logger, db, queue, rc.QueueWorkerConcurrency[queue], rc.QueueWorkerMaxAttempts[queue], func(job *Job) error {
+			return r.InvokeFunctionQueueWorker(fn, job)
+		}))
+	}
+	if len(rc.StorageChange) != 0 {
+		collections := make(map[string]bool, len(rc.StorageChange))
+		for c := range rc.StorageChange {
+			collections[c] = true
+		}
+		r.storageRouter = storageRouter.WithChangeCollections(collections)
+		r.storageChangeWorker = NewStorageChangeWorker(logger, db, r.storageRouter, r.InvokeFunctionStorageChange)
+	}
+	r.activeUsers.Start()
+	r.tournamentScheduler = NewTournamentScheduler(logger, db, clusterLeader, func(id uuid.UUID, progress *TournamentProgress) {
+		RuntimeTournamentHook(logger, r, id, progress)
+	})
+	r.tournamentScheduler.Start()
+	r.oneTimeTokenSweeper = NewOneTimeTokenSweeper(logger, db)
+	notificationService.runtime.Store(r)
+
+	for i := 0; i < runtimeAsyncWorkers; i++ {
+		r.asyncWg.Add(1)
+		go func() {
+			defer r.asyncWg.Done()
+			for f := range r.asyncQueue {
+				f()
+			}
+		}()
+	}
+
 	return r, nil
 }
 
@@ -196,122 +335,2481 @@ func (r *Runtime) GetRuntimeCallback(e ExecutionMode, key string) *lua.LFunction
 		return cp.Before[k]
 	case AFTER:
 		return cp.After[k]
+	case TRANSFORM:
+		return cp.Transform[k]
 	}
 
 	return nil
 }
 
-func (r *Runtime) InvokeFunctionRPC(fn *lua.LFunction, uid uuid.UUID, handle string, sessionExpiry int64, payload []byte) ([]byte, error) {
+// GetRuntimeFallback returns the function registered to run in place of the before or after function for a message
+// type when that function causes an error, or nil if there is none.
+func (r *Runtime) GetRuntimeFallback(e ExecutionMode, key string) *lua.LFunction {
+	k := strings.ToLower(key)
+	cp := r.vm.Context().Value(CALLBACKS).(*Callbacks)
+	switch e {
+	case BEFORE:
+		return cp.BeforeFallback[k]
+	case AFTER:
+		return cp.AfterFallback[k]
+	}
+
+	return nil
+}
+
+// IsReady reports whether runtime modules are ready to serve, using the registered readiness function if there is one.
+// The result is cached briefly so frequent health checks don't hammer the runtime.
+func (r *Runtime) IsReady() bool {
+	fn := r.vm.Context().Value(CALLBACKS).(*Callbacks).Readiness
+	if fn == nil {
+		return true
+	}
+
+	r.readinessMutex.Lock()
+	defer r.readinessMutex.Unlock()
+	if time.Since(r.readinessCheckedAt) < runtimeReadinessCacheDuration {
+		return r.ready
+	}
+
 	l, _ := r.NewStateThread()
 	defer l.Close()
 
-	ctx := NewLuaContext(l, r.luaEnv, RPC, uid, handle, sessionExpiry)
-	var lv lua.LValue
-	if payload != nil {
-		lv = lua.LString(payload)
+	ctx := NewLuaContext(l, r.luaEnv, READINESS, uuid.Nil, "", 0)
+	retValue, err := r.invokeFunction(l, fn, ctx, nil)
+	if err != nil {
+		r.logger.Error("Runtime readiness function caused an error", zap.Error(err))
 	}
 
-	retValue, err := r.invokeFunction(l, fn, ctx, lv)
-	if err != nil {
-		return nil, err
+	r.ready = err == nil && retValue != nil && lua.LVAsBool(retValue)
+	r.readinessCheckedAt = time.Now()
+	return r.ready
+}
+
+// IsRuntimeBeforeUserFlags reports whether the before function for the message type was registered to see the user's
+// flags in its context.
+func (r *Runtime) IsRuntimeBeforeUserFlags(messageType string) bool {
+	cp := r.vm.Context().Value(CALLBACKS).(*Callbacks)
+	return cp.BeforeUserFlags[strings.ToLower(messageType)]
+}
+
+// GetRuntimeAfterSampleRate returns the fraction of messages the after function for the message type should see, 1 if not sampled.
+func (r *Runtime) GetRuntimeAfterSampleRate(messageType string) float64 {
+	cp := r.vm.Context().Value(CALLBACKS).(*Callbacks)
+	if rate, ok := cp.AfterSampleRate[strings.ToLower(messageType)]; ok {
+		return rate
 	}
+	return 1
+}
 
-	if retValue == nil || retValue == lua.LNil {
-		return nil, nil
-	} else if retValue.Type() == lua.LTString {
-		return []byte(retValue.String()), nil
+// IsRuntimeAfterLeaderOnly reports whether the after function for the message type was registered to run only on the
+// cluster leader.
+func (r *Runtime) IsRuntimeAfterLeaderOnly(messageType string) bool {
+	cp := r.vm.Context().Value(CALLBACKS).(*Callbacks)
+	return cp.AfterLeaderOnly[strings.ToLower(messageType)]
+}
+
+// IsRuntimeAfterExternal reports whether the after function for the message type was registered as external, so it
+// must only see payloads with the configured redaction rules applied.
+func (r *Runtime) IsRuntimeAfterExternal(messageType string) bool {
+	cp := r.vm.Context().Value(CALLBACKS).(*Callbacks)
+	return cp.AfterExternal[strings.ToLower(messageType)]
+}
+
+// IsLeader reports whether the current node is the cluster leader.
+func (r *Runtime) IsLeader() bool {
+	return r.clusterLeader.IsLeader()
+}
+
+// StorageRouter returns the storage router the runtime was created with, set to capture changes to the collections that
+// have storage change functions. Storage calls outside the runtime must use it so their changes are delivered too.
+func (r *Runtime) StorageRouter() *StorageRouter {
+	return r.storageRouter
+}
+
+// ListUserSessions returns the active sessions of a user on this node.
+func (r *Runtime) ListUserSessions(userID uuid.UUID) []*SessionInfo {
+	return r.sessionRegistry.ListUser(userID)
+}
+
+// RevokeSession disconnects a session and invalidates its token on every node. The session itself must be on this node,
+// it returns false if it is not found. Other nodes read revocations periodically, so sessions they hold with the token
+// are closed within a few seconds rather than at once.
+func (r *Runtime) RevokeSession(sessionID uuid.UUID) bool {
+	return r.sessionRegistry.Revoke(sessionID)
+}
+
+// GetFriends returns a page of the user's friends and a cursor for the next page, if there is one.
+func (r *Runtime) GetFriends(userID uuid.UUID, limit int64, cursor []byte) ([]*User, []byte, error) {
+	return FriendsList(r.logger, r.db, userID, limit, cursor)
+}
+
+// GetMutualFriends returns a page of the friends two users have in common and a cursor for the next page, if there is one.
+func (r *Runtime) GetMutualFriends(userID uuid.UUID, otherUserID uuid.UUID, limit int64, cursor []byte) ([]*User, []byte, error) {
+	return FriendsMutual(r.logger, r.db, userID, otherUserID, limit, cursor)
+}
+
+// ChannelHistory returns a page of a topic's messages matching the filter, newest first, and a cursor for the next
+// page if there is one.
+func (r *Runtime) ChannelHistory(topic *TopicId, filter *TopicMessageFilter, limit int64, cursor []byte) ([]*TopicMessage, []byte, error) {
+	return TopicMessagesHistory(r.logger, r.db, topic, filter, limit, cursor)
+}
+
+// NotifyQuery sends a persistent notification with the given subject, content and code to every user matching the
+// filter. It returns how many users match. In dry run mode nothing is sent, otherwise recipients are resolved and
+// notified in rate limited batches in the background.
+func (r *Runtime) NotifyQuery(filter *NotificationQueryFilter, subject string, content []byte, code int64, dryRun bool) (int64, error) {
+	if subject == "" {
+		return 0, errors.New("Notification subject must not be empty")
+	}
+
+	count, err := r.notificationService.NotificationQueryCount(filter)
+	if err != nil || dryRun || count == 0 {
+		return count, err
 	}
 
-	return nil, errors.New("Runtime function returned invalid data. Only allowed one return value of type String/Byte")
+	err = r.notificationService.NotificationQuery(filter, func(userIDs [][]byte) error {
+		notifications := make([]*NNotification, len(userIDs))
+		for i, userID := range userIDs {
+			notifications[i] = &NNotification{
+				UserID:     userID,
+				Subject:    subject,
+				Content:    content,
+				Code:       code,
+				Persistent: true,
+			}
+		}
+		if err := RuntimeNotificationHook(r.logger, r, notifications); err != nil {
+			return err
+		}
+		return r.notificationService.NotificationSend(notifications)
+	})
+	return count, err
 }
 
-func (r *Runtime) InvokeFunctionBefore(fn *lua.LFunction, uid uuid.UUID, handle string, sessionExpiry int64, payload map[string]interface{}) (map[string]interface{}, error) {
-	l, _ := r.NewStateThread()
-	defer l.Close()
+// NotifyUsers sends a persistent notification with the given subject, content and code to each of the users, listed
+// IDs are sent to once. Users are notified in batches, each stored in one transaction and delivered live to users with
+// a session. It returns how many users had the notification delivered live, and how many notifications were stored.
+func (r *Runtime) NotifyUsers(userIDs []uuid.UUID, subject string, content []byte, code int64) (int, int, error) {
+	if subject == "" {
+		return 0, 0, errors.New("Notification subject must not be empty")
+	}
 
-	ctx := NewLuaContext(l, r.luaEnv, BEFORE, uid, handle, sessionExpiry)
-	var lv lua.LValue
-	if payload != nil {
-		lv = ConvertMap(l, payload)
+	seen := make(map[uuid.UUID]bool, len(userIDs))
+	notifications := make([]*NNotification, 0, len(userIDs))
+	for _, userID := range userIDs {
+		if seen[userID] {
+			continue
+		}
+		seen[userID] = true
+		notifications = append(notifications, &NNotification{
+			UserID:     userID.Bytes(),
+			Subject:    subject,
+			Content:    content,
+			Code:       code,
+			Persistent: true,
+		})
 	}
 
-	retValue, err := r.invokeFunction(l, fn, ctx, lv)
+	delivered, stored := 0, 0
+	for len(notifications) != 0 {
+		batch := notifications
+		if len(batch) > notificationQueryBatchSize {
+			batch = batch[:notificationQueryBatchSize]
+		}
+		notifications = notifications[len(batch):]
+
+		if err := RuntimeNotificationHook(r.logger, r, batch); err != nil {
+			return delivered, stored, err
+		}
+		batchDelivered, batchStored, err := r.notificationService.send(batch)
+		if err != nil {
+			return delivered, stored, err
+		}
+		delivered += batchDelivered
+		stored += batchStored
+	}
+	return delivered, stored, nil
+}
+
+// StorageScan pages through all records in a bucket, or in one of its collections, calling fn with each batch and the
+// cursor that resumes after it. Each batch is read with its own query, no transaction is held open between batches.
+// The scan ends when fn returns false or an error, or when there are no more records. It returns the cursor to resume
+// from, or nil if the scan reached the end.
+func (r *Runtime) StorageScan(bucket string, collection string, batchSize int64, cursor []byte, fn func(data []*StorageData, cursor []byte) (bool, error)) ([]byte, error) {
+	if bucket == "" {
+		return nil, errors.New("Bucket is required to scan storage")
+	}
+
+	for {
+		data, newCursor, _, err := StorageList(r.logger, r.db, r.storageRouter, uuid.Nil, nil, bucket, collection, batchSize, cursor)
+		if err != nil {
+			return cursor, err
+		}
+		if len(data) != 0 {
+			more, err := fn(data, newCursor)
+			if err != nil {
+				return cursor, err
+			}
+			if !more {
+				return newCursor, nil
+			}
+		}
+		if len(newCursor) == 0 {
+			return nil, nil
+		}
+		cursor = newCursor
+	}
+}
+
+// StorageSetOp returns a page of the record keys in the intersection, union or difference of two owners' collections
+// in a bucket, and a cursor for the next page. The keys are compared in the database, so neither set is loaded to
+// compute the result.
+func (r *Runtime) StorageSetOp(bucket, collectionA string, ownerA uuid.UUID, collectionB string, ownerB uuid.UUID, op string, limit int64, cursor []byte) ([]string, []byte, error) {
+	records, newCursor, _, err := StorageSetOp(r.logger, r.db, r.storageRouter, bucket, collectionA, ownerA, collectionB, ownerB, op, limit, cursor)
+	return records, newCursor, err
+}
+
+// CheckCooldown starts the cooldown of a user's action and returns 0 if the action is ready, or returns the time left
+// until it is ready without changing it.
+func (r *Runtime) CheckCooldown(userID uuid.UUID, action string, cooldown time.Duration) (time.Duration, error) {
+	return CooldownCheck(r.logger, r.db, userID.Bytes(), action, cooldown)
+}
+
+// GetUserFlags returns all server side flags set for a user. Flags are cached on this node until one of the user's flags
+// is set here, flags set on other nodes are only seen once the cached flags expire.
+func (r *Runtime) GetUserFlags(userID uuid.UUID) (map[string]string, error) {
+	return r.userFlagCache.Get(userID)
+}
+
+// SetUserFlag sets a server side flag for a user, an empty value removes the flag.
+func (r *Runtime) SetUserFlag(userID uuid.UUID, key, value string) error {
+	return r.userFlagCache.Set(userID, key, value)
+}
+
+// LeaderboardRank returns the rank and score of an owner's record in the current period of a leaderboard. Ranks are
+// cached for a few seconds, so they can trail recent writes. It returns ErrLeaderboardRecordNotFound if the owner has
+// no record.
+func (r *Runtime) LeaderboardRank(leaderboardID string, ownerID uuid.UUID) (int64, int64, error) {
+	return r.leaderboardRankCache.Get(r.logger, r.db, []byte(leaderboardID), ownerID.Bytes())
+}
+
+// LeaderboardAggregateRegister makes an authoritative leaderboard the aggregate of the given regional leaderboards. Each
+// owner appears in it once, with their best unexpired record across the regions, and ties go to the earliest record.
+func (r *Runtime) LeaderboardAggregateRegister(aggregateID string, sourceIDs []string) error {
+	sources := make([][]byte, len(sourceIDs))
+	for i, sourceID := range sourceIDs {
+		sources[i] = []byte(sourceID)
+	}
+	return LeaderboardAggregateRegister(r.logger, r.db, []byte(aggregateID), sources)
+}
+
+// LeaderboardAggregateRefresh rebuilds the records of an aggregate leaderboard from its sources.
+func (r *Runtime) LeaderboardAggregateRefresh(aggregateID string) error {
+	return LeaderboardAggregateRefresh(r.logger, r.db, []byte(aggregateID))
+}
+
+// RecordActiveUser notes that a user connected today, for active user counts. It is recorded on the runtime worker
+// pool so connects never wait on the database. If the pool is full the user is not recorded for this connect, which is
+// logged and counted in runtime.active_users.dropped, so counts may be low while the pool is saturated.
+func (r *Runtime) RecordActiveUser(userID uuid.UUID) {
+	if !r.RunAsync(func() { r.activeUsers.Record(userID) }) {
+		r.logger.Warn("Runtime worker pool full, dropping active user record", zap.String("uid", userID.String()))
+		metrics.IncrCounter([]string{"runtime", "active_users", "dropped"}, 1)
+	}
+}
+
+// ActiveUsers returns the latest count of daily, weekly or monthly active users by window "day", "week" or "month",
+// and the UTC day it was counted for as days since the Unix epoch. Counts are as of the last scheduled rollup.
+func (r *Runtime) ActiveUsers(window string) (int64, int64, error) {
+	return r.activeUsers.Count(window)
+}
+
+// ActiveUsersRollup counts active users now rather than waiting for the scheduled rollup.
+func (r *Runtime) ActiveUsersRollup() error {
+	return r.activeUsers.Rollup()
+}
+
+// CreateOneTimeToken returns an opaque token for the payload that can be consumed once within the TTL.
+func (r *Runtime) CreateOneTimeToken(payload map[string]interface{}, ttl time.Duration) (string, error) {
+	payloadBytes, err := json.Marshal(payload)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
+	return OneTimeTokenCreate(r.logger, r.db, payloadBytes, ttl)
+}
 
-	if retValue == nil || retValue == lua.LNil {
-		return nil, nil
-	} else if retValue.Type() == lua.LTTable {
-		return ConvertLuaTable(retValue.(*lua.LTable)), nil
+// Enqueue stores a job with the payload in the named queue, to be processed at least once by the queue's worker
+// function on any node, and returns the job ID. Jobs enqueued on behalf of a user are removed with the user's data.
+func (r *Runtime) Enqueue(queue string, userID uuid.UUID, payload map[string]interface{}) (string, error) {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	id, err := JobEnqueue(r.logger, r.db, queue, userID, payloadBytes)
+	if err != nil {
+		return "", err
 	}
+	return uuid.FromBytesOrNil(id).String(), nil
+}
 
-	return nil, errors.New("Runtime function returned invalid data. Only allowed one return value of type Table")
+// SecureRandom returns n bytes from a cryptographically secure random source, clients cannot predict them.
+func (r *Runtime) SecureRandom(n int) ([]byte, error) {
+	return SecureRandom(n)
 }
 
-func (r *Runtime) InvokeFunctionAfter(fn *lua.LFunction, uid uuid.UUID, handle string, sessionExpiry int64, payload map[string]interface{}) error {
-	l, _ := r.NewStateThread()
-	defer l.Close()
+// CommitRng creates a secret seed for the user, and returns the commitment ID and the hash of the seed to show them
+// before an outcome is rolled.
+func (r *Runtime) CommitRng(userID uuid.UUID) (string, []byte, error) {
+	id, commitment, err := RngCommit(r.logger, r.db, userID)
+	if err != nil {
+		return "", nil, err
+	}
+	return uuid.FromBytesOrNil(id).String(), commitment, nil
+}
 
-	ctx := NewLuaContext(l, r.luaEnv, AFTER, uid, handle, sessionExpiry)
-	var lv lua.LValue
-	if payload != nil {
-		lv = ConvertMap(l, payload)
+// RollRng rolls dice with a commitment's seed and the client's seed, and records the outcome for later disputes.
+func (r *Runtime) RollRng(commitmentID uuid.UUID, clientSeed string, sides, count int64) ([]int64, error) {
+	return RngRoll(r.logger, r.db, commitmentID.Bytes(), clientSeed, sides, count)
+}
+
+// RevealRng reveals a commitment's seed along with the outcome rolled with it.
+func (r *Runtime) RevealRng(commitmentID uuid.UUID) (*RngCommitment, error) {
+	return RngReveal(r.logger, r.db, commitmentID.Bytes())
+}
+
+// SetGeoIPDatabase replaces the GeoIP database loaded from the runtime config, for servers that locate addresses with
+// another source. It must be set before the server accepts connections.
+func (r *Runtime) SetGeoIPDatabase(db GeoIPDatabase) {
+	r.geoip = db
+}
+
+// GeoIPLookup locates an IP address in the GeoIP database. It returns nil if there is no database, the address is
+// invalid, or the database has no record of it.
+func (r *Runtime) GeoIPLookup(ip string) *GeoIPRecord {
+	addr := net.ParseIP(ip)
+	if r.geoip == nil || addr == nil {
+		return nil
 	}
+	return r.geoip.Lookup(addr)
+}
 
-	_, err := r.invokeFunction(l, fn, ctx, lv)
-	return err
+// ExportUserData writes everything stored about the user to w as one JSON document, to answer data access requests.
+func (r *Runtime) ExportUserData(userID uuid.UUID, w io.Writer) error {
+	return UserDataExport(r.logger, r.db, r.storageRouter, userID, w)
 }
 
-func (r *Runtime) InvokeFunctionHTTP(fn *lua.LFunction, uid uuid.UUID, handle string, sessionExpiry int64, payload map[string]interface{}) (map[string]interface{}, error) {
-	l, _ := r.NewStateThread()
-	defer l.Close()
+// DeleteUserData permanently removes everything stored about the user, or anonymizes what the erasure config says to
+// keep, and revokes the user's sessions on every node. The registered before function runs first, and the deletion
+// is abandoned if it fails. The registered after function runs once the data is gone, for cleanup in other systems.
+func (r *Runtime) DeleteUserData(userID uuid.UUID) error {
+	cb := r.vm.Context().Value(CALLBACKS).(*Callbacks)
+	if cb.UserDataDeleteBefore != nil {
+		if err := r.InvokeFunctionUserDataDelete(cb.UserDataDeleteBefore, userID); err != nil {
+			r.logger.Error("Runtime before user data delete function caused an error", zap.Error(err))
+			return err
+		}
+	}
 
-	ctx := NewLuaContext(l, r.luaEnv, HTTP, uid, handle, sessionExpiry)
-	var lv lua.LValue
-	if payload != nil {
-		lv = ConvertMap(l, payload)
+	if err := UserDelete(r.logger, r.db, r.storageRouter, r.auditLog, userID, r.erasure); err != nil {
+		return err
+	}
+	// The record of the erasure itself is kept, it is not about the user's data. The data is already gone, so a failure
+	// to record it does not fail the deletion.
+	if _, err := r.AuditLog(uuid.Nil, map[string]interface{}{"action": "user_data_delete", "user_id": userID.String()}); err != nil {
+		r.logger.Error("Could not record user data deletion in the audit log", zap.String("uid", userID.String()), zap.Error(err))
 	}
+	r.userFlagCache.forget(userID)
+	r.sessionRegistry.RevokeUser(userID)
 
-	retValue, err := r.invokeFunction(l, fn, ctx, lv)
+	if cb.UserDataDeleteAfter != nil {
+		if err := r.InvokeFunctionUserDataDelete(cb.UserDataDeleteAfter, userID); err != nil {
+			// The data is already gone, the function's cleanup is left to it to retry.
+			r.logger.Error("Runtime after user data delete function caused an error", zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// AuditLog appends an event about a user, or about no user if the ID is nil, to the tamper-evident audit log and returns
+// its sequence number. Events about a user are erased along with the user's data.
+func (r *Runtime) AuditLog(userID uuid.UUID, event map[string]interface{}) (int64, error) {
+	eventBytes, err := json.Marshal(event)
+	if err != nil {
+		r.logger.Error("Could not encode audit log event", zap.Error(err))
+		return 0, err
+	}
+	seq, err := r.auditLog.Append(userID, eventBytes)
 	if err != nil {
+		metrics.IncrCounter([]string{"runtime", "audit_log", "failed"}, 1)
+	}
+	return seq, err
+}
+
+// AuditLogVerify checks the audit log chain and returns the sequence number of the first broken link, or 0 if the
+// chain is intact.
+func (r *Runtime) AuditLogVerify() (int64, error) {
+	return r.auditLog.Verify()
+}
+
+// ConsumeOneTimeToken returns the payload of a one-time token and invalidates the token. It returns
+// ErrOneTimeTokenInvalid if the token does not exist, has expired, or was already consumed.
+func (r *Runtime) ConsumeOneTimeToken(token string) (map[string]interface{}, error) {
+	payloadBytes, err := OneTimeTokenConsume(r.logger, r.db, token)
+	if err != nil {
+		return nil, err
+	}
+	var payload map[string]interface{}
+	if err = json.Unmarshal(payloadBytes, &payload); err != nil {
 		return nil, err
 	}
+	return payload, nil
+}
 
-	if retValue == nil || retValue == lua.LNil {
-		return nil, nil
-	} else if retValue.Type() == lua.LTTable {
-		return ConvertLuaTable(retValue.(*lua.LTable)), nil
+// ClaimUnique claims a value in a namespace for the owner. It returns ErrUniqueClaimed if another owner holds the value.
+func (r *Runtime) ClaimUnique(namespace, value string, ownerID uuid.UUID) error {
+	return UniqueClaim(r.logger, r.db, namespace, value, ownerID.Bytes())
+}
+
+// ReleaseUnique releases a value held by the owner so it can be claimed again, and returns false if the owner did not
+// hold it.
+func (r *Runtime) ReleaseUnique(namespace, value string, ownerID uuid.UUID) (bool, error) {
+	return UniqueRelease(r.logger, r.db, namespace, value, ownerID.Bytes())
+}
+
+// InventoryGrant adds items to a user's inventory atomically, after the runtime inventory grant function accepts them.
+// It returns ErrInventoryUniqueOwned if the user already owns a granted unique item, or InventoryRejectedError if the
+// function rejects the grant.
+func (r *Runtime) InventoryGrant(userID uuid.UUID, items []*InventoryItem) ([]*InventoryItem, error) {
+	return InventoryGrant(r.logger, r.db, r, userID, items)
+}
+
+// InventoryConsume removes items from a user's inventory atomically. It returns ErrInventoryInsufficient and removes
+// nothing if the user owns fewer of any item than asked for.
+func (r *Runtime) InventoryConsume(userID uuid.UUID, items map[string]int64) error {
+	return InventoryConsume(r.logger, r.db, userID, items)
+}
+
+// InventoryList returns everything in a user's inventory.
+func (r *Runtime) InventoryList(userID uuid.UUID) ([]*InventoryItem, error) {
+	return InventoryList(r.logger, r.db, userID)
+}
+
+// NodeLocalGet returns a value from this node's store of transient state, and false if the key is not set or expired.
+// The store is node-local, other nodes of a cluster have their own and never see its values.
+func (r *Runtime) NodeLocalGet(key string) (string, bool, error) {
+	return r.nodeLocalStore.Get(key)
+}
+
+// NodeLocalSet sets a key in the node-local store, expiring after the TTL or never if it is 0.
+func (r *Runtime) NodeLocalSet(key string, value string, ttl time.Duration) error {
+	return r.nodeLocalStore.Set(key, value, ttl)
+}
+
+// NodeLocalIncr adds delta to an integer in the node-local store and returns the result, a ttl above 0 resets the key's expiry.
+func (r *Runtime) NodeLocalIncr(key string, delta int64, ttl time.Duration) (int64, error) {
+	return r.nodeLocalStore.Incr(key, delta, ttl)
+}
+
+// TournamentCreate stores a new single elimination tournament, which the scheduler starts at its start time and ends
+// at its end time.
+func (r *Runtime) TournamentCreate(t *Tournament) (uuid.UUID, error) {
+	return TournamentCreate(r.logger, r.db, t)
+}
+
+// TournamentJoin adds a user to a tournament before it starts, if the tournament join function accepts them, and takes
+// the entry fee it asks for from their inventory with the join. It returns ErrTournamentClosed if it has started,
+// ErrTournamentFull if it has no places left, TournamentJoinRejectedError if the function rejects the join, or
+// ErrInventoryInsufficient if they cannot pay the fee.
+func (r *Runtime) TournamentJoin(id uuid.UUID, userID uuid.UUID, handle string, rating int64) error {
+	fee, err := RuntimeTournamentJoinHook(r.logger, r, id, userID, handle, rating)
+	if err != nil {
+		return err
 	}
+	return TournamentJoin(r.logger, r.db, id, userID, handle, rating, fee)
+}
 
-	return nil, errors.New("Runtime function returned invalid data. Only allowed one return value of type Table")
+// TournamentResult records the user as the winner of their match in the current round, and runs the tournament round
+// and end functions for any round it ended. It returns ErrTournamentNoMatch if the user has no match to win.
+func (r *Runtime) TournamentResult(id uuid.UUID, winnerID uuid.UUID) error {
+	progress, err := TournamentResult(r.logger, r.db, id, winnerID)
+	if err != nil {
+		return err
+	}
+	RuntimeTournamentHook(r.logger, r, id, progress)
+	return nil
 }
 
-func (r *Runtime) invokeFunction(l *lua.LState, fn *lua.LFunction, ctx *lua.LTable, payload lua.LValue) (lua.LValue, error) {
-	l.Push(lua.LString(__nakamaReturnValue))
-	l.Push(fn)
+// TournamentGet returns a tournament with its participants and matches, or ErrTournamentNotFound.
+func (r *Runtime) TournamentGet(id uuid.UUID) (*TournamentBracket, error) {
+	return TournamentGet(r.logger, r.db, id)
+}
 
-	nargs := 1
-	l.Push(ctx)
+// TournamentSchedule starts and ends tournaments that are due now rather than waiting for the scheduler.
+func (r *Runtime) TournamentSchedule() error {
+	return r.tournamentScheduler.Run()
+}
 
-	if payload != nil {
-		nargs = 2
-		l.Push(payload)
+func (r *Runtime) GetRuntimeMatch(module string) *lua.LTable {
+	cp := r.vm.Context().Value(CALLBACKS).(*Callbacks)
+	return cp.Match[strings.ToLower(module)]
+}
+
+// CreateMatch starts a new authoritative match using the handlers registered under the given module name.
+// The params are passed to the module's match_init function.
+func (r *Runtime) CreateMatch(module string, params map[string]interface{}) (string, error) {
+	matchID, err := r.matchRegistry.Create(r, module, params)
+	if err != nil {
+		return "", err
 	}
+	return matchID.String(), nil
+}
 
-	err := l.PCall(nargs, lua.MultRet, nil)
+// CreateCodedMatch creates a match and a short code players can share to find it, valid for ttl. The code does not make
+// the match private by itself, it is up to the match to keep it out of listings. The match is stopped again if no code
+// could be created for it. Like the match, the code only exists on this node, it resolves only here.
+func (r *Runtime) CreateCodedMatch(module string, params map[string]interface{}, ttl time.Duration) (string, string, error) {
+	if ttl <= 0 {
+		ttl = MatchCodeDefaultTTL
+	}
+	matchID, err := r.CreateMatch(module, params)
 	if err != nil {
-		return nil, err
+		return "", "", err
+	}
+	code, err := r.matchCodes.Create(matchID, ttl)
+	if err != nil {
+		if mh := r.matchRegistry.Get(uuid.FromStringOrNil(matchID)); mh != nil {
+			mh.Stop()
+		}
+		return "", "", err
 	}
+	return matchID, code, nil
+}
 
-	retValue := l.Get(-1)
-	if retValue.Type() == lua.LTString && lua.LVAsString(retValue) == __nakamaReturnValue {
-		return nil, nil
+// ResolveMatchCode returns the ID of the match a code was created for, if the code has not expired and the match is
+// still running. Codes of matches that have ended are dropped.
+func (r *Runtime) ResolveMatchCode(code string) (string, bool) {
+	matchID, ok := r.matchCodes.Resolve(code)
+	if !ok {
+		return "", false
+	}
+	if r.MatchGet(matchID) == nil {
+		r.matchCodes.Remove(code)
+		return "", false
 	}
+	return matchID, true
+}
 
-	return retValue, nil
+// MatchBroadcast sends match data to all presences in a match, or only to the given presences if any are listed.
+func (r *Runtime) MatchBroadcast(matchID string, opCode int64, data []byte, presences []Presence) error {
+	mid, err := uuid.FromString(matchID)
+	if err != nil {
+		return errors.New("invalid match ID")
+	}
+	return r.matchRegistry.Broadcast(mid, opCode, data, presences)
 }
 
-func (r *Runtime) Stop() {
+// NotificationCount returns how many unexpired stored notifications a user has, and how many of those are unread.
+// Only notifications with one of the given codes are counted if any are given.
+func (r *Runtime) NotificationCount(userID uuid.UUID, codes []int64) (int64, int64, error) {
+	return r.notificationService.NotificationCount(userID, codes)
+}
+
+// NotificationsMarkRead marks stored notifications belonging to a user as read.
+func (r *Runtime) NotificationsMarkRead(userID uuid.UUID, notificationIDs []uuid.UUID) error {
+	ids := make([][]byte, len(notificationIDs))
+	for i, id := range notificationIDs {
+		ids[i] = id.Bytes()
+	}
+	return r.notificationService.NotificationsMarkRead(userID, ids)
+}
+
+// ScheduleNotification stores a notification that is sent to the user at the given time in milliseconds, and returns
+// an ID that can be used to cancel it before then. The runtime notification function decides whether it is stored and
+// for how long when it is scheduled, any expiry counts from the delivery time.
+func (r *Runtime) ScheduleNotification(userID uuid.UUID, deliverAt int64, subject string, content []byte, code int64, persistent bool) (string, error) {
+	notification := &NNotification{
+		Id:         uuid.NewV4().Bytes(),
+		UserID:     userID.Bytes(),
+		Subject:    subject,
+		Content:    content,
+		Code:       code,
+		Persistent: persistent,
+		CreatedAt:  deliverAt,
+	}
+	if err := RuntimeNotificationHook(r.logger, r, []*NNotification{notification}); err != nil {
+		return "", err
+	}
+	if err := r.notificationService.NotificationSchedule(notification, deliverAt); err != nil {
+		return "", err
+	}
+	return uuid.FromBytesOrNil(notification.Id).String(), nil
+}
+
+// CancelScheduledNotification cancels a scheduled notification, and returns false if it was already sent or cancelled.
+func (r *Runtime) CancelScheduledNotification(notificationID string) (bool, error) {
+	id, err := uuid.FromString(notificationID)
+	if err != nil {
+		return false, errors.New("invalid notification ID")
+	}
+	return r.notificationService.NotificationScheduleCancel(id.Bytes())
+}
+
+// PushToUser sends a push to the live sessions of a user, and returns false if the user had no sessions. A push that
+// is not delivered is dropped, or buffered until the user connects if buffer is set.
+func (r *Runtime) PushToUser(userID uuid.UUID, id string, payload []byte, buffer bool) bool {
+	return r.pushService.Push(userID, id, payload, buffer)
+}
+
+// MatchLabelUpdate replaces the label of a match running on this node, later match listings see the new label.
+func (r *Runtime) MatchLabelUpdate(matchID string, label string) error {
+	mid, err := uuid.FromString(matchID)
+	if err != nil {
+		return errors.New("invalid match ID")
+	}
+	mh := r.matchRegistry.Get(mid)
+	if mh == nil {
+		return errors.New("match not found")
+	}
+	return mh.SetLabel(label)
+}
+
+// MatchGet returns a match running on this node, or nil if there is no such match.
+func (r *Runtime) MatchGet(matchID string) *MatchHandler {
+	mid, err := uuid.FromString(matchID)
+	if err != nil {
+		return nil
+	}
+	return r.matchRegistry.Get(mid)
+}
+
+// MatchState runs fn inside a match running on this node, between ticks and with exclusive access to the match state,
+// and returns its result. It returns ErrMatchNotFound if there is no such match.
+func (r *Runtime) MatchState(matchID string, fn func(vm *lua.LState, ctx *lua.LTable, state lua.LValue) (lua.LValue, interface{}, error)) (interface{}, error) {
+	mh := r.MatchGet(matchID)
+	if mh == nil {
+		return nil, ErrMatchNotFound
+	}
+	return mh.State(fn)
+}
+
+// MatchTimer runs fn inside a match running on this node once the delay has passed, between ticks and with exclusive
+// access to the match state. It returns the ID of the timer, which is cancelled if the match ends first. It returns
+// ErrMatchNotFound if there is no such match.
+func (r *Runtime) MatchTimer(matchID string, after time.Duration, fn func(vm *lua.LState, ctx *lua.LTable, state lua.LValue) (lua.LValue, error)) (int64, error) {
+	mh := r.MatchGet(matchID)
+	if mh == nil {
+		return 0, ErrMatchNotFound
+	}
+	return mh.Timer(after, fn)
+}
+
+// MatchTimerCancel cancels a pending match timer, and returns false if it already ran or was cancelled. It returns
+// ErrMatchNotFound if there is no such match.
+func (r *Runtime) MatchTimerCancel(matchID string, timerID int64) (bool, error) {
+	mh := r.MatchGet(matchID)
+	if mh == nil {
+		return false, ErrMatchNotFound
+	}
+	return mh.TimerCancel(timerID), nil
+}
+
+// MatchList returns up to limit matches running on this node, only those with the given label if it is not empty.
+func (r *Runtime) MatchList(limit int, label string) []*MatchHandler {
+	return r.matchRegistry.List(limit, label)
+}
+
+// MatchListVisible returns up to limit matches running on this node that the user may see, only those with the given
+// label if it is not empty, and how many such matches there are in total. Matches are narrowed by the registered match
+// list function, before the limit is applied so that pages are full and the total counts only visible matches. With
+// no user or no match list function all matches are visible.
+func (r *Runtime) MatchListVisible(userID uuid.UUID, limit int, label string) ([]*MatchHandler, int, error) {
+	matches := r.matchRegistry.List(r.matchRegistry.Count(), label)
+	if userID != uuid.Nil && r.vm.Context().Value(CALLBACKS).(*Callbacks).MatchList != nil {
+		var err error
+		if matches, err = r.InvokeFunctionMatchList(userID, matches); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	total := len(matches)
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches, total, nil
+}
+
+// InvokeFunctionRPC runs an RPC function like InvokeFunctionRPCWithFormat without an RPC ID, so a table it returns is
+// serialized in the default format, and returns only the response.
+func (r *Runtime) InvokeFunctionRPC(fn *lua.LFunction, uid uuid.UUID, handle string, sessionExpiry int64, payload []byte) ([]byte, error) {
+	result, _, err := r.InvokeFunctionRPCWithFormat(fn, "", uid, handle, sessionExpiry, payload)
+	return result, err
+}
+
+const (
+	RPC_FORMAT_JSON        = "json"
+	RPC_FORMAT_JSON_PRETTY = "json_pretty"
+)
+
+// InvokeFunctionRPCWithFormat runs the RPC function registered with the ID, and returns the response along with its
+// content type. The function may return a string, or a table serialized in the format its RPC was registered with.
+// The registered RPC serialize function, if any, then gets to post-process the response.
+func (r *Runtime) InvokeFunctionRPCWithFormat(fn *lua.LFunction, id string, uid uuid.UUID, handle string, sessionExpiry int64, payload []byte) ([]byte, string, error) {
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	ctx := NewLuaContext(l, r.luaEnv, RPC, uid, handle, sessionExpiry)
+	var lv lua.LValue
+	if payload != nil {
+		lv = lua.LString(payload)
+	}
+
+	retValue, err := r.invokeFunction(l, fn, ctx, lv)
+	if err != nil {
+		return nil, "", err
+	}
+
+	id = strings.ToLower(id)
+	format := r.vm.Context().Value(CALLBACKS).(*Callbacks).RPCFormat[id]
+	var result []byte
+	var contentType string
+	switch {
+	case retValue == nil || retValue == lua.LNil:
+	case retValue.Type() == lua.LTString:
+		result = []byte(retValue.String())
+	case retValue.Type() == lua.LTTable:
+		data, err := ConvertLuaValueMaxDepth(retValue, r.conversionMaxDepth)
+		if err != nil {
+			return nil, "", err
+		}
+		if format == RPC_FORMAT_JSON_PRETTY {
+			result, err = json.MarshalIndent(data, "", "  ")
+		} else {
+			result, err = json.Marshal(data)
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		contentType = "application/json"
+	default:
+		return nil, "", errors.New("Runtime function returned invalid data. Only allowed one return value of type String/Byte or Table")
+	}
+
+	if format == "" {
+		format = RPC_FORMAT_JSON
+	}
+	return r.InvokeFunctionRPCSerialize(uid, handle, sessionExpiry, id, format, contentType, result)
+}
+
+// InvokeFunctionRPCSerialize passes an RPC response through the registered RPC serialize function, which sees the RPC
+// ID, its format, the content type and the serialized payload. It returns a string to send instead, nil to keep the
+// payload, and optionally the content type of what it returned.
+func (r *Runtime) InvokeFunctionRPCSerialize(uid uuid.UUID, handle string, sessionExpiry int64, id, format, contentType string, payload []byte) ([]byte, string, error) {
+	fn := r.vm.Context().Value(CALLBACKS).(*Callbacks).RPCSerialize
+	if fn == nil {
+		return payload, contentType, nil
+	}
+
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	response := l.NewTable()
+	response.RawSetString("id", lua.LString(id))
+	response.RawSetString("format", lua.LString(format))
+	response.RawSetString("content_type", lua.LString(contentType))
+	if payload != nil {
+		response.RawSetString("payload", lua.LString(payload))
+	}
+
+	ctx := NewLuaContext(l, r.luaEnv, RPC_SERIALIZE, uid, handle, sessionExpiry)
+	base := l.GetTop()
+	retValue, err := r.invokeFunction(l, fn, ctx, response)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Results start after the return flag.
+	result := l.Get(base + 2)
+	if retValue == nil || result == lua.LNil {
+		return payload, contentType, nil
+	} else if result.Type() != lua.LTString {
+		return nil, "", errors.New("Runtime function returned invalid data. Expects a payload string or nil")
+	}
+	if l.GetTop()-base-1 >= 2 {
+		if ct := l.Get(base + 3); ct.Type() == lua.LTString {
+			contentType = lua.LVAsString(ct)
+		} else if ct != lua.LNil {
+			return nil, "", errors.New("Runtime function returned invalid data. Expects a content type string or nil")
+		}
+	}
+	return []byte(lua.LVAsString(result)), contentType, nil
+}
+
+func (r *Runtime) InvokeFunctionBefore(fn *lua.LFunction, uid uuid.UUID, handle string, sessionExpiry int64, clientVersion string, payload map[string]interface{}) (map[string]interface{}, error) {
+	result, writes, err := r.InvokeFunctionBeforeWithWrites(fn, uid, handle, sessionExpiry, clientVersion, payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(writes) != 0 {
+		return nil, errors.New("Runtime function returned storage writes, which are not supported for this message")
+	}
+	return result, nil
+}
+
+// InvokeFunctionBeforeWithWrites runs a before function that may return a list of side effect storage writes as a second return value.
+// Each write has the same structure as the data passed to `nakama.storage_write`.
+func (r *Runtime) InvokeFunctionBeforeWithWrites(fn *lua.LFunction, uid uuid.UUID, handle string, sessionExpiry int64, clientVersion string, payload map[string]interface{}) (map[string]interface{}, []*StorageData, error) {
+	return r.InvokeFunctionBeforeWithContext(fn, uid, handle, sessionExpiry, clientVersion, nil, payload)
+}
+
+// InvokeFunctionBeforeWithContext runs a before function like InvokeFunctionBeforeWithWrites, adding the given values to its context.
+func (r *Runtime) InvokeFunctionBeforeWithContext(fn *lua.LFunction, uid uuid.UUID, handle string, sessionExpiry int64, clientVersion string, ctxValues map[string]interface{}, payload map[string]interface{}) (map[string]interface{}, []*StorageData, error) {
+	result, writes, directive, err := r.InvokeFunctionBeforeWithStreams(fn, uid, handle, sessionExpiry, clientVersion, ctxValues, payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	if directive != nil {
+		return nil, nil, errors.New("Runtime function returned stream subscriptions, which are not supported for this message")
+	}
+	return result, writes, nil
+}
+
+// InvokeFunctionBeforeWithStreams runs a before function like InvokeFunctionBeforeWithContext. The function may return a
+// stream directive as a third return value, a table with optional `join` and `leave` lists of streams shaped like
+// `{mode = "room", subject = "lobby"}`. The side effect writes may be nil when a directive is returned.
+func (r *Runtime) InvokeFunctionBeforeWithStreams(fn *lua.LFunction, uid uuid.UUID, handle string, sessionExpiry int64, clientVersion string, ctxValues map[string]interface{}, payload map[string]interface{}) (map[string]interface{}, []*StorageData, *StreamDirective, error) {
+	return r.invokeFunctionBefore(nil, fn, uid, handle, sessionExpiry, clientVersion, ctxValues, payload)
+}
+
+// invokeFunctionBefore runs a before function like InvokeFunctionBeforeWithStreams, and runtime calls it makes become
+// children of the span if there is one.
+func (r *Runtime) invokeFunctionBefore(span *RuntimeSpan, fn *lua.LFunction, uid uuid.UUID, handle string, sessionExpiry int64, clientVersion string, ctxValues map[string]interface{}, payload map[string]interface{}) (map[string]interface{}, []*StorageData, *StreamDirective, error) {
+	l, _ := r.NewStateThread()
+	defer l.Close()
+	withTraceSpan(l, span)
+
+	ctx := NewLuaContext(l, r.luaEnv, BEFORE, uid, handle, sessionExpiry)
+	if clientVersion != "" {
+		ctx.RawSetString(__CTX_CLIENT_VERSION, lua.LString(clientVersion))
+	}
+	for k, v := range ctxValues {
+		ctx.RawSetString(k, convertValue(l, v))
+	}
+	lv, err := r.convertPayload(l, payload)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	base := l.GetTop()
+	retValue, err := r.invokeFunction(l, fn, ctx, lv)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Return values sit above the return flag, the envelope first followed by optional side effect writes and stream
+	// directive. Writes may be nil only when a directive follows them.
+	var writes []*StorageData
+	var directive *StreamDirective
+	retCount := l.GetTop() - base - 1
+	if retCount == 3 {
+		directiveTable, ok := l.Get(base + 4).(*lua.LTable)
+		if !ok {
+			return nil, nil, nil, errors.New("Runtime function returned invalid data. Stream subscriptions must be a Table")
+		}
+		if directive, err = convertLuaStreamDirective(directiveTable); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	if retCount >= 2 {
+		if writesValue := l.Get(base + 3); retCount == 2 || writesValue != lua.LNil {
+			writesTable, ok := writesValue.(*lua.LTable)
+			if !ok {
+				return nil, nil, nil, errors.New("Runtime function returned invalid data. Side effect storage writes must be a Table")
+			}
+			if writesTable.Len() != 0 {
+				if writes, err = convertLuaStorageWrites(writesTable); err != nil {
+					return nil, nil, nil, err
+				}
+			}
+		}
+		retValue = l.Get(base + 2)
+	}
+
+	if retValue == nil || retValue == lua.LNil {
+		return nil, writes, directive, nil
+	} else if retValue.Type() == lua.LTTable {
+		result, err := r.convertResult(retValue.(*lua.LTable))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return result, writes, directive, nil
+	}
+
+	return nil, nil, nil, errors.New("Runtime function returned invalid data. Only allowed one return value of type Table")
+}
+
+func (r *Runtime) InvokeFunctionAfter(fn *lua.LFunction, uid uuid.UUID, handle string, sessionExpiry int64, clientVersion string, sampleRate float64, payload map[string]interface{}) error {
+	return r.invokeFunctionAfter(nil, fn, uid, handle, sessionExpiry, clientVersion, sampleRate, payload)
+}
+
+// invokeFunctionAfter runs an after function like InvokeFunctionAfter, and runtime calls it makes become children of
+// the span if there is one.
+func (r *Runtime) invokeFunctionAfter(span *RuntimeSpan, fn *lua.LFunction, uid uuid.UUID, handle string, sessionExpiry int64, clientVersion string, sampleRate float64, payload map[string]interface{}) error {
+	l, _ := r.NewStateThread()
+	defer l.Close()
+	withTraceSpan(l, span)
+
+	ctx := NewLuaContext(l, r.luaEnv, AFTER, uid, handle, sessionExpiry)
+	if clientVersion != "" {
+		ctx.RawSetString(__CTX_CLIENT_VERSION, lua.LString(clientVersion))
+	}
+	if sampleRate < 1 {
+		ctx.RawSetString(__CTX_SAMPLED, lua.LTrue)
+		ctx.RawSetString(__CTX_SAMPLE_RATE, lua.LNumber(sampleRate))
+	}
+	lv, err := r.convertPayload(l, payload)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.invokeFunction(l, fn, ctx, lv)
+	return err
+}
+
+func (r *Runtime) InvokeFunctionTransform(fn *lua.LFunction, clientVersion string, payload map[string]interface{}) (map[string]interface{}, error) {
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	ctx := NewLuaContext(l, r.luaEnv, TRANSFORM, uuid.Nil, "", 0)
+	if clientVersion != "" {
+		ctx.RawSetString(__CTX_CLIENT_VERSION, lua.LString(clientVersion))
+	}
+	lv, err := r.convertPayload(l, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	retValue, err := r.invokeFunction(l, fn, ctx, lv)
+	if err != nil {
+		return nil, err
+	}
+
+	if retValue == nil || retValue == lua.LNil {
+		return nil, nil
+	} else if retValue.Type() == lua.LTTable {
+		return r.convertResult(retValue.(*lua.LTable))
+	}
+
+	return nil, errors.New("Runtime function returned invalid data. Only allowed one return value of type Table")
+}
+
+// InvokeFunctionMatchmakerMatched runs the registered matchmaker matched function for one recipient of a matchmaker result.
+// The function may return a table of properties to include in the result sent to that recipient. It returns nil if
+// no function is registered.
+func (r *Runtime) InvokeFunctionMatchmakerMatched(uid uuid.UUID, handle string, matched map[string]interface{}) (map[string]interface{}, error) {
+	fn := r.vm.Context().Value(CALLBACKS).(*Callbacks).Matched
+	if fn == nil {
+		return nil, nil
+	}
+
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	ctx := NewLuaContext(l, r.luaEnv, MATCHMAKER, uid, handle, 0)
+	retValue, err := r.invokeFunction(l, fn, ctx, ConvertMap(l, matched))
+	if err != nil {
+		return nil, err
+	}
+
+	if retValue == nil || retValue == lua.LNil {
+		return nil, nil
+	} else if retValue.Type() == lua.LTTable {
+		return ConvertLuaTableMaxDepth(retValue.(*lua.LTable), r.conversionMaxDepth)
+	}
+
+	return nil, errors.New("Runtime function returned invalid data. Only allowed one return value of type Table")
+}
+
+// InvokeFunctionAccount runs the registered account function on an account fetched by its owner. The function may
+// return a table of fields to add to the account metadata in the response. It returns nil if no function is registered.
+func (r *Runtime) InvokeFunctionAccount(uid uuid.UUID, handle string, sessionExpiry int64, account map[string]interface{}) (map[string]interface{}, error) {
+	fn := r.vm.Context().Value(CALLBACKS).(*Callbacks).Account
+	if fn == nil {
+		return nil, nil
+	}
+
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	ctx := NewLuaContext(l, r.luaEnv, ACCOUNT, uid, handle, sessionExpiry)
+	retValue, err := r.invokeFunction(l, fn, ctx, ConvertMap(l, account))
+	if err != nil {
+		return nil, err
+	}
+
+	if retValue == nil || retValue == lua.LNil {
+		return nil, nil
+	} else if retValue.Type() == lua.LTTable {
+		return ConvertLuaTableMaxDepth(retValue.(*lua.LTable), r.conversionMaxDepth)
+	}
+
+	return nil, errors.New("Runtime function returned invalid data. Only allowed one return value of type Table")
+}
+
+// InvokeFunctionMatchJoin runs the registered match join function before a user joins a match. The function may return
+// a table of metadata to set on the user's match presence, or false to reject the join with ErrMatchJoinRejected. It
+// returns nil if no function is registered.
+func (r *Runtime) InvokeFunctionMatchJoin(uid uuid.UUID, handle string, sessionExpiry int64, join map[string]interface{}) (map[string]interface{}, error) {
+	fn := r.vm.Context().Value(CALLBACKS).(*Callbacks).MatchJoin
+	if fn == nil {
+		return nil, nil
+	}
+
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	ctx := NewLuaContext(l, r.luaEnv, MATCH_JOIN, uid, handle, sessionExpiry)
+	retValue, err := r.invokeFunction(l, fn, ctx, ConvertMap(l, join))
+	if err != nil {
+		return nil, err
+	}
+
+	if retValue == nil || retValue == lua.LNil {
+		return nil, nil
+	} else if retValue == lua.LFalse {
+		return nil, ErrMatchJoinRejected
+	} else if retValue.Type() == lua.LTTable {
+		return ConvertLuaTableMaxDepth(retValue.(*lua.LTable), r.conversionMaxDepth)
+	}
+
+	return nil, errors.New("Runtime function returned invalid data. Only allowed one return value of type Table, or false")
+}
+
+// InvokeFunctionShutdown runs the registered shutdown function, passing it the deadline as a Unix time in milliseconds.
+// The function is interrupted if it runs past the deadline, and the shutdown proceeds regardless.
+func (r *Runtime) InvokeFunctionShutdown(timeout time.Duration) error {
+	fn := r.vm.Context().Value(CALLBACKS).(*Callbacks).Shutdown
+	if fn == nil {
+		return nil
+	}
+
+	l, _ := r.NewStateThread()
+	deadline := time.Now().Add(timeout)
+	ctx, cancel := context.WithDeadline(r.vm.Context(), deadline)
+	defer cancel()
+	l.SetContext(ctx)
+
+	luaCtx := NewLuaContext(l, r.luaEnv, SHUTDOWN, uuid.Nil, "", 0)
+	errCh := make(chan error, 1)
+	go func() {
+		defer l.Close()
+		_, err := r.invokeFunction(l, fn, luaCtx, lua.LNumber(timeToMs(deadline)))
+		errCh <- err
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return errors.New("Runtime shutdown function did not complete before the deadline")
+	}
+}
+
+// InvokeFunctionError runs the registered error function, which may rewrite the code and message of an error sent to a client.
+// It returns the original code and message unchanged if no error function is registered.
+func (r *Runtime) InvokeFunctionError(uid uuid.UUID, handle string, sessionExpiry int64, lang string, clientVersion string, code int32, message string) (int32, string, error) {
+	fn := r.vm.Context().Value(CALLBACKS).(*Callbacks).Error
+	if fn == nil {
+		return code, message, nil
+	}
+
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	ctx := NewLuaContext(l, r.luaEnv, ERROR, uid, handle, sessionExpiry)
+	if lang != "" {
+		ctx.RawSetString(__CTX_USER_LANG, lua.LString(lang))
+	}
+	if clientVersion != "" {
+		ctx.RawSetString(__CTX_CLIENT_VERSION, lua.LString(clientVersion))
+	}
+	lv := l.NewTable()
+	lv.RawSetString("code", lua.LNumber(code))
+	lv.RawSetString("message", lua.LString(message))
+
+	retValue, err := r.invokeFunction(l, fn, ctx, lv)
+	if err != nil {
+		return code, message, err
+	}
+
+	result, ok := retValue.(*lua.LTable)
+	if !ok {
+		return code, message, errors.New("Runtime function returned invalid data. Only allowed one return value of type Table")
+	}
+	newCode, ok := result.RawGetString("code").(lua.LNumber)
+	if !ok {
+		return code, message, errors.New("Runtime function returned invalid data. Error code must be a number")
+	}
+	newMessage, ok := result.RawGetString("message").(lua.LString)
+	if !ok {
+		return code, message, errors.New("Runtime function returned invalid data. Error message must be a string")
+	}
+
+	return int32(newCode), string(newMessage), nil
+}
+
+// InvokeFunctionHandle passes a proposed user handle through the registered handle function. The function returns the normalized
+// handle to store, or nil and a rejection reason. Without a handle function the proposed handle is returned unchanged.
+func (r *Runtime) InvokeFunctionHandle(uid uuid.UUID, handle string) (string, string, error) {
+	fn := r.vm.Context().Value(CALLBACKS).(*Callbacks).Handle
+	if fn == nil {
+		return handle, "", nil
+	}
+
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	ctx := NewLuaContext(l, r.luaEnv, HANDLE, uid, "", 0)
+	base := l.GetTop()
+	if _, err := r.invokeFunction(l, fn, ctx, lua.LString(handle)); err != nil {
+		return "", "", err
+	}
+
+	// Results start after the return flag.
+	normalized := l.Get(base + 2)
+	if normalized.Type() == lua.LTString && l.GetTop()-base-1 >= 1 {
+		if lua.LVAsString(normalized) == "" {
+			return "", "", errors.New("Runtime function returned an empty handle")
+		}
+		return lua.LVAsString(normalized), "", nil
+	}
+	if normalized == lua.LNil && l.GetTop()-base-1 >= 2 {
+		if reason := l.Get(base + 3); reason.Type() == lua.LTString {
+			return "", lua.LVAsString(reason), nil
+		}
+	}
+
+	return "", "", errors.New("Runtime function returned invalid data. Expects a handle string, or nil and a rejection reason string")
+}
+
+// InvokeFunctionRateLimitTier asks the registered rate limit tier function which tier a connecting user's session
+// belongs to. It returns an empty tier if there is no rate limit tier function.
+func (r *Runtime) InvokeFunctionRateLimitTier(uid uuid.UUID, handle string, sessionExpiry int64) (string, error) {
+	fn := r.vm.Context().Value(CALLBACKS).(*Callbacks).RateLimitTier
+	if fn == nil {
+		return "", nil
+	}
+
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	ctx := NewLuaContext(l, r.luaEnv, RATE_LIMIT_TIER, uid, handle, sessionExpiry)
+	retValue, err := r.invokeFunction(l, fn, ctx, nil)
+	if err != nil {
+		return "", err
+	}
+
+	if retValue == nil || retValue == lua.LNil {
+		return "", nil
+	} else if retValue.Type() == lua.LTString {
+		return lua.LVAsString(retValue), nil
+	}
+
+	return "", errors.New("Runtime function returned invalid data. Only allowed one return value of type String")
+}
+
+// IsRuntimeInventoryGrantRegistered reports whether an inventory grant function is registered.
+func (r *Runtime) IsRuntimeInventoryGrantRegistered() bool {
+	return r.vm.Context().Value(CALLBACKS).(*Callbacks).InventoryGrant != nil
+}
+
+// InvokeFunctionInventoryGrant asks the registered inventory grant function whether to accept a grant. The function
+// sees the user and the granted items, each with the count owned before the grant, and returns true or nil to accept,
+// or false and an optional reason to reject.
+func (r *Runtime) InvokeFunctionInventoryGrant(userID uuid.UUID, grants []*InventoryItem) (bool, string, error) {
+	fn := r.vm.Context().Value(CALLBACKS).(*Callbacks).InventoryGrant
+	if fn == nil {
+		return true, "", nil
+	}
+
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	itemsTable := l.NewTable()
+	for i, grant := range grants {
+		itemsTable.RawSetInt(i+1, inventoryItemToLuaTable(l, grant))
+	}
+	grantTable := l.NewTable()
+	grantTable.RawSetString("user_id", lua.LString(userID.String()))
+	grantTable.RawSetString("items", itemsTable)
+
+	ctx := NewLuaContext(l, r.luaEnv, INVENTORY_GRANT, uuid.Nil, "", 0)
+	base := l.GetTop()
+	retValue, err := r.invokeFunction(l, fn, ctx, grantTable)
+	if err != nil {
+		return false, "", err
+	}
+
+	// Results start after the return flag.
+	accepted := l.Get(base + 2)
+	if retValue == nil || accepted == lua.LNil || accepted == lua.LTrue {
+		return true, "", nil
+	} else if accepted == lua.LFalse {
+		reason := ""
+		if l.GetTop()-base-1 >= 2 {
+			reason = lua.LVAsString(l.Get(base + 3))
+		}
+		return false, reason, nil
+	}
+
+	return false, "", errors.New("Runtime function returned invalid data. Expects true, nil, or false and a reason")
+}
+
+// IsRuntimeMatchCreateRegistered reports whether a match create function is registered.
+func (r *Runtime) IsRuntimeMatchCreateRegistered() bool {
+	return r.vm.Context().Value(CALLBACKS).(*Callbacks).MatchCreate != nil
+}
+
+// InvokeFunctionMatchCreate asks the registered match create function about the parameters a client asked to create a
+// match with. The function sees the match module, empty for a relayed match, and the parameters, and returns a table
+// of parameters to create the match with instead, nil to keep the requested ones, or false and an optional reason to
+// reject them.
+func (r *Runtime) InvokeFunctionMatchCreate(uid uuid.UUID, handle string, sessionExpiry int64, module string, params map[string]interface{}) (map[string]interface{}, bool, string, error) {
+	fn := r.vm.Context().Value(CALLBACKS).(*Callbacks).MatchCreate
+	if fn == nil {
+		return nil, true, "", nil
+	}
+
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	create := l.NewTable()
+	create.RawSetString("module", lua.LString(module))
+	create.RawSetString("params", ConvertMap(l, params))
+
+	ctx := NewLuaContext(l, r.luaEnv, MATCH_CREATE, uid, handle, sessionExpiry)
+	base := l.GetTop()
+	retValue, err := r.invokeFunction(l, fn, ctx, create)
+	if err != nil {
+		return nil, false, "", err
+	}
+
+	// Results start after the return flag.
+	result := l.Get(base + 2)
+	if retValue == nil || result == lua.LNil {
+		return nil, true, "", nil
+	} else if result == lua.LFalse {
+		reason := ""
+		if l.GetTop()-base-1 >= 2 {
+			reason = lua.LVAsString(l.Get(base + 3))
+		}
+		return nil, false, reason, nil
+	} else if result.Type() == lua.LTTable {
+		sanitized, err := ConvertLuaTableMaxDepth(result.(*lua.LTable), r.conversionMaxDepth)
+		if err != nil {
+			return nil, false, "", err
+		}
+		return sanitized, true, "", nil
+	}
+
+	return nil, false, "", errors.New("Runtime function returned invalid data. Expects a table of parameters, nil, or false and a reason")
+}
+
+// IsRuntimeFriendRequestRegistered reports whether a friend request function is registered.
+func (r *Runtime) IsRuntimeFriendRequestRegistered() bool {
+	return r.vm.Context().Value(CALLBACKS).(*Callbacks).FriendRequest != nil
+}
+
+// InvokeFunctionFriendRequest asks the registered friend request function what to do with a user's friend request. The
+// function sees the target, how many requests they received in the last window on this node, and whether they have
+// blocked the sender, and returns "allow", "reject" or "drop", or nil to allow. It returns "allow" if there is no
+// friend request function.
+func (r *Runtime) InvokeFunctionFriendRequest(uid uuid.UUID, handle string, sessionExpiry int64, targetID uuid.UUID, recentRequests int64, blocked bool) (string, error) {
+	fn := r.vm.Context().Value(CALLBACKS).(*Callbacks).FriendRequest
+	if fn == nil {
+		return FRIEND_REQUEST_ALLOW, nil
+	}
+
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	request := l.NewTable()
+	request.RawSetString("target_id", lua.LString(targetID.String()))
+	request.RawSetString("recent_requests", lua.LNumber(recentRequests))
+	request.RawSetString("window_ms", lua.LNumber(friendRequestWindowMs))
+	request.RawSetString("blocked", lua.LBool(blocked))
+
+	ctx := NewLuaContext(l, r.luaEnv, FRIEND_REQUEST, uid, handle, sessionExpiry)
+	retValue, err := r.invokeFunction(l, fn, ctx, request)
+	if err != nil {
+		return "", err
+	}
+
+	if retValue == nil || retValue == lua.LNil {
+		return FRIEND_REQUEST_ALLOW, nil
+	} else if retValue.Type() == lua.LTString {
+		switch action := lua.LVAsString(retValue); action {
+		case FRIEND_REQUEST_ALLOW, FRIEND_REQUEST_REJECT, FRIEND_REQUEST_DROP:
+			return action, nil
+		}
+	}
+
+	return "", errors.New("Runtime function returned invalid data. Expects 'allow', 'reject', 'drop' or nil")
+}
+
+// IsRuntimeSessionDuplicateRegistered reports whether a session duplicate function is registered.
+func (r *Runtime) IsRuntimeSessionDuplicateRegistered() bool {
+	return r.vm.Context().Value(CALLBACKS).(*Callbacks).SessionDuplicate != nil
+}
+
+// InvokeFunctionSessionDuplicate asks the registered session duplicate function what to do with a user connecting while
+// they have active sessions on this node. The function sees the authentication type the session token was issued for,
+// the client IP and the active sessions, and returns "allow", "kick" or "reject", or nil to apply the configured policy.
+// It returns an empty policy if there is no session duplicate function.
+func (r *Runtime) InvokeFunctionSessionDuplicate(uid uuid.UUID, handle string, authType string, clientIP string, sessions []*SessionInfo) (string, error) {
+	fn := r.vm.Context().Value(CALLBACKS).(*Callbacks).SessionDuplicate
+	if fn == nil {
+		return "", nil
+	}
+
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	sessionsTable := l.NewTable()
+	for i, s := range sessions {
+		st := l.NewTable()
+		st.RawSetString("session_id", lua.LString(s.ID.String()))
+		st.RawSetString("created_at", lua.LNumber(s.CreatedAt))
+		st.RawSetString("client_ip", lua.LString(s.ClientIP))
+		sessionsTable.RawSetInt(i+1, st)
+	}
+	authTable := l.NewTable()
+	authTable.RawSetString("type", lua.LString(authType))
+	authTable.RawSetString("client_ip", lua.LString(clientIP))
+	authTable.RawSetString("sessions", sessionsTable)
+
+	// The user is known, but has no session yet.
+	ctx := NewLuaContext(l, r.luaEnv, SESSION_DUPLICATE, uid, handle, 0)
+	retValue, err := r.invokeFunction(l, fn, ctx, authTable)
+	if err != nil {
+		return "", err
+	}
+
+	if retValue == nil || retValue == lua.LNil {
+		return "", nil
+	} else if retValue.Type() == lua.LTString {
+		switch policy := lua.LVAsString(retValue); policy {
+		case SESSION_DUPLICATE_ALLOW, SESSION_DUPLICATE_KICK, SESSION_DUPLICATE_REJECT:
+			return policy, nil
+		}
+	}
+
+	return "", errors.New("Runtime function returned invalid data. Expects 'allow', 'kick', 'reject' or nil")
+}
+
+// InvokeFunctionSessionNode asks the registered session node function which node a connecting user's session should be
+// on. The function sees the current node and the names of all nodes, and returns a node name or nil to stay on the
+// current node. It returns an empty name if there is no session node function.
+func (r *Runtime) InvokeFunctionSessionNode(uid uuid.UUID, handle string, sessionExpiry int64, node string, nodes []string) (string, error) {
+	fn := r.vm.Context().Value(CALLBACKS).(*Callbacks).SessionNode
+	if fn == nil {
+		return "", nil
+	}
+
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	ctx := NewLuaContext(l, r.luaEnv, SESSION_NODE, uid, handle, sessionExpiry)
+	nodesTable := l.NewTable()
+	for _, name := range nodes {
+		nodesTable.Append(lua.LString(name))
+	}
+	cluster := l.NewTable()
+	cluster.RawSetString("node", lua.LString(node))
+	cluster.RawSetString("nodes", nodesTable)
+	retValue, err := r.invokeFunction(l, fn, ctx, cluster)
+	if err != nil {
+		return "", err
+	}
+
+	if retValue == nil || retValue == lua.LNil {
+		return "", nil
+	} else if retValue.Type() == lua.LTString {
+		return lua.LVAsString(retValue), nil
+	}
+
+	return "", errors.New("Runtime function returned invalid data. Only allowed one return value of type String")
+}
+
+// InvokeFunctionUserDataDelete runs a registered before or after user data delete function for the user.
+func (r *Runtime) InvokeFunctionUserDataDelete(fn *lua.LFunction, uid uuid.UUID) error {
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	ctx := NewLuaContext(l, r.luaEnv, USER_DATA_DELETE, uid, "", 0)
+	_, err := r.invokeFunction(l, fn, ctx, lua.LString(uid.String()))
+	return err
+}
+
+// InvokeFunctionTournament runs a registered tournament round or end function with the tournament bracket, and the
+// round that ended for round functions.
+func (r *Runtime) InvokeFunctionTournament(fn *lua.LFunction, bracket *TournamentBracket, round int) error {
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	event := l.NewTable()
+	event.RawSetString("tournament", tournamentBracketToLuaTable(l, bracket))
+	if round != 0 {
+		event.RawSetString("round", lua.LNumber(round))
+	}
+	ctx := NewLuaContext(l, r.luaEnv, TOURNAMENT, uuid.Nil, "", 0)
+	_, err := r.invokeFunction(l, fn, ctx, event)
+	return err
+}
+
+// InvokeFunctionTournamentJoin asks the registered tournament join function whether a user may join a tournament. The
+// function sees the tournament bracket, the user's rating and their inventory as item IDs to counts, and returns true
+// or nil to accept, optionally with a table of item IDs to counts to take as the entry fee, or false and an optional
+// reason to reject. A user joining again is never charged.
+func (r *Runtime) InvokeFunctionTournamentJoin(fn *lua.LFunction, bracket *TournamentBracket, uid uuid.UUID, handle string, rating int64, items []*InventoryItem) (map[string]int64, bool, string, error) {
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	inventory := l.NewTable()
+	for _, item := range items {
+		inventory.RawSetString(item.ItemID, lua.LNumber(item.Count))
+	}
+	join := l.NewTable()
+	join.RawSetString("tournament", tournamentBracketToLuaTable(l, bracket))
+	join.RawSetString("user_id", lua.LString(uid.String()))
+	join.RawSetString("handle", lua.LString(handle))
+	join.RawSetString("rating", lua.LNumber(rating))
+	join.RawSetString("inventory", inventory)
+
+	ctx := NewLuaContext(l, r.luaEnv, TOURNAMENT, uid, handle, 0)
+	base := l.GetTop()
+	retValue, err := r.invokeFunction(l, fn, ctx, join)
+	if err != nil {
+		return nil, false, "", err
+	}
+
+	// Results start after the return flag.
+	result := l.Get(base + 2)
+	if retValue == nil || result == lua.LNil {
+		return nil, true, "", nil
+	} else if result == lua.LFalse {
+		reason := ""
+		if l.GetTop()-base-1 >= 2 {
+			reason = lua.LVAsString(l.Get(base + 3))
+		}
+		return nil, false, reason, nil
+	} else if result == lua.LTrue {
+		if l.GetTop()-base-1 < 2 || l.Get(base+3) == lua.LNil {
+			return nil, true, "", nil
+		} else if feeTable, ok := l.Get(base + 3).(*lua.LTable); ok {
+			fee := make(map[string]int64)
+			invalid := false
+			feeTable.ForEach(func(k lua.LValue, v lua.LValue) {
+				count, ok := v.(lua.LNumber)
+				if !ok || k.Type() != lua.LTString {
+					invalid = true
+					return
+				}
+				fee[k.String()] = int64(count)
+			})
+			if !invalid {
+				return fee, true, "", nil
+			}
+		}
+	}
+
+	return nil, false, "", errors.New("Runtime function returned invalid data. Expects true and an optional table of item IDs to counts, nil, or false and a reason")
+}
+
+// InvokeFunctionPresenceRegion asks the registered presence region function for the region metadata of a connecting
+// session, given the IP it connects from and where the GeoIP database locates it. The function returns a table stored
+// on every presence of the session, or nil for none. It returns nil if there is no presence region function.
+func (r *Runtime) InvokeFunctionPresenceRegion(uid uuid.UUID, handle string, sessionExpiry int64, clientIP string) (map[string]interface{}, error) {
+	fn := r.vm.Context().Value(CALLBACKS).(*Callbacks).PresenceRegion
+	if fn == nil {
+		return nil, nil
+	}
+
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	ctx := NewLuaContext(l, r.luaEnv, PRESENCE_REGION, uid, handle, sessionExpiry)
+	connection := l.NewTable()
+	connection.RawSetString("ip", lua.LString(clientIP))
+	if record := r.GeoIPLookup(clientIP); record != nil {
+		connection.RawSetString("geoip", geoIPRecordToTable(l, record))
+	}
+	retValue, err := r.invokeFunction(l, fn, ctx, connection)
+	if err != nil {
+		return nil, err
+	}
+
+	if retValue == nil || retValue == lua.LNil {
+		return nil, nil
+	} else if lt, ok := retValue.(*lua.LTable); ok {
+		return ConvertLuaTableMaxDepth(lt, r.conversionMaxDepth)
+	}
+
+	return nil, errors.New("Runtime function returned invalid data. Only allowed one return value of type Table")
+}
+
+// InvokeFunctionMatchList asks the registered match list function which of the matches the user may see. The function
+// is given the matches and returns the ones to keep, in the order they should be listed. Matches it did not receive are
+// ignored.
+func (r *Runtime) InvokeFunctionMatchList(uid uuid.UUID, matches []*MatchHandler) ([]*MatchHandler, error) {
+	fn := r.vm.Context().Value(CALLBACKS).(*Callbacks).MatchList
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	ctx := NewLuaContext(l, r.luaEnv, MATCH_LIST, uid, "", 0)
+	byID := make(map[string]*MatchHandler, len(matches))
+	mt := l.CreateTable(len(matches), 0)
+	for i, mh := range matches {
+		byID[mh.ID.String()] = mh
+		mt.RawSetInt(i+1, matchToTable(l, mh))
+	}
+	retValue, err := r.invokeFunction(l, fn, ctx, mt)
+	if err != nil {
+		return nil, err
+	}
+
+	rt, ok := retValue.(*lua.LTable)
+	if !ok {
+		return nil, errors.New("Runtime function returned invalid data. Only allowed one return value of type Table")
+	}
+	visible := make([]*MatchHandler, 0, rt.Len())
+	rt.ForEach(func(k lua.LValue, v lua.LValue) {
+		if match, ok := v.(*lua.LTable); ok {
+			if mh, ok := byID[lua.LVAsString(match.RawGetString("match_id"))]; ok {
+				visible = append(visible, mh)
+				// Listed at most once, however many times the function returned it.
+				delete(byID, mh.ID.String())
+			}
+		}
+	})
+	return visible, nil
+}
+
+// IsRuntimeMessageTranslateRegistered reports whether a runtime message translate function is registered.
+func (r *Runtime) IsRuntimeMessageTranslateRegistered() bool {
+	return r.vm.Context().Value(CALLBACKS).(*Callbacks).MessageTranslate != nil
+}
+
+// InvokeFunctionMessageTranslate asks the registered message translate function for a variant of chat message data in
+// the target locale, given the message and the locale. The function returns new JSON data as a string, or nil to keep
+// the original. It returns nil data if there is no message translate function. It is only asked about recipients
+// connected to the node the message was sent on.
+func (r *Runtime) InvokeFunctionMessageTranslate(uid uuid.UUID, handle string, sessionExpiry int64, message map[string]interface{}) ([]byte, error) {
+	fn := r.vm.Context().Value(CALLBACKS).(*Callbacks).MessageTranslate
+	if fn == nil {
+		return nil, nil
+	}
+
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	ctx := NewLuaContext(l, r.luaEnv, MESSAGE_TRANSLATE, uid, handle, sessionExpiry)
+	retValue, err := r.invokeFunction(l, fn, ctx, ConvertMap(l, message))
+	if err != nil {
+		return nil, err
+	}
+
+	if retValue == nil || retValue == lua.LNil {
+		return nil, nil
+	} else if retValue.Type() == lua.LTString {
+		return []byte(lua.LVAsString(retValue)), nil
+	}
+
+	return nil, errors.New("Runtime function returned invalid data. Only allowed one return value of type String")
+}
+
+// InvokeFunctionQueueWorker runs a queue worker function for a job. The function receives the job ID, queue, attempt
+// number starting from 1, and payload. The job fails, and is retried or dead lettered, if the function raises an error
+// or returns false.
+func (r *Runtime) InvokeFunctionQueueWorker(fn *lua.LFunction, job *Job) error {
+	var payload map[string]interface{}
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return err
+	}
+
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	ctx := NewLuaContext(l, r.luaEnv, QUEUE_WORKER, uuid.Nil, "", 0)
+	jobTable := ConvertMap(l, map[string]interface{}{
+		"id":       uuid.FromBytesOrNil(job.Id).String(),
+		"queue":    job.Queue,
+		"attempts": job.Attempts,
+		"payload":  payload,
+	})
+	retValue, err := r.invokeFunction(l, fn, ctx, jobTable)
+	if err != nil {
+		return err
+	}
+
+	if retValue == lua.LFalse {
+		return errors.New("Runtime queue worker function returned false")
+	}
+	return nil
+}
+
+// InvokeFunctionStorageChange delivers a storage change to the storage change function registered for its collection,
+// with the record's values before and after the change, nil if there was no record. Returning false from the function
+// fails the delivery and it is retried, later changes to the same record wait until it succeeds. Changes to collections
+// without a function, recorded before it was removed, are dropped.
+func (r *Runtime) InvokeFunctionStorageChange(change *StorageChange, before, after []byte) error {
+	fn := r.vm.Context().Value(CALLBACKS).(*Callbacks).StorageChange[change.Bucket+"/"+change.Collection]
+	if fn == nil {
+		return nil
+	}
+
+	changeMap := map[string]interface{}{
+		"bucket":     change.Bucket,
+		"collection": change.Collection,
+		"record":     change.Record,
+		"op":         change.Op,
+		"created_at": change.CreatedAt,
+		"attempts":   change.Attempts,
+	}
+	if len(change.UserId) != 0 {
+		changeMap["user_id"] = uuid.FromBytesOrNil(change.UserId).String()
+	}
+	for key, value := range map[string][]byte{"before": before, "after": after} {
+		if value == nil {
+			continue
+		}
+		var decoded map[string]interface{}
+		if err := json.Unmarshal(value, &decoded); err != nil {
+			return err
+		}
+		changeMap[key] = decoded
+	}
+
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	ctx := NewLuaContext(l, r.luaEnv, STORAGE_CHANGE, uuid.Nil, "", 0)
+	retValue, err := r.invokeFunction(l, fn, ctx, ConvertMap(l, changeMap))
+	if err != nil {
+		return err
+	}
+
+	if retValue == lua.LFalse {
+		return errors.New("Runtime storage change function returned false")
+	}
+	return nil
+}
+
+// IsRuntimeAssetURLRegistered reports whether a runtime asset URL function is registered.
+func (r *Runtime) IsRuntimeAssetURLRegistered() bool {
+	return r.vm.Context().Value(CALLBACKS).(*Callbacks).AssetURL != nil
+}
+
+// InvokeFunctionAssetURL asks the registered asset URL function for a signed URL to a stored asset reference, such as
+// an avatar URL. The function returns the signed URL and how many seconds it stays valid for, or nil to leave the
+// reference as it is. It returns the reference unchanged, valid for no time, if there is no asset URL function.
+func (r *Runtime) InvokeFunctionAssetURL(uid uuid.UUID, handle string, sessionExpiry int64, reference string) (string, time.Duration, error) {
+	fn := r.vm.Context().Value(CALLBACKS).(*Callbacks).AssetURL
+	if fn == nil {
+		return reference, 0, nil
+	}
+
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	ctx := NewLuaContext(l, r.luaEnv, ASSET_URL, uid, handle, sessionExpiry)
+	base := l.GetTop()
+	if _, err := r.invokeFunction(l, fn, ctx, lua.LString(reference)); err != nil {
+		return "", 0, err
+	}
+
+	// Results start after the return flag.
+	results := l.GetTop() - base - 1
+	if results < 1 || l.Get(base+2) == lua.LNil {
+		return reference, 0, nil
+	}
+	url := l.Get(base + 2)
+	if url.Type() != lua.LTString {
+		return "", 0, errors.New("Runtime function returned invalid data. Expects a URL string and an optional validity in seconds")
+	}
+	var validity time.Duration
+	if results >= 2 {
+		if seconds, ok := l.Get(base + 3).(lua.LNumber); ok && seconds > 0 {
+			validity = time.Duration(float64(seconds) * float64(time.Second))
+		}
+	}
+	return lua.LVAsString(url), validity, nil
+}
+
+// IsRuntimeStorageListRegistered reports whether a runtime storage list function is registered.
+func (r *Runtime) IsRuntimeStorageListRegistered() bool {
+	return r.vm.Context().Value(CALLBACKS).(*Callbacks).StorageList != nil
+}
+
+// InvokeFunctionStorageList passes a storage listing, with the records it found under "records", through the registered
+// storage list function. The function returns virtual records to list alongside the stored ones, or nil to add none. Virtual records
+// take the listing's user ID, bucket and collection unless they set their own, and must match the listing. Their value
+// is a JSON string, as in storage writes, and they are never writable.
+func (r *Runtime) InvokeFunctionStorageList(uid uuid.UUID, handle string, sessionExpiry int64, userID []byte, bucket, collection string, limit int64, data []*StorageData) ([]*StorageData, error) {
+	fn := r.vm.Context().Value(CALLBACKS).(*Callbacks).StorageList
+	if fn == nil {
+		return nil, nil
+	}
+
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	query := map[string]interface{}{"bucket": bucket, "collection": collection, "limit": limit}
+	if len(userID) != 0 {
+		query["user_id"] = uuid.FromBytesOrNil(userID).String()
+	}
+	// Converting records rewrites their user IDs, so the function gets copies.
+	records := make([]*StorageData, len(data))
+	for i, d := range data {
+		c := *d
+		records[i] = &c
+	}
+	listing := ConvertMap(l, query)
+	listing.RawSetString("records", storageDataToTable(l, records))
+	ctx := NewLuaContext(l, r.luaEnv, STORAGE_LIST, uid, handle, sessionExpiry)
+	retValue, err := r.invokeFunction(l, fn, ctx, listing)
+	if err != nil {
+		return nil, err
+	}
+
+	if retValue == nil || retValue == lua.LNil {
+		return nil, nil
+	}
+	retTable, ok := retValue.(*lua.LTable)
+	if !ok {
+		return nil, errors.New("Runtime function returned invalid data. Only allowed one return value of type Table")
+	}
+	now := nowMs()
+	virtual := make([]*StorageData, 0, retTable.Len())
+	for i := 1; i <= retTable.Len(); i++ {
+		lt, ok := retTable.RawGetInt(i).(*lua.LTable)
+		if !ok {
+			return nil, errors.New("Runtime function returned invalid data. Virtual records must be tables")
+		}
+		d := &StorageData{
+			Bucket:         bucket,
+			Collection:     collection,
+			Record:         lua.LVAsString(lt.RawGetString("Record")),
+			UserId:         userID,
+			Value:          []byte(lua.LVAsString(lt.RawGetString("Value"))),
+			PermissionRead: 1,
+			CreatedAt:      now,
+			UpdatedAt:      now,
+		}
+		if lv := lt.RawGetString("Bucket"); lv.Type() == lua.LTString {
+			d.Bucket = lua.LVAsString(lv)
+		}
+		if lv := lt.RawGetString("Collection"); lv.Type() == lua.LTString {
+			d.Collection = lua.LVAsString(lv)
+		}
+		if lv := lt.RawGetString("UserId"); lv.Type() == lua.LTString {
+			recordUserID, err := uuid.FromString(lua.LVAsString(lv))
+			if err != nil {
+				return nil, errors.New("Runtime function returned invalid data. Virtual record user IDs must be valid")
+			}
+			d.UserId = recordUserID.Bytes()
+		}
+		if d.Bucket == "" || d.Collection == "" || d.Record == "" {
+			return nil, errors.New("Runtime function returned invalid data. Virtual records need a bucket, collection and record")
+		}
+		if (bucket != "" && d.Bucket != bucket) || (collection != "" && d.Collection != collection) || (len(userID) != 0 && !bytes.Equal(d.UserId, userID)) {
+			return nil, errors.New("Runtime function returned invalid data. Virtual records must match the listing")
+		}
+		if !json.Valid(d.Value) {
+			return nil, errors.New("Runtime function returned invalid data. Virtual record values must be JSON")
+		}
+		virtual = append(virtual, d)
+	}
+	return virtual, nil
+}
+
+// IsRuntimeMatchDataRegistered reports whether a runtime match data function is registered.
+func (r *Runtime) IsRuntimeMatchDataRegistered() bool {
+	return r.vm.Context().Value(CALLBACKS).(*Callbacks).MatchData != nil
+}
+
+// InvokeFunctionMatchData runs the registered match data function on a match data message a user sent. The message
+// carries the user's state in the match from the match data scratch space, and the function returns the new state, or
+// nil to clear it, and an optional action to take against the user, "flag" or "kick". It returns no action if there is
+// no match data function.
+func (r *Runtime) InvokeFunctionMatchData(uid uuid.UUID, handle string, sessionExpiry int64, matchID uuid.UUID, message map[string]interface{}) (string, error) {
+	fn := r.vm.Context().Value(CALLBACKS).(*Callbacks).MatchData
+	if fn == nil {
+		return "", nil
+	}
+
+	var action string
+	err := r.matchDataScratch.Update(matchID, uid, func(state map[string]interface{}) (map[string]interface{}, error) {
+		action = ""
+		l, _ := r.NewStateThread()
+		defer l.Close()
+
+		ctx := NewLuaContext(l, r.luaEnv, MATCH_DATA, uid, handle, sessionExpiry)
+		messageTable := ConvertMap(l, message)
+		messageTable.RawSetString("state", ConvertMap(l, state))
+		base := l.GetTop()
+		if _, err := r.invokeFunction(l, fn, ctx, messageTable); err != nil {
+			return nil, err
+		}
+
+		// Results start after the return flag.
+		results := l.GetTop() - base - 1
+		if results < 1 || l.Get(base+2) == lua.LNil {
+			return nil, nil
+		}
+		stateTable, ok := l.Get(base + 2).(*lua.LTable)
+		if !ok {
+			return nil, errors.New("Runtime function returned invalid data. Expects a state table and an optional action")
+		}
+		if results >= 2 && l.Get(base+3) != lua.LNil {
+			switch a := lua.LVAsString(l.Get(base + 3)); a {
+			case "flag", "kick":
+				action = a
+			default:
+				return nil, errors.New("Runtime function returned an invalid action. Expects flag or kick")
+			}
+		}
+		return ConvertLuaTableMaxDepth(stateTable, r.conversionMaxDepth)
+	})
+	return action, err
+}
+
+// KickMatchData clears the user's match data state in the match and keeps them from rejoining it until the kick
+// cooldown ends. Kicks are only known to this node.
+func (r *Runtime) KickMatchData(matchID, userID uuid.UUID) {
+	r.matchDataScratch.Kick(matchID, userID)
+}
+
+// IsMatchDataKicked reports whether the match data function kicked the user from the match and the cooldown has not
+// ended.
+func (r *Runtime) IsMatchDataKicked(matchID, userID uuid.UUID) bool {
+	return r.matchDataScratch.Kicked(matchID, userID)
+}
+
+// IsRuntimePresenceRegistered reports whether a runtime presence function is registered.
+func (r *Runtime) IsRuntimePresenceRegistered() bool {
+	return r.vm.Context().Value(CALLBACKS).(*Callbacks).Presence != nil
+}
+
+// InvokeFunctionPresence tells the registered presence function how many sessions a user has online after one or
+// more coalesced updates. A session count of 0 means the user went offline.
+func (r *Runtime) InvokeFunctionPresence(uid uuid.UUID, sessionCount int, updates int) error {
+	fn := r.vm.Context().Value(CALLBACKS).(*Callbacks).Presence
+	if fn == nil {
+		return nil
+	}
+
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	ctx := NewLuaContext(l, r.luaEnv, PRESENCE, uid, "", 0)
+	presence := ConvertMap(l, map[string]interface{}{
+		"user_id":       uid.String(),
+		"online":        sessionCount > 0,
+		"session_count": sessionCount,
+		"updates":       updates,
+	})
+	_, err := r.invokeFunction(l, fn, ctx, presence)
+	return err
+}
+
+// InvokeFunctionTopicJoin asks the registered topic join function whether a user may join a chat topic. The function
+// returns nil to allow the join, or a table with "allow" set to false and an optional "reason" to reject it, and
+// "muted" set to true to let the user join without sending messages. Joins are allowed if there is no function.
+func (r *Runtime) InvokeFunctionTopicJoin(uid uuid.UUID, handle string, sessionExpiry int64, topic map[string]interface{}) (bool, bool, string, error) {
+	fn := r.vm.Context().Value(CALLBACKS).(*Callbacks).TopicJoin
+	if fn == nil {
+		return true, false, "", nil
+	}
+
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	ctx := NewLuaContext(l, r.luaEnv, TOPIC_JOIN, uid, handle, sessionExpiry)
+	retValue, err := r.invokeFunction(l, fn, ctx, ConvertMap(l, topic))
+	if err != nil {
+		return false, false, "", err
+	}
+
+	if retValue == nil || retValue == lua.LNil {
+		return true, false, "", nil
+	} else if lt, ok := retValue.(*lua.LTable); ok {
+		allow := lt.RawGetString("allow") != lua.LFalse
+		muted := lua.LVAsBool(lt.RawGetString("muted"))
+		reason := ""
+		if lv := lt.RawGetString("reason"); lv.Type() == lua.LTString {
+			reason = lua.LVAsString(lv)
+		}
+		return allow, muted, reason, nil
+	}
+
+	return false, false, "", errors.New("Runtime function returned invalid data. Only allowed one return value of type Table")
+}
+
+// IsRuntimeLeaderboardRecordsRegistered reports whether a runtime leaderboard records function is registered.
+func (r *Runtime) IsRuntimeLeaderboardRecordsRegistered() bool {
+	return r.vm.Context().Value(CALLBACKS).(*Callbacks).LeaderboardRecords != nil
+}
+
+// InvokeFunctionLeaderboardRecords passes a page of leaderboard records about to be sent to a user through the
+// registered leaderboard records function. Each record carries the current profile of its owner, if one was found, and
+// the function returns the records in the same order. Only the handle, lang, location, timezone and metadata of the
+// returned records are copied back, the rest of each record cannot be changed.
+func (r *Runtime) InvokeFunctionLeaderboardRecords(uid uuid.UUID, handle string, sessionExpiry int64, records []*LeaderboardRecord, owners map[string]*User) error {
+	fn := r.vm.Context().Value(CALLBACKS).(*Callbacks).LeaderboardRecords
+	if fn == nil {
+		return nil
+	}
+
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	recordsTable := l.NewTable()
+	for i, record := range records {
+		lt := leaderboardRecordToLuaTable(l, record)
+		if owner, ok := owners[string(record.OwnerId)]; ok {
+			var metadata map[string]interface{}
+			json.Unmarshal(owner.Metadata, &metadata)
+			lt.RawSetString("owner", ConvertMap(l, map[string]interface{}{
+				"user_id":    uuid.FromBytesOrNil(owner.Id).String(),
+				"handle":     owner.Handle,
+				"fullname":   owner.Fullname,
+				"avatar_url": owner.AvatarUrl,
+				"lang":       owner.Lang,
+				"location":   owner.Location,
+				"timezone":   owner.Timezone,
+				"metadata":   metadata,
+			}))
+		}
+		recordsTable.RawSetInt(i+1, lt)
+	}
+	ctx := NewLuaContext(l, r.luaEnv, LEADERBOARD_RECORDS, uid, handle, sessionExpiry)
+	retValue, err := r.invokeFunction(l, fn, ctx, recordsTable)
+	if err != nil {
+		return err
+	}
+
+	if retValue == nil || retValue == lua.LNil {
+		return nil
+	}
+	retTable, ok := retValue.(*lua.LTable)
+	if !ok {
+		return errors.New("Runtime function returned invalid data. Only allowed one return value of type Table")
+	}
+	if retTable.Len() != len(records) {
+		return errors.New("Runtime function returned invalid data. Must return the same number of records it was given")
+	}
+
+	// Check every record before changing any, so a bad result leaves the whole page as it was.
+	decorated := make([]*LeaderboardRecord, len(records))
+	for i, record := range records {
+		lt, ok := retTable.RawGetInt(i + 1).(*lua.LTable)
+		if !ok {
+			return errors.New("Runtime function returned invalid data. Records must be tables")
+		}
+		d := *record
+		for field, dst := range map[string]*string{"handle": &d.Handle, "lang": &d.Lang, "location": &d.Location, "timezone": &d.Timezone} {
+			if v := lt.RawGetString(field); v.Type() == lua.LTString {
+				*dst = lua.LVAsString(v)
+			}
+		}
+		if mt, ok := lt.RawGetString("metadata").(*lua.LTable); ok {
+			data, err := ConvertLuaTableMaxDepth(mt, r.conversionMaxDepth)
+			if err != nil {
+				return err
+			}
+			metadata, err := json.Marshal(data)
+			if err != nil {
+				return err
+			}
+			d.Metadata = metadata
+		}
+		decorated[i] = &d
+	}
+	copy(records, decorated)
+	return nil
+}
+
+// IsRuntimeLeaderboardRecordUpdateRegistered reports whether a runtime leaderboard record update function is registered.
+func (r *Runtime) IsRuntimeLeaderboardRecordUpdateRegistered() bool {
+	return r.vm.Context().Value(CALLBACKS).(*Callbacks).LeaderboardRecordUpdate != nil
+}
+
+// InvokeFunctionLeaderboardRecordUpdate asks the registered leaderboard record update function which subscribers of a
+// leaderboard should receive a written record. The function returns a list of session IDs, or nil to send the record
+// to every subscriber. IDs that are not subscribed are ignored.
+func (r *Runtime) InvokeFunctionLeaderboardRecordUpdate(record *LeaderboardRecord, subscribers []Presence) ([]Presence, error) {
+	fn := r.vm.Context().Value(CALLBACKS).(*Callbacks).LeaderboardRecordUpdate
+	if fn == nil {
+		return subscribers, nil
+	}
+
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	bySession := make(map[string]Presence, len(subscribers))
+	subscribersTable := l.NewTable()
+	for i, p := range subscribers {
+		bySession[p.ID.SessionID.String()] = p
+		subscribersTable.RawSetInt(i+1, ConvertMap(l, map[string]interface{}{
+			"user_id":    p.UserID.String(),
+			"session_id": p.ID.SessionID.String(),
+			"handle":     p.Meta.Handle,
+		}))
+	}
+	ctx := NewLuaContext(l, r.luaEnv, LEADERBOARD_RECORD_UPDATE, uuid.Nil, "", 0)
+	update := l.NewTable()
+	update.RawSetString("record", leaderboardRecordToLuaTable(l, record))
+	update.RawSetString("subscribers", subscribersTable)
+	retValue, err := r.invokeFunction(l, fn, ctx, update)
+	if err != nil {
+		return nil, err
+	}
+
+	if retValue == nil || retValue == lua.LNil {
+		return subscribers, nil
+	} else if retValue.Type() == lua.LTTable {
+		recipients := make([]Presence, 0)
+		retValue.(*lua.LTable).ForEach(func(k lua.LValue, v lua.LValue) {
+			if p, ok := bySession[lua.LVAsString(v)]; ok {
+				recipients = append(recipients, p)
+				delete(bySession, lua.LVAsString(v))
+			}
+		})
+		return recipients, nil
+	}
+
+	return nil, errors.New("Runtime function returned invalid data. Only allowed one return value of type Table")
+}
+
+// StreamLeaderboardRecord sends a record written by the runtime to the sessions subscribed to its leaderboard.
+func (r *Runtime) StreamLeaderboardRecord(record *LeaderboardRecord) {
+	StreamLeaderboardRecord(r.logger, r, r.pushService.tracker, r.pushService.messageRouter, record)
+}
+
+// IsRuntimeLeaderboardTieBreakRegistered reports whether a runtime leaderboard tie-break function is registered.
+func (r *Runtime) IsRuntimeLeaderboardTieBreakRegistered() bool {
+	return r.vm.Context().Value(CALLBACKS).(*Callbacks).LeaderboardTieBreak != nil
+}
+
+// InvokeFunctionLeaderboardTieBreak asks the registered leaderboard tie-break function for the key that orders a record
+// just written among records with the same score, lower keys rank first on both ascending and descending leaderboards.
+// The function gets the record with its current key as "tie_break", and the score before the write as
+// "previous_score" unless the record is new. It returns the new key, or nil to keep the current one.
+func (r *Runtime) InvokeFunctionLeaderboardTieBreak(record, previous *LeaderboardRecord, tieBreak int64) (int64, error) {
+	fn := r.vm.Context().Value(CALLBACKS).(*Callbacks).LeaderboardTieBreak
+	if fn == nil {
+		return tieBreak, nil
+	}
+
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	recordTable := leaderboardRecordToLuaTable(l, record)
+	recordTable.RawSetString("tie_break", lua.LNumber(tieBreak))
+	if previous != nil {
+		recordTable.RawSetString("previous_score", lua.LNumber(previous.Score))
+	}
+	ctx := NewLuaContext(l, r.luaEnv, LEADERBOARD_TIE_BREAK, uuid.Nil, "", 0)
+	retValue, err := r.invokeFunction(l, fn, ctx, recordTable)
+	if err != nil {
+		return 0, err
+	}
+
+	if retValue == nil || retValue == lua.LNil {
+		return tieBreak, nil
+	}
+	key, ok := retValue.(lua.LNumber)
+	if !ok {
+		return 0, errors.New("Runtime function returned invalid data. Only allowed one return value of type Number")
+	}
+	return int64(key), nil
+}
+
+// InvokeFunctionGroupsList passes a page of groups listed by a user through the registered groups list function. The
+// function returns the groups to send in the order to send them, or nil to keep the page as it is. Returned groups are
+// matched to the page by ID, groups that were not in the page are ignored.
+func (r *Runtime) InvokeFunctionGroupsList(uid uuid.UUID, handle string, sessionExpiry int64, groups []*Group) ([]*Group, error) {
+	fn := r.vm.Context().Value(CALLBACKS).(*Callbacks).GroupsList
+	if fn == nil {
+		return groups, nil
+	}
+
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	groupsByID := make(map[string]*Group, len(groups))
+	groupsTable := l.NewTable()
+	for i, g := range groups {
+		groupID := uuid.FromBytesOrNil(g.Id).String()
+		groupsByID[groupID] = g
+		var metadata map[string]interface{}
+		json.Unmarshal(g.Metadata, &metadata)
+		groupsTable.RawSetInt(i+1, ConvertMap(l, map[string]interface{}{
+			"id":            groupID,
+			"private":       g.Private,
+			"creator_id":    uuid.FromBytesOrNil(g.CreatorId).String(),
+			"name":          g.Name,
+			"description":   g.Description,
+			"avatar_url":    g.AvatarUrl,
+			"lang":          g.Lang,
+			"utc_offset_ms": g.UtcOffsetMs,
+			"metadata":      metadata,
+			"count":         g.Count,
+			"created_at":    g.CreatedAt,
+			"updated_at":    g.UpdatedAt,
+		}))
+	}
+	ctx := NewLuaContext(l, r.luaEnv, GROUPS_LIST, uid, handle, sessionExpiry)
+	retValue, err := r.invokeFunction(l, fn, ctx, groupsTable)
+	if err != nil {
+		return nil, err
+	}
+
+	if retValue == nil || retValue == lua.LNil {
+		return groups, nil
+	}
+	retTable, ok := retValue.(*lua.LTable)
+	if !ok {
+		return nil, errors.New("Runtime function returned invalid data. Only allowed one return value of type Table")
+	}
+	result := make([]*Group, 0, retTable.Len())
+	for i := 1; i <= retTable.Len(); i++ {
+		lt, ok := retTable.RawGetInt(i).(*lua.LTable)
+		if !ok {
+			return nil, errors.New("Runtime function returned invalid data. Groups must be tables")
+		}
+		groupID := lua.LVAsString(lt.RawGetString("id"))
+		if g, ok := groupsByID[groupID]; ok {
+			result = append(result, g)
+			delete(groupsByID, groupID)
+		}
+	}
+	return result, nil
+}
+
+// IsRuntimeFriendPresenceRegistered reports whether a runtime friend presence function is registered.
+func (r *Runtime) IsRuntimeFriendPresenceRegistered() bool {
+	return r.vm.Context().Value(CALLBACKS).(*Callbacks).FriendPresence != nil
+}
+
+// InvokeFunctionFriendPresence asks the registered friend presence function which of a user's friends should see the
+// user come online or go offline. The function returns a list of user IDs, or nil to notify every friend. IDs that are
+// not in the given friends are ignored.
+func (r *Runtime) InvokeFunctionFriendPresence(uid uuid.UUID, online bool, friends []*User) ([]uuid.UUID, error) {
+	fn := r.vm.Context().Value(CALLBACKS).(*Callbacks).FriendPresence
+	if fn == nil {
+		return nil, nil
+	}
+
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	friendIDs := make(map[string]uuid.UUID, len(friends))
+	friendsTable := l.NewTable()
+	for i, f := range friends {
+		friendID := uuid.FromBytesOrNil(f.Id)
+		friendIDs[friendID.String()] = friendID
+		friendsTable.RawSetInt(i+1, ConvertMap(l, map[string]interface{}{
+			"user_id": friendID.String(),
+			"handle":  f.Handle,
+		}))
+	}
+	ctx := NewLuaContext(l, r.luaEnv, FRIEND_PRESENCE, uid, "", 0)
+	change := l.NewTable()
+	change.RawSetString("user_id", lua.LString(uid.String()))
+	change.RawSetString("online", lua.LBool(online))
+	change.RawSetString("friends", friendsTable)
+	retValue, err := r.invokeFunction(l, fn, ctx, change)
+	if err != nil {
+		return nil, err
+	}
+
+	if retValue == nil || retValue == lua.LNil {
+		ids := make([]uuid.UUID, 0, len(friendIDs))
+		for _, friendID := range friendIDs {
+			ids = append(ids, friendID)
+		}
+		return ids, nil
+	} else if retValue.Type() == lua.LTTable {
+		ids := make([]uuid.UUID, 0)
+		retValue.(*lua.LTable).ForEach(func(k lua.LValue, v lua.LValue) {
+			if friendID, ok := friendIDs[lua.LVAsString(v)]; ok {
+				ids = append(ids, friendID)
+				delete(friendIDs, friendID.String())
+			}
+		})
+		return ids, nil
+	}
+
+	return nil, errors.New("Runtime function returned invalid data. Only allowed one return value of type Table")
+}
+
+// InvokeFunctionNotification passes a notification about to be sent through the registered notification function. The
+// function may return whether the notification should be stored and its time to live in milliseconds, nil keeps the
+// notification's own setting for either value. A time to live of 0 means the notification never expires.
+func (r *Runtime) InvokeFunctionNotification(notification *NNotification) (bool, int64, error) {
+	fn := r.vm.Context().Value(CALLBACKS).(*Callbacks).Notification
+	if fn == nil {
+		return notification.Persistent, 0, nil
+	}
+
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	ctx := NewLuaContext(l, r.luaEnv, NOTIFICATION, uuid.FromBytesOrNil(notification.UserID), "", 0)
+	base := l.GetTop()
+	if _, err := r.invokeFunction(l, fn, ctx, notificationToLuaTable(l, notification)); err != nil {
+		return false, 0, err
+	}
+
+	// Results start after the return flag.
+	persistent := notification.Persistent
+	var ttl int64
+	if l.GetTop()-base-1 >= 1 {
+		switch v := l.Get(base + 2).(type) {
+		case lua.LBool:
+			persistent = bool(v)
+		case *lua.LNilType:
+		default:
+			return false, 0, errors.New("Runtime function returned invalid data. Expects a persistent boolean or nil")
+		}
+	}
+	if l.GetTop()-base-1 >= 2 {
+		switch v := l.Get(base + 3).(type) {
+		case lua.LNumber:
+			if v < 0 {
+				return false, 0, errors.New("Runtime function returned a negative time to live")
+			}
+			ttl = int64(v)
+		case *lua.LNilType:
+		default:
+			return false, 0, errors.New("Runtime function returned invalid data. Expects a time to live number or nil")
+		}
+	}
+
+	return persistent, ttl, nil
+}
+
+// IsRuntimeNotificationDeliveryRegistered reports whether a notification delivery function is registered.
+func (r *Runtime) IsRuntimeNotificationDeliveryRegistered() bool {
+	return r.vm.Context().Value(CALLBACKS).(*Callbacks).NotificationDelivery != nil
+}
+
+// InvokeFunctionNotificationDelivery asks the registered notification delivery function when a notification should
+// reach its recipient. The function sees the notification and its recipient's language, timezone, UTC offset and
+// metadata, or nil if the recipient was not found. It returns "deliver" or nil to send the notification now, "drop" to
+// discard it, or "defer" and a delivery time in milliseconds to send it later.
+func (r *Runtime) InvokeFunctionNotificationDelivery(notification *NNotification, recipient map[string]interface{}) (string, int64, error) {
+	fn := r.vm.Context().Value(CALLBACKS).(*Callbacks).NotificationDelivery
+	if fn == nil {
+		return NOTIFICATION_DELIVER, 0, nil
+	}
+
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	var recipientTable lua.LValue = lua.LNil
+	if recipient != nil {
+		recipientTable = ConvertMap(l, recipient)
+	}
+
+	ctx := NewLuaContext(l, r.luaEnv, NOTIFICATION_DELIVERY, uuid.FromBytesOrNil(notification.UserID), "", 0)
+	lt := notificationToLuaTable(l, notification)
+	lt.RawSetString("recipient", recipientTable)
+	base := l.GetTop()
+	retValue, err := r.invokeFunction(l, fn, ctx, lt)
+	if err != nil {
+		return "", 0, err
+	}
+
+	// Results start after the return flag.
+	result := l.Get(base + 2)
+	if retValue == nil || result == lua.LNil {
+		return NOTIFICATION_DELIVER, 0, nil
+	} else if result.Type() == lua.LTString {
+		switch action := lua.LVAsString(result); action {
+		case NOTIFICATION_DELIVER, NOTIFICATION_DROP:
+			return action, 0, nil
+		case NOTIFICATION_DEFER:
+			if l.GetTop()-base-1 >= 2 {
+				if deliverAt, ok := l.Get(base + 3).(lua.LNumber); ok && deliverAt > 0 {
+					return action, int64(deliverAt), nil
+				}
+			}
+			return "", 0, errors.New("Runtime function returned invalid data. Expects a delivery time in milliseconds after 'defer'")
+		}
+	}
+
+	return "", 0, errors.New("Runtime function returned invalid data. Expects 'deliver', 'defer', 'drop' or nil")
+}
+
+func notificationToLuaTable(l *lua.LState, notification *NNotification) *lua.LTable {
+	var content map[string]interface{}
+	json.Unmarshal(notification.Content, &content)
+	lt := l.NewTable()
+	lt.RawSetString("user_id", lua.LString(uuid.FromBytesOrNil(notification.UserID).String()))
+	lt.RawSetString("subject", lua.LString(notification.Subject))
+	lt.RawSetString("content", ConvertMap(l, content))
+	lt.RawSetString("code", lua.LNumber(notification.Code))
+	if len(notification.SenderID) != 0 {
+		lt.RawSetString("sender_id", lua.LString(uuid.FromBytesOrNil(notification.SenderID).String()))
+	}
+	lt.RawSetString("persistent", lua.LBool(notification.Persistent))
+	return lt
+}
+
+func (r *Runtime) InvokeFunctionHTTP(fn *lua.LFunction, uid uuid.UUID, handle string, sessionExpiry int64, payload map[string]interface{}) (map[string]interface{}, error) {
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	ctx := NewLuaContext(l, r.luaEnv, HTTP, uid, handle, sessionExpiry)
+	lv, err := r.convertPayload(l, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	retValue, err := r.invokeFunction(l, fn, ctx, lv)
+	if err != nil {
+		return nil, err
+	}
+
+	if retValue == nil || retValue == lua.LNil {
+		return nil, nil
+	} else if retValue.Type() == lua.LTTable {
+		return r.convertResult(retValue.(*lua.LTable))
+	}
+
+	return nil, errors.New("Runtime function returned invalid data. Only allowed one return value of type Table")
+}
+
+// convertPayload converts a message payload for a hook, rejecting payloads nested deeper than the configured limit.
+func (r *Runtime) convertPayload(l *lua.LState, payload map[string]interface{}) (lua.LValue, error) {
+	if payload == nil {
+		return nil, nil
+	}
+	return ConvertMapMaxDepth(l, payload, r.conversionMaxDepth)
+}
+
+// convertResult converts a table returned by a hook, rejecting tables nested deeper than the configured limit.
+func (r *Runtime) convertResult(lt *lua.LTable) (map[string]interface{}, error) {
+	return ConvertLuaTableMaxDepth(lt, r.conversionMaxDepth)
+}
+
+func (r *Runtime) invokeFunction(l *lua.LState, fn *lua.LFunction, ctx *lua.LTable, payload lua.LValue) (lua.LValue, error) {
+	l.Push(lua.LString(__nakamaReturnValue))
+	l.Push(fn)
+
+	nargs := 1
+	l.Push(ctx)
+
+	if payload != nil {
+		nargs = 2
+		l.Push(payload)
+	}
+
+	err := l.PCall(nargs, lua.MultRet, nil)
+	if err != nil {
+		return nil, runtimeValidationError(err)
+	}
+
+	retValue := l.Get(-1)
+	if retValue.Type() == lua.LTString && lua.LVAsString(retValue) == __nakamaReturnValue {
+		return nil, nil
+	}
+
+	return retValue, nil
+}
+
+// RuntimeValidationError is returned when a runtime function raises an error with a table of field names to messages,
+// such as `error({handle = "Handle is taken", lang = "Unsupported language"})`, to reject several fields at once.
+type RuntimeValidationError struct {
+	Fields map[string]string
+}
+
+func (e *RuntimeValidationError) Error() string {
+	fields := make([]string, 0, len(e.Fields))
+	for field := range e.Fields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for i, field := range fields {
+		fields[i] = field + ": " + e.Fields[field]
+	}
+	return "Validation failed: " + strings.Join(fields, ", ")
+}
+
+// runtimeValidationError converts errors raised with a table of string fields to string messages into validation
+// errors, any other error is returned unchanged.
+func runtimeValidationError(err error) error {
+	apiErr, ok := err.(*lua.ApiError)
+	if !ok {
+		return err
+	}
+	lt, ok := apiErr.Object.(*lua.LTable)
+	if !ok {
+		return err
+	}
+
+	fields := make(map[string]string)
+	valid := true
+	lt.ForEach(func(k lua.LValue, v lua.LValue) {
+		field, ok := k.(lua.LString)
+		message, mok := v.(lua.LString)
+		if !ok || !mok || field == "" {
+			valid = false
+			return
+		}
+		fields[string(field)] = string(message)
+	})
+	if !valid || len(fields) == 0 {
+		return err
+	}
+	return &RuntimeValidationError{Fields: fields}
+}
+
+// RunAsync queues a function to run on the runtime's bounded worker pool.
+// It returns false and drops the function if the queue is full or the runtime is stopping.
+func (r *Runtime) RunAsync(f func()) bool {
+	r.asyncMutex.RLock()
+	defer r.asyncMutex.RUnlock()
+	if r.asyncStopped {
+		return false
+	}
+	select {
+	case r.asyncQueue <- f:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *Runtime) Stop() {
+	for _, w := range r.jobWorkers {
+		w.Stop()
+	}
+	if r.storageChangeWorker != nil {
+		r.storageChangeWorker.Stop()
+	}
+	r.activeUsers.Stop()
+	r.tournamentScheduler.Stop()
+	r.oneTimeTokenSweeper.Stop()
+	r.asyncMutex.Lock()
+	if !r.asyncStopped {
+		r.asyncStopped = true
+		close(r.asyncQueue)
+	}
+	r.asyncMutex.Unlock()
+	r.asyncWg.Wait()
 	r.vm.Close()
+	r.tracer.Stop()
 }
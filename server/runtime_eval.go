@@ -0,0 +1,321 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+const (
+	runtimeEvalCacheSize = 1024
+	// runtimeEvalStringMaxBytes is the largest string the sandbox's string building library functions may return.
+	runtimeEvalStringMaxBytes = 1024 * 1024
+)
+
+// ErrEvalInstructionCap is returned when a snippet runs more instructions than the configured eval instruction cap.
+var ErrEvalInstructionCap = errors.New("Eval snippet ran past the instruction cap")
+
+// evalContext cancels a snippet once it has run the given number of instructions. The Lua VM checks its context
+// before every instruction, so each call to Done counts one.
+type evalContext struct {
+	context.Context
+	cancel    context.CancelFunc
+	remaining int64
+	capped    bool
+}
+
+func (c *evalContext) Done() <-chan struct{} {
+	if c.remaining--; c.remaining < 0 && !c.capped {
+		c.capped = true
+		c.cancel()
+	}
+	return c.Context.Done()
+}
+
+func (c *evalContext) Err() error {
+	if c.capped {
+		return ErrEvalInstructionCap
+	}
+	return c.Context.Err()
+}
+
+// Globals left in the sandbox once the base, table, string and math libraries are open. Anything that loads code,
+// touches the file system or inspects function environments is dropped, as is the global table itself. Library
+// functions that can build large strings are replaced by evalLimitStrings.
+var runtimeEvalGlobals = map[string]bool{
+	"_VERSION":     true,
+	"assert":       true,
+	"error":        true,
+	"getmetatable": true,
+	"ipairs":       true,
+	"next":         true,
+	"pairs":        true,
+	"pcall":        true,
+	"rawequal":     true,
+	"rawget":       true,
+	"rawset":       true,
+	"select":       true,
+	"setmetatable": true,
+	"tonumber":     true,
+	"tostring":     true,
+	"type":         true,
+	"unpack":       true,
+	"xpcall":       true,
+	"math":         true,
+	"string":       true,
+	"table":        true,
+}
+
+// RuntimeEvalCache holds compiled snippets keyed by a hash of their source. Compiled snippets hold no state, so one
+// can run in several sandboxes at once.
+type RuntimeEvalCache struct {
+	sync.Mutex
+	protos map[[sha256.Size]byte]*lua.FunctionProto
+}
+
+// NewRuntimeEvalCache creates an empty cache of compiled snippets.
+func NewRuntimeEvalCache() *RuntimeEvalCache {
+	return &RuntimeEvalCache{
+		protos: make(map[[sha256.Size]byte]*lua.FunctionProto),
+	}
+}
+
+// Compile returns the compiled form of a snippet. Snippets that are a single expression, such as
+// "player.level >= 10", are compiled as if they began with "return".
+func (c *RuntimeEvalCache) Compile(code string) (*lua.FunctionProto, error) {
+	key := sha256.Sum256([]byte(code))
+	c.Lock()
+	proto, ok := c.protos[key]
+	c.Unlock()
+	if ok {
+		return proto, nil
+	}
+
+	proto, err := compileEvalSnippet("return " + code)
+	if err != nil {
+		if proto, err = compileEvalSnippet(code); err != nil {
+			return nil, err
+		}
+	}
+
+	c.Lock()
+	if len(c.protos) >= runtimeEvalCacheSize {
+		// Drop an arbitrary entry, rules engines evaluate a small set of snippets so this rarely happens.
+		for k := range c.protos {
+			delete(c.protos, k)
+			break
+		}
+	}
+	c.protos[key] = proto
+	c.Unlock()
+	return proto, nil
+}
+
+func compileEvalSnippet(code string) (*lua.FunctionProto, error) {
+	chunk, err := parse.Parse(strings.NewReader(code), "<eval>")
+	if err != nil {
+		return nil, err
+	}
+	return lua.Compile(chunk, "<eval>")
+}
+
+// Eval runs a snippet of Lua in a fresh sandbox with the given env as its globals, and returns the snippet's first
+// return value. Sandboxes have no access to modules, the file system or the Nakama API, and snippets are interrupted
+// once they run past the configured eval timeout or instruction cap. Results nested deeper than the conversion depth
+// limit, or that contain themselves, are rejected.
+//
+// Time is bounded by the timeout and instruction cap, but memory is not bounded as such. string.rep, string.format and
+// table.concat fail rather than return more than 1MB, and string.gsub is not available, so no single library call can
+// allocate an arbitrary amount. The concatenation operator and table growth are only bounded by the instruction cap,
+// and each concatenation can double the largest string, so untrusted snippets must run with a small instruction cap.
+func (r *Runtime) Eval(code string, env map[string]interface{}) (interface{}, error) {
+	proto, err := r.evalCache.Compile(code)
+	if err != nil {
+		return nil, err
+	}
+
+	l := lua.NewState(lua.Options{
+		CallStackSize: 64,
+		RegistrySize:  1024,
+		SkipOpenLibs:  true,
+	})
+	defer l.Close()
+	for name, lib := range map[string]lua.LGFunction{
+		lua.BaseLibName:   lua.OpenBase,
+		lua.TabLibName:    lua.OpenTable,
+		lua.StringLibName: lua.OpenString,
+		lua.MathLibName:   lua.OpenMath,
+	} {
+		l.Push(l.NewFunction(lib))
+		l.Push(lua.LString(name))
+		l.Call(1, 0)
+	}
+	globals := l.G.Global
+	drop := make([]lua.LValue, 0)
+	globals.ForEach(func(k lua.LValue, v lua.LValue) {
+		if !runtimeEvalGlobals[lua.LVAsString(k)] {
+			drop = append(drop, k)
+		}
+	})
+	for _, k := range drop {
+		globals.RawSet(k, lua.LNil)
+	}
+	evalLimitStrings(l, globals)
+
+	if env != nil {
+		envTable, err := ConvertMapMaxDepth(l, env, r.conversionMaxDepth)
+		if err != nil {
+			return nil, err
+		}
+		envTable.ForEach(func(k lua.LValue, v lua.LValue) {
+			globals.RawSet(k, v)
+		})
+	}
+
+	// A timeout of 0 lets snippets run until they complete.
+	ctx, cancel := context.WithCancel(context.Background())
+	if r.evalTimeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), r.evalTimeout)
+	}
+	defer cancel()
+	// An instruction cap of 0 lets snippets run any number of instructions.
+	if r.evalInstructionCap > 0 {
+		ctx = &evalContext{Context: ctx, cancel: cancel, remaining: r.evalInstructionCap}
+	}
+	l.SetContext(ctx)
+
+	l.Push(&lua.LFunction{Env: globals, Proto: proto, Upvalues: make([]*lua.Upvalue, 0)})
+	if err := l.PCall(0, 1, nil); err != nil {
+		switch ctx.Err() {
+		case context.DeadlineExceeded:
+			return nil, errors.New("Eval snippet did not complete before the timeout")
+		case ErrEvalInstructionCap:
+			return nil, ErrEvalInstructionCap
+		}
+		return nil, err
+	}
+	return ConvertLuaValueMaxDepth(l.Get(-1), r.conversionMaxDepth)
+}
+
+// evalLimitStrings replaces the string building library functions of a sandbox with ones that fail instead of returning
+// strings larger than runtimeEvalStringMaxBytes. Strings share the string library table as their metatable index, so
+// method calls such as s:rep(n) are limited too.
+func evalLimitStrings(l *lua.LState, globals *lua.LTable) {
+	if stringLib, ok := globals.RawGetString("string").(*lua.LTable); ok {
+		// The result of gsub cannot be bounded before replacement functions and tables have run.
+		stringLib.RawSetString("gsub", lua.LNil)
+		stringLib.RawSetString("rep", l.NewFunction(evalStringRep))
+		if format, ok := stringLib.RawGetString("format").(*lua.LFunction); ok && format.IsG {
+			stringLib.RawSetString("format", l.NewFunction(evalStringFormat(format.GFunction)))
+		}
+	}
+	if tableLib, ok := globals.RawGetString("table").(*lua.LTable); ok {
+		if concat, ok := tableLib.RawGetString("concat").(*lua.LFunction); ok && concat.IsG {
+			tableLib.RawSetString("concat", l.NewFunction(evalTableConcat(concat.GFunction)))
+		}
+	}
+}
+
+func evalStringRep(l *lua.LState) int {
+	s := l.CheckString(1)
+	n := l.CheckInt(2)
+	if n <= 0 {
+		l.Push(lua.LString(""))
+		return 1
+	}
+	if len(s) > runtimeEvalStringMaxBytes/n {
+		l.RaiseError("string.rep result is larger than %v bytes", runtimeEvalStringMaxBytes)
+		return 0
+	}
+	l.Push(lua.LString(strings.Repeat(s, n)))
+	return 1
+}
+
+// evalStringFormat rejects widths and precisions over 2 digits, as Lua itself does, so the output is never much larger
+// than the format string and its arguments.
+func evalStringFormat(format lua.LGFunction) lua.LGFunction {
+	return func(l *lua.LState) int {
+		f := l.CheckString(1)
+		size := len(f)
+		for i := 0; i < len(f); i++ {
+			if f[i] != '%' {
+				continue
+			}
+			if i++; i < len(f) && f[i] == '%' {
+				continue
+			}
+			for i < len(f) && strings.IndexByte("-+ #0", f[i]) >= 0 {
+				i++
+			}
+			for _, part := range []string{"width", "precision"} {
+				digits := 0
+				for i < len(f) && f[i] >= '0' && f[i] <= '9' {
+					digits++
+					i++
+				}
+				if digits > 2 {
+					l.RaiseError("invalid format (%v too long)", part)
+					return 0
+				}
+				if part == "width" && i < len(f) && f[i] == '.' {
+					i++
+					continue
+				}
+				break
+			}
+		}
+		for i := 2; i <= l.GetTop(); i++ {
+			size += len(lua.LVAsString(l.Get(i))) + 99
+		}
+		if size > runtimeEvalStringMaxBytes {
+			l.RaiseError("string.format result is larger than %v bytes", runtimeEvalStringMaxBytes)
+			return 0
+		}
+		return format(l)
+	}
+}
+
+// evalTableConcat measures the strings it would join before joining them. Measuring stops at the first value that is
+// not a string or number, concat itself reports the error for it.
+func evalTableConcat(concat lua.LGFunction) lua.LGFunction {
+	return func(l *lua.LState) int {
+		t := l.CheckTable(1)
+		sep := l.OptString(2, "")
+		i := l.OptInt(3, 1)
+		j := l.OptInt(4, t.Len())
+		size := 0
+		for k := i; k <= j; k++ {
+			v := t.RawGetInt(k)
+			if v.Type() != lua.LTString && v.Type() != lua.LTNumber {
+				break
+			}
+			if size += len(lua.LVAsString(v)); k < j {
+				size += len(sep)
+			}
+			if size > runtimeEvalStringMaxBytes {
+				l.RaiseError("table.concat result is larger than %v bytes", runtimeEvalStringMaxBytes)
+				return 0
+			}
+		}
+		return concat(l)
+	}
+}
@@ -15,6 +15,7 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/satori/go.uuid"
@@ -30,6 +31,41 @@ const (
 	HTTP
 	JOB
 	LEADERBOARD_RESET
+	MATCH
+	TRANSFORM
+	READINESS
+	ERROR
+	HANDLE
+	NOTIFICATION
+	MATCHMAKER
+	SHUTDOWN
+	ACCOUNT
+	MATCH_JOIN
+	RATE_LIMIT_TIER
+	PRESENCE
+	FRIEND_PRESENCE
+	TOPIC_JOIN
+	LEADERBOARD_RECORDS
+	GROUPS_LIST
+	LEADERBOARD_RECORD_UPDATE
+	SESSION_NODE
+	MESSAGE_TRANSLATE
+	QUEUE_WORKER
+	ASSET_URL
+	USER_DATA_DELETE
+	MATCH_LIST
+	PRESENCE_REGION
+	MATCH_DATA
+	STORAGE_LIST
+	STORAGE_CHANGE
+	LEADERBOARD_TIE_BREAK
+	SESSION_DUPLICATE
+	INVENTORY_GRANT
+	TOURNAMENT
+	FRIEND_REQUEST
+	MATCH_CREATE
+	NOTIFICATION_DELIVERY
+	RPC_SERIALIZE
 )
 
 func (e ExecutionMode) String() string {
@@ -46,6 +82,76 @@ func (e ExecutionMode) String() string {
 		return "job"
 	case LEADERBOARD_RESET:
 		return "leaderboard_reset"
+	case MATCH:
+		return "match"
+	case TRANSFORM:
+		return "transform"
+	case READINESS:
+		return "readiness"
+	case ERROR:
+		return "error"
+	case HANDLE:
+		return "handle"
+	case NOTIFICATION:
+		return "notification"
+	case MATCHMAKER:
+		return "matchmaker"
+	case SHUTDOWN:
+		return "shutdown"
+	case ACCOUNT:
+		return "account"
+	case MATCH_JOIN:
+		return "match_join"
+	case RATE_LIMIT_TIER:
+		return "rate_limit_tier"
+	case PRESENCE:
+		return "presence"
+	case FRIEND_PRESENCE:
+		return "friend_presence"
+	case TOPIC_JOIN:
+		return "topic_join"
+	case LEADERBOARD_RECORDS:
+		return "leaderboard_records"
+	case GROUPS_LIST:
+		return "groups_list"
+	case LEADERBOARD_RECORD_UPDATE:
+		return "leaderboard_record_update"
+	case SESSION_NODE:
+		return "session_node"
+	case MESSAGE_TRANSLATE:
+		return "message_translate"
+	case QUEUE_WORKER:
+		return "queue_worker"
+	case ASSET_URL:
+		return "asset_url"
+	case USER_DATA_DELETE:
+		return "user_data_delete"
+	case MATCH_LIST:
+		return "match_list"
+	case PRESENCE_REGION:
+		return "presence_region"
+	case MATCH_DATA:
+		return "match_data"
+	case STORAGE_LIST:
+		return "storage_list"
+	case STORAGE_CHANGE:
+		return "storage_change"
+	case LEADERBOARD_TIE_BREAK:
+		return "leaderboard_tie_break"
+	case SESSION_DUPLICATE:
+		return "session_duplicate"
+	case INVENTORY_GRANT:
+		return "inventory_grant"
+	case TOURNAMENT:
+		return "tournament"
+	case FRIEND_REQUEST:
+		return "friend_request"
+	case MATCH_CREATE:
+		return "match_create"
+	case NOTIFICATION_DELIVERY:
+		return "notification_delivery"
+	case RPC_SERIALIZE:
+		return "rpc_serialize"
 	}
 
 	return ""
@@ -57,6 +163,19 @@ const (
 	__CTX_USER_ID          = "user_id"
 	__CTX_USER_HANDLE      = "user_handle"
 	__CTX_USER_SESSION_EXP = "user_session_exp"
+	__CTX_MATCH_ID         = "match_id"
+	__CTX_MATCH_MODULE     = "match_module"
+	__CTX_CLIENT_VERSION   = "client_version"
+	__CTX_USER_LANG        = "user_lang"
+	__CTX_SAMPLED          = "sampled"
+	__CTX_SAMPLE_RATE      = "sample_rate"
+	__CTX_STORAGE_COUNT    = "storage_usage_count"
+	__CTX_STORAGE_BYTES    = "storage_usage_bytes"
+	__CTX_USER_FLAGS       = "user_flags"
+	__CTX_PURCHASE_STORE   = "purchase_store"
+	__CTX_PURCHASE_PRODUCT = "purchase_product_id"
+	__CTX_PURCHASE_RECEIPT = "purchase_receipt"
+	__CTX_SEQUENCE_LAST    = "sequence_last"
 )
 
 func NewLuaContext(l *lua.LState, env *lua.LTable, mode ExecutionMode, uid uuid.UUID, handle string, sessionExpiry int64) *lua.LTable {
@@ -82,6 +201,83 @@ func ConvertMap(l *lua.LState, data map[string]interface{}) *lua.LTable {
 	return lt
 }
 
+// ErrConversionDepth is returned when data converted between Go and Lua is nested deeper than allowed.
+var ErrConversionDepth = errors.New("data is nested too deeply")
+
+// ConvertMapMaxDepth converts like ConvertMap, but fails without converting anything if the data is nested deeper than
+// maxDepth. The map itself is at depth 1, and a maxDepth of 0 means there is no limit.
+func ConvertMapMaxDepth(l *lua.LState, data map[string]interface{}, maxDepth int) (*lua.LTable, error) {
+	if maxDepth > 0 && valueDepthExceeds(data, 1, maxDepth) {
+		return nil, ErrConversionDepth
+	}
+	return ConvertMap(l, data), nil
+}
+
+// ConvertLuaTableMaxDepth converts like ConvertLuaTable, but fails if the table is nested deeper than maxDepth or
+// contains itself. A maxDepth of 0 means there is no limit on nesting.
+func ConvertLuaTableMaxDepth(lv *lua.LTable, maxDepth int) (map[string]interface{}, error) {
+	data, err := ConvertLuaValueMaxDepth(lv, maxDepth)
+	if err != nil {
+		return nil, err
+	}
+	returnData, _ := data.(map[string]interface{})
+	return returnData, nil
+}
+
+// ConvertLuaValueMaxDepth converts any Lua value like ConvertLuaTableMaxDepth does tables, so arrays and plain values
+// can be converted with the same guards.
+func ConvertLuaValueMaxDepth(lv lua.LValue, maxDepth int) (interface{}, error) {
+	if luaValueDepthExceeds(lv, 1, maxDepth, make(map[*lua.LTable]bool)) {
+		return nil, ErrConversionDepth
+	}
+	return convertLuaValue(lv), nil
+}
+
+func valueDepthExceeds(val interface{}, depth int, maxDepth int) bool {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		if depth > maxDepth {
+			return true
+		}
+		for _, e := range v {
+			if valueDepthExceeds(e, depth+1, maxDepth) {
+				return true
+			}
+		}
+	case []interface{}:
+		if depth > maxDepth {
+			return true
+		}
+		for _, e := range v {
+			if valueDepthExceeds(e, depth+1, maxDepth) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// luaValueDepthExceeds returns true if a value is nested deeper than maxDepth, or contains one of the tables on the path
+// to it.
+func luaValueDepthExceeds(lv lua.LValue, depth int, maxDepth int, path map[*lua.LTable]bool) bool {
+	lt, ok := lv.(*lua.LTable)
+	if !ok {
+		return false
+	}
+	if (maxDepth > 0 && depth > maxDepth) || path[lt] {
+		return true
+	}
+	path[lt] = true
+	exceeds := false
+	lt.ForEach(func(key, value lua.LValue) {
+		if !exceeds && luaValueDepthExceeds(value, depth+1, maxDepth, path) {
+			exceeds = true
+		}
+	})
+	delete(path, lt)
+	return exceeds
+}
+
 func ConvertLuaTable(lv *lua.LTable) map[string]interface{} {
 	returnData, _ := convertLuaValue(lv).(map[string]interface{})
 	return returnData
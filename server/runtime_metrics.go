@@ -0,0 +1,130 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+var (
+	runtimeMetricNameRegex = regexp.MustCompile(`^[a-z][a-z0-9_]*(\.[a-z][a-z0-9_]*)*$`)
+
+	errRuntimeMetricName        = errors.New("metric names must be lowercase dot separated segments of letters, digits and underscores")
+	errRuntimeMetricTag         = errors.New("metric tag keys and values must be non-empty and must not contain dots")
+	errRuntimeMetricCardinality = errors.New("metric has reached its limit of distinct tag combinations")
+)
+
+// RuntimeMetrics forwards metrics emitted by runtime scripts to the server's metrics sink.
+//
+// Metric names are lowercase, dot separated segments such as "purchase.completed" or "match.outcome", and each
+// segment may only contain letters, digits and underscores. All runtime metrics are emitted under the "runtime.custom"
+// prefix, followed by the name and then each tag key and value sorted by key, for example tags {mode = "ranked"} on
+// "match.outcome" emit "runtime.custom.match.outcome.mode.ranked".
+//
+// Each metric name can only be used with a limited number of distinct tag combinations, further combinations are
+// rejected to keep the number of series in the sink bounded. Prefer tags with a small fixed set of values, never
+// user IDs or other unbounded values.
+type RuntimeMetrics struct {
+	sync.Mutex
+	tagLimit int
+	tagSets  map[string]map[string]bool
+}
+
+// NewRuntimeMetrics creates a runtime metrics emitter allowing up to tagLimit distinct tag combinations per metric name,
+// or any number of them if tagLimit is 0 or less.
+func NewRuntimeMetrics(tagLimit int) *RuntimeMetrics {
+	return &RuntimeMetrics{
+		tagLimit: tagLimit,
+		tagSets:  make(map[string]map[string]bool),
+	}
+}
+
+// Counter increments a counter by the given value.
+func (m *RuntimeMetrics) Counter(name string, value float32, tags map[string]string) error {
+	key, err := m.key(name, tags)
+	if err != nil {
+		return err
+	}
+	metrics.IncrCounter(key, value)
+	return nil
+}
+
+// Gauge sets a gauge to the given value.
+func (m *RuntimeMetrics) Gauge(name string, value float32, tags map[string]string) error {
+	key, err := m.key(name, tags)
+	if err != nil {
+		return err
+	}
+	metrics.SetGauge(key, value)
+	return nil
+}
+
+// Timing records a duration sample, reported in milliseconds like other server timings.
+func (m *RuntimeMetrics) Timing(name string, value time.Duration, tags map[string]string) error {
+	key, err := m.key(name, tags)
+	if err != nil {
+		return err
+	}
+	metrics.AddSample(key, float32(value)/float32(time.Millisecond))
+	return nil
+}
+
+func (m *RuntimeMetrics) key(name string, tags map[string]string) ([]string, error) {
+	if !runtimeMetricNameRegex.MatchString(name) {
+		return nil, errRuntimeMetricName
+	}
+
+	tagKeys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		if k == "" || v == "" || strings.Contains(k, ".") || strings.Contains(v, ".") {
+			return nil, errRuntimeMetricTag
+		}
+		tagKeys = append(tagKeys, k)
+	}
+	sort.Strings(tagKeys)
+
+	tagKey := make([]string, 0, len(tagKeys)*2)
+	for _, k := range tagKeys {
+		tagKey = append(tagKey, k, tags[k])
+	}
+	tagSet := strings.Join(tagKey, ".")
+
+	key := append([]string{"runtime", "custom"}, strings.Split(name, ".")...)
+	if m.tagLimit <= 0 {
+		return append(key, tagKey...), nil
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	sets, ok := m.tagSets[name]
+	if !ok {
+		sets = make(map[string]bool)
+		m.tagSets[name] = sets
+	}
+	if !sets[tagSet] {
+		if len(sets) >= m.tagLimit {
+			return nil, errRuntimeMetricCardinality
+		}
+		sets[tagSet] = true
+	}
+	return append(key, tagKey...), nil
+}
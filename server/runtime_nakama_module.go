@@ -15,9 +15,11 @@
 package server
 
 import (
+	"bytes"
 	"context"
 
 	"strings"
+	"time"
 
 	"database/sql"
 
@@ -26,6 +28,9 @@ import (
 	"encoding/json"
 
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
+
 	"github.com/fatih/structs"
 	"github.com/satori/go.uuid"
 	"github.com/yuin/gopher-lua"
@@ -35,47 +40,217 @@ import (
 const CALLBACKS = "runtime_callbacks"
 
 type Callbacks struct {
-	HTTP   map[string]*lua.LFunction
-	RPC    map[string]*lua.LFunction
-	Before map[string]*lua.LFunction
-	After  map[string]*lua.LFunction
+	HTTP                    map[string]*lua.LFunction
+	RPC                     map[string]*lua.LFunction
+	RPCFormat               map[string]string
+	RPCSerialize            *lua.LFunction
+	Before                  map[string]*lua.LFunction
+	After                   map[string]*lua.LFunction
+	BeforeFallback          map[string]*lua.LFunction
+	BeforeUserFlags         map[string]bool
+	AfterFallback           map[string]*lua.LFunction
+	AfterSampleRate         map[string]float64
+	AfterLeaderOnly         map[string]bool
+	AfterExternal           map[string]bool
+	Transform               map[string]*lua.LFunction
+	Match                   map[string]*lua.LTable
+	Readiness               *lua.LFunction
+	Error                   *lua.LFunction
+	Handle                  *lua.LFunction
+	Notification            *lua.LFunction
+	Matched                 *lua.LFunction
+	Shutdown                *lua.LFunction
+	Account                 *lua.LFunction
+	MatchJoin               *lua.LFunction
+	RateLimitTier           *lua.LFunction
+	Presence                *lua.LFunction
+	FriendPresence          *lua.LFunction
+	TopicJoin               *lua.LFunction
+	LeaderboardRecords      *lua.LFunction
+	GroupsList              *lua.LFunction
+	LeaderboardRecordUpdate *lua.LFunction
+	SessionNode             *lua.LFunction
+	MessageTranslate        *lua.LFunction
+	AssetURL                *lua.LFunction
+	UserDataDeleteBefore    *lua.LFunction
+	UserDataDeleteAfter     *lua.LFunction
+	MatchList               *lua.LFunction
+	PresenceRegion          *lua.LFunction
+	MatchData               *lua.LFunction
+	StorageList             *lua.LFunction
+	LeaderboardTieBreak     *lua.LFunction
+	SessionDuplicate        *lua.LFunction
+	InventoryGrant          *lua.LFunction
+	TournamentRound         *lua.LFunction
+	TournamentEnd           *lua.LFunction
+	TournamentJoin          *lua.LFunction
+	FriendRequest           *lua.LFunction
+	MatchCreate             *lua.LFunction
+	NotificationDelivery    *lua.LFunction
+	StorageChange           map[string]*lua.LFunction
+	QueueWorker             map[string]*lua.LFunction
+	QueueWorkerConcurrency  map[string]int
+	QueueWorkerMaxAttempts  map[string]int64
 }
 
 type NakamaModule struct {
-	logger *zap.Logger
-	db     *sql.DB
+	logger  *zap.Logger
+	db      *sql.DB
+	runtime *Runtime
 }
 
-func NewNakamaModule(logger *zap.Logger, db *sql.DB, l *lua.LState) *NakamaModule {
+func NewNakamaModule(logger *zap.Logger, db *sql.DB, runtime *Runtime, l *lua.LState) *NakamaModule {
 	l.SetContext(context.WithValue(context.Background(), CALLBACKS, &Callbacks{
-		RPC:    make(map[string]*lua.LFunction),
-		Before: make(map[string]*lua.LFunction),
-		After:  make(map[string]*lua.LFunction),
-		HTTP:   make(map[string]*lua.LFunction),
+		RPC:                    make(map[string]*lua.LFunction),
+		RPCFormat:              make(map[string]string),
+		Before:                 make(map[string]*lua.LFunction),
+		After:                  make(map[string]*lua.LFunction),
+		BeforeFallback:         make(map[string]*lua.LFunction),
+		BeforeUserFlags:        make(map[string]bool),
+		AfterFallback:          make(map[string]*lua.LFunction),
+		AfterSampleRate:        make(map[string]float64),
+		AfterLeaderOnly:        make(map[string]bool),
+		AfterExternal:          make(map[string]bool),
+		Transform:              make(map[string]*lua.LFunction),
+		HTTP:                   make(map[string]*lua.LFunction),
+		Match:                  make(map[string]*lua.LTable),
+		StorageChange:          make(map[string]*lua.LFunction),
+		QueueWorker:            make(map[string]*lua.LFunction),
+		QueueWorkerConcurrency: make(map[string]int),
+		QueueWorkerMaxAttempts: make(map[string]int64),
 	}))
 	return &NakamaModule{
-		logger: logger,
-		db:     db,
+		logger:  logger,
+		db:      db,
+		runtime: runtime,
 	}
 }
 
 func (n *NakamaModule) Loader(l *lua.LState) int {
-	mod := l.SetFuncs(l.NewTable(), map[string]lua.LGFunction{
-		"logger_info":        n.loggerInfo,
-		"logger_warn":        n.loggerWarn,
-		"logger_error":       n.loggerError,
-		"register_rpc":       n.registerRPC,
-		"register_before":    n.registerBefore,
-		"register_after":     n.registerAfter,
-		"register_http":      n.registerHTTP,
-		"user_fetch_id":      n.userFetchId,
-		"user_fetch_handle":  n.userFetchHandle,
-		"storage_list":       n.storageList,
-		"storage_fetch":      n.storageFetch,
-		"storage_write":      n.storageWrite,
-		"storage_remove":     n.storageRemove,
-		"leaderboard_create": n.leaderboardCreate,
-	})
+	functions := map[string]lua.LGFunction{
+		"logger_info":                        n.loggerInfo,
+		"logger_warn":                        n.loggerWarn,
+		"logger_error":                       n.loggerError,
+		"register_rpc":                       n.registerRPC,
+		"register_before":                    n.registerBefore,
+		"register_after":                     n.registerAfter,
+		"register_before_fallback":           n.registerBeforeFallback,
+		"register_after_fallback":            n.registerAfterFallback,
+		"register_transform":                 n.registerTransform,
+		"register_http":                      n.registerHTTP,
+		"register_readiness":                 n.registerReadiness,
+		"register_error":                     n.registerError,
+		"register_handle":                    n.registerHandle,
+		"register_notification":              n.registerNotification,
+		"register_matchmaker_matched":        n.registerMatchmakerMatched,
+		"register_shutdown":                  n.registerShutdown,
+		"register_account":                   n.registerAccount,
+		"register_match_join":                n.registerMatchJoin,
+		"register_rate_limit_tier":           n.registerRateLimitTier,
+		"register_presence":                  n.registerPresence,
+		"register_friend_presence":           n.registerFriendPresence,
+		"register_topic_join":                n.registerTopicJoin,
+		"register_leaderboard_records":       n.registerLeaderboardRecords,
+		"register_groups_list":               n.registerGroupsList,
+		"register_leaderboard_record_update": n.registerLeaderboardRecordUpdate,
+		"register_session_node":              n.registerSessionNode,
+		"register_message_translate":         n.registerMessageTranslate,
+		"register_queue_worker":              n.registerQueueWorker,
+		"register_asset_url":                 n.registerAssetURL,
+		"register_user_data_delete":          n.registerUserDataDelete,
+		"register_match_list":                n.registerMatchList,
+		"register_presence_region":           n.registerPresenceRegion,
+		"register_match_data":                n.registerMatchData,
+		"register_storage_list":              n.registerStorageList,
+		"register_storage_change":            n.registerStorageChange,
+		"register_leaderboard_tie_break":     n.registerLeaderboardTieBreak,
+		"register_session_duplicate":         n.registerSessionDuplicate,
+		"register_inventory_grant":           n.registerInventoryGrant,
+		"register_tournament":                n.registerTournament,
+		"register_friend_request":            n.registerFriendRequest,
+		"register_match_create":              n.registerMatchCreate,
+		"register_notification_delivery":     n.registerNotificationDelivery,
+		"register_rpc_serialize":             n.registerRPCSerialize,
+		"cluster_leader":                     n.clusterLeader,
+		"register_match":                     n.registerMatch,
+		"match_create":                       n.matchCreate,
+		"match_create_coded":                 n.matchCreateCoded,
+		"match_code_resolve":                 n.matchCodeResolve,
+		"match_broadcast":                    n.matchBroadcast,
+		"match_label_update":                 n.matchLabelUpdate,
+		"match_get":                          n.matchGet,
+		"match_list":                         n.matchList,
+		"match_state":                        n.matchState,
+		"match_timer":                        n.matchTimer,
+		"match_timer_cancel":                 n.matchTimerCancel,
+		"notification_send":                  n.notificationSend,
+		"notification_count":                 n.notificationCount,
+		"notifications_mark_read":            n.notificationsMarkRead,
+		"notification_schedule":              n.notificationSchedule,
+		"notification_schedule_cancel":       n.notificationScheduleCancel,
+		"push_to_user":                       n.pushToUser,
+		"notification_send_query":            n.notificationSendQuery,
+		"notification_send_users":            n.notificationSendUsers,
+		"session_list":                       n.sessionList,
+		"session_revoke":                     n.sessionRevoke,
+		"queue_enqueue":                      n.queueEnqueue,
+		"one_time_token_create":              n.oneTimeTokenCreate,
+		"one_time_token_consume":             n.oneTimeTokenConsume,
+		"unique_claim":                       n.uniqueClaim,
+		"unique_release":                     n.uniqueRelease,
+		"cooldown_check":                     n.cooldownCheck,
+		"geoip_lookup":                       n.geoIPLookup,
+		"secure_random":                      n.secureRandom,
+		"rng_commit":                         n.rngCommit,
+		"rng_roll":                           n.rngRoll,
+		"rng_reveal":                         n.rngReveal,
+		"rng_verify":                         n.rngVerify,
+		"audit_log":                          n.auditLog,
+		"audit_log_verify":                   n.auditLogVerify,
+		"inventory_grant":                    n.inventoryGrant,
+		"inventory_consume":                  n.inventoryConsume,
+		"inventory_list":                     n.inventoryList,
+		"tournament_create":                  n.tournamentCreate,
+		"tournament_join":                    n.tournamentJoin,
+		"tournament_result":                  n.tournamentResult,
+		"tournament_get":                     n.tournamentGet,
+		"node_local_get":                     n.nodeLocalGet,
+		"node_local_set":                     n.nodeLocalSet,
+		"node_local_incr":                    n.nodeLocalIncr,
+		"eval":                               n.eval,
+		"user_fetch_id":                      n.userFetchId,
+		"user_fetch_handle":                  n.userFetchHandle,
+		"user_flags_get":                     n.userFlagsGet,
+		"user_flag_set":                      n.userFlagSet,
+		"user_data_export":                   n.userDataExport,
+		"user_data_delete":                   n.userDataDelete,
+		"friends_list":                       n.friendsList,
+		"friends_mutual":                     n.friendsMutual,
+		"channel_history":                    n.channelHistory,
+		"storage_list":                       n.storageList,
+		"storage_scan":                       n.storageScan,
+		"storage_set_op":                     n.storageSetOp,
+		"storage_fetch":                      n.storageFetch,
+		"storage_write":                      n.storageWrite,
+		"storage_remove":                     n.storageRemove,
+		"storage_stats":                      n.storageStats,
+		"leaderboard_create":                 n.leaderboardCreate,
+		"leaderboard_record_read_write":      n.leaderboardRecordReadWrite,
+		"leaderboard_rank":                   n.leaderboardRank,
+		"leaderboard_record_increment_decay": n.leaderboardRecordIncrementDecay,
+		"leaderboard_aggregate_register":     n.leaderboardAggregateRegister,
+		"leaderboard_aggregate_refresh":      n.leaderboardAggregateRefresh,
+		"active_users":                       n.activeUsers,
+		"metrics_counter":                    n.metricsCounter,
+		"metrics_gauge":                      n.metricsGauge,
+		"metrics_timing":                     n.metricsTiming,
+	}
+	if n.runtime.tracer != nil {
+		for name, fn := range functions {
+			functions[name] = n.runtime.tracer.traceFunction(name, fn)
+		}
+	}
+	mod := l.SetFuncs(l.NewTable(), functions)
 
 	l.Push(mod)
 	return 1
@@ -117,23 +292,30 @@ func (n *NakamaModule) loggerError(l *lua.LState) int {
 func (n *NakamaModule) registerRPC(l *lua.LState) int {
 	fn := l.CheckFunction(1)
 	id := l.CheckString(2)
+	format := l.OptString(3, RPC_FORMAT_JSON)
 
 	if id == "" {
 		l.ArgError(2, "expects rpc id")
 		return 0
 	}
+	if format != RPC_FORMAT_JSON && format != RPC_FORMAT_JSON_PRETTY {
+		l.ArgError(3, "expects format 'json' or 'json_pretty'")
+		return 0
+	}
 
 	id = strings.ToLower(id)
 
 	rc := l.Context().Value(CALLBACKS).(*Callbacks)
 	rc.RPC[id] = fn
-	n.logger.Info("Registered RPC function invocation", zap.String("id", id))
+	rc.RPCFormat[id] = format
+	n.logger.Info("Registered RPC function invocation", zap.String("id", id), zap.String("format", format))
 	return 0
 }
 
 func (n *NakamaModule) registerBefore(l *lua.LState) int {
 	fn := l.CheckFunction(1)
 	messageName := l.CheckString(2)
+	userFlags := l.OptBool(3, false)
 
 	if messageName == "" {
 		l.ArgError(2, "expects message name")
@@ -144,6 +326,11 @@ func (n *NakamaModule) registerBefore(l *lua.LState) int {
 
 	rc := l.Context().Value(CALLBACKS).(*Callbacks)
 	rc.Before[messageName] = fn
+	if userFlags {
+		rc.BeforeUserFlags[messageName] = true
+	} else {
+		delete(rc.BeforeUserFlags, messageName)
+	}
 	n.logger.Info("Registered Before function invocation", zap.String("message", messageName))
 	return 0
 }
@@ -151,17 +338,90 @@ func (n *NakamaModule) registerBefore(l *lua.LState) int {
 func (n *NakamaModule) registerAfter(l *lua.LState) int {
 	fn := l.CheckFunction(1)
 	messageName := l.CheckString(2)
+	sampleRate := float64(l.OptNumber(3, 1))
+	leaderOnly := l.OptBool(4, false)
+	external := l.OptBool(5, false)
 
 	if messageName == "" {
 		l.ArgError(2, "expects message name")
 		return 0
 	}
+	if sampleRate <= 0 || sampleRate > 1 {
+		l.ArgError(3, "expects sample rate greater than 0 and at most 1")
+		return 0
+	}
 
 	messageName = strings.ToLower(messageName)
 
 	rc := l.Context().Value(CALLBACKS).(*Callbacks)
 	rc.After[messageName] = fn
-	n.logger.Info("Registered After function invocation", zap.String("message", messageName))
+	if sampleRate < 1 {
+		rc.AfterSampleRate[messageName] = sampleRate
+	} else {
+		delete(rc.AfterSampleRate, messageName)
+	}
+	if leaderOnly {
+		rc.AfterLeaderOnly[messageName] = true
+	} else {
+		delete(rc.AfterLeaderOnly, messageName)
+	}
+	if external {
+		rc.AfterExternal[messageName] = true
+	} else {
+		delete(rc.AfterExternal, messageName)
+	}
+	n.logger.Info("Registered After function invocation", zap.String("message", messageName), zap.Float64("sample_rate", sampleRate), zap.Bool("leader_only", leaderOnly), zap.Bool("external", external))
+	return 0
+}
+
+func (n *NakamaModule) registerBeforeFallback(l *lua.LState) int {
+	fn := l.CheckFunction(1)
+	messageName := l.CheckString(2)
+
+	if messageName == "" {
+		l.ArgError(2, "expects message name")
+		return 0
+	}
+
+	messageName = strings.ToLower(messageName)
+
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.BeforeFallback[messageName] = fn
+	n.logger.Info("Registered Before Fallback function invocation", zap.String("message", messageName))
+	return 0
+}
+
+func (n *NakamaModule) registerAfterFallback(l *lua.LState) int {
+	fn := l.CheckFunction(1)
+	messageName := l.CheckString(2)
+
+	if messageName == "" {
+		l.ArgError(2, "expects message name")
+		return 0
+	}
+
+	messageName = strings.ToLower(messageName)
+
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.AfterFallback[messageName] = fn
+	n.logger.Info("Registered After Fallback function invocation", zap.String("message", messageName))
+	return 0
+}
+
+func (n *NakamaModule) registerTransform(l *lua.LState) int {
+	fn := l.CheckFunction(1)
+	messageName := l.CheckString(2)
+
+	if messageName == "" {
+		l.ArgError(2, "expects message name")
+		return 0
+	}
+
+	messageName = strings.ToLower(messageName)
+
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.Transform[messageName] = fn
+	n.logger.Info("Registered Transform function invocation", zap.String("message", messageName))
 	return 0
 }
 
@@ -187,228 +447,2041 @@ func (n *NakamaModule) registerHTTP(l *lua.LState) int {
 	return 0
 }
 
-func (n *NakamaModule) userFetchId(l *lua.LState) int {
-	lt := l.CheckTable(1)
-	userIds, ok := convertLuaValue(lt).([]interface{})
-	if !ok {
-		l.ArgError(1, "invalid user id data")
-		return 0
-	}
+func (n *NakamaModule) registerReadiness(l *lua.LState) int {
+	fn := l.CheckFunction(1)
 
-	userIdBytes := make([][]byte, 0)
-	for _, id := range userIds {
-		if ids, ok := id.(string); !ok {
-			l.ArgError(1, "each user id must be a string")
-			return 0
-		} else {
-			if uid, err := uuid.FromString(ids); err != nil {
-				l.ArgError(1, "invalid user id")
-				return 0
-			} else {
-				userIdBytes = append(userIdBytes, uid.Bytes())
-			}
-		}
-	}
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.Readiness = fn
+	n.logger.Info("Registered Readiness function invocation")
+	return 0
+}
 
-	users, err := UsersFetchIds(n.logger, n.db, userIdBytes)
-	if err != nil {
-		l.RaiseError(fmt.Sprintf("failed to retrieve users: %s", err.Error()))
-		return 0
-	}
+func (n *NakamaModule) registerError(l *lua.LState) int {
+	fn := l.CheckFunction(1)
 
-	//translate uuid to string bytes
-	lv := l.NewTable()
-	for i, u := range users {
-		uid, _ := uuid.FromBytes(u.Id)
-		u.Id = []byte(uid.String())
-		um := structs.Map(u)
-		lv.RawSetInt(i+1, convertValue(l, um))
-	}
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.Error = fn
+	n.logger.Info("Registered Error function invocation")
+	return 0
+}
 
-	l.Push(lv)
-	return 1
+func (n *NakamaModule) registerHandle(l *lua.LState) int {
+	fn := l.CheckFunction(1)
+
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.Handle = fn
+	n.logger.Info("Registered Handle function invocation")
+	return 0
 }
 
-func (n *NakamaModule) userFetchHandle(l *lua.LState) int {
-	lt := l.CheckTable(1)
-	handles, ok := convertLuaValue(lt).([]interface{})
-	if !ok {
-		l.ArgError(1, "invalid user handle data")
-		return 0
-	}
+func (n *NakamaModule) registerNotification(l *lua.LState) int {
+	fn := l.CheckFunction(1)
 
-	userHandles := make([]string, 0)
-	for _, h := range handles {
-		if hs, ok := h.(string); !ok {
-			l.ArgError(1, "invalid user handle data, each handle must be a string")
-			return 0
-		} else {
-			userHandles = append(userHandles, hs)
-		}
-	}
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.Notification = fn
+	n.logger.Info("Registered Notification function invocation")
+	return 0
+}
 
-	users, err := UsersFetchHandle(n.logger, n.db, userHandles)
-	if err != nil {
-		l.RaiseError(fmt.Sprintf("failed to retrieve users: %s", err.Error()))
-		return 0
-	}
+func (n *NakamaModule) registerMatchmakerMatched(l *lua.LState) int {
+	fn := l.CheckFunction(1)
 
-	//translate uuid to string bytes
-	lv := l.NewTable()
-	for i, u := range users {
-		uid, _ := uuid.FromBytes(u.Id)
-		u.Id = []byte(uid.String())
-		um := structs.Map(u)
-		lv.RawSetInt(i+1, convertValue(l, um))
-	}
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.Matched = fn
+	n.logger.Info("Registered Matchmaker Matched function invocation")
+	return 0
+}
 
-	l.Push(lv)
-	return 1
+func (n *NakamaModule) registerShutdown(l *lua.LState) int {
+	fn := l.CheckFunction(1)
+
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.Shutdown = fn
+	n.logger.Info("Registered Shutdown function invocation")
+	return 0
 }
 
-func (n *NakamaModule) storageList(l *lua.LState) int {
-	var userID []byte
-	if us := l.OptString(1, ""); us != "" {
-		if uid, err := uuid.FromString(us); err != nil {
-			l.ArgError(1, "expects a valid user ID or nil")
-			return 0
-		} else {
-			userID = uid.Bytes()
-		}
-	}
-	bucket := l.OptString(2, "")
-	collection := l.OptString(3, "")
-	limit := l.CheckInt64(4)
-	var cursor []byte
-	if cs := l.OptString(5, ""); cs != "" {
-		cb, err := base64.StdEncoding.DecodeString(cs)
-		if err != nil {
-			l.ArgError(5, "cursor is invalid")
-			return 0
-		}
-		cursor = cb
-	}
+func (n *NakamaModule) registerAccount(l *lua.LState) int {
+	fn := l.CheckFunction(1)
 
-	values, newCursor, _, err := StorageList(n.logger, n.db, uuid.Nil, userID, bucket, collection, limit, cursor)
-	if err != nil {
-		l.RaiseError(fmt.Sprintf("failed to list storage: %s", err.Error()))
-		return 0
-	}
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.Account = fn
+	n.logger.Info("Registered Account function invocation")
+	return 0
+}
 
-	// Convert and push the values.
-	lv := l.NewTable()
-	for i, v := range values {
-		// Convert UUIDs to string representation if needed.
-		if len(v.UserId) != 0 {
-			uid, _ := uuid.FromBytes(v.UserId)
-			v.UserId = []byte(uid.String())
-		}
-		vm := structs.Map(v)
-		lv.RawSetInt(i+1, convertValue(l, vm))
-	}
-	l.Push(lv)
+func (n *NakamaModule) registerMatchJoin(l *lua.LState) int {
+	fn := l.CheckFunction(1)
 
-	// Convert and push the new cursor, if any.
-	if len(newCursor) != 0 {
-		newCursorString := base64.StdEncoding.EncodeToString(newCursor)
-		l.Push(lua.LString(newCursorString))
-	} else {
-		l.Push(lua.LNil)
-	}
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.MatchJoin = fn
+	n.logger.Info("Registered Match Join function invocation")
+	return 0
+}
 
-	return 2
+func (n *NakamaModule) registerRateLimitTier(l *lua.LState) int {
+	fn := l.CheckFunction(1)
+
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.RateLimitTier = fn
+	n.logger.Info("Registered Rate Limit Tier function invocation")
+	return 0
 }
 
-func (n *NakamaModule) storageFetch(l *lua.LState) int {
-	keysTable := l.CheckTable(1)
-	if keysTable == nil || keysTable.Len() == 0 {
-		l.ArgError(1, "expects a valid set of keys")
-		return 0
-	}
-	keysRaw, ok := convertLuaValue(keysTable).([]interface{})
-	if !ok {
-		l.ArgError(1, "expects a valid set of data")
-		return 0
-	}
-	keyMap := make([]map[string]interface{}, 0)
-	for _, d := range keysRaw {
-		if m, ok := d.(map[string]interface{}); !ok {
-			l.ArgError(1, "expects a valid set of data")
-			return 0
-		} else {
-			keyMap = append(keyMap, m)
-		}
-	}
+func (n *NakamaModule) registerPresence(l *lua.LState) int {
+	fn := l.CheckFunction(1)
 
-	keys := make([]*StorageKey, len(keyMap))
-	idx := 0
-	for _, k := range keyMap {
-		var bucket string
-		if b, ok := k["Bucket"]; !ok {
-			l.ArgError(1, "expects a bucket in each key")
-			return 0
-		} else {
-			if bs, ok := b.(string); !ok {
-				l.ArgError(1, "bucket must be a string")
-				return 0
-			} else {
-				bucket = bs
-			}
-		}
-		var collection string
-		if c, ok := k["Collection"]; !ok {
-			l.ArgError(1, "expects a collection in each key")
-			return 0
-		} else {
-			if cs, ok := c.(string); !ok {
-				l.ArgError(1, "collection must be a string")
-				return 0
-			} else {
-				collection = cs
-			}
-		}
-		var record string
-		if r, ok := k["Record"]; !ok {
-			l.ArgError(1, "expects a record in each key")
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.Presence = fn
+	n.logger.Info("Registered Presence function invocation")
+	return 0
+}
+
+func (n *NakamaModule) registerFriendPresence(l *lua.LState) int {
+	fn := l.CheckFunction(1)
+
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.FriendPresence = fn
+	n.logger.Info("Registered Friend Presence function invocation")
+	return 0
+}
+
+func (n *NakamaModule) registerTopicJoin(l *lua.LState) int {
+	fn := l.CheckFunction(1)
+
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.TopicJoin = fn
+	n.logger.Info("Registered Topic Join function invocation")
+	return 0
+}
+
+func (n *NakamaModule) registerLeaderboardRecords(l *lua.LState) int {
+	fn := l.CheckFunction(1)
+
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.LeaderboardRecords = fn
+	n.logger.Info("Registered Leaderboard Records function invocation")
+	return 0
+}
+
+func (n *NakamaModule) registerGroupsList(l *lua.LState) int {
+	fn := l.CheckFunction(1)
+
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.GroupsList = fn
+	n.logger.Info("Registered Groups List function invocation")
+	return 0
+}
+
+func (n *NakamaModule) registerLeaderboardRecordUpdate(l *lua.LState) int {
+	fn := l.CheckFunction(1)
+
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.LeaderboardRecordUpdate = fn
+	n.logger.Info("Registered Leaderboard Record Update function invocation")
+	return 0
+}
+
+func (n *NakamaModule) registerSessionNode(l *lua.LState) int {
+	fn := l.CheckFunction(1)
+
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.SessionNode = fn
+	n.logger.Info("Registered Session Node function invocation")
+	return 0
+}
+
+func (n *NakamaModule) registerMessageTranslate(l *lua.LState) int {
+	fn := l.CheckFunction(1)
+
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.MessageTranslate = fn
+	n.logger.Info("Registered Message Translate function invocation")
+	return 0
+}
+
+func (n *NakamaModule) registerMatchList(l *lua.LState) int {
+	fn := l.CheckFunction(1)
+
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.MatchList = fn
+	n.logger.Info("Registered Match List function invocation")
+	return 0
+}
+
+func (n *NakamaModule) registerPresenceRegion(l *lua.LState) int {
+	fn := l.CheckFunction(1)
+
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.PresenceRegion = fn
+	n.logger.Info("Registered Presence Region function invocation")
+	return 0
+}
+
+func (n *NakamaModule) registerMatchData(l *lua.LState) int {
+	fn := l.CheckFunction(1)
+
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.MatchData = fn
+	n.logger.Info("Registered Match Data function invocation")
+	return 0
+}
+
+func (n *NakamaModule) registerStorageList(l *lua.LState) int {
+	fn := l.CheckFunction(1)
+
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.StorageList = fn
+	n.logger.Info("Registered Storage List function invocation")
+	return 0
+}
+
+func (n *NakamaModule) registerStorageChange(l *lua.LState) int {
+	fn := l.CheckFunction(1)
+	bucket := l.CheckString(2)
+	collection := l.CheckString(3)
+
+	if bucket == "" || collection == "" {
+		l.ArgError(2, "expects a bucket and collection")
+		return 0
+	}
+	// Change records are kept in the main database, they cannot commit together with writes to another backend.
+	if n.runtime.storageRouter.routed(bucket, collection) {
+		l.ArgError(2, "expects a collection in the main storage database")
+		return 0
+	}
+
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.StorageChange[bucket+"/"+collection] = fn
+	n.logger.Info("Registered Storage Change function invocation", zap.String("bucket", bucket), zap.String("collection", collection))
+	return 0
+}
+
+func (n *NakamaModule) registerLeaderboardTieBreak(l *lua.LState) int {
+	fn := l.CheckFunction(1)
+
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.LeaderboardTieBreak = fn
+	n.logger.Info("Registered Leaderboard Tie Break function invocation")
+	return 0
+}
+
+func (n *NakamaModule) registerSessionDuplicate(l *lua.LState) int {
+	fn := l.CheckFunction(1)
+
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.SessionDuplicate = fn
+	n.logger.Info("Registered Session Duplicate function invocation")
+	return 0
+}
+
+func (n *NakamaModule) registerInventoryGrant(l *lua.LState) int {
+	fn := l.CheckFunction(1)
+
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.InventoryGrant = fn
+	n.logger.Info("Registered Inventory Grant function invocation")
+	return 0
+}
+
+func (n *NakamaModule) registerUserDataDelete(l *lua.LState) int {
+	fn := l.CheckFunction(1)
+	phase := l.CheckString(2)
+
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	switch phase {
+	case "before":
+		rc.UserDataDeleteBefore = fn
+	case "after":
+		rc.UserDataDeleteAfter = fn
+	default:
+		l.ArgError(2, "expects before or after")
+		return 0
+	}
+	n.logger.Info("Registered User Data Delete function invocation", zap.String("phase", phase))
+	return 0
+}
+
+func (n *NakamaModule) registerTournament(l *lua.LState) int {
+	fn := l.CheckFunction(1)
+	event := l.CheckString(2)
+
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	switch event {
+	case "round":
+		rc.TournamentRound = fn
+	case "end":
+		rc.TournamentEnd = fn
+	case "join":
+		rc.TournamentJoin = fn
+	default:
+		l.ArgError(2, "expects round, end or join")
+		return 0
+	}
+	n.logger.Info("Registered Tournament function invocation", zap.String("event", event))
+	return 0
+}
+
+func (n *NakamaModule) registerFriendRequest(l *lua.LState) int {
+	fn := l.CheckFunction(1)
+
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.FriendRequest = fn
+	n.logger.Info("Registered Friend Request function invocation")
+	return 0
+}
+
+func (n *NakamaModule) registerMatchCreate(l *lua.LState) int {
+	fn := l.CheckFunction(1)
+
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.MatchCreate = fn
+	n.logger.Info("Registered Match Create function invocation")
+	return 0
+}
+
+func (n *NakamaModule) registerNotificationDelivery(l *lua.LState) int {
+	fn := l.CheckFunction(1)
+
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.NotificationDelivery = fn
+	n.logger.Info("Registered Notification Delivery function invocation")
+	return 0
+}
+
+func (n *NakamaModule) registerRPCSerialize(l *lua.LState) int {
+	fn := l.CheckFunction(1)
+
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.RPCSerialize = fn
+	n.logger.Info("Registered RPC Serialize function invocation")
+	return 0
+}
+
+func (n *NakamaModule) registerQueueWorker(l *lua.LState) int {
+	fn := l.CheckFunction(1)
+	queue := l.CheckString(2)
+	concurrency := l.OptInt(3, 1)
+	maxAttempts := l.OptInt64(4, 5)
+
+	if queue == "" {
+		l.ArgError(2, "expects queue name")
+		return 0
+	}
+	if concurrency < 1 || concurrency > 100 {
+		l.ArgError(3, "expects concurrency between 1 and 100")
+		return 0
+	}
+	if maxAttempts < 1 {
+		l.ArgError(4, "expects max attempts of at least 1")
+		return 0
+	}
+
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.QueueWorker[queue] = fn
+	rc.QueueWorkerConcurrency[queue] = concurrency
+	rc.QueueWorkerMaxAttempts[queue] = maxAttempts
+	n.logger.Info("Registered Queue Worker function invocation", zap.String("queue", queue), zap.Int("concurrency", concurrency), zap.Int64("max_attempts", maxAttempts))
+	return 0
+}
+
+func (n *NakamaModule) registerAssetURL(l *lua.LState) int {
+	fn := l.CheckFunction(1)
+
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.AssetURL = fn
+	n.logger.Info("Registered Asset URL function invocation")
+	return 0
+}
+
+func (n *NakamaModule) clusterLeader(l *lua.LState) int {
+	l.Push(lua.LString(n.runtime.clusterLeader.Leader()))
+	l.Push(lua.LBool(n.runtime.clusterLeader.IsLeader()))
+	return 2
+}
+
+func (n *NakamaModule) registerMatch(l *lua.LState) int {
+	handlers := l.CheckTable(1)
+	module := l.CheckString(2)
+
+	if module == "" {
+		l.ArgError(2, "expects match module name")
+		return 0
+	}
+	if _, ok := handlers.RawGetString(matchHandlerInit).(*lua.LFunction); !ok {
+		l.ArgError(1, "expects a match_init function in match handlers")
+		return 0
+	}
+	if _, ok := handlers.RawGetString(matchHandlerLoop).(*lua.LFunction); !ok {
+		l.ArgError(1, "expects a match_loop function in match handlers")
+		return 0
+	}
+
+	module = strings.ToLower(module)
+
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.Match[module] = handlers
+	n.logger.Info("Registered match handlers", zap.String("module", module))
+	return 0
+}
+
+func (n *NakamaModule) matchCreate(l *lua.LState) int {
+	module := l.CheckString(1)
+	params := l.OptTable(2, l.NewTable())
+
+	if module == "" {
+		l.ArgError(1, "expects match module name")
+		return 0
+	}
+
+	matchID, err := n.runtime.CreateMatch(module, ConvertLuaTable(params))
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to create match: %s", err.Error()))
+		return 0
+	}
+
+	l.Push(lua.LString(matchID))
+	return 1
+}
+
+func (n *NakamaModule) matchCreateCoded(l *lua.LState) int {
+	module := l.CheckString(1)
+	params := l.OptTable(2, l.NewTable())
+	ttl := l.OptInt64(3, 0)
+
+	if module == "" {
+		l.ArgError(1, "expects match module name")
+		return 0
+	} else if ttl < 0 {
+		l.ArgError(3, "expects a positive expiry in milliseconds")
+		return 0
+	}
+
+	matchID, code, err := n.runtime.CreateCodedMatch(module, ConvertLuaTable(params), time.Duration(ttl)*time.Millisecond)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to create match: %s", err.Error()))
+		return 0
+	}
+
+	l.Push(lua.LString(matchID))
+	l.Push(lua.LString(code))
+	return 2
+}
+
+func (n *NakamaModule) matchCodeResolve(l *lua.LState) int {
+	code := l.CheckString(1)
+
+	matchID, ok := n.runtime.ResolveMatchCode(code)
+	if !ok {
+		l.Push(lua.LNil)
+		return 1
+	}
+	l.Push(lua.LString(matchID))
+	return 1
+}
+
+func (n *NakamaModule) matchLabelUpdate(l *lua.LState) int {
+	matchID := l.CheckString(1)
+	label := l.OptString(2, "")
+
+	if matchID == "" {
+		l.ArgError(1, "expects match ID")
+		return 0
+	}
+
+	if err := n.runtime.MatchLabelUpdate(matchID, label); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to update match label: %s", err.Error()))
+	}
+	return 0
+}
+
+func (n *NakamaModule) matchGet(l *lua.LState) int {
+	matchID := l.CheckString(1)
+
+	mh := n.runtime.MatchGet(matchID)
+	if mh == nil {
+		l.Push(lua.LNil)
+		return 1
+	}
+	l.Push(matchToTable(l, mh))
+	return 1
+}
+
+func (n *NakamaModule) matchList(l *lua.LState) int {
+	limit := l.OptInt(1, 100)
+	label := l.OptString(2, "")
+	userID := uuid.Nil
+	if u := l.OptString(3, ""); u != "" {
+		var err error
+		if userID, err = uuid.FromString(u); err != nil {
+			l.ArgError(3, "expects a valid user ID")
+			return 0
+		}
+	}
+
+	if limit < 1 || limit > 100 {
+		l.ArgError(1, "expects limit to be 1-100")
+		return 0
+	}
+
+	list, total, err := n.runtime.MatchListVisible(userID, limit, label)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to list matches: %s", err.Error()))
+		return 0
+	}
+	matches := l.NewTable()
+	for i, mh := range list {
+		matches.RawSetInt(i+1, matchToTable(l, mh))
+	}
+	l.Push(matches)
+	l.Push(lua.LNumber(total))
+	return 2
+}
+
+func (n *NakamaModule) matchState(l *lua.LState) int {
+	matchID := l.CheckString(1)
+	fn := l.CheckFunction(2)
+
+	if ctx := l.Context(); ctx != nil && ctx.Value(MATCH_GOROUTINE) != nil {
+		// The match would wait on itself, or on a match that may be waiting on it.
+		l.RaiseError("match_state cannot be called from inside a match")
+		return 0
+	}
+
+	result, err := n.runtime.MatchState(matchID, func(vm *lua.LState, ctx *lua.LTable, state lua.LValue) (lua.LValue, interface{}, error) {
+		vm.Push(fn)
+		vm.Push(ctx)
+		vm.Push(state)
+		if err := vm.PCall(2, 2, nil); err != nil {
+			return nil, nil, err
+		}
+		newState, result := vm.Get(-2), vm.Get(-1)
+		vm.Pop(2)
+		return newState, convertLuaValue(result), nil
+	})
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to run match state function: %s", err.Error()))
+		return 0
+	}
+	l.Push(convertValue(l, result))
+	return 1
+}
+
+func (n *NakamaModule) matchTimer(l *lua.LState) int {
+	matchID := l.CheckString(1)
+	afterMs := l.CheckInt64(2)
+	fn := l.CheckFunction(3)
+
+	if afterMs < 0 {
+		l.ArgError(2, "expects a delay of 0 or more milliseconds")
+		return 0
+	}
+
+	id, err := n.runtime.MatchTimer(matchID, time.Duration(afterMs)*time.Millisecond, func(vm *lua.LState, ctx *lua.LTable, state lua.LValue) (lua.LValue, error) {
+		vm.Push(fn)
+		vm.Push(ctx)
+		vm.Push(state)
+		if err := vm.PCall(2, 1, nil); err != nil {
+			return nil, err
+		}
+		newState := vm.Get(-1)
+		vm.Pop(1)
+		return newState, nil
+	})
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to start match timer: %s", err.Error()))
+		return 0
+	}
+	l.Push(lua.LNumber(id))
+	return 1
+}
+
+func (n *NakamaModule) matchTimerCancel(l *lua.LState) int {
+	matchID := l.CheckString(1)
+	timerID := l.CheckInt64(2)
+
+	cancelled, err := n.runtime.MatchTimerCancel(matchID, timerID)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to cancel match timer: %s", err.Error()))
+		return 0
+	}
+	l.Push(lua.LBool(cancelled))
+	return 1
+}
+
+func matchToTable(l *lua.LState, mh *MatchHandler) *lua.LTable {
+	mt := l.NewTable()
+	mt.RawSetString("match_id", lua.LString(mh.ID.String()))
+	mt.RawSetString("module", lua.LString(mh.Module))
+	mt.RawSetString("label", lua.LString(mh.Label()))
+	return mt
+}
+
+func (n *NakamaModule) matchBroadcast(l *lua.LState) int {
+	matchID := l.CheckString(1)
+	opCode := l.CheckInt64(2)
+	data := l.OptString(3, "")
+	presencesTable := l.OptTable(4, nil)
+
+	if matchID == "" {
+		l.ArgError(1, "expects match ID")
+		return 0
+	}
+
+	var presences []Presence
+	if presencesTable != nil {
+		presences = make([]Presence, 0, presencesTable.Len())
+		var conversionError string
+		presencesTable.ForEach(func(k lua.LValue, v lua.LValue) {
+			if conversionError != "" {
+				return
+			}
+			pt, ok := v.(*lua.LTable)
+			if !ok {
+				conversionError = "expects presences to be tables"
+				return
+			}
+			userID := uuid.FromStringOrNil(pt.RawGetString("user_id").String())
+			sessionID := uuid.FromStringOrNil(pt.RawGetString("session_id").String())
+			if userID == uuid.Nil || sessionID == uuid.Nil {
+				conversionError = "expects each presence to have a valid user_id and session_id"
+				return
+			}
+			presences = append(presences, Presence{ID: PresenceID{SessionID: sessionID}, UserID: userID})
+		})
+		if conversionError != "" {
+			l.ArgError(4, conversionError)
+			return 0
+		}
+	}
+
+	if err := n.runtime.MatchBroadcast(matchID, opCode, []byte(data), presences); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to broadcast match data: %s", err.Error()))
+	}
+	return 0
+}
+
+func (n *NakamaModule) notificationSend(l *lua.LState) int {
+	userID := l.CheckString(1)
+	subject := l.CheckString(2)
+	content := l.OptTable(3, l.NewTable())
+	code := l.CheckInt64(4)
+	senderID := l.OptString(5, "")
+	persistent := l.OptBool(6, true)
+
+	uid, err := uuid.FromString(userID)
+	if err != nil {
+		l.ArgError(1, "expects a valid user ID")
+		return 0
+	}
+	if subject == "" {
+		l.ArgError(2, "expects a subject string")
+		return 0
+	}
+	contentBytes, err := json.Marshal(ConvertLuaTable(content))
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to convert content: %s", err.Error()))
+		return 0
+	}
+
+	notification := &NNotification{
+		UserID:     uid.Bytes(),
+		Subject:    subject,
+		Content:    contentBytes,
+		Code:       code,
+		Persistent: persistent,
+	}
+	if senderID != "" {
+		sid, err := uuid.FromString(senderID)
+		if err != nil {
+			l.ArgError(5, "expects a valid sender ID")
+			return 0
+		}
+		notification.SenderID = sid.Bytes()
+	}
+
+	notifications := []*NNotification{notification}
+	if err = RuntimeNotificationHook(n.logger, n.runtime, notifications); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to send notification: %s", err.Error()))
+		return 0
+	}
+	if err = n.runtime.notificationService.NotificationSend(notifications); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to send notification: %s", err.Error()))
+		return 0
+	}
+	return 0
+}
+
+func (n *NakamaModule) notificationCount(l *lua.LState) int {
+	userID := l.CheckString(1)
+	codesTable := l.OptTable(2, nil)
+
+	uid, err := uuid.FromString(userID)
+	if err != nil {
+		l.ArgError(1, "expects a valid user ID")
+		return 0
+	}
+	var codes []int64
+	if codesTable != nil {
+		codes = make([]int64, 0, codesTable.Len())
+		valid := true
+		codesTable.ForEach(func(k lua.LValue, v lua.LValue) {
+			code, ok := v.(lua.LNumber)
+			if !ok {
+				valid = false
+				return
+			}
+			codes = append(codes, int64(code))
+		})
+		if !valid {
+			l.ArgError(2, "expects codes to be numbers")
+			return 0
+		}
+	}
+
+	total, unread, err := n.runtime.NotificationCount(uid, codes)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to count notifications: %s", err.Error()))
+		return 0
+	}
+	l.Push(lua.LNumber(total))
+	l.Push(lua.LNumber(unread))
+	return 2
+}
+
+func (n *NakamaModule) notificationsMarkRead(l *lua.LState) int {
+	userID := l.CheckString(1)
+	idsTable := l.CheckTable(2)
+
+	uid, err := uuid.FromString(userID)
+	if err != nil {
+		l.ArgError(1, "expects a valid user ID")
+		return 0
+	}
+	ids := make([]uuid.UUID, 0, idsTable.Len())
+	valid := true
+	idsTable.ForEach(func(k lua.LValue, v lua.LValue) {
+		id, err := uuid.FromString(v.String())
+		if err != nil {
+			valid = false
+			return
+		}
+		ids = append(ids, id)
+	})
+	if !valid {
+		l.ArgError(2, "expects valid notification IDs")
+		return 0
+	}
+
+	if err = n.runtime.NotificationsMarkRead(uid, ids); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to mark notifications as read: %s", err.Error()))
+	}
+	return 0
+}
+
+func (n *NakamaModule) notificationSchedule(l *lua.LState) int {
+	userID := l.CheckString(1)
+	deliverAt := l.CheckInt64(2)
+	subject := l.CheckString(3)
+	content := l.OptTable(4, l.NewTable())
+	code := l.CheckInt64(5)
+	persistent := l.OptBool(6, true)
+
+	uid, err := uuid.FromString(userID)
+	if err != nil {
+		l.ArgError(1, "expects a valid user ID")
+		return 0
+	}
+	if subject == "" {
+		l.ArgError(3, "expects a subject string")
+		return 0
+	}
+	contentBytes, err := json.Marshal(ConvertLuaTable(content))
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to convert content: %s", err.Error()))
+		return 0
+	}
+
+	id, err := n.runtime.ScheduleNotification(uid, deliverAt, subject, contentBytes, code, persistent)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to schedule notification: %s", err.Error()))
+		return 0
+	}
+	l.Push(lua.LString(id))
+	return 1
+}
+
+func (n *NakamaModule) notificationScheduleCancel(l *lua.LState) int {
+	id := l.CheckString(1)
+
+	cancelled, err := n.runtime.CancelScheduledNotification(id)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to cancel scheduled notification: %s", err.Error()))
+		return 0
+	}
+	l.Push(lua.LBool(cancelled))
+	return 1
+}
+
+func (n *NakamaModule) pushToUser(l *lua.LState) int {
+	userID := l.CheckString(1)
+	id := l.CheckString(2)
+	payload := l.OptString(3, "")
+	buffer := l.OptBool(4, false)
+
+	uid, err := uuid.FromString(userID)
+	if err != nil {
+		l.ArgError(1, "expects a valid user ID")
+		return 0
+	}
+
+	l.Push(lua.LBool(n.runtime.PushToUser(uid, id, []byte(payload), buffer)))
+	return 1
+}
+
+func (n *NakamaModule) notificationSendQuery(l *lua.LState) int {
+	filterTable := l.CheckTable(1)
+	subject := l.CheckString(2)
+	content := l.OptTable(3, l.NewTable())
+	code := l.CheckInt64(4)
+	dryRun := l.OptBool(5, false)
+
+	filter := &NotificationQueryFilter{}
+	times := map[string]*int64{
+		"last_online_after":  &filter.LastOnlineAfter,
+		"last_online_before": &filter.LastOnlineBefore,
+		"created_after":      &filter.CreatedAfter,
+		"created_before":     &filter.CreatedBefore,
+	}
+	values := map[string]*string{
+		"lang":     &filter.Lang,
+		"location": &filter.Location,
+		"timezone": &filter.Timezone,
+	}
+	conversionError := ""
+	filterTable.ForEach(func(k lua.LValue, v lua.LValue) {
+		if conversionError != "" {
+			return
+		}
+		key := k.String()
+		if t, ok := times[key]; ok {
+			ms, ok := v.(lua.LNumber)
+			if !ok {
+				conversionError = "expects " + key + " to be a time in milliseconds"
+				return
+			}
+			*t = int64(ms)
+		} else if value, ok := values[key]; ok {
+			str, ok := v.(lua.LString)
+			if !ok {
+				conversionError = "expects " + key + " to be a string"
+				return
+			}
+			*value = string(str)
+		} else {
+			conversionError = "expects a filter of last_online_after, last_online_before, created_after, created_before, lang, location and timezone"
+		}
+	})
+	if conversionError != "" {
+		l.ArgError(1, conversionError)
+		return 0
+	}
+	if subject == "" {
+		l.ArgError(2, "expects a subject string")
+		return 0
+	}
+	contentBytes, err := json.Marshal(ConvertLuaTable(content))
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to convert content: %s", err.Error()))
+		return 0
+	}
+
+	count, err := n.runtime.NotifyQuery(filter, subject, contentBytes, code, dryRun)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to send notifications: %s", err.Error()))
+		return 0
+	}
+	l.Push(lua.LNumber(count))
+	return 1
+}
+
+func (n *NakamaModule) notificationSendUsers(l *lua.LState) int {
+	userIDsTable := l.CheckTable(1)
+	subject := l.CheckString(2)
+	content := l.OptTable(3, l.NewTable())
+	code := l.CheckInt64(4)
+
+	userIDs := make([]uuid.UUID, 0, userIDsTable.Len())
+	valid := true
+	userIDsTable.ForEach(func(k lua.LValue, v lua.LValue) {
+		uid, err := uuid.FromString(v.String())
+		if err != nil {
+			valid = false
+			return
+		}
+		userIDs = append(userIDs, uid)
+	})
+	if !valid {
+		l.ArgError(1, "expects a list of valid user IDs")
+		return 0
+	}
+	if subject == "" {
+		l.ArgError(2, "expects a subject string")
+		return 0
+	}
+	contentBytes, err := json.Marshal(ConvertLuaTable(content))
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to convert content: %s", err.Error()))
+		return 0
+	}
+
+	delivered, stored, err := n.runtime.NotifyUsers(userIDs, subject, contentBytes, code)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to send notifications: %s", err.Error()))
+		return 0
+	}
+	l.Push(lua.LNumber(delivered))
+	l.Push(lua.LNumber(stored))
+	return 2
+}
+
+func (n *NakamaModule) sessionList(l *lua.LState) int {
+	userID, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid user ID")
+		return 0
+	}
+
+	sessions := n.runtime.ListUserSessions(userID)
+	lv := l.NewTable()
+	for i, s := range sessions {
+		st := l.NewTable()
+		st.RawSetString("session_id", lua.LString(s.ID.String()))
+		st.RawSetString("user_id", lua.LString(s.UserID.String()))
+		st.RawSetString("created_at", lua.LNumber(s.CreatedAt))
+		st.RawSetString("client_ip", lua.LString(s.ClientIP))
+		lv.RawSetInt(i+1, st)
+	}
+	l.Push(lv)
+	return 1
+}
+
+func (n *NakamaModule) sessionRevoke(l *lua.LState) int {
+	sessionID, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid session ID")
+		return 0
+	}
+
+	l.Push(lua.LBool(n.runtime.RevokeSession(sessionID)))
+	return 1
+}
+
+func (n *NakamaModule) queueEnqueue(l *lua.LState) int {
+	queue := l.CheckString(1)
+	payload := l.OptTable(2, l.NewTable())
+	if queue == "" {
+		l.ArgError(1, "expects queue name")
+		return 0
+	}
+	userID := uuid.Nil
+	if u := l.OptString(3, ""); u != "" {
+		var err error
+		if userID, err = uuid.FromString(u); err != nil {
+			l.ArgError(3, "expects a valid user ID")
+			return 0
+		}
+	}
+
+	id, err := n.runtime.Enqueue(queue, userID, ConvertLuaTable(payload))
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to enqueue job: %s", err.Error()))
+		return 0
+	}
+	l.Push(lua.LString(id))
+	return 1
+}
+
+func (n *NakamaModule) oneTimeTokenCreate(l *lua.LState) int {
+	payload := l.OptTable(1, l.NewTable())
+	ttl := l.CheckInt64(2)
+	if ttl <= 0 {
+		l.ArgError(2, "expects a TTL in milliseconds greater than 0")
+		return 0
+	}
+
+	token, err := n.runtime.CreateOneTimeToken(ConvertLuaTable(payload), time.Duration(ttl)*time.Millisecond)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to create one-time token: %s", err.Error()))
+		return 0
+	}
+	l.Push(lua.LString(token))
+	return 1
+}
+
+func (n *NakamaModule) geoIPLookup(l *lua.LState) int {
+	record := n.runtime.GeoIPLookup(l.CheckString(1))
+	if record == nil {
+		l.Push(lua.LNil)
+		return 1
+	}
+	l.Push(geoIPRecordToTable(l, record))
+	return 1
+}
+
+func geoIPRecordToTable(l *lua.LState, record *GeoIPRecord) *lua.LTable {
+	lt := l.NewTable()
+	lt.RawSetString("country", lua.LString(record.Country))
+	lt.RawSetString("region", lua.LString(record.Region))
+	lt.RawSetString("latitude", lua.LNumber(record.Latitude))
+	lt.RawSetString("longitude", lua.LNumber(record.Longitude))
+	return lt
+}
+
+func (n *NakamaModule) secureRandom(l *lua.LState) int {
+	b, err := n.runtime.SecureRandom(l.CheckInt(1))
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to generate random bytes: %s", err.Error()))
+		return 0
+	}
+	l.Push(lua.LString(hex.EncodeToString(b)))
+	return 1
+}
+
+func (n *NakamaModule) rngCommit(l *lua.LState) int {
+	userID, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid user ID")
+		return 0
+	}
+
+	id, commitment, err := n.runtime.CommitRng(userID)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to create RNG commitment: %s", err.Error()))
+		return 0
+	}
+	l.Push(lua.LString(id))
+	l.Push(lua.LString(hex.EncodeToString(commitment)))
+	return 2
+}
+
+func (n *NakamaModule) rngRoll(l *lua.LState) int {
+	id, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid commitment ID")
+		return 0
+	}
+	clientSeed := l.CheckString(2)
+	sides := l.CheckInt64(3)
+	count := l.OptInt64(4, 1)
+
+	results, err := n.runtime.RollRng(id, clientSeed, sides, count)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to roll: %s", err.Error()))
+		return 0
+	}
+	l.Push(rngResultsToTable(l, results))
+	return 1
+}
+
+func (n *NakamaModule) rngReveal(l *lua.LState) int {
+	id, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid commitment ID")
+		return 0
+	}
+
+	c, err := n.runtime.RevealRng(id)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to reveal RNG commitment: %s", err.Error()))
+		return 0
+	}
+	ct := l.NewTable()
+	ct.RawSetString("id", lua.LString(id.String()))
+	ct.RawSetString("user_id", lua.LString(uuid.FromBytesOrNil(c.UserID).String()))
+	ct.RawSetString("seed", lua.LString(hex.EncodeToString(c.Seed)))
+	ct.RawSetString("commitment", lua.LString(hex.EncodeToString(c.Commitment)))
+	ct.RawSetString("client_seed", lua.LString(c.ClientSeed))
+	ct.RawSetString("sides", lua.LNumber(c.Sides))
+	ct.RawSetString("results", rngResultsToTable(l, c.Results))
+	ct.RawSetString("created_at", lua.LNumber(c.CreatedAt))
+	ct.RawSetString("rolled_at", lua.LNumber(c.RolledAt))
+	ct.RawSetString("revealed_at", lua.LNumber(c.RevealedAt))
+	l.Push(ct)
+	return 1
+}
+
+func (n *NakamaModule) rngVerify(l *lua.LState) int {
+	commitment, err := hex.DecodeString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a hex encoded commitment")
+		return 0
+	}
+	seed, err := hex.DecodeString(l.CheckString(2))
+	if err != nil {
+		l.ArgError(2, "expects a hex encoded seed")
+		return 0
+	}
+	clientSeed := l.CheckString(3)
+	sides := l.CheckInt64(4)
+	count := l.OptInt64(5, 1)
+
+	results, ok := RngVerify(commitment, seed, clientSeed, sides, count)
+	if !ok {
+		l.Push(lua.LNil)
+		return 1
+	}
+	l.Push(rngResultsToTable(l, results))
+	return 1
+}
+
+func rngResultsToTable(l *lua.LState, results []int64) *lua.LTable {
+	lv := l.CreateTable(len(results), 0)
+	for i, r := range results {
+		lv.RawSetInt(i+1, lua.LNumber(r))
+	}
+	return lv
+}
+
+func (n *NakamaModule) oneTimeTokenConsume(l *lua.LState) int {
+	token := l.CheckString(1)
+
+	// Invalid, expired, and already consumed tokens all return nil, only other failures raise an error.
+	payload, err := n.runtime.ConsumeOneTimeToken(token)
+	if err == ErrOneTimeTokenInvalid {
+		l.Push(lua.LNil)
+		return 1
+	} else if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to consume one-time token: %s", err.Error()))
+		return 0
+	}
+	l.Push(ConvertMap(l, payload))
+	return 1
+}
+
+func (n *NakamaModule) uniqueClaim(l *lua.LState) int {
+	namespace := l.CheckString(1)
+	value := l.CheckString(2)
+	ownerID, err := uuid.FromString(l.CheckString(3))
+	if err != nil {
+		l.ArgError(3, "expects a valid owner ID")
+		return 0
+	}
+
+	// A value held by another owner returns false, only other failures raise an error.
+	err = n.runtime.ClaimUnique(namespace, value, ownerID)
+	if err == ErrUniqueClaimed {
+		l.Push(lua.LFalse)
+		return 1
+	} else if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to claim unique value: %s", err.Error()))
+		return 0
+	}
+	l.Push(lua.LTrue)
+	return 1
+}
+
+func (n *NakamaModule) uniqueRelease(l *lua.LState) int {
+	namespace := l.CheckString(1)
+	value := l.CheckString(2)
+	ownerID, err := uuid.FromString(l.CheckString(3))
+	if err != nil {
+		l.ArgError(3, "expects a valid owner ID")
+		return 0
+	}
+
+	released, err := n.runtime.ReleaseUnique(namespace, value, ownerID)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to release unique value: %s", err.Error()))
+		return 0
+	}
+	l.Push(lua.LBool(released))
+	return 1
+}
+
+func (n *NakamaModule) inventoryGrant(l *lua.LState) int {
+	userID, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid user ID")
+		return 0
+	}
+	itemsTable := l.CheckTable(2)
+
+	grants := make([]*InventoryItem, 0, itemsTable.Len())
+	var conversionErr error
+	itemsTable.ForEach(func(_ lua.LValue, v lua.LValue) {
+		if conversionErr != nil {
+			return
+		}
+		it, ok := v.(*lua.LTable)
+		if !ok {
+			conversionErr = errors.New("expects a list of item tables")
+			return
+		}
+		count, ok := it.RawGetString("count").(lua.LNumber)
+		if !ok {
+			count = 1
+		}
+		grant := &InventoryItem{
+			ItemID: lua.LVAsString(it.RawGetString("item_id")),
+			Count:  int64(count),
+			Unique: lua.LVAsBool(it.RawGetString("unique")),
+		}
+		if metadata, ok := it.RawGetString("metadata").(*lua.LTable); ok {
+			if grant.Metadata, conversionErr = json.Marshal(ConvertLuaTable(metadata)); conversionErr != nil {
+				return
+			}
+		}
+		grants = append(grants, grant)
+	})
+	if conversionErr != nil {
+		l.ArgError(2, conversionErr.Error())
+		return 0
+	}
+
+	// Grants the user cannot have return nil and the reason, only other failures raise an error.
+	items, err := n.runtime.InventoryGrant(userID, grants)
+	if rejected, ok := err.(*InventoryRejectedError); ok {
+		l.Push(lua.LNil)
+		l.Push(lua.LString(rejected.Reason))
+		return 2
+	} else if err == ErrInventoryUniqueOwned {
+		l.Push(lua.LNil)
+		l.Push(lua.LString(err.Error()))
+		return 2
+	} else if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to grant inventory items: %s", err.Error()))
+		return 0
+	}
+
+	lv := l.NewTable()
+	for i, item := range items {
+		lv.RawSetInt(i+1, inventoryItemToLuaTable(l, item))
+	}
+	l.Push(lv)
+	return 1
+}
+
+func (n *NakamaModule) inventoryConsume(l *lua.LState) int {
+	userID, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid user ID")
+		return 0
+	}
+	itemsTable := l.CheckTable(2)
+
+	consume := make(map[string]int64)
+	var invalid bool
+	itemsTable.ForEach(func(k lua.LValue, v lua.LValue) {
+		count, ok := v.(lua.LNumber)
+		if !ok || k.Type() != lua.LTString {
+			invalid = true
+			return
+		}
+		consume[k.String()] = int64(count)
+	})
+	if invalid {
+		l.ArgError(2, "expects a table of item IDs to counts")
+		return 0
+	}
+
+	// Owning too few returns false, only other failures raise an error.
+	err = n.runtime.InventoryConsume(userID, consume)
+	if err == ErrInventoryInsufficient {
+		l.Push(lua.LFalse)
+		return 1
+	} else if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to consume inventory items: %s", err.Error()))
+		return 0
+	}
+	l.Push(lua.LTrue)
+	return 1
+}
+
+func (n *NakamaModule) inventoryList(l *lua.LState) int {
+	userID, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid user ID")
+		return 0
+	}
+
+	items, err := n.runtime.InventoryList(userID)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to list inventory: %s", err.Error()))
+		return 0
+	}
+
+	lv := l.NewTable()
+	for i, item := range items {
+		lv.RawSetInt(i+1, inventoryItemToLuaTable(l, item))
+	}
+	l.Push(lv)
+	return 1
+}
+
+func inventoryItemToLuaTable(l *lua.LState, item *InventoryItem) *lua.LTable {
+	var metadata map[string]interface{}
+	json.Unmarshal(item.Metadata, &metadata)
+
+	lt := l.NewTable()
+	lt.RawSetString("item_id", lua.LString(item.ItemID))
+	lt.RawSetString("count", lua.LNumber(item.Count))
+	lt.RawSetString("owned", lua.LNumber(item.Owned))
+	lt.RawSetString("unique", lua.LBool(item.Unique))
+	lt.RawSetString("metadata", ConvertMap(l, metadata))
+	lt.RawSetString("created_at", lua.LNumber(item.CreatedAt))
+	lt.RawSetString("updated_at", lua.LNumber(item.UpdatedAt))
+	return lt
+}
+
+// The node_local_* functions read and write node-local state kept in memory, each node of a cluster has its own values,
+// they are never propagated to other nodes and are lost when the node stops.
+func (n *NakamaModule) nodeLocalGet(l *lua.LState) int {
+	value, ok, err := n.runtime.NodeLocalGet(l.CheckString(1))
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to get node-local value: %s", err.Error()))
+		return 0
+	} else if !ok {
+		l.Push(lua.LNil)
+		return 1
+	}
+	l.Push(lua.LString(value))
+	return 1
+}
+
+func (n *NakamaModule) nodeLocalSet(l *lua.LState) int {
+	key := l.CheckString(1)
+	value := l.CheckString(2)
+	ttlMs := l.OptInt64(3, 0)
+	if ttlMs < 0 {
+		l.ArgError(3, "expects a TTL in milliseconds of 0 or more")
+		return 0
+	}
+
+	if err := n.runtime.NodeLocalSet(key, value, time.Duration(ttlMs)*time.Millisecond); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to set node-local value: %s", err.Error()))
+	}
+	return 0
+}
+
+func (n *NakamaModule) nodeLocalIncr(l *lua.LState) int {
+	key := l.CheckString(1)
+	delta := l.OptInt64(2, 1)
+	ttlMs := l.OptInt64(3, 0)
+	if ttlMs < 0 {
+		l.ArgError(3, "expects a TTL in milliseconds of 0 or more")
+		return 0
+	}
+
+	value, err := n.runtime.NodeLocalIncr(key, delta, time.Duration(ttlMs)*time.Millisecond)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to increment node-local value: %s", err.Error()))
+		return 0
+	}
+	l.Push(lua.LNumber(value))
+	return 1
+}
+
+func (n *NakamaModule) tournamentCreate(l *lua.LState) int {
+	lt := l.CheckTable(1)
+
+	t := &Tournament{
+		Title:   lua.LVAsString(lt.RawGetString("title")),
+		Size:    int(lua.LVAsNumber(lt.RawGetString("size"))),
+		StartAt: int64(lua.LVAsNumber(lt.RawGetString("start_at"))),
+		EndAt:   int64(lua.LVAsNumber(lt.RawGetString("end_at"))),
+	}
+	if metadata, ok := lt.RawGetString("metadata").(*lua.LTable); ok {
+		metadataBytes, err := json.Marshal(ConvertLuaTable(metadata))
+		if err != nil {
+			l.ArgError(1, fmt.Sprintf("failed to convert metadata: %s", err.Error()))
+			return 0
+		}
+		t.Metadata = metadataBytes
+	}
+
+	id, err := n.runtime.TournamentCreate(t)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to create tournament: %s", err.Error()))
+		return 0
+	}
+	l.Push(lua.LString(id.String()))
+	return 1
+}
+
+func (n *NakamaModule) tournamentJoin(l *lua.LState) int {
+	id, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid tournament ID")
+		return 0
+	}
+	userID, err := uuid.FromString(l.CheckString(2))
+	if err != nil {
+		l.ArgError(2, "expects a valid user ID")
+		return 0
+	}
+	handle := l.CheckString(3)
+	rating := l.OptInt64(4, 0)
+
+	// Tournaments the user cannot join return false and the reason, only other failures raise an error.
+	err = n.runtime.TournamentJoin(id, userID, handle, rating)
+	if _, rejected := err.(*TournamentJoinRejectedError); rejected || err == ErrTournamentNotFound || err == ErrTournamentClosed || err == ErrTournamentFull || err == ErrInventoryInsufficient {
+		l.Push(lua.LFalse)
+		l.Push(lua.LString(err.Error()))
+		return 2
+	} else if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to join tournament: %s", err.Error()))
+		return 0
+	}
+	l.Push(lua.LTrue)
+	return 1
+}
+
+func (n *NakamaModule) tournamentResult(l *lua.LState) int {
+	id, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid tournament ID")
+		return 0
+	}
+	winnerID, err := uuid.FromString(l.CheckString(2))
+	if err != nil {
+		l.ArgError(2, "expects a valid winner user ID")
+		return 0
+	}
+
+	// Results that do not apply return false and the reason, only other failures raise an error.
+	err = n.runtime.TournamentResult(id, winnerID)
+	if err == ErrTournamentNotFound || err == ErrTournamentNotRunning || err == ErrTournamentNoMatch {
+		l.Push(lua.LFalse)
+		l.Push(lua.LString(err.Error()))
+		return 2
+	} else if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to submit tournament result: %s", err.Error()))
+		return 0
+	}
+	l.Push(lua.LTrue)
+	return 1
+}
+
+func (n *NakamaModule) tournamentGet(l *lua.LState) int {
+	id, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid tournament ID")
+		return 0
+	}
+
+	bracket, err := n.runtime.TournamentGet(id)
+	if err == ErrTournamentNotFound {
+		l.Push(lua.LNil)
+		return 1
+	} else if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to get tournament: %s", err.Error()))
+		return 0
+	}
+	l.Push(tournamentBracketToLuaTable(l, bracket))
+	return 1
+}
+
+// tournamentBracketToLuaTable converts a bracket, users are nil for byes and undecided winners.
+func tournamentBracketToLuaTable(l *lua.LState, bracket *TournamentBracket) *lua.LTable {
+	t := bracket.Tournament
+	var metadata map[string]interface{}
+	json.Unmarshal(t.Metadata, &metadata)
+
+	userID := func(id uuid.UUID) lua.LValue {
+		if id == uuid.Nil {
+			return lua.LNil
+		}
+		return lua.LString(id.String())
+	}
+
+	participants := l.NewTable()
+	for i, p := range bracket.Participants {
+		lp := l.NewTable()
+		lp.RawSetString("user_id", lua.LString(p.UserID.String()))
+		lp.RawSetString("handle", lua.LString(p.Handle))
+		lp.RawSetString("rating", lua.LNumber(p.Rating))
+		lp.RawSetString("seed", lua.LNumber(p.Seed))
+		lp.RawSetString("created_at", lua.LNumber(p.CreatedAt))
+		participants.RawSetInt(i+1, lp)
+	}
+	matches := l.NewTable()
+	for i, m := range bracket.Matches {
+		lm := l.NewTable()
+		lm.RawSetString("round", lua.LNumber(m.Round))
+		lm.RawSetString("position", lua.LNumber(m.Position))
+		lm.RawSetString("user_a", userID(m.UserA))
+		lm.RawSetString("user_b", userID(m.UserB))
+		lm.RawSetString("winner_id", userID(m.WinnerID))
+		lm.RawSetString("updated_at", lua.LNumber(m.UpdatedAt))
+		matches.RawSetInt(i+1, lm)
+	}
+
+	lt := l.NewTable()
+	lt.RawSetString("id", lua.LString(t.ID.String()))
+	lt.RawSetString("title", lua.LString(t.Title))
+	lt.RawSetString("size", lua.LNumber(t.Size))
+	lt.RawSetString("state", lua.LString(tournamentStates[t.State]))
+	lt.RawSetString("round", lua.LNumber(t.Round))
+	lt.RawSetString("winner_id", userID(t.WinnerID))
+	lt.RawSetString("metadata", ConvertMap(l, metadata))
+	lt.RawSetString("start_at", lua.LNumber(t.StartAt))
+	lt.RawSetString("end_at", lua.LNumber(t.EndAt))
+	lt.RawSetString("created_at", lua.LNumber(t.CreatedAt))
+	lt.RawSetString("updated_at", lua.LNumber(t.UpdatedAt))
+	lt.RawSetString("participants", participants)
+	lt.RawSetString("matches", matches)
+	return lt
+}
+
+func (n *NakamaModule) cooldownCheck(l *lua.LState) int {
+	userID, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid user ID")
+		return 0
+	}
+	action := l.CheckString(2)
+	cooldown := l.CheckInt64(3)
+	if cooldown <= 0 {
+		l.ArgError(3, "expects a cooldown in milliseconds greater than 0")
+		return 0
+	}
+
+	remaining, err := n.runtime.CheckCooldown(userID, action, time.Duration(cooldown)*time.Millisecond)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to check cooldown: %s", err.Error()))
+		return 0
+	}
+	l.Push(lua.LBool(remaining == 0))
+	l.Push(lua.LNumber(remaining / time.Millisecond))
+	return 2
+}
+
+// User flags are kept in the database but cached on each node, so a flag set through one node is only seen by modules
+// on the others once their cached copy expires, up to 30 seconds later.
+func (n *NakamaModule) userFlagsGet(l *lua.LState) int {
+	userID, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid user ID")
+		return 0
+	}
+
+	flags, err := n.runtime.GetUserFlags(userID)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to get user flags: %s", err.Error()))
+		return 0
+	}
+	lt := l.NewTable()
+	for k, v := range flags {
+		lt.RawSetString(k, lua.LString(v))
+	}
+	l.Push(lt)
+	return 1
+}
+
+func (n *NakamaModule) userFlagSet(l *lua.LState) int {
+	userID, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid user ID")
+		return 0
+	}
+	key := l.CheckString(2)
+	value := l.OptString(3, "")
+
+	if err = n.runtime.SetUserFlag(userID, key, value); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to set user flag: %s", err.Error()))
+		return 0
+	}
+	return 0
+}
+
+func (n *NakamaModule) userDataExport(l *lua.LState) int {
+	userID, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid user ID")
+		return 0
+	}
+
+	// With a function the export is passed to it in chunks as it is read, otherwise it is returned as one string.
+	if fn := l.OptFunction(2, nil); fn != nil {
+		if err = n.runtime.ExportUserData(userID, &luaChunkWriter{l: l, fn: fn}); err != nil {
+			l.RaiseError(fmt.Sprintf("failed to export user data: %s", err.Error()))
+		}
+		return 0
+	}
+
+	var buf bytes.Buffer
+	if err = n.runtime.ExportUserData(userID, &buf); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to export user data: %s", err.Error()))
+		return 0
+	}
+	l.Push(lua.LString(buf.String()))
+	return 1
+}
+
+// luaChunkWriter passes each chunk written to it to a Lua function.
+type luaChunkWriter struct {
+	l  *lua.LState
+	fn *lua.LFunction
+}
+
+func (w *luaChunkWriter) Write(p []byte) (int, error) {
+	if err := w.l.CallByParam(lua.P{Fn: w.fn, NRet: 0, Protect: true}, lua.LString(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (n *NakamaModule) userDataDelete(l *lua.LState) int {
+	userID, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid user ID")
+		return 0
+	}
+
+	if err = n.runtime.DeleteUserData(userID); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to delete user data: %s", err.Error()))
+	}
+	return 0
+}
+
+func (n *NakamaModule) auditLog(l *lua.LState) int {
+	event := l.CheckTable(1)
+	userID := uuid.Nil
+	if u := l.OptString(2, ""); u != "" {
+		var err error
+		if userID, err = uuid.FromString(u); err != nil {
+			l.ArgError(2, "expects a valid user ID")
+			return 0
+		}
+	}
+
+	seq, err := n.runtime.AuditLog(userID, ConvertLuaTable(event))
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to append to audit log: %s", err.Error()))
+		return 0
+	}
+	l.Push(lua.LNumber(seq))
+	return 1
+}
+
+func (n *NakamaModule) auditLogVerify(l *lua.LState) int {
+	broken, err := n.runtime.AuditLogVerify()
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to verify audit log: %s", err.Error()))
+		return 0
+	}
+	if broken == 0 {
+		l.Push(lua.LNil)
+	} else {
+		l.Push(lua.LNumber(broken))
+	}
+	return 1
+}
+
+func (n *NakamaModule) eval(l *lua.LState) int {
+	code := l.CheckString(1)
+	var env map[string]interface{}
+	if lt := l.OptTable(2, nil); lt != nil {
+		env = ConvertLuaTable(lt)
+	}
+
+	result, err := n.runtime.Eval(code, env)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to eval snippet: %s", err.Error()))
+		return 0
+	}
+	l.Push(convertValue(l, result))
+	return 1
+}
+
+func (n *NakamaModule) userFetchId(l *lua.LState) int {
+	lt := l.CheckTable(1)
+	userIds, ok := convertLuaValue(lt).([]interface{})
+	if !ok {
+		l.ArgError(1, "invalid user id data")
+		return 0
+	}
+
+	userIdBytes := make([][]byte, 0)
+	for _, id := range userIds {
+		if ids, ok := id.(string); !ok {
+			l.ArgError(1, "each user id must be a string")
 			return 0
 		} else {
-			if rs, ok := r.(string); !ok {
-				l.ArgError(1, "record must be a string")
+			if uid, err := uuid.FromString(ids); err != nil {
+				l.ArgError(1, "invalid user id")
+				return 0
+			} else {
+				userIdBytes = append(userIdBytes, uid.Bytes())
+			}
+		}
+	}
+
+	users, err := UsersFetchIds(n.logger, n.db, userIdBytes)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to retrieve users: %s", err.Error()))
+		return 0
+	}
+
+	//translate uuid to string bytes
+	lv := l.NewTable()
+	for i, u := range users {
+		uid, _ := uuid.FromBytes(u.Id)
+		u.Id = []byte(uid.String())
+		um := structs.Map(u)
+		lv.RawSetInt(i+1, convertValue(l, um))
+	}
+
+	l.Push(lv)
+	return 1
+}
+
+func (n *NakamaModule) userFetchHandle(l *lua.LState) int {
+	lt := l.CheckTable(1)
+	handles, ok := convertLuaValue(lt).([]interface{})
+	if !ok {
+		l.ArgError(1, "invalid user handle data")
+		return 0
+	}
+
+	userHandles := make([]string, 0)
+	for _, h := range handles {
+		if hs, ok := h.(string); !ok {
+			l.ArgError(1, "invalid user handle data, each handle must be a string")
+			return 0
+		} else {
+			userHandles = append(userHandles, hs)
+		}
+	}
+
+	users, err := UsersFetchHandle(n.logger, n.db, userHandles)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to retrieve users: %s", err.Error()))
+		return 0
+	}
+
+	//translate uuid to string bytes
+	lv := l.NewTable()
+	for i, u := range users {
+		uid, _ := uuid.FromBytes(u.Id)
+		u.Id = []byte(uid.String())
+		um := structs.Map(u)
+		lv.RawSetInt(i+1, convertValue(l, um))
+	}
+
+	l.Push(lv)
+	return 1
+}
+
+func (n *NakamaModule) friendsList(l *lua.LState) int {
+	userID, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid user ID")
+		return 0
+	}
+	limit := l.OptInt64(2, 0)
+	cursor, ok := n.optCursor(l, 3)
+	if !ok {
+		return 0
+	}
+
+	users, newCursor, err := n.runtime.GetFriends(userID, limit, cursor)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to list friends: %s", err.Error()))
+		return 0
+	}
+	return n.pushUsersPage(l, users, newCursor)
+}
+
+func (n *NakamaModule) friendsMutual(l *lua.LState) int {
+	userID, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid user ID")
+		return 0
+	}
+	otherUserID, err := uuid.FromString(l.CheckString(2))
+	if err != nil {
+		l.ArgError(2, "expects a valid user ID")
+		return 0
+	}
+	limit := l.OptInt64(3, 0)
+	cursor, ok := n.optCursor(l, 4)
+	if !ok {
+		return 0
+	}
+
+	users, newCursor, err := n.runtime.GetMutualFriends(userID, otherUserID, limit, cursor)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to list mutual friends: %s", err.Error()))
+		return 0
+	}
+	return n.pushUsersPage(l, users, newCursor)
+}
+
+func (n *NakamaModule) channelHistory(l *lua.LState) int {
+	topic, ok := n.checkTopic(l, 1)
+	if !ok {
+		return 0
+	}
+	filter := &TopicMessageFilter{}
+	if ft := l.OptTable(2, nil); ft != nil {
+		if us := ft.RawGetString("user_id"); us != lua.LNil {
+			uid, err := uuid.FromString(lua.LVAsString(us))
+			if err != nil {
+				l.ArgError(2, "expects filter user_id to be a valid user ID")
 				return 0
-			} else {
-				record = rs
 			}
+			filter.UserID = uid.Bytes()
 		}
-		var userID []byte
-		if u, ok := k["UserId"]; ok {
-			if us, ok := u.(string); !ok {
-				l.ArgError(1, "expects valid user IDs in each key, when provided")
-				return 0
-			} else {
-				if uid, err := uuid.FromString(us); err != nil {
-					l.ArgError(1, "expects valid user IDs in each key, when provided")
-					return 0
-				} else {
-					userID = uid.Bytes()
-				}
-			}
+		filter.Contains = lua.LVAsString(ft.RawGetString("contains"))
+	}
+	limit := l.OptInt64(3, 0)
+	cursor, ok := n.optCursor(l, 4)
+	if !ok {
+		return 0
+	}
+
+	messages, newCursor, err := n.runtime.ChannelHistory(topic, filter, limit, cursor)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to list channel history: %s", err.Error()))
+		return 0
+	}
+
+	lv := l.NewTable()
+	for i, m := range messages {
+		messageID, _ := uuid.FromBytes(m.MessageId)
+		userID, _ := uuid.FromBytes(m.UserId)
+		mt := l.NewTable()
+		mt.RawSetString("message_id", lua.LString(messageID.String()))
+		mt.RawSetString("user_id", lua.LString(userID.String()))
+		mt.RawSetString("handle", lua.LString(m.Handle))
+		mt.RawSetString("type", lua.LNumber(m.Type))
+		mt.RawSetString("data", lua.LString(m.Data))
+		mt.RawSetString("created_at", lua.LNumber(m.CreatedAt))
+		mt.RawSetString("expires_at", lua.LNumber(m.ExpiresAt))
+		lv.RawSetInt(i+1, mt)
+	}
+	l.Push(lv)
+
+	if len(newCursor) != 0 {
+		l.Push(lua.LString(base64.StdEncoding.EncodeToString(newCursor)))
+	} else {
+		l.Push(lua.LNil)
+	}
+	return 2
+}
+
+// checkTopic reads a topic given as a table with one of room, group_id, or user_ids holding the two users of a direct
+// message topic.
+func (n *NakamaModule) checkTopic(l *lua.LState, idx int) (*TopicId, bool) {
+	t := l.CheckTable(idx)
+	if room := t.RawGetString("room"); room != lua.LNil {
+		name := lua.LVAsString(room)
+		if name == "" || len(name) > 64 {
+			l.ArgError(idx, "expects room name to be 1-64 chars")
+			return nil, false
 		}
+		return &TopicId{Id: &TopicId_Room{Room: []byte(name)}}, true
+	}
+	if gs := t.RawGetString("group_id"); gs != lua.LNil {
+		groupID, err := uuid.FromString(lua.LVAsString(gs))
+		if err != nil {
+			l.ArgError(idx, "expects group_id to be a valid group ID")
+			return nil, false
+		}
+		return &TopicId{Id: &TopicId_GroupId{GroupId: groupID.Bytes()}}, true
+	}
+	if ut, ok := t.RawGetString("user_ids").(*lua.LTable); ok && ut.Len() == 2 {
+		a, errA := uuid.FromString(lua.LVAsString(ut.RawGetInt(1)))
+		b, errB := uuid.FromString(lua.LVAsString(ut.RawGetInt(2)))
+		if errA != nil || errB != nil || a == b {
+			l.ArgError(idx, "expects user_ids to be two different valid user IDs")
+			return nil, false
+		}
+		// Direct message topics are keyed by both user IDs, lowest first.
+		if a.String() > b.String() {
+			a, b = b, a
+		}
+		return &TopicId{Id: &TopicId_Dm{Dm: append(a.Bytes(), b.Bytes()...)}}, true
+	}
+	l.ArgError(idx, "expects a topic with room, group_id, or user_ids")
+	return nil, false
+}
 
-		keys[idx] = &StorageKey{
-			Bucket:     bucket,
-			Collection: collection,
-			Record:     record,
-			UserId:     userID,
+func (n *NakamaModule) optCursor(l *lua.LState, idx int) ([]byte, bool) {
+	cs := l.OptString(idx, "")
+	if cs == "" {
+		return nil, true
+	}
+	cursor, err := base64.StdEncoding.DecodeString(cs)
+	if err != nil {
+		l.ArgError(idx, "cursor is invalid")
+		return nil, false
+	}
+	return cursor, true
+}
+
+func (n *NakamaModule) pushUsersPage(l *lua.LState, users []*User, cursor []byte) int {
+	lv := l.NewTable()
+	for i, u := range users {
+		uid, _ := uuid.FromBytes(u.Id)
+		u.Id = []byte(uid.String())
+		um := structs.Map(u)
+		lv.RawSetInt(i+1, convertValue(l, um))
+	}
+	l.Push(lv)
+
+	if len(cursor) != 0 {
+		l.Push(lua.LString(base64.StdEncoding.EncodeToString(cursor)))
+	} else {
+		l.Push(lua.LNil)
+	}
+	return 2
+}
+
+func (n *NakamaModule) storageList(l *lua.LState) int {
+	var userID []byte
+	if us := l.OptString(1, ""); us != "" {
+		if uid, err := uuid.FromString(us); err != nil {
+			l.ArgError(1, "expects a valid user ID or nil")
+			return 0
+		} else {
+			userID = uid.Bytes()
 		}
-		idx++
+	}
+	bucket := l.OptString(2, "")
+	collection := l.OptString(3, "")
+	limit := l.CheckInt64(4)
+	var cursor []byte
+	if cs := l.OptString(5, ""); cs != "" {
+		cb, err := base64.StdEncoding.DecodeString(cs)
+		if err != nil {
+			l.ArgError(5, "cursor is invalid")
+			return 0
+		}
+		cursor = cb
 	}
 
-	values, _, err := StorageFetch(n.logger, n.db, uuid.Nil, keys)
+	list := StorageList
+	if l.OptBool(6, false) {
+		list = StorageListPrimary
+	}
+	values, newCursor, _, err := list(n.logger, n.db, n.runtime.storageRouter, uuid.Nil, userID, bucket, collection, limit, cursor)
 	if err != nil {
-		l.RaiseError(fmt.Sprintf("failed to fetch storage: %s", err.Error()))
+		l.RaiseError(fmt.Sprintf("failed to list storage: %s", err.Error()))
+		return 0
+	}
+
+	// Convert and push the values.
+	l.Push(storageDataToTable(l, values))
+
+	// Convert and push the new cursor, if any.
+	if len(newCursor) != 0 {
+		newCursorString := base64.StdEncoding.EncodeToString(newCursor)
+		l.Push(lua.LString(newCursorString))
+	} else {
+		l.Push(lua.LNil)
+	}
+
+	return 2
+}
+
+func (n *NakamaModule) storageScan(l *lua.LState) int {
+	bucket := l.CheckString(1)
+	collection := l.OptString(2, "")
+	batchSize := l.CheckInt64(3)
+	fn := l.CheckFunction(4)
+	var cursor []byte
+	if cs := l.OptString(5, ""); cs != "" {
+		cb, err := base64.StdEncoding.DecodeString(cs)
+		if err != nil {
+			l.ArgError(5, "cursor is invalid")
+			return 0
+		}
+		cursor = cb
+	}
+
+	// Each batch is passed to the callback along with the cursor that resumes after it. Returning false stops the scan.
+	newCursor, err := n.runtime.StorageScan(bucket, collection, batchSize, cursor, func(values []*StorageData, batchCursor []byte) (bool, error) {
+		lc := lua.LValue(lua.LNil)
+		if len(batchCursor) != 0 {
+			lc = lua.LString(base64.StdEncoding.EncodeToString(batchCursor))
+		}
+		if err := l.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}, storageDataToTable(l, values), lc); err != nil {
+			return false, err
+		}
+		ret := l.Get(-1)
+		l.Pop(1)
+		return ret != lua.LFalse, nil
+	})
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to scan storage: %s", err.Error()))
+		return 0
+	}
+
+	if len(newCursor) != 0 {
+		l.Push(lua.LString(base64.StdEncoding.EncodeToString(newCursor)))
+	} else {
+		l.Push(lua.LNil)
+	}
+	return 1
+}
+
+func (n *NakamaModule) storageSetOp(l *lua.LState) int {
+	bucket := l.CheckString(1)
+	collectionA := l.CheckString(2)
+	ownerA := uuid.Nil
+	if us := l.OptString(3, ""); us != "" {
+		if uid, err := uuid.FromString(us); err != nil {
+			l.ArgError(3, "expects a valid user ID or nil")
+			return 0
+		} else {
+			ownerA = uid
+		}
+	}
+	collectionB := l.CheckString(4)
+	ownerB := uuid.Nil
+	if us := l.OptString(5, ""); us != "" {
+		if uid, err := uuid.FromString(us); err != nil {
+			l.ArgError(5, "expects a valid user ID or nil")
+			return 0
+		} else {
+			ownerB = uid
+		}
+	}
+	op := l.CheckString(6)
+	limit := l.OptInt64(7, 0)
+	var cursor []byte
+	if cs := l.OptString(8, ""); cs != "" {
+		cb, err := base64.StdEncoding.DecodeString(cs)
+		if err != nil {
+			l.ArgError(8, "cursor is invalid")
+			return 0
+		}
+		cursor = cb
+	}
+
+	records, newCursor, err := n.runtime.StorageSetOp(bucket, collectionA, ownerA, collectionB, ownerB, op, limit, cursor)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to compute storage set operation: %s", err.Error()))
 		return 0
 	}
 
+	lv := l.CreateTable(len(records), 0)
+	for i, record := range records {
+		lv.RawSetInt(i+1, lua.LString(record))
+	}
+	l.Push(lv)
+	if len(newCursor) != 0 {
+		l.Push(lua.LString(base64.StdEncoding.EncodeToString(newCursor)))
+	} else {
+		l.Push(lua.LNil)
+	}
+	return 2
+}
+
+func storageDataToTable(l *lua.LState, values []*StorageData) *lua.LTable {
 	lv := l.NewTable()
 	for i, v := range values {
 		// Convert UUIDs to string representation if needed.
@@ -419,35 +2492,33 @@ func (n *NakamaModule) storageFetch(l *lua.LState) int {
 		vm := structs.Map(v)
 		lv.RawSetInt(i+1, convertValue(l, vm))
 	}
-
-	l.Push(lv)
-	return 1
+	return lv
 }
 
-func (n *NakamaModule) storageWrite(l *lua.LState) int {
-	dataTable := l.CheckTable(1)
-	if dataTable == nil || dataTable.Len() == 0 {
-		l.ArgError(1, "expects a valid set of data")
+func (n *NakamaModule) storageFetch(l *lua.LState) int {
+	keysTable := l.CheckTable(1)
+	if keysTable == nil || keysTable.Len() == 0 {
+		l.ArgError(1, "expects a valid set of keys")
 		return 0
 	}
-	dataRaw, ok := convertLuaValue(dataTable).([]interface{})
+	keysRaw, ok := convertLuaValue(keysTable).([]interface{})
 	if !ok {
 		l.ArgError(1, "expects a valid set of data")
 		return 0
 	}
-	dataMap := make([]map[string]interface{}, 0)
-	for _, d := range dataRaw {
+	keyMap := make([]map[string]interface{}, 0)
+	for _, d := range keysRaw {
 		if m, ok := d.(map[string]interface{}); !ok {
 			l.ArgError(1, "expects a valid set of data")
 			return 0
 		} else {
-			dataMap = append(dataMap, m)
+			keyMap = append(keyMap, m)
 		}
 	}
 
-	data := make([]*StorageData, len(dataMap))
+	keys := make([]*StorageKey, len(keyMap))
 	idx := 0
-	for _, k := range dataMap {
+	for _, k := range keyMap {
 		var bucket string
 		if b, ok := k["Bucket"]; !ok {
 			l.ArgError(1, "expects a bucket in each key")
@@ -484,78 +2555,74 @@ func (n *NakamaModule) storageWrite(l *lua.LState) int {
 				record = rs
 			}
 		}
-		var value []byte
-		if v, ok := k["Value"]; !ok {
-			l.ArgError(1, "expects a value in each key")
-			return 0
-		} else {
-			if vs, ok := v.(string); !ok {
-				l.ArgError(1, "value must be a string")
-				return 0
-			} else {
-				value = []byte(vs)
-			}
-		}
 		var userID []byte
 		if u, ok := k["UserId"]; ok {
 			if us, ok := u.(string); !ok {
-				l.ArgError(1, "expects valid user IDs in each value, when provided")
+				l.ArgError(1, "expects valid user IDs in each key, when provided")
 				return 0
 			} else {
-				uid, err := uuid.FromString(us)
-				if err != nil {
-					l.ArgError(1, "expects valid user IDs in each value, when provided")
+				if uid, err := uuid.FromString(us); err != nil {
+					l.ArgError(1, "expects valid user IDs in each key, when provided")
 					return 0
+				} else {
+					userID = uid.Bytes()
 				}
-				userID = uid.Bytes()
-			}
-		}
-		var version []byte
-		if v, ok := k["Version"]; ok {
-			if vs, ok := v.(string); !ok {
-				l.ArgError(1, "version must be a string")
-				return 0
-			} else {
-				version = []byte(vs)
-			}
-		}
-		readPermission := int64(1)
-		if r, ok := k["PermissionRead"]; ok {
-			if rf, ok := r.(float64); !ok {
-				l.ArgError(1, "permission read must be a number")
-				return 0
-			} else {
-				readPermission = int64(rf)
 			}
 		}
-		writePermission := int64(1)
-		if w, ok := k["PermissionWrite"]; ok {
-			if wf, ok := w.(float64); !ok {
-				l.ArgError(1, "permission read must be a number")
-				return 0
-			} else {
-				writePermission = int64(wf)
-			}
+
+		keys[idx] = &StorageKey{
+			Bucket:     bucket,
+			Collection: collection,
+			Record:     record,
+			UserId:     userID,
 		}
+		idx++
+	}
 
-		data[idx] = &StorageData{
-			Bucket:          bucket,
-			Collection:      collection,
-			Record:          record,
-			UserId:          userID,
-			Value:           value,
-			Version:         version,
-			PermissionRead:  readPermission,
-			PermissionWrite: writePermission,
+	// Reads that must see every committed write can skip the read replica.
+	fetch := StorageFetch
+	if l.OptBool(2, false) {
+		fetch = StorageFetchPrimary
+	}
+	values, _, err := fetch(n.logger, n.db, n.runtime.storageRouter, uuid.Nil, keys)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to fetch storage: %s", err.Error()))
+		return 0
+	}
+
+	lv := l.NewTable()
+	for i, v := range values {
+		// Convert UUIDs to string representation if needed.
+		if len(v.UserId) != 0 {
+			uid, _ := uuid.FromBytes(v.UserId)
+			v.UserId = []byte(uid.String())
 		}
-		idx++
+		vm := structs.Map(v)
+		lv.RawSetInt(i+1, convertValue(l, vm))
+	}
+
+	l.Push(lv)
+	return 1
+}
+
+func (n *NakamaModule) storageWrite(l *lua.LState) int {
+	dataTable := l.CheckTable(1)
+	if dataTable == nil || dataTable.Len() == 0 {
+		l.ArgError(1, "expects a valid set of data")
+		return 0
+	}
+	data, err := convertLuaStorageWrites(dataTable)
+	if err != nil {
+		l.ArgError(1, err.Error())
+		return 0
 	}
 
-	keys, _, err := StorageWrite(n.logger, n.db, uuid.Nil, data)
+	keys, _, err := StorageWrite(n.logger, n.db, n.runtime.storageRouter, uuid.Nil, data)
 	if err != nil {
 		l.RaiseError(fmt.Sprintf("failed to write storage: %s", err.Error()))
 		return 0
 	}
+	n.runtime.storageUsageCache.InvalidateData(data)
 
 	lv := l.NewTable()
 	for i, k := range keys {
@@ -660,12 +2727,44 @@ func (n *NakamaModule) storageRemove(l *lua.LState) int {
 		idx++
 	}
 
-	if _, err := StorageRemove(n.logger, n.db, uuid.Nil, keys); err != nil {
+	if _, err := StorageRemove(n.logger, n.db, n.runtime.storageRouter, uuid.Nil, keys); err != nil {
 		l.RaiseError(fmt.Sprintf("failed to remove storage: %s", err.Error()))
 	}
+	for _, k := range keys {
+		n.runtime.storageUsageCache.Invalidate(k.UserId)
+	}
 	return 0
 }
 
+func (n *NakamaModule) storageStats(l *lua.LState) int {
+	bucket := l.OptString(1, "")
+	collection := l.OptString(2, "")
+	if bucket == "" && collection != "" {
+		l.ArgError(1, "expects a bucket when a collection is given")
+		return 0
+	}
+
+	stats, _, err := n.runtime.storageStatsCache.Get(n.logger, n.db, n.runtime.storageRouter, bucket, collection)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to get storage stats: %s", err.Error()))
+		return 0
+	}
+
+	// A single collection returns its count and size directly, otherwise return the breakdown by collection.
+	if collection != "" {
+		l.Push(lua.LNumber(stats[0].Count))
+		l.Push(lua.LNumber(stats[0].Bytes))
+		return 2
+	}
+
+	lv := l.NewTable()
+	for i, s := range stats {
+		lv.RawSetInt(i+1, convertValue(l, structs.Map(s)))
+	}
+	l.Push(lv)
+	return 1
+}
+
 func (n *NakamaModule) leaderboardCreate(l *lua.LState) int {
 	id := l.CheckString(1)
 	sort := l.CheckString(2)
@@ -699,3 +2798,412 @@ func (n *NakamaModule) leaderboardCreate(l *lua.LState) int {
 
 	return 0
 }
+
+func (n *NakamaModule) leaderboardRecordReadWrite(l *lua.LState) int {
+	id := l.CheckString(1)
+	owner := l.CheckString(2)
+	fn := l.CheckFunction(3)
+
+	leaderboardId, err := uuid.FromString(id)
+	if err != nil {
+		l.ArgError(1, "invalid leaderboard id")
+		return 0
+	}
+	ownerId, err := uuid.FromString(owner)
+	if err != nil {
+		l.ArgError(2, "invalid owner id")
+		return 0
+	}
+
+	// The update function runs inside the transaction, and again if the transaction is retried after a conflicting
+	// write, its result decides what is written.
+	update := func(record *LeaderboardRecord) (*LeaderboardRecord, error) {
+		var lv lua.LValue = lua.LNil
+		if record != nil {
+			lv = leaderboardRecordToLuaTable(l, record)
+		}
+		l.Push(fn)
+		l.Push(lv)
+		if err := l.PCall(1, 1, nil); err != nil {
+			return nil, err
+		}
+		ret := l.Get(-1)
+		l.Pop(1)
+		if ret == lua.LNil {
+			return nil, nil
+		}
+		lt, ok := ret.(*lua.LTable)
+		if !ok {
+			return nil, errors.New("update function must return a table or nil")
+		}
+		score, ok := lt.RawGetString("score").(lua.LNumber)
+		if !ok {
+			return nil, errors.New("update function must return a record with a numeric score")
+		}
+		updated := &LeaderboardRecord{
+			Score:    int64(score),
+			Location: lua.LVAsString(lt.RawGetString("location")),
+			Timezone: lua.LVAsString(lt.RawGetString("timezone")),
+		}
+		if metadata, ok := lt.RawGetString("metadata").(*lua.LTable); ok {
+			metadataBytes, err := json.Marshal(ConvertLuaTable(metadata))
+			if err != nil {
+				return nil, err
+			}
+			updated.Metadata = metadataBytes
+		}
+		return updated, nil
+	}
+
+	record, err := leaderboardRecordReadWrite(n.logger, n.db, n.runtime, []byte(leaderboardId.String()), ownerId.Bytes(), update)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to read and write leaderboard record: %s", err.Error()))
+		return 0
+	}
+	if record != nil {
+		n.runtime.StreamLeaderboardRecord(record)
+	}
+
+	if record == nil {
+		l.Push(lua.LNil)
+	} else {
+		l.Push(leaderboardRecordToLuaTable(l, record))
+	}
+	return 1
+}
+
+func (n *NakamaModule) leaderboardRecordIncrementDecay(l *lua.LState) int {
+	id := l.CheckString(1)
+	owner := l.CheckString(2)
+	delta := l.CheckInt64(3)
+	halfLifeMs := l.CheckInt64(4)
+
+	leaderboardId, err := uuid.FromString(id)
+	if err != nil {
+		l.ArgError(1, "invalid leaderboard id")
+		return 0
+	}
+	ownerId, err := uuid.FromString(owner)
+	if err != nil {
+		l.ArgError(2, "invalid owner id")
+		return 0
+	}
+	if halfLifeMs <= 0 {
+		l.ArgError(4, "expects half-life greater than zero")
+		return 0
+	}
+
+	record, err := LeaderboardRecordIncrementDecay(n.logger, n.db, n.runtime, []byte(leaderboardId.String()), ownerId.Bytes(), delta, halfLifeMs)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to increment leaderboard record: %s", err.Error()))
+		return 0
+	}
+	n.runtime.StreamLeaderboardRecord(record)
+
+	l.Push(leaderboardRecordToLuaTable(l, record))
+	return 1
+}
+
+func (n *NakamaModule) leaderboardAggregateRegister(l *lua.LState) int {
+	id := l.CheckString(1)
+	sources := l.CheckTable(2)
+
+	if _, err := uuid.FromString(id); err != nil {
+		l.ArgError(1, "invalid leaderboard id")
+		return 0
+	}
+	sourceIDs := make([]string, 0, sources.Len())
+	var invalid bool
+	sources.ForEach(func(_ lua.LValue, v lua.LValue) {
+		if _, err := uuid.FromString(v.String()); v.Type() != lua.LTString || err != nil {
+			invalid = true
+			return
+		}
+		sourceIDs = append(sourceIDs, v.String())
+	})
+	if invalid || len(sourceIDs) == 0 {
+		l.ArgError(2, "expects a list of source leaderboard ids")
+		return 0
+	}
+
+	if err := n.runtime.LeaderboardAggregateRegister(id, sourceIDs); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to register aggregate leaderboard: %s", err.Error()))
+	}
+	return 0
+}
+
+func (n *NakamaModule) leaderboardAggregateRefresh(l *lua.LState) int {
+	id := l.CheckString(1)
+
+	if _, err := uuid.FromString(id); err != nil {
+		l.ArgError(1, "invalid leaderboard id")
+		return 0
+	}
+
+	if err := n.runtime.LeaderboardAggregateRefresh(id); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to refresh aggregate leaderboard: %s", err.Error()))
+	}
+	return 0
+}
+
+func (n *NakamaModule) activeUsers(l *lua.LState) int {
+	window := l.OptString(1, ACTIVE_USERS_DAY)
+
+	count, day, err := n.runtime.ActiveUsers(window)
+	if err == ErrActiveUsersWindow {
+		l.ArgError(1, "expects window 'day', 'week' or 'month'")
+		return 0
+	} else if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to get active users: %s", err.Error()))
+		return 0
+	}
+	l.Push(lua.LNumber(count))
+	l.Push(lua.LNumber(day))
+	return 2
+}
+
+func (n *NakamaModule) leaderboardRank(l *lua.LState) int {
+	id := l.CheckString(1)
+	ownerID, err := uuid.FromString(l.CheckString(2))
+	if err != nil {
+		l.ArgError(2, "invalid owner id")
+		return 0
+	}
+
+	// Owners without a record return nil, only other failures raise an error.
+	rank, score, err := n.runtime.LeaderboardRank(id, ownerID)
+	if err == ErrLeaderboardRecordNotFound {
+		l.Push(lua.LNil)
+		return 1
+	} else if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to get leaderboard rank: %s", err.Error()))
+		return 0
+	}
+	l.Push(lua.LNumber(rank))
+	l.Push(lua.LNumber(score))
+	return 2
+}
+
+func leaderboardRecordToLuaTable(l *lua.LState, record *LeaderboardRecord) *lua.LTable {
+	var metadata map[string]interface{}
+	json.Unmarshal(record.Metadata, &metadata)
+
+	lt := l.NewTable()
+	lt.RawSetString("leaderboard_id", lua.LString(record.LeaderboardId))
+	lt.RawSetString("owner_id", lua.LString(uuid.FromBytesOrNil(record.OwnerId).String()))
+	lt.RawSetString("handle", lua.LString(record.Handle))
+	lt.RawSetString("lang", lua.LString(record.Lang))
+	lt.RawSetString("location", lua.LString(record.Location))
+	lt.RawSetString("timezone", lua.LString(record.Timezone))
+	lt.RawSetString("rank", lua.LNumber(record.Rank))
+	lt.RawSetString("score", lua.LNumber(record.Score))
+	lt.RawSetString("num_score", lua.LNumber(record.NumScore))
+	lt.RawSetString("metadata", ConvertMap(l, metadata))
+	lt.RawSetString("ranked_at", lua.LNumber(record.RankedAt))
+	lt.RawSetString("updated_at", lua.LNumber(record.UpdatedAt))
+	lt.RawSetString("expires_at", lua.LNumber(record.ExpiresAt))
+	return lt
+}
+
+func (n *NakamaModule) metricsCounter(l *lua.LState) int {
+	name := l.CheckString(1)
+	value := l.OptNumber(2, 1)
+	tags := l.OptTable(3, nil)
+	n.emitMetric(l, name, tags, func(tagsMap map[string]string) error {
+		return n.runtime.metrics.Counter(name, float32(value), tagsMap)
+	})
+	return 0
+}
+
+func (n *NakamaModule) metricsGauge(l *lua.LState) int {
+	name := l.CheckString(1)
+	value := l.CheckNumber(2)
+	tags := l.OptTable(3, nil)
+	n.emitMetric(l, name, tags, func(tagsMap map[string]string) error {
+		return n.runtime.metrics.Gauge(name, float32(value), tagsMap)
+	})
+	return 0
+}
+
+func (n *NakamaModule) metricsTiming(l *lua.LState) int {
+	name := l.CheckString(1)
+	value := l.CheckNumber(2)
+	tags := l.OptTable(3, nil)
+	n.emitMetric(l, name, tags, func(tagsMap map[string]string) error {
+		// Timings are given in milliseconds.
+		return n.runtime.metrics.Timing(name, time.Duration(float64(value)*float64(time.Millisecond)), tagsMap)
+	})
+	return 0
+}
+
+func (n *NakamaModule) emitMetric(l *lua.LState, name string, tags *lua.LTable, emit func(tagsMap map[string]string) error) {
+	tagsMap := make(map[string]string)
+	if tags != nil {
+		tags.ForEach(func(k lua.LValue, v lua.LValue) {
+			tagsMap[k.String()] = v.String()
+		})
+	}
+
+	switch err := emit(tagsMap); err {
+	case nil:
+	case errRuntimeMetricCardinality:
+		// Dropping the sample is preferable to failing the hook that emitted it.
+		n.logger.Warn("Dropping runtime metric", zap.String("name", name), zap.Error(err))
+	default:
+		l.RaiseError(fmt.Sprintf("failed to emit metric: %s", err.Error()))
+	}
+}
+
+// convertLuaStreamDirective converts the stream subscriptions a before function returned from Lua.
+func convertLuaStreamDirective(directiveTable *lua.LTable) (*StreamDirective, error) {
+	directive := &StreamDirective{}
+	for _, key := range []string{"join", "leave"} {
+		lv := directiveTable.RawGetString(key)
+		if lv == lua.LNil {
+			continue
+		}
+		streamsRaw, ok := convertLuaValue(lv).([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s must be a list of streams", key)
+		}
+
+		streams := make([]*StreamDescriptor, 0, len(streamsRaw))
+		for _, sr := range streamsRaw {
+			sm, ok := sr.(map[string]interface{})
+			if !ok {
+				return nil, errors.New("expects each stream to be a table")
+			}
+			mode, ok := sm["mode"].(string)
+			if !ok {
+				return nil, errors.New("expects a mode in each stream")
+			}
+			subject, ok := sm["subject"].(string)
+			if !ok {
+				return nil, errors.New("expects a subject in each stream")
+			}
+			stream := &StreamDescriptor{Mode: mode, Subject: subject}
+			if _, err := stream.Topic(); err != nil {
+				return nil, err
+			}
+			streams = append(streams, stream)
+		}
+
+		if key == "join" {
+			directive.Join = streams
+		} else {
+			directive.Leave = streams
+		}
+	}
+	return directive, nil
+}
+
+// convertLuaStorageWrites converts a list of storage write operations from Lua into storage data.
+func convertLuaStorageWrites(dataTable *lua.LTable) ([]*StorageData, error) {
+	dataRaw, ok := convertLuaValue(dataTable).([]interface{})
+	if !ok {
+		return nil, errors.New("expects a valid set of data")
+	}
+	dataMap := make([]map[string]interface{}, 0)
+	for _, d := range dataRaw {
+		if m, ok := d.(map[string]interface{}); !ok {
+			return nil, errors.New("expects a valid set of data")
+		} else {
+			dataMap = append(dataMap, m)
+		}
+	}
+
+	data := make([]*StorageData, len(dataMap))
+	idx := 0
+	for _, k := range dataMap {
+		var bucket string
+		if b, ok := k["Bucket"]; !ok {
+			return nil, errors.New("expects a bucket in each key")
+		} else {
+			if bs, ok := b.(string); !ok {
+				return nil, errors.New("bucket must be a string")
+			} else {
+				bucket = bs
+			}
+		}
+		var collection string
+		if c, ok := k["Collection"]; !ok {
+			return nil, errors.New("expects a collection in each key")
+		} else {
+			if cs, ok := c.(string); !ok {
+				return nil, errors.New("collection must be a string")
+			} else {
+				collection = cs
+			}
+		}
+		var record string
+		if r, ok := k["Record"]; !ok {
+			return nil, errors.New("expects a record in each key")
+		} else {
+			if rs, ok := r.(string); !ok {
+				return nil, errors.New("record must be a string")
+			} else {
+				record = rs
+			}
+		}
+		var value []byte
+		if v, ok := k["Value"]; !ok {
+			return nil, errors.New("expects a value in each key")
+		} else {
+			if vs, ok := v.(string); !ok {
+				return nil, errors.New("value must be a string")
+			} else {
+				value = []byte(vs)
+			}
+		}
+		var userID []byte
+		if u, ok := k["UserId"]; ok {
+			if us, ok := u.(string); !ok {
+				return nil, errors.New("expects valid user IDs in each value, when provided")
+			} else {
+				uid, err := uuid.FromString(us)
+				if err != nil {
+					return nil, errors.New("expects valid user IDs in each value, when provided")
+				}
+				userID = uid.Bytes()
+			}
+		}
+		var version []byte
+		if v, ok := k["Version"]; ok {
+			if vs, ok := v.(string); !ok {
+				return nil, errors.New("version must be a string")
+			} else {
+				version = []byte(vs)
+			}
+		}
+		readPermission := int64(1)
+		if r, ok := k["PermissionRead"]; ok {
+			if rf, ok := r.(float64); !ok {
+				return nil, errors.New("permission read must be a number")
+			} else {
+				readPermission = int64(rf)
+			}
+		}
+		writePermission := int64(1)
+		if w, ok := k["PermissionWrite"]; ok {
+			if wf, ok := w.(float64); !ok {
+				return nil, errors.New("permission read must be a number")
+			} else {
+				writePermission = int64(wf)
+			}
+		}
+
+		data[idx] = &StorageData{
+			Bucket:          bucket,
+			Collection:      collection,
+			Record:          record,
+			UserId:          userID,
+			Value:           value,
+			Version:         version,
+			PermissionRead:  readPermission,
+			PermissionWrite: writePermission,
+		}
+		idx++
+	}
+
+	return data, nil
+}
@@ -24,7 +24,6 @@ import (
 
 	"encoding/base64"
 
-	"github.com/satori/go.uuid"
 	"github.com/yuin/gopher-lua"
 	"go.uber.org/zap"
 	"encoding/hex"
@@ -62,7 +61,7 @@ func (nx *NakamaxModule) Loader(l *lua.LState) int {
 
 func (nx *NakamaxModule) uuidV4(l *lua.LState) int {
 	// TODO ensure there were no arguments to the function
-	l.Push(lua.LString(uuid.NewV4().String()))
+	l.Push(lua.LString(getSources(l).UUID.NewV4().String()))
 	return 1
 }
 
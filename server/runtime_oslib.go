@@ -74,12 +74,12 @@ func osDiffTime(L *lua.LState) int {
 }
 
 func osDate(L *lua.LState) int {
-	t := time.Now()
+	t := getSources(L).Clock.Now()
 	cfmt := "%c"
 	if L.GetTop() >= 1 {
 		cfmt = L.CheckString(1)
 		if strings.HasPrefix(cfmt, "!") {
-			t = time.Now().UTC()
+			t = t.UTC()
 			cfmt = strings.TrimLeft(cfmt, "!")
 		}
 		if L.GetTop() >= 2 {
@@ -107,7 +107,7 @@ func osDate(L *lua.LState) int {
 
 func osTime(L *lua.LState) int {
 	if L.GetTop() == 0 {
-		L.Push(lua.LNumber(time.Now().Unix()))
+		L.Push(lua.LNumber(getSources(L).Clock.Now().Unix()))
 	} else {
 		tbl := L.CheckTable(1)
 		sec := getIntField(L, tbl, "sec", 0)
@@ -0,0 +1,200 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+const (
+	// A user's friends are loaded this many at a time, and no more than the maximum are told about a presence change.
+	runtimePresenceFriendsPageSize = 100
+	runtimePresenceMaxFriends      = 1000
+)
+
+// NotificationCodeFriendPresence is the code of the live notifications telling users a friend came online or went
+// offline. Their content holds the friend's "user_id" and whether they are "online".
+const NotificationCodeFriendPresence int64 = -1
+
+type runtimePresenceUpdate struct {
+	timer   *time.Timer
+	updates int
+}
+
+// RuntimePresenceCoalescer delivers user online status changes to the runtime presence function. Changes for a user
+// within the coalescing window are merged into one delivery, which reports the user's state when it runs.
+type RuntimePresenceCoalescer struct {
+	sync.Mutex
+	logger  *zap.Logger
+	runtime *Runtime
+	tracker Tracker
+	window  time.Duration
+	pending map[uuid.UUID]*runtimePresenceUpdate
+	stopped bool
+}
+
+// NewRuntimePresenceCoalescer creates a presence coalescer, a window of 0 delivers every change on its own.
+func NewRuntimePresenceCoalescer(logger *zap.Logger, runtime *Runtime, tracker Tracker, window time.Duration) *RuntimePresenceCoalescer {
+	return &RuntimePresenceCoalescer{
+		logger:  logger,
+		runtime: runtime,
+		tracker: tracker,
+		window:  window,
+		pending: make(map[uuid.UUID]*runtimePresenceUpdate),
+	}
+}
+
+// HandleDiff is a tracker diff listener. Users come online and go offline as their sessions join and leave their
+// notification topics.
+func (c *RuntimePresenceCoalescer) HandleDiff(joins, leaves []Presence) {
+	if !c.runtime.IsRuntimePresenceRegistered() && !c.runtime.IsRuntimeFriendPresenceRegistered() {
+		return
+	}
+	for _, ps := range [][]Presence{joins, leaves} {
+		for _, p := range ps {
+			if strings.HasPrefix(p.Topic, "notifications:") {
+				c.update(p.UserID)
+			}
+		}
+	}
+}
+
+// Stop drops any pending deliveries.
+func (c *RuntimePresenceCoalescer) Stop() {
+	c.Lock()
+	c.stopped = true
+	for userID, u := range c.pending {
+		u.timer.Stop()
+		delete(c.pending, userID)
+	}
+	c.Unlock()
+}
+
+func (c *RuntimePresenceCoalescer) update(userID uuid.UUID) {
+	c.Lock()
+	defer c.Unlock()
+	if c.stopped {
+		return
+	}
+	if c.window <= 0 {
+		c.deliver(userID, 1)
+		return
+	}
+	if u, ok := c.pending[userID]; ok {
+		u.updates++
+		metrics.IncrCounter([]string{"runtime", "presence", "coalesced"}, 1)
+		return
+	}
+	c.pending[userID] = &runtimePresenceUpdate{
+		timer:   time.AfterFunc(c.window, func() { c.flush(userID) }),
+		updates: 1,
+	}
+}
+
+func (c *RuntimePresenceCoalescer) flush(userID uuid.UUID) {
+	c.Lock()
+	defer c.Unlock()
+	u, ok := c.pending[userID]
+	delete(c.pending, userID)
+	if ok && !c.stopped {
+		c.deliver(userID, u.updates)
+	}
+}
+
+// deliver queues a delivery to the runtime. It must be called with the lock held, and the delivery is skipped if the
+// coalescer stops before it runs. If the runtime worker pool is full the delivery is dropped, logged and counted in
+// runtime.presence.dropped, and the user's next presence change delivers their current state.
+func (c *RuntimePresenceCoalescer) deliver(userID uuid.UUID, updates int) {
+	queued := c.runtime.RunAsync(func() {
+		c.Lock()
+		stopped := c.stopped
+		c.Unlock()
+		if stopped {
+			return
+		}
+
+		// Read the state when the function runs, so the delivered state is never older than the one before it.
+		sessionCount := len(c.tracker.ListByTopic("notifications:" + userID.String()))
+		if err := c.runtime.InvokeFunctionPresence(userID, sessionCount, updates); err != nil {
+			c.logger.Error("Runtime presence function caused an error", zap.Error(err))
+		}
+		c.notifyFriends(userID, sessionCount > 0)
+	})
+	if !queued {
+		c.logger.Warn("Runtime worker pool full, dropping presence invocation", zap.String("uid", userID.String()))
+		metrics.IncrCounter([]string{"runtime", "presence", "dropped"}, 1)
+		return
+	}
+	metrics.IncrCounter([]string{"runtime", "presence", "delivered"}, 1)
+}
+
+// notifyFriends sends a live notification about the user's presence to the friends chosen by the friend presence
+// function. Notifications are not stored, so friends who are offline at the time never see them.
+func (c *RuntimePresenceCoalescer) notifyFriends(userID uuid.UUID, online bool) {
+	if !c.runtime.IsRuntimeFriendPresenceRegistered() {
+		return
+	}
+
+	friends := make([]*User, 0)
+	var cursor []byte
+	for {
+		page, nextCursor, err := c.runtime.GetFriends(userID, runtimePresenceFriendsPageSize, cursor)
+		if err != nil {
+			c.logger.Error("Could not list friends for presence notification", zap.Error(err))
+			return
+		}
+		friends = append(friends, page...)
+		if nextCursor == nil || len(friends) >= runtimePresenceMaxFriends {
+			break
+		}
+		cursor = nextCursor
+	}
+	if len(friends) == 0 {
+		return
+	}
+
+	friendIDs, err := c.runtime.InvokeFunctionFriendPresence(userID, online, friends)
+	if err != nil {
+		c.logger.Error("Runtime friend presence function caused an error", zap.Error(err))
+		return
+	}
+	if len(friendIDs) == 0 {
+		return
+	}
+
+	content, _ := json.Marshal(map[string]interface{}{"user_id": userID.String(), "online": online})
+	notifications := make([]*NNotification, 0, len(friendIDs))
+	for _, friendID := range friendIDs {
+		notifications = append(notifications, &NNotification{
+			UserID:   friendID.Bytes(),
+			Subject:  "friend_presence",
+			Content:  content,
+			Code:     NotificationCodeFriendPresence,
+			SenderID: userID.Bytes(),
+		})
+	}
+	if err := c.runtime.notificationService.NotificationSend(notifications); err != nil {
+		c.logger.Error("Could not send friend presence notifications", zap.Error(err))
+		return
+	}
+	metrics.IncrCounter([]string{"runtime", "presence", "friends_notified"}, float32(len(notifications)))
+}
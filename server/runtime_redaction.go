@@ -0,0 +1,91 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// redactionRule removes or masks the fields found at a path in payloads handed to external after functions.
+type redactionRule struct {
+	path []string
+	mask string
+}
+
+// newRedactionRules parses the configured rules. Paths are dot separated field names in the JSON form of a message,
+// such as "self.user.email", where "*" matches any field or array element.
+func newRedactionRules(config []*RedactionRuleConfig) ([]*redactionRule, error) {
+	rules := make([]*redactionRule, 0, len(config))
+	for _, c := range config {
+		if c == nil || c.Path == "" {
+			return nil, errors.New("redaction rules must have a path")
+		}
+		path := strings.Split(c.Path, ".")
+		for _, segment := range path {
+			if segment == "" {
+				return nil, fmt.Errorf("redaction rule path %v has an empty field name", c.Path)
+			}
+		}
+		rules = append(rules, &redactionRule{path: path, mask: c.Mask})
+	}
+	return rules, nil
+}
+
+// redact applies all rules to the payload in place. Fields are removed, or replaced with the rule's mask if it has one.
+func redact(payload map[string]interface{}, rules []*redactionRule) {
+	for _, rule := range rules {
+		redactPath(payload, rule.path, rule.mask)
+	}
+}
+
+func redactPath(value interface{}, path []string, mask string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if len(path) == 1 {
+			for field := range v {
+				if path[0] != "*" && field != path[0] {
+					continue
+				}
+				if mask == "" {
+					delete(v, field)
+				} else {
+					v[field] = mask
+				}
+			}
+			return
+		}
+		if path[0] == "*" {
+			for _, child := range v {
+				redactPath(child, path[1:], mask)
+			}
+		} else if child, ok := v[path[0]]; ok {
+			redactPath(child, path[1:], mask)
+		}
+	case []interface{}:
+		// Array elements are matched by a wildcard, they cannot be removed without shifting the rest.
+		if path[0] != "*" {
+			return
+		}
+		for i, child := range v {
+			if len(path) == 1 {
+				v[i] = mask
+			} else {
+				redactPath(child, path[1:], mask)
+			}
+		}
+	}
+}
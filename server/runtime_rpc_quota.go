@@ -0,0 +1,101 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// RpcQuotaStore decides whether an API key is allowed to make another runtime RPC call.
+type RpcQuotaStore interface {
+	// Allow records a call for the given API key and RPC ID. If the key is over quota it returns false
+	// along with how long the caller should wait before retrying.
+	Allow(apiKey string, id string) (bool, time.Duration)
+}
+
+// rpcApiKeyUnauthenticated names calls in audit records and metrics when they are rejected before their API key is
+// checked.
+const rpcApiKeyUnauthenticated = "unauthenticated"
+
+// RpcApiKeyName returns the name configured for an API key, which is used in place of the key itself for quotas,
+// metrics and logs. It returns false if keys are configured and the key is missing or not one of them. Without
+// configured keys the header cannot be trusted, so every caller shares the "default" quota.
+func RpcApiKeyName(keys map[string]string, apiKey string) (string, bool) {
+	if len(keys) == 0 {
+		return "default", true
+	}
+	if apiKey == "" {
+		return "", false
+	}
+	name, ok := keys[apiKey]
+	return name, ok
+}
+
+type rpcQuotaWindow struct {
+	start time.Time
+	count int
+}
+
+// LocalRpcQuotaStore is an in-memory fixed window quota store, quotas are not shared between nodes.
+type LocalRpcQuotaStore struct {
+	sync.Mutex
+	limit   int
+	window  time.Duration
+	windows map[string]*rpcQuotaWindow
+	swept   time.Time
+}
+
+// NewLocalRpcQuotaStore creates a quota store allowing up to limit calls per key name in each window.
+// A limit of 0 disables quotas.
+func NewLocalRpcQuotaStore(limit int, window time.Duration) *LocalRpcQuotaStore {
+	return &LocalRpcQuotaStore{
+		limit:   limit,
+		window:  window,
+		windows: make(map[string]*rpcQuotaWindow),
+	}
+}
+
+func (s *LocalRpcQuotaStore) Allow(apiKey string, id string) (bool, time.Duration) {
+	if s.limit <= 0 {
+		return true, 0
+	}
+
+	now := time.Now()
+	s.Lock()
+	defer s.Unlock()
+
+	// Drop windows that have ended, at most once per window, so keys that stop calling do not stay in memory.
+	if now.Sub(s.swept) >= s.window {
+		for key, w := range s.windows {
+			if now.Sub(w.start) >= s.window {
+				delete(s.windows, key)
+			}
+		}
+		s.swept = now
+	}
+
+	w, ok := s.windows[apiKey]
+	if !ok || now.Sub(w.start) >= s.window {
+		s.windows[apiKey] = &rpcQuotaWindow{start: now, count: 1}
+		return true, 0
+	}
+
+	if w.count >= s.limit {
+		return false, w.start.Add(s.window).Sub(now)
+	}
+	w.count++
+	return true, 0
+}
@@ -0,0 +1,104 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"github.com/yuin/gopher-lua"
+)
+
+const SOURCES = "runtime_sources"
+
+// RuntimeUUIDSource generates the UUIDs handed out to runtime scripts.
+type RuntimeUUIDSource interface {
+	NewV4() uuid.UUID
+}
+
+// RuntimeClock is the time source read by runtime scripts.
+type RuntimeClock interface {
+	Now() time.Time
+}
+
+// Sources are the UUID and time sources available to every runtime invocation through the Lua state context.
+// They are consulted by `nakamax.uuid_v4()`, `os.time()` and `os.date()`. `os.clock()` still reports real elapsed time.
+type Sources struct {
+	UUID  RuntimeUUIDSource
+	Clock RuntimeClock
+}
+
+// NewSources returns real UUID and time sources, unless the runtime config asks for deterministic ones.
+// A non-zero deterministic seed makes UUIDs repeatable, a non-zero deterministic time fixes the clock at that Unix time.
+func NewSources(config *RuntimeConfig) *Sources {
+	s := &Sources{
+		UUID:  &realUUIDSource{},
+		Clock: &realClock{},
+	}
+	if config.DeterministicSeed != 0 {
+		s.UUID = &seededUUIDSource{random: rand.New(rand.NewSource(config.DeterministicSeed))}
+	}
+	if config.DeterministicTime != 0 {
+		s.Clock = &fixedClock{now: time.Unix(config.DeterministicTime, 0).UTC()}
+	}
+	return s
+}
+
+// getSources returns the sources set in the Lua state context, falling back to real sources.
+func getSources(l *lua.LState) *Sources {
+	if ctx := l.Context(); ctx != nil {
+		if s, ok := ctx.Value(SOURCES).(*Sources); ok {
+			return s
+		}
+	}
+	return &Sources{UUID: &realUUIDSource{}, Clock: &realClock{}}
+}
+
+type realUUIDSource struct{}
+
+func (r *realUUIDSource) NewV4() uuid.UUID {
+	return uuid.NewV4()
+}
+
+type realClock struct{}
+
+func (r *realClock) Now() time.Time {
+	return time.Now()
+}
+
+type seededUUIDSource struct {
+	sync.Mutex
+	random *rand.Rand
+}
+
+func (s *seededUUIDSource) NewV4() uuid.UUID {
+	u := uuid.UUID{}
+	s.Lock()
+	s.random.Read(u[:])
+	s.Unlock()
+	u.SetVersion(4)
+	u.SetVariant()
+	return u
+}
+
+type fixedClock struct {
+	now time.Time
+}
+
+func (f *fixedClock) Now() time.Time {
+	return f.now
+}
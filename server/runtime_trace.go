@@ -0,0 +1,247 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/yuin/gopher-lua"
+	"go.uber.org/zap"
+)
+
+// TRACE_SPAN is the Lua state context key of the span that runtime calls made by a function belong to.
+const TRACE_SPAN = "runtime_trace_span"
+
+const (
+	runtimeTraceQueueSize     = 1024
+	runtimeTraceBatchSize     = 100
+	runtimeTraceFlushInterval = time.Second
+)
+
+// RuntimeSpan is one timed step of a trace, such as a hook invocation or a runtime call made by it. Spans are exported
+// as JSON in the shape of OpenTelemetry spans, with hex encoded IDs and nanosecond timestamps.
+type RuntimeSpan struct {
+	TraceID    string                 `json:"trace_id"`
+	SpanID     string                 `json:"span_id"`
+	ParentID   string                 `json:"parent_span_id,omitempty"`
+	Name       string                 `json:"name"`
+	StartTime  int64                  `json:"start_time_unix_nano"`
+	EndTime    int64                  `json:"end_time_unix_nano"`
+	Attributes map[string]interface{} `json:"attributes"`
+	Status     string                 `json:"status"`
+
+	tracer *RuntimeTracer
+	start  time.Time
+}
+
+// RuntimeTracer exports spans of runtime function invocations to a collector. Spans are sent in batches from a
+// background goroutine, and dropped if the collector falls behind. A nil tracer creates no spans.
+type RuntimeTracer struct {
+	logger   *zap.Logger
+	endpoint string
+	client   *http.Client
+	queue    chan *RuntimeSpan
+	wg       sync.WaitGroup
+	// Guards the queue against being closed while spans that are still running end.
+	stopMutex sync.RWMutex
+	stopped   bool
+}
+
+// NewRuntimeTracer creates a tracer that posts spans to the endpoint, or returns nil if there is no endpoint.
+func NewRuntimeTracer(logger *zap.Logger, endpoint string) *RuntimeTracer {
+	if endpoint == "" {
+		return nil
+	}
+	t := &RuntimeTracer{
+		logger:   logger,
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 5 * time.Second},
+		queue:    make(chan *RuntimeSpan, runtimeTraceQueueSize),
+	}
+	t.wg.Add(1)
+	go t.run()
+	return t
+}
+
+// Start begins a span, as a child of parent if there is one or as the root of a new trace otherwise.
+func (t *RuntimeTracer) Start(parent *RuntimeSpan, name string, attributes map[string]interface{}) *RuntimeSpan {
+	if t == nil {
+		return nil
+	}
+	if attributes == nil {
+		attributes = make(map[string]interface{})
+	}
+	now := time.Now()
+	s := &RuntimeSpan{
+		SpanID:     runtimeTraceID(8),
+		Name:       name,
+		StartTime:  now.UnixNano(),
+		Attributes: attributes,
+		tracer:     t,
+		start:      now,
+	}
+	if parent != nil {
+		s.TraceID = parent.TraceID
+		s.ParentID = parent.SpanID
+	} else {
+		s.TraceID = runtimeTraceID(16)
+	}
+	return s
+}
+
+// End records the duration and outcome of the span and queues it for export. Spans that end after the tracer was stopped
+// are dropped.
+func (s *RuntimeSpan) End(err error) {
+	if s == nil {
+		return
+	}
+	end := time.Now()
+	s.EndTime = end.UnixNano()
+	s.Attributes["duration_ms"] = float64(end.Sub(s.start)) / float64(time.Millisecond)
+	if err != nil {
+		s.Status = "error"
+		s.Attributes["error"] = err.Error()
+	} else {
+		s.Status = "ok"
+	}
+
+	s.tracer.stopMutex.RLock()
+	defer s.tracer.stopMutex.RUnlock()
+	if s.tracer.stopped {
+		metrics.IncrCounter([]string{"runtime", "trace", "dropped"}, 1)
+		return
+	}
+	select {
+	case s.tracer.queue <- s:
+	default:
+		metrics.IncrCounter([]string{"runtime", "trace", "dropped"}, 1)
+	}
+}
+
+// Stop exports any queued spans and waits for the exporter to finish.
+func (t *RuntimeTracer) Stop() {
+	if t == nil {
+		return
+	}
+	t.stopMutex.Lock()
+	if !t.stopped {
+		t.stopped = true
+		close(t.queue)
+	}
+	t.stopMutex.Unlock()
+	t.wg.Wait()
+}
+
+func (t *RuntimeTracer) run() {
+	defer t.wg.Done()
+	ticker := time.NewTicker(runtimeTraceFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*RuntimeSpan, 0, runtimeTraceBatchSize)
+	for {
+		select {
+		case s, ok := <-t.queue:
+			if !ok {
+				t.export(batch)
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) < runtimeTraceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		t.export(batch)
+		batch = batch[:0]
+	}
+}
+
+func (t *RuntimeTracer) export(spans []*RuntimeSpan) {
+	if len(spans) == 0 {
+		return
+	}
+	body, err := json.Marshal(map[string]interface{}{"spans": spans})
+	if err != nil {
+		t.logger.Error("Could not encode trace spans", zap.Error(err))
+		return
+	}
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.logger.Warn("Could not export trace spans", zap.Error(err))
+		metrics.IncrCounter([]string{"runtime", "trace", "dropped"}, float32(len(spans)))
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		t.logger.Warn("Trace collector rejected spans", zap.Int("status", resp.StatusCode))
+		metrics.IncrCounter([]string{"runtime", "trace", "dropped"}, float32(len(spans)))
+		return
+	}
+	metrics.IncrCounter([]string{"runtime", "trace", "exported"}, float32(len(spans)))
+}
+
+// traceFunction wraps a runtime call so that calls made while a function is traced become child spans of it.
+func (t *RuntimeTracer) traceFunction(name string, fn lua.LGFunction) lua.LGFunction {
+	return func(l *lua.LState) (n int) {
+		ctx := l.Context()
+		var parent *RuntimeSpan
+		if ctx != nil {
+			parent, _ = ctx.Value(TRACE_SPAN).(*RuntimeSpan)
+		}
+		if parent == nil {
+			return fn(l)
+		}
+
+		span := t.Start(parent, "nakama."+name, nil)
+		l.SetContext(context.WithValue(ctx, TRACE_SPAN, span))
+		defer func() {
+			l.SetContext(ctx)
+			// Runtime calls fail by raising a Lua error, which unwinds the call.
+			if p := recover(); p != nil {
+				span.End(fmt.Errorf("%v", p))
+				panic(p)
+			}
+			span.End(nil)
+		}()
+		return fn(l)
+	}
+}
+
+// withTraceSpan makes the span the parent of runtime calls made on the Lua state.
+func withTraceSpan(l *lua.LState, span *RuntimeSpan) {
+	if span == nil {
+		return
+	}
+	ctx := l.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	l.SetContext(context.WithValue(ctx, TRACE_SPAN, span))
+}
+
+func runtimeTraceID(size int) string {
+	id := make([]byte, size)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
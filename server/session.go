@@ -36,16 +36,25 @@ type session struct {
 	userID           uuid.UUID
 	handle           *atomic.String
 	lang             string
+	clientVersion    string
 	expiry           int64
+	token            string
+	clientIP         string
+	region           string // JSON set by the runtime presence region function, copied to the session's presences.
+	createdAt        int64
+	rateLimiter      *sessionRateLimiter
+	sequence         *SessionSequence
+	mutedTopics      map[string]bool // Only used while processing the session's own messages, so it needs no lock.
 	stopped          bool
 	conn             *websocket.Conn
 	pingTicker       *time.Ticker
 	pingTickerStopCh chan (bool)
 	unregister       func(s *session)
+	transform        func(s *session, envelope *Envelope) *Envelope
 }
 
 // NewSession creates a new session which encapsulates a socket connection
-func NewSession(logger *zap.Logger, config Config, userID uuid.UUID, handle string, lang string, expiry int64, websocketConn *websocket.Conn, unregister func(s *session)) *session {
+func NewSession(logger *zap.Logger, config Config, userID uuid.UUID, handle string, lang string, clientVersion string, expiry int64, token string, clientIP string, rateLimitTier string, region string, websocketConn *websocket.Conn, unregister func(s *session), transform func(s *session, envelope *Envelope) *Envelope) *session {
 	sessionID := uuid.NewV4()
 	sessionLogger := logger.With(zap.String("uid", userID.String()), zap.String("sid", sessionID.String()))
 
@@ -58,12 +67,21 @@ func NewSession(logger *zap.Logger, config Config, userID uuid.UUID, handle stri
 		userID:           userID,
 		handle:           atomic.NewString(handle),
 		lang:             lang,
+		clientVersion:    clientVersion,
 		expiry:           expiry,
+		token:            token,
+		clientIP:         clientIP,
+		region:           region,
+		createdAt:        nowMs(),
+		rateLimiter:      newSessionRateLimiter(config.GetRateLimit(), rateLimitTier),
+		sequence:         NewSessionSequence(config.GetSession().SequencedMessageTypes),
+		mutedTopics:      make(map[string]bool),
 		conn:             websocketConn,
 		stopped:          false,
 		pingTicker:       time.NewTicker(time.Duration(config.GetTransport().PingPeriodMs) * time.Millisecond),
 		pingTickerStopCh: make(chan bool),
 		unregister:       unregister,
+		transform:        transform,
 	}
 }
 
@@ -143,6 +161,10 @@ func (s *session) pingNow() bool {
 func (s *session) Send(envelope *Envelope) error {
 	s.logger.Debug(fmt.Sprintf("Sending %T message", envelope.Payload), zap.String("cid", envelope.CollationId))
 
+	if s.transform != nil {
+		envelope = s.transform(s, envelope)
+	}
+
 	payload, err := proto.Marshal(envelope)
 
 	if err != nil {
@@ -162,7 +184,7 @@ func (s *session) SendBytes(payload []byte) error {
 	}
 
 	s.conn.SetWriteDeadline(time.Now().Add(time.Duration(s.config.GetTransport().WriteWaitMs) * time.Millisecond))
-	err := s.conn.WriteMessage(websocket.BinaryMessage, payload)
+	err := CompressionWriteMessage(s.conn, s.config.GetTransport().CompressionMinBytes, payload)
 	if err != nil {
 		s.logger.Warn("Could not write message", zap.Error(err))
 		//TODO investigate whether we need to cleanupClosedConnection if write fails
@@ -21,8 +21,10 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"mime"
+	"net"
 	"net/http"
 	"regexp"
 	"strconv"
@@ -31,6 +33,7 @@ import (
 
 	"nakama/pkg/social"
 
+	"github.com/armon/go-metrics"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gogo/protobuf/jsonpb"
 	"github.com/gogo/protobuf/proto"
@@ -65,7 +68,10 @@ type authenticationService struct {
 	registry          *SessionRegistry
 	pipeline          *pipeline
 	runtime           *Runtime
+	clusterNodes      ClusterNodes
+	rpcQuotaStore     RpcQuotaStore
 	mux               *mux.Router
+	server            *http.Server
 	hmacSecretByte    []byte
 	upgrader          *websocket.Upgrader
 	socialClient      *social.Client
@@ -75,7 +81,7 @@ type authenticationService struct {
 }
 
 // NewAuthenticationService creates a new AuthenticationService
-func NewAuthenticationService(logger *zap.Logger, config Config, db *sql.DB, statService StatsService, registry *SessionRegistry, socialClient *social.Client, pipeline *pipeline, runtime *Runtime) *authenticationService {
+func NewAuthenticationService(logger *zap.Logger, config Config, db *sql.DB, statService StatsService, registry *SessionRegistry, socialClient *social.Client, pipeline *pipeline, runtime *Runtime, rpcQuotaStore RpcQuotaStore) *authenticationService {
 	a := &authenticationService{
 		logger:         logger,
 		config:         config,
@@ -84,13 +90,16 @@ func NewAuthenticationService(logger *zap.Logger, config Config, db *sql.DB, sta
 		registry:       registry,
 		pipeline:       pipeline,
 		runtime:        runtime,
+		clusterNodes:   NewStaticClusterNodes(config.GetName(), config.GetCluster().Nodes),
+		rpcQuotaStore:  rpcQuotaStore,
 		socialClient:   socialClient,
 		random:         rand.New(rand.NewSource(time.Now().UnixNano())),
 		hmacSecretByte: []byte(config.GetSession().EncryptionKey),
 		upgrader: &websocket.Upgrader{
-			ReadBufferSize:  1024,
-			WriteBufferSize: 1024,
-			CheckOrigin:     func(r *http.Request) bool { return true },
+			ReadBufferSize:    1024,
+			WriteBufferSize:   1024,
+			CheckOrigin:       func(r *http.Request) bool { return true },
+			EnableCompression: config.GetTransport().CompressionEnabled,
 		},
 		jsonpbMarshaler: &jsonpb.Marshaler{
 			EnumsAsInts:  true,
@@ -140,8 +149,8 @@ func (a *authenticationService) configure() {
 		}
 
 		token := r.URL.Query().Get("token")
-		uid, handle, exp, auth := a.authenticateToken(token)
-		if !auth {
+		uid, handle, exp, authType, auth := a.authenticateToken(token)
+		if !auth || a.registry.IsRevoked(token, uid, exp) {
 			http.Error(w, "Missing or invalid token", 401)
 			return
 		}
@@ -152,32 +161,87 @@ func (a *authenticationService) configure() {
 			lang = "en"
 		}
 
-		conn, err := a.upgrader.Upgrade(w, r, nil)
+		// Clients may report their version so runtime hooks and transforms can adapt messages to older clients.
+		clientVersion := r.URL.Query().Get("version")
+		if clientVersion == "" {
+			clientVersion = r.Header.Get("X-Nakama-Client-Version")
+		}
+
+		// Sessions the runtime prefers on another node are sent there before the connection is upgraded.
+		if node, address := RuntimeSessionNodeHook(a.logger, a.runtime, a.clusterNodes, uid, handle, exp); address != "" {
+			w.Header().Set("X-Nakama-Node", node)
+			http.Redirect(w, r, redirectScheme(r)+"://"+address+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+			return
+		}
+
+		clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			clientIP = r.RemoteAddr
+		}
+
+		// The duplicate policy is applied on every connect, so one token cannot open any number of sockets. Only
+		// sessions on this node are considered, as with other per user session lookups. Other sessions are only kicked
+		// once this connection is upgraded and has an IP slot, by the registry as it adds the session, so a connection
+		// rejected for either reason leaves them open.
+		duplicatePolicy := a.config.GetSession().DuplicatePolicy
+		if sessions := a.registry.ListUser(uid); len(sessions) != 0 {
+			duplicatePolicy = RuntimeSessionDuplicateHook(a.logger, a.runtime, duplicatePolicy, uid, handle, authType, clientIP, sessions)
+			if duplicatePolicy == SESSION_DUPLICATE_REJECT {
+				http.Error(w, "User already has an active session", 409)
+				return
+			}
+		}
+
+		conn, err := CompressionUpgrade(a.upgrader, w, r)
 		if err != nil {
 			// http.Error is invoked automatically from within the Upgrade func
 			a.logger.Warn("Could not upgrade to websockets", zap.Error(err))
 			return
 		}
 
-		a.registry.add(uid, handle, lang, exp, conn, a.pipeline.processRequest)
+		if !a.registry.acquireIP(clientIP) {
+			a.logger.Warn("Too many sessions from client IP, closing connection", zap.String("client_ip", clientIP))
+			closeMessage := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "Too many connections from this IP address")
+			conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Duration(a.config.GetTransport().WriteWaitMs)*time.Millisecond))
+			conn.Close()
+			return
+		}
+
+		a.runtime.RecordActiveUser(uid)
+		rateLimitTier := RuntimeRateLimitTierHook(a.logger, a.runtime, uid, handle, exp)
+		region := RuntimePresenceRegionHook(a.logger, a.runtime, uid, handle, exp, clientIP)
+
+		a.registry.Add(uid, handle, lang, clientVersion, exp, token, clientIP, rateLimitTier, region, duplicatePolicy, conn, a.pipeline.ProcessRequest, a.pipeline.transformResponse)
 	}).Methods("GET", "OPTIONS")
 
 	a.mux.HandleFunc("/runtime/{path}", func(w http.ResponseWriter, r *http.Request) {
+		// Every call is audited, including those rejected before the API key is known.
+		path := mux.Vars(r)["path"]
+		keyName := rpcApiKeyUnauthenticated
+		status := 200
+		start := time.Now()
+		defer func() {
+			RuntimeAfterHookRpc(a.logger, keyName, path, status, time.Since(start))
+		}()
+
 		accept := r.Header.Get("accept")
 		if accept != "" && accept != "application/json" {
-			http.Error(w, "Runtime function only accept JSON data", 400)
+			status = 400
+			http.Error(w, "Runtime function only accept JSON data", status)
 			return
 		}
 
 		contentType := r.Header.Get("content-type")
 		if contentType != "" && contentType != "application/json" {
-			http.Error(w, "Runtime function expects JSON data", 400)
+			status = 400
+			http.Error(w, "Runtime function expects JSON data", status)
 			return
 		}
 
 		key := r.URL.Query().Get("key")
 		if key != a.config.GetRuntime().HTTPKey {
-			http.Error(w, "Invalid runtime key", 401)
+			status = 401
+			http.Error(w, "Invalid runtime key", status)
 			return
 		}
 
@@ -186,11 +250,27 @@ func (a *authenticationService) configure() {
 			return
 		}
 
-		path := mux.Vars(r)["path"]
+		name, ok := RpcApiKeyName(a.config.GetRuntime().RPCAPIKeys, r.Header.Get("X-Nakama-Api-Key"))
+		if !ok {
+			metrics.IncrCounter([]string{"runtime", "rpc", "invalid_key"}, 1)
+			status = 401
+			http.Error(w, "Invalid API key", status)
+			return
+		}
+		keyName = name
+
+		if allowed, retryAfter := RuntimeBeforeHookRpc(a.logger, a.rpcQuotaStore, keyName, path); !allowed {
+			status = 429
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			http.Error(w, "Runtime function quota exceeded", status)
+			return
+		}
+
 		fn := a.runtime.GetRuntimeCallback(HTTP, path)
 		if fn == nil {
 			a.logger.Warn("HTTP invocation failed as path was not found", zap.String("path", path))
-			http.Error(w, "Runtime function could not be invoked. Path not found.", 404)
+			status = 404
+			http.Error(w, "Runtime function could not be invoked. Path not found.", status)
 			return
 		}
 
@@ -202,21 +282,24 @@ func (a *authenticationService) configure() {
 			payload = nil
 		case err != nil:
 			a.logger.Error("Could not decode request data", zap.Error(err))
-			http.Error(w, "Bad request data", 400)
+			status = 400
+			http.Error(w, "Bad request data", status)
 			return
 		}
 
 		responseData, funError := a.runtime.InvokeFunctionHTTP(fn, uuid.Nil, "", 0, payload)
 		if funError != nil {
 			a.logger.Error("Runtime function caused an error", zap.String("path", path), zap.Error(funError))
-			http.Error(w, fmt.Sprintf("Runtime function caused an error: %s", funError.Error()), 500)
+			status = 500
+			http.Error(w, fmt.Sprintf("Runtime function caused an error: %s", funError.Error()), status)
 			return
 		}
 
 		responseBytes, err := json.Marshal(responseData)
 		if err != nil {
 			a.logger.Error("Could not marshal function response data", zap.Error(err))
-			http.Error(w, "Runtime function caused an error", 500)
+			status = 500
+			http.Error(w, "Runtime function caused an error", status)
 			return
 		}
 		w.Header().Set("X-Content-Type-Options", "nosniff")
@@ -227,14 +310,19 @@ func (a *authenticationService) configure() {
 	}).Methods("POST", "OPTIONS")
 }
 
+// Handler returns the handler serving the client API, with CORS applied.
+func (a *authenticationService) Handler() http.Handler {
+	CORSHeaders := handlers.AllowedHeaders([]string{"Authorization", "Content-Type", "X-Nakama-Api-Key"})
+	CORSOrigins := handlers.AllowedOrigins([]string{"*"})
+
+	return handlers.CORS(CORSHeaders, CORSOrigins)(a.mux)
+}
+
 func (a *authenticationService) StartServer(logger *zap.Logger) {
+	a.server = &http.Server{Addr: fmt.Sprintf(":%d", a.config.GetPort()), Handler: a.Handler()}
 	go func() {
-		CORSHeaders := handlers.AllowedHeaders([]string{"Authorization", "Content-Type"})
-		CORSOrigins := handlers.AllowedOrigins([]string{"*"})
-
-		handlerWithCORS := handlers.CORS(CORSHeaders, CORSOrigins)(a.mux)
-		err := http.ListenAndServe(fmt.Sprintf(":%d", a.config.GetPort()), handlerWithCORS)
-		if err != nil {
+		err := a.server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
 			logger.Fatal("Client listener failed", zap.Error(err))
 		}
 	}()
@@ -303,12 +391,15 @@ func (a *authenticationService) handleAuth(w http.ResponseWriter, r *http.Reques
 	}
 
 	uid, _ := uuid.FromBytes(userID)
+
 	exp := time.Now().UTC().Add(time.Duration(a.config.GetSession().TokenExpiryMs) * time.Millisecond).Unix()
 
+	// The auth type is kept in the token for the session duplicate function, which runs when the token connects.
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 		"uid": uid.String(),
 		"exp": exp,
 		"han": handle,
+		"aut": strings.TrimSuffix(strings.TrimPrefix(messageType, "*server."), "_"),
 	})
 	signedToken, _ := token.SignedString(a.hmacSecretByte)
 
@@ -1011,17 +1102,31 @@ WHERE NOT EXISTS
 }
 
 func (a *authenticationService) generateHandle() string {
-	b := make([]byte, 10)
-	for i := range b {
-		b[i] = letters[a.random.Intn(len(letters))]
+	var handle string
+	// Generated handles go through the same naming policy as handles chosen by users.
+	for attempt := 0; attempt < 5; attempt++ {
+		b := make([]byte, 10)
+		for i := range b {
+			b[i] = letters[a.random.Intn(len(letters))]
+		}
+		handle = string(b)
+
+		normalized, reason, err := a.runtime.InvokeFunctionHandle(uuid.Nil, handle)
+		if err != nil {
+			a.logger.Error("Runtime handle function caused an error", zap.Error(err))
+			return handle
+		} else if reason == "" {
+			return normalized
+		}
 	}
-	return string(b)
+	a.logger.Warn("Runtime handle function rejected all generated handles", zap.String("handle", handle))
+	return handle
 }
 
-func (a *authenticationService) authenticateToken(tokenString string) (uuid.UUID, string, int64, bool) {
+func (a *authenticationService) authenticateToken(tokenString string) (uuid.UUID, string, int64, string, bool) {
 	if tokenString == "" {
 		a.logger.Warn("Token missing")
-		return uuid.Nil, "", 0, false
+		return uuid.Nil, "", 0, "", false
 	}
 
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
@@ -1036,21 +1141,44 @@ func (a *authenticationService) authenticateToken(tokenString string) (uuid.UUID
 			uid, uerr := uuid.FromString(claims["uid"].(string))
 			if uerr != nil {
 				a.logger.Warn("Invalid user ID in token", zap.String("token", tokenString), zap.Error(uerr))
-				return uuid.Nil, "", 0, false
+				return uuid.Nil, "", 0, "", false
 			}
-			return uid, claims["han"].(string), int64(claims["exp"].(float64)), true
+			authType, _ := claims["aut"].(string)
+			return uid, claims["han"].(string), int64(claims["exp"].(float64)), authType, true
 		}
 	}
 
 	a.logger.Warn("Token invalid", zap.String("token", tokenString), zap.Error(err))
-	return uuid.Nil, "", 0, false
+	return uuid.Nil, "", 0, "", false
 }
 
 func (a *authenticationService) Stop() {
-	// TODO stop incoming net connections
+	// Refuse new connections first. Established sessions are not affected, so the runtime shutdown function can still
+	// reach connected users before their sessions are closed.
+	if a.server != nil {
+		if err := a.server.Close(); err != nil {
+			a.logger.Error("Could not close client listener", zap.Error(err))
+		}
+	}
+	RuntimeShutdownHook(a.logger, a.runtime, time.Duration(a.config.GetRuntime().ShutdownTimeoutMs)*time.Millisecond)
 	a.registry.stop()
 }
 
+// redirectScheme returns the WebSocket scheme a client should reconnect with, wss if it connected over TLS either
+// directly or through a proxy that terminates TLS and sets X-Forwarded-Proto.
+func redirectScheme(r *http.Request) string {
+	switch strings.ToLower(strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-Proto"), ",")[0])) {
+	case "https", "wss":
+		return "wss"
+	case "http", "ws":
+		return "ws"
+	}
+	if r.TLS != nil {
+		return "wss"
+	}
+	return "ws"
+}
+
 func now() time.Time {
 	return time.Now().UTC()
 }
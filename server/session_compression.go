@@ -0,0 +1,118 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/gorilla/websocket"
+	"go.uber.org/atomic"
+)
+
+// CompressionUpgrade upgrades a client connection to a websocket. Connections that negotiate permessage-deflate count
+// the bytes they write to the network, to measure what compression saves. Messages are compressed at the websocket
+// library's default deflate level, with its default window bits and memory level.
+func CompressionUpgrade(upgrader *websocket.Upgrader, w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
+	negotiated := upgrader.EnableCompression && compressionOffered(r)
+	if negotiated {
+		w = &compressionResponseWriter{ResponseWriter: w}
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, err
+	}
+	if negotiated {
+		metrics.IncrCounter([]string{"session", "compression", "negotiated"}, 1)
+	}
+	return conn, nil
+}
+
+// CompressionWriteMessage writes a binary message to a websocket. If the connection negotiated compression, messages
+// smaller than minBytes are sent uncompressed, deflate would cost more than it saves, and the sizes and write time of
+// every message are recorded.
+func CompressionWriteMessage(conn *websocket.Conn, minBytes int, payload []byte) error {
+	c, ok := conn.UnderlyingConn().(*compressionConn)
+	if !ok {
+		return conn.WriteMessage(websocket.BinaryMessage, payload)
+	}
+	compressed := len(payload) >= minBytes
+	conn.EnableWriteCompression(compressed)
+	start := time.Now()
+	writtenBefore := c.written.Load()
+	err := conn.WriteMessage(websocket.BinaryMessage, payload)
+	c.measure(compressed, len(payload), writtenBefore, start)
+	return err
+}
+
+// compressionConn is the network connection of a session that negotiated permessage-deflate. It counts the bytes
+// written to the network, so each message's size on the wire can be compared with its payload.
+type compressionConn struct {
+	net.Conn
+	written *atomic.Int64
+}
+
+func (c *compressionConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+// measure records one data message written since the given number of bytes were on the wire. Compressed and
+// uncompressed messages are recorded apart, so the time compressing costs can be weighed against the bytes it saves.
+func (c *compressionConn) measure(compressed bool, payloadBytes int, writtenBefore int64, start time.Time) {
+	kind := "uncompressed"
+	if compressed {
+		kind = "compressed"
+	}
+	metrics.MeasureSince([]string{"session", "write", kind, "latency"}, start)
+	metrics.AddSample([]string{"session", "write", kind, "payload_bytes"}, float32(payloadBytes))
+	metrics.AddSample([]string{"session", "write", kind, "wire_bytes"}, float32(c.written.Load()-writtenBefore))
+}
+
+// compressionResponseWriter hands the websocket upgrade a counting connection when it hijacks the HTTP connection.
+type compressionResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w *compressionResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not implement http.Hijacker")
+	}
+	conn, rw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &compressionConn{Conn: conn, written: atomic.NewInt64(0)}, rw, nil
+}
+
+// compressionOffered reports whether the client offers permessage-deflate, which the upgrade accepts when compression
+// is enabled.
+func compressionOffered(r *http.Request) bool {
+	for _, header := range r.Header["Sec-Websocket-Extensions"] {
+		for _, extension := range strings.Split(header, ",") {
+			if strings.TrimSpace(strings.SplitN(extension, ";", 2)[0]) == "permessage-deflate" {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/armon/go-metrics"
+	"go.uber.org/zap"
+)
+
+// An IP's session count is published as a gauge only while it holds at least this fraction of the limit, so the number
+// of series stays bounded by how many IPs can come near the limit at once.
+const sessionIPGaugeFraction = 0.75
+
+// SessionIPLimiter caps the concurrent sessions each client IP may hold on this node. Exempt IPs, such as known NAT
+// gateways shared by many players, are never limited but are still counted.
+type SessionIPLimiter struct {
+	sync.Mutex
+	limit  int
+	exempt []*net.IPNet
+	counts map[string]int
+}
+
+// NewSessionIPLimiter creates a limiter allowing limit sessions per IP, 0 allows any number. Exempt entries are IPs or
+// CIDR ranges, invalid entries are logged and ignored.
+func NewSessionIPLimiter(logger *zap.Logger, limit int, exempt []string) *SessionIPLimiter {
+	l := &SessionIPLimiter{
+		limit:  limit,
+		exempt: make([]*net.IPNet, 0, len(exempt)),
+		counts: make(map[string]int),
+	}
+	for _, e := range exempt {
+		if !strings.Contains(e, "/") {
+			if ip := net.ParseIP(e); ip != nil && ip.To4() != nil {
+				e += "/32"
+			} else {
+				e += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(e)
+		if err != nil {
+			logger.Warn("Ignoring invalid connection limit exempt address", zap.String("address", e), zap.Error(err))
+			continue
+		}
+		l.exempt = append(l.exempt, ipNet)
+	}
+	return l
+}
+
+// Acquire counts a new session from the IP, and returns false without counting it if the IP is at its limit.
+func (l *SessionIPLimiter) Acquire(clientIP string) bool {
+	l.Lock()
+	defer l.Unlock()
+	count := l.counts[clientIP]
+	if l.limit > 0 && count >= l.limit && !l.isExempt(clientIP) {
+		metrics.IncrCounter([]string{"session", "ip", "rejected"}, 1)
+		return false
+	}
+	l.counts[clientIP] = count + 1
+	if l.nearLimit(count + 1) {
+		metrics.SetGauge([]string{"session", "ip", sessionIPMetricName(clientIP), "connections"}, float32(count+1))
+	}
+	return true
+}
+
+// Release uncounts a closed session from the IP.
+func (l *SessionIPLimiter) Release(clientIP string) {
+	l.Lock()
+	defer l.Unlock()
+	count := l.counts[clientIP] - 1
+	if count <= 0 {
+		delete(l.counts, clientIP)
+		count = 0
+	} else {
+		l.counts[clientIP] = count
+	}
+	// The IP's gauge is still published when it falls below the threshold, so it does not keep its last value.
+	if l.nearLimit(count + 1) {
+		metrics.SetGauge([]string{"session", "ip", sessionIPMetricName(clientIP), "connections"}, float32(count))
+	}
+}
+
+// nearLimit returns true if a session count is high enough for its IP's gauge to be published. No gauges are
+// published while sessions are not limited.
+func (l *SessionIPLimiter) nearLimit(count int) bool {
+	return l.limit > 0 && float64(count) >= sessionIPGaugeFraction*float64(l.limit)
+}
+
+// sessionIPMetricName makes an IP safe to use as a metric name segment, replacing separators such as dots and colons.
+func sessionIPMetricName(clientIP string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') {
+			return r
+		}
+		return '_'
+	}, clientIP)
+}
+
+func (l *SessionIPLimiter) isExempt(clientIP string) bool {
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range l.exempt {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+const sessionRateLimitPeriod = time.Minute
+
+type sessionRateLimitWindow struct {
+	start time.Time
+	count int
+}
+
+// sessionRateLimiter limits the messages one session may send, using fixed one minute windows for the session's tier.
+type sessionRateLimiter struct {
+	sync.Mutex
+	tier    string
+	config  *RateLimitTierConfig
+	all     *sessionRateLimitWindow
+	windows map[string]*sessionRateLimitWindow
+}
+
+// newSessionRateLimiter creates a rate limiter for the given tier. Unknown tiers fall back to the default tier, and
+// sessions are unlimited if neither is configured.
+func newSessionRateLimiter(config *RateLimitConfig, tier string) *sessionRateLimiter {
+	tierConfig, ok := config.Tiers[tier]
+	if !ok {
+		tier = config.DefaultTier
+		tierConfig = config.Tiers[tier]
+	}
+	if tierConfig == nil {
+		tierConfig = &RateLimitTierConfig{}
+	}
+
+	metrics.IncrCounter([]string{"session", "rate_limit", tier, "sessions"}, 1)
+	return &sessionRateLimiter{
+		tier:    tier,
+		config:  tierConfig,
+		all:     &sessionRateLimitWindow{},
+		windows: make(map[string]*sessionRateLimitWindow),
+	}
+}
+
+// Allow records a message of the given type, and returns false if it exceeds the tier's total or per type limit.
+func (r *sessionRateLimiter) Allow(messageType string) bool {
+	typeLimit := r.config.MessageTypes[messageType]
+	if r.config.MessagesPerMinute <= 0 && typeLimit <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	r.Lock()
+	defer r.Unlock()
+
+	window, ok := r.windows[messageType]
+	if !ok {
+		window = &sessionRateLimitWindow{}
+		r.windows[messageType] = window
+	}
+	if !r.all.allow(now, r.config.MessagesPerMinute) || !window.allow(now, typeLimit) {
+		metrics.IncrCounter([]string{"session", "rate_limit", r.tier, "limited"}, 1)
+		return false
+	}
+	r.all.count++
+	window.count++
+	return true
+}
+
+// allow starts a new window if the current one has elapsed, and reports whether another message fits in it.
+func (w *sessionRateLimitWindow) allow(now time.Time, limit int) bool {
+	if now.Sub(w.start) >= sessionRateLimitPeriod {
+		w.start = now
+		w.count = 0
+	}
+	return limit <= 0 || w.count < limit
+}
@@ -15,39 +15,89 @@
 package server
 
 import (
+	"database/sql"
+	"errors"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/satori/go.uuid"
 	"go.uber.org/zap"
 )
 
+// Policies for a user connecting while they have active sessions on the same node: allow the new session alongside
+// the others, kick the others by disconnecting them, or reject the connection.
+const (
+	SESSION_DUPLICATE_ALLOW  = "allow"
+	SESSION_DUPLICATE_KICK   = "kick"
+	SESSION_DUPLICATE_REJECT = "reject"
+)
+
+// ValidateSessionDuplicatePolicy checks a configured session duplicate policy.
+func ValidateSessionDuplicatePolicy(policy string) error {
+	switch policy {
+	case SESSION_DUPLICATE_ALLOW, SESSION_DUPLICATE_KICK, SESSION_DUPLICATE_REJECT:
+		return nil
+	}
+	return errors.New("Session duplicate policy must be 'allow', 'kick' or 'reject'")
+}
+
 // SessionRegistry maintains a list of sessions to their IDs. This is thread-safe.
 type SessionRegistry struct {
 	sync.RWMutex
 	logger     *zap.Logger
 	config     Config
+	db         *sql.DB
 	tracker    Tracker
 	matchmaker Matchmaker
 	sessions   map[uuid.UUID]*session
+	// Sessions of each user on this node, so the duplicate policy is applied under the same lock sessions are added.
+	users map[uuid.UUID]map[uuid.UUID]*session
+	// Hashes of revoked session tokens, mapped to the token expiry so they can be dropped once they'd be rejected anyway.
+	revoked map[string]int64
+	// Users whose tokens are all revoked if they expire at or before the time they are mapped to.
+	revokedUsers map[uuid.UUID]int64
+	// When revocations stored by other nodes were last read, in milliseconds.
+	revocationsSyncedAt int64
+	// Last message sequences of closed sessions by token, if sequences resume on reconnect.
+	sequences *SessionSequenceResumes
+	ipLimiter *SessionIPLimiter
+	stopCh    chan struct{}
+}
+
+// SessionInfo describes an active session.
+type SessionInfo struct {
+	ID        uuid.UUID
+	UserID    uuid.UUID
+	CreatedAt int64
+	ClientIP  string
 }
 
 // NewSessionRegistry creates a new SessionRegistry
-func NewSessionRegistry(logger *zap.Logger, config Config, tracker Tracker, matchmaker Matchmaker) *SessionRegistry {
+func NewSessionRegistry(logger *zap.Logger, config Config, db *sql.DB, tracker Tracker, matchmaker Matchmaker) *SessionRegistry {
 	return &SessionRegistry{
-		logger:     logger,
-		config:     config,
-		tracker:    tracker,
-		matchmaker: matchmaker,
-		sessions:   make(map[uuid.UUID]*session),
+		logger:       logger,
+		config:       config,
+		db:           db,
+		tracker:      tracker,
+		matchmaker:   matchmaker,
+		sessions:     make(map[uuid.UUID]*session),
+		users:        make(map[uuid.UUID]map[uuid.UUID]*session),
+		revoked:      make(map[string]int64),
+		revokedUsers: make(map[uuid.UUID]int64),
+		sequences:    NewSessionSequenceResumes(),
+		ipLimiter:    NewSessionIPLimiter(logger, config.GetTransport().MaxSessionsPerIP, config.GetTransport().SessionLimitExempt),
+		stopCh:       make(chan struct{}),
 	}
 }
 
 func (a *SessionRegistry) stop() {
+	close(a.stopCh)
 	a.Lock()
 	for _, session := range a.sessions {
 		if a.sessions[session.id] != nil {
 			delete(a.sessions, session.id)
+			delete(a.users, session.userID)
 			go func() {
 				a.matchmaker.RemoveAll(session.id) // Drop all active matchmaking requests for this session.
 				a.tracker.UntrackAll(session.id)   // Drop all tracked presences for this session.
@@ -67,22 +117,105 @@ func (a *SessionRegistry) Get(sessionID uuid.UUID) *session {
 	return s
 }
 
-func (a *SessionRegistry) add(userID uuid.UUID, handle string, lang string, expiry int64, conn *websocket.Conn, processRequest func(logger *zap.Logger, session *session, envelope *Envelope)) {
-	s := NewSession(a.logger, a.config, userID, handle, lang, expiry, conn, a.remove)
+// ListUser returns the active sessions of the given user on this node. Sessions on other nodes are not listed.
+func (a *SessionRegistry) ListUser(userID uuid.UUID) []*SessionInfo {
+	// Every session tracks its user's notification topic, so that's a cheap lookup for a user's sessions.
+	ps := a.tracker.ListLocalByTopic("notifications:" + userID.String())
+	infos := make([]*SessionInfo, 0, len(ps))
+	for _, p := range ps {
+		if s := a.Get(p.ID.SessionID); s != nil {
+			infos = append(infos, &SessionInfo{
+				ID:        s.id,
+				UserID:    s.userID,
+				CreatedAt: s.createdAt,
+				ClientIP:  s.clientIP,
+			})
+		}
+	}
+	return infos
+}
+
+// acquireIP reserves a session for the client IP, and returns false if the IP already holds as many sessions as it is
+// allowed. Reserved sessions are released when the session added for them is removed.
+func (a *SessionRegistry) acquireIP(clientIP string) bool {
+	return a.ipLimiter.Acquire(clientIP)
+}
+
+// Add starts a session on a connection that has been authenticated and upgraded, and serves it until it closes. It
+// blocks while the session is open. The duplicate policy is applied to the user's other sessions on this node in the
+// same step the session is added, so sessions connecting at once cannot both get past it. With kick the other sessions
+// are removed and disconnected, with reject the connection is closed if the user has any, releasing the IP slot
+// acquired for it.
+func (a *SessionRegistry) Add(userID uuid.UUID, handle string, lang string, clientVersion string, expiry int64, token string, clientIP string, rateLimitTier string, region string, duplicatePolicy string, conn *websocket.Conn, processRequest func(logger *zap.Logger, session *session, envelope *Envelope), transformResponse func(session *session, envelope *Envelope) *Envelope) {
 	a.Lock()
+	if duplicatePolicy == SESSION_DUPLICATE_REJECT && len(a.users[userID]) != 0 {
+		a.ipLimiter.Release(clientIP)
+		a.Unlock()
+		a.logger.Info("User already has an active session, closing connection", zap.String("uid", userID.String()))
+		closeMessage := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "User already has an active session")
+		conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Duration(a.config.GetTransport().WriteWaitMs)*time.Millisecond))
+		conn.Close()
+		return
+	}
+	var kicked []*session
+	if duplicatePolicy == SESSION_DUPLICATE_KICK {
+		for _, k := range a.users[userID] {
+			kicked = append(kicked, k)
+			a.removeLocked(k)
+		}
+	}
+	s := NewSession(a.logger, a.config, userID, handle, lang, clientVersion, expiry, token, clientIP, rateLimitTier, region, conn, a.remove, transformResponse)
 	a.sessions[s.id] = s
+	if a.users[userID] == nil {
+		a.users[userID] = make(map[uuid.UUID]*session)
+	}
+	a.users[userID][s.id] = s
+	if last, ok := a.sequences.Take(token, time.Now().Unix()); ok {
+		s.sequence.Commit(last)
+	}
 	a.Unlock()
+
+	for _, k := range kicked {
+		k.logger.Info("Session kicked")
+		k.close()
+	}
+	// Notifications are routed to all of a user's sessions through this topic.
+	a.tracker.Track(s.id, "notifications:"+userID.String(), userID, PresenceMeta{Handle: handle, Region: region})
 	s.Consume(processRequest)
 }
 
+// Kick disconnects a session without revoking its token, the client may connect again with it.
+func (a *SessionRegistry) Kick(sessionID uuid.UUID) bool {
+	s := a.Get(sessionID)
+	if s == nil {
+		return false
+	}
+	s.logger.Info("Session kicked")
+	s.close()
+	return true
+}
+
 func (a *SessionRegistry) remove(c *session) {
 	a.Lock()
+	a.removeLocked(c)
+	a.Unlock()
+}
+
+// removeLocked removes a session from the registry, the caller must hold the registry lock.
+func (a *SessionRegistry) removeLocked(c *session) {
 	if a.sessions[c.id] != nil {
 		delete(a.sessions, c.id)
+		delete(a.users[c.userID], c.id)
+		if len(a.users[c.userID]) == 0 {
+			delete(a.users, c.userID)
+		}
+		a.ipLimiter.Release(c.clientIP)
+		if a.config.GetSession().SequenceResume {
+			a.sequences.Keep(c.token, c.sequence.Last(), c.expiry, time.Now().Unix())
+		}
 		go func() {
 			a.matchmaker.RemoveAll(c.id) // Drop all active matchmaking requests for this session.
 			a.tracker.UntrackAll(c.id)   // Drop all tracked presences for this session.
 		}()
 	}
-	a.Unlock()
 }
@@ -0,0 +1,200 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/sha256"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+// Kinds of session revocation: a single token, or every token issued to a user up to an expiry.
+const (
+	sessionRevocationToken = 0
+	sessionRevocationUser  = 1
+)
+
+// How often each node reads revocations made by other nodes. A revoked token can reach another node's sessions for up
+// to this long before that node closes them.
+const sessionRevocationSyncInterval = 5 * time.Second
+
+// How far back each read looks, so revocations written by a node whose clock lags are still picked up.
+const sessionRevocationSyncLagMs = 60000
+
+// Start reads revocations made by other nodes in the background until the registry is stopped.
+func (a *SessionRegistry) Start() {
+	a.syncRevocations()
+	go func() {
+		ticker := time.NewTicker(sessionRevocationSyncInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-a.stopCh:
+				return
+			case <-ticker.C:
+				a.syncRevocations()
+			}
+		}
+	}()
+}
+
+// Revoke rejects the session's token until it expires, and disconnects every session using the token on this node. The
+// revocation is stored, and other nodes close their sessions using the token the next time they read revocations, at
+// most sessionRevocationSyncInterval later. It returns false if the session is not found, sessions are only looked up
+// on this node.
+func (a *SessionRegistry) Revoke(sessionID uuid.UUID) bool {
+	s := a.Get(sessionID)
+	if s == nil {
+		return false
+	}
+
+	hash := sessionTokenHash(s.token)
+	a.Lock()
+	a.revoked[hash] = s.expiry
+	a.Unlock()
+	a.storeRevocation([]byte(hash), sessionRevocationToken, s.userID, s.expiry)
+
+	a.closeRevoked()
+	return true
+}
+
+// RevokeUser rejects every token issued to the user so far, and disconnects the user's sessions on this node. Other
+// nodes close the user's sessions the next time they read revocations, like Revoke.
+func (a *SessionRegistry) RevokeUser(userID uuid.UUID) {
+	// No token issued until now expires later than a token issued now.
+	before := time.Now().UTC().Add(time.Duration(a.config.GetSession().TokenExpiryMs) * time.Millisecond).Unix()
+	a.Lock()
+	if a.revokedUsers[userID] < before {
+		a.revokedUsers[userID] = before
+	}
+	a.Unlock()
+	a.storeRevocation(userID.Bytes(), sessionRevocationUser, userID, before)
+
+	a.closeRevoked()
+}
+
+// IsRevoked reports whether the session token was revoked, on its own or along with all of its user's tokens.
+func (a *SessionRegistry) IsRevoked(token string, userID uuid.UUID, expiry int64) bool {
+	a.RLock()
+	defer a.RUnlock()
+	return a.isRevoked(sessionTokenHash(token), userID, expiry)
+}
+
+// isRevoked must be called with the lock held.
+func (a *SessionRegistry) isRevoked(hash string, userID uuid.UUID, expiry int64) bool {
+	if _, revoked := a.revoked[hash]; revoked {
+		return true
+	}
+	before, ok := a.revokedUsers[userID]
+	return ok && expiry <= before
+}
+
+func (a *SessionRegistry) storeRevocation(id []byte, kind int, userID uuid.UUID, expiry int64) {
+	_, err := a.db.Exec(`
+INSERT INTO session_revocation (id, kind, user_id, expires_at, created_at) VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (id) DO UPDATE SET expires_at = $4, created_at = $5`, id, kind, userID.Bytes(), expiry, nowMs())
+	if err != nil {
+		a.logger.Error("Could not store session revocation, it only applies on this node", zap.Error(err))
+	}
+}
+
+type sessionRevocation struct {
+	id     []byte
+	kind   int
+	userID []byte
+	expiry int64
+}
+
+// syncRevocations reads the revocations stored since the last read, and closes the local sessions they cover.
+// Expired revocations are dropped, their tokens are rejected anyway. Revocations are read before the lock is taken, so
+// sessions are not held up waiting on the database.
+func (a *SessionRegistry) syncRevocations() {
+	now := time.Now().Unix()
+	syncedAt := nowMs()
+	a.RLock()
+	since := a.revocationsSyncedAt - sessionRevocationSyncLagMs
+	a.RUnlock()
+	rows, err := a.db.Query("SELECT id, kind, user_id, expires_at FROM session_revocation WHERE created_at >= $1 AND expires_at > $2", since, now)
+	if err != nil {
+		a.logger.Warn("Could not read session revocations", zap.Error(err))
+		return
+	}
+	revocations := make([]*sessionRevocation, 0)
+	for rows.Next() {
+		r := &sessionRevocation{}
+		if err := rows.Scan(&r.id, &r.kind, &r.userID, &r.expiry); err != nil {
+			a.logger.Warn("Could not read session revocations", zap.Error(err))
+			break
+		}
+		revocations = append(revocations, r)
+	}
+	rows.Close()
+
+	a.Lock()
+	for hash, expiry := range a.revoked {
+		if expiry <= now {
+			delete(a.revoked, hash)
+		}
+	}
+	for userID, expiry := range a.revokedUsers {
+		if expiry <= now {
+			delete(a.revokedUsers, userID)
+		}
+	}
+	for _, r := range revocations {
+		if r.kind == sessionRevocationUser {
+			uid := uuid.FromBytesOrNil(r.userID)
+			if a.revokedUsers[uid] < r.expiry {
+				a.revokedUsers[uid] = r.expiry
+			}
+		} else {
+			a.revoked[string(r.id)] = r.expiry
+		}
+	}
+	a.revocationsSyncedAt = syncedAt
+	a.Unlock()
+
+	if len(revocations) != 0 {
+		a.closeRevoked()
+	}
+
+	if _, err := a.db.Exec("DELETE FROM session_revocation WHERE expires_at <= $1", now); err != nil {
+		a.logger.Warn("Could not remove expired session revocations", zap.Error(err))
+	}
+}
+
+// closeRevoked disconnects this node's sessions whose tokens are revoked.
+func (a *SessionRegistry) closeRevoked() {
+	revoked := make([]*session, 0)
+	a.RLock()
+	for _, s := range a.sessions {
+		if a.isRevoked(sessionTokenHash(s.token), s.userID, s.expiry) {
+			revoked = append(revoked, s)
+		}
+	}
+	a.RUnlock()
+
+	for _, s := range revoked {
+		s.logger.Info("Session revoked")
+		s.close()
+	}
+}
+
+func sessionTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return string(sum[:])
+}
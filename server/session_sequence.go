@@ -0,0 +1,156 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// SessionSequence checks the sequence numbers a session's client puts on its messages, so replayed and reordered
+// messages are rejected. Each message carrying a sequence must have a higher one than any message the session sent
+// before, gaps are allowed. Messages of the sequenced types must carry one.
+type SessionSequence struct {
+	sync.Mutex
+	types map[string]bool
+	last  int64
+}
+
+func NewSessionSequence(types []string) *SessionSequence {
+	q := &SessionSequence{
+		types: make(map[string]bool, len(types)),
+	}
+	for _, t := range types {
+		q.types[t] = true
+	}
+	return q
+}
+
+// Last returns the highest sequence accepted from the session so far, 0 if none.
+func (q *SessionSequence) Last() int64 {
+	q.Lock()
+	defer q.Unlock()
+	return q.last
+}
+
+// Check reports whether a message of the given type and sequence is in order. It does not accept the sequence, that is
+// left to Commit once the message has passed all other checks.
+func (q *SessionSequence) Check(messageType string, sequence int64) bool {
+	if sequence == 0 && !q.types[messageType] {
+		return true
+	}
+	q.Lock()
+	defer q.Unlock()
+	return sequence > q.last
+}
+
+// Commit accepts a sequence, later messages must carry a higher one.
+func (q *SessionSequence) Commit(sequence int64) {
+	q.Lock()
+	if sequence > q.last {
+		q.last = sequence
+	}
+	q.Unlock()
+}
+
+// SessionSequenceResumes keeps the last sequences of closed sessions by token, so a client reconnecting with the same
+// token carries on from it instead of starting over. Entries are dropped when their token expires, soonest first from
+// a heap, so closing a session never scans the others. It is not safe for concurrent use, the session registry lock
+// guards it.
+type SessionSequenceResumes struct {
+	tokens map[string]*sessionSequenceResume
+	heap   sessionSequenceResumeHeap
+}
+
+type sessionSequenceResume struct {
+	token  string
+	last   int64
+	expiry int64
+	index  int
+}
+
+func NewSessionSequenceResumes() *SessionSequenceResumes {
+	return &SessionSequenceResumes{
+		tokens: make(map[string]*sessionSequenceResume),
+	}
+}
+
+// Keep remembers the last sequence of a token until the token expires, in seconds. Tokens already expired at now are
+// dropped, along with every other expired token.
+func (r *SessionSequenceResumes) Keep(token string, last, expiry, now int64) {
+	r.expire(now)
+	if last == 0 || expiry <= now {
+		return
+	}
+	if resume, ok := r.tokens[token]; ok {
+		resume.last = last
+		resume.expiry = expiry
+		heap.Fix(&r.heap, resume.index)
+		return
+	}
+	resume := &sessionSequenceResume{token: token, last: last, expiry: expiry}
+	r.tokens[token] = resume
+	heap.Push(&r.heap, resume)
+}
+
+// Take returns and forgets the last sequence kept for a token, if it has not expired.
+func (r *SessionSequenceResumes) Take(token string, now int64) (int64, bool) {
+	resume, ok := r.tokens[token]
+	if !ok {
+		return 0, false
+	}
+	delete(r.tokens, token)
+	heap.Remove(&r.heap, resume.index)
+	if resume.expiry <= now {
+		return 0, false
+	}
+	return resume.last, true
+}
+
+// Len returns how many tokens have a sequence kept.
+func (r *SessionSequenceResumes) Len() int {
+	return len(r.tokens)
+}
+
+func (r *SessionSequenceResumes) expire(now int64) {
+	for len(r.heap) > 0 && r.heap[0].expiry <= now {
+		resume := heap.Pop(&r.heap).(*sessionSequenceResume)
+		delete(r.tokens, resume.token)
+	}
+}
+
+// sessionSequenceResumeHeap orders resumes by expiry, soonest first.
+type sessionSequenceResumeHeap []*sessionSequenceResume
+
+func (h sessionSequenceResumeHeap) Len() int           { return len(h) }
+func (h sessionSequenceResumeHeap) Less(i, j int) bool { return h[i].expiry < h[j].expiry }
+func (h sessionSequenceResumeHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *sessionSequenceResumeHeap) Push(x interface{}) {
+	resume := x.(*sessionSequenceResume)
+	resume.index = len(*h)
+	*h = append(*h, resume)
+}
+
+func (h *sessionSequenceResumeHeap) Pop() interface{} {
+	old := *h
+	resume := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return resume
+}
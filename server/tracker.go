@@ -28,6 +28,12 @@ type PresenceID struct {
 
 type PresenceMeta struct {
 	Handle string
+	// Metadata is JSON set by the runtime match join function, it is only used for match presences.
+	Metadata string
+	// Region is JSON set by the runtime presence region function from the IP the session connected from.
+	Region string
+	// Role is assigned by an authoritative match when the presence joins it, such as player or spectator.
+	Role string
 }
 
 type Presence struct {
@@ -55,6 +61,8 @@ type Tracker interface {
 	ListByTopic(topic string) []Presence
 	// List presences on the current node by topic.
 	ListLocalByTopic(topic string) []Presence
+	// List presences by user, across all their sessions.
+	ListByUser(userID uuid.UUID) []Presence
 }
 
 type presenceCompact struct {
@@ -68,6 +76,8 @@ type TrackerService struct {
 	name          string
 	diffListeners []func([]Presence, []Presence)
 	values        map[presenceCompact]PresenceMeta
+	// The same presences indexed by user, so listing a user's presences does not scan all of them.
+	byUser map[uuid.UUID]map[presenceCompact]bool
 }
 
 func NewTrackerService(name string) *TrackerService {
@@ -75,6 +85,29 @@ func NewTrackerService(name string) *TrackerService {
 		name:          name,
 		diffListeners: make([]func([]Presence, []Presence), 0),
 		values:        make(map[presenceCompact]PresenceMeta),
+		byUser:        make(map[uuid.UUID]map[presenceCompact]bool),
+	}
+}
+
+// add stores a presence and indexes it, callers must hold the lock.
+func (t *TrackerService) add(pc presenceCompact, meta PresenceMeta) {
+	t.values[pc] = meta
+	userPresences, ok := t.byUser[pc.UserID]
+	if !ok {
+		userPresences = make(map[presenceCompact]bool)
+		t.byUser[pc.UserID] = userPresences
+	}
+	userPresences[pc] = true
+}
+
+// remove deletes a presence and its index entry, callers must hold the lock.
+func (t *TrackerService) remove(pc presenceCompact) {
+	delete(t.values, pc)
+	if userPresences, ok := t.byUser[pc.UserID]; ok {
+		delete(userPresences, pc)
+		if len(userPresences) == 0 {
+			delete(t.byUser, pc.UserID)
+		}
 	}
 }
 
@@ -93,7 +126,7 @@ func (t *TrackerService) Track(sessionID uuid.UUID, topic string, userID uuid.UU
 	t.Lock()
 	_, ok := t.values[pc]
 	if !ok {
-		t.values[pc] = meta
+		t.add(pc, meta)
 		t.notifyDiffListeners(
 			[]Presence{
 				Presence{ID: pc.ID, Topic: topic, UserID: userID, Meta: meta},
@@ -109,7 +142,7 @@ func (t *TrackerService) Untrack(sessionID uuid.UUID, topic string, userID uuid.
 	t.Lock()
 	meta, ok := t.values[pc]
 	if ok {
-		delete(t.values, pc)
+		t.remove(pc)
 		t.notifyDiffListeners(
 			[]Presence{},
 			[]Presence{
@@ -130,7 +163,7 @@ func (t *TrackerService) UntrackAll(sessionID uuid.UUID) {
 	}
 	if len(ps) != 0 {
 		for _, p := range ps {
-			delete(t.values, presenceCompact{ID: p.ID, Topic: p.Topic, UserID: p.UserID})
+			t.remove(presenceCompact{ID: p.ID, Topic: p.Topic, UserID: p.UserID})
 		}
 		t.notifyDiffListeners(
 			[]Presence{},
@@ -224,6 +257,16 @@ func (t *TrackerService) ListLocalByTopic(topic string) []Presence {
 	return ps
 }
 
+func (t *TrackerService) ListByUser(userID uuid.UUID) []Presence {
+	ps := make([]Presence, 0)
+	t.RLock()
+	for pc := range t.byUser[userID] {
+		ps = append(ps, Presence{ID: pc.ID, Topic: pc.Topic, UserID: userID, Meta: t.values[pc]})
+	}
+	t.RUnlock()
+	return ps
+}
+
 func (t *TrackerService) notifyDiffListeners(joins, leaves []Presence) {
 	go func() {
 		for _, f := range t.diffListeners {
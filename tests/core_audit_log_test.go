@@ -0,0 +1,145 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"crypto/sha256"
+	"sync"
+	"testing"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"nakama/server"
+)
+
+func TestAuditLogVerify(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+	logger, _ := zap.NewDevelopment(zap.AddStacktrace(zap.ErrorLevel))
+	auditLog := server.NewAuditLogService(logger, db, []byte("testauditlogkey"))
+
+	first, err := auditLog.Append(uuid.Nil, []byte(`{"action":"ban"}`))
+	assert.Nil(t, err, "err was not nil")
+	second, err := auditLog.Append(uuid.Nil, []byte(`{"action":"unban"}`))
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, first+1, second, "sequence numbers were not consecutive")
+
+	// Digests of events are keyed, so a kept digest cannot confirm a guess at an erased event.
+	var digest []byte
+	err = db.QueryRow("SELECT event_digest FROM audit_log WHERE seq = $1", first).Scan(&digest)
+	assert.Nil(t, err, "err was not nil")
+	sum := sha256.Sum256([]byte(`{"action":"ban"}`))
+	assert.NotEqual(t, sum[:], digest, "event digest was not keyed")
+
+	broken, err := auditLog.Verify()
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, int64(0), broken, "chain was not intact")
+
+	_, err = db.Exec("UPDATE audit_log SET event = $1 WHERE seq = $2", []byte(`{"action":"kick"}`), first)
+	assert.Nil(t, err, "err was not nil")
+	broken, err = auditLog.Verify()
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, first, broken, "tampered entry was not reported")
+
+	// Restore the entry so the chain stays intact for other tests.
+	_, err = db.Exec("UPDATE audit_log SET event = $1 WHERE seq = $2", []byte(`{"action":"ban"}`), first)
+	assert.Nil(t, err, "err was not nil")
+}
+
+func TestAuditLogAppendConcurrent(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+	logger, _ := zap.NewDevelopment(zap.AddStacktrace(zap.ErrorLevel))
+	// Two services stand in for two nodes, their appends only meet in the database.
+	auditLogs := []*server.AuditLogService{
+		server.NewAuditLogService(logger, db, []byte("testauditlogkey")),
+		server.NewAuditLogService(logger, db, []byte("testauditlogkey")),
+	}
+
+	var wg sync.WaitGroup
+	seqs := make(chan int64, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(auditLog *server.AuditLogService) {
+			defer wg.Done()
+			seq, err := auditLog.Append(uuid.NewV4(), []byte(`{"action":"flag"}`))
+			assert.Nil(t, err, "err was not nil")
+			seqs <- seq
+		}(auditLogs[i%2])
+	}
+	wg.Wait()
+	close(seqs)
+
+	seen := make(map[int64]bool)
+	for seq := range seqs {
+		assert.False(t, seen[seq], "sequence number was used twice")
+		seen[seq] = true
+	}
+	broken, err := auditLogs[0].Verify()
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, int64(0), broken, "chain was not intact")
+}
+
+func TestAuditLogVerifyErased(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+	logger, _ := zap.NewDevelopment(zap.AddStacktrace(zap.ErrorLevel))
+	auditLog := server.NewAuditLogService(logger, db, []byte("testauditlogkey"))
+
+	erasedUser := uuid.NewV4()
+	erased, err := auditLog.Append(erasedUser, []byte(`{"action":"ban"}`))
+	assert.Nil(t, err, "err was not nil")
+	otherUser := uuid.NewV4()
+	other, err := auditLog.Append(otherUser, []byte(`{"action":"flag"}`))
+	assert.Nil(t, err, "err was not nil")
+
+	tx, err := db.Begin()
+	assert.Nil(t, err, "err was not nil")
+	assert.Nil(t, auditLog.Erase(tx, erasedUser.Bytes(), 1000), "err was not nil")
+	assert.Nil(t, tx.Commit(), "err was not nil")
+	broken, err := auditLog.Verify()
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, int64(0), broken, "chain with a signed erasure was not intact")
+
+	// An erased entry whose event is rewritten is reported.
+	_, err = db.Exec("UPDATE audit_log SET event = $1 WHERE seq = $2", []byte(`{"action":"unban"}`), erased)
+	assert.Nil(t, err, "err was not nil")
+	broken, err = auditLog.Verify()
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, erased, broken, "rewritten erased entry was not reported")
+	_, err = db.Exec("UPDATE audit_log SET event = '{}' WHERE seq = $1", erased)
+	assert.Nil(t, err, "err was not nil")
+
+	// An entry marked as erased without the key is reported.
+	_, err = db.Exec("UPDATE audit_log SET event = '{}', user_id = NULL, erased_at = 1000 WHERE seq = $1", other)
+	assert.Nil(t, err, "err was not nil")
+	broken, err = auditLog.Verify()
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, other, broken, "forged erasure was not reported")
+
+	// Restore the entry so the chain stays intact for other tests.
+	_, err = db.Exec("UPDATE audit_log SET event = $1, user_id = $2, erased_at = 0 WHERE seq = $3", []byte(`{"action":"flag"}`), otherUser.Bytes(), other)
+	assert.Nil(t, err, "err was not nil")
+}
@@ -0,0 +1,74 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"nakama/server"
+)
+
+func TestGroupCheckCapacity(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	groupID := uuid.NewV4()
+	_, err = db.Exec(`INSERT INTO groups (id, creator_id, name, metadata, count, created_at, updated_at)
+VALUES ($1, $2, $3, $4, 2, 1, 1)`, groupID.Bytes(), uuid.NewV4().Bytes(), generateString(), []byte(`{"max_count":2}`))
+	assert.Nil(t, err, "err was not nil")
+
+	tx, err := db.Begin()
+	assert.Nil(t, err, "err was not nil")
+	_, err = server.GroupCheckCapacity(tx, groupID.Bytes())
+	assert.Equal(t, server.ErrGroupFull, err, "join at capacity was not rejected")
+	tx.Rollback()
+
+	_, err = db.Exec("UPDATE groups SET count = 1 WHERE id = $1", groupID.Bytes())
+	assert.Nil(t, err, "err was not nil")
+	tx, err = db.Begin()
+	assert.Nil(t, err, "err was not nil")
+	state, err := server.GroupCheckCapacity(tx, groupID.Bytes())
+	assert.Nil(t, err, "join below capacity was rejected")
+	assert.Equal(t, int64(0), state, "state was not public")
+	tx.Rollback()
+}
+
+func TestGroupMetadataMaxCount(t *testing.T) {
+	stripped := server.GroupMetadataStripMaxCount([]byte(`{"max_count":500,"tier":"gold"}`))
+	assert.Equal(t, `{"tier":"gold"}`, string(stripped), "client max_count was not removed")
+	assert.Equal(t, `[1]`, string(server.GroupMetadataStripMaxCount([]byte(`[1]`))), "invalid metadata was changed")
+
+	// An update without a limit keeps the stored one, even when it removes the metadata.
+	kept, err := server.GroupMetadataKeepMaxCount([]byte(`{"tier":"silver"}`), []byte(`{"max_count":50}`))
+	assert.Nil(t, err, "err was not nil")
+	var m map[string]interface{}
+	assert.Nil(t, json.Unmarshal(kept, &m), "kept metadata was not valid JSON")
+	assert.Equal(t, float64(50), m["max_count"], "stored max_count was not kept")
+	assert.Equal(t, "silver", m["tier"], "updated metadata was not kept")
+
+	kept, err = server.GroupMetadataKeepMaxCount(nil, []byte(`{"max_count":50}`))
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, `{"max_count":50}`, string(kept), "removing metadata removed the limit")
+
+	kept, err = server.GroupMetadataKeepMaxCount([]byte(`{"max_count":80}`), []byte(`{"max_count":50}`))
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, `{"max_count":80}`, string(kept), "limit set by a before hook was replaced")
+}
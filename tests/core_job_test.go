@@ -0,0 +1,101 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"nakama/server"
+)
+
+func TestJobQueueRetryDeadLetter(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+	logger, _ := zap.NewDevelopment(zap.AddStacktrace(zap.ErrorLevel))
+
+	queue := generateString()
+	id, err := server.JobEnqueue(logger, db, queue, uuid.Nil, []byte("{\"reward\":10}"))
+	assert.Nil(t, err, "err was not nil")
+	assert.NotEmpty(t, id, "id was empty")
+
+	jobs, err := server.JobClaim(logger, db, queue, 10, 2)
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, jobs, 1, "jobs length was not 1")
+	assert.Equal(t, int64(1), jobs[0].Attempts, "attempts was not 1")
+	assert.Equal(t, "{\"reward\":10}", string(jobs[0].Payload), "payload did not match")
+
+	jobs2, err := server.JobClaim(logger, db, queue, 10, 2)
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, jobs2, 0, "leased job was claimed twice")
+
+	dead, err := server.JobFail(logger, db, jobs[0], 2, errors.New("first failure"))
+	assert.Nil(t, err, "err was not nil")
+	assert.False(t, dead, "job was dead lettered before max attempts")
+
+	// Skip the retry backoff.
+	_, err = db.Exec("UPDATE job SET run_at = 1 WHERE id = $1", id)
+	assert.Nil(t, err, "err was not nil")
+	jobs, err = server.JobClaim(logger, db, queue, 10, 2)
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, jobs, 1, "jobs length was not 1")
+	assert.Equal(t, int64(2), jobs[0].Attempts, "attempts was not 2")
+
+	dead, err = server.JobFail(logger, db, jobs[0], 2, errors.New("second failure"))
+	assert.Nil(t, err, "err was not nil")
+	assert.True(t, dead, "job was not dead lettered at max attempts")
+
+	_, err = db.Exec("UPDATE job SET run_at = 1 WHERE id = $1", id)
+	assert.Nil(t, err, "err was not nil")
+	jobs, err = server.JobClaim(logger, db, queue, 10, 2)
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, jobs, 0, "dead lettered job was claimed")
+}
+
+func TestJobClaimExhaustedLease(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+	logger, _ := zap.NewDevelopment(zap.AddStacktrace(zap.ErrorLevel))
+
+	queue := generateString()
+	id, err := server.JobEnqueue(logger, db, queue, uuid.Nil, []byte("{}"))
+	assert.Nil(t, err, "err was not nil")
+
+	jobs, err := server.JobClaim(logger, db, queue, 10, 1)
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, jobs, 1, "jobs length was not 1")
+
+	// The worker stops without completing or failing the job, and its lease on the last attempt ends.
+	_, err = db.Exec("UPDATE job SET run_at = 1 WHERE id = $1", id)
+	assert.Nil(t, err, "err was not nil")
+	jobs, err = server.JobClaim(logger, db, queue, 10, 1)
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, jobs, 0, "exhausted job was claimed")
+
+	var attempts, deadAt int64
+	err = db.QueryRow("SELECT attempts, dead_at FROM job WHERE id = $1", id).Scan(&attempts, &deadAt)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, int64(1), attempts, "attempts was not 1")
+	assert.NotZero(t, deadAt, "exhausted job was not dead lettered")
+}
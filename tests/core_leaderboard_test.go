@@ -0,0 +1,103 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"nakama/server"
+)
+
+func TestLeaderboardRecordIncrementDecay(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+	logger, _ := zap.NewDevelopment(zap.AddStacktrace(zap.ErrorLevel))
+
+	uid := uuid.NewV4()
+	handle := uid.String()[:20]
+	_, err = db.Exec("INSERT INTO users (id, handle, email, created_at, updated_at) VALUES ($1, $2, $3, $4, $4)", uid.Bytes(), handle, handle+"@example.com", 1)
+	assert.Nil(t, err, "err was not nil")
+	leaderboardID := []byte(uuid.NewV4().String())
+	_, err = db.Exec("INSERT INTO leaderboard (id, sort_order) VALUES ($1, 1)", leaderboardID)
+	assert.Nil(t, err, "err was not nil")
+
+	record, err := server.LeaderboardRecordIncrementDecay(logger, db, nil, leaderboardID, uid.Bytes(), 1000, 60000)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, int64(1000), record.Score, "first increment should start from zero")
+
+	// Age the last decay by two half-lives, the next increment decays it to a quarter before adding. Updating the
+	// record in between does not reset the decay.
+	_, err = db.Exec("UPDATE leaderboard_record SET decayed_at = decayed_at - 120000 WHERE leaderboard_id = $1 AND owner_id = $2", leaderboardID, uid.Bytes())
+	assert.Nil(t, err, "err was not nil")
+	_, err = db.Exec("UPDATE leaderboard_record SET updated_at = $3 WHERE leaderboard_id = $1 AND owner_id = $2", leaderboardID, uid.Bytes(), record.UpdatedAt+1000)
+	assert.Nil(t, err, "err was not nil")
+	record, err = server.LeaderboardRecordIncrementDecay(logger, db, nil, leaderboardID, uid.Bytes(), 100, 60000)
+	assert.Nil(t, err, "err was not nil")
+	assert.InDelta(t, 350, record.Score, 2, "score was not decayed and incremented")
+	assert.Equal(t, int64(2), record.NumScore, "num score did not match")
+
+	var score, updatedAt, decayedAt int64
+	err = db.QueryRow("SELECT score, updated_at, decayed_at FROM leaderboard_record WHERE leaderboard_id = $1 AND owner_id = $2", leaderboardID, uid.Bytes()).Scan(&score, &updatedAt, &decayedAt)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, record.Score, score, "stored score did not match")
+	assert.Equal(t, record.UpdatedAt, decayedAt, "decay time was not stored with the score")
+
+	assert.Equal(t, int64(500), server.LeaderboardDecayScore(1000, 60000, 60000), "decayed score did not match")
+	assert.Equal(t, int64(1000), server.LeaderboardDecayScore(1000, 0, 60000), "score decayed without elapsed time")
+}
+
+func TestLeaderboardRecordIncrementDecayConcurrent(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+	logger, _ := zap.NewDevelopment(zap.AddStacktrace(zap.ErrorLevel))
+
+	uid := uuid.NewV4()
+	handle := uid.String()[:20]
+	_, err = db.Exec("INSERT INTO users (id, handle, email, created_at, updated_at) VALUES ($1, $2, $3, $4, $4)", uid.Bytes(), handle, handle+"@example.com", 1)
+	assert.Nil(t, err, "err was not nil")
+	leaderboardID := []byte(uuid.NewV4().String())
+	_, err = db.Exec("INSERT INTO leaderboard (id, sort_order) VALUES ($1, 1)", leaderboardID)
+	assert.Nil(t, err, "err was not nil")
+
+	// A half-life far longer than the test keeps decay negligible, so every delta must be counted exactly once.
+	// Conflicting increments are retried, so each one succeeds.
+	n := int64(5)
+	var wg sync.WaitGroup
+	for i := int64(0); i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := server.LeaderboardRecordIncrementDecay(logger, db, nil, leaderboardID, uid.Bytes(), 1000000, 365*24*3600*1000)
+			assert.Nil(t, err, "err was not nil")
+		}()
+	}
+	wg.Wait()
+
+	var score, numScore int64
+	err = db.QueryRow("SELECT score, num_score FROM leaderboard_record WHERE leaderboard_id = $1 AND owner_id = $2", leaderboardID, uid.Bytes()).Scan(&score, &numScore)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, n, numScore, "num score did not match increments")
+	assert.InDelta(t, n*1000000, score, float64(n), "score did not match the sum of all increments")
+}
@@ -0,0 +1,121 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/satori/go.uuid"
+	"nakama/server"
+)
+
+func TestMatchDataScratchEvictsLeastRecentlyUpdated(t *testing.T) {
+	s := server.NewMatchDataScratch()
+	matchID := uuid.NewV4()
+	first := uuid.NewV4()
+	increment := func(state map[string]interface{}) (map[string]interface{}, error) {
+		count, _ := state["count"].(int)
+		return map[string]interface{}{"count": count + 1}, nil
+	}
+	if err := s.Update(matchID, first, increment); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10000; i++ {
+		if err := s.Update(matchID, uuid.NewV4(), increment); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var seen map[string]interface{}
+	s.Update(matchID, first, func(state map[string]interface{}) (map[string]interface{}, error) {
+		seen = state
+		return state, nil
+	})
+	if seen != nil {
+		t.Error("Expected the least recently updated state to be evicted", seen)
+	}
+}
+
+func TestMatchDataScratchConcurrentUpdates(t *testing.T) {
+	s := server.NewMatchDataScratch()
+	matchID := uuid.NewV4()
+	userID := uuid.NewV4()
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	applied := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := s.Update(matchID, userID, func(state map[string]interface{}) (map[string]interface{}, error) {
+				count, _ := state["count"].(int)
+				return map[string]interface{}{"count": count + 1}, nil
+			})
+			if err == nil {
+				mutex.Lock()
+				applied++
+				mutex.Unlock()
+			} else if err != server.ErrMatchDataScratchConflict {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var count int
+	s.Update(matchID, userID, func(state map[string]interface{}) (map[string]interface{}, error) {
+		count, _ = state["count"].(int)
+		return state, nil
+	})
+	if count != applied {
+		t.Error("Expected every applied update to be kept", count, applied)
+	}
+}
+
+func TestMatchDataScratchKick(t *testing.T) {
+	s := server.NewMatchDataScratch()
+	matchID := uuid.NewV4()
+	userID := uuid.NewV4()
+	if err := s.Update(matchID, userID, func(state map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{"suspicion": 10}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Kick(matchID, userID)
+	if !s.Kicked(matchID, userID) {
+		t.Error("Expected user to be kicked from the match")
+	}
+	if s.Kicked(uuid.NewV4(), userID) {
+		t.Error("Expected kick to apply to one match only")
+	}
+	s.Update(matchID, userID, func(state map[string]interface{}) (map[string]interface{}, error) {
+		if state != nil {
+			t.Error("Expected kick to clear the user's state", state)
+		}
+		return nil, nil
+	})
+
+	// Errors leave the state as it was.
+	failed := errors.New("failed")
+	if err := s.Update(matchID, userID, func(state map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{"suspicion": 1}, failed
+	}); err != failed {
+		t.Error("Expected the function's error", err)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"testing"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"nakama/server"
+)
+
+func TestTopicMessagesHistoryFilter(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+	logger, _ := zap.NewDevelopment(zap.AddStacktrace(zap.ErrorLevel))
+
+	room := []byte(generateString())
+	alice := uuid.NewV4()
+	bob := uuid.NewV4()
+	for i, sender := range []uuid.UUID{alice, bob, alice, bob, alice} {
+		data := "{\"text\":\"hello\"}"
+		if i%2 == 0 {
+			data = "{\"text\":\"Some BADWORD here\"}"
+		}
+		_, err := db.Exec(`
+INSERT INTO message (topic, topic_type, message_id, user_id, created_at, expires_at, handle, type, data)
+VALUES ($1, 1, $2, $3, $4, 0, $5, 0, $6)`, room, uuid.NewV4().Bytes(), sender.Bytes(), int64(1000+i), "h", []byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	topic := &server.TopicId{Id: &server.TopicId_Room{Room: room}}
+
+	messages, cursor, err := server.TopicMessagesHistory(logger, db, topic, &server.TopicMessageFilter{UserID: bob.Bytes()}, 10, nil)
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, messages, 2, "messages length was not 2")
+	assert.Nil(t, cursor, "cursor was not nil")
+
+	messages, cursor, err = server.TopicMessagesHistory(logger, db, topic, &server.TopicMessageFilter{Contains: "badword"}, 2, nil)
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, messages, 2, "messages length was not 2")
+	assert.Equal(t, int64(1004), messages[0].CreatedAt, "messages were not newest first")
+	assert.NotNil(t, cursor, "cursor was nil")
+
+	messages, cursor, err = server.TopicMessagesHistory(logger, db, topic, &server.TopicMessageFilter{Contains: "badword"}, 2, cursor)
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, messages, 1, "messages length was not 1")
+	assert.Equal(t, int64(1000), messages[0].CreatedAt, "second page did not continue the first")
+	assert.Nil(t, cursor, "cursor was not nil")
+}
@@ -0,0 +1,96 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"nakama/server"
+)
+
+func TestNodeLocalStoreIncrConcurrent(t *testing.T) {
+	s := server.NewNodeLocalStore()
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.Incr("counter", 1, 0); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if value, ok, err := s.Get("counter"); err != nil || !ok || value != "10" {
+		t.Error("Expected concurrent increments to add up", value, ok, err)
+	}
+}
+
+func TestNodeLocalStoreExpiry(t *testing.T) {
+	s := server.NewNodeLocalStore()
+
+	if err := s.Set("short", "a", 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("cleared", "b", 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	// Setting a key again without a TTL makes it never expire.
+	if err := s.Set("cleared", "b", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Incr("counter", 1, 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	// Incrementing without a TTL keeps the expiry the key has.
+	if _, err := s.Incr("counter", 1, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if _, ok, err := s.Get("short"); err != nil || ok {
+		t.Error("Expected key to expire after TTL", err)
+	}
+	if value, ok, err := s.Get("cleared"); err != nil || !ok || value != "b" {
+		t.Error("Expected key set without a TTL to be kept", value, ok, err)
+	}
+	if _, ok, err := s.Get("counter"); err != nil || ok {
+		t.Error("Expected incremented key to keep its expiry", err)
+	}
+}
+
+func TestNodeLocalStoreInvalidKey(t *testing.T) {
+	s := server.NewNodeLocalStore()
+	long := string(make([]byte, 129))
+
+	if _, _, err := s.Get(""); err != server.ErrNodeLocalKeyInvalid {
+		t.Error("Expected empty key to be rejected on get", err)
+	}
+	if _, _, err := s.Get(long); err != server.ErrNodeLocalKeyInvalid {
+		t.Error("Expected long key to be rejected on get", err)
+	}
+	if err := s.Set(long, "value", 0); err != server.ErrNodeLocalKeyInvalid {
+		t.Error("Expected long key to be rejected on set", err)
+	}
+	if _, err := s.Incr("", 1, 0); err != server.ErrNodeLocalKeyInvalid {
+		t.Error("Expected empty key to be rejected on incr", err)
+	}
+	if err := s.Set("big", string(make([]byte, 16*1024+1)), 0); err != server.ErrNodeLocalValueTooLarge {
+		t.Error("Expected large value to be rejected", err)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"nakama/server"
+)
+
+func TestNotificationQueryFilterAndPaging(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+	logger, _ := zap.NewDevelopment(zap.AddStacktrace(zap.ErrorLevel))
+	tracker := server.NewTrackerService("nakama")
+	registry := server.NewSessionRegistry(logger, server.NewConfig(), db, tracker, server.NewMatchmakerService("nakama", server.NewMatchmakerConfig()))
+	n := server.NewNotificationService(logger, db, tracker, server.NewMessageRouterService(registry))
+
+	// A language unique to this run keeps users from other tests out of the results.
+	lang := uuid.NewV4().String()[:18]
+	var recent [][]byte
+	for i, user := range []struct {
+		lastOnlineAt int64
+		disabledAt   int64
+	}{{5000, 0}, {6000, 0}, {7000, 0}, {1000, 0}, {8000, 1}} {
+		uid := uuid.NewV4()
+		handle := uid.String()[:20]
+		_, err = db.Exec("INSERT INTO users (id, handle, email, lang, created_at, updated_at, last_online_at, disabled_at) VALUES ($1, $2, $3, $4, $5, $5, $6, $7)",
+			uid.Bytes(), handle, handle+"@example.com", lang, i+1, user.lastOnlineAt, user.disabledAt)
+		assert.Nil(t, err, "err was not nil")
+		if user.lastOnlineAt >= 5000 && user.disabledAt == 0 {
+			recent = append(recent, uid.Bytes())
+		}
+	}
+	sort.Slice(recent, func(i, j int) bool { return bytes.Compare(recent[i], recent[j]) < 0 })
+
+	// Recently online users in the language, the user last online earlier and the disabled user are left out.
+	filter := &server.NotificationQueryFilter{Lang: lang, LastOnlineAfter: 5000}
+	count, err := n.NotificationQueryCount(filter)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, int64(3), count, "count did not match filter")
+
+	page, err := n.NotificationQueryUsers(filter, nil, 2)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, recent[:2], page, "first page did not match")
+	page, err = n.NotificationQueryUsers(filter, page[len(page)-1], 2)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, recent[2:], page, "second page did not match")
+
+	count, err = n.NotificationQueryCount(&server.NotificationQueryFilter{Lang: lang, LastOnlineBefore: 5000})
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, int64(1), count, "count did not match filter")
+
+	// Values are bound as parameters, so SQL in them matches nothing.
+	count, err = n.NotificationQueryCount(&server.NotificationQueryFilter{Lang: "en' OR '1'='1"})
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, int64(0), count, "filter value was not bound as a parameter")
+
+	_, err = n.NotificationQueryCount(&server.NotificationQueryFilter{})
+	assert.NotNil(t, err, "empty filter was accepted")
+}
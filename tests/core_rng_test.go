@@ -0,0 +1,51 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"testing"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"nakama/server"
+)
+
+func TestRngCommitRollReveal(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+	logger, _ := zap.NewDevelopment(zap.AddStacktrace(zap.ErrorLevel))
+
+	id, commitment, err := server.RngCommit(logger, db, uuid.NewV4())
+	assert.Nil(t, err, "err was not nil")
+
+	results, err := server.RngRoll(logger, db, id, "client", 20, 5)
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, results, 5, "results length was not 5")
+
+	_, err = server.RngRoll(logger, db, id, "other", 20, 5)
+	assert.Equal(t, server.ErrRngCommitmentUsed, err, "commitment was rolled twice")
+
+	c, err := server.RngReveal(logger, db, id)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, results, c.Results, "revealed results did not match")
+
+	verified, ok := server.RngVerify(commitment, c.Seed, c.ClientSeed, c.Sides, int64(len(c.Results)))
+	assert.True(t, ok, "revealed seed did not match commitment")
+	assert.Equal(t, results, verified, "verified results did not match")
+}
@@ -15,14 +15,17 @@
 package tests
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"github.com/satori/go.uuid"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
 	"nakama/server"
 	"net/url"
+	"sort"
 	"strconv"
 	"testing"
 	"time"
@@ -65,7 +68,7 @@ func TestStorageWriteRuntimeGlobalSingle(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -84,7 +87,7 @@ func TestStorageWriteRuntimeGlobalSingle(t *testing.T) {
 			Record:     record,
 		},
 	}
-	data, code, err = server.StorageFetch(logger, db, uuid.Nil, keys)
+	data, code, err = server.StorageFetch(logger, db, nil, uuid.Nil, keys)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -133,7 +136,7 @@ func TestStorageWriteRuntimeGlobalMultiple(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -193,7 +196,7 @@ func TestStorageWriteRuntimeUserMultiple(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -235,7 +238,7 @@ func TestStorageWriteRuntimeGlobalSingleIfMatchNotExists(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uuid.Nil, data)
 
 	assert.Nil(t, keys, "keys was not nil")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
@@ -261,7 +264,7 @@ func TestStorageWriteRuntimeGlobalSingleIfMatchExists(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -285,7 +288,7 @@ func TestStorageWriteRuntimeGlobalSingleIfMatchExists(t *testing.T) {
 		},
 	}
 
-	keys, code, err = server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err = server.StorageWrite(logger, db, nil, uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -316,7 +319,7 @@ func TestStorageWriteRuntimeGlobalSingleIfMatchExistsFail(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -340,7 +343,7 @@ func TestStorageWriteRuntimeGlobalSingleIfMatchExistsFail(t *testing.T) {
 		},
 	}
 
-	keys, code, err = server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err = server.StorageWrite(logger, db, nil, uuid.Nil, data)
 
 	assert.Nil(t, keys, "keys was not nil")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
@@ -367,7 +370,7 @@ func TestStorageWriteRuntimeGlobalSingleIfNoneMatchNotExists(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -398,7 +401,7 @@ func TestStorageWriteRuntimeGlobalSingleIfNoneMatchExists(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -422,7 +425,7 @@ func TestStorageWriteRuntimeGlobalSingleIfNoneMatchExists(t *testing.T) {
 		},
 	}
 
-	keys, code, err = server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err = server.StorageWrite(logger, db, nil, uuid.Nil, data)
 
 	assert.Nil(t, keys, "keys was not nil")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
@@ -457,7 +460,7 @@ func TestStorageWriteRuntimeGlobalMultipleIfMatchNotExists(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uuid.Nil, data)
 
 	assert.Nil(t, keys, "keys was not nil")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
@@ -483,7 +486,7 @@ func TestStorageWritePipelineSingleGlobalNotAllowed(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.NewV4(), data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uuid.NewV4(), data)
 
 	assert.Nil(t, keys, "keys was not nil")
 	assert.Equal(t, server.BAD_INPUT, code, "code did not match")
@@ -510,7 +513,7 @@ func TestStorageWritePipelineSingleOtherClientNotAllowed(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.NewV4(), data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uuid.NewV4(), data)
 
 	assert.Nil(t, keys, "keys was not nil")
 	assert.Equal(t, server.BAD_INPUT, code, "code did not match")
@@ -539,7 +542,7 @@ func TestStorageWritePipelineUserSingle(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -591,7 +594,7 @@ func TestStorageWritePipelineUserMultiple(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -650,7 +653,7 @@ func TestStorageWriteRuntimeGlobalMultipleSameKey(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -680,7 +683,7 @@ func TestStorageWriteRuntimeGlobalMultipleSameKey(t *testing.T) {
 		},
 	}
 
-	data, code, err = server.StorageFetch(logger, db, uuid.Nil, keys)
+	data, code, err = server.StorageFetch(logger, db, nil, uuid.Nil, keys)
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
 	assert.NotNil(t, data, "data was nil")
@@ -725,7 +728,7 @@ func TestStorageWritePipelineUserMultipleSameKey(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -751,7 +754,7 @@ func TestStorageWritePipelineUserMultipleSameKey(t *testing.T) {
 		},
 	}
 
-	data, code, err = server.StorageFetch(logger, db, uuid.Nil, keys)
+	data, code, err = server.StorageFetch(logger, db, nil, uuid.Nil, keys)
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
 	assert.NotNil(t, data, "data was nil")
@@ -787,7 +790,7 @@ func TestStorageWritePipelineIfMatchNotExists(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, keys, "keys was not nil")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
@@ -816,7 +819,7 @@ func TestStorageWritePipelineIfMatchExistsFail(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -840,7 +843,7 @@ func TestStorageWritePipelineIfMatchExistsFail(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err = server.StorageWrite(logger, db, uid, data)
+	keys, code, err = server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, keys, "keys was not nil")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
@@ -870,7 +873,7 @@ func TestStorageWritePipelineIfMatchExists(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -894,7 +897,7 @@ func TestStorageWritePipelineIfMatchExists(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err = server.StorageWrite(logger, db, uid, data)
+	keys, code, err = server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -929,7 +932,7 @@ func TestStorageWritePipelineIfNoneMatchNotExists(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -964,7 +967,7 @@ func TestStorageWritePipelineIfNoneMatchExists(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -988,7 +991,7 @@ func TestStorageWritePipelineIfNoneMatchExists(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err = server.StorageWrite(logger, db, uid, data)
+	keys, code, err = server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, keys, "keys was not nil")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
@@ -1018,7 +1021,7 @@ func TestStorageWritePipelinePermissionFail(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1041,7 +1044,7 @@ func TestStorageWritePipelinePermissionFail(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err = server.StorageWrite(logger, db, uid, data)
+	keys, code, err = server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, keys, "keys was not nil")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
@@ -1069,7 +1072,7 @@ func TestStorageFetchRuntimeGlobalPrivate(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1088,7 +1091,7 @@ func TestStorageFetchRuntimeGlobalPrivate(t *testing.T) {
 			Record:     record,
 		},
 	}
-	data, code, err = server.StorageFetch(logger, db, uuid.Nil, keys)
+	data, code, err = server.StorageFetch(logger, db, nil, uuid.Nil, keys)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1123,7 +1126,7 @@ func TestStorageFetchRuntimeMixed(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1147,7 +1150,7 @@ func TestStorageFetchRuntimeMixed(t *testing.T) {
 			Record:     "notfound",
 		},
 	}
-	data, code, err = server.StorageFetch(logger, db, uuid.Nil, keys)
+	data, code, err = server.StorageFetch(logger, db, nil, uuid.Nil, keys)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1184,7 +1187,7 @@ func TestStorageFetchRuntimeUserPrivate(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1204,7 +1207,7 @@ func TestStorageFetchRuntimeUserPrivate(t *testing.T) {
 			UserId:     uid.Bytes(),
 		},
 	}
-	data, code, err = server.StorageFetch(logger, db, uuid.Nil, keys)
+	data, code, err = server.StorageFetch(logger, db, nil, uuid.Nil, keys)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1239,7 +1242,7 @@ func TestStorageFetchPipelineGlobalPrivate(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1258,7 +1261,7 @@ func TestStorageFetchPipelineGlobalPrivate(t *testing.T) {
 			Record:     record,
 		},
 	}
-	data, code, err = server.StorageFetch(logger, db, uuid.NewV4(), keys)
+	data, code, err = server.StorageFetch(logger, db, nil, uuid.NewV4(), keys)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1288,7 +1291,7 @@ func TestStorageFetchPipelineUserPrivate(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1308,7 +1311,7 @@ func TestStorageFetchPipelineUserPrivate(t *testing.T) {
 			UserId:     uid.Bytes(),
 		},
 	}
-	data, code, err = server.StorageFetch(logger, db, uid, keys)
+	data, code, err = server.StorageFetch(logger, db, nil, uid, keys)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1338,7 +1341,7 @@ func TestStorageFetchPipelineUserRead(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1358,7 +1361,7 @@ func TestStorageFetchPipelineUserRead(t *testing.T) {
 			UserId:     uid.Bytes(),
 		},
 	}
-	data, code, err = server.StorageFetch(logger, db, uid, keys)
+	data, code, err = server.StorageFetch(logger, db, nil, uid, keys)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1395,7 +1398,7 @@ func TestStorageFetchPipelineUserPublic(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1415,7 +1418,7 @@ func TestStorageFetchPipelineUserPublic(t *testing.T) {
 			UserId:     uid.Bytes(),
 		},
 	}
-	data, code, err = server.StorageFetch(logger, db, uid, keys)
+	data, code, err = server.StorageFetch(logger, db, nil, uid, keys)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1452,7 +1455,7 @@ func TestStorageFetchPipelineUserOtherRead(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1472,7 +1475,7 @@ func TestStorageFetchPipelineUserOtherRead(t *testing.T) {
 			UserId:     uid.Bytes(),
 		},
 	}
-	data, code, err = server.StorageFetch(logger, db, uuid.NewV4(), keys)
+	data, code, err = server.StorageFetch(logger, db, nil, uuid.NewV4(), keys)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1502,7 +1505,7 @@ func TestStorageFetchPipelineUserOtherPublic(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1522,7 +1525,7 @@ func TestStorageFetchPipelineUserOtherPublic(t *testing.T) {
 			UserId:     uid.Bytes(),
 		},
 	}
-	data, code, err = server.StorageFetch(logger, db, uuid.NewV4(), keys)
+	data, code, err = server.StorageFetch(logger, db, nil, uuid.NewV4(), keys)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1569,7 +1572,7 @@ func TestStorageFetchPipelineUserOtherPublicMixed(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1600,7 +1603,7 @@ func TestStorageFetchPipelineUserOtherPublicMixed(t *testing.T) {
 			UserId:     uid.Bytes(),
 		},
 	}
-	data, code, err = server.StorageFetch(logger, db, uuid.NewV4(), keys)
+	data, code, err = server.StorageFetch(logger, db, nil, uuid.NewV4(), keys)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1635,7 +1638,7 @@ func TestStorageRemoveRuntimeGlobalPublic(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1654,12 +1657,12 @@ func TestStorageRemoveRuntimeGlobalPublic(t *testing.T) {
 			Record:     record,
 		},
 	}
-	code, err = server.StorageRemove(logger, db, uuid.Nil, keys)
+	code, err = server.StorageRemove(logger, db, nil, uuid.Nil, keys)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
 
-	data, code, err = server.StorageFetch(logger, db, uuid.Nil, keys)
+	data, code, err = server.StorageFetch(logger, db, nil, uuid.Nil, keys)
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
 	assert.Len(t, data, 0, "data length was not 0")
@@ -1685,7 +1688,7 @@ func TestStorageRemoveRuntimeGlobalPrivate(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1704,12 +1707,12 @@ func TestStorageRemoveRuntimeGlobalPrivate(t *testing.T) {
 			Record:     record,
 		},
 	}
-	code, err = server.StorageRemove(logger, db, uuid.Nil, keys)
+	code, err = server.StorageRemove(logger, db, nil, uuid.Nil, keys)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
 
-	data, code, err = server.StorageFetch(logger, db, uuid.Nil, keys)
+	data, code, err = server.StorageFetch(logger, db, nil, uuid.Nil, keys)
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
 	assert.Len(t, data, 0, "data length was not 0")
@@ -1737,7 +1740,7 @@ func TestStorageRemoveRuntimeUserPublic(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1757,12 +1760,12 @@ func TestStorageRemoveRuntimeUserPublic(t *testing.T) {
 			UserId:     uid.Bytes(),
 		},
 	}
-	code, err = server.StorageRemove(logger, db, uuid.Nil, keys)
+	code, err = server.StorageRemove(logger, db, nil, uuid.Nil, keys)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
 
-	data, code, err = server.StorageFetch(logger, db, uuid.Nil, keys)
+	data, code, err = server.StorageFetch(logger, db, nil, uuid.Nil, keys)
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
 	assert.Len(t, data, 0, "data length was not 0")
@@ -1790,7 +1793,7 @@ func TestStorageRemoveRuntimeUserPrivate(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1810,12 +1813,12 @@ func TestStorageRemoveRuntimeUserPrivate(t *testing.T) {
 			UserId:     uid.Bytes(),
 		},
 	}
-	code, err = server.StorageRemove(logger, db, uuid.Nil, keys)
+	code, err = server.StorageRemove(logger, db, nil, uuid.Nil, keys)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
 
-	data, code, err = server.StorageFetch(logger, db, uuid.Nil, keys)
+	data, code, err = server.StorageFetch(logger, db, nil, uuid.Nil, keys)
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
 	assert.Len(t, data, 0, "data length was not 0")
@@ -1841,7 +1844,7 @@ func TestStorageRemovePipelineGlobalRejected(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1860,7 +1863,7 @@ func TestStorageRemovePipelineGlobalRejected(t *testing.T) {
 			Record:     record,
 		},
 	}
-	code, err = server.StorageRemove(logger, db, uuid.NewV4(), keys)
+	code, err = server.StorageRemove(logger, db, nil, uuid.NewV4(), keys)
 
 	assert.NotNil(t, err, "err was not nil")
 	assert.Equal(t, server.BAD_INPUT, code, "code did not match")
@@ -1888,7 +1891,7 @@ func TestStorageRemovePipelineUserOtherRejected(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1908,7 +1911,7 @@ func TestStorageRemovePipelineUserOtherRejected(t *testing.T) {
 			UserId:     data[0].UserId,
 		},
 	}
-	code, err = server.StorageRemove(logger, db, uuid.NewV4(), keys)
+	code, err = server.StorageRemove(logger, db, nil, uuid.NewV4(), keys)
 
 	assert.NotNil(t, err, "err was not nil")
 	assert.Equal(t, server.BAD_INPUT, code, "code did not match")
@@ -1937,7 +1940,7 @@ func TestStorageRemovePipelineUserWrite(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1957,7 +1960,7 @@ func TestStorageRemovePipelineUserWrite(t *testing.T) {
 			UserId:     uid.Bytes(),
 		},
 	}
-	code, err = server.StorageRemove(logger, db, uid, keys)
+	code, err = server.StorageRemove(logger, db, nil, uid, keys)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code did not match")
@@ -1985,7 +1988,7 @@ func TestStorageRemovePipelineUserDenied(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -2005,7 +2008,7 @@ func TestStorageRemovePipelineUserDenied(t *testing.T) {
 			UserId:     uid.Bytes(),
 		},
 	}
-	code, err = server.StorageRemove(logger, db, uid, keys)
+	code, err = server.StorageRemove(logger, db, nil, uid, keys)
 
 	assert.NotNil(t, err, "err was nil")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
@@ -2028,7 +2031,7 @@ func TestStorageRemoveRuntimeGlobalIfMatchNotExists(t *testing.T) {
 			Version:    []byte("fail"),
 		},
 	}
-	code, err := server.StorageRemove(logger, db, uuid.Nil, keys)
+	code, err := server.StorageRemove(logger, db, nil, uuid.Nil, keys)
 
 	assert.NotNil(t, err, "err was nil")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
@@ -2055,7 +2058,7 @@ func TestStorageRemoveRuntimeGlobalIfMatchRejected(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -2075,7 +2078,7 @@ func TestStorageRemoveRuntimeGlobalIfMatchRejected(t *testing.T) {
 			Version:    []byte("fail"),
 		},
 	}
-	code, err = server.StorageRemove(logger, db, uuid.Nil, keys)
+	code, err = server.StorageRemove(logger, db, nil, uuid.Nil, keys)
 
 	assert.NotNil(t, err, "err was nil")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
@@ -2102,7 +2105,7 @@ func TestStorageRemoveRuntimeGlobalIfMatch(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -2122,7 +2125,7 @@ func TestStorageRemoveRuntimeGlobalIfMatch(t *testing.T) {
 			Version:    keys[0].Version,
 		},
 	}
-	code, err = server.StorageRemove(logger, db, uuid.Nil, keys)
+	code, err = server.StorageRemove(logger, db, nil, uuid.Nil, keys)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code did not match")
@@ -2157,7 +2160,7 @@ func TestStorageRemoveRuntimeGlobalMultiple(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -2186,7 +2189,7 @@ func TestStorageRemoveRuntimeGlobalMultiple(t *testing.T) {
 			Record:     record2,
 		},
 	}
-	code, err = server.StorageRemove(logger, db, uuid.Nil, keys)
+	code, err = server.StorageRemove(logger, db, nil, uuid.Nil, keys)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code did not match")
@@ -2213,7 +2216,7 @@ func TestStorageRemoveRuntimeGlobalMultipleMixed(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -2237,7 +2240,7 @@ func TestStorageRemoveRuntimeGlobalMultipleMixed(t *testing.T) {
 			Record:     record2,
 		},
 	}
-	code, err = server.StorageRemove(logger, db, uuid.Nil, keys)
+	code, err = server.StorageRemove(logger, db, nil, uuid.Nil, keys)
 
 	assert.NotNil(t, err, "err was nil")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
@@ -2273,7 +2276,7 @@ func TestStorageRemoveRuntimeGlobalMultipleMixedIfMatch(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -2303,7 +2306,7 @@ func TestStorageRemoveRuntimeGlobalMultipleMixedIfMatch(t *testing.T) {
 			Version:    []byte("fail"),
 		},
 	}
-	code, err = server.StorageRemove(logger, db, uuid.Nil, keys)
+	code, err = server.StorageRemove(logger, db, nil, uuid.Nil, keys)
 
 	assert.NotNil(t, err, "err was nil")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
@@ -2342,7 +2345,7 @@ func TestStorageRemovePipelineUserMultipleMixedDenied(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -2373,7 +2376,7 @@ func TestStorageRemovePipelineUserMultipleMixedDenied(t *testing.T) {
 			UserId:     uid.Bytes(),
 		},
 	}
-	code, err = server.StorageRemove(logger, db, uid, keys)
+	code, err = server.StorageRemove(logger, db, nil, uid, keys)
 
 	assert.NotNil(t, err, "err was nil")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
@@ -2412,7 +2415,7 @@ func TestStorageRemoveRuntimeUserMultipleMixed(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -2443,7 +2446,7 @@ func TestStorageRemoveRuntimeUserMultipleMixed(t *testing.T) {
 			UserId:     uid.Bytes(),
 		},
 	}
-	code, err = server.StorageRemove(logger, db, uuid.Nil, keys)
+	code, err = server.StorageRemove(logger, db, nil, uuid.Nil, keys)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code did not match")
@@ -2481,7 +2484,7 @@ func TestStorageRemoveRuntimeUserMultipleIfMatchFail(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -2513,7 +2516,7 @@ func TestStorageRemoveRuntimeUserMultipleIfMatchFail(t *testing.T) {
 			Version:    []byte("fail"),
 		},
 	}
-	code, err = server.StorageRemove(logger, db, uuid.Nil, keys)
+	code, err = server.StorageRemove(logger, db, nil, uuid.Nil, keys)
 
 	assert.NotNil(t, err, "err was nil")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
@@ -2533,7 +2536,7 @@ func TestStorageRemoveRuntimeUserMultipleIfMatchFail(t *testing.T) {
 			UserId:     uid.Bytes(),
 		},
 	}
-	data, code, err = server.StorageFetch(logger, db, uuid.Nil, keys)
+	data, code, err = server.StorageFetch(logger, db, nil, uuid.Nil, keys)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -2583,7 +2586,7 @@ func TestStorageRemoveRuntimeUserMultipleIfMatch(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -2615,7 +2618,7 @@ func TestStorageRemoveRuntimeUserMultipleIfMatch(t *testing.T) {
 			Version:    keys[1].Version,
 		},
 	}
-	code, err = server.StorageRemove(logger, db, uuid.Nil, keys)
+	code, err = server.StorageRemove(logger, db, nil, uuid.Nil, keys)
 
 	assert.Nil(t, err, "err was nil")
 	assert.Equal(t, 0, int(code), "code did not match")
@@ -2634,7 +2637,7 @@ func TestStorageRemoveRuntimeUserMultipleIfMatch(t *testing.T) {
 			UserId:     uid.Bytes(),
 		},
 	}
-	data, code, err = server.StorageFetch(logger, db, uuid.Nil, keys)
+	data, code, err = server.StorageFetch(logger, db, nil, uuid.Nil, keys)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -2681,14 +2684,14 @@ func TestStorageListRuntimeUser(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
 	assert.NotNil(t, keys, "keys was nil")
 	assert.Len(t, keys, 3, "keys length was not 3")
 
-	values, cursor, code, err := server.StorageList(logger, db, uuid.Nil, uid.Bytes(), "testbucket", "testcollection", 10, nil)
+	values, cursor, code, err := server.StorageList(logger, db, nil, uuid.Nil, uid.Bytes(), "testbucket", "testcollection", 10, nil)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -2740,14 +2743,14 @@ func TestStorageListPipelineUserSelf(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
 	assert.NotNil(t, keys, "keys was nil")
 	assert.Len(t, keys, 3, "keys length was not 3")
 
-	values, cursor, code, err := server.StorageList(logger, db, uid, uid.Bytes(), "testbucket", collection, 10, nil)
+	values, cursor, code, err := server.StorageList(logger, db, nil, uid, uid.Bytes(), "testbucket", collection, 10, nil)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -2798,14 +2801,14 @@ func TestStorageListPipelineUserOther(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
 	assert.NotNil(t, keys, "keys was nil")
 	assert.Len(t, keys, 3, "keys length was not 3")
 
-	values, cursor, code, err := server.StorageList(logger, db, uuid.NewV4(), uid.Bytes(), "testbucket", collection, 10, nil)
+	values, cursor, code, err := server.StorageList(logger, db, nil, uuid.NewV4(), uid.Bytes(), "testbucket", collection, 10, nil)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -2813,3 +2816,661 @@ func TestStorageListPipelineUserOther(t *testing.T) {
 	assert.Len(t, values, 0, "values length was not 0")
 	assert.Nil(t, cursor, "cursor was not nil")
 }
+
+func TestStorageWriteIdempotent(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+	logger, _ := zap.NewDevelopment(zap.AddStacktrace(zap.ErrorLevel))
+
+	uid := uuid.NewV4()
+	record := generateString()
+	idempotencyKey := generateString()
+	data := []*server.StorageData{
+		&server.StorageData{
+			Bucket:          "testbucket",
+			Collection:      "testcollection",
+			Record:          record,
+			UserId:          uid.Bytes(),
+			Value:           []byte("{\"count\":1}"),
+			PermissionRead:  1,
+			PermissionWrite: 1,
+		},
+	}
+	keys, repeated, code, err := server.StorageWriteIdempotent(logger, db, nil, uid, data, nil, idempotencyKey, time.Minute)
+
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+	assert.False(t, repeated, "first write was repeated")
+	assert.Len(t, keys, 1, "keys length was not 1")
+
+	// A retry with a different value still returns the original result, and leaves the stored value alone.
+	data[0].Value = []byte("{\"count\":2}")
+	retryKeys, repeated, code, err := server.StorageWriteIdempotent(logger, db, nil, uid, data, nil, idempotencyKey, time.Minute)
+
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+	assert.True(t, repeated, "retry was not repeated")
+	assert.Len(t, retryKeys, 1, "keys length was not 1")
+	assert.EqualValues(t, keys[0].Version, retryKeys[0].Version, "version did not match")
+
+	fetched, _, err := server.StorageFetch(logger, db, nil, uid, []*server.StorageKey{&server.StorageKey{Bucket: "testbucket", Collection: "testcollection", Record: record, UserId: uid.Bytes()}})
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, fetched, 1, "fetched length was not 1")
+	assert.EqualValues(t, []byte("{\"count\":1}"), fetched[0].Value, "value was written again")
+}
+
+func TestStorageWriteEncrypted(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+	logger, _ := zap.NewDevelopment(zap.AddStacktrace(zap.ErrorLevel))
+
+	_, err = server.NewStorageRouter(&server.StorageConfig{EncryptionKeys: []string{"k1:c2hvcnQ="}}, nil)
+	assert.NotNil(t, err, "short key was accepted")
+	_, err = server.NewStorageRouter(&server.StorageConfig{EncryptedCollections: []string{"testbucket/testsecret"}}, nil)
+	assert.NotNil(t, err, "encrypted collection without keys was accepted")
+
+	oldKey := "k1:MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	newKey := "k2:ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA="
+	router, err := server.NewStorageRouter(&server.StorageConfig{EncryptionKeys: []string{oldKey}, EncryptedCollections: []string{"testbucket/testsecret"}}, nil)
+	assert.Nil(t, err, "err was not nil")
+
+	uid := uuid.NewV4()
+	record := generateString()
+	value := []byte("{\"secret\":\"foo\"}")
+	data := []*server.StorageData{
+		&server.StorageData{
+			Bucket:          "testbucket",
+			Collection:      "testsecret",
+			Record:          record,
+			UserId:          uid.Bytes(),
+			Value:           value,
+			PermissionRead:  1,
+			PermissionWrite: 1,
+		},
+	}
+	keys, code, err := server.StorageWrite(logger, db, router, uid, data)
+
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+	assert.Len(t, keys, 1, "keys length was not 1")
+	assert.EqualValues(t, []byte(fmt.Sprintf("%x", sha256.Sum256(value))), keys[0].Version, "version was not computed from the plaintext")
+
+	var stored []byte
+	err = db.QueryRow("SELECT value FROM storage WHERE user_id = $1 AND bucket = $2 AND collection = $3 AND record = $4", uid.Bytes(), "testbucket", "testsecret", record).Scan(&stored)
+	assert.Nil(t, err, "err was not nil")
+	assert.NotEqual(t, value, stored, "value was stored in plaintext")
+
+	// Values written before a key rotation still decrypt while the old key is kept.
+	router, err = server.NewStorageRouter(&server.StorageConfig{EncryptionKeys: []string{newKey, oldKey}, EncryptedCollections: []string{"testbucket/testsecret"}}, nil)
+	assert.Nil(t, err, "err was not nil")
+
+	fetched, code, err := server.StorageFetch(logger, db, router, uid, []*server.StorageKey{&server.StorageKey{Bucket: "testbucket", Collection: "testsecret", Record: record, UserId: uid.Bytes()}})
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+	assert.Len(t, fetched, 1, "fetched length was not 1")
+	assert.EqualValues(t, value, fetched[0].Value, "value was not decrypted")
+
+	listed, _, code, err := server.StorageList(logger, db, router, uid, uid.Bytes(), "testbucket", "testsecret", 10, nil)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+	assert.Len(t, listed, 1, "listed length was not 1")
+	assert.EqualValues(t, value, listed[0].Value, "value was not decrypted")
+
+	// Without the old key the value can no longer be read.
+	router, err = server.NewStorageRouter(&server.StorageConfig{EncryptionKeys: []string{newKey}}, nil)
+	assert.Nil(t, err, "err was not nil")
+
+	_, _, err = server.StorageFetch(logger, db, router, uid, []*server.StorageKey{&server.StorageKey{Bucket: "testbucket", Collection: "testsecret", Record: record, UserId: uid.Bytes()}})
+	assert.NotNil(t, err, "value decrypted without its key")
+}
+
+func TestStorageWriteCollectionPermissions(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+	logger, _ := zap.NewDevelopment(zap.AddStacktrace(zap.ErrorLevel))
+
+	_, err = server.NewStoragePermissionPolicy(&server.StorageConfig{CollectionPermissions: map[string]*server.StoragePermissionsConfig{"testbucket": {Read: 2, Write: 1}}})
+	assert.NotNil(t, err, "collection without a bucket was accepted")
+	_, err = server.NewStoragePermissionPolicy(&server.StorageConfig{CollectionPermissions: map[string]*server.StoragePermissionsConfig{"testbucket/testprofile": {Read: 3, Write: 1}}})
+	assert.NotNil(t, err, "invalid read permission was accepted")
+
+	router, err := server.NewStorageRouter(&server.StorageConfig{CollectionPermissions: map[string]*server.StoragePermissionsConfig{"testbucket/testprofile": {Read: 2, Write: 1}}}, nil)
+	assert.Nil(t, err, "err was not nil")
+
+	uid := uuid.NewV4()
+	record := generateString()
+	data := []*server.StorageData{
+		&server.StorageData{
+			Bucket:          "testbucket",
+			Collection:      "testprofile",
+			Record:          record,
+			UserId:          uid.Bytes(),
+			Value:           []byte("{\"name\":\"foo\"}"),
+			PermissionRead:  0,
+			PermissionWrite: 0,
+		},
+		&server.StorageData{
+			Bucket:          "testbucket",
+			Collection:      "testcollection",
+			Record:          record,
+			UserId:          uid.Bytes(),
+			Value:           []byte("{\"name\":\"foo\"}"),
+			PermissionRead:  0,
+			PermissionWrite: 0,
+		},
+	}
+	_, code, err := server.StorageWrite(logger, db, router, uid, data)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+
+	fetched, code, err := server.StorageFetch(logger, db, router, uuid.Nil, []*server.StorageKey{
+		&server.StorageKey{Bucket: "testbucket", Collection: "testprofile", Record: record, UserId: uid.Bytes()},
+		&server.StorageKey{Bucket: "testbucket", Collection: "testcollection", Record: record, UserId: uid.Bytes()},
+	})
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+	assert.Len(t, fetched, 2, "fetched length was not 2")
+	for _, d := range fetched {
+		if d.Collection == "testprofile" {
+			assert.EqualValues(t, 2, d.PermissionRead, "governed read permission was not applied")
+			assert.EqualValues(t, 1, d.PermissionWrite, "governed write permission was not applied")
+		} else {
+			assert.EqualValues(t, 0, d.PermissionRead, "ungoverned read permission was changed")
+			assert.EqualValues(t, 0, d.PermissionWrite, "ungoverned write permission was changed")
+		}
+	}
+}
+
+func TestPurchaseGrantReceiptOnce(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+	logger, _ := zap.NewDevelopment(zap.AddStacktrace(zap.ErrorLevel))
+
+	uid := uuid.NewV4()
+	receipt := generateString()
+	grant := func() []*server.StorageData {
+		return []*server.StorageData{
+			&server.StorageData{
+				Bucket:     "testbucket",
+				Collection: "testinventory",
+				Record:     "gems",
+				UserId:     uid.Bytes(),
+				Value:      []byte("{\"count\":100}"),
+			},
+		}
+	}
+
+	keys, code, err := server.PurchaseGrant(logger, db, nil, uid, "apple", "gems_100", receipt, grant())
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+	assert.Len(t, keys, 1, "keys length was not 1")
+
+	keys, code, err = server.PurchaseGrant(logger, db, nil, uid, "apple", "gems_100", receipt, grant())
+	assert.Equal(t, server.ErrPurchaseReceiptUsed, err, "receipt was used twice")
+	assert.Equal(t, server.PURCHASE_RECEIPT_USED, code, "code was not receipt used")
+	assert.Nil(t, keys, "keys was not nil")
+
+	_, _, err = server.PurchaseGrant(logger, db, nil, uid, "google", "gems_100", receipt, grant())
+	assert.Nil(t, err, "receipts of different stores should not collide")
+}
+
+func TestStorageCollectionBackends(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+	secondary, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer secondary.Close()
+	logger, _ := zap.NewDevelopment(zap.AddStacktrace(zap.ErrorLevel))
+
+	_, err = server.NewStorageRouter(&server.StorageConfig{CollectionBackends: map[string]string{"testbucket/testarchive": "missing"}}, map[string]*sql.DB{"archive": secondary})
+	assert.NotNil(t, err, "unknown backend was accepted")
+
+	router, err := server.NewStorageRouter(&server.StorageConfig{CollectionBackends: map[string]string{"testbucket/testarchive": "archive"}}, map[string]*sql.DB{"archive": secondary})
+	assert.Nil(t, err, "err was not nil")
+
+	uid := uuid.NewV4()
+	record := generateString()
+	archived := &server.StorageData{
+		Bucket:     "testbucket",
+		Collection: "testarchive",
+		Record:     record,
+		UserId:     uid.Bytes(),
+		Value:      []byte("{\"season\":1}"),
+	}
+	_, code, err := server.StorageWrite(logger, db, router, uuid.Nil, []*server.StorageData{archived})
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+
+	fetched, _, err := server.StorageFetch(logger, db, router, uuid.Nil, []*server.StorageKey{
+		&server.StorageKey{Bucket: "testbucket", Collection: "testarchive", Record: record, UserId: uid.Bytes()},
+	})
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, fetched, 1, "routed record was not fetched")
+
+	// Stats over the whole bucket include the routed collection once, counted in its own backend.
+	stats, _, err := server.StorageStats(logger, db, router, "testbucket", "")
+	assert.Nil(t, err, "err was not nil")
+	archives := 0
+	for _, stat := range stats {
+		if stat.Collection == "testarchive" {
+			archives++
+			assert.NotZero(t, stat.Count, "routed collection was not counted")
+		}
+	}
+	assert.Equal(t, 1, archives, "routed collection was not in the stats once")
+
+	current := &server.StorageData{
+		Bucket:     "testbucket",
+		Collection: "testcollection",
+		Record:     record,
+		UserId:     uid.Bytes(),
+		Value:      []byte("{\"season\":2}"),
+	}
+	_, code, err = server.StorageWrite(logger, db, router, uuid.Nil, []*server.StorageData{archived, current})
+	assert.Equal(t, server.ErrStorageBackendsSpanned, err, "write across backends was accepted")
+	assert.Equal(t, server.BAD_INPUT, code, "code was not bad input")
+
+	_, _, err = server.StorageFetch(logger, db, router, uuid.Nil, []*server.StorageKey{
+		&server.StorageKey{Bucket: "testbucket", Collection: "testarchive", Record: record, UserId: uid.Bytes()},
+		&server.StorageKey{Bucket: "testbucket", Collection: "testcollection", Record: record, UserId: uid.Bytes()},
+	})
+	assert.Equal(t, server.ErrStorageBackendsSpanned, err, "fetch across backends was accepted")
+
+	_, _, err = server.PurchaseGrant(logger, db, router, uid, "apple", "archive_pass", generateString(), []*server.StorageData{archived})
+	assert.Equal(t, server.ErrStorageBackendsSpanned, err, "receipt was recorded apart from its grants")
+
+	_, _, code, err = server.StorageWriteIdempotent(logger, db, router, uid, []*server.StorageData{archived}, nil, generateString(), time.Minute)
+	assert.NotNil(t, err, "idempotency key was recorded apart from its write")
+	assert.Equal(t, server.BAD_INPUT, code, "code was not bad input")
+}
+
+func TestUserDataExport(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+	logger, _ := zap.NewDevelopment(zap.AddStacktrace(zap.ErrorLevel))
+
+	uid := uuid.NewV4()
+
+	data := []*server.StorageData{
+		&server.StorageData{
+			Bucket:          "testbucket",
+			Collection:      "testcollection",
+			Record:          "export",
+			UserId:          uid.Bytes(),
+			Value:           []byte(`{"level":3}`),
+			PermissionRead:  1,
+			PermissionWrite: 1,
+		},
+	}
+	_, code, err := server.StorageWrite(logger, db, nil, uid, data)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+
+	// One row in each table erased with the user, which the export must also cover.
+	for _, seed := range []struct {
+		query  string
+		params []interface{}
+	}{
+		{"INSERT INTO message (topic, topic_type, message_id, user_id, created_at, handle, type, data) VALUES ('lobby', 1, $1, $2, 1, 'exporter', 0, '{}')", []interface{}{uuid.NewV4().Bytes(), uid.Bytes()}},
+		{"INSERT INTO unique_claim (namespace, value, owner_id, created_at) VALUES ('names', $1, $2, 1)", []interface{}{uid.String(), uid.Bytes()}},
+		{"INSERT INTO cooldown (user_id, action, ready_at) VALUES ($1, 'daily', 1)", []interface{}{uid.Bytes()}},
+		{"INSERT INTO rng_commitment (id, user_id, seed, commitment, created_at) VALUES ($1, $2, 'seed', 'commitment', 1)", []interface{}{uuid.NewV4().Bytes(), uid.Bytes()}},
+		{"INSERT INTO notification_schedule (id, user_id, subject, code, created_at, deliver_at) VALUES ($1, $2, 'reminder', 101, 1, 1)", []interface{}{uuid.NewV4().Bytes(), uid.Bytes()}},
+	} {
+		_, err = db.Exec(seed.query, seed.params...)
+		assert.Nil(t, err, "err was not nil")
+	}
+
+	var buf bytes.Buffer
+	err = server.UserDataExport(logger, db, nil, uid, &buf)
+	assert.Nil(t, err, "err was not nil")
+
+	var export struct {
+		UserID  string `json:"user_id"`
+		Storage []struct {
+			Record string          `json:"record"`
+			Value  json.RawMessage `json:"value"`
+		} `json:"storage"`
+		Messages []struct {
+			Topic string `json:"topic"`
+		} `json:"messages"`
+		UniqueClaims []struct {
+			Value string `json:"value"`
+		} `json:"unique_claims"`
+		Cooldowns []struct {
+			Action string `json:"action"`
+		} `json:"cooldowns"`
+		RngCommitments []struct {
+			Seed string `json:"seed"`
+		} `json:"rng_commitments"`
+		ScheduledNotifications []struct {
+			Subject string `json:"subject"`
+		} `json:"scheduled_notifications"`
+	}
+	err = json.Unmarshal(buf.Bytes(), &export)
+	assert.Nil(t, err, "export was not valid JSON")
+	assert.Equal(t, uid.String(), export.UserID, "user ID did not match")
+	assert.Len(t, export.Storage, 1, "storage length was not 1")
+	assert.Equal(t, "export", export.Storage[0].Record, "record did not match")
+	assert.JSONEq(t, `{"level":3}`, string(export.Storage[0].Value), "value did not match")
+	if assert.Len(t, export.Messages, 1, "messages length was not 1") {
+		assert.Equal(t, "lobby", export.Messages[0].Topic, "message topic did not match")
+	}
+	if assert.Len(t, export.UniqueClaims, 1, "unique claims length was not 1") {
+		assert.Equal(t, uid.String(), export.UniqueClaims[0].Value, "unique claim did not match")
+	}
+	if assert.Len(t, export.Cooldowns, 1, "cooldowns length was not 1") {
+		assert.Equal(t, "daily", export.Cooldowns[0].Action, "cooldown did not match")
+	}
+	if assert.Len(t, export.RngCommitments, 1, "rng commitments length was not 1") {
+		assert.Empty(t, export.RngCommitments[0].Seed, "unrevealed seed was exported")
+	}
+	if assert.Len(t, export.ScheduledNotifications, 1, "scheduled notifications length was not 1") {
+		assert.Equal(t, "reminder", export.ScheduledNotifications[0].Subject, "scheduled notification did not match")
+	}
+}
+
+func TestUserDeleteAnonymize(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+	logger, _ := zap.NewDevelopment(zap.AddStacktrace(zap.ErrorLevel))
+
+	uid := uuid.NewV4()
+	handle := uid.String()[:20]
+	_, err = db.Exec("INSERT INTO users (id, handle, email, created_at, updated_at) VALUES ($1, $2, $3, $4, $4)", uid.Bytes(), handle, handle+"@example.com", 1)
+	assert.Nil(t, err, "err was not nil")
+
+	data := []*server.StorageData{
+		&server.StorageData{
+			Bucket:          "testbucket",
+			Collection:      "testcollection",
+			Record:          "erase",
+			UserId:          uid.Bytes(),
+			Value:           []byte("{}"),
+			PermissionRead:  1,
+			PermissionWrite: 1,
+		},
+	}
+	_, _, err = server.StorageWrite(logger, db, nil, uid, data)
+	assert.Nil(t, err, "err was not nil")
+
+	err = server.UserDelete(logger, db, nil, server.NewAuditLogService(logger, db, []byte("testauditlogkey")), uid, &server.UserErasure{AnonymizeAccount: true})
+	assert.Nil(t, err, "err was not nil")
+
+	var anonymousHandle string
+	var email sql.NullString
+	err = db.QueryRow("SELECT handle, email FROM users WHERE id = $1", uid.Bytes()).Scan(&anonymousHandle, &email)
+	assert.Nil(t, err, "anonymized account was not kept")
+	assert.NotEqual(t, handle, anonymousHandle, "handle was not anonymized")
+	assert.False(t, email.Valid, "email was not removed")
+
+	values, _, _, err := server.StorageList(logger, db, nil, uuid.Nil, uid.Bytes(), "testbucket", "testcollection", 10, nil)
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, values, 0, "storage was not removed")
+
+	err = server.UserDelete(logger, db, nil, server.NewAuditLogService(logger, db, []byte("testauditlogkey")), uid, &server.UserErasure{})
+	assert.Nil(t, err, "err was not nil")
+	err = server.UserDelete(logger, db, nil, server.NewAuditLogService(logger, db, []byte("testauditlogkey")), uid, &server.UserErasure{})
+	assert.Equal(t, server.ErrUserNotFound, err, "deleted account was found")
+}
+
+func TestStorageChangeOrderPerRecord(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+	logger, _ := zap.NewDevelopment(zap.AddStacktrace(zap.ErrorLevel))
+
+	var router *server.StorageRouter
+	router = router.WithChangeCollections(map[string]bool{"testbucket/changes": true})
+
+	uid := uuid.NewV4()
+	for _, value := range []string{`{"count":1}`, `{"count":2}`} {
+		data := []*server.StorageData{
+			&server.StorageData{
+				Bucket:          "testbucket",
+				Collection:      "changes",
+				Record:          "record",
+				UserId:          uid.Bytes(),
+				Value:           []byte(value),
+				PermissionRead:  1,
+				PermissionWrite: 1,
+			},
+		}
+		_, _, err = server.StorageWrite(logger, db, router, uid, data)
+		assert.Nil(t, err, "err was not nil")
+	}
+	_, err = server.StorageRemove(logger, db, router, uid, []*server.StorageKey{&server.StorageKey{Bucket: "testbucket", Collection: "changes", Record: "record", UserId: uid.Bytes()}})
+	assert.Nil(t, err, "err was not nil")
+
+	// Row ids taken on different nodes are not ordered by commit, so reverse them to check they are not relied on.
+	_, err = db.Exec("UPDATE storage_change SET seq = -seq WHERE user_id = $1", uid.Bytes())
+	assert.Nil(t, err, "err was not nil")
+
+	// Changes to the record come out one at a time, in the order they were made.
+	expected := []struct {
+		op     string
+		before string
+		after  string
+	}{
+		{server.STORAGE_CHANGE_WRITE, "", `{"count":1}`},
+		{server.STORAGE_CHANGE_WRITE, `{"count":1}`, `{"count":2}`},
+		{server.STORAGE_CHANGE_REMOVE, `{"count":2}`, ""},
+	}
+	for _, e := range expected {
+		changes, err := server.StorageChangeClaim(logger, db, 100)
+		assert.Nil(t, err, "err was not nil")
+		var change *server.StorageChange
+		for _, c := range changes {
+			if bytes.Equal(c.UserId, uid.Bytes()) {
+				assert.Nil(t, change, "more than one change to the record was claimed")
+				change = c
+			}
+		}
+		if !assert.NotNil(t, change, "change was not claimed") {
+			return
+		}
+		assert.Equal(t, e.op, change.Op, "op did not match")
+		assert.Equal(t, e.before, string(change.Before), "before value did not match")
+		assert.Equal(t, e.after, string(change.After), "after value did not match")
+		assert.Nil(t, server.StorageChangeComplete(logger, db, change), "err was not nil")
+	}
+}
+
+func TestUserDeleteStorageChanges(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+	logger, _ := zap.NewDevelopment(zap.AddStacktrace(zap.ErrorLevel))
+
+	var router *server.StorageRouter
+	router = router.WithChangeCollections(map[string]bool{"testbucket/erasechanges": true})
+
+	uid := uuid.NewV4()
+	handle := uid.String()[:20]
+	_, err = db.Exec("INSERT INTO users (id, handle, created_at, updated_at) VALUES ($1, $2, $3, $3)", uid.Bytes(), handle, 1)
+	assert.Nil(t, err, "err was not nil")
+	data := []*server.StorageData{
+		&server.StorageData{
+			Bucket:          "testbucket",
+			Collection:      "erasechanges",
+			Record:          "record",
+			UserId:          uid.Bytes(),
+			Value:           []byte(`{"secret":1}`),
+			PermissionRead:  1,
+			PermissionWrite: 1,
+		},
+	}
+	_, _, err = server.StorageWrite(logger, db, router, uid, data)
+	assert.Nil(t, err, "err was not nil")
+
+	// Pending changes are part of the user's data.
+	var buf bytes.Buffer
+	err = server.UserDataExport(logger, db, router, uid, &buf)
+	assert.Nil(t, err, "err was not nil")
+	var export struct {
+		StorageChanges []struct {
+			Op         string          `json:"op"`
+			ValueAfter json.RawMessage `json:"value_after"`
+		} `json:"storage_changes"`
+	}
+	err = json.Unmarshal(buf.Bytes(), &export)
+	assert.Nil(t, err, "export was not valid JSON")
+	assert.Len(t, export.StorageChanges, 1, "storage changes length was not 1")
+	assert.JSONEq(t, `{"secret":1}`, string(export.StorageChanges[0].ValueAfter), "value did not match")
+
+	err = server.UserDelete(logger, db, router, server.NewAuditLogService(logger, db, []byte("testauditlogkey")), uid, &server.UserErasure{})
+	assert.Nil(t, err, "err was not nil")
+
+	// The pending write is gone with its value, only the removal is left to deliver.
+	changes, err := server.StorageChangeClaim(logger, db, 100)
+	assert.Nil(t, err, "err was not nil")
+	var removals []*server.StorageChange
+	for _, change := range changes {
+		if uuid.FromBytesOrNil(change.UserId) == uid {
+			removals = append(removals, change)
+			assert.Nil(t, server.StorageChangeComplete(logger, db, change), "err was not nil")
+		}
+	}
+	assert.Len(t, removals, 1, "removals length was not 1")
+	assert.Equal(t, server.STORAGE_CHANGE_REMOVE, removals[0].Op, "op was not remove")
+	assert.Nil(t, removals[0].Before, "value before was kept")
+	assert.Nil(t, removals[0].After, "value after was kept")
+}
+
+func TestStorageReadReplica(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+	// A closed replica fails every read sent to it, so reads that reach the primary are the ones that succeed.
+	replica, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	replica.Close()
+	logger, _ := zap.NewDevelopment(zap.AddStacktrace(zap.ErrorLevel))
+	var router *server.StorageRouter
+	router = router.WithReadReplica(server.NewStorageReplica(db, replica, 60000))
+
+	writer := uuid.NewV4()
+	other := uuid.NewV4()
+	record := generateString()
+	data := []*server.StorageData{
+		&server.StorageData{Bucket: "testbucket", Collection: "testcollection", Record: record, UserId: writer.Bytes(), Value: []byte("{}")},
+	}
+	_, code, err := server.StorageWrite(logger, db, router, uuid.Nil, data)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+
+	fetched, _, err := server.StorageFetch(logger, db, router, uuid.Nil, []*server.StorageKey{
+		&server.StorageKey{Bucket: "testbucket", Collection: "testcollection", Record: record, UserId: writer.Bytes()},
+	})
+	assert.Nil(t, err, "recently written records were not read from the primary")
+	assert.Len(t, fetched, 1, "recently written record was not fetched")
+
+	otherKeys := []*server.StorageKey{
+		&server.StorageKey{Bucket: "testbucket", Collection: "testcollection", Record: record, UserId: other.Bytes()},
+	}
+	_, _, err = server.StorageFetch(logger, db, router, uuid.Nil, otherKeys)
+	assert.NotNil(t, err, "read was not sent to the replica")
+	_, _, err = server.StorageFetchPrimary(logger, db, router, uuid.Nil, otherKeys)
+	assert.Nil(t, err, "primary read was sent to the replica")
+}
+
+func TestStorageSetOp(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+	logger, _ := zap.NewDevelopment(zap.AddStacktrace(zap.ErrorLevel))
+
+	a := uuid.NewV4()
+	b := uuid.NewV4()
+	shared := generateString()
+	onlyA := generateString()
+	onlyB := generateString()
+	data := []*server.StorageData{
+		&server.StorageData{Bucket: "testbucket", Collection: "testcollection", Record: shared, UserId: a.Bytes(), Value: []byte("{}")},
+		&server.StorageData{Bucket: "testbucket", Collection: "testcollection", Record: onlyA, UserId: a.Bytes(), Value: []byte("{}")},
+		&server.StorageData{Bucket: "testbucket", Collection: "testcollection", Record: shared, UserId: b.Bytes(), Value: []byte("{}")},
+		&server.StorageData{Bucket: "testbucket", Collection: "testcollection", Record: onlyB, UserId: b.Bytes(), Value: []byte("{}")},
+	}
+	_, code, err := server.StorageWrite(logger, db, nil, uuid.Nil, data)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+
+	records, cursor, _, err := server.StorageSetOp(logger, db, nil, "testbucket", "testcollection", a, "testcollection", b, server.STORAGE_SET_INTERSECT, 0, nil)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, []string{shared}, records, "intersection did not match")
+	assert.Nil(t, cursor, "cursor was not nil")
+
+	records, cursor, _, err = server.StorageSetOp(logger, db, nil, "testbucket", "testcollection", a, "testcollection", b, server.STORAGE_SET_UNION, 0, nil)
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, records, 3, "union did not match")
+	assert.Contains(t, records, onlyB, "union did not include the second owner's records")
+
+	records, cursor, _, err = server.StorageSetOp(logger, db, nil, "testbucket", "testcollection", a, "testcollection", b, server.STORAGE_SET_DIFFERENCE, 0, nil)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, []string{onlyA}, records, "difference did not match")
+
+	_, _, code, err = server.StorageSetOp(logger, db, nil, "testbucket", "testcollection", a, "testcollection", b, "xor", 0, nil)
+	assert.NotNil(t, err, "unknown set operation was accepted")
+	assert.Equal(t, server.BAD_INPUT, code, "code was not bad input")
+
+	// Larger results are returned a page at a time, in order, until the cursor runs out.
+	data = make([]*server.StorageData, 0, 30)
+	for i := 0; i < 15; i++ {
+		record := generateString()
+		data = append(data,
+			&server.StorageData{Bucket: "testbucket", Collection: "testcollection", Record: record, UserId: a.Bytes(), Value: []byte("{}")},
+			&server.StorageData{Bucket: "testbucket", Collection: "testcollection", Record: record, UserId: b.Bytes(), Value: []byte("{}")})
+	}
+	_, code, err = server.StorageWrite(logger, db, nil, uuid.Nil, data)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+
+	records, cursor, _, err = server.StorageSetOp(logger, db, nil, "testbucket", "testcollection", a, "testcollection", b, server.STORAGE_SET_INTERSECT, 10, nil)
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, records, 10, "first page did not match")
+	assert.NotNil(t, cursor, "cursor was nil")
+	page, cursor, _, err := server.StorageSetOp(logger, db, nil, "testbucket", "testcollection", a, "testcollection", b, server.STORAGE_SET_INTERSECT, 10, cursor)
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, page, 6, "second page did not match")
+	assert.Nil(t, cursor, "cursor was not nil")
+	records = append(records, page...)
+	assert.True(t, sort.StringsAreSorted(records), "records were not sorted")
+	assert.Contains(t, records, shared, "pages did not include the shared record")
+
+	_, _, code, err = server.StorageSetOp(logger, db, nil, "testbucket", "testcollection", a, "testcollection", b, server.STORAGE_SET_INTERSECT, 1000, nil)
+	assert.NotNil(t, err, "limit over the maximum was accepted")
+	assert.Equal(t, server.BAD_INPUT, code, "code was not bad input")
+}
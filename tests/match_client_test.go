@@ -0,0 +1,95 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"os"
+	"testing"
+
+	"nakama/server"
+)
+
+func TestClientMatchesDisabled(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("client-match.lua", `
+local nk = require("nakama")
+local match = {}
+function match.match_init(ctx, params)
+	return {}, 1
+end
+function match.match_loop(ctx, state, tick, messages)
+	return state
+end
+nk.register_match(match, "arena")
+	`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := server.NewMatchmakerConfig()
+	if _, err = server.NewClientMatches(config).Create(r, "arena", nil); err != server.ErrClientMatchCreateDisabled {
+		t.Error("Expected client match creation to be rejected while it is off", err)
+	}
+
+	config.ClientMatchCreate = true
+	config.MaxClientMatches = 1
+	matches := server.NewClientMatches(config)
+	matchID, err := matches.Create(r, "arena", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = matches.Create(r, "arena", nil); err != server.ErrClientMatchesFull {
+		t.Error("Expected client match over the cap to be rejected", err)
+	}
+
+	// Ended matches free their place.
+	mh := r.MatchGet(matchID)
+	mh.Stop()
+	mh.Wait()
+	if _, err = matches.Create(r, "arena", nil); err != nil {
+		t.Error("Expected ended client match to free a place", err)
+	}
+}
+
+func TestClientMatchesCreateFunction(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("client-match-create.lua", `
+local nk = require("nakama")
+local match = {}
+function match.match_init(ctx, params)
+	return {}, 1
+end
+function match.match_loop(ctx, state, tick, messages)
+	return state
+end
+nk.register_match(match, "arena")
+nk.register_match_create(function(ctx, create)
+	return nil
+end)
+	`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = server.NewClientMatches(server.NewMatchmakerConfig()).Create(r, "arena", nil); err != nil {
+		t.Error("Expected a match create function to allow client matches", err)
+	}
+}
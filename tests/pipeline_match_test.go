@@ -0,0 +1,133 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/gorilla/websocket"
+	"github.com/satori/go.uuid"
+	"github.com/yuin/gopher-lua"
+	"go.uber.org/zap"
+	"nakama/server"
+)
+
+func TestPipelineMatchDataSenderRole(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("match-data-role.lua", `
+local nk = require("nakama")
+
+local match = {}
+function match.match_init(ctx, params)
+	return {role = ""}, 30, ""
+end
+function match.match_loop(ctx, state, tick, messages)
+	for _, m in ipairs(messages) do
+		state.role = m.presence.role
+	end
+	return state
+end
+nk.register_match(match, "data-role")
+`)
+
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	logger, _ := zap.NewDevelopment(zap.AddStacktrace(zap.ErrorLevel))
+	config := server.NewConfig()
+	runtimeConfig := server.NewRuntimeConfig()
+	runtimeConfig.Path = filepath.Join(DATA_PATH, "modules")
+	tracker := server.NewTrackerService(config.GetName())
+	matchmaker := server.NewMatchmakerService(config.GetName(), config.GetMatchmaker())
+	registry := server.NewSessionRegistry(logger, config, db, tracker, matchmaker)
+	messageRouter := server.NewMessageRouterService(registry)
+	matchRegistry := server.NewMatchRegistryService(logger, config.GetName(), tracker, messageRouter)
+	notificationService := server.NewNotificationService(logger, db, tracker, messageRouter)
+	pushService := server.NewPushService(logger, tracker, messageRouter, runtimeConfig)
+	r, err := server.NewRuntime(logger, logger, db, nil, runtimeConfig, matchRegistry, notificationService, pushService, server.NewStaticClusterLeader("nakama", ""), registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	pipeline := server.NewPipeline(config, db, nil, tracker, matchmaker, matchRegistry, messageRouter, registry, nil, r, notificationService)
+
+	matchID, err := r.CreateMatch("data-role", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userID := uuid.NewV4()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, req, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		registry.Add(userID, "alice", "en", "", time.Now().Add(time.Hour).Unix(), "token-"+userID.String(), "127.0.0.1", "", "", server.SESSION_DUPLICATE_ALLOW, conn, pipeline.ProcessRequest, nil)
+	}))
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var sessions []*server.SessionInfo
+	for i := 0; i < 100 && len(sessions) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		sessions = registry.ListUser(userID)
+	}
+	if len(sessions) != 1 {
+		t.Fatal("Expected the connected session to be listed", sessions)
+	}
+	// Joined as the match would track it, with the role it assigned.
+	tracker.Track(sessions[0].ID, "match:"+matchID, userID, server.PresenceMeta{Handle: "alice", Role: server.MatchRoleSpectator})
+
+	data, err := proto.Marshal(&server.Envelope{Payload: &server.Envelope_MatchDataSend{MatchDataSend: &server.MatchDataSend{
+		MatchId: uuid.FromStringOrNil(matchID).Bytes(),
+		OpCode:  1,
+		Data:    []byte("cheer"),
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		t.Fatal(err)
+	}
+
+	var role interface{}
+	for i := 0; i < 100 && role != server.MatchRoleSpectator; i++ {
+		time.Sleep(10 * time.Millisecond)
+		role, err = r.MatchState(matchID, func(vm *lua.LState, ctx *lua.LTable, state lua.LValue) (lua.LValue, interface{}, error) {
+			return nil, state.(*lua.LTable).RawGetString("role").String(), nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if role != server.MatchRoleSpectator {
+		t.Error("Expected match_loop to see the sender's role", role)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/gorilla/websocket"
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+	"nakama/server"
+)
+
+func TestPipelineStorageWriteRepeatSkipsBeforeHook(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	counter := "storage-write-repeat-" + uuid.NewV4().String()
+	writeFile("storage-write-repeat.lua", `
+local nk = require("nakama")
+
+local function count_write(ctx, envelope)
+	nk.node_local_incr("`+counter+`", 1)
+	return envelope
+end
+
+nk.register_before(count_write, "StorageWrite")
+`)
+
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	logger, _ := zap.NewDevelopment(zap.AddStacktrace(zap.ErrorLevel))
+	config := server.NewConfig()
+	runtimeConfig := server.NewRuntimeConfig()
+	runtimeConfig.Path = filepath.Join(DATA_PATH, "modules")
+	tracker := server.NewTrackerService(config.GetName())
+	matchmaker := server.NewMatchmakerService(config.GetName(), config.GetMatchmaker())
+	registry := server.NewSessionRegistry(logger, config, db, tracker, matchmaker)
+	messageRouter := server.NewMessageRouterService(registry)
+	matchRegistry := server.NewMatchRegistryService(logger, config.GetName(), tracker, messageRouter)
+	notificationService := server.NewNotificationService(logger, db, tracker, messageRouter)
+	pushService := server.NewPushService(logger, tracker, messageRouter, runtimeConfig)
+	r, err := server.NewRuntime(logger, logger, db, nil, runtimeConfig, matchRegistry, notificationService, pushService, server.NewStaticClusterLeader("nakama", ""), registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	pipeline := server.NewPipeline(config, db, nil, tracker, matchmaker, matchRegistry, messageRouter, registry, nil, r, notificationService)
+
+	userID := uuid.NewV4()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, req, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		registry.Add(userID, "alice", "en", "", time.Now().Add(time.Hour).Unix(), "token-"+userID.String(), "127.0.0.1", "", "", server.SESSION_DUPLICATE_ALLOW, conn, pipeline.ProcessRequest, nil)
+	}))
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The client retries the same write, as it would after losing the first response.
+	idempotencyKey := uuid.NewV4().String()
+	var versions []string
+	for _, collationID := range []string{"first", "retry"} {
+		data, err := proto.Marshal(&server.Envelope{CollationId: collationID, Payload: &server.Envelope_StorageWrite{StorageWrite: &server.TStorageWrite{
+			Data: []*server.TStorageWrite_StorageData{&server.TStorageWrite_StorageData{
+				Bucket:     "testbucket",
+				Collection: "testcollection",
+				Record:     "record",
+				Value:      []byte(`{"count":1}`),
+			}},
+			IdempotencyKey: idempotencyKey,
+		}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+			t.Fatal(err)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		envelope := &server.Envelope{}
+		if err = proto.Unmarshal(message, envelope); err != nil {
+			t.Fatal(err)
+		}
+		keys := envelope.GetStorageKeys()
+		if envelope.CollationId != collationID || keys == nil || len(keys.Keys) != 1 {
+			t.Fatal("Expected the storage write keys", envelope)
+		}
+		versions = append(versions, string(keys.Keys[0].Version))
+	}
+	if versions[0] != versions[1] {
+		t.Error("Expected the retry to return the original write's result", versions)
+	}
+
+	count, _, err := r.NodeLocalGet(counter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != "1" {
+		t.Error("Expected the before function to run once for the idempotency key", count)
+	}
+}
@@ -17,9 +17,15 @@ package tests
 import (
 	"errors"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"nakama/server"
 
@@ -30,21 +36,37 @@ import (
 	"reflect"
 
 	"github.com/gogo/protobuf/jsonpb"
+	"github.com/gogo/protobuf/proto"
 	"github.com/satori/go.uuid"
+	"github.com/yuin/gopher-lua"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 const DATA_PATH = "/tmp/nakama/data/"
 
 func newRuntime() (*server.Runtime, error) {
+	return newRuntimeWithConfig(server.NewRuntimeConfig())
+}
+
+func newRuntimeWithConfig(c *server.RuntimeConfig) (*server.Runtime, error) {
+	return newRuntimeWithLeader(c, server.NewStaticClusterLeader("nakama", ""))
+}
+
+func newRuntimeWithLeader(c *server.RuntimeConfig, clusterLeader server.ClusterLeader) (*server.Runtime, error) {
 	db, err := setupDB()
 	if err != nil {
 		return nil, err
 	}
 	logger, _ := zap.NewDevelopment(zap.AddStacktrace(zap.ErrorLevel))
-	c := server.NewRuntimeConfig()
 	c.Path = filepath.Join(DATA_PATH, "modules")
-	return server.NewRuntime(logger, logger, db, c)
+	tracker := server.NewTrackerService("nakama")
+	sessionRegistry := server.NewSessionRegistry(logger, server.NewConfig(), db, tracker, server.NewMatchmakerService("nakama", server.NewMatchmakerConfig()))
+	messageRouter := server.NewMessageRouterService(sessionRegistry)
+	matchRegistry := server.NewMatchRegistryService(logger, "nakama", tracker, messageRouter)
+	notificationService := server.NewNotificationService(logger, db, tracker, messageRouter)
+	pushService := server.NewPushService(logger, tracker, messageRouter, c)
+	return server.NewRuntime(logger, logger, db, nil, c, matchRegistry, notificationService, pushService, clusterLeader, sessionRegistry)
 }
 
 func writeStatsModule() {
@@ -417,7 +439,7 @@ nakama.register_before(test.printWorld, "SelfFetch")
 		t.Error(err)
 	}
 
-	result, err := r.InvokeFunctionBefore(fn, uuid.Nil, "", 0, jsonEnvelope)
+	result, err := r.InvokeFunctionBefore(fn, uuid.Nil, "", 0, "", jsonEnvelope)
 	if err != nil {
 		t.Error(err)
 	}
@@ -438,6 +460,54 @@ nakama.register_before(test.printWorld, "SelfFetch")
 
 }
 
+func TestRuntimeRegisterAfterGlobal(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("after-global.lua", `
+local nk = require("nakama")
+
+local seen = ""
+
+local function observe(ctx, payload)
+  seen = payload.message_type
+end
+nk.register_after(observe, "*")
+
+local function status(ctx, payload)
+  return seen
+end
+nk.register_rpc(status, "status")
+`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jsonpbMarshaler := &jsonpb.Marshaler{
+		EnumsAsInts:  true,
+		EmitDefaults: false,
+		Indent:       "",
+		OrigName:     true,
+	}
+	envelope := &server.Envelope{Payload: &server.Envelope_SelfUpdate{SelfUpdate: &server.TSelfUpdate{Handle: "alice"}}}
+	server.RuntimeAfterHook(zap.NewNop(), r, jsonpbMarshaler, "SelfUpdate", envelope, nil)
+
+	// The global hook runs on the worker pool, wait for it to observe the message.
+	fn := r.GetRuntimeCallback(server.RPC, "status")
+	var result []byte
+	for i := 0; i < 100; i++ {
+		if result, err = r.InvokeFunctionRPC(fn, uuid.Nil, "", 0, nil); err != nil {
+			t.Fatal(err)
+		}
+		if string(result) == "SelfUpdate" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("Global after hook did not observe the message", string(result))
+}
+
 func TestRuntimeUserId(t *testing.T) {
 	defer os.RemoveAll(DATA_PATH)
 	writeFile("userid.lua", `
@@ -481,6 +551,128 @@ nk.leaderboard_create(leaderboard_id, "desc", "0 0 * * 1", metadata, false)
 	}
 }
 
+func TestRuntimeLeaderboardRecordReadWrite(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("leaderboard-read-write.lua", `
+local nk = require("nakama")
+local nkx = require("nakamax")
+
+local leaderboard_id = nkx.uuid_v4()
+nk.leaderboard_create(leaderboard_id, "desc", "", {}, false)
+
+local function update(record)
+  assert(record == nil, "owner should not have a record yet")
+  return nil
+end
+
+local record = nk.leaderboard_record_read_write(leaderboard_id, nkx.uuid_v4(), update)
+assert(record == nil, "skipped update should not write a record")
+	`)
+
+	setupDB()
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRuntimeLeaderboardRecordIncrementDecay(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	leaderboardID := uuid.NewV4().String()
+	writeFile("leaderboard-increment-decay.lua", `
+local nk = require("nakama")
+nk.leaderboard_create("`+leaderboardID+`", "desc", "", {}, false)
+
+local function increment(ctx, payload)
+	local record = nk.leaderboard_record_increment_decay("`+leaderboardID+`", ctx.user_id, tonumber(payload), 60000)
+	return tostring(record.score)
+end
+nk.register_rpc(increment, "increment")
+	`)
+
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uid := uuid.NewV4()
+	handle := uid.String()[:20]
+	if _, err = db.Exec("INSERT INTO users (id, handle, email, created_at, updated_at) VALUES ($1, $2, $3, $4, $4)", uid.Bytes(), handle, handle+"@example.com", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	fn := r.GetRuntimeCallback(server.RPC, "increment")
+	result, err := r.InvokeFunctionRPC(fn, uid, "", 0, []byte("1000"))
+	if err != nil || string(result) != "1000" {
+		t.Fatal("Expected the first increment to start from zero", string(result), err)
+	}
+
+	// Two half-lives after the last decay the existing score is a quarter of what it was when it is incremented.
+	if _, err = db.Exec("UPDATE leaderboard_record SET decayed_at = decayed_at - 120000 WHERE leaderboard_id = $1 AND owner_id = $2", []byte(leaderboardID), uid.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	result, err = r.InvokeFunctionRPC(fn, uid, "", 0, []byte("100"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if score, _ := strconv.ParseInt(string(result), 10, 64); score < 348 || score > 350 {
+		t.Error("Expected the existing score to be decayed before the increment", string(result))
+	}
+}
+
+func TestRuntimeLeaderboardRank(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	leaderboardID := uuid.NewV4().String()
+	writeFile("leaderboard-rank.lua", `
+local nk = require("nakama")
+nk.leaderboard_create("`+leaderboardID+`", "desc", "", {}, false)
+assert(nk.leaderboard_rank("`+leaderboardID+`", "4c2ae592-b2a7-445e-98ec-697694478b1c") == nil, "owner without a record should have no rank")
+	`)
+
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, tied, later := uuid.NewV4(), uuid.NewV4(), uuid.NewV4()
+	for _, record := range []struct {
+		ownerID   uuid.UUID
+		score     int64
+		updatedAt int64
+	}{{first, 100, 1000}, {tied, 50, 2000}, {later, 50, 3000}} {
+		_, err = db.Exec(`INSERT INTO leaderboard_record (id, leaderboard_id, owner_id, handle, lang, score, num_score, updated_at, updated_at_inverse, expires_at)
+			VALUES ($1, $2, $3, $4, 'en', $5, 1, $6, $6, 0)`,
+			uuid.NewV4().Bytes(), []byte(leaderboardID), record.ownerID.Bytes(), record.ownerID.String()[:20], record.score, record.updatedAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for ownerID, expected := range map[uuid.UUID]int64{first: 1, tied: 2, later: 3} {
+		rank, _, err := r.LeaderboardRank(leaderboardID, ownerID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rank != expected {
+			t.Error("Invalid leaderboard rank", ownerID, rank, expected)
+		}
+	}
+	if _, _, err = r.LeaderboardRank(leaderboardID, uuid.NewV4()); err != server.ErrLeaderboardRecordNotFound {
+		t.Error("Expected no record for an unknown owner", err)
+	}
+}
+
 func TestStorageWrite(t *testing.T) {
 	defer os.RemoveAll(DATA_PATH)
 	writeFile("storage_write.lua", `
@@ -526,3 +718,4006 @@ end
 		t.Error(err)
 	}
 }
+
+func TestStorageStats(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("storage_stats.lua", `
+local nk = require("nakama")
+
+local new_records = {
+	{Bucket = "statsgame", Collection = "settings", Record = "a", UserId = nil, Value = "{}"},
+	{Bucket = "statsgame", Collection = "settings", Record = "b", UserId = nil, Value = "{}"}
+}
+nk.storage_write(new_records)
+
+local count, size = nk.storage_stats("statsgame", "settings")
+assert(count == 2, "'count' must be 2")
+assert(size == 4, "'size' must be 4")
+
+local stats = nk.storage_stats("statsgame")
+assert(#stats == 1, "expects one collection in the breakdown")
+assert(stats[1].Collection == "settings", "'Collection' must be 'settings'")
+`)
+
+	setupDB()
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRuntimeMatchCreate(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("match.lua", `
+local nk = require("nakama")
+
+local match = {}
+function match.match_init(ctx, params)
+	assert(params.difficulty == "hard")
+	return {difficulty = params.difficulty}, 10
+end
+function match.match_loop(ctx, state, tick, messages)
+	return state
+end
+
+nk.register_match(match, "boss_fight")
+`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Error(err)
+	}
+
+	matchID, err := r.CreateMatch("boss_fight", map[string]interface{}{"difficulty": "hard"})
+	if err != nil {
+		t.Error(err)
+	}
+	if uuid.FromStringOrNil(matchID) == uuid.Nil {
+		t.Error("Invalid match ID returned")
+	}
+}
+
+func TestRuntimeMatchCreateUnregistered(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if _, err := r.CreateMatch("missing", nil); err == nil {
+		t.Error("Created a match for an unregistered module")
+	}
+}
+
+func TestRuntimeMatchCreateCoded(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("match.lua", `
+local nk = require("nakama")
+
+local match = {}
+function match.match_init(ctx, params)
+	return {}, 10
+end
+function match.match_loop(ctx, state, tick, messages)
+	return state
+end
+
+nk.register_match(match, "lobby")
+
+local match_id, code = nk.match_create_coded("lobby", {}, 60000)
+assert(#code == 6)
+assert(nk.match_code_resolve(string.lower(code)) == match_id)
+assert(nk.match_code_resolve("NOPE00") == nil)
+`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matchID, code, err := r.CreateCodedMatch("lobby", nil, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved, ok := r.ResolveMatchCode(code); !ok || resolved != matchID {
+		t.Fatal("Expected the code to resolve to the match", resolved)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := r.ResolveMatchCode(code); ok {
+		t.Error("Expected the expired code not to resolve")
+	}
+}
+
+func TestRuntimeRpcQuota(t *testing.T) {
+	q := server.NewLocalRpcQuotaStore(2, time.Minute)
+
+	for i := 0; i < 2; i++ {
+		if allowed, _ := q.Allow("key1", "test"); !allowed {
+			t.Error("Call within quota was rejected")
+		}
+	}
+
+	allowed, retryAfter := q.Allow("key1", "test")
+	if allowed {
+		t.Error("Call over quota was allowed")
+	}
+	if retryAfter <= 0 || retryAfter > time.Minute {
+		t.Error("Invalid retry after duration", retryAfter)
+	}
+
+	if allowed, _ := q.Allow("key2", "test"); !allowed {
+		t.Error("Quota was shared between API keys")
+	}
+}
+
+func TestRuntimeRpcQuotaKeyName(t *testing.T) {
+	if name, ok := server.RpcApiKeyName(nil, "anything"); !ok || name != "default" {
+		t.Error("Unconfigured API keys did not share the default quota", name)
+	}
+
+	keys := map[string]string{"secret1": "partner"}
+	if name, ok := server.RpcApiKeyName(keys, "secret1"); !ok || name != "partner" {
+		t.Error("Configured API key was not named", name)
+	}
+	if _, ok := server.RpcApiKeyName(keys, "unknown"); ok {
+		t.Error("Unknown API key was accepted")
+	}
+	if _, ok := server.RpcApiKeyName(keys, ""); ok {
+		t.Error("Missing API key was accepted")
+	}
+}
+
+func TestRuntimeHTTPAuditRejectedKey(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	config := server.NewConfig()
+	config.GetRuntime().RPCAPIKeys = map[string]string{"secret1": "partner"}
+	auth := server.NewAuthenticationService(zap.New(core), config, nil, nil, nil, nil, nil, nil, server.NewLocalRpcQuotaStore(10, time.Minute))
+	ts := httptest.NewServer(auth.Handler())
+	defer ts.Close()
+
+	for _, c := range []struct {
+		query  string
+		apiKey string
+	}{
+		{"?key=wrong", "secret1"},
+		{"?key=defaultkey", "unknown"},
+	} {
+		req, _ := http.NewRequest("POST", ts.URL+"/runtime/test"+c.query, nil)
+		req.Header.Set("X-Nakama-Api-Key", c.apiKey)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != 401 {
+			t.Error("Expected the call to be rejected", c, res.StatusCode)
+		}
+	}
+
+	audits := logs.FilterMessage("Runtime RPC audit").
+		FilterField(zap.String("api_key_name", "unauthenticated")).
+		FilterField(zap.String("id", "test")).
+		FilterField(zap.Int("status", 401))
+	if audits.Len() != 2 {
+		t.Error("Expected an audit record for each rejected call", logs.All())
+	}
+}
+
+func TestRuntimeTransformClientVersion(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("transform.lua", `
+local nk = require("nakama")
+
+-- Clients before 2.0 only display the handle field, so show them the user's full name there instead.
+local function legacy_self(ctx, envelope)
+	if ctx.client_version == "1.0" then
+		local user = envelope.self.self.user
+		user.handle = user.fullname
+		user.fullname = nil
+	end
+	return envelope
+end
+
+nk.register_transform(legacy_self, "Self")
+`)
+
+	jsonpbMarshaler := &jsonpb.Marshaler{
+		EnumsAsInts:  true,
+		EmitDefaults: false,
+		Indent:       "",
+		OrigName:     false,
+	}
+	jsonpbUnmarshaler := &jsonpb.Unmarshaler{
+		AllowUnknownFields: false,
+	}
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Error(err)
+	}
+
+	newEnvelope := func() *server.Envelope {
+		return &server.Envelope{
+			CollationId: "123",
+			Payload: &server.Envelope_Self{
+				Self: &server.TSelf{Self: &server.Self{User: &server.User{Handle: "alice", Fullname: "Alice Smith"}}},
+			}}
+	}
+
+	legacy, err := server.RuntimeTransformHook(r, jsonpbMarshaler, jsonpbUnmarshaler, "Self", newEnvelope(), "1.0")
+	if err != nil {
+		t.Error(err)
+	}
+	user := legacy.GetSelf().Self.User
+	if user.Handle != "Alice Smith" || user.Fullname != "" {
+		t.Error("Legacy client envelope was not transformed", user)
+	}
+
+	current, err := server.RuntimeTransformHook(r, jsonpbMarshaler, jsonpbUnmarshaler, "Self", newEnvelope(), "2.0")
+	if err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(newEnvelope(), current) {
+		t.Error("Current client envelope should not be transformed")
+	}
+}
+
+func TestRuntimeDeterministicSources(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("sources.lua", `
+local nk = require("nakama")
+local nx = require("nakamax")
+
+local function sources(ctx, payload)
+	return nx.uuid_v4() .. " " .. os.time() .. " " .. os.date("!%Y-%m-%d")
+end
+
+nk.register_rpc(sources, "sources")
+`)
+
+	invoke := func() string {
+		c := server.NewRuntimeConfig()
+		c.DeterministicSeed = 42
+		c.DeterministicTime = 1500000000
+		r, err := newRuntimeWithConfig(c)
+		defer r.Stop()
+		if err != nil {
+			t.Error(err)
+		}
+
+		fn := r.GetRuntimeCallback(server.RPC, "sources")
+		result, err := r.InvokeFunctionRPC(fn, uuid.Nil, "", 0, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		return string(result)
+	}
+
+	first := invoke()
+	second := invoke()
+	if first != second {
+		t.Error("Deterministic sources returned different results", first, second)
+	}
+	if !strings.HasSuffix(first, " 1500000000 2017-07-14") {
+		t.Error("Deterministic clock was not used", first)
+	}
+}
+
+func TestRuntimeBeforeHookStorageWrites(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("before-writes.lua", `
+local nk = require("nakama")
+
+local function record_attempt(ctx, envelope)
+	local writes = {
+		{Bucket = "mygame", Collection = "attempts", Record = "last", UserId = ctx.user_id, Value = "{\"attempted\": true}"}
+	}
+	return envelope, writes
+end
+
+nk.register_before(record_attempt, "StorageWrite")
+`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Error(err)
+	}
+
+	userID := uuid.NewV4()
+	fn := r.GetRuntimeCallback(server.BEFORE, "StorageWrite")
+	result, writes, err := r.InvokeFunctionBeforeWithWrites(fn, userID, "handle", 0, "", map[string]interface{}{"collationId": "123"})
+	if err != nil {
+		t.Error(err)
+	}
+	if result["collationId"] != "123" {
+		t.Error("Envelope was not returned", result)
+	}
+	if len(writes) != 1 {
+		t.Fatal("Expected one side effect write", writes)
+	}
+	if writes[0].Collection != "attempts" || !bytes.Equal(writes[0].UserId, userID.Bytes()) {
+		t.Error("Invalid side effect write", writes[0])
+	}
+
+	if _, err := r.InvokeFunctionBefore(fn, userID, "handle", 0, "", map[string]interface{}{"collationId": "123"}); err == nil {
+		t.Error("Side effect writes should be rejected where they are not supported")
+	}
+}
+
+func TestRuntimeReadiness(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("readiness.lua", `
+local nk = require("nakama")
+
+local function ready(ctx)
+	return false
+end
+
+nk.register_readiness(ready)
+`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if r.IsReady() {
+		t.Error("Runtime reported ready before the readiness function allowed it")
+	}
+}
+
+func TestRuntimeReadinessNotRegistered(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !r.IsReady() {
+		t.Error("Runtime without a readiness function should be ready")
+	}
+}
+
+func TestRuntimeErrorHook(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("error.lua", `
+local nk = require("nakama")
+
+local function format_error(ctx, err)
+	if ctx.user_lang == "fr" then
+		error("no translations yet")
+	end
+	return {code = err.code, message = err.message .. " (ticket 42)"}
+end
+
+nk.register_error(format_error)
+`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Error(err)
+	}
+
+	code, message, err := r.InvokeFunctionError(uuid.NewV4(), "handle", 0, "en", "", int32(server.BAD_INPUT), "Bad input")
+	if err != nil {
+		t.Error(err)
+	}
+	if code != int32(server.BAD_INPUT) || message != "Bad input (ticket 42)" {
+		t.Error("Error was not transformed", code, message)
+	}
+
+	code, message, err = r.InvokeFunctionError(uuid.NewV4(), "handle", 0, "fr", "", int32(server.BAD_INPUT), "Bad input")
+	if err == nil {
+		t.Error("Expected error function to fail")
+	}
+	if code != int32(server.BAD_INPUT) || message != "Bad input" {
+		t.Error("Failing error function did not fall back to the original error", code, message)
+	}
+}
+
+func TestRuntimeMatchBroadcast(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("match.lua", `
+local nk = require("nakama")
+
+local match = {}
+function match.match_init(ctx, params)
+	return {}, 1
+end
+function match.match_loop(ctx, state, tick, messages)
+	return state
+end
+
+nk.register_match(match, "boss_fight")
+`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Error(err)
+	}
+
+	matchID, err := r.CreateMatch("boss_fight", nil)
+	if err != nil {
+		t.Error(err)
+	}
+	if err := r.MatchBroadcast(matchID, 1, []byte("boss spawned"), nil); err != nil {
+		t.Error(err)
+	}
+	if err := r.MatchBroadcast(uuid.NewV4().String(), 1, []byte("boss spawned"), nil); err == nil {
+		t.Error("Broadcast to an unknown match should fail")
+	}
+}
+
+func TestRuntimeHandleNormalize(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("handle.lua", `
+local nk = require("nakama")
+
+local function handle_policy(ctx, handle)
+	if string.find(string.lower(handle), "badword") then
+		return nil, "Handle is not allowed"
+	end
+	-- Fold case and common homoglyphs so visually identical handles collide.
+	return (string.gsub(string.lower(handle), "0", "o"))
+end
+
+nk.register_handle(handle_policy)
+`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Error(err)
+	}
+
+	first, reason, err := r.InvokeFunctionHandle(uuid.NewV4(), "B0bby")
+	if err != nil || reason != "" {
+		t.Error("Handle was rejected", reason, err)
+	}
+	second, _, _ := r.InvokeFunctionHandle(uuid.NewV4(), "bobby")
+	if first != "bobby" || first != second {
+		t.Error("Visually identical handles were normalized differently", first, second)
+	}
+
+	if _, reason, err := r.InvokeFunctionHandle(uuid.NewV4(), "BadWord99"); err != nil || reason != "Handle is not allowed" {
+		t.Error("Handle should have been rejected", reason, err)
+	}
+}
+
+func TestRuntimeRegisterAfterSampleRate(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("after-sampled.lua", `
+local nk = require("nakama")
+
+local function analytics(ctx, envelope)
+end
+
+nk.register_after(analytics, "SelfFetch", 0.1)
+nk.register_after(analytics, "SelfUpdate")
+`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if rate := r.GetRuntimeAfterSampleRate("SelfFetch"); rate != 0.1 {
+		t.Error("Invalid sample rate", rate)
+	}
+	if rate := r.GetRuntimeAfterSampleRate("SelfUpdate"); rate != 1 {
+		t.Error("After function registered without a sample rate should see every message", rate)
+	}
+}
+
+func TestMatchmakerTicketTimeout(t *testing.T) {
+	matchmaker := server.NewMatchmakerService("nakama", server.NewMatchmakerConfig())
+
+	// Both tickets belong to the same user so they are never matched with each other.
+	userID := uuid.NewV4()
+	expiring := uuid.NewV4()
+	matchmaker.Add(expiring, userID, server.PresenceMeta{Handle: "expiring"}, 2, 10, "")
+	waiting := uuid.NewV4()
+	matchmaker.Add(waiting, userID, server.PresenceMeta{Handle: "waiting"}, 2, int64(time.Hour/time.Millisecond), "")
+
+	time.Sleep(20 * time.Millisecond)
+
+	_, selected := matchmaker.Add(uuid.NewV4(), uuid.NewV4(), server.PresenceMeta{Handle: "new"}, 2, 0, "")
+	if len(selected) != 2 {
+		t.Fatal("Expected a match with the ticket that has not expired", len(selected))
+	}
+	found := false
+	for mk := range selected {
+		if mk.ID.SessionID == expiring {
+			t.Error("Expired ticket should not be matched")
+		}
+		if mk.ID.SessionID == waiting {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Ticket with a longer timeout should still be matched")
+	}
+}
+
+func TestMatchmakerTicketSweep(t *testing.T) {
+	config := server.NewMatchmakerConfig()
+	config.MaxTicketTimeoutMs = 10
+	matchmaker := server.NewMatchmakerService("nakama", config)
+
+	// Timeouts above the maximum, and tickets that would never expire, are capped.
+	long := uuid.NewV4()
+	matchmaker.Add(long, uuid.NewV4(), server.PresenceMeta{Handle: "long"}, 2, int64(time.Hour/time.Millisecond), "")
+	forever := uuid.NewV4()
+	matchmaker.Add(forever, uuid.NewV4(), server.PresenceMeta{Handle: "forever"}, 3, 0, "")
+
+	if expired := matchmaker.Sweep(time.Now().UnixNano() / int64(time.Millisecond)); len(expired) != 0 {
+		t.Fatal("Tickets expired before their timeout", len(expired))
+	}
+	expired := matchmaker.Sweep(time.Now().Add(time.Second).UnixNano() / int64(time.Millisecond))
+	if len(expired) != 2 {
+		t.Fatal("Expected both capped tickets to expire", len(expired))
+	}
+	for mk := range expired {
+		if mk.ID.SessionID != long && mk.ID.SessionID != forever {
+			t.Error("Unexpected ticket expired", mk.ID.SessionID)
+		}
+	}
+	if expired := matchmaker.Sweep(time.Now().Add(time.Second).UnixNano() / int64(time.Millisecond)); len(expired) != 0 {
+		t.Error("Expired tickets were not removed", len(expired))
+	}
+}
+
+func TestMatchmakerTicketTimeoutDefaultMax(t *testing.T) {
+	matchmaker := server.NewMatchmakerService("nakama", server.NewMatchmakerConfig())
+
+	// Clients cannot keep tickets waiting longer than the default maximum.
+	long := uuid.NewV4()
+	matchmaker.Add(long, uuid.NewV4(), server.PresenceMeta{Handle: "long"}, 2, int64(time.Hour/time.Millisecond), "")
+
+	expired := matchmaker.Sweep(time.Now().Add(11*time.Minute).UnixNano() / int64(time.Millisecond))
+	if len(expired) != 1 {
+		t.Fatal("Expected the ticket capped at the default maximum to expire", len(expired))
+	}
+}
+
+func TestMatchmakerPoolPromotion(t *testing.T) {
+	config := server.NewMatchmakerConfig()
+	config.Pools["gold"] = &server.MatchmakerPoolConfig{PromoteAfterMs: 20, PromoteTo: "silver"}
+	matchmaker := server.NewMatchmakerService("nakama", config)
+
+	gold := uuid.NewV4()
+	matchmaker.Add(gold, uuid.NewV4(), server.PresenceMeta{Handle: "gold"}, 2, 0, "gold")
+
+	// Tickets are only matched within their own pool until they are promoted.
+	if _, selected := matchmaker.Add(uuid.NewV4(), uuid.NewV4(), server.PresenceMeta{Handle: "default"}, 2, 0, ""); selected != nil {
+		t.Fatal("Ticket was matched across pools")
+	}
+	if _, selected := matchmaker.Add(uuid.NewV4(), uuid.NewV4(), server.PresenceMeta{Handle: "silver"}, 2, 0, "silver"); selected != nil {
+		t.Fatal("Ticket was matched before it was promoted")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	_, selected := matchmaker.Add(uuid.NewV4(), uuid.NewV4(), server.PresenceMeta{Handle: "silver"}, 2, 0, "silver")
+	if len(selected) != 2 {
+		t.Fatal("Expected a match with the promoted ticket", len(selected))
+	}
+	for mk, mp := range selected {
+		if mp.Pool != "silver" {
+			t.Error("Matched ticket does not report the pool it was matched in", mp.Pool)
+		}
+		if mk.ID.SessionID != gold && mp.Meta.Handle != "silver" {
+			t.Error("Unexpected ticket matched", mp.Meta.Handle)
+		}
+	}
+}
+
+func TestMatchmakerPoolPromotionMatch(t *testing.T) {
+	config := server.NewMatchmakerConfig()
+	config.Pools["gold"] = &server.MatchmakerPoolConfig{PromoteAfterMs: 20, PromoteTo: "silver"}
+	matchmaker := server.NewMatchmakerService("nakama", config)
+
+	gold := uuid.NewV4()
+	matchmaker.Add(gold, uuid.NewV4(), server.PresenceMeta{Handle: "gold"}, 2, 0, "gold")
+	silver := uuid.NewV4()
+	matchmaker.Add(silver, uuid.NewV4(), server.PresenceMeta{Handle: "silver"}, 2, 0, "silver")
+
+	if matches := matchmaker.Match(time.Now().UnixNano() / int64(time.Millisecond)); len(matches) != 0 {
+		t.Fatal("Tickets were matched before promotion", len(matches))
+	}
+
+	// Both tickets are waiting, the promoted one is matched without another ticket being added.
+	matches := matchmaker.Match(time.Now().Add(time.Second).UnixNano() / int64(time.Millisecond))
+	if len(matches) != 1 || len(matches[0]) != 2 {
+		t.Fatal("Expected the promoted ticket to be matched with the waiting one", len(matches))
+	}
+	for mk, mp := range matches[0] {
+		if mk.ID.SessionID != gold && mk.ID.SessionID != silver {
+			t.Error("Unexpected ticket matched", mp.Meta.Handle)
+		}
+		if mp.Pool != "silver" {
+			t.Error("Matched ticket does not report the pool it was matched in", mp.Pool)
+		}
+	}
+
+	if !server.MatchmakerPoolConfigured(config.Pools, "silver") || !server.MatchmakerPoolConfigured(config.Pools, server.MatchmakerDefaultPool) {
+		t.Error("Configured pool was not accepted")
+	}
+	if server.MatchmakerPoolConfigured(config.Pools, "platinum") {
+		t.Error("Unknown pool was accepted")
+	}
+}
+
+func TestRuntimeMetrics(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("metrics.lua", `
+local nk = require("nakama")
+
+nk.metrics_counter("purchase.completed", 1, {store = "apple"})
+nk.metrics_gauge("match.active", 3)
+nk.metrics_timing("match.duration", 1500, {mode = "ranked"})
+
+local ok = pcall(nk.metrics_counter, "Purchase Completed", 1)
+assert(not ok, "invalid metric name should be rejected")
+`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRuntimeMetricsTagLimit(t *testing.T) {
+	m := server.NewRuntimeMetrics(2)
+
+	if err := m.Counter("purchase.completed", 1, map[string]string{"store": "apple"}); err != nil {
+		t.Error(err)
+	}
+	if err := m.Counter("purchase.completed", 1, map[string]string{"store": "google"}); err != nil {
+		t.Error(err)
+	}
+	if err := m.Counter("purchase.completed", 1, map[string]string{"store": "apple"}); err != nil {
+		t.Error("Previously seen tags should still be accepted", err)
+	}
+	if err := m.Counter("purchase.completed", 1, map[string]string{"store": "steam"}); err == nil {
+		t.Error("Expected tag combinations over the limit to be rejected")
+	}
+	if err := m.Counter("purchase.refunded", 1, map[string]string{"store": "steam"}); err != nil {
+		t.Error("Tag limit should apply per metric name", err)
+	}
+
+	unlimited := server.NewRuntimeMetrics(0)
+	for _, store := range []string{"apple", "google", "steam"} {
+		if err := unlimited.Counter("purchase.completed", 1, map[string]string{"store": store}); err != nil {
+			t.Error("Expected no tag limit when it is 0", err)
+		}
+	}
+}
+
+func TestRuntimeNotificationHook(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("notification.lua", `
+local nk = require("nakama")
+
+local function notification_policy(ctx, notification)
+  if notification.code == 1 then
+    -- Invites are only useful while the sender is still waiting.
+    return false
+  elseif notification.code == 2 then
+    return true, 60000
+  end
+end
+
+nk.register_notification(notification_policy)
+`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ephemeral := &server.NNotification{UserID: uuid.NewV4().Bytes(), Subject: "invite", Code: 1, Persistent: true, CreatedAt: 1000}
+	durable := &server.NNotification{UserID: uuid.NewV4().Bytes(), Subject: "reward", Code: 2, Persistent: true, CreatedAt: 1000}
+	unchanged := &server.NNotification{UserID: uuid.NewV4().Bytes(), Subject: "news", Code: 3, Persistent: true, CreatedAt: 1000}
+	if err := server.RuntimeNotificationHook(zap.NewNop(), r, []*server.NNotification{ephemeral, durable, unchanged}); err != nil {
+		t.Fatal(err)
+	}
+
+	if ephemeral.Persistent {
+		t.Error("Expected invite notification to be ephemeral")
+	}
+	if !durable.Persistent || durable.ExpiresAt != 61000 {
+		t.Error("Expected reward notification to be stored with a time to live", durable.Persistent, durable.ExpiresAt)
+	}
+	if !unchanged.Persistent || unchanged.ExpiresAt != 0 {
+		t.Error("Expected notification to keep its defaults when the function returns nothing", unchanged.Persistent, unchanged.ExpiresAt)
+	}
+}
+
+func TestRuntimeNotifyUsers(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("notify-users.lua", `
+local nk = require("nakama")
+local nkx = require("nakamax")
+
+local user_id = nkx.uuid_v4()
+local delivered, stored = nk.notification_send_users({user_id, user_id, nkx.uuid_v4()}, "event", {name = "winter"}, 1)
+assert(delivered == 0, "offline users should not have live deliveries")
+assert(stored == 2, "duplicate user IDs should be notified once")
+	`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userIDs := make([]uuid.UUID, 0, 1200)
+	for i := 0; i < 600; i++ {
+		userID := uuid.NewV4()
+		userIDs = append(userIDs, userID, userID)
+	}
+	delivered, stored, err := r.NotifyUsers(userIDs, "event", []byte("{}"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivered != 0 || stored != 600 {
+		t.Error("Expected each user to have one stored notification", delivered, stored)
+	}
+	total, _, err := r.NotificationCount(userIDs[len(userIDs)-1], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 1 {
+		t.Error("Expected the last user to be notified once", total)
+	}
+}
+
+func TestRuntimeMatchmakerMatchedHook(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("matchmaker-matched.lua", `
+local nk = require("nakama")
+
+local function matched(ctx, result)
+  assert(#result.presences == 2, "expects both matched presences")
+  local team = "blue"
+  if result.self.handle == "red-player" then
+    team = "red"
+  end
+  return {team = team, region = "eu"}
+end
+
+nk.register_matchmaker_matched(matched)
+`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	red := server.MatchmakerKey{ID: server.PresenceID{SessionID: uuid.NewV4(), Node: "nakama"}, UserID: uuid.NewV4(), Ticket: uuid.NewV4()}
+	blue := server.MatchmakerKey{ID: server.PresenceID{SessionID: uuid.NewV4(), Node: "nakama"}, UserID: uuid.NewV4(), Ticket: uuid.NewV4()}
+	selected := map[server.MatchmakerKey]*server.MatchmakerProfile{
+		red:  &server.MatchmakerProfile{Meta: server.PresenceMeta{Handle: "red-player"}, RequiredCount: 2},
+		blue: &server.MatchmakerProfile{Meta: server.PresenceMeta{Handle: "blue-player"}, RequiredCount: 2},
+	}
+
+	properties := server.RuntimeMatchmakerMatchedHook(zap.NewNop(), r, red, selected[red], selected, 2)
+	if string(properties) != `{"region":"eu","team":"red"}` {
+		t.Error("Invalid matchmaker matched properties", string(properties))
+	}
+}
+
+func TestRuntimeBeforeHookStorageQuota(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("storage-quota.lua", `
+local nk = require("nakama")
+
+local function storage_quota(ctx, envelope)
+  if ctx.storage_usage_bytes >= 1024 then
+    error("storage quota exceeded")
+  end
+  return envelope
+end
+
+nk.register_before(storage_quota, "StorageWrite")
+`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Error(err)
+	}
+
+	fn := r.GetRuntimeCallback(server.BEFORE, "StorageWrite")
+	envelope := map[string]interface{}{"collationId": "123"}
+	if _, _, err := r.InvokeFunctionBeforeWithContext(fn, uuid.NewV4(), "handle", 0, "", map[string]interface{}{"storage_usage_bytes": 512}, envelope); err != nil {
+		t.Error("Write under quota should be allowed", err)
+	}
+	if _, _, err := r.InvokeFunctionBeforeWithContext(fn, uuid.NewV4(), "handle", 0, "", map[string]interface{}{"storage_usage_bytes": 2048}, envelope); err == nil || !strings.Contains(err.Error(), "storage quota exceeded") {
+		t.Error("Write over quota should be rejected", err)
+	}
+}
+
+func TestRuntimeShutdown(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("shutdown.lua", `
+local nk = require("nakama")
+
+local function shutdown(ctx, deadline)
+  assert(ctx.execution_mode == "shutdown", "expects shutdown execution mode")
+  assert(deadline > 0, "expects a deadline")
+end
+
+nk.register_shutdown(shutdown)
+`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.InvokeFunctionShutdown(time.Second); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRuntimeShutdownDeadline(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("shutdown-slow.lua", `
+local nk = require("nakama")
+
+local function shutdown(ctx, deadline)
+  while true do end
+end
+
+nk.register_shutdown(shutdown)
+`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if err := r.InvokeFunctionShutdown(50 * time.Millisecond); err == nil {
+		t.Error("Expected shutdown function to be interrupted at the deadline")
+	}
+	if time.Since(start) > time.Second {
+		t.Error("Shutdown function ran well past its deadline")
+	}
+}
+
+func TestRuntimeShutdownRunAsync(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	r, err := newRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Stop()
+	if r.RunAsync(func() {}) {
+		t.Error("Function was queued after the runtime stopped")
+	}
+}
+
+func TestRuntimeRegisterAccount(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("account.lua", `
+local nk = require("nakama")
+
+local function account(ctx, account)
+  assert(ctx.execution_mode == "account", "expects account execution mode")
+  local level = math.floor(account.metadata.xp / 100)
+  return {level = level, vip = level >= 5}
+end
+
+nk.register_account(account)
+`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userID := uuid.NewV4()
+	self := &server.Self{User: &server.User{Id: userID.Bytes(), Handle: "player", Metadata: []byte(`{"xp":650}`)}}
+	server.RuntimeAccountHook(zap.NewNop(), r, "player", 0, self)
+
+	if string(self.User.Metadata) != `{"level":6,"vip":true,"xp":650}` {
+		t.Error("Invalid account metadata", string(self.User.Metadata))
+	}
+}
+
+func TestRuntimeRegisterAfterLeaderOnly(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("leader-only.lua", `
+local nk = require("nakama")
+local nx = require("nakamax")
+
+local calls = 0
+
+local function singleton(ctx, envelope)
+  calls = calls + 1
+end
+nk.register_after(singleton, "SelfFetch", 1, true)
+
+local function status(ctx, payload)
+  local leader, is_leader = nk.cluster_leader()
+  return nx.json_encode({leader = leader, is_leader = is_leader, calls = calls})
+end
+nk.register_rpc(status, "status")
+`)
+
+	jsonpbMarshaler := &jsonpb.Marshaler{
+		EnumsAsInts:  true,
+		EmitDefaults: false,
+		Indent:       "",
+		OrigName:     true,
+	}
+	envelope := &server.Envelope{Payload: &server.Envelope_SelfFetch{SelfFetch: &server.TSelfFetch{}}}
+
+	for node, expected := range map[string]string{
+		"nakama": `{"calls":1,"is_leader":true,"leader":"nakama"}`,
+		"other":  `{"calls":0,"is_leader":false,"leader":"nakama"}`,
+	} {
+		r, err := newRuntimeWithLeader(server.NewRuntimeConfig(), server.NewStaticClusterLeader(node, "nakama"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		server.RuntimeAfterHook(zap.NewNop(), r, jsonpbMarshaler, "SelfFetch", envelope, nil)
+
+		fn := r.GetRuntimeCallback(server.RPC, "status")
+		result, err := r.InvokeFunctionRPC(fn, uuid.Nil, "", 0, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		if string(result) != expected {
+			t.Error("Invalid leader only result on node", node, string(result))
+		}
+		r.Stop()
+	}
+}
+
+func TestRuntimeSessionListRevoke(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("sessions.lua", `
+local nk = require("nakama")
+
+local function logout_everywhere(ctx, payload)
+  local revoked = 0
+  for _, s in ipairs(nk.session_list(ctx.user_id)) do
+    if nk.session_revoke(s.session_id) then
+      revoked = revoked + 1
+    end
+  end
+  assert(not nk.session_revoke("`+uuid.NewV4().String()+`"), "expects unknown session not to be revoked")
+  return tostring(revoked)
+end
+nk.register_rpc(logout_everywhere, "logout_everywhere")
+`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userID := uuid.NewV4()
+	if sessions := r.ListUserSessions(userID); len(sessions) != 0 {
+		t.Error("Expected no sessions", sessions)
+	}
+
+	fn := r.GetRuntimeCallback(server.RPC, "logout_everywhere")
+	result, err := r.InvokeFunctionRPC(fn, userID, "", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != "0" {
+		t.Error("Invalid revoked session count", string(result))
+	}
+}
+
+func TestRuntimeRegisterMatchJoin(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("match-join.lua", `
+local nk = require("nakama")
+
+local function match_join(ctx, join)
+  assert(ctx.execution_mode == "match_join", "expects match join execution mode")
+  if join.handle == "greedy" then
+    return {padding = string.rep("x", 2048)}
+  end
+  return {skill_bucket = 3, party_id = "party-" .. join.handle}
+end
+
+nk.register_match_join(match_join)
+`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userID := uuid.NewV4()
+	metadata, err := server.RuntimeMatchJoinHook(zap.NewNop(), r, userID, uuid.NewV4(), "player", 0, uuid.NewV4())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata != `{"party_id":"party-player","skill_bucket":3}` {
+		t.Error("Invalid match join metadata", metadata)
+	}
+
+	if _, err = server.RuntimeMatchJoinHook(zap.NewNop(), r, userID, uuid.NewV4(), "greedy", 0, uuid.NewV4()); err == nil {
+		t.Error("Expected metadata over the size limit to be rejected")
+	}
+}
+
+func TestRuntimeBeforeHookStreamDirective(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("stream-directive.lua", `
+local nk = require("nakama")
+
+local function topics_join(ctx, envelope)
+  local room = envelope.topicsJoin.joins[1].room
+  return envelope, nil, {join = {{mode = "room", subject = room .. "-news"}}, leave = {{mode = "room", subject = "lobby"}}}
+end
+nk.register_before(topics_join, "TopicsJoin")
+
+local function invalid(ctx, envelope)
+  return envelope, {}, {join = {{mode = "dm", subject = "someone"}}}
+end
+nk.register_before(invalid, "TopicsLeave")
+`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userID := uuid.NewV4()
+	sessionID := uuid.NewV4()
+	envelope := map[string]interface{}{"topicsJoin": map[string]interface{}{"joins": []interface{}{map[string]interface{}{"room": "general"}}}}
+	fn := r.GetRuntimeCallback(server.BEFORE, "TopicsJoin")
+	result, writes, directive, err := r.InvokeFunctionBeforeWithStreams(fn, userID, "handle", 0, "", nil, envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result == nil || len(writes) != 0 || directive == nil {
+		t.Fatal("Invalid before function result", result, writes, directive)
+	}
+
+	tracker := server.NewTrackerService("nakama")
+	tracker.Track(sessionID, "room:lobby", userID, server.PresenceMeta{Handle: "handle"})
+	if err = server.StreamDirectiveApply(tracker, sessionID, userID, "handle", directive); err != nil {
+		t.Fatal(err)
+	}
+	if ps := tracker.ListByTopic("room:general-news"); len(ps) != 1 || ps[0].ID.SessionID != sessionID {
+		t.Error("Expected session to be subscribed to the joined stream", ps)
+	}
+	if ps := tracker.ListByTopic("room:lobby"); len(ps) != 0 {
+		t.Error("Expected session to be unsubscribed from the left stream", ps)
+	}
+
+	fn = r.GetRuntimeCallback(server.BEFORE, "TopicsLeave")
+	if _, _, _, err = r.InvokeFunctionBeforeWithStreams(fn, userID, "handle", 0, "", nil, envelope); err == nil {
+		t.Error("Expected invalid stream mode to be rejected")
+	}
+}
+
+func TestFriendsList(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("friends-list.lua", `
+local nk = require("nakama")
+local nkx = require("nakamax")
+
+local user_id = nkx.uuid_v4()
+local friends, cursor = nk.friends_list(user_id, 10)
+assert(#friends == 0, "new user should have no friends")
+assert(cursor == nil, "single page should have no cursor")
+
+local mutual, cursor = nk.friends_mutual(user_id, nkx.uuid_v4())
+assert(#mutual == 0, "new users should have no mutual friends")
+assert(cursor == nil, "single page should have no cursor")
+	`)
+
+	setupDB()
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRuntimeConversionMaxDepth(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("conversion-depth.lua", `
+local nk = require("nakama")
+
+local function echo(ctx, envelope)
+  return envelope
+end
+nk.register_before(echo, "SelfFetch")
+
+local function nested(ctx, envelope)
+  local t = {}
+  local deepest = t
+  for i = 1, 100 do
+    deepest.next = {}
+    deepest = deepest.next
+  end
+  return t
+end
+nk.register_before(nested, "SelfUpdate")
+
+local function cyclic(ctx, envelope)
+  local t = {}
+  t.self = t
+  return t
+end
+nk.register_before(cyclic, "UsersFetch")
+`)
+
+	c := server.NewRuntimeConfig()
+	c.ConversionMaxDepth = 16
+	r, err := newRuntimeWithConfig(c)
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Build a payload nested far deeper than the limit.
+	payload := map[string]interface{}{"collationId": "123"}
+	deepest := payload
+	for i := 0; i < 10000; i++ {
+		next := map[string]interface{}{}
+		deepest["next"] = next
+		deepest = next
+	}
+
+	fn := r.GetRuntimeCallback(server.BEFORE, "SelfFetch")
+	if _, err = r.InvokeFunctionBefore(fn, uuid.Nil, "", 0, "", payload); err != server.ErrConversionDepth {
+		t.Error("Expected deeply nested payload to be rejected", err)
+	}
+	if _, err = r.InvokeFunctionBefore(fn, uuid.Nil, "", 0, "", map[string]interface{}{"collationId": "123"}); err != nil {
+		t.Error(err)
+	}
+
+	fn = r.GetRuntimeCallback(server.BEFORE, "SelfUpdate")
+	if _, err = r.InvokeFunctionBefore(fn, uuid.Nil, "", 0, "", map[string]interface{}{"collationId": "123"}); err != server.ErrConversionDepth {
+		t.Error("Expected deeply nested result to be rejected", err)
+	}
+
+	fn = r.GetRuntimeCallback(server.BEFORE, "UsersFetch")
+	if _, err = r.InvokeFunctionBefore(fn, uuid.Nil, "", 0, "", map[string]interface{}{"collationId": "123"}); err != server.ErrConversionDepth {
+		t.Error("Expected cyclic result to be rejected", err)
+	}
+}
+
+func TestNotificationSendQuery(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("notification-send-query.lua", `
+local nk = require("nakama")
+local nkx = require("nakamax")
+
+local handle = nkx.uuid_v4()
+local count = nk.notification_send_query("handle = $1", {handle}, "subject", {}, 1, true)
+assert(count == 0, "dry run should match no users")
+
+count = nk.notification_send_query("handle = $1", {handle}, "subject", {}, 1)
+assert(count == 0, "send should match no users")
+
+local ok = pcall(nk.notification_send_query, "handle = $1", {handle}, "", {}, 1)
+assert(not ok, "empty subject should be rejected")
+	`)
+
+	setupDB()
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNotificationSchedule(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("notification-schedule.lua", `
+local nk = require("nakama")
+local nkx = require("nakamax")
+
+local deliver_at = (os.time() + 3600) * 1000
+local id = nk.notification_schedule(nkx.uuid_v4(), deliver_at, "energy refilled", {energy = 10}, 1)
+assert(nk.notification_schedule_cancel(id), "scheduled notification should be cancelled")
+assert(not nk.notification_schedule_cancel(id), "cancelled notification should not be found again")
+
+local ok = pcall(nk.notification_schedule, nkx.uuid_v4(), deliver_at, "", {}, 1)
+assert(not ok, "empty subject should be rejected")
+	`)
+
+	setupDB()
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNotificationScheduleExpiry(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("notification-schedule-expiry.lua", `
+local nk = require("nakama")
+nk.register_notification(function(ctx, notification)
+  return true, 60000
+end)
+	`)
+
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deliverAt := (time.Now().Unix() + 3600) * 1000
+	id, err := r.ScheduleNotification(uuid.NewV4(), deliverAt, "energy refilled", []byte("{}"), 1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expiresAt int64
+	if err = db.QueryRow("SELECT expires_at FROM notification_schedule WHERE id = $1", uuid.FromStringOrNil(id).Bytes()).Scan(&expiresAt); err != nil {
+		t.Fatal(err)
+	}
+	if expiresAt != deliverAt+60000 {
+		t.Error("Expected scheduled notification to expire a time to live after delivery", deliverAt, expiresAt)
+	}
+}
+
+func TestNotificationCount(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("notification-count.lua", `
+local nk = require("nakama")
+local nkx = require("nakamax")
+
+local user_id = nkx.uuid_v4()
+nk.notification_send(user_id, "reward", {}, 5)
+nk.notification_send(user_id, "message", {}, 6)
+
+local total, unread = nk.notification_count(user_id)
+assert(total == 2 and unread == 2, "all notifications should be counted as unread")
+total, unread = nk.notification_count(user_id, {5})
+assert(total == 1 and unread == 1, "only notifications with the code should be counted")
+
+nk.notifications_mark_read(user_id, {nkx.uuid_v4()})
+total, unread = nk.notification_count(user_id)
+assert(unread == 2, "unknown notification IDs should not change the unread count")
+	`)
+
+	setupDB()
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStorageScan(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("storage-scan.lua", `
+local nk = require("nakama")
+local nkx = require("nakamax")
+
+local collection = nkx.uuid_v4()
+local new_records = {}
+for i = 1, 15 do
+  table.insert(new_records, {Bucket = "mygame", Collection = collection, Record = tostring(i), UserId = nil, Value = "{}"})
+end
+nk.storage_write(new_records)
+
+local seen = 0
+local cursor = nk.storage_scan("mygame", collection, 10, function(records, cursor)
+  seen = seen + #records
+end)
+assert(seen == 15, "scan should visit every record")
+assert(cursor == nil, "complete scan should have no cursor")
+
+seen = 0
+cursor = nk.storage_scan("mygame", collection, 10, function(records, cursor)
+  seen = seen + #records
+  return false
+end)
+assert(seen == 10, "stopped scan should visit one batch")
+assert(cursor ~= nil, "stopped scan should return a cursor")
+
+nk.storage_scan("mygame", collection, 10, function(records, cursor)
+  seen = seen + #records
+end, cursor)
+assert(seen == 15, "resumed scan should visit the remaining records")
+	`)
+
+	setupDB()
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+type welcomeMatchRegistry struct {
+	server.MatchRegistry
+	broadcasts chan []server.Presence
+}
+
+func (w *welcomeMatchRegistry) Broadcast(matchID uuid.UUID, opCode int64, data []byte, presences []server.Presence) error {
+	if opCode == 7 && string(data) == "welcome bob" {
+		w.broadcasts <- presences
+	}
+	return nil
+}
+
+func (w *welcomeMatchRegistry) Remove(matchID uuid.UUID) {}
+
+func TestRuntimeMatchWelcome(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("match-welcome.lua", `
+local nk = require("nakama")
+
+local match = {}
+function match.match_init(ctx, params)
+	return {joined = 0}, 1
+end
+function match.match_join(ctx, state, joins)
+	state.joined = state.joined + #joins
+	return state
+end
+function match.match_welcome(ctx, state, presence)
+	if state.joined ~= 1 then
+		return nil
+	end
+	return 7, "welcome " .. presence.handle
+end
+function match.match_loop(ctx, state, tick, messages)
+	return state
+end
+
+nk.register_match(match, "welcome")
+`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger, _ := zap.NewDevelopment(zap.AddStacktrace(zap.ErrorLevel))
+	registry := &welcomeMatchRegistry{broadcasts: make(chan []server.Presence, 1)}
+	mh, err := server.NewMatchHandler(logger, r, registry, uuid.NewV4(), "welcome", r.GetRuntimeMatch("welcome"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mh.Start()
+	defer func() {
+		mh.Stop()
+		mh.Wait()
+	}()
+
+	bob := server.Presence{ID: server.PresenceID{Node: "nakama", SessionID: uuid.NewV4()}, UserID: uuid.NewV4(), Meta: server.PresenceMeta{Handle: "bob"}}
+	mh.Join([]server.Presence{bob})
+
+	select {
+	case presences := <-registry.broadcasts:
+		if len(presences) != 1 || presences[0].ID.SessionID != bob.ID.SessionID {
+			t.Error("Welcome message was not sent only to the joining presence", presences)
+		}
+	case <-time.After(time.Second):
+		t.Error("Welcome message was not sent")
+	}
+}
+
+func TestRuntimeMatchOpCodes(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("match-op-codes.lua", `
+local nk = require("nakama")
+
+local received = {}
+
+local match = {match_op_codes = {1, 2}}
+function match.match_init(ctx, params)
+	return {}, 30
+end
+function match.match_loop(ctx, state, tick, messages)
+	for _, m in ipairs(messages) do
+		table.insert(received, tostring(m.op_code))
+	end
+	return state
+end
+nk.register_match(match, "op_codes")
+
+local function status(ctx, payload)
+	return table.concat(received, ",")
+end
+nk.register_rpc(status, "status")
+`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matchID, err := r.CreateMatch("op_codes", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mh := r.MatchGet(matchID)
+
+	bob := server.Presence{ID: server.PresenceID{Node: "nakama", SessionID: uuid.NewV4()}, UserID: uuid.NewV4(), Meta: server.PresenceMeta{Handle: "bob"}}
+	mh.Data(bob, 9, nil)
+	mh.Data(bob, 2, nil)
+	time.Sleep(100 * time.Millisecond)
+
+	result, err := r.InvokeFunctionRPC(r.GetRuntimeCallback(server.RPC, "status"), uuid.Nil, "", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != "2" {
+		t.Error("Only match data with allowed op codes should reach the match loop", string(result))
+	}
+}
+
+func TestRuntimeMatchSummary(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("match-summary.lua", `
+local nk = require("nakama")
+local nx = require("nakamax")
+
+local summaries = 0
+local participants = 0
+
+local match = {}
+function match.match_init(ctx, params)
+	return {kills = {}}, 30
+end
+function match.match_leave(ctx, state, presences)
+	for _, p in ipairs(presences) do
+		state.kills[p.user_id] = 3
+	end
+	return state
+end
+function match.match_loop(ctx, state, tick, messages)
+	return state
+end
+function match.match_summary(ctx, state, tick, presences)
+	summaries = summaries + 1
+	participants = #presences
+	local result = {}
+	for _, p in ipairs(presences) do
+		result[p.user_id] = {kills = state.kills[p.user_id] or 0}
+	end
+	return result
+end
+nk.register_match(match, "summary")
+
+local function status(ctx, payload)
+	return nx.json_encode({summaries = summaries, participants = participants})
+end
+nk.register_rpc(status, "status")
+`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matchID, err := r.CreateMatch("summary", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mh := r.MatchGet(matchID)
+
+	bob := server.Presence{ID: server.PresenceID{Node: "nakama", SessionID: uuid.NewV4()}, UserID: uuid.NewV4(), Meta: server.PresenceMeta{Handle: "bob"}}
+	alice := server.Presence{ID: server.PresenceID{Node: "nakama", SessionID: uuid.NewV4()}, UserID: uuid.NewV4(), Meta: server.PresenceMeta{Handle: "alice"}}
+	mh.Join([]server.Presence{bob, alice})
+	mh.Leave([]server.Presence{alice})
+	time.Sleep(50 * time.Millisecond)
+	mh.Stop()
+	mh.Wait()
+
+	result, err := r.InvokeFunctionRPC(r.GetRuntimeCallback(server.RPC, "status"), uuid.Nil, "", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != `{"participants":2,"summaries":1}` {
+		t.Error("Match summary should run once with everyone who joined", string(result))
+	}
+}
+
+func TestRuntimeBeforeHookValidationError(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("validation-error.lua", `
+local nk = require("nakama")
+
+local function self_update(ctx, envelope)
+  local errors = {}
+  if string.len(envelope.selfUpdate.handle) < 3 then
+    errors.handle = "Handle is too short"
+  end
+  if envelope.selfUpdate.lang ~= "en" then
+    errors.lang = "Unsupported language"
+  end
+  if next(errors) ~= nil then
+    error(errors)
+  end
+  return envelope
+end
+nk.register_before(self_update, "SelfUpdate")
+
+local function plain_error(ctx, envelope)
+  error("plain failure")
+end
+nk.register_before(plain_error, "SelfFetch")
+`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	envelope := map[string]interface{}{"selfUpdate": map[string]interface{}{"handle": "ab", "lang": "xx"}}
+	fn := r.GetRuntimeCallback(server.BEFORE, "SelfUpdate")
+	_, _, _, err = r.InvokeFunctionBeforeWithStreams(fn, uuid.NewV4(), "handle", 0, "", nil, envelope)
+	validationErr, ok := err.(*server.RuntimeValidationError)
+	if !ok {
+		t.Fatal("Expected a validation error", err)
+	}
+	if !reflect.DeepEqual(validationErr.Fields, map[string]string{"handle": "Handle is too short", "lang": "Unsupported language"}) {
+		t.Error("Invalid validation error fields", validationErr.Fields)
+	}
+	if validationErr.Error() != "Validation failed: handle: Handle is too short, lang: Unsupported language" {
+		t.Error("Invalid validation error message", validationErr.Error())
+	}
+
+	fn = r.GetRuntimeCallback(server.BEFORE, "SelfFetch")
+	_, _, _, err = r.InvokeFunctionBeforeWithStreams(fn, uuid.NewV4(), "handle", 0, "", nil, map[string]interface{}{"selfFetch": map[string]interface{}{}})
+	if _, ok := err.(*server.RuntimeValidationError); ok || err == nil {
+		t.Error("Expected a plain error", err)
+	}
+}
+
+func TestRuntimeRegisterRateLimitTier(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("rate-limit-tier.lua", `
+local nk = require("nakama")
+
+local function tier(ctx)
+  if string.sub(ctx.user_handle, 1, 3) == "vip" then
+    return "premium"
+  end
+  return nil
+end
+nk.register_rate_limit_tier(tier)
+`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tier, err := r.InvokeFunctionRateLimitTier(uuid.NewV4(), "vipalice", 0); err != nil || tier != "premium" {
+		t.Error("Expected premium tier", tier, err)
+	}
+	if tier, err := r.InvokeFunctionRateLimitTier(uuid.NewV4(), "bob", 0); err != nil || tier != "" {
+		t.Error("Expected default tier", tier, err)
+	}
+}
+
+func TestRuntimeRegisterAfterExternalRedaction(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("after-external.lua", `
+local nk = require("nakama")
+local nx = require("nakamax")
+
+local seen = {}
+
+local function forward(ctx, envelope)
+  seen = envelope.self_update
+end
+nk.register_after(forward, "SelfUpdate", 1, false, true)
+
+local function status(ctx, payload)
+  return nx.json_encode(seen)
+end
+nk.register_rpc(status, "status")
+`)
+
+	c := server.NewRuntimeConfig()
+	c.RedactionRules = []*server.RedactionRuleConfig{
+		&server.RedactionRuleConfig{Path: "self_update.fullname", Mask: "***"},
+		&server.RedactionRuleConfig{Path: "self_update.location"},
+	}
+	r, err := newRuntimeWithConfig(c)
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jsonpbMarshaler := &jsonpb.Marshaler{
+		EnumsAsInts:  true,
+		EmitDefaults: false,
+		Indent:       "",
+		OrigName:     true,
+	}
+	envelope := &server.Envelope{Payload: &server.Envelope_SelfUpdate{SelfUpdate: &server.TSelfUpdate{Handle: "alice", Fullname: "Alice Smith", Location: "London"}}}
+	server.RuntimeAfterHook(zap.NewNop(), r, jsonpbMarshaler, "SelfUpdate", envelope, nil)
+
+	fn := r.GetRuntimeCallback(server.RPC, "status")
+	result, err := r.InvokeFunctionRPC(fn, uuid.Nil, "", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != `{"fullname":"***","handle":"alice"}` {
+		t.Error("Invalid redacted payload", string(result))
+	}
+	if envelope.GetSelfUpdate().Fullname != "Alice Smith" {
+		t.Error("Redaction changed the original envelope")
+	}
+
+	c = server.NewRuntimeConfig()
+	c.RedactionRules = []*server.RedactionRuleConfig{&server.RedactionRuleConfig{Path: "self_update..email"}}
+	if _, err := newRuntimeWithConfig(c); err == nil {
+		t.Error("Expected invalid redaction rule to be rejected")
+	}
+}
+
+func TestOneTimeToken(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("one-time-token.lua", `
+local nk = require("nakama")
+
+local token = nk.one_time_token_create({action = "verify_email", email = "alice@example.com"}, 60000)
+assert(type(token) == "string" and token ~= "", "token should be a string")
+
+local payload = nk.one_time_token_consume(token)
+assert(payload ~= nil, "token should be consumed")
+assert(payload.action == "verify_email", "payload should be returned")
+
+assert(nk.one_time_token_consume(token) == nil, "token should only be consumed once")
+assert(nk.one_time_token_consume("unknown") == nil, "unknown token should not be consumed")
+	`)
+
+	setupDB()
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRuntimeClaimUnique(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	// Claims are kept in the database, so the name is unique to each run.
+	name := uuid.NewV4().String()
+	writeFile("unique-claim.lua", `
+local nk = require("nakama")
+
+local alice = "4c2ae592-b2a7-445e-98ec-697694478b1c"
+local bob = "8f1a1d5c-2b3e-4a4f-9c6d-7e8f9a0b1c2d"
+local name = "`+name+`"
+
+assert(nk.unique_claim("guild_name", name, alice), "value should be claimed")
+assert(nk.unique_claim("guild_name", name, alice), "owner should be able to claim again")
+assert(not nk.unique_claim("guild_name", name, bob), "claimed value should not be claimed by another owner")
+assert(nk.unique_claim("vanity_url", name, bob), "namespaces should be separate")
+
+assert(not nk.unique_release("guild_name", name, bob), "only the owner should release a value")
+assert(nk.unique_release("guild_name", name, alice), "value should be released")
+assert(nk.unique_claim("guild_name", name, bob), "released value should be claimed")
+	`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := uuid.NewV4().String()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	winners := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := r.ClaimUnique("guild_name", value, uuid.NewV4())
+			if err == server.ErrUniqueClaimed {
+				return
+			} else if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			winners++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if winners != 1 {
+		t.Error("Expected exactly one claim to win", winners)
+	}
+}
+
+func TestRuntimeCheckCooldown(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("cooldown.lua", `
+local nk = require("nakama")
+local nkx = require("nakamax")
+
+local user_id = nkx.uuid_v4()
+local ready, remaining = nk.cooldown_check(user_id, "daily_reward", 60000)
+assert(ready and remaining == 0, "first check should be ready")
+ready, remaining = nk.cooldown_check(user_id, "daily_reward", 60000)
+assert(not ready and remaining > 0 and remaining <= 60000, "second check should be cooling down")
+assert(nk.cooldown_check(user_id, "fireball", 60000), "actions should cool down separately")
+	`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userID := uuid.NewV4()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	ready := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			remaining, err := r.CheckCooldown(userID, "ability", time.Minute)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if remaining == 0 {
+				mu.Lock()
+				ready++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if ready != 1 {
+		t.Error("Expected exactly one check to find the action ready", ready)
+	}
+}
+
+func TestRuntimeUserFlags(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("user-flags.lua", `
+local nk = require("nakama")
+local nkx = require("nakamax")
+
+local user_id = nkx.uuid_v4()
+assert(next(nk.user_flags_get(user_id)) == nil, "new user should have no flags")
+nk.user_flag_set(user_id, "checkout", "variant_b")
+nk.user_flag_set(user_id, "beta", "true")
+local flags = nk.user_flags_get(user_id)
+assert(flags.checkout == "variant_b" and flags.beta == "true", "flags should be read back")
+nk.user_flag_set(user_id, "beta")
+assert(nk.user_flags_get(user_id).beta == nil, "flag should be removed")
+	`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userID := uuid.NewV4()
+	if _, err = r.GetUserFlags(userID); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.SetUserFlag(userID, "checkout", "variant_a"); err != nil {
+		t.Fatal(err)
+	}
+	flags, err := r.GetUserFlags(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags["checkout"] != "variant_a" {
+		t.Error("Setting a flag should invalidate the cached flags", flags)
+	}
+}
+
+func TestRuntimeRegisterPresenceCoalesced(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("presence.lua", `
+local nk = require("nakama")
+local nx = require("nakamax")
+
+local deliveries = {}
+
+local function presence(ctx, p)
+  table.insert(deliveries, {online = p.online, session_count = p.session_count, updates = p.updates})
+end
+nk.register_presence(presence)
+
+local function status(ctx, payload)
+  return nx.json_encode({count = #deliveries, last = deliveries[#deliveries]})
+end
+nk.register_rpc(status, "status")
+`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger, _ := zap.NewDevelopment(zap.AddStacktrace(zap.ErrorLevel))
+	tracker := server.NewTrackerService("nakama")
+	coalescer := server.NewRuntimePresenceCoalescer(logger, r, tracker, 50*time.Millisecond)
+	defer coalescer.Stop()
+	tracker.AddDiffListener(coalescer.HandleDiff)
+
+	// A flapping client connects, disconnects, and connects again within the window.
+	userID := uuid.NewV4()
+	topic := "notifications:" + userID.String()
+	first := uuid.NewV4()
+	tracker.Track(first, topic, userID, server.PresenceMeta{Handle: "alice"})
+	tracker.Untrack(first, topic, userID)
+	tracker.Track(uuid.NewV4(), topic, userID, server.PresenceMeta{Handle: "alice"})
+
+	time.Sleep(200 * time.Millisecond)
+
+	fn := r.GetRuntimeCallback(server.RPC, "status")
+	result, err := r.InvokeFunctionRPC(fn, uuid.Nil, "", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != `{"count":1,"last":{"online":true,"session_count":1,"updates":3}}` {
+		t.Error("Expected one coalesced presence delivery", string(result))
+	}
+}
+
+func TestRuntimeEval(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	c := server.NewRuntimeConfig()
+	c.EvalTimeoutMs = 50
+	c.EvalInstructionCap = 0
+	r, err := newRuntimeWithConfig(c)
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]interface{}{"player": map[string]interface{}{"level": 12}}
+	result, err := r.Eval("player.level >= 10", env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != true {
+		t.Error("Invalid eval result", result)
+	}
+
+	result, err = r.Eval("local total = 0 for i = 1, player.level do total = total + i end return total", env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != float64(78) {
+		t.Error("Invalid eval result", result)
+	}
+
+	for _, code := range []string{"os.exit()", "io.open('/etc/passwd')", "require('nakama')", "loadstring('return 1')()"} {
+		if _, err := r.Eval(code, nil); err == nil {
+			t.Error("Sandboxed eval allowed", code)
+		}
+	}
+
+	if _, err := r.Eval("while true do end", nil); err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Error("Eval was not interrupted by the timeout", err)
+	}
+
+	// Library calls cannot build strings large enough to exhaust memory in a single instruction.
+	for _, code := range []string{"string.rep('x', 2^31)", "('x'):rep(2^31)", "string.format('%999999999d', 1)", "table.concat({string.rep('x', 1024 * 1024), 'x'})", "string.gsub('x', 'x', 'xx')"} {
+		if _, err := r.Eval(code, nil); err == nil {
+			t.Error("Sandboxed eval built an unbounded string", code)
+		}
+	}
+	if result, err = r.Eval("string.format('%5.2f', 1) .. string.rep('ab', 2) .. table.concat({'c', 'd'}, ',')", nil); err != nil || result != " 1.00ababc,d" {
+		t.Error("Invalid eval result", result, err)
+	}
+
+	// The global table is not reachable, and results that contain themselves are rejected rather than converted.
+	if result, err = r.Eval("return _G", nil); err != nil || result != nil {
+		t.Error("Sandboxed eval reached the global table", result, err)
+	}
+	for _, code := range []string{"local t = {} t.self = t return t", "local t = {} t[1] = t return t", "local t = {} local c = t for i = 1, 100 do c.next = {} c = c.next end return t"} {
+		if _, err := r.Eval(code, nil); err != server.ErrConversionDepth {
+			t.Error("Expected eval result to be rejected", code, err)
+		}
+	}
+}
+
+func TestRuntimeEvalInstructionCap(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	c := server.NewRuntimeConfig()
+	c.EvalTimeoutMs = 0
+	c.EvalInstructionCap = 1000
+	r, err := newRuntimeWithConfig(c)
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.Eval("while true do end", nil); err != server.ErrEvalInstructionCap {
+		t.Error("Eval was not stopped by the instruction cap", err)
+	}
+	result, err := r.Eval("return 1 + 1", nil)
+	if err != nil || result != float64(2) {
+		t.Error("Eval under the instruction cap failed", result, err)
+	}
+}
+
+func TestRuntimeEvalNoTimeout(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	c := server.NewRuntimeConfig()
+	c.EvalTimeoutMs = 0
+	r, err := newRuntimeWithConfig(c)
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := r.Eval("return 1 + 1", nil)
+	if err != nil {
+		t.Fatal("Eval failed without a timeout", err)
+	}
+	if result != float64(2) {
+		t.Error("Invalid eval result", result)
+	}
+}
+
+func TestRuntimeRegisterFriendPresence(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("friend-presence.lua", `
+local nk = require("nakama")
+
+local function friend_presence(ctx, change)
+  if not change.online then
+    return nil
+  end
+  local visible = {}
+  for _, f in ipairs(change.friends) do
+    if f.handle ~= "hidden" then
+      table.insert(visible, f.user_id)
+    end
+  end
+  table.insert(visible, "not-a-friend")
+  return visible
+end
+nk.register_friend_presence(friend_presence)
+`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uid := uuid.NewV4()
+	visible := &server.User{Id: uuid.NewV4().Bytes(), Handle: "visible"}
+	hidden := &server.User{Id: uuid.NewV4().Bytes(), Handle: "hidden"}
+	friends := []*server.User{visible, hidden}
+
+	ids, err := r.InvokeFunctionFriendPresence(uid, true, friends)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || !bytes.Equal(ids[0].Bytes(), visible.Id) {
+		t.Error("Invalid friends notified when online", ids)
+	}
+
+	ids, err = r.InvokeFunctionFriendPresence(uid, false, friends)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 {
+		t.Error("Invalid friends notified when offline", ids)
+	}
+}
+
+func TestRuntimeMatchLabel(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("match-label.lua", `
+local nk = require("nakama")
+
+local match = {}
+function match.match_init(ctx, params)
+	return {}, 30, "in lobby"
+end
+function match.match_loop(ctx, state, tick, messages)
+	if tick == 2 then
+		nk.match_label_update(ctx.match_id, "in progress")
+	end
+	return state
+end
+nk.register_match(match, "label")
+
+local function list(ctx, payload)
+	local matches = nk.match_list(10, payload)
+	if #matches == 0 then
+		return ""
+	end
+	return matches[1].label
+end
+nk.register_rpc(list, "list")
+`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matchID, err := r.CreateMatch("label", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mh := r.MatchGet(matchID); mh == nil || mh.Label() != "in lobby" {
+		t.Fatal("Match label was not set by match_init")
+	}
+
+	fn := r.GetRuntimeCallback(server.RPC, "list")
+	deadline := time.Now().Add(time.Second)
+	for {
+		result, err := r.InvokeFunctionRPC(fn, uuid.Nil, "", 0, []byte("in progress"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(result) == "in progress" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Match label update was not listed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := r.MatchLabelUpdate(matchID, "bad\nlabel"); err == nil {
+		t.Error("Match label with control chars was accepted")
+	}
+	if err := r.MatchLabelUpdate(matchID, strings.Repeat("a", 2049)); err == nil {
+		t.Error("Oversized match label was accepted")
+	}
+}
+
+type pushMessageRouter struct {
+	pushes chan *server.RpcPush
+}
+
+func (p *pushMessageRouter) Send(logger *zap.Logger, ps []server.Presence, msg proto.Message) {
+	if envelope, ok := msg.(*server.Envelope); ok && envelope.GetRpcPush() != nil {
+		p.pushes <- envelope.GetRpcPush()
+	}
+}
+
+func TestRuntimePushToUserBuffered(t *testing.T) {
+	logger, _ := zap.NewDevelopment(zap.AddStacktrace(zap.ErrorLevel))
+	tracker := server.NewTrackerService("nakama")
+	router := &pushMessageRouter{pushes: make(chan *server.RpcPush, 4)}
+	pushService := server.NewPushService(logger, tracker, router, server.NewRuntimeConfig())
+	tracker.AddDiffListener(pushService.HandleDiff)
+
+	uid := uuid.NewV4()
+	if pushService.Push(uid, "dropped", []byte("{}"), false) {
+		t.Error("Push to an offline user was delivered")
+	}
+	if pushService.Push(uid, "buffered", []byte(`{"result":1}`), true) {
+		t.Error("Push to an offline user was delivered")
+	}
+
+	tracker.Track(uuid.NewV4(), "notifications:"+uid.String(), uid, server.PresenceMeta{})
+	select {
+	case push := <-router.pushes:
+		if push.Id != "buffered" || string(push.Payload) != `{"result":1}` {
+			t.Error("Invalid buffered push delivered", push)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Buffered push was not delivered when the user connected")
+	}
+
+	if !pushService.Push(uid, "live", nil, false) {
+		t.Error("Push to an online user was not delivered")
+	}
+	if push := <-router.pushes; push.Id != "live" {
+		t.Error("Invalid live push delivered", push)
+	}
+}
+
+func TestRuntimeRegisterTopicJoin(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("topic-join.lua", `
+local nk = require("nakama")
+
+local function topic_join(ctx, topic)
+  if topic.type == "room" and topic.room == "vip" then
+    return {allow = false, reason = "VIP members only"}
+  elseif topic.type == "room" and topic.room == "quiet" then
+    return {muted = true}
+  end
+  return nil
+end
+nk.register_topic_join(topic_join)
+`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uid := uuid.NewV4()
+	allow, muted, reason, err := r.InvokeFunctionTopicJoin(uid, "bob", 0, map[string]interface{}{"type": "room", "room": "vip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allow || reason != "VIP members only" {
+		t.Error("Topic join was not rejected with the reason", allow, reason)
+	}
+
+	allow, muted, _, err = r.InvokeFunctionTopicJoin(uid, "bob", 0, map[string]interface{}{"type": "room", "room": "quiet"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !allow || !muted {
+		t.Error("Topic join was not allowed muted", allow, muted)
+	}
+
+	allow, muted, _, err = r.InvokeFunctionTopicJoin(uid, "bob", 0, map[string]interface{}{"type": "group", "group_id": uuid.NewV4().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !allow || muted {
+		t.Error("Topic join was not allowed", allow, muted)
+	}
+}
+
+func TestRuntimeRegisterLeaderboardRecords(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("leaderboard-records.lua", `
+local nk = require("nakama")
+
+local function leaderboard_records(ctx, records)
+  for _, record in ipairs(records) do
+    if record.owner then
+      record.handle = record.owner.handle
+      record.metadata = {avatar_url = record.owner.avatar_url}
+    end
+  end
+  return records
+end
+nk.register_leaderboard_records(leaderboard_records)
+`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.IsRuntimeLeaderboardRecordsRegistered() {
+		t.Fatal("Leaderboard records function was not registered")
+	}
+
+	known := uuid.NewV4()
+	unknown := uuid.NewV4()
+	records := []*server.LeaderboardRecord{
+		{OwnerId: known.Bytes(), Handle: "old-handle", Score: 10},
+		{OwnerId: unknown.Bytes(), Handle: "gone", Score: 5},
+	}
+	owners := map[string]*server.User{
+		string(known.Bytes()): {Id: known.Bytes(), Handle: "new-handle", AvatarUrl: "https://example.com/a.png"},
+	}
+	if err = r.InvokeFunctionLeaderboardRecords(uuid.NewV4(), "bob", 0, records, owners); err != nil {
+		t.Fatal(err)
+	}
+
+	if records[0].Handle != "new-handle" || string(records[0].Metadata) != `{"avatar_url":"https://example.com/a.png"}` {
+		t.Error("Record was not decorated with owner data", records[0].Handle, string(records[0].Metadata))
+	}
+	if records[0].Score != 10 {
+		t.Error("Record score was changed", records[0].Score)
+	}
+	if records[1].Handle != "gone" {
+		t.Error("Record without an owner was changed", records[1].Handle)
+	}
+}
+
+func TestRuntimeBeforeHookPurchaseValidate(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("purchase-validate.lua", `
+local nk = require("nakama")
+
+local function validate(ctx, envelope)
+  if ctx.purchase_store ~= "apple" or ctx.purchase_receipt ~= "valid-receipt" then
+    error("receipt rejected by store")
+  end
+  local grants = {
+    {Bucket = "mygame", Collection = "inventory", Record = ctx.purchase_product_id, UserId = nil, Value = "{\"count\": 100}"}
+  }
+  return envelope, grants
+end
+nk.register_before(validate, "PurchaseValidate")
+`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jsonpbMarshaler := &jsonpb.Marshaler{EnumsAsInts: true}
+	jsonpbUnmarshaler := &jsonpb.Unmarshaler{}
+	envelope := &server.Envelope{
+		CollationId: "123",
+		Payload: &server.Envelope_PurchaseValidate{PurchaseValidate: &server.TPurchaseValidate{
+			Store:     "apple",
+			ProductId: "gems_100",
+			Receipt:   "valid-receipt",
+		}},
+	}
+	_, grants, _, err := server.RuntimeBeforeHook(r, jsonpbMarshaler, jsonpbUnmarshaler, "PurchaseValidate", envelope, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(grants) != 1 || grants[0].Record != "gems_100" {
+		t.Error("Purchase grants were not returned", grants)
+	}
+
+	envelope.GetPurchaseValidate().Receipt = "forged-receipt"
+	if _, _, _, err = server.RuntimeBeforeHook(r, jsonpbMarshaler, jsonpbUnmarshaler, "PurchaseValidate", envelope, nil); err == nil {
+		t.Error("Invalid receipt should be rejected")
+	}
+}
+
+func TestRuntimeBeforeHookTrace(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("before-trace.lua", `
+local nk = require("nakama")
+
+local function traced(ctx, envelope)
+  nk.logger_info("inside a traced hook")
+  return envelope
+end
+nk.register_before(traced, "SelfFetch")
+`)
+
+	var mu sync.Mutex
+	spans := make([]map[string]interface{}, 0)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var batch struct {
+			Spans []map[string]interface{} `json:"spans"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&batch); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		spans = append(spans, batch.Spans...)
+		mu.Unlock()
+	}))
+	defer collector.Close()
+
+	config := server.NewRuntimeConfig()
+	config.TraceEndpoint = collector.URL
+	r, err := newRuntimeWithConfig(config)
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	envelope := &server.Envelope{
+		CollationId: "123",
+		Payload:     &server.Envelope_SelfFetch{SelfFetch: &server.TSelfFetch{}},
+	}
+	if _, _, _, err = server.RuntimeBeforeHook(r, &jsonpb.Marshaler{EnumsAsInts: true}, &jsonpb.Unmarshaler{}, "SelfFetch", envelope, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 30; i++ {
+		mu.Lock()
+		n := len(spans)
+		mu.Unlock()
+		if n >= 2 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(spans) != 2 {
+		t.Fatal("Expected a hook span and a runtime call span", spans)
+	}
+	child, root := spans[0], spans[1]
+	if root["name"] != "runtime.before" || root["status"] != "ok" {
+		t.Error("Hook span was not exported", root)
+	}
+	if attributes, _ := root["attributes"].(map[string]interface{}); attributes["message_type"] != "SelfFetch" {
+		t.Error("Hook span is missing the message type", root)
+	}
+	if child["name"] != "nakama.logger_info" || child["parent_span_id"] != root["span_id"] || child["trace_id"] != root["trace_id"] {
+		t.Error("Runtime call span is not a child of the hook span", child)
+	}
+}
+
+func TestRuntimeTracerStopInFlight(t *testing.T) {
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer collector.Close()
+
+	tracer := server.NewRuntimeTracer(zap.NewNop(), collector.URL)
+	span := tracer.Start(nil, "runtime.before", nil)
+	tracer.Stop()
+	tracer.Stop()
+
+	// Spans still running when the tracer stops are dropped when they end.
+	span.End(nil)
+}
+
+func TestRuntimeBeforeHookFallback(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("before-fallback.lua", `
+local nk = require("nakama")
+
+local function enrich(ctx, envelope)
+  error("enrichment service unavailable")
+end
+local function degrade(ctx, envelope)
+  envelope.collationId = "degraded"
+  return envelope
+end
+nk.register_before(enrich, "SelfFetch")
+nk.register_before_fallback(degrade, "SelfFetch")
+
+nk.register_before(enrich, "SelfUpdate")
+nk.register_before_fallback(function(ctx, envelope) error("fallback failed") end, "SelfUpdate")
+
+nk.register_before(function(ctx, envelope) error({handle = "Handle is taken"}) end, "FriendsList")
+nk.register_before_fallback(degrade, "FriendsList")
+`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jsonpbMarshaler := &jsonpb.Marshaler{EnumsAsInts: true}
+	jsonpbUnmarshaler := &jsonpb.Unmarshaler{}
+	envelope := &server.Envelope{
+		CollationId: "123",
+		Payload:     &server.Envelope_SelfFetch{SelfFetch: &server.TSelfFetch{}},
+	}
+	result, _, _, err := server.RuntimeBeforeHook(r, jsonpbMarshaler, jsonpbUnmarshaler, "SelfFetch", envelope, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.CollationId != "degraded" {
+		t.Error("Fallback result was not used", result.CollationId)
+	}
+
+	envelope = &server.Envelope{
+		CollationId: "123",
+		Payload:     &server.Envelope_SelfUpdate{SelfUpdate: &server.TSelfUpdate{}},
+	}
+	_, _, _, err = server.RuntimeBeforeHook(r, jsonpbMarshaler, jsonpbUnmarshaler, "SelfUpdate", envelope, nil)
+	if err == nil || !strings.Contains(err.Error(), "fallback failed") {
+		t.Error("Fallback error was not returned", err)
+	}
+
+	envelope = &server.Envelope{
+		CollationId: "123",
+		Payload:     &server.Envelope_FriendsList{FriendsList: &server.TFriendsList{}},
+	}
+	_, _, _, err = server.RuntimeBeforeHook(r, jsonpbMarshaler, jsonpbUnmarshaler, "FriendsList", envelope, nil)
+	if _, ok := err.(*server.RuntimeValidationError); !ok {
+		t.Error("Validation error was not returned", err)
+	}
+}
+
+func TestRuntimeRegisterGroupsList(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("groups-list.lua", `
+local nk = require("nakama")
+
+local function groups_list(ctx, groups)
+  local result = {}
+  for _, group in ipairs(groups) do
+    if not group.private then
+      table.insert(result, group)
+    end
+  end
+  table.sort(result, function(a, b) return a.updated_at > b.updated_at end)
+  table.insert(result, {id = "not-in-page"})
+  return result
+end
+nk.register_groups_list(groups_list)
+`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	groups := []*server.Group{
+		{Id: uuid.NewV4().Bytes(), Name: "old", UpdatedAt: 1},
+		{Id: uuid.NewV4().Bytes(), Name: "secret", Private: true, UpdatedAt: 3},
+		{Id: uuid.NewV4().Bytes(), Name: "active", UpdatedAt: 2},
+	}
+	result, err := r.InvokeFunctionGroupsList(uuid.NewV4(), "bob", 0, groups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 2 || result[0].Name != "active" || result[1].Name != "old" {
+		t.Error("Groups were not filtered and reordered", result)
+	}
+}
+
+type leaderboardMessageRouter struct {
+	sends chan []server.Presence
+}
+
+func (r *leaderboardMessageRouter) Send(logger *zap.Logger, ps []server.Presence, msg proto.Message) {
+	if envelope, ok := msg.(*server.Envelope); ok && envelope.GetLeaderboardRecordUpdate() != nil {
+		r.sends <- ps
+	}
+}
+
+func TestRuntimeLeaderboardRecordStream(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("leaderboard-record-update.lua", `
+local nk = require("nakama")
+
+local function leaderboard_record_update(ctx, update)
+  if update.record.rank > 100 then
+    return {}
+  end
+  local recipients = {}
+  for _, s in ipairs(update.subscribers) do
+    if s.handle ~= "spectator" then
+      table.insert(recipients, s.session_id)
+    end
+  end
+  return recipients
+end
+nk.register_leaderboard_record_update(leaderboard_record_update)
+`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger, _ := zap.NewDevelopment(zap.AddStacktrace(zap.ErrorLevel))
+	tracker := server.NewTrackerService("nakama")
+	router := &leaderboardMessageRouter{sends: make(chan []server.Presence, 4)}
+
+	player := uuid.NewV4()
+	playerSession := uuid.NewV4()
+	tracker.Track(playerSession, "leaderboard:weekly", player, server.PresenceMeta{Handle: "player"})
+	tracker.Track(uuid.NewV4(), "leaderboard:weekly", uuid.NewV4(), server.PresenceMeta{Handle: "spectator"})
+
+	server.StreamLeaderboardRecord(logger, r, tracker, router, &server.LeaderboardRecord{LeaderboardId: []byte("weekly"), OwnerId: player.Bytes(), Rank: 500})
+	server.StreamLeaderboardRecord(logger, r, tracker, router, &server.LeaderboardRecord{LeaderboardId: []byte("weekly"), OwnerId: player.Bytes(), Rank: 10})
+	select {
+	case ps := <-router.sends:
+		if len(ps) != 1 || ps[0].ID.SessionID != playerSession {
+			t.Error("Leaderboard record update was not filtered to the picked subscribers", ps)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Leaderboard record update was not sent")
+	}
+	select {
+	case ps := <-router.sends:
+		t.Error("Leaderboard record update outside the top 100 was sent", ps)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	stream := &server.StreamDescriptor{Mode: "leaderboard", Subject: "weekly"}
+	if topic, err := stream.Topic(); err != nil || topic != "leaderboard:weekly" {
+		t.Error("Invalid leaderboard stream topic", topic, err)
+	}
+}
+
+func TestRuntimeRegisterSessionNode(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("session-node.lua", `
+local nakama = require("nakama")
+nakama.register_session_node(function(ctx, cluster)
+	if ctx.execution_mode ~= "session_node" or ctx.user_handle == "local" then
+		return nil
+	end
+	if ctx.user_handle == "lost" then
+		return "missing"
+	end
+	return cluster.nodes[2]
+end)
+	`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Error(err)
+	}
+
+	logger, _ := zap.NewDevelopment(zap.AddStacktrace(zap.ErrorLevel))
+	nodes := server.NewStaticClusterNodes("nakama1", map[string]string{"nakama1": "127.0.0.1:7350", "nakama2": "127.0.0.2:7350"})
+	node, err := r.InvokeFunctionSessionNode(uuid.NewV4(), "remote", 0, nodes.Self(), nodes.Names())
+	if err != nil {
+		t.Error(err)
+	}
+	if node != "nakama2" {
+		t.Error("Invocation failed. Return result not expected", node)
+	}
+
+	if node, address := server.RuntimeSessionNodeHook(logger, r, nodes, uuid.NewV4(), "remote", 0); node != "nakama2" || address != "127.0.0.2:7350" {
+		t.Error("Expected session redirected to nakama2", node, address)
+	}
+	if _, address := server.RuntimeSessionNodeHook(logger, r, nodes, uuid.NewV4(), "local", 0); address != "" {
+		t.Error("Expected session kept on nakama1", address)
+	}
+	if _, address := server.RuntimeSessionNodeHook(logger, r, nodes, uuid.NewV4(), "lost", 0); address != "" {
+		t.Error("Expected session with unknown node kept on nakama1", address)
+	}
+}
+
+func TestRuntimeRegisterMessageTranslate(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+
+	var mu sync.Mutex
+	requests := 0
+	translator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		if req.URL.Query().Get("locale") != "fr" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("{\"text\":\"bonjour\"}"))
+	}))
+	defer translator.Close()
+
+	writeFile("message-translate.lua", `
+local nk = require("nakama")
+local nkx = require("nakamax")
+nk.register_message_translate(function(ctx, message)
+	assert(ctx.execution_mode == "message_translate", "unexpected execution mode")
+	assert(message.room == "lobby", "unexpected room")
+	local status, headers, body = nkx.http_request("`+translator.URL+`/?locale=" .. message.locale, "POST", {}, message.data)
+	if status ~= 200 then
+		return nil
+	end
+	return body
+end)
+	`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, _ := zap.NewDevelopment(zap.AddStacktrace(zap.ErrorLevel))
+
+	topic := &server.TopicId{Id: &server.TopicId_Room{Room: []byte("lobby")}}
+	data := []byte("{\"text\":\"hello\"}")
+	for i := 0; i < 2; i++ {
+		translated := server.RuntimeMessageTranslateHook(logger, r, uuid.NewV4(), "sender", 0, topic, data, "fr")
+		if string(translated) != "{\"text\":\"bonjour\"}" {
+			t.Error("Expected translated message", string(translated))
+		}
+	}
+	if requests != 1 {
+		t.Error("Expected translation to be cached", requests)
+	}
+
+	if translated := server.RuntimeMessageTranslateHook(logger, r, uuid.NewV4(), "sender", 0, topic, data, "de"); string(translated) != string(data) {
+		t.Error("Expected original message when translation fails", string(translated))
+	}
+}
+
+func TestRuntimeRegisterAssetURL(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("asset-url.lua", `
+local nk = require("nakama")
+local nkx = require("nakamax")
+nk.register_asset_url(function(ctx, reference)
+	assert(ctx.execution_mode == "asset_url", "unexpected execution mode")
+	if reference == "public.png" then
+		return nil
+	elseif reference == "once.png" then
+		return "https://cdn.example.com/once.png?sig=" .. nkx.uuid_v4()
+	end
+	return "https://cdn.example.com/" .. reference .. "?sig=" .. nkx.uuid_v4(), 3600
+end)
+	`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, _ := zap.NewDevelopment(zap.AddStacktrace(zap.ErrorLevel))
+
+	uid := uuid.NewV4()
+	signed := server.RuntimeAssetURLHook(logger, r, uid, "user", 0, "avatar.png")
+	if !strings.HasPrefix(signed, "https://cdn.example.com/avatar.png?sig=") {
+		t.Error("Expected signed URL", signed)
+	}
+	if cached := server.RuntimeAssetURLHook(logger, r, uid, "user", 0, "avatar.png"); cached != signed {
+		t.Error("Expected signed URL to be cached while valid", cached, signed)
+	}
+	if once := server.RuntimeAssetURLHook(logger, r, uid, "user", 0, "once.png"); once == server.RuntimeAssetURLHook(logger, r, uid, "user", 0, "once.png") {
+		t.Error("Expected URL without validity not to be cached", once)
+	}
+	if public := server.RuntimeAssetURLHook(logger, r, uid, "user", 0, "public.png"); public != "public.png" {
+		t.Error("Expected reference kept when the function abstains", public)
+	}
+}
+
+func TestRuntimeSecureRandomVerify(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("secure-random.lua", `
+local nk = require("nakama")
+local random = nk.secure_random(16)
+assert(#random == 32, "expected 16 hex encoded bytes")
+assert(random ~= nk.secure_random(16), "expected random bytes to differ")
+
+-- sha256 of the seed "seed".
+local commitment = "19b25856e1c150ca834cffc8b59b23adbd0ec0389e58eb22b3b64768098d002b"
+local seed = "73656564"
+local rolls = nk.rng_verify(commitment, seed, "client", 6, 3)
+assert(#rolls == 3, "expected 3 rolls")
+for _, roll in ipairs(rolls) do
+	assert(roll >= 1 and roll <= 6, "expected rolls of a 6 sided die")
+end
+local again = nk.rng_verify(commitment, seed, "client", 6, 3)
+for i = 1, 3 do
+	assert(rolls[i] == again[i], "expected rolls to be deterministic")
+end
+assert(nk.rng_verify(commitment, "00", "client", 6, 3) == nil, "expected seed not matching commitment to fail")
+	`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRuntimeMatchJoinLimit(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("match-join-limit.lua", `
+local nk = require("nakama")
+
+nk.register_match_join(function(ctx, join)
+  if join.match_count >= 2 then
+    return false
+  end
+  return nil
+end)
+`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userID := uuid.NewV4()
+	if _, err = server.RuntimeMatchJoinHookWithCount(zap.NewNop(), r, userID, uuid.NewV4(), "player", 0, uuid.NewV4(), 1, 0); err != nil {
+		t.Error("Expected join under the limit to be allowed", err)
+	}
+	if _, err = server.RuntimeMatchJoinHookWithCount(zap.NewNop(), r, userID, uuid.NewV4(), "player", 0, uuid.NewV4(), 2, 0); err != server.ErrMatchJoinRejected {
+		t.Error("Expected join at the limit to be rejected", err)
+	}
+
+	tracker := server.NewTrackerService("nakama")
+	tracker.Track(uuid.NewV4(), "match:a", userID, server.PresenceMeta{})
+	tracker.Track(uuid.NewV4(), "match:b", userID, server.PresenceMeta{})
+	tracker.Track(uuid.NewV4(), "match:a", uuid.NewV4(), server.PresenceMeta{})
+	if ps := tracker.ListByUser(userID); len(ps) != 2 {
+		t.Error("Expected presences of the user across sessions", len(ps))
+	}
+}
+
+func TestRuntimeRegisterUserDataDelete(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("user-data-delete.lua", `
+local nk = require("nakama")
+nk.register_user_data_delete(function(ctx, user_id)
+	assert(ctx.execution_mode == "user_data_delete", "unexpected execution mode")
+	assert(ctx.user_id == user_id, "unexpected user ID")
+	error("analytics unavailable")
+end, "before")
+	`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = r.DeleteUserData(uuid.NewV4())
+	if err == nil || !strings.Contains(err.Error(), "analytics unavailable") {
+		t.Error("Expected deletion abandoned when the before function fails", err)
+	}
+}
+
+func TestRuntimeMatchListVisible(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("match-list.lua", `
+local nk = require("nakama")
+
+local match = {}
+function match.match_init(ctx, params)
+	return {}, 30, params.region
+end
+function match.match_loop(ctx, state, tick, messages)
+	return state
+end
+nk.register_match(match, "region")
+
+nk.register_match_list(function(ctx, matches)
+	assert(ctx.execution_mode == "match_list", "unexpected execution mode")
+	local visible = {}
+	for _, m in ipairs(matches) do
+		if m.label == "eu" then
+			table.insert(visible, m)
+		end
+	end
+	return visible
+end)
+`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, region := range []string{"eu", "us", "eu"} {
+		if _, err := r.CreateMatch("region", map[string]interface{}{"region": region}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	matches, total, err := r.MatchListVisible(uuid.NewV4(), 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].Label() != "eu" || total != 2 {
+		t.Error("Expected one of two visible matches", len(matches), total)
+	}
+
+	if _, total, _ = r.MatchListVisible(uuid.Nil, 10, ""); total != 3 {
+		t.Error("Expected all matches visible without a user", total)
+	}
+}
+
+func TestRuntimeRegisterPresenceRegion(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	os.MkdirAll(DATA_PATH, os.ModePerm)
+	geoIPPath := filepath.Join(DATA_PATH, "geoip.csv")
+	ioutil.WriteFile(geoIPPath, []byte("203.0.113.0/24,IE,eu-west,53.3,-6.2\n203.0.113.128/25,GB,eu-north\n2001:db8::/32,US,us-east\n"), 0644)
+	writeFile("presence-region.lua", `
+local nk = require("nakama")
+assert(nk.geoip_lookup("2001:db8::1").region == "us-east", "expected IPv6 lookup")
+assert(nk.geoip_lookup("198.51.100.1") == nil, "expected no record")
+nk.register_presence_region(function(ctx, connection)
+	assert(ctx.execution_mode == "presence_region", "unexpected execution mode")
+	if connection.geoip == nil then
+		return nil
+	end
+	return {region = connection.geoip.region, ip = connection.ip}
+end)
+	`)
+
+	c := server.NewRuntimeConfig()
+	c.GeoIPPath = geoIPPath
+	r, err := newRuntimeWithConfig(c)
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, _ := zap.NewDevelopment(zap.AddStacktrace(zap.ErrorLevel))
+
+	uid := uuid.NewV4()
+	if region := server.RuntimePresenceRegionHook(logger, r, uid, "user", 0, "203.0.113.7"); region != `{"ip":"203.0.113.7","region":"eu-west"}` {
+		t.Error("Invalid presence region", region)
+	}
+	if region := server.RuntimePresenceRegionHook(logger, r, uid, "user", 0, "203.0.113.200"); region != `{"ip":"203.0.113.200","region":"eu-north"}` {
+		t.Error("Expected the most specific network", region)
+	}
+	if region := server.RuntimePresenceRegionHook(logger, r, uid, "user", 0, "198.51.100.1"); region != "" {
+		t.Error("Expected no region when the function abstains", region)
+	}
+}
+
+func TestRuntimeMatchState(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("match-state.lua", `
+local nk = require("nakama")
+
+local match = {}
+function match.match_init(ctx, params)
+	return {score = 0}, 30, ""
+end
+function match.match_loop(ctx, state, tick, messages)
+	return state
+end
+nk.register_match(match, "state")
+
+local function bonus(ctx, payload)
+	local score = nk.match_state(payload, function(ctx, state)
+		state.score = state.score + 10
+		return state, state.score
+	end)
+	return tostring(score)
+end
+nk.register_rpc(bonus, "bonus")
+`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matchID, err := r.CreateMatch("state", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fn := r.GetRuntimeCallback(server.RPC, "bonus")
+	result, err := r.InvokeFunctionRPC(fn, uuid.Nil, "", 0, []byte(matchID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != "10" {
+		t.Error("Invalid match state function result", string(result))
+	}
+
+	score, err := r.MatchState(matchID, func(vm *lua.LState, ctx *lua.LTable, state lua.LValue) (lua.LValue, interface{}, error) {
+		return nil, float64(state.(*lua.LTable).RawGetString("score").(lua.LNumber)), nil
+	})
+	if err != nil || score != float64(10) {
+		t.Error("Expected match state kept between calls", score, err)
+	}
+
+	if _, err = r.MatchState(uuid.NewV4().String(), nil); err != server.ErrMatchNotFound {
+		t.Error("Expected unknown match to be rejected", err)
+	}
+}
+
+func TestRuntimeMatchStateCrossMatch(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("match-state-cross.lua", `
+local nk = require("nakama")
+
+-- Each match reads the other's state from its loop, which would leave both waiting on each other.
+local match = {}
+function match.match_init(ctx, params)
+	return {other = params.other, error = ""}, 30, ""
+end
+function match.match_loop(ctx, state, tick, messages)
+	if state.other ~= nil and state.error == "" then
+		local ok, err = pcall(nk.match_state, state.other, function(ctx, other)
+			return other, other.error
+		end)
+		state.error = ok and "none" or tostring(err)
+	end
+	return state
+end
+nk.register_match(match, "cross")
+`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := r.CreateMatch("cross", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := r.CreateMatch("cross", map[string]interface{}{"other": first})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.MatchState(first, func(vm *lua.LState, ctx *lua.LTable, state lua.LValue) (lua.LValue, interface{}, error) {
+		state.(*lua.LTable).RawSetString("other", lua.LString(second))
+		return state, nil, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, matchID := range []string{first, second} {
+		var result interface{}
+		for i := 0; i < 100 && (result == nil || result == ""); i++ {
+			time.Sleep(10 * time.Millisecond)
+			result, err = r.MatchState(matchID, func(vm *lua.LState, ctx *lua.LTable, state lua.LValue) (lua.LValue, interface{}, error) {
+				return nil, state.(*lua.LTable).RawGetString("error").String(), nil
+			})
+			if err != nil {
+				t.Fatal("Expected the match to keep running", err)
+			}
+		}
+		if s, _ := result.(string); !strings.Contains(s, "match_state cannot be called from inside a match") {
+			t.Error("Expected match_state to be rejected inside a match", matchID, result)
+		}
+	}
+}
+
+func TestRuntimeMatchJoinAttempt(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("match-join-attempt.lua", `
+local nk = require("nakama")
+
+local match = {match_roles = {player = 1, spectator = 2}}
+function match.match_init(ctx, params)
+	return {attempts = 0}, 30
+end
+function match.match_join_attempt(ctx, state, presence, role)
+	state.attempts = state.attempts + 1
+	if presence.handle == "mallory" then
+		return state, false
+	elseif presence.handle == "dave" then
+		return state, true, "spectator"
+	end
+	return state, true
+end
+function match.match_loop(ctx, state, tick, messages)
+	return state
+end
+nk.register_match(match, "join_attempt")
+`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matchID, err := r.CreateMatch("join_attempt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mh := r.MatchGet(matchID)
+
+	presence := func(handle string) server.Presence {
+		return server.Presence{ID: server.PresenceID{Node: "nakama", SessionID: uuid.NewV4()}, UserID: uuid.NewV4(), Meta: server.PresenceMeta{Handle: handle}}
+	}
+
+	alice := presence("alice")
+	if role, err := mh.JoinAttempt(alice, ""); err != nil || role != server.MatchRolePlayer {
+		t.Fatal("Expected first join to take the player place", role, err)
+	}
+	if _, err := mh.JoinAttempt(presence("bob"), server.MatchRolePlayer); err != server.ErrMatchFull {
+		t.Error("Expected join as player to be rejected when full", err)
+	}
+	if role, err := mh.JoinAttempt(presence("dave"), server.MatchRolePlayer); err != nil || role != server.MatchRoleSpectator {
+		t.Error("Expected join attempt function to assign spectator role", role, err)
+	}
+	if _, err := mh.JoinAttempt(presence("mallory"), server.MatchRoleSpectator); err != server.ErrMatchJoinRejected {
+		t.Error("Expected join attempt function to reject join", err)
+	}
+	if _, err := mh.JoinAttempt(presence("carol"), "referee"); err != server.ErrMatchRoleInvalid {
+		t.Error("Expected join in unknown role to be rejected", err)
+	}
+
+	mh.Leave([]server.Presence{alice})
+	if role, err := mh.JoinAttempt(presence("bob"), server.MatchRolePlayer); err != nil || role != server.MatchRolePlayer {
+		t.Error("Expected player place to be free after leave", role, err)
+	}
+
+	attempts, err := r.MatchState(matchID, func(vm *lua.LState, ctx *lua.LTable, state lua.LValue) (lua.LValue, interface{}, error) {
+		return nil, float64(state.(*lua.LTable).RawGetString("attempts").(lua.LNumber)), nil
+	})
+	if err != nil || attempts != float64(6) {
+		t.Error("Expected every join attempt to reach the match module", attempts, err)
+	}
+}
+
+func TestRuntimeRegisterMatchData(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("match-data.lua", `
+local nk = require("nakama")
+nk.register_match_data(function(ctx, message)
+	assert(ctx.execution_mode == "match_data", "unexpected execution mode")
+	local state = message.state
+	state.count = (state.count or 0) + 1
+	if message.op_code == 99 then
+		return nil
+	elseif state.count >= 3 then
+		return state, "kick"
+	end
+	return state
+end)
+	`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uid := uuid.NewV4()
+	matchID := uuid.NewV4()
+	message := map[string]interface{}{"match_id": matchID.String(), "op_code": int64(1), "data": "move"}
+	for i := 1; i <= 3; i++ {
+		action, err := r.InvokeFunctionMatchData(uid, "user", 0, matchID, message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < 3 && action != "" {
+			t.Error("Expected no action before the threshold", i, action)
+		} else if i == 3 && action != "kick" {
+			t.Error("Expected kick at the threshold", action)
+		}
+	}
+
+	// State is kept per match.
+	if action, err := r.InvokeFunctionMatchData(uid, "user", 0, uuid.NewV4(), message); err != nil {
+		t.Fatal(err)
+	} else if action != "" {
+		t.Error("Expected no action in another match", action)
+	}
+
+	// Returning nil clears the user's state.
+	message["op_code"] = int64(99)
+	if _, err := r.InvokeFunctionMatchData(uid, "user", 0, matchID, message); err != nil {
+		t.Fatal(err)
+	}
+	message["op_code"] = int64(1)
+	if action, err := r.InvokeFunctionMatchData(uid, "user", 0, matchID, message); err != nil {
+		t.Fatal(err)
+	} else if action != "" {
+		t.Error("Expected state to have been cleared", action)
+	}
+}
+
+func TestRuntimeRegisterStorageList(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("storage-list.lua", `
+local nk = require("nakama")
+local nx = require("nakamax")
+nk.register_storage_list(function(ctx, listing)
+	assert(ctx.execution_mode == "storage_list", "unexpected execution mode")
+	local records = listing.records
+	if listing.collection == "mismatch" then
+		return {{Collection = "other", Record = "stats", Value = "{}"}}
+	end
+	return {{Record = "stats", Value = nx.json_encode({count = #records, owner = records[1].UserId})}}
+end)
+	`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uid := uuid.NewV4()
+	data := []*server.StorageData{{Bucket: "b", Collection: "c", Record: "r", UserId: uid.Bytes(), Value: []byte("{}")}}
+	virtual, err := r.InvokeFunctionStorageList(uid, "user", 0, uid.Bytes(), "b", "c", 10, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(virtual) != 1 {
+		t.Fatal("Expected one virtual record", virtual)
+	}
+	v := virtual[0]
+	if v.Bucket != "b" || v.Collection != "c" || v.Record != "stats" || !bytes.Equal(v.UserId, uid.Bytes()) || v.PermissionWrite != 0 {
+		t.Error("Invalid virtual record", v)
+	}
+	if string(v.Value) != `{"count":1,"owner":"`+uid.String()+`"}` {
+		t.Error("Invalid virtual record value", string(v.Value))
+	}
+	if !bytes.Equal(data[0].UserId, uid.Bytes()) {
+		t.Error("Listed records were changed")
+	}
+
+	if _, err = r.InvokeFunctionStorageList(uid, "user", 0, uid.Bytes(), "b", "mismatch", 10, data); err == nil {
+		t.Error("Expected an error for a virtual record outside the listing")
+	}
+}
+
+func TestRuntimeRegisterStorageChange(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("storage-change.lua", `
+local nk = require("nakama")
+nk.register_storage_change(function(ctx, change)
+	assert(ctx.execution_mode == "storage_change", "unexpected execution mode")
+	if change.op == "remove" then
+		assert(change.before.count == 1 and change.after == nil, "unexpected remove values")
+		return false
+	end
+	assert(change.before == nil and change.after.count == 1, "unexpected write values")
+	assert(change.record == "r" and change.user_id ~= nil, "unexpected record")
+end, "b", "c")
+	`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uid := uuid.NewV4()
+	write := &server.StorageChange{Bucket: "b", Collection: "c", Record: "r", UserId: uid.Bytes(), Op: server.STORAGE_CHANGE_WRITE}
+	if err = r.InvokeFunctionStorageChange(write, nil, []byte(`{"count":1}`)); err != nil {
+		t.Error("Expected write to be delivered", err)
+	}
+	remove := &server.StorageChange{Bucket: "b", Collection: "c", Record: "r", UserId: uid.Bytes(), Op: server.STORAGE_CHANGE_REMOVE}
+	if err = r.InvokeFunctionStorageChange(remove, []byte(`{"count":1}`), nil); err == nil {
+		t.Error("Expected remove delivery to fail")
+	}
+	other := &server.StorageChange{Bucket: "b", Collection: "other", Record: "r", Op: server.STORAGE_CHANGE_REMOVE}
+	if err = r.InvokeFunctionStorageChange(other, nil, nil); err != nil {
+		t.Error("Expected change without a function to be dropped", err)
+	}
+}
+
+func TestRuntimeRegisterSessionDuplicate(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("session-duplicate.lua", `
+local nk = require("nakama")
+nk.register_session_duplicate(function(ctx, auth)
+	assert(ctx.execution_mode == "session_duplicate", "unexpected execution mode")
+	if auth.type ~= "AuthenticateRequest_Device" then
+		return nil
+	end
+	if #auth.sessions > 1 then
+		return "reject"
+	end
+	return "kick"
+end)
+	`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions := []*server.SessionInfo{{ID: uuid.NewV4(), UserID: uuid.NewV4(), CreatedAt: 1000, ClientIP: "10.0.0.1"}}
+	if policy, err := r.InvokeFunctionSessionDuplicate(sessions[0].UserID, "alice", "AuthenticateRequest_Device", "10.0.0.2", sessions); err != nil || policy != server.SESSION_DUPLICATE_KICK {
+		t.Error("Expected the old session to be kicked", policy, err)
+	}
+	sessions = append(sessions, &server.SessionInfo{ID: uuid.NewV4(), UserID: sessions[0].UserID, CreatedAt: 2000, ClientIP: "10.0.0.3"})
+	if policy, err := r.InvokeFunctionSessionDuplicate(sessions[0].UserID, "alice", "AuthenticateRequest_Device", "10.0.0.2", sessions); err != nil || policy != server.SESSION_DUPLICATE_REJECT {
+		t.Error("Expected the new session to be rejected", policy, err)
+	}
+	if policy, err := r.InvokeFunctionSessionDuplicate(sessions[0].UserID, "alice", "AuthenticateRequest_Email", "10.0.0.2", sessions); err != nil || policy != "" {
+		t.Error("Expected the configured policy to apply", policy, err)
+	}
+}
+
+func TestRuntimeRegisterInventoryGrant(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("inventory-grant.lua", `
+local nk = require("nakama")
+nk.register_inventory_grant(function(ctx, grant)
+	assert(ctx.execution_mode == "inventory_grant", "unexpected execution mode")
+	for _, item in ipairs(grant.items) do
+		if item.item_id == "potion" and item.owned + item.count > 10 then
+			return false, "potion cap reached"
+		end
+	end
+	return true
+end)
+	`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userID := uuid.NewV4()
+	if accepted, _, err := r.InvokeFunctionInventoryGrant(userID, []*server.InventoryItem{{ItemID: "potion", Count: 3, Owned: 7}}); err != nil || !accepted {
+		t.Error("Expected a grant up to the cap to be accepted", err)
+	}
+	accepted, reason, err := r.InvokeFunctionInventoryGrant(userID, []*server.InventoryItem{{ItemID: "sword", Count: 1, Unique: true}, {ItemID: "potion", Count: 4, Owned: 7}})
+	if err != nil || accepted || reason != "potion cap reached" {
+		t.Error("Expected a grant over the cap to be rejected", accepted, reason, err)
+	}
+}
+
+func TestRuntimeLeaderboardTieBreak(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	leaderboardID := uuid.NewV4().String()
+	writeFile("leaderboard-tie-break.lua", `
+local nk = require("nakama")
+nk.leaderboard_create("`+leaderboardID+`", "desc", "", {}, false)
+nk.register_leaderboard_tie_break(function(ctx, record)
+	assert(ctx.execution_mode == "leaderboard_tie_break", "unexpected execution mode")
+	if record.previous_score == record.score then
+		return nil
+	end
+	return record.updated_at
+end)
+	`)
+
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record := &server.LeaderboardRecord{LeaderboardId: []byte(leaderboardID), Score: 50, UpdatedAt: 1000}
+	if key, err := r.InvokeFunctionLeaderboardTieBreak(record, nil, 0); err != nil || key != 1000 {
+		t.Error("Expected a new record to be keyed by its update time", key, err)
+	}
+	record.UpdatedAt = 2000
+	if key, err := r.InvokeFunctionLeaderboardTieBreak(record, &server.LeaderboardRecord{Score: 50}, 1000); err != nil || key != 1000 {
+		t.Error("Expected an unchanged score to keep its key", key, err)
+	}
+
+	// Keys are stored negated on descending leaderboards. The earlier key ranks first, whatever the update times.
+	first, early, late := uuid.NewV4(), uuid.NewV4(), uuid.NewV4()
+	for _, record := range []struct {
+		ownerID   uuid.UUID
+		score     int64
+		tieBreak  int64
+		updatedAt int64
+	}{{first, 100, -5000, 1000}, {early, 50, -1000, 3000}, {late, 50, -2000, 2000}} {
+		_, err = db.Exec(`INSERT INTO leaderboard_record (id, leaderboard_id, owner_id, handle, lang, score, num_score, updated_at, updated_at_inverse, expires_at, tie_break)
+			VALUES ($1, $2, $3, $4, 'en', $5, 1, $6, $6, 0, $7)`,
+			uuid.NewV4().Bytes(), []byte(leaderboardID), record.ownerID.Bytes(), record.ownerID.String()[:20], record.score, record.updatedAt, record.tieBreak)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for ownerID, expected := range map[uuid.UUID]int64{first: 1, early: 2, late: 3} {
+		rank, _, err := r.LeaderboardRank(leaderboardID, ownerID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rank != expected {
+			t.Error("Invalid leaderboard rank", ownerID, rank, expected)
+		}
+	}
+}
+
+func TestRuntimeLeaderboardAggregate(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	eu, us, global := uuid.NewV4().String(), uuid.NewV4().String(), uuid.NewV4().String()
+	writeFile("leaderboard-aggregate.lua", `
+local nk = require("nakama")
+nk.leaderboard_create("`+eu+`", "desc", "", {}, false)
+nk.leaderboard_create("`+us+`", "desc", "", {}, false)
+nk.leaderboard_create("`+global+`", "desc", "", {}, true)
+	`)
+
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The traveller plays in both regions and must be counted once, with their best score.
+	traveller, local := uuid.NewV4(), uuid.NewV4()
+	for _, record := range []struct {
+		leaderboardID string
+		ownerID       uuid.UUID
+		score         int64
+	}{{eu, traveller, 80}, {us, traveller, 120}, {eu, local, 100}} {
+		_, err = db.Exec(`INSERT INTO leaderboard_record (id, leaderboard_id, owner_id, handle, lang, score, num_score, updated_at, updated_at_inverse, expires_at)
+			VALUES ($1, $2, $3, $4, 'en', $5, 1, 1000, 1000, 0)`,
+			uuid.NewV4().Bytes(), []byte(record.leaderboardID), record.ownerID.Bytes(), record.ownerID.String()[:20], record.score)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = r.LeaderboardAggregateRegister(eu, []string{us}); err == nil {
+		t.Error("Expected a non-authoritative aggregate to be rejected")
+	}
+	if err = r.LeaderboardAggregateRegister(global, []string{eu, us}); err != nil {
+		t.Fatal(err)
+	}
+
+	var count int
+	if err = db.QueryRow("SELECT count(*) FROM leaderboard_record WHERE leaderboard_id = $1", []byte(global)).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Error("Expected one aggregate record per owner", count)
+	}
+	for ownerID, expected := range map[uuid.UUID][]int64{traveller: {1, 120}, local: {2, 100}} {
+		rank, score, err := r.LeaderboardRank(global, ownerID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rank != expected[0] || score != expected[1] {
+			t.Error("Invalid aggregate leaderboard rank", ownerID, rank, score, expected)
+		}
+	}
+}
+
+func TestRuntimeActiveUsers(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = r.ActiveUsersRollup(); err != nil {
+		t.Fatal(err)
+	}
+	before, _, err := r.ActiveUsers(server.ACTIVE_USERS_WEEK)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reconnects on the same day count once. Activity is recorded in the background.
+	first, second := uuid.NewV4(), uuid.NewV4()
+	r.RecordActiveUser(first)
+	r.RecordActiveUser(first)
+	r.RecordActiveUser(second)
+	var count, day int64
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if err = r.ActiveUsersRollup(); err != nil {
+			t.Fatal(err)
+		}
+		if count, day, err = r.ActiveUsers(server.ACTIVE_USERS_WEEK); err != nil {
+			t.Fatal(err)
+		} else if count == before+2 {
+			break
+		}
+	}
+	if count != before+2 {
+		t.Error("Invalid weekly active users", count, before)
+	}
+	if day != time.Now().Unix()/86400 {
+		t.Error("Expected the latest rollup to be for today", day)
+	}
+	if _, _, err = r.ActiveUsers("year"); err != server.ErrActiveUsersWindow {
+		t.Error("Expected an unknown window to be rejected", err)
+	}
+}
+
+func TestRuntimeInventory(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("inventory.lua", `
+local nk = require("nakama")
+local nkx = require("nakamax")
+
+local user_id = nkx.uuid_v4()
+local items = nk.inventory_grant(user_id, {{item_id = "sword", unique = true}, {item_id = "potion", count = 2}})
+assert(#items == 2 and items[2].count == 2, "items should be granted")
+local _, reason = nk.inventory_grant(user_id, {{item_id = "sword", unique = true}})
+assert(reason ~= nil, "unique item should only be granted once")
+assert(not nk.inventory_consume(user_id, {potion = 1, sword = 2}), "consuming more than owned should fail")
+assert(#nk.inventory_list(user_id) == 2 and nk.inventory_list(user_id)[1].count == 2, "failed consume should change nothing")
+assert(nk.inventory_consume(user_id, {potion = 2}), "owned items should be consumed")
+assert(#nk.inventory_list(user_id) == 1, "used up stacks should be removed")
+	`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userID := uuid.NewV4()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := r.InventoryGrant(userID, []*server.InventoryItem{{ItemID: "coin", Count: 5}}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var mu sync.Mutex
+	consumed := 0
+	for i := 0; i < 15; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := r.InventoryConsume(userID, map[string]int64{"coin": 4})
+			if err == server.ErrInventoryInsufficient {
+				return
+			} else if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			consumed++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	// 50 coins cover 12 consumes of 4, leaving 2.
+	items, err := r.InventoryList(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if consumed != 12 || len(items) != 1 || items[0].Count != 2 {
+		t.Error("Invalid inventory after concurrent consumes", consumed, items)
+	}
+}
+
+func TestRuntimeTournament(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("tournament.lua", `
+local nk = require("nakama")
+
+local rounds = {}
+local winner = ""
+nk.register_tournament(function(ctx, event)
+	assert(ctx.execution_mode == "tournament", "unexpected execution mode")
+	table.insert(rounds, tostring(event.round))
+end, "round")
+nk.register_tournament(function(ctx, event)
+	winner = event.tournament.winner_id
+end, "end")
+
+local function status(ctx, payload)
+	return table.concat(rounds, ",") .. " " .. winner
+end
+nk.register_rpc(status, "status")
+	`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	id, err := r.TournamentCreate(&server.Tournament{Title: "Cup", Size: 4, StartAt: now - 1000, EndAt: now + 60000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeds := []uuid.UUID{uuid.NewV4(), uuid.NewV4(), uuid.NewV4()}
+	for i, userID := range seeds {
+		if err = r.TournamentJoin(id, userID, "user"+strconv.Itoa(i), int64(30-i*10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = r.TournamentSchedule(); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.TournamentJoin(id, uuid.NewV4(), "late", 0); err != server.ErrTournamentClosed {
+		t.Error("Expected joining a started tournament to be rejected", err)
+	}
+
+	// The best seed has a bye, the other two play in the first round.
+	bracket, err := r.TournamentGet(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bracket.Tournament.State != server.TOURNAMENT_STATE_RUNNING || len(bracket.Matches) != 2 || bracket.Matches[0].WinnerID != seeds[0] {
+		t.Fatal("Expected first round drawn with a bye for the top seed", bracket.Tournament, bracket.Matches)
+	}
+
+	if err = r.TournamentResult(id, seeds[2]); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.TournamentResult(id, seeds[1]); err != server.ErrTournamentNoMatch {
+		t.Error("Expected eliminated user to have no match", err)
+	}
+	if err = r.TournamentResult(id, seeds[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	bracket, err = r.TournamentGet(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bracket.Tournament.State != server.TOURNAMENT_STATE_COMPLETE || bracket.Tournament.WinnerID != seeds[0] || len(bracket.Matches) != 3 {
+		t.Error("Expected tournament complete with the final winner", bracket.Tournament, bracket.Matches)
+	}
+
+	result, err := r.InvokeFunctionRPC(r.GetRuntimeCallback(server.RPC, "status"), uuid.Nil, "", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != "1,2 "+seeds[0].String() {
+		t.Error("Expected tournament round and end functions to run", string(result))
+	}
+}
+
+func TestRuntimeTournamentJoinFee(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("tournament-join.lua", `
+local nk = require("nakama")
+nk.register_tournament(function(ctx, join)
+	assert(join.tournament.title == "Cup", "unexpected tournament")
+	if not join.inventory["ticket"] then
+		return false, "no ticket"
+	end
+	return true, {gold = 10}
+end, "join")
+	`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	id, err := r.TournamentCreate(&server.Tournament{Title: "Cup", Size: 4, StartAt: now + 60000, EndAt: now + 120000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	noTicket := uuid.NewV4()
+	if err = r.TournamentJoin(id, noTicket, "no-ticket", 0); err == nil || err.Error() != "Tournament join rejected: no ticket" {
+		t.Error("Expected join without a ticket to be rejected", err)
+	}
+
+	// The fee and the join commit or roll back together.
+	poor, rich := uuid.NewV4(), uuid.NewV4()
+	if _, err = r.InventoryGrant(poor, []*server.InventoryItem{{ItemID: "ticket", Count: 1}, {ItemID: "gold", Count: 5}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.InventoryGrant(rich, []*server.InventoryItem{{ItemID: "ticket", Count: 1}, {ItemID: "gold", Count: 15}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.TournamentJoin(id, poor, "poor", 0); err != server.ErrInventoryInsufficient {
+		t.Error("Expected join without the fee to fail", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err = r.TournamentJoin(id, rich, "rich", int64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bracket, err := r.TournamentGet(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bracket.Participants) != 1 || bracket.Participants[0].UserID != rich || bracket.Participants[0].Rating != 1 {
+		t.Error("Expected only the user who paid to join", bracket.Participants)
+	}
+	for userID, gold := range map[uuid.UUID]int64{poor: 5, rich: 5} {
+		items, err := r.InventoryList(userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != 2 || items[0].ItemID != "gold" || items[0].Count != gold {
+			t.Error("Expected the fee taken once from the user who joined", userID, items)
+		}
+	}
+}
+
+func TestRuntimeRegisterFriendRequest(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("friend-request.lua", `
+local nk = require("nakama")
+nk.register_friend_request(function(ctx, request)
+	assert(ctx.execution_mode == "friend_request", "unexpected execution mode")
+	if request.blocked then
+		return "drop"
+	elseif request.recent_requests >= 10 then
+		return "reject"
+	end
+	return nil
+end)
+	`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uid := uuid.NewV4()
+	target := uuid.NewV4()
+	for _, c := range []struct {
+		recent  int64
+		blocked bool
+		action  string
+	}{
+		{0, false, server.FRIEND_REQUEST_ALLOW},
+		{10, false, server.FRIEND_REQUEST_REJECT},
+		{0, true, server.FRIEND_REQUEST_DROP},
+	} {
+		action, err := r.InvokeFunctionFriendRequest(uid, "user", 0, target, c.recent, c.blocked)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if action != c.action {
+			t.Error("Unexpected friend request action", c.recent, c.blocked, action)
+		}
+	}
+
+	counter := server.NewFriendRequestCounter(60000)
+	counter.Add(target)
+	if recent := counter.Add(target); recent != 1 {
+		t.Error("Expected requests counted per target", recent)
+	}
+	if recent := counter.Add(uid); recent != 0 {
+		t.Error("Expected requests to other users counted apart", recent)
+	}
+}
+
+func TestRuntimeNodeLocalStore(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("node-local-store.lua", `
+local nk = require("nakama")
+
+assert(nk.node_local_get("phase") == nil, "unset key should be nil")
+nk.node_local_set("phase", "boss")
+assert(nk.node_local_get("phase") == "boss", "set value should be read")
+assert(nk.node_local_incr("kills") == 1, "missing counter should start at 0")
+assert(nk.node_local_incr("kills", 4) == 5, "counter should add delta")
+assert(not pcall(nk.node_local_incr, "phase"), "non integer value should not be incremented")
+	`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = r.NodeLocalSet("event", "open", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if value, ok, err := r.NodeLocalGet("event"); err != nil || !ok || value != "open" {
+		t.Error("Expected node-local value before TTL", value, ok, err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, ok, err := r.NodeLocalGet("event"); err != nil || ok {
+		t.Error("Expected node-local value to expire after TTL", err)
+	}
+	if value, ok, err := r.NodeLocalGet("kills"); err != nil || !ok || value != "5" {
+		t.Error("Expected runtime modules and Go to share values", value, ok, err)
+	}
+	if err = r.NodeLocalSet("", "value", 0); err != server.ErrNodeLocalKeyInvalid {
+		t.Error("Expected empty key to be rejected", err)
+	}
+}
+
+func TestRuntimeRegisterMatchCreate(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("match-create.lua", `
+local nk = require("nakama")
+nk.register_match_create(function(ctx, create)
+	assert(ctx.execution_mode == "match_create", "unexpected execution mode")
+	if create.module == "" then
+		return nil
+	end
+	local params = create.params
+	if params.map ~= "forest" and params.map ~= "desert" then
+		return false, "unknown map"
+	end
+	return { map = params.map, max_players = math.min(params.max_players or 8, 8) }
+end)
+	`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uid := uuid.NewV4()
+	params, accepted, _, err := r.InvokeFunctionMatchCreate(uid, "user", 0, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !accepted || params != nil {
+		t.Error("Expected relayed match params kept", accepted, params)
+	}
+
+	_, accepted, reason, err := r.InvokeFunctionMatchCreate(uid, "user", 0, "arena", map[string]interface{}{"map": "moon"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accepted || reason != "unknown map" {
+		t.Error("Expected match create rejected", accepted, reason)
+	}
+
+	params, accepted, _, err = r.InvokeFunctionMatchCreate(uid, "user", 0, "arena", map[string]interface{}{"map": "forest", "max_players": 32})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !accepted || params["map"] != "forest" || params["max_players"] != float64(8) {
+		t.Error("Expected sanitized match params", accepted, params)
+	}
+}
+
+func TestRuntimeRegisterNotificationDelivery(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("notification-delivery.lua", `
+local nk = require("nakama")
+nk.register_notification_delivery(function(ctx, notification)
+	assert(ctx.execution_mode == "notification_delivery", "unexpected execution mode")
+	local recipient = notification.recipient
+	if recipient == nil or notification.code < 100 then
+		return nil
+	end
+	local quiet_until = recipient.metadata.quiet_until
+	if quiet_until == nil then
+		return "deliver"
+	elseif notification.code >= 200 then
+		return "drop"
+	end
+	return "defer", quiet_until
+end)
+	`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.IsRuntimeNotificationDeliveryRegistered() {
+		t.Fatal("Notification delivery function was not registered")
+	}
+
+	quiet := map[string]interface{}{"timezone": "Europe/London", "utc_offset_ms": 0, "metadata": map[string]interface{}{"quiet_until": 5000}}
+	awake := map[string]interface{}{"timezone": "Europe/London", "utc_offset_ms": 0, "metadata": map[string]interface{}{}}
+	for _, c := range []struct {
+		code      int64
+		recipient map[string]interface{}
+		action    string
+		deliverAt int64
+	}{
+		{1, quiet, server.NOTIFICATION_DELIVER, 0},
+		{100, awake, server.NOTIFICATION_DELIVER, 0},
+		{100, quiet, server.NOTIFICATION_DEFER, 5000},
+		{200, quiet, server.NOTIFICATION_DROP, 0},
+		{100, nil, server.NOTIFICATION_DELIVER, 0},
+	} {
+		notification := &server.NNotification{UserID: uuid.NewV4().Bytes(), Subject: "reward", Content: []byte("{}"), Code: c.code}
+		action, deliverAt, err := r.InvokeFunctionNotificationDelivery(notification, c.recipient)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if action != c.action || deliverAt != c.deliverAt {
+			t.Error("Unexpected notification delivery", c.code, action, deliverAt)
+		}
+	}
+}
+
+func TestRuntimeRPCFormat(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("rpc-format.lua", `
+local nk = require("nakama")
+local function rewards(ctx, payload)
+	return { coins = 10 }
+end
+nk.register_rpc(rewards, "rewards")
+nk.register_rpc(rewards, "rewards_debug", "json_pretty")
+nk.register_rpc(rewards, "rewards_envelope")
+nk.register_rpc(function(ctx, payload)
+	local t = {}
+	t.self = t
+	return t
+end, "cyclic")
+nk.register_rpc_serialize(function(ctx, response)
+	assert(ctx.execution_mode == "rpc_serialize", "unexpected execution mode")
+	if response.id == "rewards_envelope" then
+		return "<reply>" .. response.payload .. "</reply>", "application/xml"
+	end
+	return nil
+end)
+	`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		id          string
+		result      string
+		contentType string
+	}{
+		{"rewards", `{"coins":10}`, "application/json"},
+		{"rewards_debug", "{\n  \"coins\": 10\n}", "application/json"},
+		{"rewards_envelope", `<reply>{"coins":10}</reply>`, "application/xml"},
+	} {
+		result, contentType, err := r.InvokeFunctionRPCWithFormat(r.GetRuntimeCallback(server.RPC, c.id), c.id, uuid.Nil, "", 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(result) != c.result || contentType != c.contentType {
+			t.Error("Unexpected RPC response", c.id, string(result), contentType)
+		}
+	}
+
+	// A table that contains itself is an error for the caller, not a crash.
+	if _, _, err = r.InvokeFunctionRPCWithFormat(r.GetRuntimeCallback(server.RPC, "cyclic"), "cyclic", uuid.Nil, "", 0, nil); err != server.ErrConversionDepth {
+		t.Error("Expected cyclic RPC response to be rejected", err)
+	}
+}
+
+func TestRuntimeMatchTimer(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("match-timer.lua", `
+local nk = require("nakama")
+
+local match = {}
+function match.match_init(ctx, params)
+	return {fired = ""}, 30
+end
+function match.match_loop(ctx, state, tick, messages)
+	return state
+end
+nk.register_match(match, "timer")
+
+local function arm(ctx, match_id)
+	nk.match_timer(match_id, 10, function(ctx, state)
+		state.fired = state.fired .. "a"
+		return state
+	end)
+	local cancelled = nk.match_timer(match_id, 10, function(ctx, state)
+		state.fired = state.fired .. "b"
+		return state
+	end)
+	assert(nk.match_timer_cancel(match_id, cancelled), "pending timer was not cancelled")
+	assert(not nk.match_timer_cancel(match_id, cancelled), "timer was cancelled twice")
+	return ""
+end
+nk.register_rpc(arm, "arm")
+`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matchID, err := r.CreateMatch("timer", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.InvokeFunctionRPC(r.GetRuntimeCallback(server.RPC, "arm"), uuid.Nil, "", 0, []byte(matchID)); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	fired, err := r.MatchState(matchID, func(vm *lua.LState, ctx *lua.LTable, state lua.LValue) (lua.LValue, interface{}, error) {
+		return nil, lua.LVAsString(state.(*lua.LTable).RawGetString("fired")), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fired != "a" {
+		t.Error("Expected only the timer left pending to fire", fired)
+	}
+
+	// Timers pending when the match ends never run.
+	ran := make(chan bool, 1)
+	if _, err = r.MatchTimer(matchID, 50*time.Millisecond, func(vm *lua.LState, ctx *lua.LTable, state lua.LValue) (lua.LValue, error) {
+		ran <- true
+		return nil, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	mh := r.MatchGet(matchID)
+	mh.Stop()
+	mh.Wait()
+	select {
+	case <-ran:
+		t.Error("Timer ran after the match ended")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, err = r.MatchTimerCancel(matchID, 1); err != server.ErrMatchNotFound {
+		t.Error("Expected timers of an ended match to be gone", err)
+	}
+}
+
+func TestRuntimeMatchTimerBusy(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeFile("match-timer-busy.lua", `
+local nk = require("nakama")
+
+local match = {}
+function match.match_init(ctx, params)
+	return {}, 30
+end
+function match.match_loop(ctx, state, tick, messages)
+	return state
+end
+nk.register_match(match, "timer_busy")
+`)
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matchID, err := r.CreateMatch("timer_busy", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keep the match goroutine busy while far more timers fire than the call queue holds, none of them are dropped.
+	count := 0
+	busy := make(chan struct{})
+	go r.MatchState(matchID, func(vm *lua.LState, ctx *lua.LTable, state lua.LValue) (lua.LValue, interface{}, error) {
+		close(busy)
+		time.Sleep(100 * time.Millisecond)
+		return nil, nil, nil
+	})
+	<-busy
+	for i := 0; i < 500; i++ {
+		if _, err = r.MatchTimer(matchID, time.Millisecond, func(vm *lua.LState, ctx *lua.LTable, state lua.LValue) (lua.LValue, error) {
+			count++
+			return nil, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	ran, err := r.MatchState(matchID, func(vm *lua.LState, ctx *lua.LTable, state lua.LValue) (lua.LValue, interface{}, error) {
+		return nil, count, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ran != 500 {
+		t.Error("Expected every fired timer to run", ran)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/gorilla/websocket"
+	"nakama/server"
+)
+
+func TestSessionCompressionSmallMessagesUncompressed(t *testing.T) {
+	sink := metrics.NewInmemSink(time.Minute, time.Minute)
+	config := metrics.DefaultConfig("")
+	config.EnableHostname = false
+	config.EnableRuntimeMetrics = false
+	metrics.NewGlobal(config, sink)
+
+	small := []byte("small")
+	large := bytes.Repeat([]byte("large"), 1000)
+	done := make(chan bool)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		conn, err := server.CompressionUpgrade(&websocket.Upgrader{EnableCompression: true}, w, r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		for _, payload := range [][]byte{small, large} {
+			if err = server.CompressionWriteMessage(conn, 256, payload); err != nil {
+				t.Error(err)
+			}
+		}
+	}))
+	defer ts.Close()
+
+	dialer := &websocket.Dialer{EnableCompression: true}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, expected := range [][]byte{small, large} {
+		_, payload, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(expected, payload) {
+			t.Error("Message did not match", len(expected), len(payload))
+		}
+	}
+	<-done
+
+	data := sink.Data()
+	interval := data[len(data)-1]
+	interval.RLock()
+	defer interval.RUnlock()
+	if c, ok := interval.Counters["session.compression.negotiated"]; !ok || c.Sum != 1 {
+		t.Error("Expected the negotiated compression to be counted", c)
+	}
+	// A frame header is all a small message adds on the wire, a large one shrinks.
+	uncompressed, ok := interval.Samples["session.write.uncompressed.wire_bytes"]
+	if !ok || uncompressed.Count != 1 || uncompressed.Sum < float64(len(small)) || uncompressed.Sum > float64(len(small)+2) {
+		t.Error("Expected the small message to be sent uncompressed", uncompressed)
+	}
+	compressed, ok := interval.Samples["session.write.compressed.wire_bytes"]
+	if !ok || compressed.Count != 1 || compressed.Sum >= float64(len(large)) {
+		t.Error("Expected the large message to be sent compressed", compressed)
+	}
+	if payloadBytes, ok := interval.Samples["session.write.compressed.payload_bytes"]; !ok || payloadBytes.Sum != float64(len(large)) {
+		t.Error("Expected the large message payload size to be recorded", payloadBytes)
+	}
+}
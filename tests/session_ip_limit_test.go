@@ -0,0 +1,88 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"go.uber.org/zap"
+	"nakama/server"
+)
+
+func TestSessionIPLimiter(t *testing.T) {
+	logger, _ := zap.NewDevelopment(zap.AddStacktrace(zap.ErrorLevel))
+	limiter := server.NewSessionIPLimiter(logger, 2, []string{"10.0.0.0/8", "192.168.1.1", "not-an-ip"})
+
+	for i := 0; i < 2; i++ {
+		if !limiter.Acquire("203.0.113.7") {
+			t.Fatal("Expected sessions under the limit to be allowed", i)
+		}
+	}
+	if limiter.Acquire("203.0.113.7") {
+		t.Error("Expected session over the limit to be rejected")
+	}
+	if !limiter.Acquire("203.0.113.8") {
+		t.Error("Expected other IPs to have their own limit")
+	}
+	limiter.Release("203.0.113.7")
+	if !limiter.Acquire("203.0.113.7") {
+		t.Error("Expected released session to free a place")
+	}
+
+	for _, ip := range []string{"10.1.2.3", "192.168.1.1"} {
+		for i := 0; i < 3; i++ {
+			if !limiter.Acquire(ip) {
+				t.Error("Expected exempt IP to be allowed over the limit", ip)
+			}
+		}
+	}
+}
+
+func TestSessionIPLimiterGauges(t *testing.T) {
+	sink := metrics.NewInmemSink(time.Minute, time.Minute)
+	config := metrics.DefaultConfig("")
+	config.EnableHostname = false
+	config.EnableRuntimeMetrics = false
+	metrics.NewGlobal(config, sink)
+
+	// Unlimited sessions publish no gauges.
+	unlimited := server.NewSessionIPLimiter(zap.NewNop(), 0, nil)
+	for i := 0; i < 10; i++ {
+		unlimited.Acquire("203.0.113.9")
+	}
+
+	limiter := server.NewSessionIPLimiter(zap.NewNop(), 4, nil)
+	limiter.Acquire("203.0.113.7")
+	limiter.Acquire("2001:db8::1")
+	for i := 0; i < 3; i++ {
+		limiter.Acquire("198.51.100.2")
+	}
+	limiter.Release("198.51.100.2")
+
+	data := sink.Data()
+	interval := data[len(data)-1]
+	interval.RLock()
+	defer interval.RUnlock()
+	for _, name := range []string{"session.ip.203_0_113_9.connections", "session.ip.203_0_113_7.connections", "session.ip.2001_db8__1.connections"} {
+		if _, ok := interval.Gauges[name]; ok {
+			t.Error("Expected no gauge for an IP far from the limit", name)
+		}
+	}
+	if g, ok := interval.Gauges["session.ip.198_51_100_2.connections"]; !ok || g != 2 {
+		t.Error("Expected a sanitized gauge for an IP near the limit, updated when it falls below", g)
+	}
+}
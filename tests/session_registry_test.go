@@ -0,0 +1,161 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+	"nakama/server"
+)
+
+func TestSessionRegistryRevokeConnected(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	logger, _ := zap.NewDevelopment(zap.AddStacktrace(zap.ErrorLevel))
+	tracker := server.NewTrackerService("nakama")
+	registry := server.NewSessionRegistry(logger, server.NewConfig(), db, tracker, server.NewMatchmakerService("nakama", server.NewMatchmakerConfig()))
+
+	userID := uuid.NewV4()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		registry.Add(userID, "alice", "en", "", time.Now().Add(time.Hour).Unix(), "token-"+userID.String(), "127.0.0.1", "", "", server.SESSION_DUPLICATE_ALLOW, conn, nil, nil)
+	}))
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var sessions []*server.SessionInfo
+	for i := 0; i < 100 && len(sessions) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		sessions = registry.ListUser(userID)
+	}
+	if len(sessions) != 1 {
+		t.Fatal("Expected the connected session to be listed", sessions)
+	}
+	if !registry.Revoke(sessions[0].ID) {
+		t.Fatal("Expected the connected session to be revoked")
+	}
+
+	// The revoked session is disconnected, and its token rejected.
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		if _, _, err = conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+	if netErr, ok := err.(interface{ Timeout() bool }); ok && netErr.Timeout() {
+		t.Error("Expected the revoked session to be disconnected")
+	}
+	if !registry.IsRevoked("token-"+userID.String(), userID, time.Now().Add(time.Hour).Unix()) {
+		t.Error("Expected the revoked token to be rejected")
+	}
+}
+
+func TestSessionRegistryDuplicatePolicy(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	logger, _ := zap.NewDevelopment(zap.AddStacktrace(zap.ErrorLevel))
+	tracker := server.NewTrackerService("nakama")
+	registry := server.NewSessionRegistry(logger, server.NewConfig(), db, tracker, server.NewMatchmakerService("nakama", server.NewMatchmakerConfig()))
+
+	userID := uuid.NewV4()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		registry.Add(userID, "alice", "en", "", time.Now().Add(time.Hour).Unix(), "token-"+userID.String(), "127.0.0.1", "", "", r.URL.Query().Get("policy"), conn, nil, nil)
+	}))
+	defer ts.Close()
+
+	dial := func(policy string) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"?policy="+policy, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	// closed waits for the server to close a connection, and returns the error it was closed with.
+	closed := func(conn *websocket.Conn) error {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				if netErr, ok := err.(interface{ Timeout() bool }); ok && netErr.Timeout() {
+					return nil
+				}
+				return err
+			}
+		}
+	}
+	waitSessions := func(count int) []*server.SessionInfo {
+		var sessions []*server.SessionInfo
+		for i := 0; i < 100; i++ {
+			if sessions = registry.ListUser(userID); len(sessions) == count {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return sessions
+	}
+
+	first := dial(server.SESSION_DUPLICATE_ALLOW)
+	defer first.Close()
+	if sessions := waitSessions(1); len(sessions) != 1 {
+		t.Fatal("Expected the first session to be listed", sessions)
+	}
+
+	// A rejected connection is closed, and the session already open is kept.
+	rejected := dial(server.SESSION_DUPLICATE_REJECT)
+	defer rejected.Close()
+	if err := closed(rejected); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Error("Expected the duplicate connection to be rejected", err)
+	}
+	if sessions := waitSessions(1); len(sessions) != 1 {
+		t.Error("Expected the first session to be kept", sessions)
+	}
+
+	// A kicking connection disconnects the session already open and takes its place.
+	kicking := dial(server.SESSION_DUPLICATE_KICK)
+	defer kicking.Close()
+	if err := closed(first); err == nil {
+		t.Error("Expected the first session to be kicked")
+	}
+	sessions := waitSessions(1)
+	if len(sessions) != 1 || registry.Get(sessions[0].ID) == nil {
+		t.Error("Expected only the kicking session to be listed", sessions)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"nakama/server"
+)
+
+func TestSessionSequenceOrder(t *testing.T) {
+	q := server.NewSessionSequence([]string{"StorageWrite"})
+
+	assert.True(t, q.Check("TopicMessageSend", 5), "first sequence was rejected")
+	q.Commit(5)
+	// Gaps are allowed, replays and reordering are not.
+	assert.True(t, q.Check("TopicMessageSend", 9), "higher sequence was rejected")
+	q.Commit(9)
+	assert.False(t, q.Check("TopicMessageSend", 9), "replayed sequence was accepted")
+	assert.False(t, q.Check("TopicMessageSend", 7), "lower sequence was accepted")
+	assert.Equal(t, int64(9), q.Last(), "last sequence did not match")
+}
+
+func TestSessionSequenceTypes(t *testing.T) {
+	q := server.NewSessionSequence([]string{"StorageWrite"})
+	q.Commit(3)
+
+	// Other message types may leave the sequence out, sequenced types must carry one.
+	assert.True(t, q.Check("TopicMessageSend", 0), "unsequenced message was rejected")
+	assert.False(t, q.Check("StorageWrite", 0), "sequenced type without a sequence was accepted")
+	assert.True(t, q.Check("StorageWrite", 4), "sequenced type with a sequence was rejected")
+	// A sequence on any message type is still checked.
+	assert.False(t, q.Check("TopicMessageSend", 2), "lower sequence was accepted")
+}
+
+func TestSessionSequenceRejectedNotConsumed(t *testing.T) {
+	q := server.NewSessionSequence(nil)
+	q.Commit(1)
+
+	// A message a before hook rejects is checked but never committed, so it may be sent again with the same sequence.
+	assert.True(t, q.Check("StorageWrite", 2), "sequence was rejected")
+	assert.True(t, q.Check("StorageWrite", 2), "sequence of rejected message was consumed")
+	assert.Equal(t, int64(1), q.Last(), "last sequence did not match")
+}
+
+func TestSessionSequenceResume(t *testing.T) {
+	r := server.NewSessionSequenceResumes()
+	now := int64(1000)
+
+	// The reconnecting session carries on from the closed one.
+	r.Keep("token", 7, now+60, now)
+	last, ok := r.Take("token", now+1)
+	assert.True(t, ok, "sequence was not kept")
+	q := server.NewSessionSequence(nil)
+	q.Commit(last)
+	assert.False(t, q.Check("StorageWrite", 7), "sequence from before reconnect was accepted")
+	assert.True(t, q.Check("StorageWrite", 8), "next sequence was rejected")
+
+	// Sequences are taken once.
+	_, ok = r.Take("token", now+1)
+	assert.False(t, ok, "sequence was taken twice")
+
+	// Expired tokens are dropped when other sessions close.
+	r.Keep("expiring", 3, now+10, now)
+	r.Keep("lasting", 4, now+100, now)
+	r.Keep("other", 5, now+100, now+20)
+	assert.Equal(t, 2, r.Len(), "expired token was not dropped")
+	_, ok = r.Take("expiring", now+20)
+	assert.False(t, ok, "expired sequence was resumed")
+	last, ok = r.Take("lasting", now+20)
+	assert.True(t, ok, "sequence was not kept")
+	assert.Equal(t, int64(4), last, "last sequence did not match")
+}